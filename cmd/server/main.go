@@ -1,12 +1,19 @@
 package main
 
 import (
+	"SE/internal/audit"
 	"SE/internal/auth"
+	"SE/internal/cache"
+	"SE/internal/drivemanager"
 	"SE/internal/filehandlers"
 	"SE/internal/fileprocessor"
 	"SE/internal/handlers"
+	"SE/internal/manifest"
+	"SE/internal/metrics"
 	"SE/internal/middleware"
+	"SE/internal/models"
 	"SE/internal/oauth"
+	"SE/internal/replication"
 	"SE/internal/store"
 	"context"
 	"encoding/json"
@@ -14,6 +21,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -48,51 +59,322 @@ func main() {
 		}
 	}()
 
+	// Initialize auth config
+	auth.InitAuthConfig()
+	if err := auth.BootstrapAdmins(ctx); err != nil {
+		log.Fatalf("bootstrap admins: %v", err)
+	}
+
 	// Initialize oauth config
 	oauth.InitOAuthConfig()
 
 	// Initialize file processor config
 	fileprocessor.InitFileConfig()
 
-	// Setup routes
+	// Initialize drive manager config
+	drivemanager.InitDriveConfig()
+
+	// Initialize the cache shared by replicas
+	cache.InitCacheConfig()
+
+	// Initialize the proxies client addresses are taken from
+	middleware.InitProxyConfig()
+
+	// Initialize rate limit config
+	middleware.InitRateLimitConfig()
+
+	// Initialize bandwidth limits
+	middleware.InitBandwidthConfig()
+
+	// Initialize request log format
+	middleware.InitLogConfig()
+
+	// Initialize metrics config
+	metrics.InitMetricsConfig()
+
+	// Initialize drive manifest config
+	manifest.InitManifestConfig()
+
+	// Initialize how many files are healed at once
+	replication.InitReplicationConfig()
+
+	// Initialize CORS allowed origins
+	middleware.InitCORSConfig()
+
+	// Initialize request body caps
+	middleware.InitBodyLimitConfig()
+
+	// Initialize the audit event queue
+	audit.InitAuditConfig()
+
+	// Initialize request timeouts
+	middleware.InitTimeoutConfig()
+
+	// Initialize response compression
+	middleware.InitCompressConfig()
+
+	// Initialize the sunset of the unversioned API routes
+	middleware.InitVersionConfig()
+
+	// Write audit events in the background, off the request path
+	auditCtx, stopAudit := context.WithCancel(context.Background())
+	defer stopAudit()
+	audit.Start(auditCtx)
+
+	// Reclaim abandoned upload sessions in the background
+	sweepCtx, stopSweeper := context.WithCancel(context.Background())
+	defer stopSweeper()
+	fileprocessor.StartSessionSweeper(sweepCtx)
+
+	// Retry webhook notifications that failed or were interrupted by a restart
+	fileprocessor.StartWebhookRetrier(sweepCtx)
+
+	// Process failed and interrupted uploads again until they run out of attempts
+	filehandlers.StartUploadRetrier(sweepCtx)
+
+	// Finalize sessions that weren't finalized in time, when FINALIZE_TIMEOUT_ACTION asks to
+	filehandlers.StartAutoFinalizer(sweepCtx)
+
+	// Enable disabled drive accounts again once they pass a probe after their cooldown
+	drivemanager.StartDriveProber(sweepCtx)
+
+	// Setup routes. Each group has its own CORS policy: authenticated API routes only allow
+	// CORS_ALLOWED_ORIGINS, public endpoints any origin and OAuth routes OAUTH_CORS_ALLOWED_ORIGINS.
+	// Only the API and OAuth routes allow credentials, when CORS_ALLOW_CREDENTIALS is set.
+	// Requests time out after REQUEST_TIMEOUT_SECONDS, transfers and routes going through every
+	// chunk of a file or drive after LONG_REQUEST_TIMEOUT_MINUTES.
 	mux := http.NewServeMux()
+	api := routeGroup{mux: mux, cors: middleware.CORS(middleware.APIOrigins(), middleware.AllowCredentials()), timeout: middleware.RequestTimeout()}
+	public := routeGroup{mux: mux, cors: middleware.CORS([]string{"*"}, false), timeout: middleware.RequestTimeout()}
+	oauthRoutes := routeGroup{mux: mux, cors: middleware.CORS(middleware.OAuthOrigins(), middleware.AllowCredentials()), timeout: middleware.RequestTimeout()}
 
 	// Health check route
-	mux.HandleFunc("/health", requireMethod("GET", healthCheckHandler))
+	public.HandleFunc("/health", "GET", healthCheckHandler)
 
 	// Authentication routes
-	mux.HandleFunc("/api/signup", requireMethod("POST", auth.SignupHandler))
-	mux.HandleFunc("/api/login", requireMethod("POST", auth.LoginHandler))
+	api.HandleFunc("/api/signup", "POST", middleware.RateLimit(middleware.LimitJSONBody(auth.SignupHandler)))
+	api.HandleFunc("/api/login", "POST", middleware.RateLimit(middleware.LimitJSONBody(auth.LoginHandler)))
+	api.HandleFunc("/api/auth/refresh", "POST", middleware.RateLimit(middleware.LimitJSONBody(auth.RefreshHandler)))
+	api.HandleFunc("/api/auth/forgot", "POST", middleware.RateLimit(middleware.LimitJSONBody(auth.ForgotPasswordHandler)))
+	api.HandleFunc("/api/auth/reset", "POST", middleware.RateLimit(middleware.LimitJSONBody(auth.ResetPasswordHandler)))
+	api.HandleFunc("/api/auth/revoke", "POST", auth.AuthMiddleware(middleware.RateLimit(middleware.LimitJSONBody(auth.RevokeHandler))))
+	api.HandleFunc("/api/auth/2fa/setup", "POST", auth.AuthMiddleware(middleware.RateLimit(middleware.LimitJSONBody(auth.SetupTwoFactorHandler))))
+	api.HandleFunc("/api/auth/2fa/enable", "POST", auth.AuthMiddleware(middleware.RateLimit(middleware.LimitJSONBody(auth.EnableTwoFactorHandler))))
+	api.HandleFunc("/api/auth/2fa/disable", "POST", auth.AuthMiddleware(middleware.RateLimit(middleware.LimitJSONBody(auth.DisableTwoFactorHandler))))
+	api.HandleFunc("/api/auth/2fa/verify", "POST", middleware.RateLimit(middleware.LimitJSONBody(auth.VerifyTwoFactorHandler)))
+	api.HandleFunc("/api/auth/google", "GET", middleware.RateLimit(auth.GoogleLoginHandler))
+	api.HandleFunc("/api/auth/google/reauth", "POST", auth.AuthMiddleware(middleware.RateLimit(auth.GoogleReauthHandler)))
+	api.HandleFunc("/api/auth/google/link", "POST", middleware.RateLimit(middleware.LimitJSONBody(auth.LinkGoogleHandler)))
+
+	// Account routes
+	api.HandleFunc("/api/account", "DELETE", auth.AuthMiddleware(middleware.RateLimit(middleware.LimitJSONBody(auth.DeleteAccountHandler))))
+	api.HandleFunc("/api/account/deletion", "GET", auth.AuthMiddleware(middleware.RateLimit(auth.GetAccountDeletionHandler)))
+	api.HandleFunc("/api/account/stats", "GET", auth.AuthMiddleware(middleware.RateLimit(filehandlers.StorageStatsHandler)))
+	api.HandleFunc("/api/account/audit", "GET", auth.AuthMiddleware(middleware.RateLimit(handlers.ListAuditEventsHandler)))
+	// Serves GET, PUT and DELETE
+	api.HandleFunc("/api/account/webhook", "GET PUT DELETE", auth.AuthMiddleware(middleware.RateLimit(middleware.LimitJSONBody(handlers.WebhookHandler))))
+	api.HandleFunc("/api/account/export", "GET POST", auth.AuthMiddleware(middleware.RateLimit(middleware.LimitJSONBody(filehandlers.ExportHandler))))
+	api.HandleFunc("/api/account/webhook/deliveries", "GET", auth.AuthMiddleware(middleware.RateLimit(handlers.ListWebhookDeliveriesHandler)))
+	api.WithTimeout(middleware.LongRequestTimeout()).HandleFunc("/api/account/manifest/export", "GET", auth.AuthMiddleware(middleware.RateLimit(handlers.ExportManifestHandler)))
+	// Backups can be far larger than other JSON bodies, capped by MANIFEST_IMPORT_MAX_MB
+	api.WithTimeout(middleware.LongRequestTimeout()).HandleFunc("/api/account/manifest/import", "POST", auth.AuthMiddleware(middleware.RateLimit(middleware.LimitBody(manifest.GetImportBodyLimit(), handlers.ImportManifestHandler))))
 
 	// Drive OAuth routes
-	mux.HandleFunc("/api/drive/link", auth.AuthMiddleware(requireMethod("GET", oauth.DriveLinkHandler)))
-	mux.HandleFunc("/api/drive/accounts", auth.AuthMiddleware(requireMethod("GET", handlers.ListDriveAccountsHandler)))
-	mux.HandleFunc("/api/drive/space", auth.AuthMiddleware(requireMethod("GET", filehandlers.GetDriveSpacesHandler)))
-
-	// File upload routes
-	mux.HandleFunc("/api/files/upload/initiate", auth.AuthMiddleware(requireMethod("POST", filehandlers.InitiateUploadHandler)))
-	mux.HandleFunc("/api/files/upload/chunk", auth.AuthMiddleware(requireMethod("POST", filehandlers.UploadChunkHandler)))
-	mux.HandleFunc("/api/files/upload/finalize", auth.AuthMiddleware(requireMethod("POST", filehandlers.FinalizeUploadHandler)))
-	mux.HandleFunc("/api/files/upload/status/", auth.AuthMiddleware(requireMethod("GET", filehandlers.GetUploadStatusHandler)))
-	mux.HandleFunc("/api/files/chunking/calculate", auth.AuthMiddleware(requireMethod("POST", filehandlers.CalculateChunkingHandler)))
-	mux.HandleFunc("/api/files/download-key/", auth.AuthMiddleware(requireMethod("GET", filehandlers.DownloadKeyFileHandler)))
+	api.HandleFunc("/api/drive/link", "GET", auth.AuthMiddleware(middleware.RateLimit(oauth.DriveLinkHandler)))
+	api.HandleFunc("/api/drive/link/s3", "POST", auth.AuthMiddleware(middleware.RateLimit(middleware.LimitJSONBody(handlers.LinkS3Handler))))
+	api.HandleFunc("/api/drive/link/webdav", "POST", auth.AuthMiddleware(middleware.RateLimit(middleware.LimitJSONBody(handlers.LinkWebDAVHandler))))
+	api.HandleFunc("/api/drive/accounts", "GET", auth.AuthMiddleware(middleware.RateLimit(handlers.ListDriveAccountsHandler)))
+	api.HandleFunc("/api/drive/accounts/priority", "PUT", auth.AuthMiddleware(middleware.RateLimit(middleware.LimitJSONBody(handlers.SetDriveAccountPriorityHandler))))
+	api.HandleFunc("/api/drive/accounts/{drive_id}", "DELETE", auth.AuthMiddleware(middleware.RateLimit(handlers.UnlinkDriveAccountHandler)))
+	api.HandleFunc("/api/drive/accounts/{drive_id}/test", "POST", auth.AuthMiddleware(middleware.RateLimit(handlers.TestDriveAccountHandler)))
+	api.HandleFunc("/api/drive/accounts/{drive_id}/enable", "POST", auth.AuthMiddleware(middleware.RateLimit(handlers.EnableDriveAccountHandler)))
+	api.WithTimeout(middleware.LongRequestTimeout()).HandleFunc("/api/drive/accounts/{drive_id}/manifest/rebuild", "POST", auth.AuthMiddleware(middleware.RateLimit(handlers.RebuildManifestHandler)))
+	api.HandleFunc("/api/drive/space", "GET", auth.AuthMiddleware(middleware.RateLimit(filehandlers.GetDriveSpacesHandler)))
+
+	// File upload routes. JSON bodies are capped at MAX_JSON_BODY_KB, chunk bodies at the session's chunk size
+	api.HandleFunc("/api/files/upload/initiate", "POST", auth.AuthMiddleware(middleware.RateLimit(middleware.LimitJSONBody(filehandlers.InitiateUploadHandler))))
+	api.WithTimeout(middleware.LongRequestTimeout()).HandleFunc("/api/files/upload/chunk", "POST", auth.AuthMiddleware(middleware.RateLimit(filehandlers.UploadChunkHandler)))
+	api.HandleFunc("/api/files/upload/from-url", "POST", auth.AuthMiddleware(middleware.RateLimit(middleware.LimitJSONBody(filehandlers.UploadFromURLHandler))))
+	api.HandleFunc("/api/files/upload/finalize", "POST", auth.AuthMiddleware(middleware.RateLimit(middleware.LimitJSONBody(filehandlers.FinalizeUploadHandler))))
+	api.HandleFunc("/api/files/upload/status/", "GET", auth.AuthMiddleware(middleware.RateLimit(filehandlers.GetUploadStatusHandler)))
+	api.HandleFunc("/api/files/upload/status/batch", "POST", auth.AuthMiddleware(middleware.RateLimit(middleware.LimitJSONBody(filehandlers.BatchUploadStatusHandler))))
+	// Event streams stay open until the upload ends
+	api.WithTimeout(0).HandleFunc("/api/files/upload/events/{session_id}", "GET", auth.AuthMiddleware(middleware.RateLimit(filehandlers.UploadEventsHandler)))
+	api.HandleFunc("/api/files/chunking/calculate", "POST", auth.AuthMiddleware(middleware.RateLimit(middleware.LimitJSONBody(filehandlers.CalculateChunkingHandler))))
+	api.HandleFunc("/api/files/download-key/", "GET", auth.AuthMiddleware(middleware.RateLimit(filehandlers.DownloadKeyFileHandler)))
+
+	// File download routes
+	api.WithTimeout(middleware.LongRequestTimeout()).HandleFunc("/api/files/download/", "GET", auth.AuthMiddleware(middleware.RateLimit(filehandlers.DownloadFileHandler)))
+
+	// Stored file management routes
+	api.WithTimeout(middleware.LongRequestTimeout()).HandleFunc("/api/files/reconcile", "POST", auth.AuthMiddleware(middleware.RateLimit(middleware.LimitJSONBody(filehandlers.ReconcileFilesHandler))))
+	api.HandleFunc("/api/files", "GET", auth.AuthMiddleware(middleware.RateLimit(filehandlers.ListFilesHandler)))
+	// Serves /api/files/{file_id}/meta, /share, /tags, /chunks, /proof, /thumbnail, /verify, /restore, /update, /append and /rekey (admin),
+	// each action with its own timeout
+	api.WithTimeout(0).HandleFuncMethods("/api/files/", filehandlers.FileActionMethods, auth.AuthMiddleware(middleware.RateLimit(middleware.LimitJSONBody(filehandlers.FileActionHandler))))
+	api.WithTimeout(middleware.LongRequestTimeout()).HandleFunc("/api/files/delete", "POST", auth.AuthMiddleware(middleware.RateLimit(middleware.LimitJSONBody(filehandlers.BulkDeleteFilesHandler))))
+	api.HandleFunc("/api/files/{file_id}", "DELETE", auth.AuthMiddleware(middleware.RateLimit(filehandlers.DeleteFileHandler)))
+
+	// Share link routes, downloading a shared file needs no account
+	api.HandleFunc("/api/shares/{share_id}", "DELETE", auth.AuthMiddleware(middleware.RateLimit(filehandlers.RevokeShareLinkHandler)))
+	public.WithTimeout(middleware.LongRequestTimeout()).HandleFunc("/api/shared/{token}", "GET", middleware.RateLimit(filehandlers.SharedDownloadHandler))
+
+	// Admin routes
+	api.HandleFunc("/api/admin/users/{user_id}/quota", "PUT", auth.AuthMiddleware(middleware.RateLimit(middleware.RequireRole(models.RoleAdmin, middleware.LimitJSONBody(handlers.SetUserQuotaHandler)))))
+	api.HandleFunc("/api/admin/users/{user_id}/bandwidth", "PUT", auth.AuthMiddleware(middleware.RateLimit(middleware.RequireRole(models.RoleAdmin, middleware.LimitJSONBody(handlers.SetUserBandwidthHandler)))))
+	api.HandleFunc("/api/admin/auth/keys", "GET", auth.AuthMiddleware(middleware.RateLimit(middleware.RequireRole(models.RoleAdmin, auth.ListSigningKeysHandler))))
+	api.HandleFunc("/api/admin/users/{user_id}/role", "PUT", auth.AuthMiddleware(middleware.RateLimit(middleware.RequireRole(models.RoleAdmin, middleware.LimitJSONBody(handlers.SetUserRoleHandler)))))
+	api.HandleFunc("/api/admin/users/{user_id}/rekey", "POST", auth.AuthMiddleware(middleware.RateLimit(middleware.RequireRole(models.RoleAdmin, middleware.LimitJSONBody(handlers.StartUserRekeyHandler)))))
+	api.HandleFunc("/api/admin/users/{user_id}/rekey/status", "GET", auth.AuthMiddleware(middleware.RateLimit(middleware.RequireRole(models.RoleAdmin, handlers.GetUserRekeyHandler))))
+	api.HandleFunc("/api/admin/drives/{drive_id}/manifest/versions", "GET", auth.AuthMiddleware(middleware.RateLimit(middleware.RequireRole(models.RoleAdmin, handlers.ListManifestVersionsHandler))))
+	api.WithTimeout(middleware.LongRequestTimeout()).HandleFunc("/api/admin/drives/{drive_id}/manifest/restore", "POST", auth.AuthMiddleware(middleware.RateLimit(middleware.RequireRole(models.RoleAdmin, middleware.LimitJSONBody(handlers.RestoreManifestHandler)))))
+	api.WithTimeout(middleware.LongRequestTimeout()).HandleFunc("/api/admin/files/{file_id}/rebalance", "POST", auth.AuthMiddleware(middleware.RateLimit(middleware.RequireRole(models.RoleAdmin, middleware.LimitJSONBody(handlers.RebalanceFileHandler)))))
+	api.HandleFunc("/api/admin/downloads", "GET", auth.AuthMiddleware(middleware.RateLimit(middleware.RequireRole(models.RoleAdmin, handlers.ListDownloadSessionsHandler))))
+	api.HandleFunc("/api/admin/downloads/{id}", "DELETE", auth.AuthMiddleware(middleware.RateLimit(middleware.RequireRole(models.RoleAdmin, handlers.DeleteDownloadSessionHandler))))
 
 	// OAuth callback (no auth header; state validated via DB)
-	mux.HandleFunc("/oauth2/callback", requireMethod("GET", oauth.OauthCallbackHandler))
+	oauthRoutes.HandleFunc("/oauth2/callback", "GET", middleware.RateLimit(oauth.OauthCallbackHandler))
+	oauthRoutes.HandleFunc("/oauth2/login/callback", "GET", middleware.RateLimit(auth.GoogleLoginCallbackHandler))
 
 	// OAuth completion page
-	mux.HandleFunc("/oauth/finished", func(w http.ResponseWriter, r *http.Request) {
+	oauthRoutes.HandleFunc("/oauth/finished", "GET", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
 		w.Write([]byte("<h1>OAuth flow completed</h1><p>You can close this window and return to the application.</p>"))
 	})
 
+	// Prometheus metrics, on their own listener when METRICS_ADDR is set
+	var metricsSrv *http.Server
+	if metrics.Enabled() {
+		registerSessionGauges()
+		if metrics.Addr() != "" {
+			metricsMux := http.NewServeMux()
+			metricsMux.Handle("/metrics", metrics.Handler())
+			metricsSrv = &http.Server{Addr: metrics.Addr(), Handler: metricsMux}
+			go func() {
+				if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					log.Printf("metrics server: %v", err)
+				}
+			}()
+			fmt.Printf("Serving metrics on %s\n", metrics.Addr())
+		} else {
+			mux.Handle("/metrics", metrics.Handler())
+		}
+	}
+
+	// How long a shutdown waits for requests and upload processing to finish
+	graceSecs, _ := strconv.Atoi(os.Getenv("SHUTDOWN_GRACE_SECONDS"))
+	if graceSecs == 0 {
+		graceSecs = 30
+	}
+	grace := time.Duration(graceSecs) * time.Second
+
 	addr := ":8080"
 	fmt.Printf("Starting server on %s\n", addr)
-	// Apply middlewares: CORS (allow all for now) then Logger
-	handler := middleware.CORS([]string{"*"})(mux)
-	if err := http.ListenAndServe(addr, middleware.Logger(handler)); err != nil {
-		log.Fatalf("server: %v", err)
+	// Apply middlewares: Versioning, serving /api/v1/ with the routes registered under /api/, then Logger, which logs the path as requested, then Compress so logged bodies stay readable, then RequestID outermost so every log line has the ID. CORS is set per route group.
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: middleware.RequestID(middleware.Compress(middleware.Logger(middleware.Versioning(mux)))),
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-serverErr:
+		// Returning instead of log.Fatalf so the store still disconnects
+		log.Printf("server: %v", err)
+		return
+	case sig := <-stop:
+		log.Printf("Received %s, shutting down (grace period %s)", sig, grace)
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), grace)
+	defer cancelShutdown()
+
+	// Stop accepting connections and wait for active requests
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Requests still active after grace period: %v", err)
+		srv.Close()
+	}
+	if metricsSrv != nil {
+		metricsSrv.Close()
+	}
+
+	// Uploads still processing when the grace period ends are left resumable
+	if pending := fileprocessor.WaitForProcessing(shutdownCtx); len(pending) > 0 {
+		log.Printf("Marking %d upload sessions incomplete", len(pending))
+		markCtx, cancelMark := context.WithTimeout(context.Background(), 5*time.Second)
+		fileprocessor.MarkSessionsIncomplete(markCtx, pending)
+		cancelMark()
 	}
+
+	// Events still queued are written before the store disconnects
+	stopAudit()
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	audit.Wait(flushCtx)
+	cancelFlush()
+	log.Printf("Server stopped")
+}
+
+// routeGroup registers routes sharing one CORS policy and request timeout
+type routeGroup struct {
+	mux     *http.ServeMux
+	cors    func(http.Handler) http.Handler
+	timeout time.Duration
+}
+
+// WithTimeout returns the group with requests timing out after d instead, 0 for never
+func (g routeGroup) WithTimeout(d time.Duration) routeGroup {
+	g.timeout = d
+	return g
+}
+
+// HandleFunc registers h for the pattern, serving only the methods listed, e.g. "GET PUT"
+func (g routeGroup) HandleFunc(pattern, methods string, h http.HandlerFunc) {
+	allowed := strings.Fields(methods)
+	g.HandleFuncMethods(pattern, func(*http.Request) []string { return allowed }, h)
+}
+
+// HandleFuncMethods registers h for the pattern, serving the methods returned for the request.
+// GET routes answer HEAD too, net/http drops the body. Other methods get a 405, and OPTIONS
+// requests a 204, both listing the served methods in the Allow header, and a CORS preflight
+// in Access-Control-Allow-Methods too. Requests no methods are returned for are left to h.
+// Requests asking in Accept-Version for an API version that isn't served get a 406.
+func (g routeGroup) HandleFuncMethods(pattern string, methods func(*http.Request) []string, h http.HandlerFunc) {
+	h = middleware.Timeout(g.timeout, h)
+	g.mux.Handle(pattern, g.cors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed := methods(r)
+		switch {
+		case allowed == nil:
+		case r.Method == http.MethodOptions:
+			middleware.WriteOptions(w, r, allowed...)
+			return
+		case !middleware.MethodAllowed(allowed, r.Method):
+			middleware.WriteMethodNotAllowed(w, allowed...)
+			return
+		}
+		if !middleware.CheckAcceptVersion(w, r) {
+			return
+		}
+		h(w, r)
+	})))
+}
+
+// registerSessionGauges exposes the number of active upload and download sessions
+func registerSessionGauges() {
+	metrics.RegisterGaugeFunc("vcrypt_active_upload_sessions", "Unexpired upload sessions that are uploading or processing.", func(ctx context.Context) (float64, error) {
+		n, err := store.CountActiveSessions(ctx)
+		return float64(n), err
+	})
+	metrics.RegisterGaugeFunc("vcrypt_active_download_sessions", "Unexpired download sessions still reconstructing their file.", func(ctx context.Context) (float64, error) {
+		n, err := store.CountActiveDownloadSessions(ctx)
+		return float64(n), err
+	})
 }
 
 func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
@@ -106,14 +388,4 @@ func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func requireMethod(verb string, h http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != verb {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		h(w, r)
-	}
-}
-
  
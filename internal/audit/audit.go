@@ -0,0 +1,119 @@
+package audit
+
+import (
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// How long writing one event may take
+const writeTimeout = 5 * time.Second
+
+var (
+	events  chan *models.AuditEvent
+	stopped chan struct{}
+)
+
+// InitAuditConfig reads the audit settings from the environment
+func InitAuditConfig() {
+	// Events waiting to be written. Once the queue is full new events are dropped rather than
+	// holding up the request that caused them.
+	size, _ := strconv.Atoi(os.Getenv("AUDIT_QUEUE_SIZE"))
+	if size <= 0 {
+		size = 1024
+	}
+	events = make(chan *models.AuditEvent, size)
+}
+
+// Start writes queued events in the background until ctx is done, then writes the events still
+// queued and returns
+func Start(ctx context.Context) {
+	if events == nil {
+		InitAuditConfig()
+	}
+	stopped = make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case event := <-events:
+				write(event)
+			case <-ctx.Done():
+				for {
+					select {
+					case event := <-events:
+						write(event)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Wait waits for the writer to finish after its context is done, or for ctx
+func Wait(ctx context.Context) {
+	if stopped == nil {
+		return
+	}
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+	}
+}
+
+func write(event *models.AuditEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+	if err := store.InsertAuditEvent(ctx, event); err != nil {
+		log.Printf("[%s] Failed to write audit event %s of user %s: %v", event.RequestID, event.Type, event.UserID.Hex(), err)
+	}
+}
+
+// Record queues an event of the user caused by r. It never blocks.
+func Record(r *http.Request, userID primitive.ObjectID, eventType string, details map[string]string) {
+	enqueue(&models.AuditEvent{
+		UserID:    userID,
+		Type:      eventType,
+		IP:        middleware.ClientIP(r),
+		RequestID: middleware.GetRequestID(r.Context()),
+		Details:   details,
+		CreatedAt: time.Now().UTC(),
+	})
+}
+
+// RecordContext queues an event of the user from background work of a request, taking the
+// request ID and client IP from ctx. It never blocks.
+func RecordContext(ctx context.Context, userID primitive.ObjectID, eventType string, details map[string]string) {
+	ip, _ := ctx.Value("clientIP").(string)
+	enqueue(&models.AuditEvent{
+		UserID:    userID,
+		Type:      eventType,
+		IP:        ip,
+		RequestID: middleware.GetRequestID(ctx),
+		Details:   details,
+		CreatedAt: time.Now().UTC(),
+	})
+}
+
+// WithClientIP returns ctx carrying the client IP of r, used to hand it to background work
+func WithClientIP(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, "clientIP", middleware.ClientIP(r))
+}
+
+func enqueue(event *models.AuditEvent) {
+	select {
+	case events <- event:
+	default:
+		log.Printf("[%s] Audit queue full, dropping event %s of user %s", event.RequestID, event.Type, event.UserID.Hex())
+	}
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"SE/internal/audit"
+	"SE/internal/fileprocessor"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// typ claim of the token confirming an account deletion
+	accountDeletionTokenType = "account_deletion"
+	// How long after asking the deletion can be confirmed
+	accountDeletionTokenTTL = 10 * time.Minute
+)
+
+type accountDeletionReq struct {
+	ConfirmationToken string `json:"confirmation_token"`
+	Password          string `json:"password"`
+	ReauthToken       string `json:"reauth_token"` // In place of the password for users who have none
+	Code              string `json:"code"`         // TOTP or recovery code, when two-factor authentication is enabled
+	Force             bool   `json:"force"`        // Remove the user even though something couldn't be deleted
+}
+
+// DELETE /api/account
+// deletes the user's account with everything stored for it. Without a confirmation_token the
+// response hands one out along with what will be deleted; the deletion starts once that token
+// comes back with the password, and the second factor of users who have one enabled. Users
+// without a password give the second factor alone, or else a reauth token. It runs in the
+// background, GET /api/account/deletion reports its progress.
+func DeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var req accountDeletionReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		middleware.WriteDecodeError(w, err, "bad request")
+		return
+	}
+
+	u, err := store.FindUserByID(r.Context(), userID)
+	if err != nil || u == nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+
+	if req.ConfirmationToken == "" {
+		writeAccountDeletionChallenge(w, r, u)
+		return
+	}
+
+	tokenUserID, _, err := parseTypedToken(req.ConfirmationToken, accountDeletionTokenType)
+	if err != nil || tokenUserID != userID {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeInvalidToken, "invalid or expired confirmation token")
+		return
+	}
+	if !checkIdentity(u, req.Password, req.ReauthToken) {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeInvalidCredentials, "invalid credentials")
+		return
+	}
+	if u.TwoFactor != nil && u.TwoFactor.Enabled {
+		ok, err := checkSecondFactor(r.Context(), u, req.Code)
+		if err != nil {
+			writeSecondFactorError(w, err)
+			return
+		}
+		if !ok {
+			middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeInvalidCode, "invalid code")
+			return
+		}
+	}
+
+	// The deletion outlives the request, its audit event references it
+	ctx := middleware.WithRequestID(context.Background(), middleware.GetRequestID(r.Context()))
+	ctx = audit.WithClientIP(ctx, r)
+	job, err := fileprocessor.StartAccountDeletion(ctx, userID, req.Force)
+	if err != nil {
+		log.Printf("Failed to start account deletion for user %s: %v", userID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to start account deletion")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// writeAccountDeletionChallenge hands out the token confirming the deletion of the user's
+// account, with what is stored for it
+func writeAccountDeletionChallenge(w http.ResponseWriter, r *http.Request, u *models.User) {
+	files, err := store.ListUserFiles(r.Context(), u.ID, "", nil, true)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	token, err := signTypedToken(u.ID, accountDeletionTokenType, accountDeletionTokenTTL)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "token gen failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"confirmation_required": true,
+		"confirmation_token":    token,
+		"expires_in":            int(accountDeletionTokenTTL.Seconds()),
+		"files":                 len(files),
+		"drive_accounts":        len(u.DriveAccounts),
+		"two_factor_required":   u.TwoFactor != nil && u.TwoFactor.Enabled,
+		"password_required":     len(u.PasswordsHash) > 0,
+	})
+}
+
+// GET /api/account/deletion
+// reports the user's latest account deletion
+func GetAccountDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	job, err := fileprocessor.GetAccountDeletionJob(r.Context(), userID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if job == nil {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "no account deletion")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
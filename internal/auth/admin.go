@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"log"
+	"strings"
+)
+
+// emails given the admin role, from ADMIN_EMAILS
+var adminEmails map[string]bool
+
+func loadAdminEmails(list string) map[string]bool {
+	emails := make(map[string]bool)
+	for _, e := range strings.Split(list, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e != "" {
+			emails[e] = true
+		}
+	}
+	return emails
+}
+
+// BootstrapAdmins gives the admin role to the existing accounts listed in ADMIN_EMAILS, so
+// there is an admin to grant roles to everyone else. Listed emails that sign up later are
+// made admins at signup.
+func BootstrapAdmins(ctx context.Context) error {
+	emails := make([]string, 0, len(adminEmails))
+	for e := range adminEmails {
+		emails = append(emails, e)
+	}
+	promoted, err := store.PromoteUsersToAdmin(ctx, emails)
+	if err != nil {
+		return err
+	}
+	if promoted > 0 {
+		log.Printf("Gave the admin role to %d ADMIN_EMAILS accounts", promoted)
+	}
+	return nil
+}
+
+// roleForEmail returns the role a new account with the email starts with
+func roleForEmail(email string) string {
+	if adminEmails[strings.ToLower(email)] {
+		return models.RoleAdmin
+	}
+	return models.RoleUser
+}
+
+// userRole returns the user's role, accounts made before roles existed are users
+func userRole(u *models.User) string {
+	if u.Role == "" {
+		return models.RoleUser
+	}
+	return u.Role
+}
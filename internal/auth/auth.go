@@ -1,14 +1,18 @@
 package auth
 
 import (
+	"SE/internal/audit"
+	"SE/internal/middleware"
 	"SE/internal/models"
 	"SE/internal/store"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,7 +21,59 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-var jwtSecret = []byte(os.Getenv("JWT_SECRET"))
+var (
+	accessTokenTTL   time.Duration
+	refreshTokenTTL  time.Duration
+	passwordResetTTL time.Duration
+	passwordResetURL string
+)
+
+func InitAuthConfig() {
+	initSigningKeys()
+
+	// Lifetime of the access JWT
+	accessMins, _ := strconv.Atoi(os.Getenv("ACCESS_TOKEN_TTL_MINUTES"))
+	if accessMins == 0 {
+		accessMins = 24 * 60 // 24 hours
+	}
+	accessTokenTTL = time.Duration(accessMins) * time.Minute
+
+	// Lifetime of the refresh token used to get new access tokens
+	refreshHours, _ := strconv.Atoi(os.Getenv("REFRESH_TOKEN_TTL_HOURS"))
+	if refreshHours == 0 {
+		refreshHours = 30 * 24 // 30 days
+	}
+	refreshTokenTTL = time.Duration(refreshHours) * time.Hour
+
+	initPasswordConfig()
+
+	initTwoFactorConfig()
+
+	initGoogleLoginConfig()
+
+	// Comma separated list of emails given the admin role
+	adminEmails = loadAdminEmails(os.Getenv("ADMIN_EMAILS"))
+
+	// How long a password reset link stays valid
+	resetMins, _ := strconv.Atoi(os.Getenv("PASSWORD_RESET_TTL_MINUTES"))
+	if resetMins == 0 {
+		resetMins = 30
+	}
+	passwordResetTTL = time.Duration(resetMins) * time.Minute
+
+	// Frontend page that takes the reset token, it is appended as ?token=
+	passwordResetURL = os.Getenv("PASSWORD_RESET_URL")
+	if passwordResetURL == "" {
+		passwordResetURL = "http://localhost:3000/reset-password"
+	}
+
+	// Reset links are emailed when an SMTP relay is configured, logged otherwise
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		SetResetSender(newSMTPResetSender(addr, os.Getenv("SMTP_FROM"), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD")))
+	} else {
+		log.Printf("SMTP_ADDR not set, password reset links will be written to the log")
+	}
+}
 
 type loginReq struct {
 	Email    string `json:"email"`
@@ -25,51 +81,53 @@ type loginReq struct {
 }
 
 type loginResp struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
 }
 
 func SignupHandler(w http.ResponseWriter, r *http.Request) {
 	var req loginReq
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "bad request", http.StatusBadRequest)
+		middleware.WriteDecodeError(w, err, "bad request")
 		return
 	}
 
 	// Validate input
 	if req.Email == "" || req.Password == "" {
-		http.Error(w, "email and password required", http.StatusBadRequest)
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "email and password required")
 		return
 	}
-	if len(req.Password) < 6 {
-		http.Error(w, "password must be at least 6 characters", http.StatusBadRequest)
+	if !requireStrongPassword(w, req.Password) {
 		return
 	}
 
 	ctx := r.Context()
 	existing, err := store.FindUserByEmail(ctx, req.Email)
 	if err != nil {
-		http.Error(w, "server error", http.StatusInternalServerError)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
 		return
 	}
 	if existing != nil {
-		http.Error(w, "email exists", http.StatusBadRequest)
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeEmailExists, "email exists")
 		return
 	}
 
-	passHash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	passHash, err := hashPassword(req.Password)
 	if err != nil {
-		http.Error(w, "server error", http.StatusInternalServerError)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
 		return
 	}
 
+	email := strings.ToLower(strings.TrimSpace(req.Email))
 	u := &models.User{
-		Email:         strings.ToLower(strings.TrimSpace(req.Email)),
+		Email:         email,
 		PasswordsHash: passHash,
 		DriveAccounts: []models.DriveAccount{},
+		Role:          roleForEmail(email),
 	}
 
 	if err := store.CreateUser(ctx, u); err != nil {
-		http.Error(w, "create user failed", http.StatusInternalServerError)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "create user failed")
 		return
 	}
 
@@ -81,63 +139,104 @@ func SignupHandler(w http.ResponseWriter, r *http.Request) {
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	var req loginReq
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "bad request", http.StatusBadRequest)
+		middleware.WriteDecodeError(w, err, "bad request")
 		return
 	}
 
 	ctx := r.Context()
 	u, err := store.FindUserByEmail(ctx, strings.ToLower(strings.TrimSpace(req.Email)))
 	if err != nil {
-		http.Error(w, "server error", http.StatusInternalServerError)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
 		return
 	}
 	if u == nil {
-		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeInvalidCredentials, "invalid credentials")
 		return
 	}
 
 	if err := bcrypt.CompareHashAndPassword(u.PasswordsHash, []byte(req.Password)); err != nil {
-		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		audit.Record(r, u.ID, models.AuditLoginFailure, nil)
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeInvalidCredentials, "invalid credentials")
+		return
+	}
+
+	// Hashes made before BCRYPT_COST changed are upgraded while the password is at hand
+	if needsRehash(u.PasswordsHash) {
+		if passHash, err := hashPassword(req.Password); err == nil {
+			if err := store.UpdateUserPassword(ctx, u.ID, passHash); err != nil {
+				log.Printf("Failed to rehash password of user %s: %v", u.ID.Hex(), err)
+			}
+		}
+	}
+
+	// The tokens wait for the second factor, see VerifyTwoFactorHandler
+	if u.TwoFactor != nil && u.TwoFactor.Enabled {
+		writeTwoFactorChallenge(w, u)
 		return
 	}
 
-	tokenString, err := generateJWT(u.ID.Hex())
+	writeLoginTokens(w, r, u)
+}
+
+// writeLoginTokens answers a successful login with new access and refresh tokens
+func writeLoginTokens(w http.ResponseWriter, r *http.Request, u *models.User) {
+	resp, err := issueLoginTokens(r, u)
 	if err != nil {
-		http.Error(w, "token gen failed", http.StatusInternalServerError)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "token gen failed")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(loginResp{Token: tokenString})
+	json.NewEncoder(w).Encode(resp)
+}
+
+// issueLoginTokens issues the access and refresh tokens of a successful login
+func issueLoginTokens(r *http.Request, u *models.User) (loginResp, error) {
+	tokenString, err := generateJWT(u.ID.Hex(), userRole(u))
+	if err != nil {
+		return loginResp{}, err
+	}
+
+	refreshToken, err := issueRefreshToken(r.Context(), u.ID)
+	if err != nil {
+		return loginResp{}, err
+	}
+	audit.Record(r, u.ID, models.AuditLoginSuccess, nil)
+	return loginResp{Token: tokenString, RefreshToken: refreshToken}, nil
 }
 
-func generateJWT(userID string) (string, error) {
+func generateJWT(userID, role string) (string, error) {
 	claims := jwt.MapClaims{
-		"sub": userID,
-		"exp": time.Now().Add(24 * time.Hour).Unix(), // 24 hours instead of 15 minutes
-		"iat": time.Now().Unix(),
+		"sub":  userID,
+		"role": role,
+		"exp":  time.Now().Add(accessTokenTTL).Unix(),
+		"iat":  time.Now().Unix(),
 	}
-	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return t.SignedString(jwtSecret)
+	return signToken(claims)
 }
 
-// parse and validate JWT, return userID
-func parseJWT(tokenStr string) (string, error) {
-	tkn, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-		if t.Method != jwt.SigningMethodHS256 {
-			return nil, errors.New("unexpected signing method")
-		}
-		return jwtSecret, nil
-	})
+// parse and validate JWT, return userID, role and issued-at time
+func parseJWT(tokenStr string) (string, string, int64, error) {
+	tkn, err := jwt.Parse(tokenStr, verificationKey)
 	if err != nil || !tkn.Valid {
-		return "", errors.New("invalid token")
+		return "", "", 0, errors.New("invalid token")
 	}
 	if claims, ok := tkn.Claims.(jwt.MapClaims); ok {
+		// Pre-auth and confirmation tokens carry a typ, access tokens none
+		if _, ok := claims["typ"]; ok {
+			return "", "", 0, errors.New("not an access token")
+		}
 		if sub, ok := claims["sub"].(string); ok {
-			return sub, nil
+			iat, _ := claims["iat"].(float64)
+			// Tokens issued before roles existed carry none
+			role, _ := claims["role"].(string)
+			if role == "" {
+				role = models.RoleUser
+			}
+			return sub, role, int64(iat), nil
 		}
 	}
-	return "", errors.New("invalid claims")
+	return "", "", 0, errors.New("invalid claims")
 }
 
 // middleware that extracts bearer token and sets user id context
@@ -145,7 +244,7 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		h := r.Header.Get("Authorization")
 		if h == "" {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, "unauthorized")
 			return
 		}
 
@@ -153,24 +252,36 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		var tok string
 		_, err := fmt.Sscanf(h, "Bearer %s", &tok)
 		if err != nil || tok == "" {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, "unauthorized")
 			return
 		}
 
-		uid, err := parseJWT(tok)
+		uid, role, issuedAt, err := parseJWT(tok)
 		if err != nil {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, "unauthorized")
 			return
 		}
 
 		oid, err := primitive.ObjectIDFromHex(uid)
 		if err != nil {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, "unauthorized")
+			return
+		}
+
+		// reject tokens issued before the user's last revocation
+		revocation, err := store.GetTokenRevocation(r.Context(), oid)
+		if err != nil {
+			middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+			return
+		}
+		if revocation != nil && issuedAt < revocation.RevokedBefore.Unix() {
+			middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, "unauthorized")
 			return
 		}
 
 		// add to context
 		ctx := context.WithValue(r.Context(), "userID", oid)
+		ctx = context.WithValue(ctx, "role", role)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
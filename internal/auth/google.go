@@ -0,0 +1,364 @@
+package auth
+
+import (
+	"SE/internal/audit"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/oauth"
+	"SE/internal/store"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const googleUserInfoURL = "https://openidconnect.googleapis.com/v1/userinfo"
+
+// Signing in with Google asks only for the user's identity, never for their Drive, which is
+// granted separately through /api/drive/link
+var googleLoginConf *oauth2.Config
+
+// Frontend page a Google sign-in is handed to, the tokens in its fragment. Empty answers the
+// callback with JSON like /api/login.
+var googleLoginRedirectURL string
+
+// errGoogleAccountTaken is a Google sign-in with the email of a user who signs in with another
+// Google account
+var errGoogleAccountTaken = errors.New("the account with this email signs in with another Google account")
+
+// errGoogleLinkRequired is a first Google sign-in with the email of a user who signs in with a
+// password. Signing up never proved the email was theirs, so the password has to confirm the
+// link, see LinkGoogleHandler.
+var errGoogleLinkRequired = errors.New("confirm linking the Google account with the account's password")
+
+// typ claim of the token a Google sign-in hands out for confirming the link of its account
+const googleLinkTokenType = "google-link"
+
+func initGoogleLoginConfig() {
+	baseURL := strings.TrimSuffix(os.Getenv("BASE_URL"), "/")
+	googleLoginConf = &oauth2.Config{
+		ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
+		ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
+		Endpoint:     google.Endpoint,
+		Scopes:       []string{"openid", "email", "profile"},
+		RedirectURL:  baseURL + "/oauth2/login/callback",
+	}
+	googleLoginRedirectURL = os.Getenv("GOOGLE_LOGIN_REDIRECT_URL")
+}
+
+// googleUserInfo is the part of Google's OpenID Connect userinfo a sign-in uses
+type googleUserInfo struct {
+	Sub           string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// GET /api/auth/google
+// returns JSON { auth_url: ... }
+func GoogleLoginHandler(w http.ResponseWriter, r *http.Request) {
+	state, err := oauth.NewState(r.Context(), primitive.NilObjectID, models.OAuthPurposeLogin)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+
+	url := googleLoginConf.AuthCodeURL(state, oauth2.SetAuthURLParam("prompt", "select_account"))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"auth_url": url})
+}
+
+// GET /oauth2/login/callback?state=...&code=...
+func GoogleLoginCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	stored, code := oauth.ConsumeState(w, r, models.OAuthPurposeLogin)
+	if stored == nil {
+		return
+	}
+
+	tok, err := googleLoginConf.Exchange(r.Context(), code)
+	if err != nil {
+		log.Printf("Google sign-in token exchange failed: %v", err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeOAuthFailed, "token exchange failed")
+		return
+	}
+
+	info, err := fetchGoogleUserInfo(r.Context(), tok)
+	if err != nil {
+		log.Printf("Failed to get Google user info: %v", err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeOAuthFailed, "failed to get Google account")
+		return
+	}
+	// Only an address Google verified proves the user owns the account it matches
+	if !info.EmailVerified {
+		middleware.WriteJSONError(w, http.StatusForbidden, middleware.ErrCodeEmailUnverified, "Google account email is not verified")
+		return
+	}
+
+	// A signed in user proving it's still them, see GoogleReauthHandler
+	if !stored.UserID.IsZero() {
+		if err := store.DeleteOAuthState(r.Context(), stored.State); err != nil {
+			log.Printf("Failed to delete OAuth state %s: %v", stored.State, err)
+		}
+		writeReauthToken(w, r, stored.UserID, info, tok)
+		return
+	}
+
+	u, err := googleUser(r, info)
+	linkRequired := errors.Is(err, errGoogleLinkRequired)
+	if linkRequired {
+		err = nil
+	}
+	if errors.Is(err, errGoogleAccountTaken) {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Google sign-in of %s failed: %v", info.Email, err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+
+	// The state is used up, the sweeper would remove it anyway
+	if err := store.DeleteOAuthState(r.Context(), stored.State); err != nil {
+		log.Printf("Failed to delete OAuth state %s: %v", stored.State, err)
+	}
+
+	// Signing in with Google replaces the password, not the second factor
+	var resp interface{}
+	fragment := url.Values{}
+	if linkRequired {
+		challenge, err := googleLinkChallenge(u, info.Sub)
+		if err != nil {
+			middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "token gen failed")
+			return
+		}
+		resp = challenge
+		fragment.Set("google_link_required", "true")
+		fragment.Set("link_token", challenge.LinkToken)
+		fragment.Set("expires_in", strconv.Itoa(challenge.ExpiresIn))
+	} else if u.TwoFactor != nil && u.TwoFactor.Enabled {
+		challenge, err := twoFactorChallenge(u)
+		if err != nil {
+			middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "token gen failed")
+			return
+		}
+		resp = challenge
+		fragment.Set("two_factor_required", "true")
+		fragment.Set("two_factor_token", challenge.TwoFactorToken)
+		fragment.Set("expires_in", strconv.Itoa(challenge.ExpiresIn))
+	} else {
+		tokens, err := issueLoginTokens(r, u)
+		if err != nil {
+			middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "token gen failed")
+			return
+		}
+		resp = tokens
+		fragment.Set("token", tokens.Token)
+		fragment.Set("refresh_token", tokens.RefreshToken)
+	}
+
+	// A fragment never reaches the frontend's server or its logs
+	if googleLoginRedirectURL != "" {
+		http.Redirect(w, r, googleLoginRedirectURL+"#"+fragment.Encode(), http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// fetchGoogleUserInfo reads the identity of the Google account the token was granted by
+func fetchGoogleUserInfo(ctx context.Context, tok *oauth2.Token) (*googleUserInfo, error) {
+	resp, err := googleLoginConf.Client(ctx, tok).Get(googleUserInfoURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("userinfo returned %d: %s", resp.StatusCode, body)
+	}
+
+	var info googleUserInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("failed to parse userinfo: %w", err)
+	}
+	if info.Sub == "" || info.Email == "" {
+		return nil, errors.New("userinfo has no subject or email")
+	}
+	return &info, nil
+}
+
+// googleUser returns the user signing in with the Google account: the one linked to it, else
+// the one with its email, who is linked to it from now on, else a new user without a password.
+// A user with the email and a password is returned with errGoogleLinkRequired, unlinked.
+func googleUser(r *http.Request, info *googleUserInfo) (*models.User, error) {
+	ctx := r.Context()
+	u, err := store.FindUserByGoogleID(ctx, info.Sub)
+	if err != nil || u != nil {
+		return u, err
+	}
+
+	email := strings.ToLower(strings.TrimSpace(info.Email))
+	u, err = store.FindUserByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if u != nil {
+		if u.GoogleID != "" {
+			return nil, errGoogleAccountTaken
+		}
+		if len(u.PasswordsHash) > 0 {
+			return u, errGoogleLinkRequired
+		}
+		if err := linkGoogleAccount(r, u, info.Sub); err != nil {
+			return nil, err
+		}
+		return u, nil
+	}
+
+	u = &models.User{
+		Email:         email,
+		DriveAccounts: []models.DriveAccount{},
+		Role:          roleForEmail(email),
+		GoogleID:      info.Sub,
+	}
+	if err := store.CreateUser(ctx, u); err != nil {
+		return nil, err
+	}
+	audit.Record(r, u.ID, models.AuditGoogleLinked, map[string]string{"email": email})
+	return u, nil
+}
+
+// linkGoogleAccount links the user to the Google account from now on
+func linkGoogleAccount(r *http.Request, u *models.User, sub string) error {
+	linked, err := store.LinkGoogleAccount(r.Context(), u.ID, sub)
+	if err != nil {
+		return err
+	}
+	// Another sign-in linked a Google account in the meantime
+	if !linked {
+		return errGoogleAccountTaken
+	}
+	u.GoogleID = sub
+	audit.Record(r, u.ID, models.AuditGoogleLinked, map[string]string{"email": u.Email})
+	return nil
+}
+
+type googleLinkResp struct {
+	GoogleLinkRequired bool   `json:"google_link_required"`
+	LinkToken          string `json:"link_token"`
+	ExpiresIn          int    `json:"expires_in"` // Seconds
+}
+
+type googleLinkReq struct {
+	LinkToken string `json:"link_token"`
+	Password  string `json:"password"`
+}
+
+// googleLinkChallenge issues the challenge of a Google sign-in waiting for the password of the
+// user with its email. It names the Google account, so only that one can be linked with it.
+func googleLinkChallenge(u *models.User, sub string) (googleLinkResp, error) {
+	now := time.Now()
+	token, err := signToken(jwt.MapClaims{
+		"sub":        u.ID.Hex(),
+		"typ":        googleLinkTokenType,
+		"google_sub": sub,
+		"exp":        now.Add(twoFactorTokenTTL).Unix(),
+		"iat":        now.Unix(),
+	})
+	if err != nil {
+		return googleLinkResp{}, err
+	}
+	return googleLinkResp{
+		GoogleLinkRequired: true,
+		LinkToken:          token,
+		ExpiresIn:          int(twoFactorTokenTTL.Seconds()),
+	}, nil
+}
+
+// POST /api/auth/google/link
+// links the Google account of a sign-in to the user with its email, given the link token the
+// callback returned and the user's password, and completes the sign-in like /api/login
+func LinkGoogleHandler(w http.ResponseWriter, r *http.Request) {
+	var req googleLinkReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.LinkToken == "" || req.Password == "" {
+		middleware.WriteDecodeError(w, err, "link_token and password required")
+		return
+	}
+
+	userID, sub, err := parseGoogleLinkToken(req.LinkToken)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeInvalidToken, "invalid or expired link token")
+		return
+	}
+	u, err := store.FindUserByID(r.Context(), userID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if u == nil {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeInvalidToken, "invalid or expired link token")
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword(u.PasswordsHash, []byte(req.Password)); err != nil {
+		audit.Record(r, u.ID, models.AuditLoginFailure, map[string]string{"factor": "google_link"})
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeInvalidCredentials, "invalid credentials")
+		return
+	}
+	if u.GoogleID != sub {
+		if u.GoogleID != "" {
+			middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, errGoogleAccountTaken.Error())
+			return
+		}
+		err := linkGoogleAccount(r, u, sub)
+		if errors.Is(err, errGoogleAccountTaken) {
+			middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("Linking a Google account to user %s failed: %v", u.ID.Hex(), err)
+			middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+			return
+		}
+	}
+
+	if u.TwoFactor != nil && u.TwoFactor.Enabled {
+		writeTwoFactorChallenge(w, u)
+		return
+	}
+	writeLoginTokens(w, r, u)
+}
+
+// parseGoogleLinkToken validates a token googleLinkChallenge issued, returning its user and
+// Google account
+func parseGoogleLinkToken(tokenStr string) (primitive.ObjectID, string, error) {
+	tkn, err := jwt.Parse(tokenStr, verificationKey)
+	if err != nil || !tkn.Valid {
+		return primitive.NilObjectID, "", errors.New("invalid token")
+	}
+	claims, ok := tkn.Claims.(jwt.MapClaims)
+	if !ok || claims["typ"] != googleLinkTokenType {
+		return primitive.NilObjectID, "", errors.New("invalid claims")
+	}
+	sub, _ := claims["sub"].(string)
+	userID, err := primitive.ObjectIDFromHex(sub)
+	googleSub, _ := claims["google_sub"].(string)
+	if err != nil || googleSub == "" {
+		return primitive.NilObjectID, "", errors.New("invalid claims")
+	}
+	return userID, googleSub, nil
+}
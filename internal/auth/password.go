@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"SE/internal/middleware"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	bcryptCost        int
+	passwordMinLength int
+)
+
+// Passwords rejected whatever rules they meet, compared case-insensitively
+var commonPasswords = map[string]bool{
+	"password": true, "password1": true, "password123": true, "passw0rd": true, "p@ssw0rd": true,
+	"123456": true, "12345678": true, "123456789": true, "1234567890": true, "qwerty": true,
+	"qwerty123": true, "qwertyuiop": true, "abc123": true, "abcd1234": true, "111111": true,
+	"123123": true, "letmein": true, "welcome": true, "welcome1": true, "welcome123": true,
+	"iloveyou": true, "admin": true, "admin123": true, "administrator": true, "login": true,
+	"monkey": true, "dragon": true, "football": true, "baseball": true, "sunshine": true,
+	"princess": true, "master": true, "shadow": true, "superman": true, "trustno1": true,
+	"starwars": true, "changeme": true, "secret": true, "default": true, "zaq12wsx": true,
+	"1qaz2wsx": true, "q1w2e3r4": true, "asdfghjkl": true, "michael": true, "jennifer": true,
+}
+
+// initPasswordConfig reads BCRYPT_COST (default bcrypt.DefaultCost) and PASSWORD_MIN_LENGTH (default 8)
+func initPasswordConfig() {
+	bcryptCost, _ = strconv.Atoi(os.Getenv("BCRYPT_COST"))
+	if bcryptCost == 0 {
+		bcryptCost = bcrypt.DefaultCost
+	}
+	if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+		log.Printf("BCRYPT_COST %d out of range %d-%d, using %d", bcryptCost, bcrypt.MinCost, bcrypt.MaxCost, bcrypt.DefaultCost)
+		bcryptCost = bcrypt.DefaultCost
+	}
+
+	passwordMinLength, _ = strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH"))
+	if passwordMinLength == 0 {
+		passwordMinLength = 8
+	}
+}
+
+func hashPassword(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+}
+
+// needsRehash reports whether a hash was made with another cost than the configured one
+func needsRehash(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err == nil && cost != bcryptCost
+}
+
+// passwordRule is a strength rule a password failed
+type passwordRule struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// checkPasswordStrength returns the rules the password fails, none for a strong enough one
+func checkPasswordStrength(password string) []passwordRule {
+	failed := []passwordRule{}
+	if len([]rune(password)) < passwordMinLength {
+		failed = append(failed, passwordRule{"min_length", "must be at least " + strconv.Itoa(passwordMinLength) + " characters"})
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if !lower {
+		failed = append(failed, passwordRule{"lowercase", "must contain a lowercase letter"})
+	}
+	if !upper {
+		failed = append(failed, passwordRule{"uppercase", "must contain an uppercase letter"})
+	}
+	if !digit && !symbol {
+		failed = append(failed, passwordRule{"digit_or_symbol", "must contain a digit or a symbol"})
+	}
+	if commonPasswords[strings.ToLower(password)] {
+		failed = append(failed, passwordRule{"common", "is too common"})
+	}
+	return failed
+}
+
+// requireStrongPassword writes a 400 listing the failed rules when the password is too weak
+func requireStrongPassword(w http.ResponseWriter, password string) bool {
+	failed := checkPasswordStrength(password)
+	if len(failed) == 0 {
+		return true
+	}
+	middleware.WriteJSONErrorDetails(w, http.StatusBadRequest, middleware.ErrCodeWeakPassword, "password too weak", map[string]interface{}{
+		"failed_rules": failed,
+	})
+	return false
+}
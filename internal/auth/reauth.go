@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/oauth"
+	"SE/internal/store"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// typ claim of the token a fresh Google sign-in of a signed in user hands out, taken in place
+	// of the password by users who have none
+	reauthTokenType = "reauth"
+
+	// How long before the callback the Google sign-in may have happened to count as fresh
+	reauthMaxAge = 5 * time.Minute
+)
+
+type reauthResp struct {
+	ReauthToken string `json:"reauth_token"`
+	ExpiresIn   int    `json:"expires_in"` // Seconds
+}
+
+// POST /api/auth/google/reauth
+// returns JSON { auth_url: ... } of a Google sign-in proving it's still the user, for users who
+// sign in with Google and have no password to give for disabling two-factor authentication or
+// deleting their account
+func GoogleReauthHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	u, err := store.FindUserByID(r.Context(), userID)
+	if err != nil || u == nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if u.GoogleID == "" {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "the account doesn't sign in with Google")
+		return
+	}
+
+	// The state names the user, which tells the callback it's a re-authentication
+	state, err := oauth.NewState(r.Context(), userID, models.OAuthPurposeLogin)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	url := googleLoginConf.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("prompt", "select_account"),
+		oauth2.SetAuthURLParam("max_age", "0"),
+		oauth2.SetAuthURLParam("login_hint", u.Email))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"auth_url": url})
+}
+
+// writeReauthToken answers the callback of a re-authentication of the user, with the token
+// confirming it when the Google account is theirs and was just signed in to
+func writeReauthToken(w http.ResponseWriter, r *http.Request, userID primitive.ObjectID, info *googleUserInfo, tok *oauth2.Token) {
+	u, err := store.FindUserByID(r.Context(), userID)
+	if err != nil || u == nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if u.GoogleID == "" || u.GoogleID != info.Sub {
+		middleware.WriteJSONError(w, http.StatusForbidden, middleware.ErrCodeForbidden, "signed in with another Google account")
+		return
+	}
+	authTime, err := googleAuthTime(tok)
+	if err != nil || time.Since(authTime) > reauthMaxAge {
+		middleware.WriteJSONError(w, http.StatusForbidden, middleware.ErrCodeForbidden, "the Google sign-in isn't fresh, start again")
+		return
+	}
+
+	token, err := signTypedToken(u.ID, reauthTokenType, twoFactorTokenTTL)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "token gen failed")
+		return
+	}
+	resp := reauthResp{ReauthToken: token, ExpiresIn: int(twoFactorTokenTTL.Seconds())}
+
+	if googleLoginRedirectURL != "" {
+		fragment := url.Values{}
+		fragment.Set("reauth_token", resp.ReauthToken)
+		fragment.Set("expires_in", strconv.Itoa(resp.ExpiresIn))
+		http.Redirect(w, r, googleLoginRedirectURL+"#"+fragment.Encode(), http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// googleAuthTime reads when the user last signed in to Google from the ID token of the
+// exchange. It came straight from Google's token endpoint over TLS, so its signature needn't be
+// checked (OpenID Connect Core 3.1.3.7).
+func googleAuthTime(tok *oauth2.Token) (time.Time, error) {
+	idToken, _ := tok.Extra("id_token").(string)
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return time.Time{}, errors.New("no id token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, err
+	}
+	var claims struct {
+		AuthTime int64 `json:"auth_time"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, err
+	}
+	if claims.AuthTime == 0 {
+		return time.Time{}, errors.New("id token has no auth_time")
+	}
+	return time.Unix(claims.AuthTime, 0), nil
+}
+
+// checkIdentity reports whether the user proved it's them again for a sensitive change: with
+// their password, or, users without one who sign in with Google only, with the reauth token of
+// a fresh Google sign-in. Users without a password who have a second factor may give it alone,
+// the caller checks it, so passing nothing here.
+func checkIdentity(u *models.User, password, reauthToken string) bool {
+	if len(u.PasswordsHash) > 0 {
+		return bcrypt.CompareHashAndPassword(u.PasswordsHash, []byte(password)) == nil
+	}
+	if reauthToken != "" {
+		userID, _, err := parseTypedToken(reauthToken, reauthTokenType)
+		return err == nil && userID == u.ID
+	}
+	return u.TwoFactor != nil && u.TwoFactor.Enabled
+}
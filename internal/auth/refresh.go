@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type refreshReq struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// POST /api/auth/refresh
+// exchanges a refresh token for a new access token and a rotated refresh token
+func RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	var req refreshReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		middleware.WriteDecodeError(w, err, "bad request")
+		return
+	}
+
+	ctx := r.Context()
+	stored, err := store.FindRefreshTokenByHash(ctx, hashToken(req.RefreshToken))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if stored == nil || time.Now().After(stored.ExpiresAt) {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeInvalidToken, "invalid refresh token")
+		return
+	}
+
+	// A rotated token showing up again means it leaked, so kill the whole chain
+	if stored.RevokedAt != nil {
+		revokeAllTokens(ctx, stored.UserID)
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeInvalidToken, "invalid refresh token")
+		return
+	}
+
+	refreshToken, newToken, err := newRefreshToken(stored.UserID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "token gen failed")
+		return
+	}
+
+	// Rotate before issuing so two concurrent refreshes can't both succeed
+	rotated, err := store.RotateRefreshToken(ctx, stored.ID, newToken.ID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if !rotated {
+		revokeAllTokens(ctx, stored.UserID)
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeInvalidToken, "invalid refresh token")
+		return
+	}
+
+	if err := store.InsertRefreshToken(ctx, newToken); err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+
+	// The role is read again so a changed role reaches the next access token
+	u, err := store.FindUserByID(ctx, stored.UserID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if u == nil {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeInvalidToken, "invalid refresh token")
+		return
+	}
+
+	tokenString, err := generateJWT(stored.UserID.Hex(), userRole(u))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "token gen failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(loginResp{Token: tokenString, RefreshToken: refreshToken})
+}
+
+// POST /api/auth/revoke
+// revokes every refresh token and access token issued to the authenticated user
+func RevokeHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	if err := revokeAllTokens(r.Context(), userID); err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "tokens revoked"})
+}
+
+// revokeAllTokens adds the user to the revocation list and revokes their refresh tokens
+func revokeAllTokens(ctx context.Context, userID primitive.ObjectID) error {
+	if err := store.SetTokensRevokedBefore(ctx, userID, time.Now().UTC().Truncate(time.Second)); err != nil {
+		log.Printf("Failed to revoke access tokens for user %s: %v", userID.Hex(), err)
+		return err
+	}
+	if err := store.RevokeUserRefreshTokens(ctx, userID); err != nil {
+		log.Printf("Failed to revoke refresh tokens for user %s: %v", userID.Hex(), err)
+		return err
+	}
+	return nil
+}
+
+// issueRefreshToken creates and stores a new refresh token for the user
+func issueRefreshToken(ctx context.Context, userID primitive.ObjectID) (string, error) {
+	refreshToken, record, err := newRefreshToken(userID)
+	if err != nil {
+		return "", err
+	}
+	if err := store.InsertRefreshToken(ctx, record); err != nil {
+		return "", err
+	}
+	return refreshToken, nil
+}
+
+// newRefreshToken generates a random token and the record that stores its hash
+func newRefreshToken(userID primitive.ObjectID) (string, *models.RefreshToken, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token := hex.EncodeToString(b)
+
+	record := &models.RefreshToken{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().UTC().Add(refreshTokenTTL),
+	}
+	return token, record, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
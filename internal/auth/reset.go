@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ResetSender delivers password reset links to users
+type ResetSender interface {
+	SendPasswordReset(ctx context.Context, email, link string) error
+}
+
+var resetSender ResetSender = logResetSender{}
+
+// SetResetSender replaces the sender used by the forgot password endpoint
+func SetResetSender(s ResetSender) {
+	resetSender = s
+}
+
+// logResetSender writes reset links to the server log, for development without SMTP
+type logResetSender struct{}
+
+func (logResetSender) SendPasswordReset(ctx context.Context, email, link string) error {
+	log.Printf("Password reset link for %s: %s", email, link)
+	return nil
+}
+
+// smtpResetSender emails reset links through an SMTP relay
+type smtpResetSender struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func newSMTPResetSender(addr, from, username, password string) smtpResetSender {
+	s := smtpResetSender{addr: addr, from: from}
+	if username != "" {
+		host := addr
+		if i := strings.LastIndex(addr, ":"); i >= 0 {
+			host = addr[:i]
+		}
+		s.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return s
+}
+
+func (s smtpResetSender) SendPasswordReset(ctx context.Context, email, link string) error {
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: Reset your password\r\n\r\n"+
+		"Someone asked to reset the password of your account.\r\n"+
+		"Open this link within %d minutes to choose a new one:\r\n\r\n%s\r\n\r\n"+
+		"If it wasn't you, ignore this email.\r\n",
+		s.from, email, int(passwordResetTTL.Minutes()), link)
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{email}, []byte(msg))
+}
+
+type forgotReq struct {
+	Email string `json:"email"`
+}
+
+type resetReq struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// POST /api/auth/forgot
+// emails a reset link if the email belongs to a user. The response never says whether it does.
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req forgotReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		middleware.WriteDecodeError(w, err, "bad request")
+		return
+	}
+
+	// Lookup and delivery run in the background so timing doesn't reveal registered emails
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	go sendPasswordReset(context.Background(), email)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "if the email is registered, a reset link has been sent"})
+}
+
+// sendPasswordReset issues a reset token for the user with email and sends its link
+func sendPasswordReset(ctx context.Context, email string) {
+	u, err := store.FindUserByEmail(ctx, email)
+	if err != nil {
+		log.Printf("Failed to look up user for password reset: %v", err)
+		return
+	}
+	if u == nil {
+		return
+	}
+
+	token, record, err := newPasswordResetToken(u.ID)
+	if err != nil {
+		log.Printf("Failed to generate password reset token for user %s: %v", u.ID.Hex(), err)
+		return
+	}
+	if err := store.InsertPasswordResetToken(ctx, record); err != nil {
+		log.Printf("Failed to store password reset token for user %s: %v", u.ID.Hex(), err)
+		return
+	}
+
+	if err := resetSender.SendPasswordReset(ctx, u.Email, resetLink(token)); err != nil {
+		log.Printf("Failed to send password reset to user %s: %v", u.ID.Hex(), err)
+	}
+}
+
+// POST /api/auth/reset
+// sets a new password with a reset token, then revokes every token of the user
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req resetReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		middleware.WriteDecodeError(w, err, "bad request")
+		return
+	}
+	if !requireStrongPassword(w, req.Password) {
+		return
+	}
+
+	ctx := r.Context()
+	stored, err := store.FindPasswordResetByHash(ctx, hashToken(req.Token))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if stored == nil || stored.UsedAt != nil || time.Now().After(stored.ExpiresAt) {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidToken, "invalid or expired reset token")
+		return
+	}
+
+	// Consume before updating so two concurrent resets can't both succeed
+	consumed, err := store.ConsumePasswordResetToken(ctx, stored.ID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if !consumed {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidToken, "invalid or expired reset token")
+		return
+	}
+
+	passHash, err := hashPassword(req.Password)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if err := store.UpdateUserPassword(ctx, stored.UserID, passHash); err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+
+	// Other reset links and sessions opened with the old password stop working
+	if err := store.ConsumeUserPasswordResets(ctx, stored.UserID); err != nil {
+		log.Printf("Failed to consume password resets for user %s: %v", stored.UserID.Hex(), err)
+	}
+	if err := revokeAllTokens(ctx, stored.UserID); err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "password updated"})
+}
+
+// newPasswordResetToken generates a random token and the record that stores its hash
+func newPasswordResetToken(userID primitive.ObjectID) (string, *models.PasswordResetToken, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token := hex.EncodeToString(b)
+
+	record := &models.PasswordResetToken{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().UTC().Add(passwordResetTTL),
+	}
+	return token, record, nil
+}
+
+// resetLink appends the token to PASSWORD_RESET_URL
+func resetLink(token string) string {
+	sep := "?"
+	if strings.Contains(passwordResetURL, "?") {
+		sep = "&"
+	}
+	return passwordResetURL + sep + "token=" + url.QueryEscape(token)
+}
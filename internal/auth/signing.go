@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key ID of the key tokens issued without a kid were signed with, JWT_SECRET before key IDs
+const defaultKeyID = "default"
+
+// signingKey is a key tokens are verified with, and for the current key signed with
+type signingKey struct {
+	id        string
+	method    jwt.SigningMethod
+	sign      interface{} // []byte for HS256, *rsa.PrivateKey for RS256, nil for a previous key
+	verify    interface{} // []byte for HS256, *rsa.PublicKey for RS256
+	retiresAt time.Time   // Zero for the current key
+}
+
+var (
+	currentKey *signingKey
+	// Every key tokens are accepted from, the current one included, by key ID
+	verificationKeys map[string]*signingKey
+)
+
+// previousKeyConfig is an entry of JWT_PREVIOUS_KEYS, with secret for an HS256 key or
+// public_key_file for an RS256 one
+type previousKeyConfig struct {
+	KeyID         string    `json:"kid"`
+	Secret        string    `json:"secret"`
+	PublicKeyFile string    `json:"public_key_file"`
+	RetireAt      time.Time `json:"retire_at"`
+}
+
+// initSigningKeys reads the current key from JWT_ALGORITHM, JWT_KEY_ID and JWT_SECRET or
+// JWT_PRIVATE_KEY_FILE, and the keys it replaced from JWT_PREVIOUS_KEYS
+func initSigningKeys() {
+	keyID := os.Getenv("JWT_KEY_ID")
+	if keyID == "" {
+		keyID = defaultKeyID
+	}
+
+	currentKey = &signingKey{id: keyID}
+	switch alg := os.Getenv("JWT_ALGORITHM"); alg {
+	case "", "HS256":
+		secret := []byte(os.Getenv("JWT_SECRET"))
+		currentKey.method, currentKey.sign, currentKey.verify = jwt.SigningMethodHS256, secret, secret
+	case "RS256":
+		path := os.Getenv("JWT_PRIVATE_KEY_FILE")
+		if path == "" {
+			log.Fatalf("JWT_ALGORITHM=RS256 needs JWT_PRIVATE_KEY_FILE")
+		}
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Failed to read JWT_PRIVATE_KEY_FILE: %v", err)
+		}
+		priv, err := jwt.ParseRSAPrivateKeyFromPEM(raw)
+		if err != nil {
+			log.Fatalf("JWT_PRIVATE_KEY_FILE must be a PEM RSA private key: %v", err)
+		}
+		currentKey.method, currentKey.sign, currentKey.verify = jwt.SigningMethodRS256, priv, &priv.PublicKey
+	default:
+		log.Fatalf("JWT_ALGORITHM must be HS256 or RS256, got %q", alg)
+	}
+	verificationKeys = map[string]*signingKey{keyID: currentKey}
+
+	if raw := os.Getenv("JWT_PREVIOUS_KEYS"); raw != "" {
+		var previous []previousKeyConfig
+		if err := json.Unmarshal([]byte(raw), &previous); err != nil {
+			log.Fatalf("JWT_PREVIOUS_KEYS must be a JSON array of keys: %v", err)
+		}
+		for _, cfg := range previous {
+			key, err := loadPreviousKey(cfg)
+			if err != nil {
+				log.Fatalf("JWT_PREVIOUS_KEYS: %v", err)
+			}
+			if _, ok := verificationKeys[key.id]; ok {
+				log.Fatalf("JWT_PREVIOUS_KEYS: key ID %q is used twice", key.id)
+			}
+			verificationKeys[key.id] = key
+		}
+	}
+
+	log.Printf("Signing tokens with %s key %q, accepting keys %v", currentKey.method.Alg(), currentKey.id, activeKeyIDs())
+}
+
+func loadPreviousKey(cfg previousKeyConfig) (*signingKey, error) {
+	if cfg.KeyID == "" {
+		return nil, errors.New("every key needs a kid")
+	}
+	if cfg.RetireAt.IsZero() {
+		return nil, fmt.Errorf("key %q needs a retire_at", cfg.KeyID)
+	}
+	key := &signingKey{id: cfg.KeyID, retiresAt: cfg.RetireAt}
+	switch {
+	case cfg.Secret != "" && cfg.PublicKeyFile == "":
+		key.method, key.verify = jwt.SigningMethodHS256, []byte(cfg.Secret)
+	case cfg.PublicKeyFile != "" && cfg.Secret == "":
+		raw, err := os.ReadFile(cfg.PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", cfg.KeyID, err)
+		}
+		pub, err := jwt.ParseRSAPublicKeyFromPEM(raw)
+		if err != nil {
+			return nil, fmt.Errorf("key %q must be a PEM RSA public key: %w", cfg.KeyID, err)
+		}
+		key.method, key.verify = jwt.SigningMethodRS256, pub
+	default:
+		return nil, fmt.Errorf("key %q needs either a secret or a public_key_file", cfg.KeyID)
+	}
+	return key, nil
+}
+
+// signToken signs claims with the current key, naming it in the kid header
+func signToken(claims jwt.MapClaims) (string, error) {
+	t := jwt.NewWithClaims(currentKey.method, claims)
+	t.Header["kid"] = currentKey.id
+	return t.SignedString(currentKey.sign)
+}
+
+// verificationKey is the jwt.Keyfunc of every token: it picks the key by the token's kid,
+// refusing keys past their retire_at and tokens of another algorithm than their key's
+func verificationKey(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		kid = defaultKeyID
+	}
+	key, ok := verificationKeys[kid]
+	if !ok {
+		return nil, errors.New("unknown signing key")
+	}
+	if !key.retiresAt.IsZero() && !time.Now().Before(key.retiresAt) {
+		return nil, errors.New("signing key is retired")
+	}
+	if t.Method.Alg() != key.method.Alg() {
+		return nil, errors.New("unexpected signing method")
+	}
+	return key.verify, nil
+}
+
+// activeKeyIDs returns the IDs of the keys tokens are accepted from, the current one first
+func activeKeyIDs() []string {
+	keys := activeKeys()
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = key.id
+	}
+	return ids
+}
+
+// activeKeys returns the keys not retired yet, the current one first and the others by the
+// time they retire
+func activeKeys() []*signingKey {
+	now := time.Now()
+	keys := make([]*signingKey, 0, len(verificationKeys))
+	for _, key := range verificationKeys {
+		if key.retiresAt.IsZero() || now.Before(key.retiresAt) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].retiresAt.IsZero() != keys[j].retiresAt.IsZero() {
+			return keys[i].retiresAt.IsZero()
+		}
+		return keys[i].retiresAt.Before(keys[j].retiresAt)
+	})
+	return keys
+}
+
+type signingKeyInfo struct {
+	KeyID     string     `json:"kid"`
+	Algorithm string     `json:"algorithm"`
+	Current   bool       `json:"current"`
+	RetiresAt *time.Time `json:"retires_at,omitempty"`
+}
+
+// GET /api/admin/auth/keys
+// Lists the keys tokens are accepted from, without their material
+func ListSigningKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys := activeKeys()
+	out := make([]signingKeyInfo, 0, len(keys))
+	for _, key := range keys {
+		info := signingKeyInfo{KeyID: key.id, Algorithm: key.method.Alg(), Current: key == currentKey}
+		if !key.retiresAt.IsZero() {
+			retiresAt := key.retiresAt
+			info.RetiresAt = &retiresAt
+		}
+		out = append(out, info)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": out})
+}
@@ -0,0 +1,457 @@
+package auth
+
+import (
+	"SE/internal/audit"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/oauth"
+	"SE/internal/store"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	totpPeriod    = 30 // Seconds per TOTP time step
+	totpDigits    = 6
+	totpSkew      = 1 // Time steps either side of now whose codes are accepted, for clock drift
+	totpSecretLen = 20
+
+	recoveryCodeCount = 10
+
+	// typ claim of the pre-auth token LoginHandler hands out, which isn't an access token
+	twoFactorTokenType = "2fa"
+)
+
+var (
+	twoFactorTokenTTL time.Duration
+	twoFactorIssuer   string
+)
+
+// TOTP secrets are shown in unpadded base32 as authenticator apps expect, recovery codes too
+// but in lowercase
+var codeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func initTwoFactorConfig() {
+	// How long after the password the second factor can be given
+	ttlMins, _ := strconv.Atoi(os.Getenv("TWO_FACTOR_TOKEN_TTL_MINUTES"))
+	if ttlMins <= 0 {
+		ttlMins = 5
+	}
+	twoFactorTokenTTL = time.Duration(ttlMins) * time.Minute
+
+	// Name authenticator apps show the account under
+	twoFactorIssuer = os.Getenv("TWO_FACTOR_ISSUER")
+	if twoFactorIssuer == "" {
+		twoFactorIssuer = "2xpfm"
+	}
+}
+
+type twoFactorCodeReq struct {
+	Code string `json:"code"`
+}
+
+type twoFactorDisableReq struct {
+	Password    string `json:"password"`
+	ReauthToken string `json:"reauth_token"` // In place of the password for users who have none
+	Code        string `json:"code"`
+}
+
+type twoFactorVerifyReq struct {
+	TwoFactorToken string `json:"two_factor_token"`
+	Code           string `json:"code"`
+}
+
+type twoFactorLoginResp struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	TwoFactorToken    string `json:"two_factor_token"`
+	ExpiresIn         int    `json:"expires_in"` // Seconds
+}
+
+// POST /api/auth/2fa/setup
+// creates a new TOTP secret for the user, enabled once a code from it is verified. Setting up
+// again replaces a secret that wasn't enabled.
+func SetupTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	u, err := store.FindUserByID(r.Context(), userID)
+	if err != nil || u == nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if u.TwoFactor != nil && u.TwoFactor.Enabled {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "two-factor authentication is already enabled")
+		return
+	}
+
+	secret := make([]byte, totpSecretLen)
+	if _, err := rand.Read(secret); err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	encrypted, err := oauth.Encrypt(secret)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	set, err := store.SetTwoFactorSecret(r.Context(), userID, encrypted)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if !set {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "two-factor authentication is already enabled")
+		return
+	}
+
+	encoded := codeEncoding.EncodeToString(secret)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":           encoded,
+		"provisioning_uri": provisioningURI(u.Email, encoded),
+	})
+}
+
+// POST /api/auth/2fa/enable
+// enables the secret that was set up once a code from it checks out, and returns the recovery
+// codes, the only time they are shown
+func EnableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var req twoFactorCodeReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		middleware.WriteDecodeError(w, err, "code required")
+		return
+	}
+
+	u, err := store.FindUserByID(r.Context(), userID)
+	if err != nil || u == nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if u.TwoFactor == nil {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "set up two-factor authentication first")
+		return
+	}
+	if u.TwoFactor.Enabled {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := oauth.Decrypt(u.TwoFactor.Secret)
+	if err != nil {
+		log.Printf("Failed to decrypt TOTP secret of user %s: %v", userID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	step, ok := checkTOTP(secret, req.Code, time.Now())
+	if !ok {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidCode, "invalid code")
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	enabled, err := store.EnableTwoFactor(r.Context(), userID, u.TwoFactor.Secret, hashes, step)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if !enabled {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "the secret was set up again meanwhile, verify a code of the new one")
+		return
+	}
+	audit.Record(r, userID, models.AuditTwoFactorOn, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// POST /api/auth/2fa/disable
+// removes the second factor, given the password and a code or recovery code. Users without a
+// password give the code alone, or a reauth token for a secret that was never enabled.
+func DisableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var req twoFactorDisableReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		middleware.WriteDecodeError(w, err, "bad request")
+		return
+	}
+
+	u, err := store.FindUserByID(r.Context(), userID)
+	if err != nil || u == nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if u.TwoFactor == nil {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "two-factor authentication is not set up")
+		return
+	}
+	if !checkIdentity(u, req.Password, req.ReauthToken) {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeInvalidCredentials, "invalid credentials")
+		return
+	}
+	// A secret that was only set up never guarded a login
+	if u.TwoFactor.Enabled {
+		ok, err := checkSecondFactor(r.Context(), u, req.Code)
+		if err != nil {
+			writeSecondFactorError(w, err)
+			return
+		}
+		if !ok {
+			middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeInvalidCode, "invalid code")
+			return
+		}
+	}
+
+	if err := store.DisableTwoFactor(r.Context(), userID); err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if u.TwoFactor.Enabled {
+		audit.Record(r, userID, models.AuditTwoFactorOff, nil)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "two-factor authentication disabled"})
+}
+
+// POST /api/auth/2fa/verify
+// completes a login of a user with two-factor authentication: the pre-auth token LoginHandler
+// returned and a code, or a recovery code, are exchanged for the access and refresh tokens
+func VerifyTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var req twoFactorVerifyReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TwoFactorToken == "" || req.Code == "" {
+		middleware.WriteDecodeError(w, err, "two_factor_token and code required")
+		return
+	}
+
+	ctx := r.Context()
+	userID, issuedAt, err := parseTypedToken(req.TwoFactorToken, twoFactorTokenType)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeInvalidToken, "invalid or expired two-factor token")
+		return
+	}
+	revocation, err := store.GetTokenRevocation(ctx, userID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if revocation != nil && issuedAt < revocation.RevokedBefore.Unix() {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeInvalidToken, "invalid or expired two-factor token")
+		return
+	}
+	spent, err := twoFactorTokenSpent(ctx, req.TwoFactorToken)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if spent {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeInvalidToken, "too many wrong codes, log in again")
+		return
+	}
+
+	u, err := store.FindUserByID(ctx, userID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	// Disabled since the password was given, logging in again issues the tokens directly
+	if u == nil || u.TwoFactor == nil || !u.TwoFactor.Enabled {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeInvalidToken, "invalid or expired two-factor token")
+		return
+	}
+
+	ok, err := checkSecondFactor(ctx, u, req.Code)
+	if err != nil {
+		writeSecondFactorError(w, err)
+		return
+	}
+	if !ok {
+		if err := recordTwoFactorTokenFailure(ctx, req.TwoFactorToken); err != nil {
+			log.Printf("Failed to count a wrong two-factor code of user %s: %v", u.ID.Hex(), err)
+		}
+		audit.Record(r, u.ID, models.AuditLoginFailure, map[string]string{"factor": "2fa"})
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeInvalidCode, "invalid code")
+		return
+	}
+
+	writeLoginTokens(w, r, u)
+}
+
+// writeTwoFactorChallenge answers a login with the right credentials of a user with two-factor
+// authentication, handing out the pre-auth token VerifyTwoFactorHandler takes
+func writeTwoFactorChallenge(w http.ResponseWriter, u *models.User) {
+	resp, err := twoFactorChallenge(u)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "token gen failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// twoFactorChallenge issues the challenge of a login waiting for the user's second factor
+func twoFactorChallenge(u *models.User) (twoFactorLoginResp, error) {
+	token, err := signTypedToken(u.ID, twoFactorTokenType, twoFactorTokenTTL)
+	if err != nil {
+		return twoFactorLoginResp{}, err
+	}
+	return twoFactorLoginResp{
+		TwoFactorRequired: true,
+		TwoFactorToken:    token,
+		ExpiresIn:         int(twoFactorTokenTTL.Seconds()),
+	}, nil
+}
+
+// signTypedToken issues a short-lived token of the user that isn't an access token, its typ
+// claim telling what it is for
+func signTypedToken(userID primitive.ObjectID, tokenType string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"sub": userID.Hex(),
+		"typ": tokenType,
+		"exp": now.Add(ttl).Unix(),
+		"iat": now.Unix(),
+	}
+	return signToken(claims)
+}
+
+// parseTypedToken validates a token signTypedToken issued for tokenType, returning its user and
+// issued-at time
+func parseTypedToken(tokenStr, tokenType string) (primitive.ObjectID, int64, error) {
+	tkn, err := jwt.Parse(tokenStr, verificationKey)
+	if err != nil || !tkn.Valid {
+		return primitive.NilObjectID, 0, errors.New("invalid token")
+	}
+	claims, ok := tkn.Claims.(jwt.MapClaims)
+	if !ok || claims["typ"] != tokenType {
+		return primitive.NilObjectID, 0, errors.New("invalid claims")
+	}
+	sub, _ := claims["sub"].(string)
+	userID, err := primitive.ObjectIDFromHex(sub)
+	if err != nil {
+		return primitive.NilObjectID, 0, errors.New("invalid claims")
+	}
+	iat, _ := claims["iat"].(float64)
+	return userID, int64(iat), nil
+}
+
+// checkSecondFactor checks a TOTP code, or else a recovery code, of a user with two-factor
+// authentication enabled. Each code is accepted once. Wrong codes are counted, and lock the
+// user's second factor for a while when they keep coming: no code is checked then, the error
+// is errTwoFactorLocked.
+func checkSecondFactor(ctx context.Context, u *models.User, code string) (bool, error) {
+	if err := checkTwoFactorLock(ctx, u.ID); err != nil {
+		return false, err
+	}
+	ok, err := matchSecondFactor(ctx, u, code)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		if err := recordTwoFactorFailure(ctx, u.ID); err != nil {
+			log.Printf("Failed to count a wrong two-factor code of user %s: %v", u.ID.Hex(), err)
+		}
+		return false, nil
+	}
+	clearTwoFactorFailures(ctx, u.ID)
+	return true, nil
+}
+
+func matchSecondFactor(ctx context.Context, u *models.User, code string) (bool, error) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) == totpDigits {
+		secret, err := oauth.Decrypt(u.TwoFactor.Secret)
+		if err != nil {
+			log.Printf("Failed to decrypt TOTP secret of user %s: %v", u.ID.Hex(), err)
+			return false, err
+		}
+		step, ok := checkTOTP(secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		return store.UseTwoFactorStep(ctx, u.ID, step)
+	}
+	return store.ConsumeRecoveryCode(ctx, u.ID, hashRecoveryCode(code))
+}
+
+// checkTOTP returns the time step whose code, per RFC 6238 with HMAC-SHA1, matches code
+func checkTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// provisioningURI is the otpauth:// URI authenticator apps scan from a QR code
+func provisioningURI(email, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", twoFactorIssuer)
+	query.Set("digits", strconv.Itoa(totpDigits))
+	query.Set("period", strconv.Itoa(totpPeriod))
+	label := url.PathEscape(twoFactorIssuer + ":" + email)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// newRecoveryCodes generates the one-time recovery codes, as shown to the user and as stored
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		encoded := strings.ToLower(codeEncoding.EncodeToString(b))
+		code := encoded[:4] + "-" + encoded[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code the way it's stored, ignoring case and dashes
+func hashRecoveryCode(code string) string {
+	return hashToken(strings.ToLower(strings.ReplaceAll(code, "-", "")))
+}
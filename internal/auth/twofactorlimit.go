@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"SE/internal/cache"
+	"SE/internal/middleware"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// Wrong codes a pre-auth token takes before it's spent and the password has to be given again
+	twoFactorTokenMaxFailures = 5
+
+	// Wrong codes of a user in a row that lock their second factor, for twoFactorLockBase after
+	// the first run and twice as long after each further one, up to twoFactorLockMax
+	twoFactorLockFailures = 5
+	twoFactorLockBase     = time.Minute
+	twoFactorLockMax      = time.Hour
+	// How long failures are remembered after the last one
+	twoFactorFailureTTL = 24 * time.Hour
+)
+
+// errTwoFactorLocked is returned by checkSecondFactor while the user's second factor is locked
+var errTwoFactorLocked = errors.New("too many wrong codes")
+
+// twoFactorLockError tells how long the second factor stays locked
+type twoFactorLockError struct {
+	wait time.Duration
+}
+
+func (e *twoFactorLockError) Error() string {
+	return fmt.Sprintf("%v, try again in %s", errTwoFactorLocked, e.wait.Round(time.Second))
+}
+
+func (e *twoFactorLockError) Unwrap() error {
+	return errTwoFactorLocked
+}
+
+// writeSecondFactorError answers a failed checkSecondFactor, 429 while the factor is locked
+func writeSecondFactorError(w http.ResponseWriter, err error) {
+	var locked *twoFactorLockError
+	if errors.As(err, &locked) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(locked.wait.Seconds()))))
+		middleware.WriteJSONError(w, http.StatusTooManyRequests, middleware.ErrCodeRateLimited, locked.Error())
+		return
+	}
+	middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+}
+
+func twoFactorFailuresKey(userID primitive.ObjectID) string {
+	return "2fa:failures:" + userID.Hex()
+}
+
+func twoFactorLockKey(userID primitive.ObjectID) string {
+	return "2fa:lock:" + userID.Hex()
+}
+
+// twoFactorTokenKey names the failures of a pre-auth token, hashed like the tokens stored
+func twoFactorTokenKey(token string) string {
+	return "2fa:token:" + hashToken(token)
+}
+
+// checkTwoFactorLock returns a *twoFactorLockError while the user's second factor is locked
+func checkTwoFactorLock(ctx context.Context, userID primitive.ObjectID) error {
+	v, ok, err := cache.Shared().Get(ctx, twoFactorLockKey(userID))
+	if err != nil || !ok {
+		return err
+	}
+	until, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil
+	}
+	if wait := time.Until(time.Unix(until, 0)); wait > 0 {
+		return &twoFactorLockError{wait: wait}
+	}
+	return nil
+}
+
+// recordTwoFactorFailure counts a wrong code of the user, locking their second factor after
+// every twoFactorLockFailures in a row
+func recordTwoFactorFailure(ctx context.Context, userID primitive.ObjectID) error {
+	key := twoFactorFailuresKey(userID)
+	n, err := cache.Shared().Incr(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := cache.Shared().Expire(ctx, key, twoFactorFailureTTL); err != nil {
+		return err
+	}
+	if n%twoFactorLockFailures != 0 {
+		return nil
+	}
+	lock := twoFactorLockMax
+	if runs := n / twoFactorLockFailures; runs <= 6 {
+		lock = min(twoFactorLockBase<<(runs-1), twoFactorLockMax)
+	}
+	log.Printf("Locking the second factor of user %s for %s after %d wrong codes", userID.Hex(), lock, n)
+	until := time.Now().Add(lock).Unix()
+	return cache.Shared().Set(ctx, twoFactorLockKey(userID), strconv.FormatInt(until, 10), lock)
+}
+
+// clearTwoFactorFailures forgets the user's wrong codes once a code checked out
+func clearTwoFactorFailures(ctx context.Context, userID primitive.ObjectID) {
+	if err := cache.Shared().Delete(ctx, twoFactorFailuresKey(userID)); err != nil {
+		log.Printf("Failed to reset two-factor failures of user %s: %v", userID.Hex(), err)
+	}
+}
+
+// twoFactorTokenSpent reports whether the pre-auth token took twoFactorTokenMaxFailures
+// wrong codes
+func twoFactorTokenSpent(ctx context.Context, token string) (bool, error) {
+	v, ok, err := cache.Shared().Get(ctx, twoFactorTokenKey(token))
+	if err != nil || !ok {
+		return false, err
+	}
+	n, _ := strconv.Atoi(v)
+	return n >= twoFactorTokenMaxFailures, nil
+}
+
+// recordTwoFactorTokenFailure counts a wrong code given with the pre-auth token, remembered
+// as long as the token is valid
+func recordTwoFactorTokenFailure(ctx context.Context, token string) error {
+	key := twoFactorTokenKey(token)
+	if _, err := cache.Shared().Incr(ctx, key); err != nil {
+		return err
+	}
+	return cache.Shared().Expire(ctx, key, twoFactorTokenTTL)
+}
@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cache holds short-lived state every replica of the server has to agree on, like rate limit
+// counters and idempotency keys. A ttl of 0 keeps a key until it is deleted.
+type Cache interface {
+	// Get returns the key's value, reporting false when it isn't set
+	Get(ctx context.Context, key string) (string, bool, error)
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+	// SetNX sets the key unless it is set already, reporting whether it did
+	SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
+	// Incr adds 1 to the integer at key, starting from 0 when it isn't set, and returns it
+	Incr(ctx context.Context, key string) (int64, error)
+	// Expire gives a key that is set the ttl from now
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+}
+
+// ErrNotInteger is returned by Incr of a key whose value isn't an integer
+var ErrNotInteger = errors.New("value is not an integer")
+
+var shared Cache
+
+// InitCacheConfig selects the cache shared by the server, in memory unless CACHE_BACKEND is
+// redis. In memory every replica keeps its own state, so replicas behind a load balancer need
+// Redis for their rate limits and idempotency keys to hold across them.
+func InitCacheConfig() {
+	backend := strings.ToLower(os.Getenv("CACHE_BACKEND"))
+	switch backend {
+	case "", "memory":
+		shared = NewMemory()
+		log.Printf("Cache: in memory")
+	case "redis":
+		url := os.Getenv("REDIS_URL")
+		if url == "" {
+			url = "redis://localhost:6379/0"
+		}
+		// Connections kept open to Redis, requests wait for one when all are in use
+		poolSize := 10
+		if v := os.Getenv("REDIS_POOL_SIZE"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				log.Fatalf("REDIS_POOL_SIZE must be a positive number, got %q", v)
+			}
+			poolSize = n
+		}
+		// Prefix of every key, so deployments can share a Redis
+		prefix, ok := os.LookupEnv("REDIS_KEY_PREFIX")
+		if !ok {
+			prefix = "vcrypt:"
+		}
+
+		r, err := NewRedis(url, poolSize, prefix)
+		if err != nil {
+			log.Fatalf("REDIS_URL: %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := r.Ping(ctx); err != nil {
+			log.Fatalf("Cache: failed to reach Redis at %s: %v", r.addr, err)
+		}
+		shared = r
+		log.Printf("Cache: Redis at %s, %d connections", r.addr, poolSize)
+	default:
+		log.Fatalf("CACHE_BACKEND must be memory or redis, got %q", backend)
+	}
+}
+
+// Shared returns the cache selected by CACHE_BACKEND, nil before InitCacheConfig
+func Shared() Cache {
+	return shared
+}
@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Memory is a Cache kept in the process, for a single instance of the server
+type Memory struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	value   string
+	expires time.Time // Zero when the key doesn't expire
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// NewMemory returns an empty in-memory cache, its expired keys are dropped in the background
+func NewMemory() *Memory {
+	m := &Memory{entries: make(map[string]memoryEntry)}
+	go m.evictExpired()
+	return m
+}
+
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// get returns the key's entry unless it expired. Callers hold mu.
+func (m *Memory) get(key string) (memoryEntry, bool) {
+	e, ok := m.entries[key]
+	if ok && e.expired(time.Now()) {
+		delete(m.entries, key)
+		return memoryEntry{}, false
+	}
+	return e, ok
+}
+
+func (m *Memory) Get(ctx context.Context, key string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.get(key)
+	return e.value, ok, nil
+}
+
+func (m *Memory) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = memoryEntry{value: value, expires: expiry(ttl)}
+	return nil
+}
+
+func (m *Memory) SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.get(key); ok {
+		return false, nil
+	}
+	m.entries[key] = memoryEntry{value: value, expires: expiry(ttl)}
+	return true, nil
+}
+
+func (m *Memory) Incr(ctx context.Context, key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, _ := m.get(key)
+	var n int64
+	if e.value != "" {
+		var err error
+		if n, err = strconv.ParseInt(e.value, 10, 64); err != nil {
+			return 0, ErrNotInteger
+		}
+	}
+	n++
+	e.value = strconv.FormatInt(n, 10)
+	m.entries[key] = e
+	return n, nil
+}
+
+func (m *Memory) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.get(key); ok {
+		e.expires = expiry(ttl)
+		m.entries[key] = e
+	}
+	return nil
+}
+
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+// evictExpired drops expired keys nobody reads anymore, reads already skip them
+func (m *Memory) evictExpired() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		m.mu.Lock()
+		for key, e := range m.entries {
+			if e.expired(now) {
+				delete(m.entries, key)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
@@ -0,0 +1,301 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time a command gets when its context has no deadline
+const redisCommandTimeout = 5 * time.Second
+
+// Redis is a Cache shared by every replica of the server, stored in Redis. It speaks the
+// RESP protocol over a fixed pool of connections, the few commands the Cache needs don't
+// warrant a client library.
+type Redis struct {
+	addr     string
+	username string
+	password string
+	db       int
+	tls      bool
+	prefix   string
+	// Holds a token per connection that may be open, idle connections are kept in idle
+	slots chan struct{}
+	idle  chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// redisError is an error reply of the server, the connection stays usable after one
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// NewRedis returns a Redis cache for rawURL, redis://[user:password@]host[:port][/db] or
+// rediss:// to connect over TLS, prefixing every key with prefix. Connections are opened on use.
+func NewRedis(rawURL string, poolSize int, prefix string) (*Redis, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("scheme must be redis or rediss, got %q", u.Scheme)
+	}
+	r := &Redis{
+		addr:   u.Host,
+		tls:    u.Scheme == "rediss",
+		prefix: prefix,
+		slots:  make(chan struct{}, poolSize),
+		idle:   make(chan *redisConn, poolSize),
+	}
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		r.username = u.User.Username()
+		r.password, _ = u.User.Password()
+		// redis://:password@host has no user, only a password
+		if _, ok := u.User.Password(); !ok {
+			r.password, r.username = r.username, ""
+		}
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if r.db, err = strconv.Atoi(db); err != nil || r.db < 0 {
+			return nil, fmt.Errorf("invalid database %q", db)
+		}
+	}
+	return r, nil
+}
+
+// Ping checks Redis can be reached with the configured credentials
+func (r *Redis) Ping(ctx context.Context) error {
+	_, err := r.do(ctx, "PING")
+	return err
+}
+
+func (r *Redis) Get(ctx context.Context, key string) (string, bool, error) {
+	reply, err := r.do(ctx, "GET", r.prefix+key)
+	if err != nil || reply == nil {
+		return "", false, err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return "", false, fmt.Errorf("redis: unexpected reply %v to GET", reply)
+	}
+	return value, true, nil
+}
+
+func (r *Redis) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	_, err := r.do(ctx, setArgs(r.prefix+key, value, ttl)...)
+	return err
+}
+
+func (r *Redis) SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	reply, err := r.do(ctx, append(setArgs(r.prefix+key, value, ttl), "NX")...)
+	// A key that is set already gets a null reply
+	return reply != nil, err
+}
+
+func setArgs(key, value string, ttl time.Duration) []string {
+	args := []string{"SET", key, value}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttlMillis(ttl), 10))
+	}
+	return args
+}
+
+// ttlMillis rounds up, a ttl below a millisecond would otherwise be refused
+func ttlMillis(ttl time.Duration) int64 {
+	return int64((ttl + time.Millisecond - 1) / time.Millisecond)
+}
+
+func (r *Redis) Incr(ctx context.Context, key string) (int64, error) {
+	reply, err := r.do(ctx, "INCR", r.prefix+key)
+	if err != nil {
+		var rerr redisError
+		if errors.As(err, &rerr) && strings.Contains(string(rerr), "not an integer") {
+			return 0, ErrNotInteger
+		}
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected reply %v to INCR", reply)
+	}
+	return n, nil
+}
+
+func (r *Redis) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	if ttl <= 0 {
+		_, err := r.do(ctx, "PERSIST", r.prefix+key)
+		return err
+	}
+	_, err := r.do(ctx, "PEXPIRE", r.prefix+key, strconv.FormatInt(ttlMillis(ttl), 10))
+	return err
+}
+
+func (r *Redis) Delete(ctx context.Context, key string) error {
+	_, err := r.do(ctx, "DEL", r.prefix+key)
+	return err
+}
+
+// do sends a command on a pooled connection and returns its reply: a string, an int64, nil
+// for a null reply, or a redisError. A connection failing mid-command is closed, not reused.
+func (r *Redis) do(ctx context.Context, args ...string) (interface{}, error) {
+	c, err := r.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisCommandTimeout)
+	}
+	c.conn.SetDeadline(deadline)
+
+	reply, err := c.command(args...)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		c.conn.Close()
+		<-r.slots
+		return nil, err
+	}
+	r.idle <- c
+	return reply, err
+}
+
+// conn returns an idle connection, or opens one when the pool has room for it
+func (r *Redis) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case c := <-r.idle:
+		return c, nil
+	default:
+	}
+	select {
+	case c := <-r.idle:
+		return c, nil
+	case r.slots <- struct{}{}:
+		c, err := r.dial(ctx)
+		if err != nil {
+			<-r.slots
+			return nil, err
+		}
+		return c, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dial opens a connection, authenticated and on the configured database
+func (r *Redis) dial(ctx context.Context) (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisCommandTimeout}
+	var conn net.Conn
+	var err error
+	if r.tls {
+		host, _, _ := net.SplitHostPort(r.addr)
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", r.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", r.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis: failed to connect: %w", err)
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	conn.SetDeadline(time.Now().Add(redisCommandTimeout))
+
+	if r.password != "" {
+		args := []string{"AUTH", r.password}
+		if r.username != "" {
+			args = []string{"AUTH", r.username, r.password}
+		}
+		if _, err := c.command(args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis: failed to authenticate: %w", err)
+		}
+	}
+	if r.db != 0 {
+		if _, err := c.command("SELECT", strconv.Itoa(r.db)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis: failed to select database %d: %w", r.db, err)
+		}
+	}
+	return c, nil
+}
+
+// command writes args as an array of bulk strings and reads the reply
+func (c *redisConn) command(args ...string) (interface{}, error) {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.reply()
+}
+
+// reply reads one RESP reply, the elements of an array reply are skipped
+func (c *redisConn) reply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed reply %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed reply %q", line)
+		}
+		for i := 0; i < n; i++ {
+			if _, err := c.reply(); err != nil {
+				var rerr redisError
+				if !errors.As(err, &rerr) {
+					return nil, err
+				}
+			}
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		return n, nil
+	default:
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+}
@@ -0,0 +1,178 @@
+package drivemanager
+
+import (
+	"SE/internal/metrics"
+	"SE/internal/models"
+	"SE/internal/netguard"
+	"SE/internal/oauth"
+	"SE/internal/store"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// StorageBackend is where a linked account keeps its chunks and manifests. Objects are
+// addressed by the ID the backend returns when storing them.
+type StorageBackend interface {
+	// Put stores the file at path as a new object called name and returns its ID. Objects with
+	// the same name are kept side by side.
+	Put(ctx context.Context, name, path string) (string, error)
+	// Get streams the object into w and returns the bytes copied
+	Get(ctx context.Context, id string, w io.Writer) (int64, error)
+	// Delete removes the object, an object that is already gone counts as deleted
+	Delete(ctx context.Context, id string) error
+	// Exists reports whether the object is still stored, without downloading it
+	Exists(ctx context.Context, id string) (bool, error)
+	// Quota reports the account's storage limit and usage
+	Quota(ctx context.Context) (*BackendQuota, error)
+
+	// FindByPrefix returns the IDs of the files written by Write whose name starts with
+	// prefix, keyed by name
+	FindByPrefix(ctx context.Context, prefix string) (map[string]string, error)
+	// Write replaces the content of id, or creates a file called name when id is empty, and
+	// returns the ID of the written file
+	Write(ctx context.Context, id, name string, data []byte) (string, error)
+}
+
+// BackendQuota is the storage limit and usage of an account
+type BackendQuota struct {
+	Limit      int64
+	Usage      int64
+	OwnerName  string
+	OwnerEmail string
+}
+
+// backendClient is the HTTP client of the S3 and WebDAV backends. Their endpoints are given by
+// users, so it only dials public addresses, redirects included.
+var backendClient = &http.Client{
+	Transport: metrics.InstrumentRoundTripper(metrics.DriveRequests, &http.Transport{
+		Proxy: nil, // A proxy would dial on our behalf and bypass the address check
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: netguard.CheckAddr,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		MaxIdleConnsPerHost:   8,
+		IdleConnTimeout:       90 * time.Second,
+	}),
+	Timeout: 10 * time.Minute,
+}
+
+// backendForAccount returns the storage backend of a linked account and its provider
+func backendForAccount(ctx context.Context, accountID primitive.ObjectID) (StorageBackend, string, error) {
+	account, err := store.GetDriveAccountByID(ctx, accountID)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get drive account: %w", err)
+	}
+	if account == nil {
+		return nil, "", fmt.Errorf("drive account %s not found", accountID.Hex())
+	}
+
+	var backend StorageBackend
+	switch account.Provider {
+	case models.ProviderGoogle, "":
+		// Drive client refreshes the account's token as needed
+		client, err := oauth.DriveClientForAccount(ctx, accountID)
+		if err != nil {
+			return nil, "", err
+		}
+		return &googleBackend{client: client, accountID: accountID}, models.ProviderGoogle, nil
+	case models.ProviderS3:
+		var config S3Config
+		if err := decryptBackendConfig(account, &config); err != nil {
+			return nil, "", err
+		}
+		backend, err = NewS3Backend(config)
+	case models.ProviderWebDAV:
+		var config WebDAVConfig
+		if err := decryptBackendConfig(account, &config); err != nil {
+			return nil, "", err
+		}
+		backend, err = NewWebDAVBackend(config)
+	default:
+		return nil, "", fmt.Errorf("unsupported storage provider %q", account.Provider)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return backend, account.Provider, nil
+}
+
+// EncryptBackendConfig seals the configuration of an S3 or WebDAV account for storage in
+// the account's EncryptedToken, like the OAuth token of a Drive account
+func EncryptBackendConfig(config interface{}) ([]byte, error) {
+	raw, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	return oauth.Encrypt(raw)
+}
+
+func decryptBackendConfig(account *models.DriveAccount, config interface{}) error {
+	raw, err := oauth.Decrypt(account.EncryptedToken)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt backend config: %w", err)
+	}
+	if err := json.Unmarshal(raw, config); err != nil {
+		return fmt.Errorf("failed to parse backend config: %w", err)
+	}
+	return nil
+}
+
+// CheckBackend verifies a backend is reachable with its credentials before it is linked
+func CheckBackend(ctx context.Context, backend StorageBackend) (*BackendQuota, error) {
+	// Any prefix works, only the listing has to succeed
+	if _, err := backend.FindByPrefix(ctx, "2xpfm."); err != nil {
+		return nil, err
+	}
+	return backend.Quota(ctx)
+}
+
+// googleBackend is a Google Drive account
+type googleBackend struct {
+	client    *http.Client
+	accountID primitive.ObjectID
+}
+
+func (b *googleBackend) Put(ctx context.Context, name, path string) (string, error) {
+	parent, err := chunkFolder(ctx, b.client, b.accountID)
+	if err != nil {
+		return "", err
+	}
+	id, err := uploadFileToDrive(ctx, b.client, b.accountID, path, name, parent)
+	if err != nil {
+		forgetChunkFolder(b.accountID)
+	}
+	return id, err
+}
+
+func (b *googleBackend) Get(ctx context.Context, id string, w io.Writer) (int64, error) {
+	return downloadDriveFile(ctx, b.client, id, w)
+}
+
+func (b *googleBackend) Delete(ctx context.Context, id string) error {
+	return deleteDriveFile(ctx, b.client, id)
+}
+
+func (b *googleBackend) Exists(ctx context.Context, id string) (bool, error) {
+	return driveFileExists(ctx, b.client, id)
+}
+
+func (b *googleBackend) Quota(ctx context.Context) (*BackendQuota, error) {
+	return queryDriveSpace(ctx, b.client)
+}
+
+func (b *googleBackend) FindByPrefix(ctx context.Context, prefix string) (map[string]string, error) {
+	return findDriveFilesByPrefix(ctx, b.client, prefix)
+}
+
+func (b *googleBackend) Write(ctx context.Context, id, name string, data []byte) (string, error) {
+	return writeDriveFile(ctx, b.client, id, name, data)
+}
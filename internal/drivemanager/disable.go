@@ -0,0 +1,138 @@
+package drivemanager
+
+import (
+	"SE/internal/store"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// How often disabled accounts past their cooldown are probed
+	driveProbeInterval = time.Minute
+	driveProbeTimeout  = 30 * time.Second
+)
+
+var (
+	driveDisableFailures int
+	driveErrorWindow     time.Duration
+	driveDisableCooldown time.Duration
+)
+
+func initDisableConfig() {
+	// Failed operations within the error window that disable an account, when they are also
+	// most of its operations. 0 never disables an account.
+	var err error
+	driveDisableFailures, err = strconv.Atoi(os.Getenv("DRIVE_DISABLE_FAILURES"))
+	if err != nil || driveDisableFailures < 0 {
+		driveDisableFailures = 10
+	}
+
+	windowMins, _ := strconv.Atoi(os.Getenv("DRIVE_ERROR_WINDOW_MINUTES"))
+	if windowMins <= 0 {
+		windowMins = 15
+	}
+	driveErrorWindow = time.Duration(windowMins) * time.Minute
+
+	// How long a disabled account rests before a probe may enable it again
+	cooldownMins, _ := strconv.Atoi(os.Getenv("DRIVE_DISABLE_COOLDOWN_MINUTES"))
+	if cooldownMins <= 0 {
+		cooldownMins = 30
+	}
+	driveDisableCooldown = time.Duration(cooldownMins) * time.Minute
+}
+
+// trackDriveErrors counts an upload or download against the account, disabling the account
+// once DRIVE_DISABLE_FAILURES operations failed within the error window and they are most of
+// its operations there
+func trackDriveErrors(ctx context.Context, accountID primitive.ObjectID, err error) {
+	errMsg := ""
+	if err != nil {
+		errMsg = err.Error()
+	}
+	health, recordErr := store.RecordDriveHealth(ctx, accountID, errMsg, driveErrorWindow)
+	if recordErr != nil {
+		log.Printf("Failed to record health of drive account %s: %v", accountID.Hex(), recordErr)
+		return
+	}
+	if err == nil || driveDisableFailures == 0 || health.Failures < driveDisableFailures || health.Failures*2 <= health.Attempts {
+		return
+	}
+
+	reason := fmt.Sprintf("%d of %d operations failed within %v, last: %s", health.Failures, health.Attempts, driveErrorWindow, errMsg)
+	disabled, err := store.DisableDriveAccount(ctx, accountID, reason)
+	if err != nil {
+		log.Printf("Failed to disable drive account %s: %v", accountID.Hex(), err)
+		return
+	}
+	if disabled {
+		log.Printf("Disabled drive account %s: %s", accountID.Hex(), reason)
+		InvalidateDriveSpace(accountID)
+	}
+}
+
+// EnableDriveAccount enables a disabled drive account and forgets its failures, reporting
+// whether it was disabled
+func EnableDriveAccount(ctx context.Context, accountID primitive.ObjectID) (bool, error) {
+	enabled, err := store.EnableDriveAccount(ctx, accountID)
+	if err != nil {
+		return false, err
+	}
+	if err := store.ResetDriveHealth(ctx, accountID); err != nil {
+		log.Printf("Failed to reset health of drive account %s: %v", accountID.Hex(), err)
+	}
+	InvalidateDriveSpace(accountID)
+	return enabled, nil
+}
+
+// StartDriveProber enables disabled drive accounts again once their cooldown has passed and a
+// probe write succeeds, until ctx is done. A failed probe starts the cooldown over.
+func StartDriveProber(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(driveProbeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			accounts, err := store.ListDisabledDriveAccounts(ctx, time.Now().Add(-driveDisableCooldown))
+			if err != nil {
+				log.Printf("Failed to list disabled drive accounts: %v", err)
+				continue
+			}
+			for _, account := range accounts {
+				probeDisabledAccount(ctx, account.ID)
+			}
+		}
+	}()
+}
+
+func probeDisabledAccount(ctx context.Context, accountID primitive.ObjectID) {
+	probeCtx, cancel := context.WithTimeout(ctx, driveProbeTimeout)
+	defer cancel()
+
+	result := TestDriveAccount(probeCtx, accountID, true)
+	if !result.Healthy {
+		last := result.Steps[len(result.Steps)-1]
+		reason := fmt.Sprintf("probe failed at %s: %s", last.Name, last.Error)
+		if err := store.RestartDriveAccountCooldown(ctx, accountID, reason); err != nil {
+			log.Printf("Failed to update disabled drive account %s: %v", accountID.Hex(), err)
+		}
+		log.Printf("Drive account %s stays disabled, %s", accountID.Hex(), reason)
+		return
+	}
+
+	if _, err := EnableDriveAccount(ctx, accountID); err != nil {
+		log.Printf("Failed to enable drive account %s: %v", accountID.Hex(), err)
+		return
+	}
+	log.Printf("Enabled drive account %s again, its probe succeeded", accountID.Hex())
+}
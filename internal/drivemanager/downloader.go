@@ -0,0 +1,53 @@
+package drivemanager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DownloadChunkFromDrive streams the content of a Drive file into w and returns the bytes copied.
+// The outcome feeds the drive health used by OrderReplicas, and counts towards disabling a
+// failing account.
+func DownloadChunkFromDrive(ctx context.Context, accountID primitive.ObjectID, fileID string, w io.Writer) (int64, error) {
+	release, err := acquireDriveDownloadSlot(ctx, accountID)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	var written int64
+	backend, _, err := backendForAccount(ctx, accountID)
+	if err == nil {
+		written, err = backend.Get(ctx, fileID, w)
+	}
+	// A cancelled request says nothing about the drive
+	if ctx.Err() == nil {
+		recordDriveResult(ctx, accountID, err)
+	}
+	return written, err
+}
+
+func downloadDriveFile(ctx context.Context, client *http.Client, fileID string, w io.Writer) (int64, error) {
+	downloadURL := fmt.Sprintf("https://www.googleapis.com/drive/v3/files/%s?alt=media", fileID)
+	req, err := http.NewRequestWithContext(ctx, "GET", downloadURL, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("drive API call failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("drive API returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	return io.Copy(w, resp.Body)
+}
@@ -0,0 +1,151 @@
+package drivemanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// FindDriveFileByName returns the ID of the app-created file called name, or "" if there is none
+func FindDriveFileByName(ctx context.Context, accountID primitive.ObjectID, name string) (string, error) {
+	files, err := FindDriveFilesByPrefix(ctx, accountID, name)
+	if err != nil {
+		return "", err
+	}
+	return files[name], nil
+}
+
+// FindDriveFilesByPrefix returns the IDs of the app-created files whose name starts with prefix,
+// keyed by name. If several files share a name the most recently modified one is returned.
+func FindDriveFilesByPrefix(ctx context.Context, accountID primitive.ObjectID, prefix string) (map[string]string, error) {
+	backend, _, err := backendForAccount(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	return backend.FindByPrefix(ctx, prefix)
+}
+
+func findDriveFilesByPrefix(ctx context.Context, client *http.Client, prefix string) (map[string]string, error) {
+	// For names, Drive's contains operator matches prefixes
+	query := url.Values{}
+	query.Set("q", fmt.Sprintf("name contains '%s' and trashed = false", prefix))
+	query.Set("fields", "files(id,name)")
+	query.Set("orderBy", "modifiedTime desc")
+	query.Set("pageSize", "1000")
+	listURL := "https://www.googleapis.com/drive/v3/files?" + query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", listURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("drive API call failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("drive API returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var list struct {
+		Files []driveFileResponse `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	files := make(map[string]string, len(list.Files))
+	for _, f := range list.Files {
+		if _, ok := files[f.Name]; !ok && strings.HasPrefix(f.Name, prefix) {
+			files[f.Name] = f.ID
+		}
+	}
+	return files, nil
+}
+
+// DriveFileExists checks the file's metadata to tell whether it is still on the drive. A
+// trashed file counts as gone.
+func DriveFileExists(ctx context.Context, accountID primitive.ObjectID, fileID string) (bool, error) {
+	backend, _, err := backendForAccount(ctx, accountID)
+	if err != nil {
+		return false, err
+	}
+	return backend.Exists(ctx, fileID)
+}
+
+func driveFileExists(ctx context.Context, client *http.Client, fileID string) (bool, error) {
+	getURL := fmt.Sprintf("https://www.googleapis.com/drive/v3/files/%s?fields=id,trashed", fileID)
+	req, err := http.NewRequestWithContext(ctx, "GET", getURL, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("drive API call failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return false, fmt.Errorf("drive API returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var meta struct {
+		Trashed bool `json:"trashed"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+		return false, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return !meta.Trashed, nil
+}
+
+// WriteDriveFile replaces the content of fileID, or creates a file called name when fileID is empty.
+// It returns the ID of the written file.
+func WriteDriveFile(ctx context.Context, accountID primitive.ObjectID, fileID, name string, data []byte) (string, error) {
+	backend, _, err := backendForAccount(ctx, accountID)
+	if err != nil {
+		return "", err
+	}
+	return backend.Write(ctx, fileID, name, data)
+}
+
+func writeDriveFile(ctx context.Context, client *http.Client, fileID, name string, data []byte) (string, error) {
+	if fileID == "" {
+		metadataJSON, _ := json.Marshal(map[string]interface{}{"name": name})
+		return simpleUpload(client, metadataJSON, bytes.NewReader(data), int64(len(data)))
+	}
+
+	updateURL := fmt.Sprintf("https://www.googleapis.com/upload/drive/v3/files/%s?uploadType=media", fileID)
+	req, err := http.NewRequestWithContext(ctx, "PATCH", updateURL, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("drive API call failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("drive API returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	return fileID, nil
+}
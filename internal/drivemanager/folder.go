@@ -0,0 +1,137 @@
+package drivemanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const driveFolderMimeType = "application/vnd.google-apps.folder"
+
+// Folder chunks are put in on Google Drive accounts, empty keeps them at the top of the drive
+var driveChunkFolder string
+
+var (
+	// Drive file ID of the chunk folder, by account
+	chunkFolders sync.Map
+	// Serializes finding or creating the chunk folder of each account, so uploads racing for it
+	// don't create one each
+	chunkFolderLocks sync.Map
+)
+
+func initChunkFolderConfig() {
+	// Set but empty puts chunks at the top of the drive, like before the folder existed
+	folder, ok := os.LookupEnv("DRIVE_CHUNK_FOLDER")
+	if !ok {
+		folder = "2xpfm"
+	}
+	if strings.ContainsAny(folder, `'\/`) {
+		log.Fatalf("DRIVE_CHUNK_FOLDER %q must not contain quotes or slashes", folder)
+	}
+	driveChunkFolder = folder
+}
+
+// chunkFolder returns the Drive file ID of the account's chunk folder, creating the folder if the
+// drive has none. It returns "" when chunks go to the top of the drive.
+func chunkFolder(ctx context.Context, client *http.Client, accountID primitive.ObjectID) (string, error) {
+	if driveChunkFolder == "" {
+		return "", nil
+	}
+	if id, ok := chunkFolders.Load(accountID); ok {
+		return id.(string), nil
+	}
+
+	mu, _ := chunkFolderLocks.LoadOrStore(accountID, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+	if id, ok := chunkFolders.Load(accountID); ok {
+		return id.(string), nil
+	}
+
+	id, err := findDriveFolder(ctx, client, driveChunkFolder)
+	if err == nil && id == "" {
+		id, err = createDriveFolder(ctx, client, driveChunkFolder)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get chunk folder: %w", err)
+	}
+	chunkFolders.Store(accountID, id)
+	return id, nil
+}
+
+// forgetChunkFolder drops the cached chunk folder of the account, after an upload into it failed
+// in case the folder was deleted
+func forgetChunkFolder(accountID primitive.ObjectID) {
+	chunkFolders.Delete(accountID)
+}
+
+// findDriveFolder returns the ID of the oldest app-created folder called name, or "" if there is none
+func findDriveFolder(ctx context.Context, client *http.Client, name string) (string, error) {
+	query := url.Values{}
+	query.Set("q", fmt.Sprintf("name = '%s' and mimeType = '%s' and trashed = false", name, driveFolderMimeType))
+	query.Set("fields", "files(id,name)")
+	query.Set("orderBy", "createdTime")
+	query.Set("pageSize", "1")
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://www.googleapis.com/drive/v3/files?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("drive API call failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("drive API returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var list struct {
+		Files []driveFileResponse `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+	if len(list.Files) == 0 {
+		return "", nil
+	}
+	return list.Files[0].ID, nil
+}
+
+func createDriveFolder(ctx context.Context, client *http.Client, name string) (string, error) {
+	metadataJSON, _ := json.Marshal(map[string]interface{}{"name": name, "mimeType": driveFolderMimeType})
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://www.googleapis.com/drive/v3/files?fields=id", bytes.NewReader(metadataJSON))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("drive API call failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("drive API returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var folder driveFileResponse
+	if err := json.NewDecoder(resp.Body).Decode(&folder); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+	return folder.ID, nil
+}
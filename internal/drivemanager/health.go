@@ -0,0 +1,49 @@
+package drivemanager
+
+import (
+	"SE/internal/models"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// driveFailureWindow is how long a failed download marks a drive as unhealthy
+const driveFailureWindow = 5 * time.Minute
+
+var (
+	healthMu     sync.Mutex
+	driveFailure = make(map[primitive.ObjectID]time.Time)
+)
+
+func recordDriveResult(ctx context.Context, accountID primitive.ObjectID, err error) {
+	healthMu.Lock()
+	if err != nil {
+		driveFailure[accountID] = time.Now()
+	} else {
+		delete(driveFailure, accountID)
+	}
+	healthMu.Unlock()
+
+	trackDriveErrors(ctx, accountID, err)
+}
+
+// driveHealthy reports whether a download from the drive hasn't failed recently
+func driveHealthy(accountID primitive.ObjectID) bool {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	failedAt, ok := driveFailure[accountID]
+	return !ok || time.Since(failedAt) >= driveFailureWindow
+}
+
+// OrderReplicas returns the replicas to try for a download. Drives that failed recently
+// go last, otherwise the stored order is kept so the primary copy is read first.
+func OrderReplicas(replicas []models.ChunkReplica) []models.ChunkReplica {
+	ordered := append([]models.ChunkReplica(nil), replicas...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return driveHealthy(ordered[i].DriveAccountID) && !driveHealthy(ordered[j].DriveAccountID)
+	})
+	return ordered
+}
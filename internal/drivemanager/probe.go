@@ -0,0 +1,99 @@
+package drivemanager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// probePrefix names the files written by TestDriveAccount, apart from chunks and manifests
+const probePrefix = "2xpfm.probe."
+
+// DriveTestStep is one round trip of a drive account test
+type DriveTestStep struct {
+	Name      string `json:"name"`
+	OK        bool   `json:"ok"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// DriveTestResult is the outcome of a drive account test. Healthy means every step passed.
+type DriveTestResult struct {
+	Healthy    bool            `json:"healthy"`
+	Provider   string          `json:"provider,omitempty"`
+	LatencyMS  int64           `json:"latency_ms"`
+	Steps      []DriveTestStep `json:"steps"`
+	TotalSpace int64           `json:"total_space,omitempty"`
+	UsedSpace  int64           `json:"used_space,omitempty"`
+	FreeSpace  int64           `json:"free_space,omitempty"`
+	OwnerEmail string          `json:"owner_email,omitempty"`
+}
+
+// TestDriveAccount checks the account still works: its credentials load, its quota can be
+// read, refreshing a Drive token on the way, and with probe set that a tiny file can be
+// written and deleted again. Steps stop at the first failure.
+func TestDriveAccount(ctx context.Context, accountID primitive.ObjectID, probe bool) *DriveTestResult {
+	result := &DriveTestResult{}
+	started := time.Now()
+	defer func() {
+		result.LatencyMS = time.Since(started).Milliseconds()
+	}()
+
+	step := func(name string, fn func() error) bool {
+		stepStarted := time.Now()
+		err := fn()
+		s := DriveTestStep{Name: name, OK: err == nil, LatencyMS: time.Since(stepStarted).Milliseconds()}
+		if err != nil {
+			s.Error = err.Error()
+		}
+		result.Steps = append(result.Steps, s)
+		return err == nil
+	}
+
+	var backend StorageBackend
+	if !step("connect", func() (err error) {
+		backend, result.Provider, err = backendForAccount(ctx, accountID)
+		return err
+	}) {
+		return result
+	}
+
+	if !step("quota", func() error {
+		quota, err := backend.Quota(ctx)
+		if err != nil {
+			return err
+		}
+		result.TotalSpace = quota.Limit
+		result.UsedSpace = quota.Usage
+		result.FreeSpace = quota.Limit - quota.Usage
+		result.OwnerEmail = quota.OwnerEmail
+		return nil
+	}) {
+		return result
+	}
+
+	if probe {
+		var probeID string
+		if !step("probe_write", func() (err error) {
+			b := make([]byte, 8)
+			if _, err := rand.Read(b); err != nil {
+				return err
+			}
+			probeID, err = backend.Write(ctx, "", probePrefix+hex.EncodeToString(b), []byte("2xpfm drive test\n"))
+			return err
+		}) {
+			return result
+		}
+		if !step("probe_delete", func() error {
+			return backend.Delete(ctx, probeID)
+		}) {
+			return result
+		}
+	}
+
+	result.Healthy = true
+	return result
+}
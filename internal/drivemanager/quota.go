@@ -0,0 +1,254 @@
+package drivemanager
+
+import (
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrStorageQuotaExceeded is returned by an upload to a drive that has no room left for it
+var ErrStorageQuotaExceeded = errors.New("drive storage quota exceeded")
+
+// isStorageQuotaExceeded reports whether a failed response says the drive is full: Google
+// answers 403 with the reason storageQuotaExceeded, WebDAV servers and S3-compatible stores
+// like MinIO 507 Insufficient Storage
+func isStorageQuotaExceeded(status int, body string) bool {
+	return status == http.StatusInsufficientStorage ||
+		(status == http.StatusForbidden && strings.Contains(body, "storageQuotaExceeded"))
+}
+
+// quotaError wraps a failed upload response in ErrStorageQuotaExceeded when it says the drive
+// is full
+func quotaError(status int, body string, err error) error {
+	if isStorageQuotaExceeded(status, body) {
+		return fmt.Errorf("%w: %v", ErrStorageQuotaExceeded, err)
+	}
+	return err
+}
+
+// DriveFullError is a chunk no drive had room for: the one it was assigned was full, and so
+// was every other drive it could fail over to
+type DriveFullError struct {
+	ChunkID int
+	Size    int64
+	Drives  []DriveQuotaInfo // The full drives, the assigned one first
+}
+
+// DriveQuotaInfo names a drive found full
+type DriveQuotaInfo struct {
+	AccountID   primitive.ObjectID `json:"drive_account_id"`
+	DisplayName string             `json:"display_name,omitempty"`
+}
+
+func (e *DriveFullError) Error() string {
+	names := make([]string, 0, len(e.Drives))
+	for _, d := range e.Drives {
+		if d.DisplayName != "" {
+			names = append(names, fmt.Sprintf("%s (%s)", d.DisplayName, d.AccountID.Hex()))
+		} else {
+			names = append(names, d.AccountID.Hex())
+		}
+	}
+	return fmt.Sprintf("chunk %d (%d bytes) fits on no drive, storage quota exceeded on drive %s", e.ChunkID, e.Size, strings.Join(names, ", "))
+}
+
+func (e *DriveFullError) Unwrap() error {
+	return ErrStorageQuotaExceeded
+}
+
+// failoverPool tracks the room left on the drives of an upload, so the copies of chunks whose
+// drive turned out full can be moved to another one
+type failoverPool struct {
+	mu     sync.Mutex
+	drives []models.DriveSpaceInfo
+	free   map[primitive.ObjectID]int64 // Room left once the planned chunks are uploaded
+	full   map[primitive.ObjectID]bool
+}
+
+// newFailoverPool returns the pool of drives for uploading assignments, with their free space
+// less what the assignments already put on them. nil drives leaves chunks where they were
+// assigned.
+func newFailoverPool(drives []models.DriveSpaceInfo, assignments []models.ChunkAssignment) *failoverPool {
+	if drives == nil {
+		return nil
+	}
+	p := &failoverPool{
+		drives: drives,
+		free:   make(map[primitive.ObjectID]int64, len(drives)),
+		full:   make(map[primitive.ObjectID]bool),
+	}
+	for _, d := range drives {
+		if d.Available && !d.Disabled {
+			p.free[d.AccountID] = d.FreeSpace
+		}
+	}
+	for _, a := range assignments {
+		for _, id := range a.DriveAccountIDs {
+			p.free[id] -= a.Size
+		}
+	}
+	return p
+}
+
+// isFull reports whether an upload already found the drive full
+func (p *failoverPool) isFull(accountID primitive.ObjectID) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.full[accountID]
+}
+
+// markFull records the drive has no room left
+func (p *failoverPool) markFull(accountID primitive.ObjectID) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.full[accountID] = true
+}
+
+// take reserves size bytes on the drive with the most room left that isn't full and doesn't
+// hold a copy of the chunk already, reporting false when none has the room
+func (p *failoverPool) take(size int64, exclude []primitive.ObjectID) (primitive.ObjectID, bool) {
+	if p == nil {
+		return primitive.NilObjectID, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	candidates := make([]primitive.ObjectID, 0, len(p.free))
+	for id, free := range p.free {
+		if !p.full[id] && free >= size && !slices.Contains(exclude, id) {
+			candidates = append(candidates, id)
+		}
+	}
+	if len(candidates) == 0 {
+		return primitive.NilObjectID, false
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if p.free[candidates[i]] != p.free[candidates[j]] {
+			return p.free[candidates[i]] > p.free[candidates[j]]
+		}
+		return candidates[i].Hex() < candidates[j].Hex()
+	})
+	p.free[candidates[0]] -= size
+	return candidates[0], true
+}
+
+// fullError returns the error of a chunk none of the pool's drives could take, naming the
+// drives found full
+func (p *failoverPool) fullError(chunkID int, size int64, assigned primitive.ObjectID) *DriveFullError {
+	e := &DriveFullError{ChunkID: chunkID, Size: size, Drives: []DriveQuotaInfo{p.quotaInfo(assigned)}}
+	if p == nil {
+		return e
+	}
+	p.mu.Lock()
+	full := make([]primitive.ObjectID, 0, len(p.full))
+	for id := range p.full {
+		if id != assigned {
+			full = append(full, id)
+		}
+	}
+	p.mu.Unlock()
+	sort.Slice(full, func(i, j int) bool { return full[i].Hex() < full[j].Hex() })
+	for _, id := range full {
+		e.Drives = append(e.Drives, p.quotaInfo(id))
+	}
+	return e
+}
+
+func (p *failoverPool) quotaInfo(accountID primitive.ObjectID) DriveQuotaInfo {
+	info := DriveQuotaInfo{AccountID: accountID}
+	if p != nil {
+		for _, d := range p.drives {
+			if d.AccountID == accountID {
+				info.DisplayName = d.DisplayName
+			}
+		}
+	}
+	return info
+}
+
+// uploadCopy uploads a copy of a chunk to accountID, failing over to another drive of the pool
+// while the drive it tries is full. holders are the drives holding the chunk's other copies,
+// which a copy can't be moved to. An error other than a *DriveFullError names the drive tried.
+func uploadCopy(ctx context.Context, pool *failoverPool, chunkID int, accountID primitive.ObjectID, holders []primitive.ObjectID, chunkPath, filename string, size int64) (models.ChunkReplica, error) {
+	assigned := accountID
+	for {
+		if pool.isFull(accountID) {
+			next, ok := pool.take(size, append(slices.Clone(holders), accountID))
+			if !ok {
+				return models.ChunkReplica{}, pool.fullError(chunkID, size, assigned)
+			}
+			log.Printf("Drive %s is full, uploading chunk %d to drive %s instead", accountID.Hex(), chunkID, next.Hex())
+			accountID = next
+		}
+
+		// Every worker takes its copy's bytes from the same limiters, so the pool as a whole
+		// stays within the user's bandwidth cap
+		if err := middleware.WaitBandwidth(ctx, int(size)); err != nil {
+			return models.ChunkReplica{}, err
+		}
+		release, err := acquireDriveSlot(ctx, accountID)
+		if err != nil {
+			return models.ChunkReplica{}, err
+		}
+		replica, err := UploadChunkToDrive(ctx, accountID, chunkPath, filename)
+		release()
+		if err == nil {
+			return replica, nil
+		}
+		if !errors.Is(err, ErrStorageQuotaExceeded) {
+			return models.ChunkReplica{}, fmt.Errorf("failed to upload chunk %d to drive %s: %w", chunkID, accountID.Hex(), err)
+		}
+		if pool == nil {
+			return models.ChunkReplica{}, pool.fullError(chunkID, size, assigned)
+		}
+		pool.markFull(accountID)
+	}
+}
+
+// fullDrives holds the accounts an upload found full, until their usage changes or the space
+// cache TTL passes
+var fullDrives = make(map[primitive.ObjectID]time.Time)
+
+// markDriveFull records the account is out of storage, so its space reads as full even though
+// Drive's quota reading, which counts on its own time, still shows room
+func markDriveFull(accountID primitive.ObjectID) {
+	spaceCacheMu.Lock()
+	defer spaceCacheMu.Unlock()
+	fullDrives[accountID] = time.Now()
+	if entry, ok := spaceCache[accountID]; ok {
+		entry.info.FreeSpace = 0
+		spaceCache[accountID] = entry
+	}
+}
+
+// driveMarkedFull reports whether an upload found the account full within the space cache TTL
+func driveMarkedFull(accountID primitive.ObjectID) bool {
+	spaceCacheMu.Lock()
+	defer spaceCacheMu.Unlock()
+	at, ok := fullDrives[accountID]
+	if !ok {
+		return false
+	}
+	if time.Since(at) >= spaceCacheTTL {
+		delete(fullDrives, accountID)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,225 @@
+package drivemanager
+
+import (
+	"SE/internal/models"
+	"SE/internal/store"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// Failed parts in a row, without Drive acknowledging any new bytes, before an upload gives up
+	resumableMaxStalls = 5
+	resumableMaxDelay  = 30 * time.Second
+)
+
+// errResumableExpired means Drive no longer knows the upload session, it has to start over
+var errResumableExpired = errors.New("resumable upload session expired")
+
+// resumableUpload uploads the file through a Drive resumable upload session, DRIVE_UPLOAD_PART_MB
+// at a time. A failed part resumes from the last byte Drive acknowledged, and the session URI
+// is saved until the file is complete so uploading the same bytes again later resumes too.
+func resumableUpload(ctx context.Context, client *http.Client, accountID primitive.ObjectID, name string, metadataJSON []byte, file *os.File, fileSize int64) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(file, 0, fileSize)); err != nil {
+		return "", err
+	}
+	record := &models.ResumableUpload{DriveAccountID: accountID, Name: name, Fingerprint: hex.EncodeToString(hash.Sum(nil))}
+
+	saved, err := store.FindResumableUpload(ctx, accountID, name, record.Fingerprint)
+	if err != nil {
+		log.Printf("Failed to look up resumable upload of %s: %v", name, err)
+	}
+	if saved != nil {
+		record.URI = saved.URI
+	}
+
+	// offset is -1 while it has to be asked for, after a failure or when resuming a saved session
+	offset := int64(-1)
+	restarted := false
+	stalls := 0
+	for {
+		if record.URI == "" {
+			uri, err := initiateResumableUpload(ctx, client, metadataJSON, fileSize)
+			if err != nil {
+				return "", err
+			}
+			record.URI = uri
+			if err := store.SaveResumableUpload(ctx, record); err != nil {
+				log.Printf("Failed to save resumable upload of %s: %v", name, err)
+			}
+			offset = 0
+		}
+
+		var fileID string
+		var err error
+		if offset < 0 {
+			offset, fileID, err = resumableStatus(ctx, client, record.URI, fileSize)
+		} else {
+			end := min(offset+drivePartSize, fileSize)
+			var acked int64
+			acked, fileID, err = uploadPart(ctx, client, record.URI, file, offset, end, fileSize)
+			switch {
+			case err != nil || fileID != "":
+			case acked > offset:
+				offset = acked
+				stalls = 0
+			default:
+				err = fmt.Errorf("drive acknowledged no bytes past %d", offset)
+			}
+		}
+
+		switch {
+		case fileID != "":
+			if err := store.DeleteResumableUpload(ctx, record); err != nil {
+				log.Printf("Failed to forget resumable upload of %s: %v", name, err)
+			}
+			return fileID, nil
+		case errors.Is(err, errResumableExpired) && !restarted:
+			if err := store.DeleteResumableUpload(ctx, record); err != nil {
+				log.Printf("Failed to forget resumable upload of %s: %v", name, err)
+			}
+			record.URI = ""
+			restarted = true
+		case err != nil:
+			var permanent permanentUploadError
+			if errors.As(err, &permanent) || errors.Is(err, errResumableExpired) || ctx.Err() != nil {
+				return "", err
+			}
+			stalls++
+			if stalls >= resumableMaxStalls {
+				return "", fmt.Errorf("upload stalled at byte %d of %d: %w", max(offset, 0), fileSize, err)
+			}
+			delay := min(time.Second<<(stalls-1), resumableMaxDelay)
+			log.Printf("Resumable upload of %s failed (%v), resuming in %v (%d/%d)", name, err, delay, stalls, resumableMaxStalls)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+			offset = -1
+		}
+	}
+}
+
+// permanentUploadError is a Drive answer sending the bytes again won't change
+type permanentUploadError struct {
+	status int
+	body   string
+}
+
+func (e permanentUploadError) Error() string {
+	return fmt.Sprintf("upload failed: status %d: %s", e.status, e.body)
+}
+
+// Unwrap tells a drive out of storage apart from other refusals
+func (e permanentUploadError) Unwrap() error {
+	if isStorageQuotaExceeded(e.status, e.body) {
+		return ErrStorageQuotaExceeded
+	}
+	return nil
+}
+
+func initiateResumableUpload(ctx context.Context, client *http.Client, metadataJSON []byte, fileSize int64) (string, error) {
+	initiateURL := "https://www.googleapis.com/upload/drive/v3/files?uploadType=resumable"
+	req, err := http.NewRequestWithContext(ctx, "POST", initiateURL, bytes.NewReader(metadataJSON))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", "application/octet-stream")
+	req.Header.Set("X-Upload-Content-Length", fmt.Sprintf("%d", fileSize))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		respBody, _ := io.ReadAll(resp.Body)
+		return "", quotaError(resp.StatusCode, string(respBody), fmt.Errorf("resumable init failed: status %d: %s", resp.StatusCode, string(respBody)))
+	}
+
+	uploadURL := resp.Header.Get("Location")
+	if uploadURL == "" {
+		return "", fmt.Errorf("no upload URL returned")
+	}
+	return uploadURL, nil
+}
+
+// uploadPart sends bytes start to end of the file, returning how many bytes Drive now holds or,
+// once it holds them all, the new file's ID. The body isn't rewindable on purpose: after a
+// failure Drive may hold part of it, so the next part starts where Drive says it stopped.
+func uploadPart(ctx context.Context, client *http.Client, uri string, file *os.File, start, end, fileSize int64) (int64, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", uri, io.NewSectionReader(file, start, end-start))
+	if err != nil {
+		return 0, "", err
+	}
+	req.ContentLength = end - start
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, fileSize))
+	return doResumable(client, req)
+}
+
+// resumableStatus asks Drive how much of the upload it holds
+func resumableStatus(ctx context.Context, client *http.Client, uri string, fileSize int64) (int64, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", uri, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", fileSize))
+	return doResumable(client, req)
+}
+
+func doResumable(client *http.Client, req *http.Request) (int64, string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated:
+		var fileResp driveFileResponse
+		if err := json.NewDecoder(resp.Body).Decode(&fileResp); err != nil {
+			return 0, "", err
+		}
+		return 0, fileResp.ID, nil
+	case resp.StatusCode == http.StatusPermanentRedirect:
+		// "Range: bytes=0-N" lists what Drive holds, no header means nothing yet
+		acked := int64(0)
+		if r := resp.Header.Get("Range"); r != "" {
+			_, last, ok := strings.Cut(strings.TrimPrefix(r, "bytes="), "-")
+			n, err := strconv.ParseInt(last, 10, 64)
+			if !ok || err != nil {
+				return 0, "", fmt.Errorf("unexpected Range %q in resumable upload response", r)
+			}
+			acked = n + 1
+		}
+		return acked, "", nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return 0, "", errResumableExpired
+	default:
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		// Rate limits come as 429 or as a 403 naming the limit, other 403s are quota or permissions
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests ||
+			(resp.StatusCode == http.StatusForbidden && (strings.Contains(string(respBody), "rateLimitExceeded") || strings.Contains(string(respBody), "userRateLimitExceeded"))) {
+			return 0, "", fmt.Errorf("upload failed: status %d: %s", resp.StatusCode, string(respBody))
+		}
+		return 0, "", permanentUploadError{status: resp.StatusCode, body: string(respBody)}
+	}
+}
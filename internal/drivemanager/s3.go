@@ -0,0 +1,337 @@
+package drivemanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// S3Config is a linked S3 bucket, stored encrypted in the account
+type S3Config struct {
+	Endpoint        string `json:"endpoint,omitempty"` // Empty for AWS, e.g. https://minio.example.com otherwise
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	Prefix          string `json:"prefix,omitempty"` // Key prefix everything is stored under
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	QuotaBytes      int64  `json:"quota_bytes"` // Buckets have no size limit of their own, this one is planned against
+}
+
+// s3Backend stores objects in an S3 bucket with signature V4 requests. Chunks get a key of
+// their own under chunks/, files written with Write keep their name as key.
+type s3Backend struct {
+	config  S3Config
+	baseURL string // Up to the bucket, path style for custom endpoints
+	prefix  string
+}
+
+// NewS3Backend checks an S3 config and returns its backend
+func NewS3Backend(config S3Config) (StorageBackend, error) {
+	if config.Bucket == "" || config.Region == "" || config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, errors.New("bucket, region, access_key_id and secret_access_key are required")
+	}
+	if config.QuotaBytes <= 0 {
+		return nil, errors.New("quota_bytes is required for S3")
+	}
+
+	b := &s3Backend{config: config}
+	if config.Endpoint == "" {
+		b.baseURL = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", config.Bucket, config.Region)
+	} else {
+		endpoint, err := url.Parse(config.Endpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return nil, errors.New("endpoint must be an http or https URL")
+		}
+		b.baseURL = strings.TrimSuffix(config.Endpoint, "/") + "/" + config.Bucket
+	}
+	if config.Prefix != "" {
+		b.prefix = strings.Trim(config.Prefix, "/") + "/"
+	}
+	return b, nil
+}
+
+func (b *s3Backend) Put(ctx context.Context, name, path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	key := b.prefix + "chunks/" + primitive.NewObjectID().Hex() + "_" + name
+	req, err := b.request(ctx, "PUT", key, nil, file, "UNSIGNED-PAYLOAD")
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = info.Size()
+	if err := b.do(req, nil, http.StatusOK); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func (b *s3Backend) Get(ctx context.Context, id string, w io.Writer) (int64, error) {
+	req, err := b.request(ctx, "GET", id, nil, nil, emptyPayloadHash)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := backendClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("s3 request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, s3Error(resp)
+	}
+	return io.Copy(w, resp.Body)
+}
+
+func (b *s3Backend) Delete(ctx context.Context, id string) error {
+	req, err := b.request(ctx, "DELETE", id, nil, nil, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	// S3 answers 204 whether or not the key existed
+	return b.do(req, nil, http.StatusNoContent, http.StatusOK, http.StatusNotFound)
+}
+
+func (b *s3Backend) Exists(ctx context.Context, id string) (bool, error) {
+	req, err := b.request(ctx, "HEAD", id, nil, nil, emptyPayloadHash)
+	if err != nil {
+		return false, err
+	}
+	return headExists(req, "s3")
+}
+
+// Quota reports the configured quota and the size of everything under the prefix
+func (b *s3Backend) Quota(ctx context.Context) (*BackendQuota, error) {
+	var usage int64
+	err := b.list(ctx, b.prefix, false, func(key string, size int64) {
+		usage += size
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BackendQuota{Limit: b.config.QuotaBytes, Usage: usage, OwnerName: b.config.Bucket}, nil
+}
+
+func (b *s3Backend) FindByPrefix(ctx context.Context, prefix string) (map[string]string, error) {
+	files := make(map[string]string)
+	// The delimiter keeps the listing to named files, chunks sit one level down
+	err := b.list(ctx, b.prefix+prefix, true, func(key string, size int64) {
+		files[strings.TrimPrefix(key, b.prefix)] = key
+	})
+	return files, err
+}
+
+func (b *s3Backend) Write(ctx context.Context, id, name string, data []byte) (string, error) {
+	key := id
+	if key == "" {
+		key = b.prefix + name
+	}
+	sum := sha256.Sum256(data)
+	req, err := b.request(ctx, "PUT", key, nil, bytes.NewReader(data), hex.EncodeToString(sum[:]))
+	if err != nil {
+		return "", err
+	}
+	if err := b.do(req, nil, http.StatusOK); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list calls fn for every key starting with prefix, only the keys without a further "/" when
+// shallow is set
+func (b *s3Backend) list(ctx context.Context, prefix string, shallow bool, fn func(key string, size int64)) error {
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if shallow {
+			query.Set("delimiter", "/")
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		req, err := b.request(ctx, "GET", "", query, nil, emptyPayloadHash)
+		if err != nil {
+			return err
+		}
+		var result s3ListResult
+		if err := b.do(req, &result, http.StatusOK); err != nil {
+			return err
+		}
+		for _, object := range result.Contents {
+			fn(object.Key, object.Size)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// do sends a signed request, decoding an XML response into out when given
+func (b *s3Backend) do(req *http.Request, out interface{}, okStatuses ...int) error {
+	resp, err := backendClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("s3 request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	for _, status := range okStatuses {
+		if resp.StatusCode == status {
+			if out != nil {
+				if err := xml.NewDecoder(resp.Body).Decode(out); err != nil {
+					return fmt.Errorf("failed to decode s3 response: %w", err)
+				}
+			}
+			return nil
+		}
+	}
+	return s3Error(resp)
+}
+
+// headExists sends a HEAD request, a 404 meaning the object is gone
+func headExists(req *http.Request, service string) (bool, error) {
+	resp, err := backendClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("%s request failed: %w", service, err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("%s returned status %d", service, resp.StatusCode)
+	}
+}
+
+// s3Error is the error of a failed response. Its body is only logged, the error can reach the
+// user who set the endpoint up, who shouldn't read whatever it answers.
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	log.Printf("S3 %s %s returned status %d: %s", resp.Request.Method, resp.Request.URL.Redacted(), resp.StatusCode, body)
+	return quotaError(resp.StatusCode, string(body), fmt.Errorf("s3 returned status %d", resp.StatusCode))
+}
+
+// SHA-256 of an empty body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// request builds a request for key, signed with AWS signature V4
+func (b *s3Backend) request(ctx context.Context, method, key string, query url.Values, body io.Reader, payloadHash string) (*http.Request, error) {
+	rawURL := b.baseURL + "/" + s3Escape(key, false)
+	if len(query) > 0 {
+		rawURL += "?" + s3CanonicalQuery(query)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	canonicalURI := req.URL.EscapedPath()
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		method,
+		canonicalURI,
+		s3CanonicalQuery(query),
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + b.config.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+b.config.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, b.config.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.config.AccessKeyID, scope, signedHeaders, signature))
+	return req, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery encodes a query string the way signature V4 expects, sorted by key
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, and "/" unless encodeSlash
+func s3Escape(s string, encodeSlash bool) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
@@ -2,7 +2,6 @@ package drivemanager
 
 import (
 	"SE/internal/models"
-	"SE/internal/oauth"
 	"SE/internal/store"
 	"context"
 	"encoding/json"
@@ -10,11 +9,11 @@ import (
 	"net/http"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"golang.org/x/oauth2"
 )
 
-// GetUserDriveSpaces retrieves available space for all user's drive accounts
-func GetUserDriveSpaces(ctx context.Context, userID primitive.ObjectID) ([]models.DriveSpaceInfo, error) {
+// GetUserDriveSpaces retrieves available space for all user's drive accounts.
+// Values younger than the cache TTL are reused unless forceRefresh is set.
+func GetUserDriveSpaces(ctx context.Context, userID primitive.ObjectID, forceRefresh bool) ([]models.DriveSpaceInfo, error) {
 	// Get user's drive accounts
 	accounts, err := store.ListUserDriveAccounts(ctx, userID)
 	if err != nil {
@@ -31,27 +30,35 @@ func GetUserDriveSpaces(ctx context.Context, userID primitive.ObjectID) ([]model
 		spaceInfo := models.DriveSpaceInfo{
 			AccountID:   account.ID,
 			DisplayName: account.DisplayName,
+			Priority:    account.Priority,
 			Available:   false,
 		}
 
-		// Decrypt OAuth token
-		tokenData, err := oauth.Decrypt(account.EncryptedToken)
-		if err != nil {
-			spaceInfo.Error = fmt.Sprintf("failed to decrypt token: %v", err)
+		// New chunks skip a disabled account, whatever its space
+		if account.Disabled {
+			spaceInfo.Disabled = true
+			spaceInfo.Error = "disabled: " + account.DisabledReason
 			spaces = append(spaces, spaceInfo)
 			continue
 		}
 
-		// Unmarshal token
-		var token oauth2.Token
-		if err := json.Unmarshal(tokenData, &token); err != nil {
-			spaceInfo.Error = fmt.Sprintf("failed to parse token: %v", err)
+		if !forceRefresh {
+			if cached, ok := cachedDriveSpace(account.ID); ok {
+				cached.DisplayName = account.DisplayName
+				cached.Priority = account.Priority
+				spaces = append(spaces, withFullMark(cached))
+				continue
+			}
+		}
+
+		backend, _, err := backendForAccount(ctx, account.ID)
+		if err != nil {
+			spaceInfo.Error = err.Error()
 			spaces = append(spaces, spaceInfo)
 			continue
 		}
 
-		// Get space info from Google Drive API
-		space, err := queryDriveSpace(&token)
+		space, err := backend.Quota(ctx)
 		if err != nil {
 			spaceInfo.Error = fmt.Sprintf("failed to query drive: %v", err)
 			spaces = append(spaces, spaceInfo)
@@ -65,12 +72,22 @@ func GetUserDriveSpaces(ctx context.Context, userID primitive.ObjectID) ([]model
 		spaceInfo.FreeSpace = space.Limit - space.Usage
 		spaceInfo.Available = true
 
-		spaces = append(spaces, spaceInfo)
+		cacheDriveSpace(spaceInfo)
+		spaces = append(spaces, withFullMark(spaceInfo))
 	}
 
 	return spaces, nil
 }
 
+// withFullMark leaves no free space on a drive an upload found full
+func withFullMark(info models.DriveSpaceInfo) models.DriveSpaceInfo {
+	if driveMarkedFull(info.AccountID) {
+		info.FreeSpace = 0
+		info.Full = true
+	}
+	return info
+}
+
 type driveAboutResponse struct {
 	User struct {
 		DisplayName  string `json:"displayName"`
@@ -83,15 +100,13 @@ type driveAboutResponse struct {
 }
 
 // queryDriveSpace calls Google Drive API to get storage info
-func queryDriveSpace(token *oauth2.Token) (*struct {
-	Limit, Usage          int64
-	OwnerName, OwnerEmail string
-}, error) {
-	// Create HTTP client with OAuth2 token (auto-refreshes using refresh_token)
-	client := oauth.NewClient(context.Background(), token)
-
+func queryDriveSpace(ctx context.Context, client *http.Client) (*BackendQuota, error) {
 	// Call Drive API
-	resp, err := client.Get("https://www.googleapis.com/drive/v3/about?fields=user(displayName,emailAddress),storageQuota")
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://www.googleapis.com/drive/v3/about?fields=user(displayName,emailAddress),storageQuota", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("drive API call failed: %w", err)
 	}
@@ -106,10 +121,7 @@ func queryDriveSpace(token *oauth2.Token) (*struct {
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
 
-	return &struct {
-		Limit, Usage          int64
-		OwnerName, OwnerEmail string
-	}{
+	return &BackendQuota{
 		Limit:      about.StorageQuota.Limit,
 		Usage:      about.StorageQuota.Usage,
 		OwnerName:  about.User.DisplayName,
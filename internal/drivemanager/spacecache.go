@@ -0,0 +1,115 @@
+package drivemanager
+
+import (
+	"SE/internal/models"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	spaceCacheTTL            time.Duration
+	uploadConcurrency        int
+	driveUploadConcurrency   int
+	downloadConcurrency      int
+	driveDownloadConcurrency int
+	drivePartSize            int64
+)
+
+// InitDriveConfig reads drive manager settings from the environment
+func InitDriveConfig() {
+	// How long a drive's quota is trusted before about.get is called again
+	ttlSecs, _ := strconv.Atoi(os.Getenv("DRIVE_SPACE_CACHE_SECONDS"))
+	if ttlSecs == 0 {
+		ttlSecs = 60
+	}
+	spaceCacheTTL = time.Duration(ttlSecs) * time.Second
+
+	// Chunks uploaded in parallel per file, and uploads allowed against one account at once
+	uploadConcurrency, _ = strconv.Atoi(os.Getenv("UPLOAD_CONCURRENCY"))
+	if uploadConcurrency <= 0 {
+		uploadConcurrency = 4
+	}
+	driveUploadConcurrency, _ = strconv.Atoi(os.Getenv("DRIVE_UPLOAD_CONCURRENCY"))
+	if driveUploadConcurrency <= 0 {
+		driveUploadConcurrency = 2
+	}
+
+	// Chunks fetched in parallel per reconstruction, and downloads allowed against one account at once
+	downloadConcurrency, _ = strconv.Atoi(os.Getenv("DOWNLOAD_CONCURRENCY"))
+	if downloadConcurrency <= 0 {
+		downloadConcurrency = 4
+	}
+	driveDownloadConcurrency, _ = strconv.Atoi(os.Getenv("DRIVE_DOWNLOAD_CONCURRENCY"))
+	if driveDownloadConcurrency <= 0 {
+		driveDownloadConcurrency = 2
+	}
+
+	// Bytes sent per request of a resumable Drive upload, Drive wants multiples of 256 KiB
+	partMB, _ := strconv.Atoi(os.Getenv("DRIVE_UPLOAD_PART_MB"))
+	if partMB <= 0 {
+		partMB = 8
+	}
+	drivePartSize = int64(partMB) * 1024 * 1024
+
+	// Disabling of accounts that keep failing
+	initDisableConfig()
+
+	// Folder chunks are kept in on Google Drive
+	initChunkFolderConfig()
+}
+
+// GetDownloadConcurrency returns how many chunks of a file are fetched at once
+func GetDownloadConcurrency() int {
+	return downloadConcurrency
+}
+
+type cachedSpace struct {
+	info      models.DriveSpaceInfo
+	fetchedAt time.Time
+}
+
+var (
+	spaceCacheMu sync.Mutex
+	spaceCache   = make(map[primitive.ObjectID]cachedSpace)
+)
+
+// cachedDriveSpace returns the cached space of an account if it hasn't expired
+func cachedDriveSpace(accountID primitive.ObjectID) (models.DriveSpaceInfo, bool) {
+	spaceCacheMu.Lock()
+	defer spaceCacheMu.Unlock()
+
+	entry, ok := spaceCache[accountID]
+	if !ok {
+		return models.DriveSpaceInfo{}, false
+	}
+	age := time.Since(entry.fetchedAt)
+	if age >= spaceCacheTTL {
+		delete(spaceCache, accountID)
+		return models.DriveSpaceInfo{}, false
+	}
+
+	info := entry.info
+	info.Cached = true
+	info.CacheAge = int64(age.Seconds())
+	return info, true
+}
+
+// cacheDriveSpace stores a live space reading. Failed readings are never cached.
+func cacheDriveSpace(info models.DriveSpaceInfo) {
+	spaceCacheMu.Lock()
+	defer spaceCacheMu.Unlock()
+	spaceCache[info.AccountID] = cachedSpace{info: info, fetchedAt: time.Now()}
+}
+
+// InvalidateDriveSpace drops the cached space of an account after its usage changed, along
+// with it having been found full
+func InvalidateDriveSpace(accountID primitive.ObjectID) {
+	spaceCacheMu.Lock()
+	defer spaceCacheMu.Unlock()
+	delete(spaceCache, accountID)
+	delete(fullDrives, accountID)
+}
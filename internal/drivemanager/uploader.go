@@ -1,51 +1,46 @@
 package drivemanager
 
 import (
+	"SE/internal/metrics"
 	"SE/internal/models"
-	"SE/internal/oauth"
-	"SE/internal/store"
 	"bytes"
 	"context"
-	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
 	"os"
+	"sync"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"golang.org/x/oauth2"
 )
 
-// UploadChunkToDrive uploads a file chunk to a specific Google Drive account
-func UploadChunkToDrive(ctx context.Context, accountID primitive.ObjectID, chunkPath, filename string) (string, error) {
-	// Get drive account
-	account, err := store.GetDriveAccountByID(ctx, accountID)
-	if err != nil {
-		return "", fmt.Errorf("failed to get drive account: %w", err)
+// UploadChunkToDrive uploads a file chunk to a specific linked account and returns the new copy.
+// The outcome counts towards disabling a failing account.
+func UploadChunkToDrive(ctx context.Context, accountID primitive.ObjectID, chunkPath, filename string) (models.ChunkReplica, error) {
+	backend, provider, err := backendForAccount(ctx, accountID)
+	var fileID string
+	if err == nil {
+		fileID, err = backend.Put(ctx, filename, chunkPath)
 	}
-
-	// Decrypt OAuth token
-	tokenData, err := oauth.Decrypt(account.EncryptedToken)
-	if err != nil {
-		return "", fmt.Errorf("failed to decrypt token: %w", err)
-	}
-
-	// Unmarshal token
-	var token oauth2.Token
-	if err := json.Unmarshal(tokenData, &token); err != nil {
-		return "", fmt.Errorf("failed to parse token: %w", err)
+	// A full drive works, it only has no room, and a cancelled upload says nothing about it
+	if errors.Is(err, ErrStorageQuotaExceeded) {
+		markDriveFull(accountID)
+	} else if ctx.Err() == nil {
+		trackDriveErrors(ctx, accountID, err)
 	}
-
-	// Upload to Drive
-	fileID, err := uploadFileToDrive(&token, chunkPath, filename)
 	if err != nil {
-		return "", fmt.Errorf("failed to upload to drive: %w", err)
+		return models.ChunkReplica{}, fmt.Errorf("failed to upload to drive: %w", err)
 	}
 
-	return fileID, nil
+	// The drive's usage changed, so its cached space is stale
+	InvalidateDriveSpace(accountID)
+
+	return models.ChunkReplica{DriveAccountID: accountID, DriveFileID: fileID, Backend: provider}, nil
 }
 
 type driveFileResponse struct {
@@ -53,8 +48,9 @@ type driveFileResponse struct {
 	Name string `json:"name"`
 }
 
-// uploadFileToDrive performs the actual upload using Google Drive API
-func uploadFileToDrive(token *oauth2.Token, filePath, filename string) (string, error) {
+// uploadFileToDrive performs the actual upload using Google Drive API, into the folder parent
+// unless it's empty
+func uploadFileToDrive(ctx context.Context, client *http.Client, accountID primitive.ObjectID, filePath, filename, parent string) (string, error) {
 	// Open file
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -67,24 +63,23 @@ func uploadFileToDrive(token *oauth2.Token, filePath, filename string) (string,
 		return "", err
 	}
 
-	// Create HTTP client with OAuth2 token that auto-refreshes
-	ctx := context.Background()
-	client := oauth.NewClient(ctx, token)
-
 	// Create metadata
 	metadata := map[string]interface{}{
 		"name": filename,
 	}
+	if parent != "" {
+		metadata["parents"] = []string{parent}
+	}
 	metadataJSON, _ := json.Marshal(metadata)
 
 	// Use simple upload for files < 5MB, resumable for larger
 	if fileStat.Size() < 5*1024*1024 {
 		return simpleUpload(client, metadataJSON, file, fileStat.Size())
 	}
-	return resumableUpload(client, metadataJSON, file, fileStat.Size())
+	return resumableUpload(ctx, client, accountID, filename, metadataJSON, file, fileStat.Size())
 }
 
-func simpleUpload(client *http.Client, metadataJSON []byte, file *os.File, fileSize int64) (string, error) {
+func simpleUpload(client *http.Client, metadataJSON []byte, file io.Reader, fileSize int64) (string, error) {
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
 
@@ -128,7 +123,7 @@ func simpleUpload(client *http.Client, metadataJSON []byte, file *os.File, fileS
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
 		respBody, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("drive API returned status %d: %s", resp.StatusCode, string(respBody))
+		return "", quotaError(resp.StatusCode, string(respBody), fmt.Errorf("drive API returned status %d: %s", resp.StatusCode, string(respBody)))
 	}
 
 	var fileResp driveFileResponse
@@ -139,137 +134,238 @@ func simpleUpload(client *http.Client, metadataJSON []byte, file *os.File, fileS
 	return fileResp.ID, nil
 }
 
-func resumableUpload(client *http.Client, metadataJSON []byte, file *os.File, fileSize int64) (string, error) {
-	// Step 1: Initiate resumable upload
-	initiateURL := "https://www.googleapis.com/upload/drive/v3/files?uploadType=resumable"
-	req, err := http.NewRequest("POST", initiateURL, bytes.NewReader(metadataJSON))
-	if err != nil {
-		return "", err
-	}
-	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
-	req.Header.Set("X-Upload-Content-Type", "application/octet-stream")
-	req.Header.Set("X-Upload-Content-Length", fmt.Sprintf("%d", fileSize))
+// driveSlots and driveDownloadSlots cap the uploads and downloads running against each drive
+// account at once, across all sessions
+var (
+	driveSlotsMu       sync.Mutex
+	driveSlots         = make(map[primitive.ObjectID]chan struct{})
+	driveDownloadSlots = make(map[primitive.ObjectID]chan struct{})
+)
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
+// acquireDriveSlot waits for a free upload slot on the account and returns its release func
+func acquireDriveSlot(ctx context.Context, accountID primitive.ObjectID) (func(), error) {
+	return acquireSlot(ctx, driveSlots, driveUploadConcurrency, accountID)
+}
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		respBody, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("resumable init failed: status %d: %s", resp.StatusCode, string(respBody))
-	}
+// acquireDriveDownloadSlot waits for a free download slot on the account and returns its release func
+func acquireDriveDownloadSlot(ctx context.Context, accountID primitive.ObjectID) (func(), error) {
+	return acquireSlot(ctx, driveDownloadSlots, driveDownloadConcurrency, accountID)
+}
 
-	uploadURL := resp.Header.Get("Location")
-	if uploadURL == "" {
-		return "", fmt.Errorf("no upload URL returned")
+func acquireSlot(ctx context.Context, pool map[primitive.ObjectID]chan struct{}, size int, accountID primitive.ObjectID) (func(), error) {
+	driveSlotsMu.Lock()
+	slots, ok := pool[accountID]
+	if !ok {
+		slots = make(chan struct{}, size)
+		pool[accountID] = slots
 	}
+	driveSlotsMu.Unlock()
 
-	// Step 2: Upload file content
-	file.Seek(0, 0) // Reset to beginning
-
-	uploadReq, err := http.NewRequest("PUT", uploadURL, file)
-	if err != nil {
-		return "", err
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	uploadReq.Header.Set("Content-Length", fmt.Sprintf("%d", fileSize))
-	uploadReq.ContentLength = fileSize
+}
 
-	uploadResp, err := client.Do(uploadReq)
-	if err != nil {
-		return "", err
-	}
-	defer uploadResp.Body.Close()
+// UploadChunksToDrivers uploads every chunk to each drive of its assignment, running up to
+// UPLOAD_CONCURRENCY chunks at once. Checksums are left for the caller to fill in. progressCallback is called with the number of chunks done.
+// uploadedCallback, if set, is told about each copy as soon as it is on a drive.
+// order lists the assignment indexes in the order chunks are started, nil keeps assignment order.
+// A copy whose drive turns out full goes to the drive of drives with the most room left instead,
+// a *DriveFullError is returned once none has room for it. nil drives doesn't fail over.
+func UploadChunksToDrivers(ctx context.Context, chunkPaths []string, assignments []models.ChunkAssignment, order []int, drives []models.DriveSpaceInfo, progressCallback func(int, int), uploadedCallback func(models.ChunkReplica)) ([]models.ChunkMetadata, error) {
+	if len(chunkPaths) != len(assignments) {
+		return nil, fmt.Errorf("mismatch: %d chunk files but %d assigned chunks", len(chunkPaths), len(assignments))
+	}
+	paths := make([][]string, len(chunkPaths))
+	for i, path := range chunkPaths {
+		paths[i] = []string{path}
+	}
+	return uploadChunks(ctx, paths, assignments, order, drives, progressCallback, uploadedCallback)
+}
 
-	if uploadResp.StatusCode != http.StatusOK && uploadResp.StatusCode != http.StatusCreated {
-		respBody, _ := io.ReadAll(uploadResp.Body)
-		return "", fmt.Errorf("upload failed: status %d: %s", uploadResp.StatusCode, string(respBody))
+// UploadShardsToDrivers uploads the erasure-coded shards of every chunk like UploadChunksToDrivers
+// uploads whole chunks, shardPaths[i][s] to the drive at index s of assignment i. Each copy
+// records its shard, and StoredSize is the size of one shard.
+func UploadShardsToDrivers(ctx context.Context, shardPaths [][]string, assignments []models.ChunkAssignment, order []int, drives []models.DriveSpaceInfo, progressCallback func(int, int), uploadedCallback func(models.ChunkReplica)) ([]models.ChunkMetadata, error) {
+	if len(shardPaths) != len(assignments) {
+		return nil, fmt.Errorf("mismatch: %d sharded chunks but %d assigned chunks", len(shardPaths), len(assignments))
 	}
-
-	var fileResp driveFileResponse
-	if err := json.NewDecoder(uploadResp.Body).Decode(&fileResp); err != nil {
-		return "", err
+	for i, paths := range shardPaths {
+		if len(paths) != len(assignments[i].DriveAccountIDs) {
+			return nil, fmt.Errorf("mismatch: chunk %d has %d shards but %d drives", assignments[i].ChunkID, len(paths), len(assignments[i].DriveAccountIDs))
+		}
 	}
-
-	return fileResp.ID, nil
+	return uploadChunks(ctx, shardPaths, assignments, order, drives, progressCallback, uploadedCallback)
 }
 
-// UploadChunksToDrivers uploads all chunks to their respective drives
-func UploadChunksToDrivers(ctx context.Context, chunkPaths []string, plan []models.ChunkPlan, progressCallback func(int, int)) ([]models.ChunkMetadata, error) {
-	if len(chunkPaths) != len(plan) {
-		return nil, fmt.Errorf("mismatch: %d chunk files but %d planned chunks", len(chunkPaths), len(plan))
+// uploadChunks uploads every chunk to the drives of its assignment, with a single file for
+// all of them or one file per drive
+func uploadChunks(ctx context.Context, chunkPaths [][]string, assignments []models.ChunkAssignment, order []int, drives []models.DriveSpaceInfo, progressCallback func(int, int), uploadedCallback func(models.ChunkReplica)) ([]models.ChunkMetadata, error) {
+	if order == nil {
+		order = make([]int, len(assignments))
+		for i := range order {
+			order[i] = i
+		}
+	}
+	if len(order) != len(assignments) {
+		return nil, fmt.Errorf("mismatch: upload order has %d chunks but %d assigned chunks", len(order), len(assignments))
 	}
 
-	chunkMetadata := make([]models.ChunkMetadata, 0, len(plan))
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pool := newFailoverPool(drives, assignments)
 
-	for i, chunkPath := range chunkPaths {
-		if progressCallback != nil {
-			progressCallback(i+1, len(chunkPaths))
-		}
+	chunkMetadata := make([]models.ChunkMetadata, len(assignments))
+	var (
+		mu       sync.Mutex
+		uploaded []models.ChunkReplica
+		errs     []error
+		done     int
+	)
 
-		chunk := plan[i]
-		filename := fmt.Sprintf("chunk_%03d.2xpfm", chunk.ChunkID)
+	recordReplica := func(replica models.ChunkReplica) {
+		mu.Lock()
+		uploaded = append(uploaded, replica)
+		mu.Unlock()
+		if uploadedCallback != nil {
+			uploadedCallback(replica)
+		}
+	}
 
-		// Upload to drive
-		driveFileID, err := UploadChunkToDrive(ctx, chunk.DriveAccountID, chunkPath, filename)
-		if err != nil {
-			// Cleanup on error: delete already uploaded chunks
-			for j := 0; j < i; j++ {
-				// Best effort cleanup
-				DeleteDriveFile(ctx, plan[j].DriveAccountID, chunkMetadata[j].DriveFileID)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(uploadConcurrency, len(assignments)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				metadata, err := uploadChunk(uploadCtx, pool, chunkPaths[i], assignments[i], recordReplica)
+
+				mu.Lock()
+				switch {
+				case err == nil:
+					chunkMetadata[i] = metadata
+					done++
+					// Called under the lock so progress is reported in order
+					if progressCallback != nil {
+						progressCallback(done, len(assignments))
+					}
+				case len(errs) > 0 && errors.Is(err, context.Canceled):
+					// Cancelled because another chunk already failed
+				default:
+					errs = append(errs, err)
+					cancel()
+				}
+				mu.Unlock()
 			}
-			return nil, fmt.Errorf("failed to upload chunk %d: %w", chunk.ChunkID, err)
-		}
+		}()
+	}
 
-		// Calculate checksum
-		checksum, err := calculateFileChecksum(chunkPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to calculate checksum for chunk %d: %w", chunk.ChunkID, err)
+feed:
+	for _, i := range order {
+		select {
+		case jobs <- i:
+		case <-uploadCtx.Done():
+			break feed
 		}
+	}
+	close(jobs)
+	wg.Wait()
 
-		metadata := models.ChunkMetadata{
-			ChunkID:        chunk.ChunkID,
-			DriveAccountID: chunk.DriveAccountID.Hex(),
-			DriveFileID:    driveFileID,
-			Filename:       filename,
-			StartOffset:    chunk.StartOffset,
-			EndOffset:      chunk.EndOffset,
-			Size:           chunk.Size,
-			Checksum:       checksum,
+	if len(errs) == 0 && ctx.Err() != nil {
+		errs = append(errs, ctx.Err())
+	}
+	if len(errs) > 0 {
+		// Delete every replica uploaded so far, even if ctx was cancelled
+		cleanupCtx := context.WithoutCancel(ctx)
+		for _, r := range uploaded {
+			// Best effort cleanup
+			DeleteDriveFile(cleanupCtx, r.DriveAccountID, r.DriveFileID)
 		}
-
-		chunkMetadata = append(chunkMetadata, metadata)
+		return nil, errors.Join(errs...)
 	}
 
 	return chunkMetadata, nil
 }
 
-// DeleteDriveFile deletes a file from Google Drive
-func DeleteDriveFile(ctx context.Context, accountID primitive.ObjectID, fileID string) error {
-	// Get drive account
-	account, err := store.GetDriveAccountByID(ctx, accountID)
+// uploadChunk uploads a copy of one chunk to every drive of its assignment, the same file to
+// all of them or, given a file per drive, each drive's shard
+func uploadChunk(ctx context.Context, pool *failoverPool, chunkPaths []string, chunk models.ChunkAssignment, uploadedCallback func(models.ChunkReplica)) (models.ChunkMetadata, error) {
+	if len(chunk.DriveAccountIDs) == 0 {
+		return models.ChunkMetadata{}, fmt.Errorf("chunk %d has no drive assigned", chunk.ChunkID)
+	}
+	filename := chunk.Filename
+	if filename == "" {
+		filename = fmt.Sprintf("chunk_%03d.2xpfm", chunk.ChunkID)
+	}
+
+	info, err := os.Stat(chunkPaths[0])
 	if err != nil {
-		return err
+		return models.ChunkMetadata{}, fmt.Errorf("failed to stat chunk %d: %w", chunk.ChunkID, err)
 	}
+	sharded := len(chunkPaths) > 1
+
+	replicas := make([]models.ChunkReplica, 0, len(chunk.DriveAccountIDs))
+	for i, accountID := range chunk.DriveAccountIDs {
+		chunkPath := chunkPaths[0]
+		if sharded {
+			chunkPath = chunkPaths[i]
+		}
+		// A copy can't fail over to a drive holding another copy of the chunk
+		holders := make([]primitive.ObjectID, 0, len(chunk.DriveAccountIDs))
+		for _, r := range replicas {
+			holders = append(holders, r.DriveAccountID)
+		}
+		holders = append(holders, chunk.DriveAccountIDs[i+1:]...)
+		start := time.Now()
+		replica, err := uploadCopy(ctx, pool, chunk.ChunkID, accountID, holders, chunkPath, filename, info.Size())
+		if err == nil {
+			metrics.ChunkUploadDuration.Since(start)
+		}
+		if err != nil {
+			return models.ChunkMetadata{}, err
+		}
+		if sharded {
+			replica.Shard = i + 1
+		}
+		replicas = append(replicas, replica)
+		uploadedCallback(replica)
+	}
+
+	return models.ChunkMetadata{
+		ChunkID:        chunk.ChunkID,
+		DriveAccountID: replicas[0].DriveAccountID.Hex(),
+		DriveFileID:    replicas[0].DriveFileID,
+		Filename:       filename,
+		StartOffset:    chunk.StartOffset,
+		EndOffset:      chunk.EndOffset,
+		Size:           chunk.Size,
+		StoredSize:     info.Size(),
+		Replicas:       replicas,
+	}, nil
+}
 
-	// Decrypt OAuth token
-	tokenData, err := oauth.Decrypt(account.EncryptedToken)
+// DeleteDriveFile deletes a file from a linked account
+func DeleteDriveFile(ctx context.Context, accountID primitive.ObjectID, fileID string) error {
+	backend, _, err := backendForAccount(ctx, accountID)
 	if err != nil {
 		return err
 	}
-
-	var token oauth2.Token
-	if err := json.Unmarshal(tokenData, &token); err != nil {
+	if err := backend.Delete(ctx, fileID); err != nil {
 		return err
 	}
 
-	// Create HTTP client with auto-refresh
-	client := oauth.NewClient(ctx, &token)
+	InvalidateDriveSpace(accountID)
+	return nil
+}
 
-	// Delete file
+// deleteDriveFile deletes a file from Google Drive
+func deleteDriveFile(ctx context.Context, client *http.Client, fileID string) error {
 	deleteURL := fmt.Sprintf("https://www.googleapis.com/drive/v3/files/%s", fileID)
-	req, err := http.NewRequest("DELETE", deleteURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "DELETE", deleteURL, nil)
 	if err != nil {
 		return err
 	}
@@ -280,24 +376,13 @@ func DeleteDriveFile(ctx context.Context, accountID primitive.ObjectID, fileID s
 	}
 	defer resp.Body.Close()
 
+	// A file that is already gone counts as deleted
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
 	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("failed to delete file, status: %d", resp.StatusCode)
 	}
-
 	return nil
 }
-
-func calculateFileChecksum(filePath string) (string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", err
-	}
-
-	return fmt.Sprintf("%x", hash.Sum(nil)), nil
-}
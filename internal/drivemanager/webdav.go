@@ -0,0 +1,248 @@
+package drivemanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// WebDAVConfig is a linked WebDAV folder, stored encrypted in the account
+type WebDAVConfig struct {
+	URL        string `json:"url"` // Folder everything is stored in
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password,omitempty"`
+	QuotaBytes int64  `json:"quota_bytes,omitempty"` // Used when the server doesn't report a quota
+}
+
+// webDAVBackend stores objects as files in a WebDAV folder. Chunks get a file of their own
+// under chunks/, files written with Write keep their name. IDs are paths relative to the folder.
+type webDAVBackend struct {
+	config  WebDAVConfig
+	baseURL *url.URL
+}
+
+// NewWebDAVBackend checks a WebDAV config and returns its backend
+func NewWebDAVBackend(config WebDAVConfig) (StorageBackend, error) {
+	base, err := url.Parse(config.URL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, errors.New("url must be an http or https URL")
+	}
+	if config.QuotaBytes < 0 {
+		return nil, errors.New("quota_bytes can't be negative")
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	return &webDAVBackend{config: config, baseURL: base}, nil
+}
+
+func (b *webDAVBackend) Put(ctx context.Context, name, filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	// 405 means the collection exists already
+	req, err := b.request(ctx, "MKCOL", "chunks/", nil)
+	if err != nil {
+		return "", err
+	}
+	if err := b.do(req, nil, http.StatusCreated, http.StatusMethodNotAllowed); err != nil {
+		return "", err
+	}
+
+	id := "chunks/" + primitive.NewObjectID().Hex() + "_" + name
+	req, err = b.request(ctx, "PUT", id, file)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = info.Size()
+	if err := b.do(req, nil, http.StatusCreated, http.StatusNoContent, http.StatusOK); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (b *webDAVBackend) Get(ctx context.Context, id string, w io.Writer) (int64, error) {
+	req, err := b.request(ctx, "GET", id, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := backendClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("webdav request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, webDAVError(resp)
+	}
+	return io.Copy(w, resp.Body)
+}
+
+func (b *webDAVBackend) Delete(ctx context.Context, id string) error {
+	req, err := b.request(ctx, "DELETE", id, nil)
+	if err != nil {
+		return err
+	}
+	return b.do(req, nil, http.StatusNoContent, http.StatusOK, http.StatusNotFound)
+}
+
+func (b *webDAVBackend) Exists(ctx context.Context, id string) (bool, error) {
+	req, err := b.request(ctx, "HEAD", id, nil)
+	if err != nil {
+		return false, err
+	}
+	return headExists(req, "webdav")
+}
+
+// Quota uses the RFC 4331 quota properties of the folder, falling back to the configured
+// quota when the server doesn't report them
+func (b *webDAVBackend) Quota(ctx context.Context) (*BackendQuota, error) {
+	responses, err := b.propfind(ctx, "", "0")
+	if err != nil {
+		return nil, err
+	}
+	quota := &BackendQuota{Limit: b.config.QuotaBytes, OwnerName: b.config.Username}
+	if len(responses) == 0 {
+		return quota, nil
+	}
+
+	prop := responses[0].Prop
+	if prop.QuotaUsed != nil {
+		quota.Usage = *prop.QuotaUsed
+	}
+	if prop.QuotaAvailable != nil && *prop.QuotaAvailable >= 0 && b.config.QuotaBytes == 0 {
+		quota.Limit = quota.Usage + *prop.QuotaAvailable
+	}
+	if quota.Limit == 0 {
+		return nil, errors.New("webdav server reports no quota, quota_bytes is required")
+	}
+	return quota, nil
+}
+
+func (b *webDAVBackend) FindByPrefix(ctx context.Context, prefix string) (map[string]string, error) {
+	responses, err := b.propfind(ctx, "", "1")
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string)
+	for _, r := range responses {
+		if r.Prop.ResourceType.Collection != nil {
+			continue
+		}
+		href, err := url.PathUnescape(r.Href)
+		if err != nil {
+			continue
+		}
+		name := path.Base(href)
+		if strings.HasPrefix(name, prefix) {
+			files[name] = name
+		}
+	}
+	return files, nil
+}
+
+func (b *webDAVBackend) Write(ctx context.Context, id, name string, data []byte) (string, error) {
+	if id == "" {
+		id = name
+	}
+	req, err := b.request(ctx, "PUT", id, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	if err := b.do(req, nil, http.StatusCreated, http.StatusNoContent, http.StatusOK); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+type webDAVMultistatus struct {
+	Responses []webDAVResponse `xml:"DAV: response"`
+}
+
+type webDAVResponse struct {
+	Href string `xml:"DAV: href"`
+	Prop struct {
+		ResourceType struct {
+			Collection *struct{} `xml:"DAV: collection"`
+		} `xml:"DAV: resourcetype"`
+		QuotaUsed      *int64 `xml:"DAV: quota-used-bytes"`
+		QuotaAvailable *int64 `xml:"DAV: quota-available-bytes"`
+	} `xml:"DAV: propstat>prop"`
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:quota-used-bytes/><d:quota-available-bytes/></d:prop></d:propfind>`
+
+func (b *webDAVBackend) propfind(ctx context.Context, id, depth string) ([]webDAVResponse, error) {
+	req, err := b.request(ctx, "PROPFIND", id, strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	var result webDAVMultistatus
+	if err := b.do(req, &result, http.StatusMultiStatus); err != nil {
+		return nil, err
+	}
+	return result.Responses, nil
+}
+
+// do sends a request, decoding an XML response into out when given
+func (b *webDAVBackend) do(req *http.Request, out interface{}, okStatuses ...int) error {
+	resp, err := backendClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("webdav request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	for _, status := range okStatuses {
+		if resp.StatusCode == status {
+			if out != nil {
+				if err := xml.NewDecoder(resp.Body).Decode(out); err != nil {
+					return fmt.Errorf("failed to decode webdav response: %w", err)
+				}
+			}
+			return nil
+		}
+	}
+	return webDAVError(resp)
+}
+
+// webDAVError is the error of a failed response. Its body is only logged, the error can reach
+// the user who set the server up, who shouldn't read whatever it answers.
+func webDAVError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	log.Printf("WebDAV %s %s returned status %d: %s", resp.Request.Method, resp.Request.URL.Redacted(), resp.StatusCode, body)
+	return quotaError(resp.StatusCode, string(body), fmt.Errorf("webdav returned status %d", resp.StatusCode))
+}
+
+// request builds a request for id relative to the folder
+func (b *webDAVBackend) request(ctx context.Context, method, id string, body io.Reader) (*http.Request, error) {
+	target := b.baseURL.ResolveReference(&url.URL{Path: id})
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if b.config.Username != "" {
+		req.SetBasicAuth(b.config.Username, b.config.Password)
+	}
+	return req, nil
+}
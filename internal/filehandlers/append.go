@@ -0,0 +1,189 @@
+package filehandlers
+
+import (
+	"SE/internal/audit"
+	"SE/internal/fileprocessor"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AppendFileHandler - POST /api/files/{file_id}/append
+// Adds the content of a completed upload session to the end of a content-defined file. The
+// existing chunks stay where they are and only the appended bytes are uploaded, as new chunks.
+// Processing runs in the background like finalize, reporting progress on the session.
+func AppendFileHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	fileID, err := primitive.ObjectIDFromHex(r.PathValue("file_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid file_id")
+		return
+	}
+
+	var req struct {
+		SessionID    string                  `json:"session_id"`
+		Distribution models.DistributionMode `json:"distribution_strategy,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		middleware.WriteDecodeError(w, err, "invalid request")
+		return
+	}
+	sessionID, err := primitive.ObjectIDFromHex(req.SessionID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid session_id")
+		return
+	}
+	if _, err := fileprocessor.GetDistributionStrategy(req.Distribution); err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get file")
+		return
+	}
+	if file == nil || file.Status == "deleted" {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "file not found")
+		return
+	}
+	if file.UserID != userID {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, "unauthorized")
+		return
+	}
+	if file.Status != "active" {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, fmt.Sprintf("file is %s, only active files can be appended to", file.Status))
+		return
+	}
+	if file.ClientEncryption != nil {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "client-encrypted files can't be appended to")
+		return
+	}
+	// Chunks of the other strategies are cut and obfuscated across the whole file, new bytes
+	// can't be added after them
+	if file.Obfuscation.Chunking != models.StrategyContentDefined {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "only content-defined files can be appended to, update the file once to convert it")
+		return
+	}
+
+	session, err := fileprocessor.GetSession(r.Context(), sessionID, userID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if session.ClientEncryption != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "appended content can't be client-encrypted")
+		return
+	}
+	if session.Status != "uploading" {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, fmt.Sprintf("session is already %s", session.Status))
+		return
+	}
+	if !checkUploadComplete(w, session) {
+		return
+	}
+
+	release, err := fileprocessor.LockFile(r.Context(), fileID, "append")
+	if err != nil {
+		writeLockError(w, err)
+		return
+	}
+
+	log.Printf("Appending session %s to file %s", sessionID.Hex(), fileID.Hex())
+
+	claimed, err := fileprocessor.ClaimSessionForProcessing(r.Context(), sessionID, "Starting...")
+	if err != nil {
+		release()
+		log.Printf("Failed to update status to processing: %v", err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to update status")
+		return
+	}
+	if !claimed {
+		release()
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "session is already being finalized")
+		return
+	}
+
+	// Tracked before the goroutine starts so a shutdown can't miss it
+	done := fileprocessor.BeginProcessing(sessionID)
+
+	ctx := middleware.WithRequestID(context.Background(), middleware.GetRequestID(r.Context()))
+	ctx = audit.WithClientIP(ctx, r)
+	ctx = fileprocessor.WithUserBandwidth(ctx, userID)
+	processReq := models.ProcessRequest{
+		SessionID:    req.SessionID,
+		Strategy:     models.StrategyContentDefined,
+		Distribution: req.Distribution,
+	}
+	go func() {
+		defer done()
+		defer release()
+		defer fileprocessor.ScheduleCleanup(ctx, sessionID)
+		if file.ChecksumState == nil {
+			fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 2, "Hashing existing content...")
+			state, err := checksumState(ctx, file)
+			if err != nil {
+				log.Printf("Processing session %s failed: %v", sessionID.Hex(), err)
+				fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 2, fmt.Sprintf("Failed to hash existing content: %v", err))
+				return
+			}
+			file.ChecksumState = state
+		}
+		processContentDefined(ctx, session, processReq, userID, file, true)
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "append started",
+		"file_id":    fileID.Hex(),
+		"session_id": sessionID.Hex(),
+		"status_url": fmt.Sprintf("%s/files/upload/status/%s", middleware.APIPrefix, sessionID.Hex()),
+	})
+}
+
+// checksumState returns the checksum state after the file's content, for files stored before
+// the state was kept. The file is reconstructed unless a recent download session of the owner
+// still has it on disk, and its checksum checked against the stored one.
+func checksumState(ctx context.Context, file *models.StoredFile) ([]byte, error) {
+	session, err := store.FindReusableDownloadSession(ctx, file.UserID, file.ID)
+	if err != nil {
+		log.Printf("Failed to look up download session: %v", err)
+	}
+	reuse := session != nil && session.Checksum == file.OriginalChecksum && fileprocessor.ReconstructionAvailable(session)
+
+	if !reuse {
+		session, err = fileprocessor.CreateDownloadSession(ctx, file.UserID, file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create download session: %w", err)
+		}
+		defer fileprocessor.BeginReconstruction(session.ID)()
+		if err := reconstructSession(ctx, session, file); err != nil {
+			return nil, err
+		}
+		defer os.Remove(session.ReconstructedPath)
+	}
+
+	f, err := fileprocessor.OpenDownloadFile(session, session.ReconstructedPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open reconstructed file: %w", err)
+	}
+	defer f.Close()
+
+	checksum, state, err := fileprocessor.ContinueChecksumReader(f, nil)
+	if err != nil {
+		return nil, err
+	}
+	if checksum != file.OriginalChecksum {
+		return nil, fmt.Errorf("reconstructed content doesn't match checksum %s", file.OriginalChecksum)
+	}
+	return state, nil
+}
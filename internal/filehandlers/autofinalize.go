@@ -0,0 +1,57 @@
+package filehandlers
+
+import (
+	"SE/internal/fileprocessor"
+	"SE/internal/models"
+	"context"
+	"log"
+	"time"
+)
+
+// StartAutoFinalizer finalizes the sessions that received every chunk but weren't finalized
+// within FINALIZE_TIMEOUT_MINUTES, one at a time, until ctx is done. It does nothing unless
+// FINALIZE_TIMEOUT_ACTION is finalize, the session sweeper marks them stale otherwise.
+func StartAutoFinalizer(ctx context.Context) {
+	if !fileprocessor.AutoFinalizeEnabled() {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(fileprocessor.AutoFinalizeInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			for ctx.Err() == nil {
+				session, err := fileprocessor.ClaimOverdueSession(ctx)
+				if err != nil {
+					log.Printf("Auto-finalize failed: %v", err)
+					break
+				}
+				if session == nil {
+					break
+				}
+				autoFinalize(session)
+			}
+		}
+	}()
+}
+
+// autoFinalize processes a claimed overdue session into a new file, like a finalize with the
+// balanced strategy would
+func autoFinalize(session *models.UploadSession) {
+	// Like a finalize, the processing isn't cut short by a shutdown but waited for
+	done := fileprocessor.BeginProcessing(session.ID)
+	defer done()
+	ctx := fileprocessor.WithUserBandwidth(context.Background(), session.UserID)
+	log.Printf("Auto-finalizing session %s, not finalized in time", session.ID.Hex())
+
+	req := fileprocessor.AutoFinalizeRequest(session)
+	if err := fileprocessor.StartUploadAttempt(ctx, session.ID, req); err != nil {
+		log.Printf("Failed to record the attempt of session %s: %v", session.ID.Hex(), err)
+	}
+	processAndUploadFile(ctx, session, req, session.UserID)
+}
@@ -0,0 +1,131 @@
+package filehandlers
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Concurrent metadata checks of one chunk listing
+const chunkCheckConcurrency = 8
+
+type chunkReplicaInfo struct {
+	DriveAccountID string `json:"drive_id"`
+	DriveFileID    string `json:"drive_file_id"`
+	Backend        string `json:"backend"`
+	Shard          int    `json:"shard,omitempty"` // Erasure-coded shard held instead of a full copy
+	Reachable      bool   `json:"reachable"`
+	Error          string `json:"error,omitempty"`
+}
+
+type chunkInfo struct {
+	ChunkID      int                `json:"chunk_id"`
+	Size         int64              `json:"size"`
+	StoredSize   int64              `json:"stored_size"`
+	Checksum     string             `json:"checksum"`
+	ChecksumAlgo string             `json:"checksum_algo"`
+	StartOffset  int64              `json:"start_offset"`
+	EndOffset    int64              `json:"end_offset"`
+	Reachable    bool               `json:"reachable"` // At least one replica, or enough shards to rebuild it, is still on its drive
+	Replicas     []chunkReplicaInfo `json:"replicas"`
+}
+
+// FileChunksHandler - GET /api/files/:file_id/chunks
+// Lists where every chunk of a file is stored, checking each replica is still on its drive
+func FileChunksHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	fileID, err := primitive.ObjectIDFromHex(r.PathValue("file_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid file_id")
+		return
+	}
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get file")
+		return
+	}
+	if file == nil || file.Status == "deleted" {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "file not found")
+		return
+	}
+	if file.UserID != userID {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, "unauthorized")
+		return
+	}
+
+	chunks := make([]chunkInfo, len(file.Chunks))
+	sem := make(chan struct{}, chunkCheckConcurrency)
+	var wg sync.WaitGroup
+	for i := range file.Chunks {
+		chunk := &file.Chunks[i]
+		chunks[i] = chunkInfo{
+			ChunkID:      chunk.ChunkID,
+			Size:         chunk.Size,
+			StoredSize:   chunk.StoredSize,
+			Checksum:     chunk.Checksum,
+			ChecksumAlgo: chunk.ChecksumAlgo,
+			StartOffset:  chunk.StartOffset,
+			EndOffset:    chunk.EndOffset,
+			Replicas:     make([]chunkReplicaInfo, len(chunk.Replicas)),
+		}
+		for j, replica := range chunk.Replicas {
+			info := &chunks[i].Replicas[j]
+			info.DriveAccountID = replica.DriveAccountID.Hex()
+			info.DriveFileID = replica.DriveFileID
+			info.Backend = replica.Backend
+			info.Shard = replica.Shard
+			if info.Backend == "" {
+				info.Backend = models.ProviderGoogle
+			}
+
+			wg.Add(1)
+			go func(replica models.ChunkReplica) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				reachable, err := drivemanager.DriveFileExists(r.Context(), replica.DriveAccountID, replica.DriveFileID)
+				info.Reachable = reachable
+				if err != nil {
+					info.Error = err.Error()
+				}
+			}(replica)
+		}
+	}
+	wg.Wait()
+
+	unreachable := 0
+	for i := range chunks {
+		// A sharded chunk needs as many shards as the coding has data shards, a copied one any copy
+		needed := 1
+		if file.Chunks[i].Sharded() && file.ErasureCoding != nil {
+			needed = file.ErasureCoding.DataShards
+		}
+		reachable := 0
+		for _, replica := range chunks[i].Replicas {
+			if replica.Reachable {
+				reachable++
+			}
+		}
+		chunks[i].Reachable = reachable >= needed
+		if !chunks[i].Reachable {
+			unreachable++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"file_id":           fileID.Hex(),
+		"chunks":            chunks,
+		"chunk_count":       len(chunks),
+		"unreachable_count": unreachable,
+	})
+}
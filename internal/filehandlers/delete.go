@@ -0,0 +1,267 @@
+package filehandlers
+
+import (
+	"SE/internal/audit"
+	"SE/internal/fileprocessor"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DeleteFileHandler - DELETE /api/files/:file_id?permanent=
+// Moves the file to the trash, or deletes its chunks right away with permanent=true
+func DeleteFileHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	fileID, err := primitive.ObjectIDFromHex(r.PathValue("file_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid file_id")
+		return
+	}
+	permanent := r.URL.Query().Get("permanent") == "true"
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get file")
+		return
+	}
+	if file == nil || file.Status == "deleted" {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "file not found")
+		return
+	}
+
+	// Verify ownership
+	if file.UserID != userID {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, "unauthorized")
+		return
+	}
+
+	result, changed, err := deleteFile(r.Context(), file, permanent)
+	if err != nil {
+		switch {
+		case errors.Is(err, errFileGone):
+			middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "file not found")
+		case errors.Is(err, fileprocessor.ErrFileLocked):
+			writeLockError(w, err)
+		default:
+			middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to update file")
+		}
+		return
+	}
+	if changed {
+		audit.Record(r, userID, models.AuditFileDeleted, map[string]string{"file_id": fileID.Hex(), "permanent": strconv.FormatBool(result["status"] != "trashed")})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// errFileGone is returned by deleteFile for a file deleted while it waited for the file's lock
+var errFileGone = errors.New("file not found")
+
+// writeLockError answers a request whose file couldn't be locked, 409 while another operation
+// holds the lock
+func writeLockError(w http.ResponseWriter, err error) {
+	if errors.Is(err, fileprocessor.ErrFileLocked) {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, err.Error())
+		return
+	}
+	log.Printf("Failed to lock file: %v", err)
+	middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to lock file")
+}
+
+// deleteFile moves the file to the trash, or deletes its chunks with permanent, and returns
+// the response describing it. It reports false for a file that was in the trash already. The
+// file is read again once it's locked, so what's deleted is what the operation before left.
+func deleteFile(ctx context.Context, file *models.StoredFile, permanent bool) (map[string]interface{}, bool, error) {
+	unlock, err := fileprocessor.LockFile(ctx, file.ID, "delete")
+	if err != nil {
+		return nil, false, err
+	}
+	defer unlock()
+
+	file, err = store.GetStoredFile(ctx, file.ID)
+	if err != nil {
+		log.Printf("Failed to get file: %v", err)
+		return nil, false, err
+	}
+	if file == nil || file.Status == "deleted" {
+		return nil, false, errFileGone
+	}
+
+	// A partially deleted file is past the trash, deleting it again retries the leftovers
+	if permanent || file.Status == "partially_deleted" {
+		status, orphaned, err := fileprocessor.DeleteFileChunks(ctx, file)
+		if err != nil {
+			log.Printf("Failed to record deletion of file %s: %v", file.ID.Hex(), err)
+			return nil, false, err
+		}
+		return map[string]interface{}{
+			"file_id":         file.ID.Hex(),
+			"status":          status,
+			"orphaned_chunks": orphaned,
+		}, true, nil
+	}
+
+	changed := file.Status != "trashed"
+	if changed {
+		if _, err := fileprocessor.TrashFile(ctx, file); err != nil {
+			log.Printf("Failed to trash file %s: %v", file.ID.Hex(), err)
+			return nil, false, err
+		}
+	}
+	return map[string]interface{}{
+		"file_id":       file.ID.Hex(),
+		"status":        file.Status,
+		"trashed_at":    file.TrashedAt,
+		"restore_until": fileprocessor.TrashRestoreDeadline(file),
+	}, changed, nil
+}
+
+// maxBulkDeleteFiles caps the file IDs of one bulk delete request
+const maxBulkDeleteFiles = 100
+
+// BulkDeleteFilesHandler - POST /api/files/delete
+// Deletes each file like DeleteFileHandler, one failing doesn't stop the others
+func BulkDeleteFilesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var req struct {
+		FileIDs   []string `json:"file_ids"`
+		Permanent bool     `json:"permanent"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		middleware.WriteDecodeError(w, err, "invalid request")
+		return
+	}
+	if len(req.FileIDs) == 0 {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "file_ids is required")
+		return
+	}
+	if len(req.FileIDs) > maxBulkDeleteFiles {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, fmt.Sprintf("at most %d file_ids per request", maxBulkDeleteFiles))
+		return
+	}
+
+	results := make([]map[string]interface{}, 0, len(req.FileIDs))
+	counts := make(map[string]int)
+	changed := make([]string, 0, len(req.FileIDs))
+	seen := make(map[string]bool, len(req.FileIDs))
+	for _, idStr := range req.FileIDs {
+		if seen[idStr] {
+			continue
+		}
+		seen[idStr] = true
+
+		result, ok := bulkDeleteFile(r.Context(), userID, idStr, req.Permanent)
+		if ok {
+			changed = append(changed, idStr)
+		}
+		counts[result["status"].(string)]++
+		results = append(results, result)
+	}
+
+	details := map[string]string{
+		"permanent": strconv.FormatBool(req.Permanent),
+		"file_ids":  strings.Join(changed, ","),
+	}
+	for status, n := range counts {
+		details[status] = strconv.Itoa(n)
+	}
+	audit.Record(r, userID, models.AuditFilesDeleted, details)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results": results,
+		"summary": counts,
+	})
+}
+
+// bulkDeleteFile deletes one file of a bulk delete, reporting files that are malformed,
+// unknown or another user's as not_found and a deletion that couldn't be recorded as failed.
+// It reports whether the file was changed.
+func bulkDeleteFile(ctx context.Context, userID primitive.ObjectID, idStr string, permanent bool) (map[string]interface{}, bool) {
+	fileID, err := primitive.ObjectIDFromHex(idStr)
+	if err != nil {
+		return map[string]interface{}{"file_id": idStr, "status": "not_found"}, false
+	}
+	file, err := store.GetStoredFile(ctx, fileID)
+	if err != nil {
+		log.Printf("Failed to get file %s: %v", idStr, err)
+		return map[string]interface{}{"file_id": idStr, "status": "failed", "error": "failed to get file"}, false
+	}
+	if file == nil || file.Status == "deleted" || file.UserID != userID {
+		return map[string]interface{}{"file_id": idStr, "status": "not_found"}, false
+	}
+
+	result, changed, err := deleteFile(ctx, file, permanent)
+	switch {
+	case errors.Is(err, errFileGone):
+		return map[string]interface{}{"file_id": idStr, "status": "not_found"}, false
+	case errors.Is(err, fileprocessor.ErrFileLocked):
+		return map[string]interface{}{"file_id": idStr, "status": "failed", "error": err.Error()}, false
+	case err != nil:
+		return map[string]interface{}{"file_id": idStr, "status": "failed", "error": "failed to update file"}, false
+	}
+	return result, changed
+}
+
+// RestoreFileHandler - POST /api/files/:file_id/restore
+func RestoreFileHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	fileID, err := primitive.ObjectIDFromHex(r.PathValue("file_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid file_id")
+		return
+	}
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get file")
+		return
+	}
+	if file == nil || file.Status == "deleted" {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "file not found")
+		return
+	}
+	if file.UserID != userID {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, "unauthorized")
+		return
+	}
+	if file.Status != "trashed" {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "file is not in the trash")
+		return
+	}
+
+	if err := fileprocessor.RestoreFile(r.Context(), file); err != nil {
+		if errors.Is(err, fileprocessor.ErrTrashExpired) {
+			middleware.WriteJSONError(w, http.StatusGone, middleware.ErrCodeGone, err.Error())
+			return
+		}
+		log.Printf("Failed to restore file %s: %v", fileID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to restore file")
+		return
+	}
+
+	status := file.TrashedFrom
+	if status == "" {
+		status = "active"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"file_id": fileID.Hex(),
+		"status":  status,
+	})
+}
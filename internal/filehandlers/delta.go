@@ -0,0 +1,601 @@
+package filehandlers
+
+import (
+	"SE/internal/audit"
+	"SE/internal/drivemanager"
+	"SE/internal/fileprocessor"
+	"SE/internal/manifest"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UpdateFileHandler - POST /api/files/:file_id/update
+// Replaces the file's content with a fully uploaded session's. The new content is cut into
+// content-defined chunks, and of a file stored that way only the chunks that changed are uploaded.
+func UpdateFileHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	fileID, err := primitive.ObjectIDFromHex(r.PathValue("file_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid file_id")
+		return
+	}
+
+	var req struct {
+		SessionID    string                  `json:"session_id"`
+		Distribution models.DistributionMode `json:"distribution_strategy,omitempty"`
+		Thumbnail    bool                    `json:"thumbnail,omitempty"` // The previous content's thumbnail is dropped either way
+		Metadata     bool                    `json:"metadata,omitempty"`  // Re-read from the new content, dropped when false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		middleware.WriteDecodeError(w, err, "invalid request")
+		return
+	}
+	sessionID, err := primitive.ObjectIDFromHex(req.SessionID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid session_id")
+		return
+	}
+	if _, err := fileprocessor.GetDistributionStrategy(req.Distribution); err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get file")
+		return
+	}
+	if file == nil || file.Status == "deleted" {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "file not found")
+		return
+	}
+	if file.UserID != userID {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, "unauthorized")
+		return
+	}
+	if file.Status != "active" {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, fmt.Sprintf("file is %s, only active files can be updated", file.Status))
+		return
+	}
+	// The server can't see which parts of client ciphertext changed
+	if file.ClientEncryption != nil {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "client-encrypted files can't be updated in place")
+		return
+	}
+
+	session, err := fileprocessor.GetSession(r.Context(), sessionID, userID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if session.ClientEncryption != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "the new content of a file can't be client-encrypted")
+		return
+	}
+	if session.Status != "uploading" {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, fmt.Sprintf("session is already %s", session.Status))
+		return
+	}
+	if !checkUploadComplete(w, session) {
+		return
+	}
+
+	release, err := fileprocessor.LockFile(r.Context(), fileID, "update")
+	if err != nil {
+		writeLockError(w, err)
+		return
+	}
+
+	log.Printf("Updating file %s from session %s", fileID.Hex(), sessionID.Hex())
+
+	claimed, err := fileprocessor.ClaimSessionForProcessing(r.Context(), sessionID, "Starting...")
+	if err != nil {
+		release()
+		log.Printf("Failed to update status to processing: %v", err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to update status")
+		return
+	}
+	if !claimed {
+		release()
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "session is already being finalized")
+		return
+	}
+
+	// Tracked before the goroutine starts so a shutdown can't miss it
+	done := fileprocessor.BeginProcessing(sessionID)
+
+	ctx := middleware.WithRequestID(context.Background(), middleware.GetRequestID(r.Context()))
+	ctx = audit.WithClientIP(ctx, r)
+	ctx = fileprocessor.WithUserBandwidth(ctx, userID)
+	processReq := models.ProcessRequest{
+		SessionID:    req.SessionID,
+		Strategy:     models.StrategyContentDefined,
+		Distribution: req.Distribution,
+		Thumbnail:    req.Thumbnail,
+		Metadata:     req.Metadata,
+	}
+	go func() {
+		defer done()
+		defer release()
+		defer fileprocessor.ScheduleCleanup(ctx, sessionID)
+		processContentDefined(ctx, session, processReq, userID, file, false)
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "update started",
+		"file_id":    fileID.Hex(),
+		"session_id": sessionID.Hex(),
+		"status_url": fmt.Sprintf("%s/files/upload/status/%s", middleware.APIPrefix, sessionID.Hex()),
+	})
+}
+
+// processContentDefined stores the session's file in content-defined chunks. With existing set
+// the file becomes existing's new content: chunks of existing whose content is unchanged are
+// kept where they are, only the others are uploaded, and chunks no longer used are deleted.
+// Appending keeps every chunk of existing, a content-defined file, and adds the session's
+// bytes after them as new chunks.
+func processContentDefined(ctx context.Context, session *models.UploadSession, req models.ProcessRequest, userID primitive.ObjectID, existing *models.StoredFile, appending bool) {
+	sessionID := session.ID
+	fail := func(progress float64, format string, args ...interface{}) {
+		message := fmt.Sprintf(format, args...)
+		log.Printf("Processing session %s failed: %s", sessionID.Hex(), message)
+		fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", progress, message)
+	}
+
+	// Step 1: Checksum the assembled original file (5%)
+	fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 5, "Computing checksum...")
+	// Appended bytes are hashed onto the state of the content before them
+	var checksumState []byte
+	totalSize := session.TotalSize
+	if appending {
+		checksumState = existing.ChecksumState
+		totalSize += existing.OriginalSize
+	}
+	originalChecksum, checksumState, err := fileprocessor.ContinueChecksum(session.TempFilePath, checksumState)
+	if err != nil {
+		fail(5, "Failed to compute checksum: %v", err)
+		return
+	}
+
+	// Step 2: Seed and data key (10%). Chunks of a content-defined file can only be kept with
+	// the seed their names and noise come from and the key they were encrypted with.
+	fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 10, "Preparing keys...")
+	keep := existing != nil && existing.Obfuscation.Chunking == models.StrategyContentDefined
+
+	var seed []byte
+	var obfMetadata *models.ObfuscationMetadata
+	if keep {
+		metadata := existing.Obfuscation
+		obfMetadata = &metadata
+		seed, err = base64.StdEncoding.DecodeString(metadata.Seed)
+	} else {
+		seed, err = fileprocessor.GenerateObfuscationSeed()
+		obfMetadata = fileprocessor.NewContentDefinedObfuscation(seed)
+	}
+	if err != nil {
+		fail(10, "Failed to prepare obfuscation seed: %v", err)
+		return
+	}
+
+	var dataKey []byte
+	var encMetadata *models.EncryptionMetadata
+	switch {
+	case keep && existing.Encryption != nil:
+		dataKey, err = fileprocessor.UnwrapDataKey(existing.Encryption)
+		encMetadata = existing.Encryption
+	case session.ClientEncryption == nil:
+		dataKey, err = fileprocessor.GenerateDataKey()
+		if err == nil {
+			encMetadata, err = fileprocessor.NewEncryptionMetadata(dataKey)
+		}
+	}
+	if err != nil {
+		fail(10, "Failed to prepare data key: %v", err)
+		return
+	}
+
+	// Step 3: Find the chunk boundaries (20%)
+	fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 20, "Finding chunk boundaries...")
+	contentChunks, err := fileprocessor.ContentDefinedChunks(session.TempFilePath, seed)
+	if err != nil {
+		fail(20, "Failed to chunk file: %v", err)
+		return
+	}
+	chunkCount := len(contentChunks)
+	if appending {
+		chunkCount += len(existing.Chunks)
+	}
+	if err := fileprocessor.CheckChunkCount(chunkCount); err != nil {
+		fail(20, "Failed to chunk file: %v", err)
+		return
+	}
+
+	unchanged := make(map[string]models.StoredChunk)
+	nextChunkID := 1
+	if keep {
+		for _, chunk := range existing.Chunks {
+			// Chunks an append keeps already back their own region
+			if _, dup := unchanged[chunk.ContentHash]; !appending && chunk.ContentHash != "" && !dup {
+				unchanged[chunk.ContentHash] = chunk
+			}
+			// Chunk IDs are never reused within a file, a new chunk can't take an old one's name
+			nextChunkID = max(nextChunkID, chunk.ChunkID+1)
+		}
+	}
+
+	// Lay out the processed stream, keeping unchanged chunks and planning the others
+	chunks := make([]models.StoredChunk, len(contentChunks))
+	var plan []models.ChunkPlan
+	var planned []int // Index in chunks of every planned chunk
+	var processedSize int64
+	if appending {
+		processedSize = existing.ProcessedSize
+	}
+	for i, cc := range contentChunks {
+		if old, ok := unchanged[cc.Hash]; ok && old.OriginalSize == cc.Size {
+			// A stored chunk backs a single region of the file
+			delete(unchanged, cc.Hash)
+			old.StartOffset = processedSize
+			old.EndOffset = processedSize + old.Size
+			chunks[i] = old
+		} else {
+			size := fileprocessor.ObfuscatedChunkSize(cc.Size, obfMetadata)
+			chunks[i] = models.StoredChunk{
+				ChunkID:      nextChunkID,
+				StartOffset:  processedSize,
+				EndOffset:    processedSize + size,
+				Size:         size,
+				OriginalSize: cc.Size,
+				ContentHash:  cc.Hash,
+			}
+			plan = append(plan, models.ChunkPlan{
+				ChunkID:     nextChunkID,
+				Size:        size,
+				StartOffset: processedSize,
+				EndOffset:   processedSize + size,
+			})
+			planned = append(planned, i)
+			nextChunkID++
+		}
+		processedSize += chunks[i].Size
+	}
+	log.Printf("Session %s has %d content-defined chunks, %d to upload", sessionID.Hex(), len(chunks), len(plan))
+
+	// Chunks the file keeps were sharded with its coding, new shards have to use the same one
+	var coding *models.ErasureCoding
+	if keep || appending {
+		coding = existing.ErasureCoding
+	}
+
+	chunkDir := filepath.Dir(session.TempFilePath)
+	if len(plan) > 0 {
+		// Step 4: Place the chunks to upload (30%)
+		fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 30, "Calculating chunk distribution...")
+
+		driveSpaces, err := drivemanager.GetUserDriveSpaces(ctx, userID, true)
+		if err != nil {
+			fail(30, "Failed to get drive spaces: %v", err)
+			return
+		}
+		if encMetadata != nil {
+			driveSpaces = fileprocessor.ReserveEncryptionOverhead(driveSpaces)
+		}
+		if err := fileprocessor.PlaceChunks(plan, driveSpaces); err != nil {
+			fail(30, "Chunking calculation failed: %v", err)
+			return
+		}
+
+		distribution, err := fileprocessor.GetDistributionStrategy(req.Distribution)
+		if err != nil {
+			fail(30, "Invalid distribution strategy: %v", err)
+			return
+		}
+		assignments, err := distribution.Assign(plan, driveSpaces)
+		if err != nil {
+			fail(30, "Chunk distribution failed: %v", err)
+			return
+		}
+		var sharding *models.ErasureCoding
+		assignments, sharding = placeCopies(assignments, driveSpaces, coding)
+		if sharding != nil {
+			coding = sharding
+		}
+		plan = fileprocessor.ApplyAssignments(plan, assignments)
+		uploadOrder, err := fileprocessor.ApplyObfuscationScheme(assignments, obfMetadata)
+		if err != nil {
+			fail(30, "Obfuscation scheme failed: %v", err)
+			return
+		}
+
+		// Step 5: Inject noise into, compress and encrypt the chunks (50%)
+		fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 50, "Preparing changed chunks...")
+
+		sealedPaths := make([]string, 0, len(plan))
+		defer func() {
+			for _, path := range sealedPaths {
+				os.Remove(path)
+			}
+		}()
+		checksumAlgo := fileprocessor.GetChecksumAlgo()
+		checksums := make([]string, len(plan))
+		compressedSizes := make([]int64, len(plan))
+		for j, p := range plan {
+			chunkPath := fmt.Sprintf("%s.chunk_%03d", session.TempFilePath, p.ChunkID)
+			written, err := fileprocessor.ObfuscateChunk(session.TempFilePath, chunkPath, contentChunks[planned[j]], p.ChunkID, obfMetadata)
+			if err == nil && written != p.Size {
+				err = fmt.Errorf("expected %d bytes, wrote %d", p.Size, written)
+			}
+			if err != nil {
+				os.Remove(chunkPath)
+				fail(50, "Obfuscation of chunk %d failed: %v", p.ChunkID, err)
+				return
+			}
+
+			sealedPath, checksum, compressedSize, err := sealChunk(chunkPath, p.ChunkID, session.Compress, dataKey, checksumAlgo)
+			if sealedPath != chunkPath {
+				os.Remove(chunkPath)
+			}
+			if err != nil {
+				fail(50, "Chunk preparation failed: %v", err)
+				return
+			}
+			sealedPaths = append(sealedPaths, sealedPath)
+			checksums[j] = checksum
+			compressedSizes[j] = compressedSize
+		}
+
+		// Step 6: Upload the chunks to drives (70%)
+		fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 70, "Uploading changed chunks to drives...")
+
+		chunkMetadata, err := uploadSealedChunks(ctx, sealedPaths, assignments, uploadOrder, driveSpaces, sharding, checksumAlgo, func(current, total int) {
+			fileprocessor.UpdateChunkUploadProgress(ctx, sessionID, 70+(20*float64(current)/float64(total)), current, total)
+		}, func(replica models.ChunkReplica) {
+			fileprocessor.PublishSessionEvent(sessionID, fileprocessor.SessionEvent{Type: "chunk", Status: "processing", DriveAccountID: replica.DriveAccountID.Hex()})
+			// Lets the session sweeper reclaim chunks of an update that never finishes
+			if err := store.AddSessionDriveChunk(ctx, sessionID, replica); err != nil {
+				log.Printf("Failed to record uploaded chunk for session %s: %v", sessionID.Hex(), err)
+			}
+		})
+		if err != nil {
+			failUpload(ctx, sessionID, 70, err)
+			return
+		}
+		for j, meta := range chunkMetadata {
+			chunk := &chunks[planned[j]]
+			chunk.Replicas = meta.Replicas
+			chunk.Filename = meta.Filename
+			chunk.StoredSize = meta.StoredSize
+			chunk.Checksum = checksums[j]
+			chunk.ChecksumAlgo = checksumAlgo
+			chunk.Compressed = compressedSizes[j] > 0
+			chunk.CompressedSize = compressedSizes[j]
+		}
+	}
+
+	if appending {
+		// The existing chunks stay where they are, in front of the appended ones
+		chunks = append(slices.Clone(existing.Chunks), chunks...)
+	}
+
+	// Step 7: Generate key file (95%)
+	fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 95, "Generating key file...")
+
+	filename := session.OriginalFilename
+	if existing != nil {
+		filename = existing.OriginalFilename
+	}
+	keyFilePath := filepath.Join(chunkDir, sessionID.Hex()+".2xpfm.key")
+	if err := fileprocessor.GenerateKeyFile(
+		filename,
+		totalSize,
+		processedSize,
+		obfMetadata,
+		encMetadata,
+		session.ClientEncryption,
+		coding,
+		keyFileChunks(chunks),
+		keyFilePath,
+	); err != nil {
+		fail(95, "Key file generation failed: %v", err)
+		return
+	}
+	store.UpdateSessionKeyFile(ctx, sessionID, keyFilePath)
+
+	// Step 8: Record the file (98%)
+	merkleRoot, err := fileprocessor.MerkleRoot(chunks)
+	if err != nil {
+		log.Printf("Failed to compute the Merkle root of session %s: %v", sessionID.Hex(), err)
+	}
+	var storedFile *models.StoredFile
+	if existing == nil {
+		storedFile = &models.StoredFile{
+			UserID:           userID,
+			SessionID:        sessionID,
+			OriginalFilename: session.OriginalFilename,
+			ContentType:      session.ContentType,
+			OriginalSize:     session.TotalSize,
+			ProcessedSize:    processedSize,
+			OriginalChecksum: originalChecksum,
+			ChecksumState:    checksumState,
+			Obfuscation:      *obfMetadata,
+			Encryption:       encMetadata,
+			ClientEncryption: session.ClientEncryption,
+			Chunks:           chunks,
+			ErasureCoding:    coding,
+			MerkleRoot:       merkleRoot,
+			Tags:             session.Tags,
+			Compress:         session.Compress,
+			Status:           "active",
+		}
+		if err := fileprocessor.CheckStoredChunks(storedFile); err != nil {
+			fail(98, "Invalid chunk layout: %v", err)
+			return
+		}
+		// Locked until finalizing is done, like processAndUploadFile
+		storedFile.ID = primitive.NewObjectID()
+		storedFile.Metadata = imageMetadata(storedFile, session.TempFilePath, dataKey, req.Metadata)
+		unlock, err := fileprocessor.LockFile(ctx, storedFile.ID, "finalize")
+		if err != nil {
+			fail(98, "Failed to lock stored file: %v", err)
+			return
+		}
+		defer unlock()
+		if err := store.CreateStoredFile(ctx, storedFile); err != nil {
+			fail(98, "Failed to record stored file: %v", err)
+			return
+		}
+	} else {
+		updated := *existing
+		storedFile = &updated
+		// The file now belongs to this session, so the sweeper leaves its new chunks alone
+		storedFile.SessionID = sessionID
+		// Appended bytes don't tell what the file is
+		if session.ContentType != "" && !appending {
+			storedFile.ContentType = session.ContentType
+		}
+		storedFile.OriginalSize = totalSize
+		storedFile.ProcessedSize = processedSize
+		storedFile.OriginalChecksum = originalChecksum
+		storedFile.ChecksumState = checksumState
+		storedFile.Obfuscation = *obfMetadata
+		storedFile.Encryption = encMetadata
+		storedFile.Chunks = chunks
+		storedFile.ErasureCoding = coding
+		storedFile.MerkleRoot = merkleRoot
+		storedFile.Compress = session.Compress
+		// Appended bytes leave the image's header as it was
+		if !appending {
+			storedFile.Metadata = imageMetadata(storedFile, session.TempFilePath, dataKey, req.Metadata)
+		}
+
+		// The file keeps its content unless the new one can be reconstructed
+		if err := fileprocessor.CheckStoredChunks(storedFile); err != nil {
+			fail(98, "Invalid chunk layout: %v", err)
+			return
+		}
+		ok, err := store.ReplaceStoredFileContent(ctx, storedFile, existing.UpdatedAt)
+		if err != nil {
+			fail(98, "Failed to record stored file: %v", err)
+			return
+		}
+		if !ok {
+			// The uploaded chunks are left to the session sweeper
+			fail(98, "File %s changed while it was being updated", existing.ID.Hex())
+			return
+		}
+	}
+	store.UpdateSessionFileID(ctx, sessionID, storedFile.ID)
+	event := models.AuditFileUploaded
+	switch {
+	case appending:
+		event = models.AuditFileAppended
+	case existing != nil:
+		event = models.AuditFileUpdated
+	}
+	audit.RecordContext(ctx, userID, event, map[string]string{"file_id": storedFile.ID.Hex(), "session_id": sessionID.Hex()})
+
+	// Drift left by a failed manifest write is picked up by reconcile
+	if err := manifest.AddFile(ctx, storedFile); err != nil {
+		log.Printf("Failed to update drive manifests for file %s: %v", storedFile.ID.Hex(), err)
+	}
+	// An append keeps every chunk, and the thumbnail of the content it starts with
+	if !appending {
+		if existing != nil {
+			deleteReplacedChunks(ctx, existing, storedFile)
+		}
+		storeThumbnail(ctx, storedFile, session.TempFilePath, dataKey, req.Thumbnail)
+	}
+
+	// Step 9: Complete (100%)
+	log.Printf("Processing complete for session %s. Key file: %s", sessionID.Hex(), keyFilePath)
+	fileprocessor.CompleteSession(ctx, sessionID)
+	fileprocessor.UpdateSessionStatus(ctx, sessionID, "complete", 100, "")
+}
+
+// deleteReplacedChunks deletes the copies of previous's chunks that its new version current no
+// longer uses. Drives left without any of the file's chunks drop it from their manifest, unless
+// a copy on them couldn't be deleted.
+func deleteReplacedChunks(ctx context.Context, previous, current *models.StoredFile) {
+	inUse := make(map[models.ChunkReplica]bool)
+	drives := make(map[primitive.ObjectID]bool)
+	for _, chunk := range current.Chunks {
+		for _, replica := range chunk.Replicas {
+			inUse[replica] = true
+			drives[replica.DriveAccountID] = true
+		}
+	}
+
+	deleted, failed := 0, 0
+	emptied := make(map[primitive.ObjectID]bool)
+	keepEntry := make(map[primitive.ObjectID]bool)
+	for _, chunk := range previous.Chunks {
+		for _, replica := range chunk.Replicas {
+			if inUse[replica] {
+				continue
+			}
+			if err := drivemanager.DeleteDriveFile(ctx, replica.DriveAccountID, replica.DriveFileID); err != nil {
+				log.Printf("Failed to delete replaced chunk %d of file %s from drive %s: %v", chunk.ChunkID, previous.ID.Hex(), replica.DriveAccountID.Hex(), err)
+				keepEntry[replica.DriveAccountID] = true
+				failed++
+				continue
+			}
+			deleted++
+			if !drives[replica.DriveAccountID] {
+				emptied[replica.DriveAccountID] = true
+			}
+		}
+	}
+
+	cleaned := make([]primitive.ObjectID, 0, len(emptied))
+	for accountID := range emptied {
+		if !keepEntry[accountID] {
+			cleaned = append(cleaned, accountID)
+		}
+	}
+	if err := manifest.RemoveFile(ctx, current, cleaned); err != nil {
+		log.Printf("Failed to update drive manifests for file %s: %v", current.ID.Hex(), err)
+	}
+	log.Printf("Update of file %s deleted %d replaced chunk copies, %d left behind", current.ID.Hex(), deleted, failed)
+}
+
+// keyFileChunks describes stored chunks the way the key file lists them
+func keyFileChunks(chunks []models.StoredChunk) []models.ChunkMetadata {
+	out := make([]models.ChunkMetadata, 0, len(chunks))
+	for _, chunk := range chunks {
+		meta := models.ChunkMetadata{
+			ChunkID:        chunk.ChunkID,
+			Filename:       chunk.Filename,
+			StartOffset:    chunk.StartOffset,
+			EndOffset:      chunk.EndOffset,
+			Size:           chunk.Size,
+			StoredSize:     chunk.StoredSize,
+			Checksum:       chunk.Checksum,
+			ChecksumAlgo:   chunk.ChecksumAlgo,
+			Compressed:     chunk.Compressed,
+			CompressedSize: chunk.CompressedSize,
+			OriginalSize:   chunk.OriginalSize,
+			ContentHash:    chunk.ContentHash,
+			Replicas:       chunk.Replicas,
+		}
+		if len(chunk.Replicas) > 0 {
+			meta.DriveAccountID = chunk.Replicas[0].DriveAccountID.Hex()
+			meta.DriveFileID = chunk.Replicas[0].DriveFileID
+		}
+		out = append(out, meta)
+	}
+	return out
+}
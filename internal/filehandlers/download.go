@@ -0,0 +1,608 @@
+package filehandlers
+
+import (
+	"SE/internal/audit"
+	"SE/internal/drivemanager"
+	"SE/internal/fileprocessor"
+	"SE/internal/metrics"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DownloadFileHandler - GET/HEAD /api/files/download/:file_id
+func DownloadFileHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	// Extract file ID from path
+	fileIDStr := r.URL.Path[len("/api/files/download/"):]
+	fileID, err := primitive.ObjectIDFromHex(fileIDStr)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid file_id")
+		return
+	}
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get file")
+		return
+	}
+	if file == nil {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "file not found")
+		return
+	}
+
+	// Verify ownership
+	if file.UserID != userID {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, "unauthorized")
+		return
+	}
+
+	if file.Status != "active" {
+		middleware.WriteJSONError(w, http.StatusGone, middleware.ErrCodeFileUnavailable, fmt.Sprintf("file not available (status: %s)", file.Status))
+		return
+	}
+
+	if !checkPreconditions(w, r, file) {
+		return
+	}
+	if r.Method != http.MethodHead {
+		audit.Record(r, userID, models.AuditFileDownloaded, map[string]string{"file_id": fileID.Hex()})
+	}
+	serveStoredFile(w, r, file)
+}
+
+// serveStoredFile sends an active file, reconstructing it from its chunks unless a recent
+// download session of the owner still has it on disk. Small files are streamed as they are
+// reconstructed, see streamDownload, and a single range is streamed from the chunks holding it.
+func serveStoredFile(w http.ResponseWriter, r *http.Request, file *models.StoredFile) {
+	userID, fileID := file.UserID, file.ID
+
+	// HEAD only needs the headers, which are known without reconstructing the file
+	if r.Method == http.MethodHead {
+		setFileHeaders(w, file)
+		w.Header().Set("Content-Length", strconv.FormatInt(file.OriginalSize, 10))
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Last-Modified", file.LastModified().UTC().Format(http.TimeFormat))
+		return
+	}
+
+	stream, err := streamDownload(r, file)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	// Shared links are throttled like the owner's own downloads
+	w = middleware.ThrottleResponseWriter(fileprocessor.WithUserBandwidth(r.Context(), userID), w)
+
+	// Resumed and range requests reuse a reconstruction that is still on disk, unless the
+	// file's content was updated since
+	session, err := store.FindReusableDownloadSession(r.Context(), userID, fileID)
+	if err != nil {
+		log.Printf("Failed to look up download session: %v", err)
+	}
+	if session != nil && session.Checksum == file.OriginalChecksum && fileprocessor.ReconstructionAvailable(session) {
+		serveReconstructedFile(w, r, session, file)
+		return
+	}
+
+	if header := r.Header.Get("Range"); header != "" && rangeApplies(r, file) {
+		start, length, err := parseByteRange(header, file.OriginalSize)
+		switch {
+		case errors.Is(err, errMultipleRanges):
+			// ServeContent answers them from the reconstruction, as a multipart response
+		case err != nil:
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", file.OriginalSize))
+			middleware.WriteJSONError(w, http.StatusRequestedRangeNotSatisfiable, middleware.ErrCodeRangeNotSatisfiable, err.Error())
+			return
+		default:
+			streamRange(w, r, file, start, length)
+			return
+		}
+	}
+
+	if stream {
+		streamStoredFile(w, r, file)
+		return
+	}
+	serveFromDisk(w, r, file)
+}
+
+var errMultipleRanges = errors.New("several ranges requested")
+
+// parseByteRange returns the start and length of the one byte range of a Range header, within
+// a file of size bytes. A range starting past the end of the file, or a header that isn't a byte
+// range, can't be satisfied. errMultipleRanges is returned for several ranges.
+func parseByteRange(header string, size int64) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid range %q", header)
+	}
+	if strings.Contains(spec, ",") {
+		return 0, 0, errMultipleRanges
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid range %q", header)
+	}
+
+	// A suffix range asks for the last bytes of the file
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid range %q", header)
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, fmt.Errorf("range %q is outside the %d byte file", header, size)
+		}
+		n = min(n, size)
+		return size - n, n, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("invalid range %q", header)
+	}
+	if start >= size {
+		return 0, 0, fmt.Errorf("range %q is outside the %d byte file", header, size)
+	}
+	end := size - 1
+	if last != "" {
+		e, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || e < start {
+			return 0, 0, fmt.Errorf("invalid range %q", header)
+		}
+		end = min(e, size-1)
+	}
+	return start, end - start + 1, nil
+}
+
+// rangeApplies reports whether a Range request gets the range rather than the whole file. An
+// If-Range date the file doesn't match asks for all of it, as ServeContent treats it; If-Range
+// ETags were checked by checkPreconditions. A date is only a strong validator when it's the
+// recorded time the content changed (RFC 9110 section 13.1.5), files stored before that was
+// kept are sent whole for any date.
+func rangeApplies(r *http.Request, file *models.StoredFile) bool {
+	ifRange := strings.TrimSpace(r.Header.Get("If-Range"))
+	if ifRange == "" || isETag(ifRange) {
+		return true
+	}
+	if file.ContentModified == nil {
+		return false
+	}
+	t, err := http.ParseTime(ifRange)
+	return err == nil && t.Unix() == file.ContentModified.Unix()
+}
+
+// reconstructSession reconstructs the file into the download session's ReconstructedPath once
+// there is disk space for it, marking the session failed when it can't
+func reconstructSession(ctx context.Context, session *models.DownloadSession, file *models.StoredFile) error {
+	// Request context may already be cancelled, failures are recorded regardless
+	failCtx := middleware.WithRequestID(context.Background(), middleware.GetRequestID(ctx))
+
+	release, err := fileprocessor.ReserveDownloadSpace(file)
+	if err != nil {
+		log.Printf("Not reconstructing file %s for download session %s: %v", file.ID.Hex(), session.ID.Hex(), err)
+		fileprocessor.UpdateDownloadStatus(failCtx, session.ID, "failed", err.Error())
+		return err
+	}
+	err = reconstructFile(ctx, session, file)
+	// Once reconstructed the file is on disk, free space accounts for it
+	release()
+	if err != nil {
+		log.Printf("Reconstruction failed for download session %s: %v", session.ID.Hex(), err)
+		fileprocessor.UpdateDownloadStatus(failCtx, session.ID, "failed", err.Error())
+		os.Remove(session.ReconstructedPath)
+		return err
+	}
+	return nil
+}
+
+// reconstructFile fetches every chunk into the session's temp file, verifies it and strips the noise.
+// A panic is returned as an error, so the caller's failure path cleans up after it too.
+func reconstructFile(ctx context.Context, session *models.DownloadSession, file *models.StoredFile) (err error) {
+	defer metrics.ReconstructionDuration.Since(time.Now())
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Reconstruction of download session %s panicked: %v\n%s", session.ID.Hex(), p, debug.Stack())
+			err = fmt.Errorf("reconstruction panicked: %v", p)
+		}
+	}()
+
+	// Chunks are fetched in the order of the file's obfuscation scheme, the one they were
+	// uploaded in, and must carry the names the scheme gives them
+	chunks, err := orderChunks(file)
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := fileprocessor.CreateDownloadFile(session, session.TempFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(session.TempFilePath)
+	defer tempFile.Close()
+
+	if file.Encryption != nil && file.ClientEncryption != nil {
+		return fmt.Errorf("file %s has both server and client encryption metadata", file.ID.Hex())
+	}
+
+	// Files stored before chunk encryption and client-encrypted files have no data key
+	var dataKey []byte
+	if file.Encryption != nil {
+		dataKey, err = fileprocessor.UnwrapDataKey(file.Encryption)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := fetchChunks(ctx, session.ID, tempFile, chunks, file.ErasureCoding, dataKey, file.Encryption); err != nil {
+		return err
+	}
+
+	checksum, err := fileprocessor.DeobfuscateStoredFile(session, file)
+	if err != nil {
+		return fmt.Errorf("failed to remove noise: %w", err)
+	}
+
+	if err := checkReconstructedChecksum(file, checksum); err != nil {
+		return err
+	}
+
+	return fileprocessor.UpdateDownloadStatus(ctx, session.ID, "complete", "")
+}
+
+// checkReconstructedChecksum compares the checksum of a reconstructed file, on disk or streamed,
+// with the one recorded at upload
+func checkReconstructedChecksum(file *models.StoredFile, checksum string) error {
+	// Files stored before whole-file checksums were recorded have nothing to compare against
+	if file.OriginalChecksum != "" && checksum != file.OriginalChecksum {
+		return fmt.Errorf("reconstructed file checksum mismatch: expected %s, got %s", file.OriginalChecksum, checksum)
+	}
+	return nil
+}
+
+// orderChunks returns the file's chunks in the order of its obfuscation scheme, checking each
+// is stored under the name the scheme derives for it
+func orderChunks(file *models.StoredFile) ([]models.StoredChunk, error) {
+	scheme, seed, err := fileprocessor.SchemeForFile(&file.Obfuscation)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[int]models.StoredChunk, len(file.Chunks))
+	ids := make([]int, 0, len(file.Chunks))
+	for _, chunk := range file.Chunks {
+		if want := fileprocessor.ChunkName(scheme, seed, &file.Obfuscation, chunk.ChunkID); chunk.Filename != "" && chunk.Filename != want {
+			return nil, fmt.Errorf("chunk %d is stored as %s, its obfuscation scheme names it %s", chunk.ChunkID, chunk.Filename, want)
+		}
+		byID[chunk.ChunkID] = chunk
+		ids = append(ids, chunk.ChunkID)
+	}
+
+	chunks := make([]models.StoredChunk, 0, len(ids))
+	for _, id := range scheme.ChunkOrder(seed, ids) {
+		chunks = append(chunks, byID[id])
+	}
+	return chunks, nil
+}
+
+// fetchChunks downloads the chunks into the temp file, up to DOWNLOAD_CONCURRENCY at once.
+// Each chunk is written at its own offset, so they can land in any order. The first failure
+// cancels the fetches still running.
+func fetchChunks(ctx context.Context, sessionID primitive.ObjectID, tempFile io.WriterAt, chunks []models.StoredChunk, coding *models.ErasureCoding, dataKey []byte, encryption *models.EncryptionMetadata) error {
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu   sync.Mutex
+		errs []error
+		done int
+	)
+
+	jobs := make(chan models.StoredChunk)
+	var wg sync.WaitGroup
+	for w := 0; w < min(drivemanager.GetDownloadConcurrency(), len(chunks)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range jobs {
+				err := fetchChunk(fetchCtx, tempFile, chunk, coding, dataKey, encryption)
+
+				mu.Lock()
+				switch {
+				case err == nil:
+					done++
+					// Fetching is the bulk of the work, noise removal takes the rest. Updated
+					// under the lock so progress never goes backwards.
+					progress := 90 * float64(done) / float64(len(chunks))
+					if err := fileprocessor.UpdateDownloadProgress(ctx, sessionID, progress); err != nil {
+						log.Printf("Failed to update download progress: %v", err)
+					}
+				case len(errs) > 0 && errors.Is(err, context.Canceled):
+					// Cancelled because another chunk already failed
+				default:
+					errs = append(errs, err)
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// Fed in scheme order, so the drives see chunks requested in the order they were uploaded
+feed:
+	for _, chunk := range chunks {
+		select {
+		case jobs <- chunk:
+		case <-fetchCtx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if len(errs) == 0 && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errors.Join(errs...)
+}
+
+// fetchChunk downloads a chunk into its place in dst, trying its replicas in turn, or rebuilds
+// it from its shards
+func fetchChunk(ctx context.Context, dst io.WriterAt, chunk models.StoredChunk, coding *models.ErasureCoding, dataKey []byte, encryption *models.EncryptionMetadata) error {
+	if len(chunk.Replicas) == 0 {
+		return fmt.Errorf("chunk %d has no replicas", chunk.ChunkID)
+	}
+	if chunk.Sharded() {
+		return fetchShards(ctx, dst, chunk, coding, dataKey, encryption)
+	}
+
+	var errs []error
+	for _, replica := range drivemanager.OrderReplicas(chunk.Replicas) {
+		err := fetchReplica(ctx, dst, chunk, replica, dataKey, encryption)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		log.Printf("Failed to fetch chunk %d from drive %s: %v", chunk.ChunkID, replica.DriveAccountID.Hex(), err)
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// fetchReplica downloads one copy of a chunk into its place in dst, verifying and decrypting it on the way.
+// A failed attempt may leave partial bytes, the next replica overwrites them. The chunk cache
+// is read first, and keeps the copy once it checked out; a cached copy goes through the same
+// checks as one from the drive, and is dropped for the drive's when it fails them.
+func fetchReplica(ctx context.Context, dst io.WriterAt, chunk models.StoredChunk, replica models.ChunkReplica, dataKey []byte, encryption *models.EncryptionMetadata) error {
+	if cached, ok := fileprocessor.OpenCachedChunk(replica.DriveFileID, chunk.Checksum); ok {
+		err := writeChunk(dst, chunk, dataKey, encryption, func(w io.Writer) (int64, error) {
+			return io.Copy(w, cached)
+		})
+		cached.Close()
+		if err == nil {
+			return nil
+		}
+		log.Printf("Cached copy of chunk %d is invalid, fetching it from drive %s: %v", chunk.ChunkID, replica.DriveAccountID.Hex(), err)
+		fileprocessor.DropCachedChunk(replica.DriveFileID, chunk.Checksum)
+	}
+
+	cache := fileprocessor.NewChunkCacheWriter(replica.DriveFileID, chunk.Checksum)
+	err := writeChunk(dst, chunk, dataKey, encryption, func(w io.Writer) (int64, error) {
+		if cache != nil {
+			w = io.MultiWriter(w, cache)
+		}
+		return drivemanager.DownloadChunkFromDrive(ctx, replica.DriveAccountID, replica.DriveFileID, w)
+	})
+	cache.Finish(err == nil)
+	return err
+}
+
+// writeChunk writes the chunk as stored, read into the writer it is given by read, into its
+// place in dst, verifying, decrypting and decompressing it on the way
+func writeChunk(dst io.WriterAt, chunk models.StoredChunk, dataKey []byte, encryption *models.EncryptionMetadata, read func(io.Writer) (int64, error)) error {
+	var out io.Writer = io.NewOffsetWriter(dst, chunk.StartOffset)
+	expectedSize := chunk.Size
+
+	// Compressed chunks are gunzipped after decryption
+	var decompressor io.WriteCloser
+	var decompressed *boundedWriter
+	if chunk.Compressed {
+		if encryption == nil {
+			return fmt.Errorf("chunk %d is compressed but its file has no encryption metadata", chunk.ChunkID)
+		}
+		decompressed = &boundedWriter{w: out, limit: chunk.Size}
+		decompressor = fileprocessor.NewDecompressingWriter(decompressed)
+		defer decompressor.Close()
+		out = decompressor
+	}
+
+	var decrypter io.WriteCloser
+	if encryption != nil {
+		var err error
+		decrypter, err = fileprocessor.NewDecryptingWriter(out, dataKey, chunk.ChunkID, encryption.FrameSize)
+		if err != nil {
+			return err
+		}
+		out = decrypter
+		expectedSize = chunk.StoredSize
+	}
+
+	// The checksum covers the bytes as stored on the drive
+	hash, err := fileprocessor.NewHash(chunk.ChecksumAlgo)
+	if err != nil {
+		return fmt.Errorf("chunk %d: %w", chunk.ChunkID, err)
+	}
+	written, err := read(io.MultiWriter(out, hash))
+	if err != nil {
+		return fmt.Errorf("failed to download chunk %d: %w", chunk.ChunkID, err)
+	}
+	if written != expectedSize {
+		return fmt.Errorf("chunk %d: expected %d bytes, got %d bytes", chunk.ChunkID, expectedSize, written)
+	}
+
+	if checksum := fmt.Sprintf("%x", hash.Sum(nil)); checksum != chunk.Checksum {
+		return fmt.Errorf("chunk %d checksum mismatch", chunk.ChunkID)
+	}
+
+	// Closing decrypts the final frame and checks its auth tag
+	if decrypter != nil {
+		if err := decrypter.Close(); err != nil {
+			return err
+		}
+	}
+
+	if decompressor != nil {
+		if err := decompressor.Close(); err != nil {
+			return fmt.Errorf("chunk %d failed to decompress: %w", chunk.ChunkID, err)
+		}
+		if decompressed.n != chunk.Size {
+			return fmt.Errorf("chunk %d: expected %d bytes after decompression, got %d bytes", chunk.ChunkID, chunk.Size, decompressed.n)
+		}
+	}
+	return nil
+}
+
+// boundedWriter counts the bytes written through it and refuses more than limit, so a bad
+// compressed chunk can't spill into its neighbour's place in the temp file
+type boundedWriter struct {
+	w     io.Writer
+	n     int64
+	limit int64
+}
+
+func (b *boundedWriter) Write(p []byte) (int, error) {
+	if b.n+int64(len(p)) > b.limit {
+		return 0, fmt.Errorf("more than %d bytes after decompression", b.limit)
+	}
+	n, err := b.w.Write(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// serveReconstructedFile sends the reconstructed file, decrypting it as it is read when the
+// session's files are encrypted, honoring Range headers
+func serveReconstructedFile(w http.ResponseWriter, r *http.Request, session *models.DownloadSession, file *models.StoredFile) {
+	f, err := fileprocessor.OpenDownloadFile(session, session.ReconstructedPath)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to open reconstructed file")
+		return
+	}
+	defer f.Close()
+
+	setFileHeaders(w, file)
+
+	// ServeContent would match an If-Range date against the fallback of a file stored before
+	// its content changes were recorded
+	if !rangeApplies(r, file) {
+		r = r.Clone(r.Context())
+		r.Header.Del("Range")
+	}
+	// ServeContent takes care of Range, If-Range and Content-Length
+	http.ServeContent(w, r, file.OriginalFilename, file.LastModified(), f)
+}
+
+func setFileHeaders(w http.ResponseWriter, file *models.StoredFile) {
+	// Files stored before content types were recorded are sent as raw bytes
+	contentType := file.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	// Client-encrypted files are sent as the ciphertext they were uploaded as, with the salt
+	// the client derives the key from
+	if file.ClientEncryption != nil {
+		contentType = "application/octet-stream"
+		w.Header().Set("X-Client-Encrypted", "true")
+		w.Header().Set("X-Key-Salt", file.ClientEncryption.KeySalt)
+	}
+	w.Header().Set("Content-Type", contentType)
+	// FormatMediaType quotes the name and encodes non-ASCII characters
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.OriginalFilename}))
+	if etag := fileETag(file); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+}
+
+// fileETag returns the strong ETag of the file's content, "" for files stored before whole-file
+// checksums were recorded
+func fileETag(file *models.StoredFile) string {
+	if file.OriginalChecksum == "" {
+		return ""
+	}
+	return `"` + file.OriginalChecksum + `"`
+}
+
+// checkPreconditions answers conditional requests before the file is reconstructed or a share
+// link download is counted. It returns false once it has written the response: 304 when
+// If-None-Match matches the file's ETag, 412 when If-Match doesn't, or when a Range request's
+// If-Range names an ETag the file no longer has. Unlike plain HTTP, which would send the whole
+// file for a stale If-Range, a resumed download is stopped so the client doesn't splice two
+// versions of the file together.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, file *models.StoredFile) bool {
+	etag := fileETag(file)
+
+	if header := r.Header.Get("If-Match"); header != "" && !etagListMatches(header, etag, false) {
+		middleware.WriteJSONError(w, http.StatusPreconditionFailed, middleware.ErrCodePreconditionFailed, "file does not match If-Match")
+		return false
+	}
+
+	// If-Range dates are left to ServeContent
+	if ifRange := strings.TrimSpace(r.Header.Get("If-Range")); r.Header.Get("Range") != "" && isETag(ifRange) {
+		if !etagListMatches(ifRange, etag, false) {
+			middleware.WriteJSONError(w, http.StatusPreconditionFailed, middleware.ErrCodePreconditionFailed, "file changed since the download started")
+			return false
+		}
+	}
+
+	if header := r.Header.Get("If-None-Match"); header != "" && etagListMatches(header, etag, true) {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return false
+	}
+	return true
+}
+
+func isETag(value string) bool {
+	return strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "W/")
+}
+
+// etagListMatches reports whether a comma separated list of ETags, or "*", matches etag. The
+// weak comparison ignores W/ prefixes, the strong one never matches a weak ETag. An empty etag
+// only matches "*".
+func etagListMatches(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if etag == "" {
+			continue
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
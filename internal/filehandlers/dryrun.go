@@ -0,0 +1,119 @@
+package filehandlers
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/fileprocessor"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// dryRunRequest is what a dry-run initiate plans with, the processing options are the
+// ones the client will later pass to finalize
+type dryRunRequest struct {
+	FileSize         int64
+	ChunkSize        int64
+	ServerEncrypted  bool
+	Strategy         models.ChunkingStrategy
+	ManualChunkSizes []int64
+	Distribution     models.DistributionMode
+	ChunkSizeBytes   int64
+}
+
+// dryRunUpload runs the checks and the planning of an upload without creating a session or
+// writing to Drive, and responds with the plan and whether the upload would go ahead. Every
+// check that fails is reported in problems rather than stopping at the first.
+func dryRunUpload(w http.ResponseWriter, r *http.Request, userID primitive.ObjectID, req dryRunRequest) {
+	if _, err := fileprocessor.GetDistributionStrategy(req.Distribution); err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if req.ChunkSizeBytes != 0 {
+		if err := fileprocessor.ValidateChunkSize(req.ChunkSizeBytes); err != nil {
+			middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+			return
+		}
+	}
+
+	problems := []string{}
+	if err := fileprocessor.CheckSessionAllowed(r.Context(), userID, req.FileSize, req.ChunkSize); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	quota, err := fileprocessor.GetQuotaUsage(r.Context(), userID)
+	if err != nil {
+		log.Printf("Failed to get quota usage: %v", err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to check storage quota")
+		return
+	}
+	if !quota.Allows(req.FileSize) {
+		problems = append(problems, "storage quota exceeded")
+	}
+
+	driveSpaces, err := drivemanager.GetUserDriveSpaces(r.Context(), userID, false)
+	if err != nil {
+		log.Printf("Failed to get drive spaces: %v", err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, err.Error())
+		return
+	}
+	capacity := fileprocessor.EstimateDriveCapacity(driveSpaces, req.FileSize, req.ServerEncrypted)
+	if !capacity.Fits() {
+		problems = append(problems, "not enough free space on linked drives")
+	}
+
+	// Planned as the pipeline plans it, on the obfuscated size and the space left after encryption
+	processedSize := fileprocessor.CalculateProcessedSize(req.FileSize)
+	planSpaces := driveSpaces
+	if req.ServerEncrypted {
+		planSpaces = fileprocessor.ReserveEncryptionOverhead(driveSpaces)
+	}
+
+	response := map[string]interface{}{
+		"dry_run":                  true,
+		"file_size":                req.FileSize,
+		"estimated_processed_size": processedSize,
+		"required_bytes":           capacity.RequiredBytes,
+		"available_bytes":          capacity.AvailableBytes,
+		"used_bytes":               quota.UsedBytes,
+		"limit_bytes":              quota.LimitBytes,
+		"drive_spaces":             driveSpaces,
+		"max_file_size":            fileprocessor.GetMaxFileSize(),
+		"total_chunks":             fileprocessor.TotalUploadChunks(&models.UploadSession{TotalSize: req.FileSize, ChunkSize: req.ChunkSize}),
+		"distribution_strategy":    req.Distribution,
+	}
+
+	plan, warning, err := calculatePlan(processedSize, planSpaces, req.Strategy, req.ManualChunkSizes, req.ChunkSizeBytes)
+	if warning != "" {
+		response["warning"] = warning
+	}
+	if err != nil {
+		problems = append(problems, "chunking calculation failed: "+err.Error())
+	} else {
+		distribution, _ := fileprocessor.GetDistributionStrategy(req.Distribution)
+		assignments, err := distribution.Assign(plan, planSpaces)
+		if err != nil {
+			problems = append(problems, "chunk distribution failed: "+err.Error())
+		} else {
+			assignments, coding := placeCopies(assignments, planSpaces, nil)
+			if coding != nil {
+				response["erasure_coding"] = coding
+			}
+			response["plan"] = fileprocessor.ApplyAssignments(plan, assignments)
+			response["assignments"] = assignments
+			response["num_chunks"] = len(plan)
+		}
+	}
+
+	response["verdict"] = "go"
+	if len(problems) > 0 {
+		response["verdict"] = "no-go"
+	}
+	response["problems"] = problems
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
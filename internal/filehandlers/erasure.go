@@ -0,0 +1,197 @@
+package filehandlers
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/fileprocessor"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// placeCopies extends the assignments to every drive a chunk is stored on: one per shard when
+// chunks are erasure-coded, otherwise the CHUNK_REPLICAS copies. coding is the file's coding
+// when it has sharded chunks already, which new chunks have to share. The returned coding is
+// nil when the chunks are stored as copies.
+func placeCopies(assignments []models.ChunkAssignment, drives []models.DriveSpaceInfo, coding *models.ErasureCoding) ([]models.ChunkAssignment, *models.ErasureCoding) {
+	if coding == nil {
+		coding = fileprocessor.ErasureCodingFor(drives)
+	}
+	if coding != nil {
+		sharded, err := fileprocessor.AssignShards(assignments, drives, coding)
+		if err == nil {
+			return sharded, coding
+		}
+		log.Printf("Storing chunks as copies instead of shards: %v", err)
+	}
+	if factor := fileprocessor.GetReplicationFactor(); factor > 1 {
+		assignments = fileprocessor.AddReplicas(assignments, drives, factor)
+	}
+	return assignments, nil
+}
+
+// uploadSealedChunks uploads every sealed chunk to the drives of its assignment, whole or, when
+// coding is set, as its shards, failing over to the other drives when one is full. Shards get their checksums under checksumAlgo, the rest of the
+// checksums are left to the caller like UploadChunksToDrivers does.
+func uploadSealedChunks(ctx context.Context, sealedPaths []string, assignments []models.ChunkAssignment, order []int, drives []models.DriveSpaceInfo, coding *models.ErasureCoding, checksumAlgo string, progressCallback func(int, int), uploadedCallback func(models.ChunkReplica)) ([]models.ChunkMetadata, error) {
+	if coding == nil {
+		return drivemanager.UploadChunksToDrivers(ctx, sealedPaths, assignments, order, drives, progressCallback, uploadedCallback)
+	}
+
+	shardPaths := make([][]string, 0, len(sealedPaths))
+	checksums := make([][]string, 0, len(sealedPaths))
+	sizes := make([]int64, 0, len(sealedPaths))
+	defer func() {
+		for _, paths := range shardPaths {
+			for _, path := range paths {
+				os.Remove(path)
+			}
+		}
+	}()
+	for i, path := range sealedPaths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat chunk %d: %w", assignments[i].ChunkID, err)
+		}
+		paths, sums, err := fileprocessor.EncodeShards(path, coding, checksumAlgo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to shard chunk %d: %w", assignments[i].ChunkID, err)
+		}
+		shardPaths = append(shardPaths, paths)
+		checksums = append(checksums, sums)
+		sizes = append(sizes, info.Size())
+	}
+
+	chunkMetadata, err := drivemanager.UploadShardsToDrivers(ctx, shardPaths, assignments, order, drives, progressCallback, uploadedCallback)
+	if err != nil {
+		return nil, err
+	}
+	for i := range chunkMetadata {
+		chunkMetadata[i].StoredSize = sizes[i]
+		for j := range chunkMetadata[i].Replicas {
+			replica := &chunkMetadata[i].Replicas[j]
+			replica.Checksum = checksums[i][replica.Shard-1]
+		}
+	}
+	return chunkMetadata, nil
+}
+
+// failUpload fails the session whose chunks couldn't all be uploaded, with the code
+// quota_exceeded when no drive had room for one of them
+func failUpload(ctx context.Context, sessionID primitive.ObjectID, progress float64, err error) {
+	log.Printf("Upload of session %s failed: %v", sessionID.Hex(), err)
+	var full *drivemanager.DriveFullError
+	if errors.As(err, &full) {
+		fileprocessor.FailSessionWithCode(ctx, sessionID, progress, middleware.ErrCodeQuotaExceeded, fmt.Sprintf("Upload failed: %v", err))
+		return
+	}
+	fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", progress, fmt.Sprintf("Upload failed: %v", err))
+}
+
+// fetchShards rebuilds an erasure-coded chunk into its place in dst from the first of its
+// shards that download with their checksum, as many as the coding has data shards
+func fetchShards(ctx context.Context, dst io.WriterAt, chunk models.StoredChunk, coding *models.ErasureCoding, dataKey []byte, encryption *models.EncryptionMetadata) error {
+	if coding == nil {
+		return fmt.Errorf("chunk %d is sharded but its file has no erasure coding", chunk.ChunkID)
+	}
+
+	dir, err := os.MkdirTemp(fileprocessor.GetUploadTempDir(), fmt.Sprintf("shards_%03d_*", chunk.ChunkID))
+	if err != nil {
+		return fmt.Errorf("chunk %d: failed to create temp dir: %w", chunk.ChunkID, err)
+	}
+	defer os.RemoveAll(dir)
+
+	shards := make(map[int]io.ReaderAt, coding.DataShards)
+	var errs []error
+	for _, replica := range drivemanager.OrderReplicas(chunk.Replicas) {
+		if len(shards) == coding.DataShards {
+			break
+		}
+		if _, ok := shards[replica.Shard-1]; ok || replica.Shard == 0 {
+			continue
+		}
+		f, err := fetchShard(ctx, dir, chunk, replica)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			log.Printf("Failed to fetch shard %d of chunk %d from drive %s: %v", replica.Shard, chunk.ChunkID, replica.DriveAccountID.Hex(), err)
+			errs = append(errs, err)
+			continue
+		}
+		defer f.Close()
+		shards[replica.Shard-1] = f
+	}
+	if len(shards) < coding.DataShards {
+		return fmt.Errorf("chunk %d: %d of the %d shards needed could be fetched: %w", chunk.ChunkID, len(shards), coding.DataShards, errors.Join(errs...))
+	}
+
+	return writeChunk(dst, chunk, dataKey, encryption, func(w io.Writer) (int64, error) {
+		return fileprocessor.JoinShards(w, shards, coding, chunk.StoredSize)
+	})
+}
+
+// fetchShard downloads one shard of a chunk into a file in dir, checking it against the
+// shard's checksum. Like fetchReplica it reads the chunk cache first.
+func fetchShard(ctx context.Context, dir string, chunk models.StoredChunk, replica models.ChunkReplica) (*os.File, error) {
+	f, err := os.CreateTemp(dir, fmt.Sprintf("shard_%02d_*", replica.Shard))
+	if err != nil {
+		return nil, err
+	}
+
+	if cached, ok := fileprocessor.OpenCachedChunk(replica.DriveFileID, replica.Checksum); ok {
+		err := copyShard(f, chunk, replica, func(w io.Writer) (int64, error) {
+			return io.Copy(w, cached)
+		})
+		cached.Close()
+		if err == nil {
+			return f, nil
+		}
+		log.Printf("Cached copy of shard %d of chunk %d is invalid, fetching it from drive %s: %v", replica.Shard, chunk.ChunkID, replica.DriveAccountID.Hex(), err)
+		fileprocessor.DropCachedChunk(replica.DriveFileID, replica.Checksum)
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	cache := fileprocessor.NewChunkCacheWriter(replica.DriveFileID, replica.Checksum)
+	err = copyShard(f, chunk, replica, func(w io.Writer) (int64, error) {
+		if cache != nil {
+			w = io.MultiWriter(w, cache)
+		}
+		return drivemanager.DownloadChunkFromDrive(ctx, replica.DriveAccountID, replica.DriveFileID, w)
+	})
+	cache.Finish(err == nil)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// copyShard writes the shard, read into the writer it is given by read, to f and checks it
+// against the shard's checksum
+func copyShard(f *os.File, chunk models.StoredChunk, replica models.ChunkReplica, read func(io.Writer) (int64, error)) error {
+	hash, err := fileprocessor.NewHash(chunk.ChecksumAlgo)
+	if err != nil {
+		return fmt.Errorf("chunk %d: %w", chunk.ChunkID, err)
+	}
+	if _, err := read(io.MultiWriter(f, hash)); err != nil {
+		return fmt.Errorf("failed to download shard %d of chunk %d: %w", replica.Shard, chunk.ChunkID, err)
+	}
+	if checksum := fmt.Sprintf("%x", hash.Sum(nil)); checksum != replica.Checksum {
+		return fmt.Errorf("shard %d of chunk %d checksum mismatch", replica.Shard, chunk.ChunkID)
+	}
+	return nil
+}
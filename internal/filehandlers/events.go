@@ -0,0 +1,127 @@
+package filehandlers
+
+import (
+	"SE/internal/fileprocessor"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// How often an idle event stream gets a keepalive and rechecks its session, which also
+// catches an outcome the stream missed
+const sessionEventsKeepalive = 15 * time.Second
+
+// UploadEventsHandler - GET /api/files/upload/events/:session_id
+func UploadEventsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	sessionID, err := primitive.ObjectIDFromHex(r.PathValue("session_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid session_id")
+		return
+	}
+
+	session, err := store.GetUploadSession(r.Context(), sessionID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get session")
+		return
+	}
+	if session == nil {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "session not found")
+		return
+	}
+	if session.UserID != userID {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, "unauthorized")
+		return
+	}
+
+	// Subscribed before the first snapshot so no update falls in between
+	events, unsubscribe := fileprocessor.SubscribeSession(sessionID)
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Keeps reverse proxies from buffering the stream
+	w.WriteHeader(http.StatusOK)
+
+	if err := writeSessionEvent(w, rc, "status", uploadStatus(session)); err != nil {
+		log.Printf("Event stream of session %s unavailable: %v", sessionID.Hex(), err)
+		return
+	}
+	if sessionFinished(session) {
+		writeSessionOutcome(w, rc, session)
+		return
+	}
+
+	keepalive := time.NewTicker(sessionEventsKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			if err := writeSessionEvent(w, rc, event.Type, event); err != nil {
+				return
+			}
+			if !event.Terminal() {
+				continue
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+
+		// The stored session is the source of truth for the outcome
+		session, err = store.GetUploadSession(r.Context(), sessionID)
+		if err != nil || session == nil {
+			return
+		}
+		if sessionFinished(session) {
+			writeSessionOutcome(w, rc, session)
+			return
+		}
+	}
+}
+
+// sessionFinished reports whether the session's processing ended
+func sessionFinished(session *models.UploadSession) bool {
+	return fileprocessor.SessionEvent{Status: session.Status}.Terminal()
+}
+
+// writeSessionOutcome sends the final "done" event of a stream
+func writeSessionOutcome(w http.ResponseWriter, rc *http.ResponseController, session *models.UploadSession) {
+	outcome := map[string]interface{}{
+		"status":        session.Status,
+		"error_message": session.ErrorMessage,
+	}
+	if session.ErrorCode != "" {
+		outcome["error_code"] = session.ErrorCode
+	}
+	if !session.FileID.IsZero() {
+		outcome["file_id"] = session.FileID.Hex()
+	}
+	writeSessionEvent(w, rc, "done", outcome)
+}
+
+func writeSessionEvent(w http.ResponseWriter, rc *http.ResponseController, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
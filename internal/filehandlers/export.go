@@ -0,0 +1,261 @@
+package filehandlers
+
+import (
+	"SE/internal/audit"
+	"SE/internal/fileprocessor"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// exporting holds the users whose export is running in this process
+var (
+	exportingMu sync.Mutex
+	exporting   = make(map[primitive.ObjectID]bool)
+)
+
+// ExportHandler routes /api/account/export by method
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		StartExportHandler(w, r)
+	case "GET", "HEAD":
+		GetExportHandler(w, r)
+	default:
+		middleware.WriteMethodNotAllowed(w, "POST", "GET")
+	}
+}
+
+// StartExportHandler - POST /api/account/export
+// Streams every active file of the user as a ZIP archive. Files are reconstructed one at a time
+// and copied into the archive as it's sent, so it is never staged on disk. Progress is recorded
+// in an export job GET returns, and only one export of a user runs at a time.
+func StartExportHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	job, files, err := startExportJob(r.Context(), userID)
+	if err != nil {
+		log.Printf("Failed to start export of user %s: %v", userID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if files == nil {
+		middleware.WriteJSONErrorDetails(w, http.StatusConflict, middleware.ErrCodeConflict, "an export is already running", map[string]interface{}{
+			"export_id": job.ID.Hex(),
+		})
+		return
+	}
+	defer func() {
+		exportingMu.Lock()
+		delete(exporting, userID)
+		exportingMu.Unlock()
+	}()
+
+	// Request context may already be cancelled, progress is recorded regardless
+	jobCtx := middleware.WithRequestID(context.Background(), middleware.GetRequestID(r.Context()))
+	log.Printf("Export job %s started for user %s: %d files", job.ID.Hex(), userID.Hex(), job.TotalFiles)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": "2xpfm-export-" + job.StartedAt.Format("20060102") + ".zip",
+	}))
+	w.Header().Set("X-Export-ID", job.ID.Hex())
+
+	// Once the archive has started a failure can't be answered with an error, the client is
+	// left with a truncated archive and the job records why
+	out := &exportWriter{w: middleware.ThrottleResponseWriter(fileprocessor.WithUserBandwidth(r.Context(), userID), w)}
+	zw := zip.NewWriter(out)
+	names := make(map[string]bool)
+	for i := range files {
+		err := exportFile(r.Context(), zw, names, &files[i])
+		if err != nil && (out.err != nil || r.Context().Err() != nil) {
+			log.Printf("Export job %s stopped, client went away: %v", job.ID.Hex(), err)
+			job.Status = "failed"
+			job.Error = fmt.Sprintf("download stopped after %d of %d files", job.ExportedFiles, job.TotalFiles)
+			saveExportJob(jobCtx, job)
+			return
+		}
+		if err != nil {
+			log.Printf("Export job %s left out file %s: %v", job.ID.Hex(), files[i].ID.Hex(), err)
+			job.FailedFiles = append(job.FailedFiles, files[i].ID)
+		} else {
+			job.ExportedFiles++
+			job.ExportedBytes += files[i].OriginalSize
+		}
+		saveExportJob(jobCtx, job)
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Export job %s failed to finish the archive: %v", job.ID.Hex(), err)
+		job.Status = "failed"
+		job.Error = "failed to finish the archive"
+		saveExportJob(jobCtx, job)
+		return
+	}
+
+	now := time.Now().UTC()
+	job.Status = "completed"
+	job.CompletedAt = &now
+	saveExportJob(jobCtx, job)
+	audit.Record(r, userID, models.AuditDataExported, map[string]string{
+		"export_id": job.ID.Hex(),
+		"files":     strconv.Itoa(job.ExportedFiles),
+	})
+	log.Printf("Export job %s completed: %d of %d files, %d bytes, %d failed",
+		job.ID.Hex(), job.ExportedFiles, job.TotalFiles, job.ExportedBytes, len(job.FailedFiles))
+}
+
+// startExportJob creates a running export job of the user's active files and returns it with
+// the files. While another export of the user runs, that export's job is returned without files.
+func startExportJob(ctx context.Context, userID primitive.ObjectID) (*models.ExportJob, []models.StoredFile, error) {
+	exportingMu.Lock()
+	defer exportingMu.Unlock()
+
+	if exporting[userID] {
+		job, err := store.GetLatestExportJob(ctx, userID)
+		if err != nil || job == nil {
+			return nil, nil, fmt.Errorf("export running without a job: %v", err)
+		}
+		return job, nil, nil
+	}
+
+	listed, err := store.ListUserFiles(ctx, userID, "", nil, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := []models.StoredFile{}
+	for _, file := range listed {
+		if file.Status == "active" {
+			files = append(files, file)
+		}
+	}
+
+	job := &models.ExportJob{UserID: userID, Status: "running", TotalFiles: len(files)}
+	if err := store.CreateExportJob(ctx, job); err != nil {
+		return nil, nil, err
+	}
+	exporting[userID] = true
+	return job, files, nil
+}
+
+// exportFile copies the file into the archive, reconstructing it unless a recent download
+// session of the owner still has it on disk
+func exportFile(ctx context.Context, zw *zip.Writer, names map[string]bool, file *models.StoredFile) error {
+	session, err := store.FindReusableDownloadSession(ctx, file.UserID, file.ID)
+	if err != nil {
+		log.Printf("Failed to look up download session: %v", err)
+	}
+	reuse := session != nil && session.Checksum == file.OriginalChecksum && fileprocessor.ReconstructionAvailable(session)
+
+	if !reuse {
+		session, err = fileprocessor.CreateDownloadSession(ctx, file.UserID, file)
+		if err != nil {
+			return fmt.Errorf("failed to create download session: %w", err)
+		}
+		defer fileprocessor.BeginReconstruction(session.ID)()
+		if err := reconstructSession(ctx, session, file); err != nil {
+			return err
+		}
+		// Exports go through every file, leaving them all for the download sweeper could fill the disk
+		defer os.Remove(session.ReconstructedPath)
+	}
+
+	f, err := fileprocessor.OpenDownloadFile(session, session.ReconstructedPath)
+	if err != nil {
+		return fmt.Errorf("failed to open reconstructed file: %w", err)
+	}
+	defer f.Close()
+
+	// Stored rather than deflated, most large files are compressed already
+	entry, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     exportName(names, file.OriginalFilename),
+		Method:   zip.Store,
+		Modified: file.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, f)
+	return err
+}
+
+// exportName returns the name of the file in the archive. Path separators are replaced so
+// every file lands at the top, and a name already taken, ignoring case, gets " (2)", " (3)"...
+// before its extension.
+func exportName(names map[string]bool, filename string) string {
+	base := strings.NewReplacer("/", "_", "\\", "_").Replace(filename)
+	if base == "" || base == "." || base == ".." {
+		base = "file"
+	}
+	ext := path.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+
+	name := base
+	for n := 2; names[strings.ToLower(name)]; n++ {
+		name = fmt.Sprintf("%s (%d)%s", stem, n, ext)
+	}
+	names[strings.ToLower(name)] = true
+	return name
+}
+
+// exportWriter remembers the first failed write, telling a client that went away from a file
+// that couldn't be exported
+type exportWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *exportWriter) Write(p []byte) (int, error) {
+	n, err := e.w.Write(p)
+	if err != nil && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+func saveExportJob(ctx context.Context, job *models.ExportJob) {
+	if err := store.SaveExportJob(ctx, job); err != nil {
+		log.Printf("Failed to save progress of export job %s: %v", job.ID.Hex(), err)
+	}
+}
+
+// GetExportHandler - GET /api/account/export
+// Returns the user's latest export job. A job left running by a process that stopped is
+// reported as interrupted.
+func GetExportHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	exportingMu.Lock()
+	job, err := store.GetLatestExportJob(r.Context(), userID)
+	if err == nil && job != nil && job.Status == "running" && !exporting[userID] {
+		job.Status = "interrupted"
+	}
+	exportingMu.Unlock()
+
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if job == nil {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "no export found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
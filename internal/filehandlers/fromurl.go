@@ -0,0 +1,166 @@
+package filehandlers
+
+import (
+	"SE/internal/audit"
+	"SE/internal/fileprocessor"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UploadFromURLHandler - POST /api/files/upload/from-url
+func UploadFromURLHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var req struct {
+		URL      string            `json:"url"`
+		Headers  map[string]string `json:"headers,omitempty"` // Sent to the remote host, e.g. Authorization
+		Filename string            `json:"filename"`
+		Compress bool              `json:"compress,omitempty"`
+		Tags     []string          `json:"tags,omitempty"`
+
+		// Processing options, as for finalize
+		Strategy         models.ChunkingStrategy `json:"strategy"`
+		ManualChunkSizes []int64                 `json:"manual_chunk_sizes,omitempty"`
+		Distribution     models.DistributionMode `json:"distribution_strategy,omitempty"`
+		ChunkSizeBytes   int64                   `json:"chunk_size_bytes,omitempty"`
+		Thumbnail        bool                    `json:"thumbnail,omitempty"`
+		Metadata         bool                    `json:"metadata,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		middleware.WriteDecodeError(w, err, "invalid request")
+		return
+	}
+	if req.URL == "" || req.Filename == "" {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "url and filename are required")
+		return
+	}
+	if err := fileprocessor.CheckFilename(req.Filename); err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	tags, err := fileprocessor.NormalizeTags(req.Tags)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if _, err := fileprocessor.GetDistributionStrategy(req.Distribution); err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if req.ChunkSizeBytes != 0 {
+		if err := fileprocessor.ValidateChunkSize(req.ChunkSizeBytes); err != nil {
+			middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+			return
+		}
+	}
+
+	// The download outlives this request, failures it records reference it
+	ctx := middleware.WithRequestID(context.Background(), middleware.GetRequestID(r.Context()))
+	ctx = audit.WithClientIP(ctx, r)
+	// The remote download and the chunk uploads count against the user's bandwidth
+	ctx = fileprocessor.WithUserBandwidth(ctx, userID)
+	ctx, cancel := context.WithCancel(ctx)
+
+	resp, err := fileprocessor.OpenRemoteFile(ctx, req.URL, req.Headers)
+	if err != nil {
+		cancel()
+		if errors.Is(err, fileprocessor.ErrRemoteNotAllowed) {
+			middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+			return
+		}
+		log.Printf("Failed to open remote file: %v", err)
+		middleware.WriteJSONError(w, http.StatusBadGateway, middleware.ErrCodeRemoteUnreachable, err.Error())
+		return
+	}
+	started := false
+	defer func() {
+		if !started {
+			resp.Body.Close()
+			cancel()
+		}
+	}()
+
+	// The size is needed up front for the quota and the session
+	size := resp.ContentLength
+	if size <= 0 {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "remote server did not report a Content-Length")
+		return
+	}
+	if size > fileprocessor.GetRemoteMaxSize() {
+		middleware.WriteJSONError(w, http.StatusRequestEntityTooLarge, middleware.ErrCodeTooLarge, fmt.Sprintf("remote file size %d exceeds maximum allowed %d bytes", size, fileprocessor.GetRemoteMaxSize()))
+		return
+	}
+	if _, ok := checkUploadFits(w, r, userID, size, true); !ok {
+		return
+	}
+
+	session, err := fileprocessor.CreateUploadSession(r.Context(), userID, req.Filename, size, 0, req.Compress, nil, tags)
+	if err != nil {
+		log.Printf("Failed to create upload session: %v", err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, err.Error())
+		return
+	}
+
+	contentType, body := fileprocessor.SniffRemoteContentType(resp.Body, session.OriginalFilename)
+	if err := store.UpdateSessionContentType(r.Context(), session.ID, contentType); err != nil {
+		log.Printf("Failed to record content type: %v", err)
+	}
+	session.ContentType = contentType
+
+	processReq := models.ProcessRequest{
+		SessionID:        session.ID.Hex(),
+		Strategy:         req.Strategy,
+		ManualChunkSizes: req.ManualChunkSizes,
+		Distribution:     req.Distribution,
+		ChunkSizeBytes:   req.ChunkSizeBytes,
+		Thumbnail:        req.Thumbnail,
+		Metadata:         req.Metadata,
+	}
+
+	// Tracked before the goroutine starts so neither a shutdown nor the sweeper can miss it
+	done := fileprocessor.BeginProcessing(session.ID)
+	started = true
+	go func() {
+		defer done()
+		defer cancel()
+		defer resp.Body.Close()
+
+		log.Printf("Downloading %d bytes from remote URL for session %s", size, session.ID.Hex())
+		if err := fileprocessor.FetchRemoteFile(ctx, session, middleware.ThrottleReader(ctx, body)); err != nil {
+			log.Printf("Remote download failed for session %s: %v", session.ID.Hex(), err)
+			os.Remove(session.TempFilePath)
+			fileprocessor.UpdateSessionStatus(ctx, session.ID, "failed", 0, err.Error())
+			return
+		}
+		session.UploadedSize = size
+
+		if err := fileprocessor.UpdateSessionStatus(ctx, session.ID, "processing", 0, "Starting..."); err != nil {
+			log.Printf("Failed to update status to processing: %v", err)
+		}
+		// Once downloaded the file is retried like an uploaded one
+		if err := fileprocessor.StartUploadAttempt(ctx, session.ID, processReq); err != nil {
+			log.Printf("Failed to record the attempt of session %s: %v", session.ID.Hex(), err)
+		}
+		processAndUploadFile(ctx, session, processReq, userID)
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":      "download started",
+		"session_id":   session.ID.Hex(),
+		"status_url":   fmt.Sprintf("%s/files/upload/status/%s", middleware.APIPrefix, session.ID.Hex()),
+		"total_size":   size,
+		"content_type": contentType,
+	})
+}
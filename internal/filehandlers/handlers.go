@@ -1,19 +1,31 @@
 package filehandlers
 
 import (
+	"SE/internal/audit"
 	"SE/internal/drivemanager"
 	"SE/internal/fileprocessor"
+	"SE/internal/manifest"
+	"SE/internal/metrics"
+	"SE/internal/middleware"
 	"SE/internal/models"
 	"SE/internal/store"
+	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -24,43 +36,233 @@ func InitiateUploadHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Parse request
 	var req struct {
-		Filename string `json:"filename"`
-		FileSize int64  `json:"file_size"`
+		Filename  string `json:"filename"`
+		FileSize  int64  `json:"file_size"`
+		ChunkSize int64  `json:"chunk_size,omitempty"` // Optional, server default otherwise
+		Compress  bool   `json:"compress,omitempty"`   // Gzip chunks before encryption where it saves space
+		// The client encrypts the file itself with a key derived from key_salt, the server never sees the key
+		ClientEncrypted bool     `json:"client_encrypted,omitempty"`
+		KeySalt         string   `json:"key_salt,omitempty"`
+		Tags            []string `json:"tags,omitempty"` // Given to the stored file
+		// SHA-256 of the file, an identical active file is returned instead of starting an upload
+		Checksum string `json:"checksum,omitempty"`
+
+		// Plan the upload without starting it, with the processing options finalize will get
+		DryRun           bool                    `json:"dry_run,omitempty"`
+		Strategy         models.ChunkingStrategy `json:"strategy,omitempty"`
+		ManualChunkSizes []int64                 `json:"manual_chunk_sizes,omitempty"`
+		Distribution     models.DistributionMode `json:"distribution_strategy,omitempty"`
+		ChunkSizeBytes   int64                   `json:"chunk_size_bytes,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid request", http.StatusBadRequest)
+		middleware.WriteDecodeError(w, err, "invalid request")
 		return
 	}
 
 	if req.Filename == "" || req.FileSize <= 0 {
-		http.Error(w, "filename and file_size are required", http.StatusBadRequest)
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "filename and file_size are required")
+		return
+	}
+	if err := fileprocessor.CheckFilename(req.Filename); err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	tags, err := fileprocessor.NormalizeTags(req.Tags)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	// A file is either encrypted by the client or by the server, never both
+	var clientEncryption *models.ClientEncryptionMetadata
+	if req.ClientEncrypted {
+		if req.Compress {
+			middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "compress can't be used with client_encrypted, ciphertext doesn't compress")
+			return
+		}
+		clientEncryption, err = fileprocessor.NewClientEncryption(req.KeySalt)
+		if err != nil {
+			middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+			return
+		}
+	} else if req.KeySalt != "" {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "key_salt requires client_encrypted")
+		return
+	}
+
+	// Ciphertext of the client differs between uploads, so only plain files can be matched
+	req.Checksum = strings.ToLower(strings.TrimSpace(req.Checksum))
+	if req.Checksum != "" {
+		if clientEncryption != nil {
+			middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "checksum can't be used with client_encrypted")
+			return
+		}
+		if !isSHA256Hex(req.Checksum) {
+			middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "checksum must be a hex SHA-256")
+			return
+		}
+	}
+
+	// Nothing is stored for a dry run, so it has nothing to replay either
+	if req.DryRun {
+		dryRunUpload(w, r, userID, dryRunRequest{
+			FileSize:         req.FileSize,
+			ChunkSize:        req.ChunkSize,
+			ServerEncrypted:  clientEncryption == nil,
+			Strategy:         req.Strategy,
+			ManualChunkSizes: req.ManualChunkSizes,
+			Distribution:     req.Distribution,
+			ChunkSizeBytes:   req.ChunkSizeBytes,
+		})
+		return
+	}
+
+	if err := fileprocessor.CheckUploadLimits(req.FileSize, req.ChunkSize); err != nil {
+		writeLimitError(w, err)
+		return
+	}
+
+	if req.Checksum != "" {
+		existing, err := store.FindDuplicateStoredFile(r.Context(), userID, req.Checksum, req.FileSize)
+		if err != nil {
+			log.Printf("Failed to look up duplicate file: %v", err)
+			middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to check for duplicates")
+			return
+		}
+		if existing != nil {
+			response := fileMetadata(existing)
+			response["duplicate"] = true
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+
+	// A retried request with the same Idempotency-Key gets the session the first one created
+	var claim *models.IdempotencyKey
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+		var replayed bool
+		claim, replayed = claimIdempotencyKey(w, r, userID, key, req)
+		if claim == nil || replayed {
+			return
+		}
+		// Frees the key again unless a session is recorded for it
+		defer func() {
+			if claim != nil {
+				fileprocessor.DeleteIdempotencyKey(context.WithoutCancel(r.Context()), claim)
+			}
+		}()
+	}
+
+	driveSpaces, ok := checkUploadFits(w, r, userID, req.FileSize, clientEncryption == nil)
+	if !ok {
 		return
 	}
 
 	// Create upload session
-	session, err := fileprocessor.CreateUploadSession(r.Context(), userID, req.Filename, req.FileSize)
+	session, err := fileprocessor.CreateUploadSession(r.Context(), userID, req.Filename, req.FileSize, req.ChunkSize, req.Compress, clientEncryption, tags)
+	if writeLimitError(w, err) {
+		return
+	}
 	if err != nil {
 		log.Printf("Failed to create upload session: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, err.Error())
 		return
 	}
 
+	if claim != nil {
+		if err := fileprocessor.SetIdempotencyKeySession(r.Context(), claim, session.ID); err != nil {
+			log.Printf("Failed to record session of idempotency key: %v", err)
+		} else {
+			claim = nil
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(initiateResponse(session, driveSpaces))
+}
+
+// writeLimitError writes the 413 of a file past MAX_FILE_SIZE_GB or MAX_CHUNKS, with the limit
+// it went past, reporting whether err was one
+func writeLimitError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, fileprocessor.ErrFileTooLarge):
+		middleware.WriteJSONErrorDetails(w, http.StatusRequestEntityTooLarge, middleware.ErrCodeTooLarge, err.Error(), map[string]interface{}{
+			"max_file_size": fileprocessor.GetMaxFileSize(),
+		})
+	case errors.Is(err, fileprocessor.ErrTooManyChunks):
+		middleware.WriteJSONErrorDetails(w, http.StatusRequestEntityTooLarge, middleware.ErrCodeTooLarge, err.Error(), map[string]interface{}{
+			"max_chunks": fileprocessor.GetMaxChunks(),
+		})
+	default:
+		return false
+	}
+	return true
+}
+
+func isSHA256Hex(s string) bool {
+	sum, err := hex.DecodeString(s)
+	return err == nil && len(sum) == sha256.Size
+}
+
+// initiateResponse is the initiate response for a created session
+func initiateResponse(session *models.UploadSession, driveSpaces []models.DriveSpaceInfo) map[string]interface{} {
+	return map[string]interface{}{
+		"session_id":       session.ID.Hex(),
+		"upload_url":       fmt.Sprintf("%s/files/upload/chunk?session_id=%s", middleware.APIPrefix, session.ID.Hex()),
+		"drive_spaces":     driveSpaces,
+		"max_file_size":    fileprocessor.GetMaxFileSize(),
+		"chunk_size":       session.ChunkSize,
+		"total_chunks":     fileprocessor.TotalUploadChunks(session),
+		"content_type":     session.ContentType,
+		"compress":         session.Compress,
+		"client_encrypted": session.ClientEncryption != nil,
+		"tags":             session.Tags,
+	}
+}
+
+// checkUploadFits enforces the user's storage quota and the free space of their drives for an
+// upload of size bytes, writing the error response when it doesn't fit. The drive spaces are
+// returned for the initiate response.
+func checkUploadFits(w http.ResponseWriter, r *http.Request, userID primitive.ObjectID, size int64, serverEncrypted bool) ([]models.DriveSpaceInfo, bool) {
+	// Enforce the user's storage quota
+	quota, err := fileprocessor.GetQuotaUsage(r.Context(), userID)
+	if err != nil {
+		log.Printf("Failed to get quota usage: %v", err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to check storage quota")
+		return nil, false
+	}
+	if !quota.Allows(size) {
+		middleware.WriteJSONErrorDetails(w, http.StatusRequestEntityTooLarge, middleware.ErrCodeQuotaExceeded, "storage quota exceeded", map[string]interface{}{
+			"used_bytes":      quota.UsedBytes,
+			"limit_bytes":     quota.LimitBytes,
+			"requested_bytes": size,
+		})
+		return nil, false
+	}
+
 	// Get available drive spaces
-	driveSpaces, err := drivemanager.GetUserDriveSpaces(r.Context(), userID)
+	driveSpaces, err := drivemanager.GetUserDriveSpaces(r.Context(), userID, false)
 	if err != nil {
 		log.Printf("Failed to get drive spaces: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, err.Error())
+		return nil, false
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"session_id":    session.ID.Hex(),
-		"upload_url":    fmt.Sprintf("/api/files/upload/chunk?session_id=%s", session.ID.Hex()),
-		"drive_spaces":  driveSpaces,
-		"max_file_size": fileprocessor.GetMaxFileSize(),
-	})
+	// Refuse uploads the linked drives can't hold before any of the file is sent
+	capacity := fileprocessor.EstimateDriveCapacity(driveSpaces, size, serverEncrypted)
+	if !capacity.Fits() {
+		middleware.WriteJSONErrorDetails(w, http.StatusInsufficientStorage, middleware.ErrCodeInsufficientStorage, "not enough free space on linked drives", map[string]interface{}{
+			"available_bytes": capacity.AvailableBytes,
+			"required_bytes":  capacity.RequiredBytes,
+			"drive_spaces":    driveSpaces,
+		})
+		return nil, false
+	}
+
+	return driveSpaces, true
 }
 
 // UploadChunkHandler - POST /api/files/upload/chunk
@@ -70,61 +272,136 @@ func UploadChunkHandler(w http.ResponseWriter, r *http.Request) {
 	// Get session ID from query
 	sessionIDStr := r.URL.Query().Get("session_id")
 	if sessionIDStr == "" {
-		http.Error(w, "session_id required", http.StatusBadRequest)
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "session_id required")
 		return
 	}
 
 	sessionID, err := primitive.ObjectIDFromHex(sessionIDStr)
 	if err != nil {
-		http.Error(w, "invalid session_id", http.StatusBadRequest)
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid session_id")
+		return
+	}
+
+	// Chunks may arrive in any order, each names its index and declares the bytes it carries
+	chunkIndex, err := strconv.Atoi(r.URL.Query().Get("chunk_index"))
+	if err != nil || chunkIndex < 0 {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidChunk, "chunk_index required")
+		return
+	}
+
+	// Claimed before the session is read, so a request that just finished the chunk can't be missed
+	release, ok := fileprocessor.BeginChunk(sessionID, chunkIndex)
+	if !ok {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, fmt.Sprintf("chunk %d is being uploaded by another request", chunkIndex))
 		return
 	}
+	defer release()
 
 	// Get session
 	session, err := fileprocessor.GetSession(r.Context(), sessionID, userID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
 		return
 	}
 
-	// Parse multipart form
-	if err := r.ParseMultipartForm(100 << 20); err != nil { // 100 MB max in memory
-		http.Error(w, "failed to parse form", http.StatusBadRequest)
+	if chunkIndex >= fileprocessor.TotalUploadChunks(session) {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidChunk, fmt.Sprintf("chunk_index out of range, the file has %d chunks", fileprocessor.TotalUploadChunks(session)))
+		return
+	}
+	if err := fileprocessor.CheckChunkRange(session, chunkIndex, r.Header.Get("Content-Range")); err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidChunk, err.Error())
+		return
+	}
+	if slices.Contains(session.ReceivedChunks, chunkIndex) {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, fmt.Sprintf("chunk %d already received", chunkIndex))
+		return
+	}
+	offset, end := fileprocessor.UploadChunkRange(session, chunkIndex)
+
+	// A raw body is streamed straight to the temp file, a multipart form spills the chunk to
+	// disk past 1 MB. Either way memory stays bounded whatever the chunk size.
+	// A request carries at most one upload chunk of the session
+	isMultipart := strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+	bodyLimit := fileprocessor.ChunkBodyLimit(session, isMultipart)
+	if r.ContentLength > bodyLimit {
+		middleware.WriteBodyTooLarge(w, bodyLimit)
 		return
 	}
+	r.Body = http.MaxBytesReader(w, r.Body, bodyLimit)
+
+	var body io.Reader
+	var offsetStr string
+	if isMultipart {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			if limit, ok := middleware.IsBodyTooLarge(err); ok {
+				middleware.WriteBodyTooLarge(w, limit)
+				return
+			}
+			middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidChunk, "failed to parse form")
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
 
-	file, _, err := r.FormFile("chunk")
-	if err != nil {
-		http.Error(w, "chunk file required", http.StatusBadRequest)
+		file, _, err := r.FormFile("chunk")
+		if err != nil {
+			middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidChunk, "chunk file required")
+			return
+		}
+		defer file.Close()
+		body = file
+		offsetStr = r.FormValue("offset")
+	} else {
+		body = r.Body
+		offsetStr = r.URL.Query().Get("offset")
+		if r.ContentLength >= 0 && r.ContentLength != end-offset {
+			middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidChunk, fmt.Sprintf("Content-Length %d doesn't match Content-Range", r.ContentLength))
+			return
+		}
+	}
+	if v := r.Header.Get("X-Chunk-Size"); v != "" && v != strconv.FormatInt(end-offset, 10) {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidChunk, "X-Chunk-Size doesn't match Content-Range")
+		return
+	}
+	// offset is optional now the range says where the chunk goes, it has to agree
+	if offsetStr != "" && offsetStr != strconv.FormatInt(offset, 10) {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidChunk, "offset doesn't match Content-Range")
 		return
 	}
-	defer file.Close()
 
-	// Get chunk offset
-	offsetStr := r.FormValue("offset")
-	offset, _ := strconv.ParseInt(offsetStr, 10, 64)
+	// The first chunk carries the magic bytes, sniff the real content type from it.
+	// Client-encrypted uploads are ciphertext, so they keep the type guessed from the filename.
+	if offset == 0 && session.ClientEncryption == nil {
+		buffered := bufio.NewReaderSize(body, 512)
+		head, _ := buffered.Peek(512)
+		contentType := fileprocessor.DetectContentType(head, session.OriginalFilename)
+		if err := store.UpdateSessionContentType(r.Context(), sessionID, contentType); err != nil {
+			log.Printf("Failed to record content type: %v", err)
+		}
+		body = buffered
+	}
 
-	// Open or create temp file
-	tempFile, err := os.OpenFile(session.TempFilePath, os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		http.Error(w, "failed to create temp file", http.StatusInternalServerError)
+	body = middleware.ThrottleReader(fileprocessor.WithUserBandwidth(r.Context(), userID), body)
+	written, checksum, err := fileprocessor.WriteUploadChunk(session, offset, body, end-offset, r.Header.Get("X-Chunk-Checksum"))
+	metrics.UploadBytes.Add(float64(written))
+	if errors.Is(err, fileprocessor.ErrChunkSizeMismatch) || errors.Is(err, fileprocessor.ErrChunkChecksumMismatch) {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidChunk, err.Error())
 		return
 	}
-	defer tempFile.Close()
-
-	// Seek to offset
-	if _, err := tempFile.Seek(offset, 0); err != nil {
-		http.Error(w, "failed to seek file", http.StatusInternalServerError)
+	if limit, ok := middleware.IsBodyTooLarge(err); ok {
+		middleware.WriteBodyTooLarge(w, limit)
 		return
 	}
-
-	// Copy chunk data
-	written, err := io.Copy(tempFile, file)
 	if err != nil {
-		http.Error(w, "failed to write chunk", http.StatusInternalServerError)
+		log.Printf("Failed to write chunk for session %s: %v", sessionID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to write chunk")
 		return
 	}
 
+	// Record the chunk so clients can resume with only the missing ones
+	if err := fileprocessor.MarkChunksReceived(r.Context(), session, []int{chunkIndex}); err != nil {
+		log.Printf("Failed to record received chunks: %v", err)
+	}
+
 	// Calculate progress based on highest offset reached
 	// offset is where chunk starts, written is how many bytes were written
 	highestByte := offset + written
@@ -140,9 +417,12 @@ func UploadChunkHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"uploaded": session.UploadedSize,
-		"total":    session.TotalSize,
-		"progress": float64(session.UploadedSize) / float64(session.TotalSize) * 100,
+		"chunk_index": chunkIndex,
+		"uploaded":    session.UploadedSize,
+		"total":       session.TotalSize,
+		"progress":    float64(session.UploadedSize) / float64(session.TotalSize) * 100,
+		"written":     written,
+		"checksum":    checksum,
 	})
 }
 
@@ -153,53 +433,139 @@ func FinalizeUploadHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse request
 	var req models.ProcessRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid request", http.StatusBadRequest)
+		middleware.WriteDecodeError(w, err, "invalid request")
 		return
 	}
 
 	sessionID, err := primitive.ObjectIDFromHex(req.SessionID)
 	if err != nil {
-		http.Error(w, "invalid session_id", http.StatusBadRequest)
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid session_id")
 		return
 	}
 
 	// Get session
 	session, err := fileprocessor.GetSession(r.Context(), sessionID, userID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if session.Status != "uploading" {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, fmt.Sprintf("session is already %s", session.Status))
+		return
+	}
+	if !checkUploadComplete(w, session) {
+		return
+	}
+	discrepancies, err := fileprocessor.CheckFinalize(session, req.TotalSize, req.ChunkCount)
+	if err != nil {
+		log.Printf("Failed to check session %s: %v", sessionID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to check upload")
+		return
+	}
+	if len(discrepancies) > 0 {
+		messages := make([]string, 0, len(discrepancies))
+		for _, d := range discrepancies {
+			messages = append(messages, fmt.Sprintf("%s: %s", d.Field, d.Message))
+		}
+		middleware.WriteJSONErrorDetails(w, http.StatusBadRequest, middleware.ErrCodeUploadMismatch,
+			"upload doesn't match the session: "+strings.Join(messages, "; "),
+			map[string]interface{}{"discrepancies": discrepancies})
 		return
 	}
 
-	// Check upload is complete
-	if session.UploadedSize != session.TotalSize {
-		http.Error(w, fmt.Sprintf("upload incomplete: %d/%d bytes", session.UploadedSize, session.TotalSize), http.StatusBadRequest)
+	if _, err := fileprocessor.GetDistributionStrategy(req.Distribution); err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if req.ChunkSizeBytes != 0 {
+		if err := fileprocessor.ValidateChunkSize(req.ChunkSizeBytes); err != nil {
+			middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+			return
+		}
+	} else if err := validateStrategy(req.Strategy, req.ManualChunkSizes); err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
 		return
 	}
 
 	log.Printf("Finalizing upload for session %s, strategy: %s", sessionID.Hex(), req.Strategy)
 
-	// Update status to processing BEFORE starting goroutine
-	if err := fileprocessor.UpdateSessionStatus(r.Context(), sessionID, "processing", 0, "Starting..."); err != nil {
+	// Claimed BEFORE starting goroutine, a second finalize of the session gets a 409
+	claimed, err := fileprocessor.ClaimSessionForProcessing(r.Context(), sessionID, "Starting...")
+	if err != nil {
 		log.Printf("Failed to update status to processing: %v", err)
-		http.Error(w, "failed to update status", http.StatusInternalServerError)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to update status")
+		return
+	}
+	if !claimed {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "session is already being finalized")
 		return
 	}
+	// Kept with the attempt, a failed upload is processed again with the same request
+	if err := fileprocessor.StartUploadAttempt(r.Context(), sessionID, req); err != nil {
+		log.Printf("Failed to record the attempt of session %s: %v", sessionID.Hex(), err)
+	}
 
 	log.Printf("Starting background processing goroutine for session %s", sessionID.Hex())
 
 	// Process file asynchronously
-	go processAndUploadFile(context.Background(), session, req.Strategy, req.ManualChunkSizes, userID)
+	// Tracked before the goroutine starts so a shutdown can't miss it
+	done := fileprocessor.BeginProcessing(sessionID)
+
+	// Failures recorded by the background work reference the finalize request
+	ctx := middleware.WithRequestID(context.Background(), middleware.GetRequestID(r.Context()))
+	ctx = audit.WithClientIP(ctx, r)
+	// Uploading the chunks to the drives counts against the user's bandwidth
+	ctx = fileprocessor.WithUserBandwidth(ctx, userID)
+	go func() {
+		defer done()
+		processAndUploadFile(ctx, session, req, userID)
+	}()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message":    "processing started",
 		"session_id": sessionID.Hex(),
-		"status_url": fmt.Sprintf("/api/files/upload/status/%s", sessionID.Hex()),
+		"status_url": fmt.Sprintf("%s/files/upload/status/%s", middleware.APIPrefix, sessionID.Hex()),
 	})
 
 	log.Printf("Finalize response sent for session %s", sessionID.Hex())
 }
 
+// validateStrategy rejects a chunking strategy the pipeline would only fail on once processing
+// started
+func validateStrategy(strategy models.ChunkingStrategy, manualSizes []int64) error {
+	switch strategy {
+	case models.StrategyGreedy, models.StrategyBalanced, models.StrategyProportional, models.StrategyContentDefined:
+		return nil
+	case models.StrategyManual:
+		if len(manualSizes) == 0 {
+			return errors.New("manual_chunk_sizes is required for the manual strategy")
+		}
+		for i, size := range manualSizes {
+			if size <= 0 {
+				return fmt.Errorf("manual_chunk_sizes[%d] must be positive, got %d", i, size)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid chunking strategy %q", strategy)
+	}
+}
+
+// checkUploadComplete answers 400 with the missing chunks unless every chunk of the session
+// was received. The highest byte written doesn't tell, chunks arrive in any order.
+func checkUploadComplete(w http.ResponseWriter, session *models.UploadSession) bool {
+	missing := fileprocessor.MissingChunks(session)
+	if len(missing) == 0 {
+		return true
+	}
+	middleware.WriteJSONErrorDetails(w, http.StatusBadRequest, middleware.ErrCodeUploadIncomplete,
+		fmt.Sprintf("upload incomplete: %d of %d chunks missing", len(missing), fileprocessor.TotalUploadChunks(session)),
+		map[string]interface{}{"missing_chunks": missing})
+	return false
+}
+
 // GetUploadStatusHandler - GET /api/files/upload/status/:id
 func GetUploadStatusHandler(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("userID").(primitive.ObjectID)
@@ -208,45 +574,143 @@ func GetUploadStatusHandler(w http.ResponseWriter, r *http.Request) {
 	sessionIDStr := r.URL.Path[len("/api/files/upload/status/"):]
 	sessionID, err := primitive.ObjectIDFromHex(sessionIDStr)
 	if err != nil {
-		http.Error(w, "invalid session_id", http.StatusBadRequest)
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid session_id")
 		return
 	}
 
 	// Get session - but DON'T validate ownership or expiry for status checks
 	session, err := store.GetUploadSession(r.Context(), sessionID)
 	if err != nil {
-		http.Error(w, "failed to get session", http.StatusInternalServerError)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get session")
 		return
 	}
 	if session == nil {
-		http.Error(w, "session not found", http.StatusNotFound)
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "session not found")
 		return
 	}
 
 	// Verify ownership
 	if session.UserID != userID {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, "unauthorized")
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(uploadStatus(session))
+}
+
+// maxBatchStatusSessions caps the session IDs of one batch status request
+const maxBatchStatusSessions = 100
+
+// BatchUploadStatusHandler - POST /api/files/upload/status/batch
+func BatchUploadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var req struct {
+		SessionIDs []string `json:"session_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		middleware.WriteDecodeError(w, err, "invalid request")
+		return
+	}
+	if len(req.SessionIDs) == 0 {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "session_ids is required")
+		return
+	}
+	if len(req.SessionIDs) > maxBatchStatusSessions {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, fmt.Sprintf("at most %d session_ids per request", maxBatchStatusSessions))
+		return
+	}
+
+	// Malformed IDs are reported as not found along with unknown ones
+	notFound := []string{}
+	ids := make([]primitive.ObjectID, 0, len(req.SessionIDs))
+	for _, idStr := range req.SessionIDs {
+		id, err := primitive.ObjectIDFromHex(idStr)
+		if err != nil {
+			notFound = append(notFound, idStr)
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	// Sessions of other users are left out by the query, so they look unknown too
+	sessions, err := store.GetUserUploadSessions(r.Context(), userID, ids)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get sessions")
+		return
+	}
+
+	statuses := make(map[string]interface{}, len(sessions))
+	for _, session := range sessions {
+		statuses[session.ID.Hex()] = uploadStatus(session)
+	}
+	for _, id := range ids {
+		if _, ok := statuses[id.Hex()]; !ok {
+			notFound = append(notFound, id.Hex())
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessions":  statuses,
+		"not_found": notFound,
+	})
+}
+
+// uploadStatus is the status report of an upload session
+func uploadStatus(session *models.UploadSession) map[string]interface{} {
+	receivedChunks := session.ReceivedChunks
+	if receivedChunks == nil {
+		receivedChunks = []int{}
+	}
+	sort.Ints(receivedChunks)
+
+	response := map[string]interface{}{
 		"status":              session.Status,
 		"uploaded_size":       session.UploadedSize,
 		"total_size":          session.TotalSize,
 		"processing_progress": session.ProcessingProgress,
 		"error_message":       session.ErrorMessage,
 		"completed_at":        session.CompletedAt,
-	})
+		"chunk_size":          session.ChunkSize,
+		"total_chunks":        fileprocessor.TotalUploadChunks(session),
+		"received_chunks":     receivedChunks,
+		"missing_chunks":      fileprocessor.MissingChunks(session),
+	}
+	if !session.FileID.IsZero() {
+		response["file_id"] = session.FileID.Hex()
+	}
+	if session.ErrorCode != "" {
+		response["error_code"] = session.ErrorCode
+	}
+	if deadline := fileprocessor.FinalizeDeadline(session); deadline != nil {
+		response["finalize_deadline"] = deadline
+		response["finalize_remaining_seconds"] = max(0, int64(time.Until(*deadline).Seconds()))
+	}
+	if session.Retry != nil {
+		response["attempts"] = session.Retry.Attempts
+		if session.Retry.NextRetryAt != nil {
+			response["next_retry_at"] = session.Retry.NextRetryAt
+		}
+		if session.Retry.GaveUp {
+			response["gave_up"] = true
+		}
+	}
+
+	return response
 }
 
 // GetDriveSpacesHandler - GET /api/drive/space
 func GetDriveSpacesHandler(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("userID").(primitive.ObjectID)
 
-	driveSpaces, err := drivemanager.GetUserDriveSpaces(r.Context(), userID)
+	// ?refresh=true skips the cache and asks every drive for its quota
+	forceRefresh := r.URL.Query().Get("refresh") == "true"
+
+	driveSpaces, err := drivemanager.GetUserDriveSpaces(r.Context(), userID, forceRefresh)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, err.Error())
 		return
 	}
 
@@ -262,36 +726,109 @@ func CalculateChunkingHandler(w http.ResponseWriter, r *http.Request) {
 		FileSize         int64                   `json:"file_size"`
 		Strategy         models.ChunkingStrategy `json:"strategy"`
 		ManualChunkSizes []int64                 `json:"manual_chunk_sizes,omitempty"`
+		Distribution     models.DistributionMode `json:"distribution_strategy,omitempty"`
+		ChunkSizeBytes   int64                   `json:"chunk_size_bytes,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid request", http.StatusBadRequest)
+		middleware.WriteDecodeError(w, err, "invalid request")
+		return
+	}
+	if req.ChunkSizeBytes != 0 {
+		if err := fileprocessor.ValidateChunkSize(req.ChunkSizeBytes); err != nil {
+			middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+			return
+		}
+	}
+	if err := fileprocessor.CheckFileSize(req.FileSize); err != nil {
+		writeLimitError(w, err)
 		return
 	}
 
 	// Get drive spaces
-	driveSpaces, err := drivemanager.GetUserDriveSpaces(r.Context(), userID)
+	driveSpaces, err := drivemanager.GetUserDriveSpaces(r.Context(), userID, false)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, err.Error())
 		return
 	}
 
 	// Calculate chunking plan
-	plan, err := fileprocessor.CalculateChunkPlan(req.FileSize, driveSpaces, req.Strategy, req.ManualChunkSizes)
+	plan, warning, err := calculatePlan(req.FileSize, driveSpaces, req.Strategy, req.ManualChunkSizes, req.ChunkSizeBytes)
+	if writeLimitError(w, err) {
+		return
+	}
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	// Place the planned chunks on drives so the client can preview the layout
+	distribution, err := fileprocessor.GetDistributionStrategy(req.Distribution)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
 		return
 	}
+	assignments, err := distribution.Assign(plan, driveSpaces)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	assignments, coding := placeCopies(assignments, driveSpaces, nil)
+
+	response := map[string]interface{}{
+		"plan":                  fileprocessor.ApplyAssignments(plan, assignments),
+		"num_chunks":            len(plan),
+		"distribution_strategy": req.Distribution,
+		"assignments":           assignments,
+	}
+	if coding != nil {
+		response["erasure_coding"] = coding
+	}
+	if req.ChunkSizeBytes != 0 {
+		response["chunk_size_bytes"] = req.ChunkSizeBytes
+	}
+	if warning != "" {
+		response["warning"] = warning
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"plan":       plan,
-		"num_chunks": len(plan),
-	})
+	json.NewEncoder(w).Encode(response)
+}
+
+// calculatePlan splits the file into fixed-size chunks when chunkSize is set, otherwise with the
+// chunking strategy. Plans past MAX_CHUNKS fail, plans close to it come with a warning.
+func calculatePlan(fileSize int64, driveSpaces []models.DriveSpaceInfo, strategy models.ChunkingStrategy, manualSizes []int64, chunkSize int64) ([]models.ChunkPlan, string, error) {
+	plan, warning, err := planChunks(fileSize, driveSpaces, strategy, manualSizes, chunkSize)
+	if err != nil {
+		return nil, warning, err
+	}
+	if err := fileprocessor.CheckChunkCount(len(plan)); err != nil {
+		return nil, warning, err
+	}
+	if countWarning := fileprocessor.ChunkCountWarning(len(plan)); countWarning != "" {
+		if warning != "" {
+			warning += "; "
+		}
+		warning += countWarning
+	}
+	return plan, warning, nil
+}
+
+func planChunks(fileSize int64, driveSpaces []models.DriveSpaceInfo, strategy models.ChunkingStrategy, manualSizes []int64, chunkSize int64) ([]models.ChunkPlan, string, error) {
+	// Content-defined boundaries need the file's bytes, a preview can only assume average chunks
+	if strategy == models.StrategyContentDefined {
+		plan, _, err := fileprocessor.CalculateFixedSizePlan(fileSize, driveSpaces, fileprocessor.GetContentChunkSize())
+		return plan, "content-defined chunks vary in size with the file's content, this plan assumes chunks of the average size", err
+	}
+	if chunkSize != 0 {
+		return fileprocessor.CalculateFixedSizePlan(fileSize, driveSpaces, chunkSize)
+	}
+	plan, err := fileprocessor.CalculateChunkPlan(fileSize, driveSpaces, strategy, manualSizes)
+	return plan, "", err
 }
 
 // processAndUploadFile handles the entire processing pipeline
-func processAndUploadFile(ctx context.Context, session *models.UploadSession, strategy models.ChunkingStrategy, manualSizes []int64, userID primitive.ObjectID) {
+func processAndUploadFile(ctx context.Context, session *models.UploadSession, req models.ProcessRequest, userID primitive.ObjectID) {
 	sessionID := session.ID
 
 	defer func() {
@@ -299,7 +836,23 @@ func processAndUploadFile(ctx context.Context, session *models.UploadSession, st
 		fileprocessor.ScheduleCleanup(ctx, sessionID)
 	}()
 
-	// Step 1: Obfuscate file (10%)
+	if req.Strategy == models.StrategyContentDefined {
+		processContentDefined(ctx, session, req, userID, nil, false)
+		return
+	}
+
+	// Step 1: Checksum the assembled original file (5%)
+	log.Printf("Computing original checksum for session %s", sessionID.Hex())
+	fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 5, "Computing checksum...")
+
+	originalChecksum, err := fileprocessor.CalculateChecksum(session.TempFilePath)
+	if err != nil {
+		log.Printf("Failed to compute original checksum: %v", err)
+		fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 5, fmt.Sprintf("Failed to compute checksum: %v", err))
+		return
+	}
+
+	// Step 2: Obfuscate file (10%)
 	log.Printf("Starting obfuscation for session %s", sessionID.Hex())
 	fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 10, "Injecting noise...")
 
@@ -320,11 +873,31 @@ func processAndUploadFile(ctx context.Context, session *models.UploadSession, st
 	defer os.Remove(obfuscatedPath)
 	log.Printf("Obfuscation complete for session %s, size: %d", sessionID.Hex(), processedSize)
 
-	// Step 2: Get drive spaces (20%)
+	// Client-encrypted files arrive as ciphertext and get no server data key
+	var dataKey []byte
+	var encMetadata *models.EncryptionMetadata
+	if session.ClientEncryption == nil {
+		// The data key is independent of the obfuscation seed so it can be rotated without re-chunking
+		dataKey, err = fileprocessor.GenerateDataKey()
+		if err != nil {
+			log.Printf("Failed to generate data key: %v", err)
+			fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 10, fmt.Sprintf("Failed to generate data key: %v", err))
+			return
+		}
+		encMetadata, err = fileprocessor.NewEncryptionMetadata(dataKey)
+		if err != nil {
+			log.Printf("Failed to wrap data key: %v", err)
+			fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 10, fmt.Sprintf("Failed to wrap data key: %v", err))
+			return
+		}
+	}
+
+	// Step 3: Get drive spaces (20%)
 	log.Printf("Checking drive spaces for session %s", sessionID.Hex())
 	fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 20, "Checking drive spaces...")
 
-	driveSpaces, err := drivemanager.GetUserDriveSpaces(ctx, userID)
+	// Chunks are about to be written, so plan against live values
+	driveSpaces, err := drivemanager.GetUserDriveSpaces(ctx, userID, true)
 	if err != nil {
 		log.Printf("Failed to get drive spaces: %v", err)
 		fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 20, fmt.Sprintf("Failed to get drive spaces: %v", err))
@@ -332,19 +905,51 @@ func processAndUploadFile(ctx context.Context, session *models.UploadSession, st
 	}
 	log.Printf("Found %d drives for session %s", len(driveSpaces), sessionID.Hex())
 
-	// Step 3: Calculate chunking plan (30%)
+	// Plan against the space left once encryption overhead is accounted for
+	if encMetadata != nil {
+		driveSpaces = fileprocessor.ReserveEncryptionOverhead(driveSpaces)
+	}
+
+	// Step 4: Calculate chunking plan (30%)
 	log.Printf("Calculating chunking plan for session %s", sessionID.Hex())
 	fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 30, "Calculating chunk distribution...")
 
-	plan, err := fileprocessor.CalculateChunkPlan(processedSize, driveSpaces, strategy, manualSizes)
+	plan, warning, err := calculatePlan(processedSize, driveSpaces, req.Strategy, req.ManualChunkSizes, req.ChunkSizeBytes)
+	if warning != "" {
+		log.Printf("Chunking plan for session %s: %s", sessionID.Hex(), warning)
+	}
 	if err != nil {
 		log.Printf("Chunking calculation failed: %v", err)
 		fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 30, fmt.Sprintf("Chunking calculation failed: %v", err))
 		return
 	}
+
+	// Place chunks on drives using the requested distribution strategy
+	distribution, err := fileprocessor.GetDistributionStrategy(req.Distribution)
+	if err != nil {
+		log.Printf("Invalid distribution strategy: %v", err)
+		fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 30, fmt.Sprintf("Invalid distribution strategy: %v", err))
+		return
+	}
+	assignments, err := distribution.Assign(plan, driveSpaces)
+	if err != nil {
+		log.Printf("Chunk distribution failed: %v", err)
+		fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 30, fmt.Sprintf("Chunk distribution failed: %v", err))
+		return
+	}
+	// Shard or mirror chunks to more drives when erasure coding or a replication factor is configured
+	assignments, coding := placeCopies(assignments, driveSpaces, nil)
+	plan = fileprocessor.ApplyAssignments(plan, assignments)
+	// Chunk names and upload order come from the obfuscation seed
+	uploadOrder, err := fileprocessor.ApplyObfuscationScheme(assignments, obfMetadata)
+	if err != nil {
+		log.Printf("Obfuscation scheme failed: %v", err)
+		fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 30, fmt.Sprintf("Obfuscation scheme failed: %v", err))
+		return
+	}
 	log.Printf("Chunking plan created: %d chunks for session %s", len(plan), sessionID.Hex())
 
-	// Step 4: Split file into chunks (50%)
+	// Step 5: Split file into chunks (50%)
 	log.Printf("Splitting file for session %s", sessionID.Hex())
 	fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 50, "Splitting file into chunks...")
 
@@ -362,32 +967,71 @@ func processAndUploadFile(ctx context.Context, session *models.UploadSession, st
 	}()
 	log.Printf("File split into %d chunks for session %s", len(chunkPaths), sessionID.Hex())
 
-	// Step 5: Upload chunks to drives (90%)
+	// Step 6: Encrypt chunks (60%)
+	log.Printf("Encrypting chunks for session %s", sessionID.Hex())
+	fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 60, "Encrypting chunks...")
+
+	encryptedPaths := make([]string, 0, len(chunkPaths))
+	defer func() {
+		for _, path := range encryptedPaths {
+			os.Remove(path)
+		}
+	}()
+	checksumAlgo := fileprocessor.GetChecksumAlgo()
+	checksums := make([]string, 0, len(chunkPaths))
+	compressedSizes := make([]int64, len(chunkPaths)) // 0 for chunks stored uncompressed
+	for i, path := range chunkPaths {
+		encryptedPath, checksum, compressedSize, err := sealChunk(path, plan[i].ChunkID, session.Compress, dataKey, checksumAlgo)
+		if err != nil {
+			log.Printf("Chunk preparation failed: %v", err)
+			fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 60, fmt.Sprintf("Chunk preparation failed: %v", err))
+			return
+		}
+		encryptedPaths = append(encryptedPaths, encryptedPath)
+		checksums = append(checksums, checksum)
+		compressedSizes[i] = compressedSize
+	}
+
+	// Step 7: Upload chunks to drives (90%)
 	log.Printf("Uploading chunks to drives for session %s", sessionID.Hex())
 	fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 70, "Uploading chunks to drives...")
 
-	chunkMetadata, err := drivemanager.UploadChunksToDrivers(ctx, chunkPaths, plan, func(current, total int) {
+	chunkMetadata, err := uploadSealedChunks(ctx, encryptedPaths, assignments, uploadOrder, driveSpaces, coding, checksumAlgo, func(current, total int) {
 		progress := 70 + (20 * float64(current) / float64(total))
 		log.Printf("Upload progress for session %s: chunk %d/%d (%.1f%%)", sessionID.Hex(), current, total, progress)
-		fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", progress, fmt.Sprintf("Uploading chunk %d/%d...", current, total))
+		fileprocessor.UpdateChunkUploadProgress(ctx, sessionID, progress, current, total)
+	}, func(replica models.ChunkReplica) {
+		fileprocessor.PublishSessionEvent(sessionID, fileprocessor.SessionEvent{Type: "chunk", Status: "processing", DriveAccountID: replica.DriveAccountID.Hex()})
+		// Lets the session sweeper reclaim chunks of an upload that never finishes
+		if err := store.AddSessionDriveChunk(ctx, sessionID, replica); err != nil {
+			log.Printf("Failed to record uploaded chunk for session %s: %v", sessionID.Hex(), err)
+		}
 	})
 	if err != nil {
-		log.Printf("Upload failed: %v", err)
-		fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 70, fmt.Sprintf("Upload failed: %v", err))
+		failUpload(ctx, sessionID, 70, err)
 		return
 	}
 	log.Printf("All chunks uploaded for session %s", sessionID.Hex())
+	for i := range chunkMetadata {
+		chunkMetadata[i].Checksum = checksums[i]
+		chunkMetadata[i].ChecksumAlgo = checksumAlgo
+		chunkMetadata[i].Compressed = compressedSizes[i] > 0
+		chunkMetadata[i].CompressedSize = compressedSizes[i]
+	}
 
-	// Step 6: Generate key file (95%)
+	// Step 8: Generate key file (95%)
 	log.Printf("Generating key file for session %s", sessionID.Hex())
 	fileprocessor.UpdateSessionStatus(ctx, sessionID, "processing", 95, "Generating key file...")
 
-	keyFilePath := filepath.Join(chunkDir, session.OriginalFilename+".2xpfm.key")
+	keyFilePath := filepath.Join(chunkDir, sessionID.Hex()+".2xpfm.key")
 	if err := fileprocessor.GenerateKeyFile(
 		session.OriginalFilename,
 		session.TotalSize,
 		processedSize,
 		obfMetadata,
+		encMetadata,
+		session.ClientEncryption,
+		coding,
 		chunkMetadata,
 		keyFilePath,
 	); err != nil {
@@ -399,12 +1043,125 @@ func processAndUploadFile(ctx context.Context, session *models.UploadSession, st
 	// Store key file path in session for download
 	store.UpdateSessionKeyFile(ctx, sessionID, keyFilePath)
 
-	// Step 7: Complete (100%)
+	// Step 9: Record the stored file so it can be reconstructed later (98%)
+	storedChunks := make([]models.StoredChunk, 0, len(chunkMetadata))
+	for _, meta := range chunkMetadata {
+		storedChunks = append(storedChunks, models.StoredChunk{
+			ChunkID:        meta.ChunkID,
+			Replicas:       meta.Replicas,
+			Filename:       meta.Filename,
+			StartOffset:    meta.StartOffset,
+			EndOffset:      meta.EndOffset,
+			Size:           meta.Size,
+			StoredSize:     meta.StoredSize,
+			Checksum:       meta.Checksum,
+			ChecksumAlgo:   meta.ChecksumAlgo,
+			Compressed:     meta.Compressed,
+			CompressedSize: meta.CompressedSize,
+		})
+	}
+	merkleRoot, err := fileprocessor.MerkleRoot(storedChunks)
+	if err != nil {
+		log.Printf("Failed to compute the Merkle root of session %s: %v", sessionID.Hex(), err)
+	}
+
+	storedFile := &models.StoredFile{
+		UserID:           userID,
+		SessionID:        sessionID,
+		OriginalFilename: session.OriginalFilename,
+		ContentType:      session.ContentType,
+		OriginalSize:     session.TotalSize,
+		ProcessedSize:    processedSize,
+		OriginalChecksum: originalChecksum,
+		Obfuscation:      *obfMetadata,
+		Encryption:       encMetadata,
+		ClientEncryption: session.ClientEncryption,
+		Chunks:           storedChunks,
+		ErasureCoding:    coding,
+		MerkleRoot:       merkleRoot,
+		Tags:             session.Tags,
+		Compress:         session.Compress,
+		Status:           "active",
+	}
+	// A file that can't be reconstructed isn't recorded, its chunks are left to the session sweeper
+	if err := fileprocessor.CheckStoredChunks(storedFile); err != nil {
+		log.Printf("Invalid chunk layout for session %s: %v", sessionID.Hex(), err)
+		fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 98, fmt.Sprintf("Invalid chunk layout: %v", err))
+		return
+	}
+	// Locked until finalizing is done, so the file isn't deleted or changed before the
+	// manifests list it
+	storedFile.ID = primitive.NewObjectID()
+	storedFile.Metadata = imageMetadata(storedFile, session.TempFilePath, dataKey, req.Metadata)
+	unlock, err := fileprocessor.LockFile(ctx, storedFile.ID, "finalize")
+	if err != nil {
+		log.Printf("Failed to lock stored file: %v", err)
+		fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 98, fmt.Sprintf("Failed to lock stored file: %v", err))
+		return
+	}
+	defer unlock()
+	if err := store.CreateStoredFile(ctx, storedFile); err != nil {
+		log.Printf("Failed to record stored file: %v", err)
+		fileprocessor.UpdateSessionStatus(ctx, sessionID, "failed", 98, fmt.Sprintf("Failed to record stored file: %v", err))
+		return
+	}
+	store.UpdateSessionFileID(ctx, sessionID, storedFile.ID)
+	audit.RecordContext(ctx, userID, models.AuditFileUploaded, map[string]string{"file_id": storedFile.ID.Hex(), "session_id": sessionID.Hex()})
+
+	// Drift left by a failed manifest write is picked up by reconcile
+	if err := manifest.AddFile(ctx, storedFile); err != nil {
+		log.Printf("Failed to update drive manifests for file %s: %v", storedFile.ID.Hex(), err)
+	}
+	storeThumbnail(ctx, storedFile, session.TempFilePath, dataKey, req.Thumbnail)
+
+	// Step 10: Complete (100%)
 	log.Printf("Processing complete for session %s. Key file: %s", sessionID.Hex(), keyFilePath)
 	fileprocessor.CompleteSession(ctx, sessionID)
 	fileprocessor.UpdateSessionStatus(ctx, sessionID, "complete", 100, "")
 }
 
+// sealChunk compresses and encrypts a chunk file the way it is stored, returning the sealed
+// file's path, its checksum and the compressed size, 0 when the chunk is stored uncompressed.
+// Without a data key the chunk is client-encrypted already and path itself is returned.
+func sealChunk(path string, chunkID int, compress bool, dataKey []byte, checksumAlgo string) (string, string, int64, error) {
+	plainPath := path
+	var compressedSize int64
+	if compress {
+		compressedPath := path + ".gz"
+		size, ok, err := fileprocessor.CompressChunkFile(path, compressedPath)
+		if err != nil {
+			return "", "", 0, fmt.Errorf("failed to compress chunk %d: %w", chunkID, err)
+		}
+		if ok {
+			plainPath = compressedPath
+			compressedSize = size
+		}
+	}
+
+	// Client-encrypted chunks are already ciphertext and are uploaded as split
+	encryptedPath := path
+	if dataKey != nil {
+		encryptedPath = path + ".enc"
+		_, err := fileprocessor.EncryptChunkFile(plainPath, encryptedPath, dataKey, chunkID)
+		if plainPath != path {
+			os.Remove(plainPath)
+		}
+		if err != nil {
+			return "", "", 0, fmt.Errorf("failed to encrypt chunk %d: %w", chunkID, err)
+		}
+	}
+
+	// The checksum covers the chunk as it will be stored on the drive
+	checksum, err := fileprocessor.HashFile(checksumAlgo, encryptedPath)
+	if err != nil {
+		if encryptedPath != path {
+			os.Remove(encryptedPath)
+		}
+		return "", "", 0, fmt.Errorf("failed to calculate checksum for chunk %d: %w", chunkID, err)
+	}
+	return encryptedPath, checksum, compressedSize, nil
+}
+
 // DownloadKeyFileHandler - GET /api/files/download-key/:session_id
 func DownloadKeyFileHandler(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("userID").(primitive.ObjectID)
@@ -413,26 +1170,26 @@ func DownloadKeyFileHandler(w http.ResponseWriter, r *http.Request) {
 	sessionIDStr := r.URL.Path[len("/api/files/download-key/"):]
 	sessionID, err := primitive.ObjectIDFromHex(sessionIDStr)
 	if err != nil {
-		http.Error(w, "invalid session_id", http.StatusBadRequest)
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid session_id")
 		return
 	}
 
 	// Get session
 	session, err := store.GetUploadSession(r.Context(), sessionID)
 	if err != nil || session == nil {
-		http.Error(w, "session not found", http.StatusNotFound)
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "session not found")
 		return
 	}
 
 	// Verify ownership
 	if session.UserID != userID {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, "unauthorized")
 		return
 	}
 
 	// Check if complete
 	if session.Status != "complete" {
-		http.Error(w, "processing not complete", http.StatusBadRequest)
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeUploadIncomplete, "processing not complete")
 		return
 	}
 
@@ -440,19 +1197,19 @@ func DownloadKeyFileHandler(w http.ResponseWriter, r *http.Request) {
 	keyFilePath := session.KeyFilePath
 	if keyFilePath == "" {
 		// Fallback: construct from temp path
-		keyFilePath = filepath.Dir(session.TempFilePath) + "/" + session.OriginalFilename + ".2xpfm.key"
+		keyFilePath = filepath.Join(filepath.Dir(session.TempFilePath), filepath.Base(session.OriginalFilename)+".2xpfm.key")
 	}
 
 	// Check if file exists
 	if _, err := os.Stat(keyFilePath); os.IsNotExist(err) {
-		http.Error(w, "key file not found", http.StatusNotFound)
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "key file not found")
 		return
 	}
 
 	// Read key file
 	data, err := os.ReadFile(keyFilePath)
 	if err != nil {
-		http.Error(w, "failed to read key file", http.StatusInternalServerError)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to read key file")
 		return
 	}
 
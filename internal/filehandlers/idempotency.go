@@ -0,0 +1,85 @@
+package filehandlers
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/fileprocessor"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	maxIdempotencyKeyLength = 255
+)
+
+// claimIdempotencyKey claims the key for an initiate request with the given payload. A key
+// already used with the same payload has its session sent back, reported with replayed set.
+// A nil claim means the response has been written.
+func claimIdempotencyKey(w http.ResponseWriter, r *http.Request, userID primitive.ObjectID, key string, payload interface{}) (*models.IdempotencyKey, bool) {
+	if len(key) > maxIdempotencyKeyLength {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength))
+		return nil, false
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid request")
+		return nil, false
+	}
+	claim := &models.IdempotencyKey{
+		UserID:      userID,
+		Key:         key,
+		RequestHash: fmt.Sprintf("%x", sha256.Sum256(body)),
+		ExpiresAt:   time.Now().UTC().Add(fileprocessor.GetIdempotencyKeyTTL()),
+	}
+
+	existing, err := fileprocessor.ClaimIdempotencyKey(r.Context(), claim)
+	if err != nil {
+		log.Printf("Failed to claim idempotency key: %v", err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to check idempotency key")
+		return nil, false
+	}
+	if existing == nil {
+		return claim, false
+	}
+
+	if existing.RequestHash != claim.RequestHash {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "Idempotency-Key was already used with a different request")
+		return nil, false
+	}
+	if existing.SessionID.IsZero() {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "a request with this Idempotency-Key is still in progress")
+		return nil, false
+	}
+
+	session, err := store.GetUploadSession(r.Context(), existing.SessionID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get session")
+		return nil, false
+	}
+	if session == nil {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "the session created with this Idempotency-Key no longer exists")
+		return nil, false
+	}
+
+	driveSpaces, err := drivemanager.GetUserDriveSpaces(r.Context(), userID, false)
+	if err != nil {
+		log.Printf("Failed to get drive spaces: %v", err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, err.Error())
+		return nil, false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	json.NewEncoder(w).Encode(initiateResponse(session, driveSpaces))
+	return existing, true
+}
@@ -0,0 +1,237 @@
+package filehandlers
+
+import (
+	"SE/internal/fileprocessor"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// FileActionHandler routes /api/files/:file_id/:action. These can't be wildcard patterns,
+// they would conflict with the /api/files/download/ style prefixes.
+func FileActionHandler(w http.ResponseWriter, r *http.Request) {
+	fileID, action, ok := strings.Cut(r.URL.Path[len("/api/files/"):], "/")
+	if !ok || fileID == "" {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "not found")
+		return
+	}
+	r.SetPathValue("file_id", fileID)
+
+	verb, handler, timeout := fileAction(action)
+	if handler == nil {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "not found")
+		return
+	}
+	if !middleware.MethodAllowed([]string{verb}, r.Method) {
+		middleware.WriteMethodNotAllowed(w, verb)
+		return
+	}
+	middleware.Timeout(timeout, handler)(w, r)
+}
+
+// FileActionMethods returns the methods /api/files/:file_id/:action serves, nil when there is
+// no such action
+func FileActionMethods(r *http.Request) []string {
+	fileID, action, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/files/"), "/")
+	if !ok || fileID == "" {
+		return nil
+	}
+	if verb, _, _ := fileAction(action); verb != "" {
+		return []string{verb}
+	}
+	return nil
+}
+
+// fileAction returns the method, handler and request timeout of a file action, nil for unknown
+// actions. Verifying and uploading new content go through every chunk of the file and get the
+// long budget.
+func fileAction(action string) (string, http.HandlerFunc, time.Duration) {
+	switch action {
+	case "meta":
+		return "GET", FileMetadataHandler, middleware.RequestTimeout()
+	case "share":
+		return "POST", CreateShareLinkHandler, middleware.RequestTimeout()
+	case "tags":
+		return "PATCH", FileTagsHandler, middleware.RequestTimeout()
+	case "chunks":
+		return "GET", FileChunksHandler, middleware.RequestTimeout()
+	case "proof":
+		return "GET", ChunkProofHandler, middleware.RequestTimeout()
+	case "thumbnail":
+		return "GET", FileThumbnailHandler, middleware.RequestTimeout()
+	case "verify":
+		return "POST", VerifyFileHandler, middleware.LongRequestTimeout()
+	case "restore":
+		return "POST", RestoreFileHandler, middleware.RequestTimeout()
+	case "update":
+		return "POST", UpdateFileHandler, middleware.LongRequestTimeout()
+	case "append":
+		return "POST", AppendFileHandler, middleware.LongRequestTimeout()
+	case "rekey":
+		return "POST", middleware.RequireRole(models.RoleAdmin, RekeyFileHandler), middleware.RequestTimeout()
+	}
+	return "", nil, 0
+}
+
+// FileMetadataHandler - GET /api/files/:file_id/meta
+func FileMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	fileID, err := primitive.ObjectIDFromHex(r.PathValue("file_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid file_id")
+		return
+	}
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get file")
+		return
+	}
+	if file == nil || file.Status == "deleted" {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "file not found")
+		return
+	}
+
+	// Verify ownership
+	if file.UserID != userID {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, "unauthorized")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fileMetadata(file))
+}
+
+// ListFilesHandler - GET /api/files?tag=&metadata.<key>=&include_trashed=
+func ListFilesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	tag := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("tag")))
+	metadata, err := fileprocessor.MetadataFilter(r.URL.Query())
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	includeTrashed := r.URL.Query().Get("include_trashed") == "true"
+	files, err := store.ListUserFiles(r.Context(), userID, tag, metadata, includeTrashed)
+	if err != nil {
+		log.Printf("Failed to list files: %v", err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to list files")
+		return
+	}
+
+	list := make([]map[string]interface{}, 0, len(files))
+	for i := range files {
+		list = append(list, fileMetadata(&files[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"files": list,
+		"count": len(list),
+	})
+}
+
+// FileTagsHandler - PATCH /api/files/:file_id/tags
+func FileTagsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	fileID, err := primitive.ObjectIDFromHex(r.PathValue("file_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid file_id")
+		return
+	}
+
+	var req struct {
+		Add    []string `json:"add,omitempty"`
+		Remove []string `json:"remove,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		middleware.WriteDecodeError(w, err, "invalid request")
+		return
+	}
+
+	add, remove, err := fileprocessor.NormalizeTagChanges(req.Add, req.Remove)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	tags, ok, err := store.ChangeStoredFileTags(r.Context(), fileID, userID, add, remove, fileprocessor.MaxTagsPerFile)
+	if err != nil {
+		log.Printf("Failed to update tags of file %s: %v", fileID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to update tags")
+		return
+	}
+	if !ok {
+		// Tell why the update matched nothing
+		file, err := store.GetStoredFile(r.Context(), fileID)
+		switch {
+		case err != nil:
+			middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get file")
+		case file == nil || file.Status == "deleted":
+			middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "file not found")
+		case file.UserID != userID:
+			middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, "unauthorized")
+		default:
+			middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, fmt.Sprintf("at most %d tags per file", fileprocessor.MaxTagsPerFile))
+		}
+		return
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"file_id": fileID.Hex(),
+		"tags":    tags,
+	})
+}
+
+// fileMetadata is the public description of a stored file
+func fileMetadata(file *models.StoredFile) map[string]interface{} {
+	tags := file.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	response := map[string]interface{}{
+		"file_id":           file.ID.Hex(),
+		"original_filename": file.OriginalFilename,
+		"content_type":      file.ContentType,
+		"original_size":     file.OriginalSize,
+		"processed_size":    file.ProcessedSize,
+		"chunk_count":       len(file.Chunks),
+		"original_checksum": file.OriginalChecksum,
+		"status":            file.Status,
+		"created_at":        file.CreatedAt,
+		"client_encrypted":  file.ClientEncryption != nil,
+		"tags":              tags,
+		"has_thumbnail":     file.HasThumbnail,
+	}
+	if file.ClientEncryption != nil {
+		response["key_salt"] = file.ClientEncryption.KeySalt
+	}
+	if file.ErasureCoding != nil {
+		response["erasure_coding"] = file.ErasureCoding
+	}
+	if file.MerkleRoot != "" {
+		response["merkle_root"] = file.MerkleRoot
+	}
+	if len(file.Metadata) > 0 {
+		response["metadata"] = file.Metadata
+	}
+	if file.Status == "trashed" {
+		response["trashed_at"] = file.TrashedAt
+		response["restore_until"] = fileprocessor.TrashRestoreDeadline(file)
+	}
+	return response
+}
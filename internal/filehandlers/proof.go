@@ -0,0 +1,67 @@
+package filehandlers
+
+import (
+	"SE/internal/fileprocessor"
+	"SE/internal/middleware"
+	"SE/internal/store"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ChunkProofHandler - GET /api/files/:file_id/proof?chunk=N
+// Returns the Merkle proof that chunk N's checksum belongs to the file, checked by hashing the
+// chunk's leaf up the path to the file's merkle_root
+func ChunkProofHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	fileID, err := primitive.ObjectIDFromHex(r.PathValue("file_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid file_id")
+		return
+	}
+	chunkID, err := strconv.Atoi(r.URL.Query().Get("chunk"))
+	if err != nil || chunkID < 0 {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "chunk must be a chunk ID")
+		return
+	}
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get file")
+		return
+	}
+	if file == nil || file.Status == "deleted" {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "file not found")
+		return
+	}
+	if file.UserID != userID {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, "unauthorized")
+		return
+	}
+	if file.MerkleRoot == "" {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "file has no merkle root, verify it to record one")
+		return
+	}
+
+	proof, err := fileprocessor.BuildMerkleProof(file.Chunks, chunkID)
+	if err != nil {
+		log.Printf("Failed to build Merkle proof of chunk %d of file %s: %v", chunkID, fileID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to build proof")
+		return
+	}
+	if proof == nil {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "chunk not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		FileID     string `json:"file_id"`
+		MerkleRoot string `json:"merkle_root"`
+		*fileprocessor.MerkleProof
+	}{fileID.Hex(), file.MerkleRoot, proof})
+}
@@ -0,0 +1,37 @@
+package filehandlers
+
+import (
+	"SE/internal/manifest"
+	"SE/internal/middleware"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ReconcileFilesHandler - POST /api/files/reconcile
+func ReconcileFilesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	// The body is optional, an empty one only reports the drift
+	var req struct {
+		Repair bool `json:"repair"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		middleware.WriteDecodeError(w, err, "invalid request")
+		return
+	}
+
+	report, err := manifest.Reconcile(r.Context(), userID, req.Repair)
+	if err != nil {
+		log.Printf("Reconcile failed for user %s: %v", userID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
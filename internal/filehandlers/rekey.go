@@ -0,0 +1,58 @@
+package filehandlers
+
+import (
+	"SE/internal/fileprocessor"
+	"SE/internal/middleware"
+	"SE/internal/store"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RekeyFileHandler - POST /api/files/:file_id/rekey (admin)
+// Re-wraps the file's data key with the current TOKEN_ENC_KEY, the chunks stay as they are
+func RekeyFileHandler(w http.ResponseWriter, r *http.Request) {
+	fileID, err := primitive.ObjectIDFromHex(r.PathValue("file_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid file_id")
+		return
+	}
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get file")
+		return
+	}
+	if file == nil || file.Status == "deleted" {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "file not found")
+		return
+	}
+	if file.Status == "partially_deleted" {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "file is being deleted")
+		return
+	}
+	if file.Encryption == nil {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "file has no server-wrapped data key")
+		return
+	}
+
+	rekeyed, err := fileprocessor.RekeyFile(r.Context(), file)
+	if errors.Is(err, fileprocessor.ErrFileLocked) {
+		writeLockError(w, err)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to rekey file %s: %v", fileID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"file_id": fileID.Hex(),
+		"rekeyed": rekeyed,
+	})
+}
@@ -0,0 +1,217 @@
+package filehandlers
+
+import (
+	"SE/internal/audit"
+	"SE/internal/fileprocessor"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const defaultShareLinkTTL = 24 * time.Hour
+
+type createShareReq struct {
+	ExpiresInHours int `json:"expires_in_hours"`
+	MaxDownloads   int `json:"max_downloads"`
+}
+
+// CreateShareLinkHandler - POST /api/files/:file_id/share
+func CreateShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	fileID, err := primitive.ObjectIDFromHex(r.PathValue("file_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid file_id")
+		return
+	}
+
+	// Both settings are optional, so an empty body is fine
+	var req createShareReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		middleware.WriteDecodeError(w, err, "invalid request")
+		return
+	}
+
+	ttl := min(defaultShareLinkTTL, fileprocessor.GetShareLinkMaxTTL())
+	if req.ExpiresInHours != 0 {
+		ttl = time.Duration(req.ExpiresInHours) * time.Hour
+	}
+	if ttl <= 0 || ttl > fileprocessor.GetShareLinkMaxTTL() {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, fmt.Sprintf("expires_in_hours must be between 1 and %d", int(fileprocessor.GetShareLinkMaxTTL().Hours())))
+		return
+	}
+	if req.MaxDownloads < 0 {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "max_downloads must not be negative")
+		return
+	}
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get file")
+		return
+	}
+	if file == nil || file.Status == "deleted" {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "file not found")
+		return
+	}
+
+	// Verify ownership
+	if file.UserID != userID {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, "unauthorized")
+		return
+	}
+
+	if file.Status != "active" {
+		middleware.WriteJSONError(w, http.StatusGone, middleware.ErrCodeFileUnavailable, fmt.Sprintf("file not available (status: %s)", file.Status))
+		return
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to create share link")
+		return
+	}
+	link := &models.ShareLink{
+		FileID:       fileID,
+		UserID:       userID,
+		TokenHash:    hashShareToken(token),
+		MaxDownloads: req.MaxDownloads,
+		ExpiresAt:    time.Now().UTC().Add(ttl),
+	}
+	if err := store.InsertShareLink(r.Context(), link); err != nil {
+		log.Printf("Failed to store share link for file %s: %v", fileID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to create share link")
+		return
+	}
+	audit.Record(r, userID, models.AuditShareCreated, map[string]string{"file_id": fileID.Hex(), "share_id": link.ID.Hex()})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"share_id":      link.ID.Hex(),
+		"token":         token,
+		"expires_at":    link.ExpiresAt,
+		"max_downloads": link.MaxDownloads,
+	})
+}
+
+// SharedDownloadHandler - GET/HEAD /api/shared/:token, no account needed
+func SharedDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	link, err := store.FindShareLinkByHash(r.Context(), hashShareToken(r.PathValue("token")))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get share link")
+		return
+	}
+	if link == nil {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "share link not found")
+		return
+	}
+	if msg := shareLinkUnusable(link); msg != "" {
+		middleware.WriteJSONError(w, http.StatusGone, middleware.ErrCodeGone, msg)
+		return
+	}
+
+	file, err := store.GetStoredFile(r.Context(), link.FileID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get file")
+		return
+	}
+	if file == nil || file.Status == "deleted" {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "file not found")
+		return
+	}
+	if file.Status != "active" {
+		middleware.WriteJSONError(w, http.StatusGone, middleware.ErrCodeFileUnavailable, fmt.Sprintf("file not available (status: %s)", file.Status))
+		return
+	}
+
+	// Neither HEAD requests nor answers from the client's cache count against the download cap
+	if !checkPreconditions(w, r, file) {
+		return
+	}
+	if r.Method != http.MethodHead {
+		ok, err := store.ClaimShareDownload(r.Context(), link.ID)
+		if err != nil {
+			log.Printf("Failed to count download of share link %s: %v", link.ID.Hex(), err)
+			middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get share link")
+			return
+		}
+		// Another request may have used the last download or revoked the link meanwhile
+		if !ok {
+			middleware.WriteJSONError(w, http.StatusGone, middleware.ErrCodeGone, "share link is no longer valid")
+			return
+		}
+		// Downloads through a link show up in the owner's audit log
+		audit.Record(r, file.UserID, models.AuditFileDownloaded, map[string]string{"file_id": file.ID.Hex(), "share_id": link.ID.Hex()})
+	}
+
+	serveStoredFile(w, r, file)
+}
+
+// RevokeShareLinkHandler - DELETE /api/shares/:share_id
+func RevokeShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	shareID, err := primitive.ObjectIDFromHex(r.PathValue("share_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid share_id")
+		return
+	}
+
+	found, err := store.RevokeShareLink(r.Context(), shareID, userID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to revoke share link")
+		return
+	}
+	if !found {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "share link not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"share_id": shareID.Hex(),
+		"revoked":  true,
+	})
+}
+
+// shareLinkUnusable explains why a link can't be downloaded from, or returns ""
+func shareLinkUnusable(link *models.ShareLink) string {
+	switch {
+	case link.RevokedAt != nil:
+		return "share link has been revoked"
+	case time.Now().After(link.ExpiresAt):
+		return "share link has expired"
+	case link.MaxDownloads > 0 && link.DownloadCount >= link.MaxDownloads:
+		return "share link download limit reached"
+	default:
+		return ""
+	}
+}
+
+func newShareToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashShareToken is what the share_links collection is keyed by, so a leaked database
+// doesn't leak working links
+func hashShareToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
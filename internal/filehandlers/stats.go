@@ -0,0 +1,27 @@
+package filehandlers
+
+import (
+	"SE/internal/fileprocessor"
+	"SE/internal/middleware"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// StorageStatsHandler - GET /api/account/stats
+// Totals of the user's files by status and drive, for a dashboard
+func StorageStatsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	stats, err := fileprocessor.UserStorageStats(r.Context(), userID)
+	if err != nil {
+		log.Printf("Failed to compute storage stats of user %s: %v", userID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to compute storage stats")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
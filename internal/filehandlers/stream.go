@@ -0,0 +1,264 @@
+package filehandlers
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/fileprocessor"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// streamDownload reports whether the file is streamed to the client rather than reconstructed
+// on disk. ?stream=true or false decides, otherwise files up to DOWNLOAD_STREAM_MAX_MB are.
+// Range requests are never streamed whole, see streamRange.
+func streamDownload(r *http.Request, file *models.StoredFile) (bool, error) {
+	stream := file.OriginalSize <= fileprocessor.GetDownloadStreamMax()
+	if value := r.URL.Query().Get("stream"); value != "" {
+		forced, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, fmt.Errorf("invalid stream %q", value)
+		}
+		stream = forced
+	}
+	return stream && r.Header.Get("Range") == "", nil
+}
+
+// streamStoredFile sends the file as its chunks are fetched, without writing it to disk. Chunks
+// are fetched in the order of their offsets, up to DOWNLOAD_CONCURRENCY ahead, and only sent
+// once their checksum matched. The last bytes are held back until the whole-file checksum
+// matched too, on a mismatch the connection is cut and the client is left with a truncated
+// download.
+func streamStoredFile(w http.ResponseWriter, r *http.Request, file *models.StoredFile) {
+	chunks := fileprocessor.ChunksByOffset(file.Chunks)
+	var next int64
+	for _, chunk := range chunks {
+		if chunk.StartOffset != next {
+			// Deobfuscation reads the chunks back to back, a gap needs the file on disk
+			log.Printf("Chunks of file %s aren't contiguous at offset %d, not streaming it", file.ID.Hex(), next)
+			serveFromDisk(w, r, file)
+			return
+		}
+		next += chunk.Size
+	}
+
+	// Files stored before chunk encryption and client-encrypted files have no data key
+	var dataKey []byte
+	if file.Encryption != nil {
+		var err error
+		dataKey, err = fileprocessor.UnwrapDataKey(file.Encryption)
+		if err != nil {
+			middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, fmt.Sprintf("reconstruction failed: %v", err))
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(streamChunks(ctx, pw, chunks, file.ErasureCoding, dataKey, file.Encryption))
+	}()
+
+	out := &streamWriter{w: w, file: file}
+	checksum, err := fileprocessor.DeobfuscateStoredStream(out, pr, file)
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err == nil {
+		err = checkReconstructedChecksum(file, checksum)
+	}
+	if err != nil {
+		log.Printf("Streaming file %s failed after %d bytes: %v", file.ID.Hex(), out.n, err)
+		if !out.started {
+			middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, fmt.Sprintf("reconstruction failed: %v", err))
+			return
+		}
+		// Ends the response short of its Content-Length, so the client can tell
+		panic(http.ErrAbortHandler)
+	}
+	if err := out.flush(); err != nil {
+		log.Printf("Streaming file %s failed: %v", file.ID.Hex(), err)
+	}
+}
+
+// streamRange sends length bytes of the file from start as a 206, fetching only the chunks
+// holding them. The first and last chunk are fetched whole, their checksums cover all of them,
+// and trimmed to the range. There's no whole-file checksum to compare a part against, so every
+// byte is sent as soon as its chunk matched.
+func streamRange(w http.ResponseWriter, r *http.Request, file *models.StoredFile, start, length int64) {
+	plan, err := fileprocessor.PlanRange(file, start, length)
+	if err != nil {
+		// Chunks with gaps between them can still be read from a reconstruction
+		log.Printf("Can't read range of file %s from its chunks, reconstructing it: %v", file.ID.Hex(), err)
+		serveFromDisk(w, r, file)
+		return
+	}
+
+	var dataKey []byte
+	if file.Encryption != nil {
+		dataKey, err = fileprocessor.UnwrapDataKey(file.Encryption)
+		if err != nil {
+			middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, fmt.Sprintf("reconstruction failed: %v", err))
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(streamChunks(ctx, pw, plan.Chunks, file.ErasureCoding, dataKey, file.Encryption))
+	}()
+
+	out := &streamWriter{w: w, file: file, contentRange: fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, file.OriginalSize), length: length}
+	err = plan.Deobfuscate(out, pr)
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		log.Printf("Streaming range of file %s failed after %d bytes: %v", file.ID.Hex(), out.n, err)
+		if !out.started {
+			middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, fmt.Sprintf("reconstruction failed: %v", err))
+			return
+		}
+		panic(http.ErrAbortHandler)
+	}
+	if err := out.flush(); err != nil {
+		log.Printf("Streaming range of file %s failed: %v", file.ID.Hex(), err)
+	}
+	log.Printf("Served %d bytes at %d of file %s from %d of its %d chunks", length, start, file.ID.Hex(), len(plan.Chunks), len(file.Chunks))
+}
+
+// serveFromDisk reconstructs the file into a new download session and serves it from there
+func serveFromDisk(w http.ResponseWriter, r *http.Request, file *models.StoredFile) {
+	session, err := fileprocessor.CreateDownloadSession(r.Context(), file.UserID, file)
+	if err != nil {
+		log.Printf("Failed to create download session: %v", err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to create download session")
+		return
+	}
+
+	log.Printf("Reconstructing file %s for download session %s", file.ID.Hex(), session.ID.Hex())
+
+	// Keeps the download sweeper away from the files until they have been served
+	defer fileprocessor.BeginReconstruction(session.ID)()
+
+	if err := reconstructSession(r.Context(), session, file); err != nil {
+		if errors.Is(err, fileprocessor.ErrInsufficientDisk) {
+			middleware.WriteJSONError(w, http.StatusInsufficientStorage, middleware.ErrCodeDiskFull, fileprocessor.ErrInsufficientDisk.Error())
+		} else {
+			middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, fmt.Sprintf("reconstruction failed: %v", err))
+		}
+		return
+	}
+
+	serveReconstructedFile(w, r, session, file)
+}
+
+// streamChunks writes the processed bytes of the chunks to dst one after another, fetching up
+// to DOWNLOAD_CONCURRENCY of them at once into memory
+func streamChunks(ctx context.Context, dst io.Writer, chunks []models.StoredChunk, coding *models.ErasureCoding, dataKey []byte, encryption *models.EncryptionMetadata) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type fetched struct {
+		data []byte
+		err  error
+	}
+
+	// Holds the chunks being fetched in order, the one written counts towards the concurrency
+	pending := make(chan chan fetched, max(drivemanager.GetDownloadConcurrency()-1, 0))
+	go func() {
+		defer close(pending)
+		for _, chunk := range chunks {
+			result := make(chan fetched, 1)
+			select {
+			case pending <- result:
+			case <-ctx.Done():
+				return
+			}
+			go func() {
+				buf := &chunkBuffer{data: make([]byte, chunk.Size), offset: chunk.StartOffset}
+				err := fetchChunk(ctx, buf, chunk, coding, dataKey, encryption)
+				result <- fetched{data: buf.data, err: err}
+			}()
+		}
+	}()
+
+	for result := range pending {
+		chunk := <-result
+		if chunk.err != nil {
+			return chunk.err
+		}
+		if _, err := dst.Write(chunk.data); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// chunkBuffer holds one chunk in memory, written at the chunk's offset in the processed file
+type chunkBuffer struct {
+	data   []byte
+	offset int64
+}
+
+func (b *chunkBuffer) WriteAt(p []byte, off int64) (int, error) {
+	off -= b.offset
+	if off < 0 || off+int64(len(p)) > int64(len(b.data)) {
+		return 0, fmt.Errorf("write of %d bytes at %d is outside the chunk", len(p), off)
+	}
+	return copy(b.data[off:], p), nil
+}
+
+// streamWriter sends the file's headers with the first bytes of the body, so a failure before
+// them can still be answered with an error, and holds back the latest write until the next one
+// or flush
+type streamWriter struct {
+	w            http.ResponseWriter
+	file         *models.StoredFile
+	contentRange string // Set when a range of length bytes is sent instead of the whole file
+	length       int64
+	started      bool
+	held         []byte
+	n            int64 // Bytes sent
+}
+
+func (s *streamWriter) start() {
+	if s.started {
+		return
+	}
+	s.started = true
+	setFileHeaders(s.w, s.file)
+	s.w.Header().Set("Accept-Ranges", "bytes")
+	s.w.Header().Set("Last-Modified", s.file.LastModified().UTC().Format(http.TimeFormat))
+	if s.contentRange != "" {
+		s.w.Header().Set("Content-Range", s.contentRange)
+		s.w.Header().Set("Content-Length", strconv.FormatInt(s.length, 10))
+		s.w.WriteHeader(http.StatusPartialContent)
+		return
+	}
+	s.w.Header().Set("Content-Length", strconv.FormatInt(s.file.OriginalSize, 10))
+	s.w.WriteHeader(http.StatusOK)
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if err := s.flush(); err != nil {
+		return 0, err
+	}
+	s.held = append(s.held[:0], p...)
+	return len(p), nil
+}
+
+// flush sends the held back bytes, and the headers if nothing was sent yet
+func (s *streamWriter) flush() error {
+	s.start()
+	n, err := s.w.Write(s.held)
+	s.n += int64(n)
+	s.held = s.held[:0]
+	return err
+}
@@ -0,0 +1,157 @@
+package filehandlers
+
+import (
+	"SE/internal/fileprocessor"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// thumbnailAD binds a sealed thumbnail to its file, so it can't be served as another file's
+func thumbnailAD(fileID primitive.ObjectID) []byte {
+	return []byte("thumbnail:" + fileID.Hex())
+}
+
+// storeThumbnail stores a thumbnail of the file's new content, assembled at path, when the
+// upload asked for one, and otherwise drops the thumbnail of its previous content. Files
+// without a server data key get none, their content is ciphertext. A thumbnail that can't be
+// made leaves the upload as it is.
+func storeThumbnail(ctx context.Context, file *models.StoredFile, path string, dataKey []byte, want bool) {
+	if want && dataKey != nil {
+		err := saveThumbnail(ctx, file, path, dataKey)
+		if err == nil {
+			file.HasThumbnail = true
+			return
+		}
+		if !errors.Is(err, fileprocessor.ErrNoThumbnail) {
+			log.Printf("Failed to make thumbnail of file %s: %v", file.ID.Hex(), err)
+			// A thumbnail may be saved without the file recording it
+			deleteThumbnail(ctx, file)
+			return
+		}
+	}
+	if file.HasThumbnail {
+		deleteThumbnail(ctx, file)
+	}
+}
+
+// imageMetadata returns the metadata of the image assembled at path when the upload asked for
+// it. Like thumbnails, files without a server data key get none. An image whose header can't be
+// read is stored without metadata.
+func imageMetadata(file *models.StoredFile, path string, dataKey []byte, want bool) map[string]string {
+	if !want || dataKey == nil {
+		return nil
+	}
+	metadata, err := fileprocessor.ExtractImageMetadata(path, file.ContentType)
+	if err != nil {
+		log.Printf("Failed to read metadata of file %s: %v", file.ID.Hex(), err)
+		return nil
+	}
+	return metadata
+}
+
+func saveThumbnail(ctx context.Context, file *models.StoredFile, path string, dataKey []byte) error {
+	data, width, height, err := fileprocessor.GenerateThumbnail(path, file.ContentType)
+	if err != nil {
+		return err
+	}
+	sealed, err := fileprocessor.SealBytes(dataKey, data, thumbnailAD(file.ID))
+	if err != nil {
+		return err
+	}
+	if err := store.SaveThumbnail(ctx, &models.Thumbnail{
+		FileID:    file.ID,
+		Width:     width,
+		Height:    height,
+		Data:      sealed,
+		CreatedAt: time.Now().UTC(),
+	}); err != nil {
+		return err
+	}
+	if err := store.SetStoredFileThumbnail(ctx, file.ID, true); err != nil {
+		return err
+	}
+	log.Printf("Stored %dx%d thumbnail of file %s", width, height, file.ID.Hex())
+	return nil
+}
+
+// deleteThumbnail removes the file's thumbnail, if it has one
+func deleteThumbnail(ctx context.Context, file *models.StoredFile) {
+	if err := store.SetStoredFileThumbnail(ctx, file.ID, false); err != nil {
+		log.Printf("Failed to clear thumbnail of file %s: %v", file.ID.Hex(), err)
+		return
+	}
+	file.HasThumbnail = false
+	if err := store.DeleteThumbnail(ctx, file.ID); err != nil {
+		log.Printf("Failed to delete thumbnail of file %s: %v", file.ID.Hex(), err)
+	}
+}
+
+// FileThumbnailHandler - GET /api/files/:file_id/thumbnail
+// Serves the JPEG thumbnail stored for an image uploaded with "thumbnail": true
+func FileThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	fileID, err := primitive.ObjectIDFromHex(r.PathValue("file_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid file_id")
+		return
+	}
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get file")
+		return
+	}
+	if file == nil || file.Status == "deleted" {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "file not found")
+		return
+	}
+	if file.UserID != userID {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, "unauthorized")
+		return
+	}
+
+	var thumbnail *models.Thumbnail
+	if file.HasThumbnail && file.Encryption != nil {
+		thumbnail, err = store.GetThumbnail(r.Context(), fileID)
+		if err != nil {
+			middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get thumbnail")
+			return
+		}
+	}
+	if thumbnail == nil {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "file has no thumbnail")
+		return
+	}
+
+	dataKey, err := fileprocessor.UnwrapDataKey(file.Encryption)
+	if err != nil {
+		log.Printf("Failed to unwrap data key of file %s: %v", fileID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to decrypt thumbnail")
+		return
+	}
+	data, err := fileprocessor.OpenBytes(dataKey, thumbnail.Data, thumbnailAD(fileID))
+	if err != nil {
+		log.Printf("Failed to open thumbnail of file %s: %v", fileID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to decrypt thumbnail")
+		return
+	}
+
+	// The sealed bytes change with every new thumbnail, unlike the file's content checksum
+	sum := sha256.Sum256(thumbnail.Data)
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeContent(w, r, "", thumbnail.CreatedAt, bytes.NewReader(data))
+}
@@ -0,0 +1,89 @@
+package filehandlers
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/fileprocessor"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// StartUploadRetrier processes failed and interrupted uploads again once their backoff has
+// passed, one at a time, until ctx is done. It does nothing when UPLOAD_RETRY_MAX_ATTEMPTS is 0.
+func StartUploadRetrier(ctx context.Context) {
+	if !fileprocessor.UploadRetryEnabled() {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(fileprocessor.UploadRetryInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			for ctx.Err() == nil {
+				session, err := fileprocessor.ClaimUploadRetry(ctx)
+				if err != nil {
+					log.Printf("Upload retry failed: %v", err)
+					break
+				}
+				if session == nil {
+					break
+				}
+				retryUpload(session)
+			}
+		}
+	}()
+}
+
+// retryUpload runs the next attempt of a claimed session. The chunks the last attempt got onto
+// the drives are of a file that was never recorded, they're deleted before the file is
+// processed again from its temp file.
+func retryUpload(session *models.UploadSession) {
+	// Like a finalize, the attempt isn't cut short by a shutdown but waited for
+	done := fileprocessor.BeginProcessing(session.ID)
+	defer done()
+	ctx := fileprocessor.WithUserBandwidth(context.Background(), session.UserID)
+	log.Printf("Retrying upload of session %s, attempt %d", session.ID.Hex(), len(session.Retry.Attempts))
+
+	// Interrupted once the file was recorded, only the session was left to complete
+	file, err := store.FindStoredFileBySession(ctx, session.ID)
+	if err != nil {
+		fileprocessor.UpdateSessionStatus(ctx, session.ID, "failed", 0, fmt.Sprintf("Failed to look up stored file: %v", err))
+		return
+	}
+	if file != nil {
+		store.UpdateSessionFileID(ctx, session.ID, file.ID)
+		fileprocessor.CompleteSession(ctx, session.ID)
+		fileprocessor.UpdateSessionStatus(ctx, session.ID, "complete", 100, "")
+		return
+	}
+
+	deleted := make([]string, 0, len(session.DriveChunks))
+	for _, chunk := range session.DriveChunks {
+		if err := drivemanager.DeleteDriveFile(ctx, chunk.DriveAccountID, chunk.DriveFileID); err != nil {
+			log.Printf("Failed to delete chunk %s of session %s: %v", chunk.DriveFileID, session.ID.Hex(), err)
+			continue
+		}
+		deleted = append(deleted, chunk.DriveFileID)
+	}
+	if len(deleted) > 0 {
+		if err := store.RemoveSessionDriveChunks(ctx, session.ID, deleted); err != nil {
+			log.Printf("Failed to forget deleted chunks of session %s: %v", session.ID.Hex(), err)
+		}
+	}
+	// Left behind, they'd outlive a session the retry completes
+	if left := len(session.DriveChunks) - len(deleted); left > 0 {
+		fileprocessor.UpdateSessionStatus(ctx, session.ID, "failed", 0, fmt.Sprintf("Failed to delete %d chunks of the previous attempt", left))
+		return
+	}
+	session.DriveChunks = nil
+
+	processAndUploadFile(ctx, session, session.Retry.Request, session.UserID)
+}
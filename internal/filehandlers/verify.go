@@ -0,0 +1,204 @@
+package filehandlers
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/fileprocessor"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type replicaVerification struct {
+	DriveAccountID string `json:"drive_id"`
+	DriveFileID    string `json:"drive_file_id"`
+	Shard          int    `json:"shard,omitempty"`
+	Status         string `json:"status"` // "ok", "mismatch" when the bytes differ from the recorded ones, "error" when they couldn't be read
+	Error          string `json:"error,omitempty"`
+}
+
+type chunkVerification struct {
+	ChunkID  int                   `json:"chunk_id"`
+	OK       bool                  `json:"ok"` // Every replica matches its checksum
+	Replicas []replicaVerification `json:"replicas"`
+}
+
+// VerifyFileHandler - POST /api/files/:file_id/verify
+// Downloads every replica of the file's chunks, or of a random sample of sample chunks, and
+// compares their checksums with the recorded ones. Replicas are hashed as they arrive, nothing
+// is written to disk, and up to DOWNLOAD_CONCURRENCY are checked at once. The chunk list itself
+// is checked against the file's Merkle root, which a full check that passes records for files
+// stored without one.
+func VerifyFileHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	fileID, err := primitive.ObjectIDFromHex(r.PathValue("file_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid file_id")
+		return
+	}
+
+	var req struct {
+		Sample int `json:"sample,omitempty"` // Chunks to check, 0 checks them all
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		middleware.WriteDecodeError(w, err, "invalid request")
+		return
+	}
+	if req.Sample < 0 {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "sample can't be negative")
+		return
+	}
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to get file")
+		return
+	}
+	if file == nil || file.Status == "deleted" {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "file not found")
+		return
+	}
+	if file.UserID != userID {
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, "unauthorized")
+		return
+	}
+
+	chunks := file.Chunks
+	sampled := req.Sample > 0 && req.Sample < len(chunks)
+	if sampled {
+		picked := make([]models.StoredChunk, 0, req.Sample)
+		for _, i := range rand.Perm(len(chunks))[:req.Sample] {
+			picked = append(picked, chunks[i])
+		}
+		slices.SortFunc(picked, func(a, b models.StoredChunk) int { return a.ChunkID - b.ChunkID })
+		chunks = picked
+	}
+
+	report := make([]chunkVerification, len(chunks))
+	sem := make(chan struct{}, drivemanager.GetDownloadConcurrency())
+	var wg sync.WaitGroup
+	for i := range chunks {
+		chunk := chunks[i]
+		report[i] = chunkVerification{ChunkID: chunk.ChunkID, Replicas: make([]replicaVerification, len(chunk.Replicas))}
+		for j, replica := range chunk.Replicas {
+			result := &report[i].Replicas[j]
+			result.DriveAccountID = replica.DriveAccountID.Hex()
+			result.DriveFileID = replica.DriveFileID
+			result.Shard = replica.Shard
+
+			wg.Add(1)
+			go func(replica models.ChunkReplica) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				status, err := verifyReplica(r, file, chunk, replica)
+				result.Status = status
+				if err != nil {
+					result.Error = err.Error()
+				}
+			}(replica)
+		}
+	}
+	wg.Wait()
+
+	failed := 0
+	for i := range report {
+		// A chunk without replicas has nothing left to check
+		report[i].OK = len(report[i].Replicas) > 0
+		for _, replica := range report[i].Replicas {
+			report[i].OK = report[i].OK && replica.Status == "ok"
+		}
+		if !report[i].OK {
+			failed++
+		}
+	}
+
+	// Checksums changed along with the chunks they describe pass the chunk checks, not this one
+	chunkList := "ok"
+	root, err := fileprocessor.MerkleRoot(file.Chunks)
+	switch {
+	case err != nil:
+		log.Printf("Failed to compute the Merkle root of file %s: %v", fileID.Hex(), err)
+		chunkList = "error"
+	case file.MerkleRoot == "" && !sampled && failed == 0:
+		if err := store.SetStoredFileMerkleRoot(r.Context(), fileID, root); err != nil {
+			log.Printf("Failed to record the Merkle root of file %s: %v", fileID.Hex(), err)
+			chunkList = "unrecorded"
+		} else {
+			file.MerkleRoot = root
+			chunkList = "recorded"
+		}
+	case file.MerkleRoot == "":
+		chunkList = "unrecorded"
+	case root != file.MerkleRoot:
+		chunkList = "mismatch"
+	}
+
+	verdict := "pass"
+	if failed > 0 || chunkList == "mismatch" {
+		verdict = "fail"
+	}
+	log.Printf("Verified %d of %d chunks of file %s: %d failed, chunk list %s", len(report), len(file.Chunks), fileID.Hex(), failed, chunkList)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"file_id":        fileID.Hex(),
+		"verdict":        verdict,
+		"sampled":        sampled,
+		"chunk_count":    len(file.Chunks),
+		"checked_chunks": len(report),
+		"failed_chunks":  failed,
+		"chunk_list":     chunkList,
+		"merkle_root":    file.MerkleRoot,
+		"chunks":         report,
+	})
+}
+
+// verifyReplica hashes one stored copy of a chunk as it downloads, returning "ok", "mismatch"
+// or "error" with what went wrong
+func verifyReplica(r *http.Request, file *models.StoredFile, chunk models.StoredChunk, replica models.ChunkReplica) (string, error) {
+	if chunk.Checksum == "" {
+		return "error", errors.New("no checksum recorded")
+	}
+	hash, err := fileprocessor.NewHash(chunk.ChecksumAlgo)
+	if err != nil {
+		return "error", err
+	}
+	// Encrypted chunks are stored at their sealed size, like fetchReplica expects them
+	expectedSize := chunk.Size
+	if file.Encryption != nil {
+		expectedSize = chunk.StoredSize
+	}
+	expected := chunk.Checksum
+	if replica.Shard > 0 {
+		if file.ErasureCoding == nil {
+			return "error", errors.New("sharded chunk of a file without erasure coding")
+		}
+		expectedSize = fileprocessor.ShardSize(chunk.StoredSize, file.ErasureCoding.DataShards)
+		expected = replica.Checksum
+	}
+
+	written, err := drivemanager.DownloadChunkFromDrive(r.Context(), replica.DriveAccountID, replica.DriveFileID, hash)
+	if err != nil {
+		return "error", err
+	}
+	if written != expectedSize {
+		return "mismatch", fmt.Errorf("expected %d bytes, got %d bytes", expectedSize, written)
+	}
+	if checksum := fmt.Sprintf("%x", hash.Sum(nil)); checksum != expected {
+		return "mismatch", fmt.Errorf("checksum mismatch: expected %s, got %s", expected, checksum)
+	}
+	return "ok", nil
+}
@@ -0,0 +1,263 @@
+package fileprocessor
+
+import (
+	"SE/internal/audit"
+	"SE/internal/drivemanager"
+	"SE/internal/manifest"
+	"SE/internal/models"
+	"SE/internal/oauth"
+	"SE/internal/store"
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// deletingAccounts holds the users whose account deletion is running in this process
+var (
+	deletingAccountsMu sync.Mutex
+	deletingAccounts   = make(map[primitive.ObjectID]bool)
+)
+
+// StartAccountDeletion deletes everything stored for the user in the background, and then the
+// user, in a new account deletion job it returns as it starts. ctx carries the request ID and
+// client IP of the request asking for it. While a deletion of the user runs that job is
+// returned instead. Whatever a job fails to delete is left for the next one: files, sessions and
+// drive accounts it did delete are gone, so running it again only retries the rest. With force
+// the user is removed even though some of it is left behind.
+func StartAccountDeletion(ctx context.Context, userID primitive.ObjectID, force bool) (*models.AccountDeletionJob, error) {
+	deletingAccountsMu.Lock()
+	defer deletingAccountsMu.Unlock()
+
+	if deletingAccounts[userID] {
+		job, err := store.GetLatestAccountDeletionJob(ctx, userID)
+		if err == nil && job != nil {
+			return job, nil
+		}
+		return nil, err
+	}
+
+	job := &models.AccountDeletionJob{UserID: userID, Status: "running", Force: force}
+	if err := store.CreateAccountDeletionJob(ctx, job); err != nil {
+		return nil, err
+	}
+
+	deletingAccounts[userID] = true
+	snapshot := *job
+	go func() {
+		defer func() {
+			deletingAccountsMu.Lock()
+			delete(deletingAccounts, userID)
+			deletingAccountsMu.Unlock()
+		}()
+		runAccountDeletion(ctx, job)
+	}()
+	return &snapshot, nil
+}
+
+// GetAccountDeletionJob returns the user's latest account deletion job, or nil. A job left
+// running by a process that stopped is reported as interrupted.
+func GetAccountDeletionJob(ctx context.Context, userID primitive.ObjectID) (*models.AccountDeletionJob, error) {
+	deletingAccountsMu.Lock()
+	defer deletingAccountsMu.Unlock()
+
+	job, err := store.GetLatestAccountDeletionJob(ctx, userID)
+	if err != nil || job == nil {
+		return job, err
+	}
+	if job.Status == "running" && !deletingAccounts[job.UserID] {
+		job.Status = "interrupted"
+	}
+	return job, nil
+}
+
+// deleteAccountFile deletes the chunks of one of the account's files under the file's lock and
+// returns its status, a file deleted in the meantime is already done
+func deleteAccountFile(ctx context.Context, fileID primitive.ObjectID) (string, error) {
+	unlock, err := LockFile(ctx, fileID, "delete")
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	file, err := store.GetStoredFile(ctx, fileID)
+	if err != nil {
+		return "", err
+	}
+	if file == nil || file.Status == "deleted" {
+		return "deleted", nil
+	}
+	status, _, err := DeleteFileChunks(ctx, file)
+	return status, err
+}
+
+func runAccountDeletion(ctx context.Context, job *models.AccountDeletionJob) {
+	log.Printf("Account deletion %s started for user %s (force %t)", job.ID.Hex(), job.UserID.Hex(), job.Force)
+
+	accounts, err := store.ListUserDriveAccounts(ctx, job.UserID)
+	if err != nil {
+		failAccountDeletion(ctx, job, "failed to list drive accounts", err)
+		return
+	}
+
+	// Sessions first, so the chunks of uploads that never finished are deleted while their
+	// drives are still linked
+	if err := deleteUserSessions(ctx, job); err != nil {
+		failAccountDeletion(ctx, job, "failed to list sessions", err)
+		return
+	}
+
+	files, err := store.ListUserFiles(ctx, job.UserID, "", nil, true)
+	if err != nil {
+		failAccountDeletion(ctx, job, "failed to list files", err)
+		return
+	}
+	job.TotalFiles = len(files)
+	saveAccountDeletionJob(ctx, job)
+	for i := range files {
+		status, err := deleteAccountFile(ctx, files[i].ID)
+		if err != nil {
+			log.Printf("Account deletion %s failed to record deletion of file %s: %v", job.ID.Hex(), files[i].ID.Hex(), err)
+		}
+		if err == nil && status == "deleted" {
+			job.DeletedFiles++
+		} else {
+			job.FailedFiles = append(job.FailedFiles, files[i].ID)
+		}
+		saveAccountDeletionJob(ctx, job)
+	}
+
+	for _, account := range accounts {
+		if err := manifest.Delete(ctx, account.ID); err != nil {
+			log.Printf("Account deletion %s failed to delete the manifest of drive %s: %v", job.ID.Hex(), account.ID.Hex(), err)
+			job.FailedManifests = append(job.FailedManifests, account.ID)
+		}
+	}
+
+	// The drives are needed to retry what is left on them
+	if !job.Force && (len(job.FailedFiles) > 0 || len(job.FailedSessions) > 0 || len(job.FailedManifests) > 0) {
+		stopAccountDeletion(ctx, job)
+		return
+	}
+
+	accountIDs := make([]primitive.ObjectID, 0, len(accounts))
+	for i := range accounts {
+		accountIDs = append(accountIDs, accounts[i].ID)
+		// Only Drive accounts hold a token to revoke, S3 and WebDAV credentials stay the user's
+		if accounts[i].Provider == models.ProviderGoogle || accounts[i].Provider == "" {
+			if err := oauth.RevokeDriveAccountToken(ctx, &accounts[i]); err != nil {
+				log.Printf("Account deletion %s failed to revoke the token of drive %s: %v", job.ID.Hex(), accounts[i].ID.Hex(), err)
+				job.FailedDrives = append(job.FailedDrives, accounts[i].ID)
+				if !job.Force {
+					continue
+				}
+			}
+		}
+		if _, err := store.RemoveDriveAccountFromUser(ctx, job.UserID, accounts[i].ID); err != nil {
+			failAccountDeletion(ctx, job, "failed to unlink drive accounts", err)
+			return
+		}
+		drivemanager.InvalidateDriveSpace(accounts[i].ID)
+		job.DeletedDrives++
+	}
+	if !job.Force && len(job.FailedDrives) > 0 {
+		stopAccountDeletion(ctx, job)
+		return
+	}
+
+	// Access tokens outlive the user otherwise
+	if err := store.RevokeUserRefreshTokens(ctx, job.UserID); err != nil {
+		failAccountDeletion(ctx, job, "failed to revoke tokens", err)
+		return
+	}
+	if err := store.SetTokensRevokedBefore(ctx, job.UserID, time.Now().UTC()); err != nil {
+		failAccountDeletion(ctx, job, "failed to revoke tokens", err)
+		return
+	}
+	if err := store.DeleteUserRecords(ctx, job.UserID, accountIDs); err != nil {
+		failAccountDeletion(ctx, job, "failed to delete records", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	job.Status = "completed"
+	job.CompletedAt = &now
+	saveAccountDeletionJob(ctx, job)
+	leftovers := len(job.FailedFiles) + len(job.FailedSessions) + len(job.FailedManifests) + len(job.FailedDrives)
+	audit.RecordContext(ctx, job.UserID, models.AuditAccountDeleted, map[string]string{
+		"job_id":    job.ID.Hex(),
+		"files":     strconv.Itoa(job.DeletedFiles),
+		"leftovers": strconv.Itoa(leftovers),
+	})
+	log.Printf("Account deletion %s completed: user %s removed, %d of %d files deleted, %d drive accounts unlinked, %d resources left behind",
+		job.ID.Hex(), job.UserID.Hex(), job.DeletedFiles, job.TotalFiles, job.DeletedDrives, leftovers)
+}
+
+// deleteUserSessions removes the user's upload and download sessions with their files, listing
+// the ones still in use or with chunks left on the drives in the job
+func deleteUserSessions(ctx context.Context, job *models.AccountDeletionJob) error {
+	uploads, err := store.ListUserUploadSessions(ctx, job.UserID)
+	if err != nil {
+		return err
+	}
+	active := make(map[primitive.ObjectID]bool)
+	for _, id := range processingSessions() {
+		active[id] = true
+	}
+	for _, session := range uploads {
+		if active[session.ID] {
+			job.FailedSessions = append(job.FailedSessions, session.ID)
+			continue
+		}
+		if _, err := RemoveUploadSession(ctx, session); err != nil {
+			log.Printf("Account deletion %s failed to delete upload session %s: %v", job.ID.Hex(), session.ID.Hex(), err)
+			job.FailedSessions = append(job.FailedSessions, session.ID)
+			continue
+		}
+		job.DeletedSessions++
+	}
+
+	downloads, err := store.ListUserDownloadSessions(ctx, job.UserID)
+	if err != nil {
+		return err
+	}
+	for i := range downloads {
+		if isReconstructing(downloads[i].ID) {
+			job.FailedSessions = append(job.FailedSessions, downloads[i].ID)
+			continue
+		}
+		if err := RemoveDownloadSession(ctx, &downloads[i]); err != nil {
+			log.Printf("Account deletion %s failed to delete download session %s: %v", job.ID.Hex(), downloads[i].ID.Hex(), err)
+			job.FailedSessions = append(job.FailedSessions, downloads[i].ID)
+			continue
+		}
+		job.DeletedSessions++
+	}
+	saveAccountDeletionJob(ctx, job)
+	return nil
+}
+
+// stopAccountDeletion ends a job that left something behind without force, keeping the user
+// so deleting the account again retries it
+func stopAccountDeletion(ctx context.Context, job *models.AccountDeletionJob) {
+	job.Status = "incomplete"
+	saveAccountDeletionJob(ctx, job)
+	log.Printf("Account deletion %s stopped with resources left: %d files, %d sessions, %d manifests, %d drive accounts",
+		job.ID.Hex(), len(job.FailedFiles), len(job.FailedSessions), len(job.FailedManifests), len(job.FailedDrives))
+}
+
+func failAccountDeletion(ctx context.Context, job *models.AccountDeletionJob, msg string, err error) {
+	log.Printf("Account deletion %s %s: %v", job.ID.Hex(), msg, err)
+	job.Status = "failed"
+	job.Error = msg
+	saveAccountDeletionJob(ctx, job)
+}
+
+func saveAccountDeletionJob(ctx context.Context, job *models.AccountDeletionJob) {
+	if err := store.SaveAccountDeletionJob(ctx, job); err != nil {
+		log.Printf("Failed to save progress of account deletion %s: %v", job.ID.Hex(), err)
+	}
+}
@@ -0,0 +1,23 @@
+package fileprocessor
+
+import (
+	"SE/internal/middleware"
+	"SE/internal/store"
+	"context"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// WithUserBandwidth returns ctx carrying the user's transfer caps for one upload or download.
+// A user that can't be loaded gets the default caps.
+func WithUserBandwidth(ctx context.Context, userID primitive.ObjectID) context.Context {
+	user, err := store.FindUserByID(ctx, userID)
+	if err != nil {
+		log.Printf("Failed to load bandwidth limits of user %s: %v", userID.Hex(), err)
+	}
+	if user == nil {
+		return middleware.WithBandwidth(ctx, userID, nil, nil)
+	}
+	return middleware.WithBandwidth(ctx, userID, user.BandwidthBPS, user.RequestBandwidthBPS)
+}
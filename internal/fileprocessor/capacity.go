@@ -0,0 +1,38 @@
+package fileprocessor
+
+import "SE/internal/models"
+
+// DriveCapacity compares the space an upload will take on the drives with their free space
+type DriveCapacity struct {
+	AvailableBytes int64 `json:"available_bytes"`
+	RequiredBytes  int64 `json:"required_bytes"`
+}
+
+// Fits reports whether the upload fits in the drives' free space
+func (c *DriveCapacity) Fits() bool {
+	return c.RequiredBytes <= c.AvailableBytes
+}
+
+// EstimateDriveCapacity estimates what a file of size bytes takes on the drives once noise,
+// server-side encryption and the configured shards or replicas are added, against the free
+// space of the drives that are reachable
+func EstimateDriveCapacity(drives []models.DriveSpaceInfo, size int64, serverEncrypted bool) *DriveCapacity {
+	required := CalculateProcessedSize(size)
+	if serverEncrypted {
+		required = EncryptedSize(required, defaultFrameSize)
+	}
+	if coding := ErasureCodingFor(drives); coding != nil {
+		required = ShardSize(required, coding.DataShards) * int64(coding.DataShards+coding.ParityShards)
+	} else if replicationFactor > 1 {
+		required *= int64(replicationFactor)
+	}
+
+	var available int64
+	for _, drive := range drives {
+		if drive.Available && drive.FreeSpace > 0 {
+			available += drive.FreeSpace
+		}
+	}
+
+	return &DriveCapacity{AvailableBytes: available, RequiredBytes: required}
+}
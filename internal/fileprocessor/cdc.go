@@ -0,0 +1,234 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"math/bits"
+	"os"
+	"sort"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+// ContentChunk is a region of the original file cut by content-defined chunking
+type ContentChunk struct {
+	Offset int64
+	Size   int64
+	Hash   string // HMAC-SHA256 of the region, keyed from the obfuscation seed
+}
+
+// contentChunkBounds returns the smallest, average and largest content-defined chunk. The
+// average is rounded down to a power of two, it becomes the boundary mask.
+func contentChunkBounds() (int64, int64, int64) {
+	avg := int64(1) << (63 - bits.LeadingZeros64(uint64(contentChunkSize)))
+	return max(avg/4, MinChunkSizeBytes), avg, min(avg*4, MaxChunkSizeBytes)
+}
+
+// GetContentChunkSize returns the average size of content-defined chunks
+func GetContentChunkSize() int64 {
+	_, avg, _ := contentChunkBounds()
+	return avg
+}
+
+// contentGear is the rolling hash's table of a value per byte. It is derived from the seed, so
+// where boundaries fall says nothing about the content of another user's file.
+func contentGear(seed []byte) (*[256]uint64, error) {
+	cipher, err := chacha20.NewUnauthenticatedCipher(DeriveObfuscationKey(seed, "content-gear"), make([]byte, 12))
+	if err != nil {
+		return nil, err
+	}
+	stream := make([]byte, 256*8)
+	cipher.XORKeyStream(stream, stream)
+
+	var gear [256]uint64
+	for i := range gear {
+		gear[i] = binary.BigEndian.Uint64(stream[i*8:])
+	}
+	return &gear, nil
+}
+
+// ContentDefinedChunks cuts the file where a gear rolling hash of its bytes hits the boundary
+// mask. An edit only moves the boundaries around it, regions before and after keep their
+// chunks and hashes.
+func ContentDefinedChunks(inputPath string, seed []byte) ([]ContentChunk, error) {
+	file, err := os.Open(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gear, err := contentGear(seed)
+	if err != nil {
+		return nil, err
+	}
+	minSize, avg, maxSize := contentChunkBounds()
+	mask := uint64(avg - 1)
+
+	hashKey := DeriveObfuscationKey(seed, "chunk-content")
+	var chunks []ContentChunk
+	var offset, size int64
+	var roll uint64
+	mac := hmac.New(sha256.New, hashKey)
+	cut := func(h hash.Hash) {
+		chunks = append(chunks, ContentChunk{Offset: offset, Size: size, Hash: hex.EncodeToString(h.Sum(nil))})
+		offset += size
+		size, roll = 0, 0
+		h.Reset()
+	}
+
+	reader := bufio.NewReaderSize(file, 1024*1024)
+	buf := make([]byte, 1024*1024)
+	for {
+		n, err := reader.Read(buf)
+		data := buf[:n]
+		start := 0
+		for i, b := range data {
+			roll = roll<<1 + gear[b]
+			size++
+			if size >= maxSize || (size >= minSize && roll&mask == 0) {
+				mac.Write(data[start : i+1])
+				start = i + 1
+				cut(mac)
+			}
+		}
+		mac.Write(data[start:])
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if size > 0 {
+		cut(mac)
+	}
+	return chunks, nil
+}
+
+// NewContentDefinedObfuscation returns the obfuscation metadata of a file whose noise is
+// injected chunk by chunk
+func NewContentDefinedObfuscation(seed []byte) *models.ObfuscationMetadata {
+	return &models.ObfuscationMetadata{
+		Algorithm:   "ChaCha20-DRBG",
+		Scheme:      defaultObfuscationScheme,
+		Seed:        base64.StdEncoding.EncodeToString(seed),
+		BlockSize:   defaultBlockSize,
+		OverheadPct: defaultOverheadPct,
+		MinGap:      defaultMinGap,
+		Chunking:    models.StrategyContentDefined,
+		NamePrefix:  chunkNamePrefix,
+	}
+}
+
+// chunkNoiseSeed derives the seed the noise of one content-defined chunk comes from
+func chunkNoiseSeed(seed []byte, chunkID int) []byte {
+	return DeriveObfuscationKey(seed, fmt.Sprintf("chunk-noise/%d", chunkID))
+}
+
+func injectionCount(size int64, metadata *models.ObfuscationMetadata) int64 {
+	n := int64(float64(size)*(metadata.OverheadPct/100.0)) / int64(metadata.BlockSize)
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
+
+// ObfuscatedChunkSize returns the size of a content-defined chunk of size bytes once its
+// noise is injected
+func ObfuscatedChunkSize(size int64, metadata *models.ObfuscationMetadata) int64 {
+	return size + injectionCount(size, metadata)*int64(metadata.BlockSize)
+}
+
+// ObfuscateChunk injects noise into one content-defined chunk of the input file, writing it
+// to outputPath. It returns the size written.
+func ObfuscateChunk(inputPath, outputPath string, chunk ContentChunk, chunkID int, metadata *models.ObfuscationMetadata) (int64, error) {
+	seed, err := base64.StdEncoding.DecodeString(metadata.Seed)
+	if err != nil {
+		return 0, fmt.Errorf("invalid obfuscation seed: %w", err)
+	}
+
+	inFile, err := os.Open(inputPath)
+	if err != nil {
+		return 0, err
+	}
+	defer inFile.Close()
+
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		return 0, err
+	}
+	defer outFile.Close()
+
+	cipher, err := chacha20.NewUnauthenticatedCipher(chunkNoiseSeed(seed, chunkID), make([]byte, 12))
+	if err != nil {
+		return 0, err
+	}
+	offsets := generateInjectionOffsets(cipher, chunk.Size, injectionCount(chunk.Size, metadata), int64(metadata.MinGap))
+
+	written, err := streamInjectNoise(io.NewSectionReader(inFile, chunk.Offset, chunk.Size), outFile, cipher, offsets, metadata.BlockSize)
+	if err != nil {
+		os.Remove(outputPath)
+		return 0, err
+	}
+	return written, nil
+}
+
+// deobfuscateChunks strips the noise of content-defined chunks from src, a file holding every
+// chunk at its offset, writing the original bytes to dst
+func deobfuscateChunks(dst io.Writer, src io.ReaderAt, metadata *models.ObfuscationMetadata, chunks []models.StoredChunk) error {
+	seed, err := base64.StdEncoding.DecodeString(metadata.Seed)
+	if err != nil {
+		return fmt.Errorf("invalid obfuscation seed: %w", err)
+	}
+
+	for _, chunk := range ChunksByOffset(chunks) {
+		chunkMetadata := *metadata
+		chunkMetadata.Seed = base64.StdEncoding.EncodeToString(chunkNoiseSeed(seed, chunk.ChunkID))
+		section := io.NewSectionReader(src, chunk.StartOffset, chunk.Size)
+		if err := DeobfuscateStream(dst, bufio.NewReaderSize(section, 32*1024), &chunkMetadata, chunk.OriginalSize); err != nil {
+			return fmt.Errorf("chunk %d: %w", chunk.ChunkID, err)
+		}
+	}
+	return nil
+}
+
+// deobfuscateChunkStream strips the noise of content-defined chunks read from src one after
+// another, in the order of their offsets, writing the original bytes to dst
+func deobfuscateChunkStream(dst io.Writer, src io.Reader, metadata *models.ObfuscationMetadata, chunks []models.StoredChunk) error {
+	seed, err := base64.StdEncoding.DecodeString(metadata.Seed)
+	if err != nil {
+		return fmt.Errorf("invalid obfuscation seed: %w", err)
+	}
+
+	for _, chunk := range ChunksByOffset(chunks) {
+		chunkMetadata := *metadata
+		chunkMetadata.Seed = base64.StdEncoding.EncodeToString(chunkNoiseSeed(seed, chunk.ChunkID))
+		section := io.LimitReader(src, chunk.Size)
+		if err := DeobfuscateStream(dst, section, &chunkMetadata, chunk.OriginalSize); err != nil {
+			return fmt.Errorf("chunk %d: %w", chunk.ChunkID, err)
+		}
+		// The next chunk starts where this one ends
+		if _, err := io.Copy(io.Discard, section); err != nil {
+			return fmt.Errorf("chunk %d: %w", chunk.ChunkID, err)
+		}
+	}
+	return nil
+}
+
+// ChunksByOffset returns a copy of the chunks sorted by their offset in the processed file
+func ChunksByOffset(chunks []models.StoredChunk) []models.StoredChunk {
+	ordered := append([]models.StoredChunk(nil), chunks...)
+	sort.Slice(ordered, func(i, j int) bool {
+		return ordered[i].StartOffset < ordered[j].StartOffset
+	})
+	return ordered
+}
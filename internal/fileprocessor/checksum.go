@@ -0,0 +1,92 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"crypto/sha256"
+	"encoding"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// NewHash returns a hasher for a chunk checksum algorithm. Chunks stored before the
+// algorithm was recorded have none and were hashed with SHA-256.
+func NewHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case models.ChecksumSHA256, "":
+		return sha256.New(), nil
+	case models.ChecksumBLAKE2b:
+		// Unkeyed, so New256 can't fail
+		h, _ := blake2b.New256(nil)
+		return h, nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algo)
+	}
+}
+
+// Hash returns the hex checksum of data under the given algorithm
+func Hash(algo string, data []byte) (string, error) {
+	h, err := NewHash(algo)
+	if err != nil {
+		return "", err
+	}
+	h.Write(data)
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// HashFile returns the hex checksum of a file under the given algorithm
+func HashFile(algo, filePath string) (string, error) {
+	h, err := NewHash(algo)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// ContinueChecksum hashes the file onto the SHA-256 state of the content before it, nil to start
+// afresh, returning the hex checksum of everything hashed and the state after the file
+func ContinueChecksum(filePath string, state []byte) (string, []byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+	return ContinueChecksumReader(file, state)
+}
+
+// ContinueChecksumReader is ContinueChecksum of the content read from r
+func ContinueChecksumReader(r io.Reader, state []byte) (string, []byte, error) {
+	h := sha256.New()
+	if state != nil {
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+			return "", nil, fmt.Errorf("invalid checksum state: %w", err)
+		}
+	}
+
+	if _, err := io.Copy(h, r); err != nil {
+		return "", nil, err
+	}
+	next, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), next, nil
+}
+
+// GetChecksumAlgo returns the algorithm new chunks are checksummed with
+func GetChecksumAlgo() string {
+	return checksumAlgo
+}
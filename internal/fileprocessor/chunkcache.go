@@ -0,0 +1,236 @@
+package fileprocessor
+
+import (
+	"SE/internal/metrics"
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chunk cache: the chunks downloads fetched, as stored on the drive and so still encrypted,
+// kept on disk so the next download of the file needn't fetch them again. Size cap in bytes,
+// 0 disables it, and directory, set by InitFileConfig.
+var (
+	chunkCacheMax int64
+	chunkCacheDir string
+)
+
+// Suffix of the files chunks are written to before they checked out and joined the cache
+const chunkCacheTempSuffix = ".tmp"
+
+type chunkCacheEntry struct {
+	key  string
+	size int64
+}
+
+// chunkCache orders the cached chunks from the most recently used to the least
+var chunkCache struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+	size    int64
+}
+
+// initChunkCache indexes the chunks a previous run left in the cache directory, the most
+// recently used ones kept when the cap shrank since
+func initChunkCache() {
+	chunkCache.order = list.New()
+	chunkCache.entries = make(map[string]*list.Element)
+	chunkCache.size = 0
+	if chunkCacheMax == 0 {
+		return
+	}
+	if err := os.MkdirAll(chunkCacheDir, 0700); err != nil {
+		log.Fatalf("Failed to create CHUNK_CACHE_DIR: %v", err)
+	}
+
+	entries, err := os.ReadDir(chunkCacheDir)
+	if err != nil {
+		log.Fatalf("Failed to read CHUNK_CACHE_DIR: %v", err)
+	}
+	type cached struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	var found []cached
+	for _, entry := range entries {
+		path := filepath.Join(chunkCacheDir, entry.Name())
+		// Left by a fetch the server stopped during
+		if strings.HasSuffix(entry.Name(), chunkCacheTempSuffix) {
+			os.Remove(path)
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		found = append(found, cached{key: entry.Name(), size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].modTime.After(found[j].modTime) })
+	for _, c := range found {
+		chunkCache.entries[c.key] = chunkCache.order.PushBack(&chunkCacheEntry{key: c.key, size: c.size})
+		chunkCache.size += c.size
+	}
+	evictChunks()
+	log.Printf("Chunk cache holds %d chunks (%d of %d bytes) in %s", chunkCache.order.Len(), chunkCache.size, chunkCacheMax, chunkCacheDir)
+}
+
+// chunkCacheKey names the cached copy of a chunk or shard after the drive file it was fetched
+// from and its checksum, so a chunk that was replaced is never mistaken for its old content
+func chunkCacheKey(driveFileID, checksum string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(driveFileID+":"+checksum)))
+}
+
+// evictChunks removes the least recently used chunks until the cache fits its cap. Called
+// with chunkCache.mu held, or before the cache is used.
+func evictChunks() {
+	for chunkCache.size > chunkCacheMax {
+		back := chunkCache.order.Back()
+		if back == nil {
+			return
+		}
+		removeCachedChunk(back)
+	}
+}
+
+// removeCachedChunk drops an entry and its file. A download still reading the file keeps it
+// open until it's done. Called with chunkCache.mu held.
+func removeCachedChunk(elem *list.Element) {
+	entry := chunkCache.order.Remove(elem).(*chunkCacheEntry)
+	delete(chunkCache.entries, entry.key)
+	chunkCache.size -= entry.size
+	if err := os.Remove(filepath.Join(chunkCacheDir, entry.key)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove cached chunk %s: %v", entry.key, err)
+	}
+}
+
+// OpenCachedChunk opens the cached copy of a chunk or shard, reporting false when the cache
+// doesn't hold it. The copy is whatever was fetched from the drive, the caller checks it
+// against checksum before using it and drops it with DropCachedChunk when it doesn't match.
+func OpenCachedChunk(driveFileID, checksum string) (*os.File, bool) {
+	if chunkCacheMax == 0 || checksum == "" {
+		return nil, false
+	}
+	key := chunkCacheKey(driveFileID, checksum)
+
+	chunkCache.mu.Lock()
+	defer chunkCache.mu.Unlock()
+	elem, ok := chunkCache.entries[key]
+	if !ok {
+		metrics.ChunkCacheRequests.Inc("miss")
+		return nil, false
+	}
+	path := filepath.Join(chunkCacheDir, key)
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("Failed to open cached chunk %s: %v", key, err)
+		removeCachedChunk(elem)
+		metrics.ChunkCacheRequests.Inc("miss")
+		return nil, false
+	}
+	chunkCache.order.MoveToFront(elem)
+	// Keeps the order across restarts
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	metrics.ChunkCacheRequests.Inc("hit")
+	return f, true
+}
+
+// DropCachedChunk removes the cached copy of a chunk or shard that didn't match its checksum
+func DropCachedChunk(driveFileID, checksum string) {
+	if chunkCacheMax == 0 {
+		return
+	}
+	key := chunkCacheKey(driveFileID, checksum)
+
+	chunkCache.mu.Lock()
+	defer chunkCache.mu.Unlock()
+	if elem, ok := chunkCache.entries[key]; ok {
+		removeCachedChunk(elem)
+	}
+	metrics.ChunkCacheRequests.Inc("invalid")
+}
+
+// ChunkCacheWriter takes a chunk or shard as it is fetched from its drive, keeping it in the
+// cache once Finish is told it checked out. Writes never fail, a copy that can't be written
+// or outgrows the cache is left out of it.
+type ChunkCacheWriter struct {
+	key    string
+	f      *os.File
+	n      int64
+	failed bool
+}
+
+// NewChunkCacheWriter returns the writer to cache a chunk or shard fetched from driveFileID
+// with, nil when the cache is disabled
+func NewChunkCacheWriter(driveFileID, checksum string) *ChunkCacheWriter {
+	if chunkCacheMax == 0 || checksum == "" {
+		return nil
+	}
+	key := chunkCacheKey(driveFileID, checksum)
+	f, err := os.CreateTemp(chunkCacheDir, key+"-*"+chunkCacheTempSuffix)
+	if err != nil {
+		log.Printf("Failed to create cached chunk %s: %v", key, err)
+		return nil
+	}
+	return &ChunkCacheWriter{key: key, f: f}
+}
+
+func (c *ChunkCacheWriter) Write(p []byte) (int, error) {
+	if c.failed {
+		return len(p), nil
+	}
+	c.n += int64(len(p))
+	if c.n > chunkCacheMax {
+		c.failed = true
+		return len(p), nil
+	}
+	if _, err := c.f.Write(p); err != nil {
+		log.Printf("Failed to write cached chunk %s: %v", c.key, err)
+		c.failed = true
+	}
+	return len(p), nil
+}
+
+// Finish adds the copy to the cache when ok, the fetch having matched its checksum, and
+// discards it otherwise. Safe on a nil writer.
+func (c *ChunkCacheWriter) Finish(ok bool) {
+	if c == nil {
+		return
+	}
+	tmp := c.f.Name()
+	if err := c.f.Close(); err != nil {
+		c.failed = true
+	}
+	if !ok || c.failed {
+		os.Remove(tmp)
+		return
+	}
+
+	chunkCache.mu.Lock()
+	defer chunkCache.mu.Unlock()
+	if err := os.Rename(tmp, filepath.Join(chunkCacheDir, c.key)); err != nil {
+		log.Printf("Failed to store cached chunk %s: %v", c.key, err)
+		os.Remove(tmp)
+		return
+	}
+	// Another download fetched the same chunk meanwhile, its copy was just replaced
+	if elem, exists := chunkCache.entries[c.key]; exists {
+		entry := elem.Value.(*chunkCacheEntry)
+		chunkCache.size += c.n - entry.size
+		entry.size = c.n
+		chunkCache.order.MoveToFront(elem)
+	} else {
+		chunkCache.entries[c.key] = chunkCache.order.PushFront(&chunkCacheEntry{key: c.key, size: c.n})
+		chunkCache.size += c.n
+	}
+	evictChunks()
+}
@@ -44,6 +44,95 @@ func CalculateChunkPlan(fileSize int64, driveSpaces []models.DriveSpaceInfo, str
 	}
 }
 
+// Bounds for a client-chosen fixed chunk size
+const (
+	MinChunkSizeBytes = 256 * 1024        // 256 KB
+	MaxChunkSizeBytes = 100 * 1024 * 1024 // 100 MB
+)
+
+// ValidateChunkSize checks a requested fixed chunk size against the server bounds
+func ValidateChunkSize(size int64) error {
+	if size < MinChunkSizeBytes || size > MaxChunkSizeBytes {
+		return fmt.Errorf("chunk_size_bytes must be between %d (256 KB) and %d (100 MB), got %d", MinChunkSizeBytes, MaxChunkSizeBytes, size)
+	}
+	return nil
+}
+
+// CalculateFixedSizePlan splits the file into chunks of chunkSize bytes, the last one taking the
+// remainder, and puts each on the drive with the most space left. The returned warning is set when
+// there are more chunks than slots for an even spread, so some drives end up holding more chunks.
+func CalculateFixedSizePlan(fileSize int64, driveSpaces []models.DriveSpaceInfo, chunkSize int64) ([]models.ChunkPlan, string, error) {
+	if err := ValidateChunkSize(chunkSize); err != nil {
+		return nil, "", err
+	}
+	if fileSize <= 0 {
+		return nil, "", errors.New("file size must be positive")
+	}
+
+	tracker, err := newFreeSpaceTracker(driveSpaces)
+	if err != nil {
+		return nil, "", err
+	}
+
+	numChunks := int((fileSize + chunkSize - 1) / chunkSize)
+
+	// Even spread: every drive holds as many full chunks as the smallest drive can
+	minSlots := int64(-1)
+	for _, id := range tracker.order {
+		if slots := tracker.free[id] / chunkSize; minSlots < 0 || slots < minSlots {
+			minSlots = slots
+		}
+	}
+	evenSlots := int(minSlots) * len(tracker.order)
+
+	chunks := make([]models.ChunkPlan, 0, numChunks)
+	offset := int64(0)
+	for chunkID := 1; offset < fileSize; chunkID++ {
+		size := chunkSize
+		if fileSize-offset < size {
+			size = fileSize - offset
+		}
+		id, ok := tracker.largest(size, nil)
+		if !ok {
+			return nil, "", fmt.Errorf("no drive has room for chunk %d (%d bytes)", chunkID, size)
+		}
+		tracker.take(id, size)
+
+		chunks = append(chunks, models.ChunkPlan{
+			ChunkID:        chunkID,
+			DriveAccountID: id,
+			Size:           size,
+			StartOffset:    offset,
+			EndOffset:      offset + size,
+		})
+		offset += size
+	}
+
+	var warning string
+	if numChunks > evenSlots {
+		warning = fmt.Sprintf("%d chunks exceed the %d slots for an even spread over %d drives, some drives will hold more chunks than others", numChunks, evenSlots, len(tracker.order))
+	}
+	return chunks, warning, nil
+}
+
+// PlaceChunks puts every planned chunk on the drive with the most space left, for plans whose
+// sizes come from the file's content rather than from its drives
+func PlaceChunks(plan []models.ChunkPlan, driveSpaces []models.DriveSpaceInfo) error {
+	tracker, err := newFreeSpaceTracker(driveSpaces)
+	if err != nil {
+		return err
+	}
+	for i := range plan {
+		id, ok := tracker.largest(plan[i].Size, nil)
+		if !ok {
+			return fmt.Errorf("no drive has room for chunk %d (%d bytes)", plan[i].ChunkID, plan[i].Size)
+		}
+		tracker.take(id, plan[i].Size)
+		plan[i].DriveAccountID = id
+	}
+	return nil
+}
+
 // calculateGreedyPlan fills largest drive first
 func calculateGreedyPlan(fileSize int64, drives []models.DriveSpaceInfo) ([]models.ChunkPlan, error) {
 	// Sort drives by free space (descending)
@@ -289,3 +378,38 @@ func SplitFile(inputPath string, outputDir string, plan []models.ChunkPlan) ([]s
 
 	return chunkPaths, nil
 }
+
+// CheckStoredChunks checks the chunks of a file about to be recorded lay out its processed
+// stream: back to back from offset 0 to ProcessedSize, each on at least one drive and, for
+// content-defined chunks, holding OriginalSize bytes of the file between them
+func CheckStoredChunks(file *models.StoredFile) error {
+	if len(file.Chunks) == 0 {
+		return errors.New("file has no chunks")
+	}
+	ids := make(map[int]bool, len(file.Chunks))
+	var offset, original int64
+	for _, chunk := range ChunksByOffset(file.Chunks) {
+		if ids[chunk.ChunkID] {
+			return fmt.Errorf("chunk %d is listed twice", chunk.ChunkID)
+		}
+		ids[chunk.ChunkID] = true
+		if chunk.StartOffset != offset {
+			return fmt.Errorf("chunk %d starts at offset %d, the previous chunk ends at %d", chunk.ChunkID, chunk.StartOffset, offset)
+		}
+		if chunk.Size <= 0 || chunk.EndOffset != chunk.StartOffset+chunk.Size {
+			return fmt.Errorf("chunk %d spans %d-%d but holds %d bytes", chunk.ChunkID, chunk.StartOffset, chunk.EndOffset, chunk.Size)
+		}
+		if len(chunk.Replicas) == 0 {
+			return fmt.Errorf("chunk %d is on no drive", chunk.ChunkID)
+		}
+		offset = chunk.EndOffset
+		original += chunk.OriginalSize
+	}
+	if offset != file.ProcessedSize {
+		return fmt.Errorf("chunks hold %d of the %d processed bytes", offset, file.ProcessedSize)
+	}
+	if file.Obfuscation.Chunking == models.StrategyContentDefined && original != file.OriginalSize {
+		return fmt.Errorf("chunks hold %d of the %d original bytes", original, file.OriginalSize)
+	}
+	return nil
+}
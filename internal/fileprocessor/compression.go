@@ -0,0 +1,94 @@
+package fileprocessor
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"sync"
+)
+
+// CompressChunkFile gzips a chunk into outputPath and returns the compressed size. When
+// compression doesn't make the chunk smaller, as with media that is already compressed,
+// the output is removed and false is returned so the chunk is stored as is.
+func CompressChunkFile(inputPath, outputPath string) (int64, bool, error) {
+	inFile, err := os.Open(inputPath)
+	if err != nil {
+		return 0, false, err
+	}
+	defer inFile.Close()
+
+	info, err := inFile.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		return 0, false, err
+	}
+	defer outFile.Close()
+
+	writer := bufio.NewWriter(outFile)
+	zw := gzip.NewWriter(writer)
+	if _, err := io.Copy(zw, bufio.NewReader(inFile)); err != nil {
+		os.Remove(outputPath)
+		return 0, false, err
+	}
+	if err := zw.Close(); err != nil {
+		os.Remove(outputPath)
+		return 0, false, err
+	}
+	if err := writer.Flush(); err != nil {
+		os.Remove(outputPath)
+		return 0, false, err
+	}
+
+	stat, err := outFile.Stat()
+	if err != nil {
+		os.Remove(outputPath)
+		return 0, false, err
+	}
+	if stat.Size() >= info.Size() {
+		os.Remove(outputPath)
+		return 0, false, nil
+	}
+	return stat.Size(), true, nil
+}
+
+type decompressingWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+	once sync.Once
+	err  error
+}
+
+// NewDecompressingWriter returns a writer that gunzips what is written to it into dst. Close
+// must be called, it waits for the decompression to finish and reports its error.
+func NewDecompressingWriter(dst io.Writer) io.WriteCloser {
+	pr, pw := io.Pipe()
+	d := &decompressingWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		zr, err := gzip.NewReader(pr)
+		if err == nil {
+			_, err = io.Copy(dst, zr)
+		}
+		// Unblocks Write if decompression stopped early
+		pr.CloseWithError(err)
+		d.done <- err
+	}()
+	return d
+}
+
+func (d *decompressingWriter) Write(p []byte) (int, error) {
+	return d.pw.Write(p)
+}
+
+// Close is safe to call more than once, so error paths can defer it
+func (d *decompressingWriter) Close() error {
+	d.once.Do(func() {
+		d.pw.Close()
+		d.err = <-d.done
+	})
+	return d.err
+}
@@ -0,0 +1,29 @@
+package fileprocessor
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// ContentTypeFromFilename guesses the MIME type from the file extension
+func ContentTypeFromFilename(filename string) string {
+	if ct := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+// DetectContentType sniffs the MIME type from the first bytes of a file. Generic results fall
+// back to the filename extension, which knows about types sniffing can't tell apart (e.g. JSON).
+func DetectContentType(head []byte, filename string) string {
+	sniffed := http.DetectContentType(head)
+	if sniffed != "application/octet-stream" && !strings.HasPrefix(sniffed, "text/plain") {
+		return sniffed
+	}
+	if byName := ContentTypeFromFilename(filename); byName != "application/octet-stream" {
+		return byName
+	}
+	return sniffed
+}
@@ -0,0 +1,52 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrInsufficientDisk is returned when the download temp directory hasn't room to reconstruct a file
+var ErrInsufficientDisk = errors.New("not enough free disk space to reconstruct the file")
+
+var (
+	downloadSpaceMu       sync.Mutex
+	downloadSpaceReserved int64
+)
+
+// reconstructionSpace returns the disk space reconstructing the file takes: the processed bytes
+// fetched from the drives and the original bytes once the noise is stripped, both on disk at once
+func reconstructionSpace(file *models.StoredFile) int64 {
+	processed := file.ProcessedSize
+	if processed == 0 {
+		processed = file.OriginalSize
+	}
+	return processed + file.OriginalSize
+}
+
+// ReserveDownloadSpace checks the download temp directory has room to reconstruct the file, on
+// top of what running reconstructions reserved and DOWNLOAD_DISK_RESERVE_MB. The space stays
+// reserved until the returned func is called. Where free space can't be read, nothing is checked.
+func ReserveDownloadSpace(file *models.StoredFile) (func(), error) {
+	need := reconstructionSpace(file)
+
+	downloadSpaceMu.Lock()
+	defer downloadSpaceMu.Unlock()
+
+	if free, ok := diskFree(downloadTempDir); ok {
+		if available := int64(free) - downloadSpaceReserved - downloadDiskReserve; need > available {
+			return nil, fmt.Errorf("%w: needs %d bytes, %d available in %s", ErrInsufficientDisk, need, max(available, 0), downloadTempDir)
+		}
+	}
+	downloadSpaceReserved += need
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			downloadSpaceMu.Lock()
+			downloadSpaceReserved -= need
+			downloadSpaceMu.Unlock()
+		})
+	}, nil
+}
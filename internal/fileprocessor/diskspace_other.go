@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package fileprocessor
+
+// diskFree can't read free space on this platform, downloads are not checked
+func diskFree(dir string) (uint64, bool) {
+	return 0, false
+}
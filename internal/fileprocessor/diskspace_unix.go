@@ -0,0 +1,14 @@
+//go:build linux || darwin
+
+package fileprocessor
+
+import "syscall"
+
+// diskFree returns the bytes available to unprivileged users on the filesystem holding dir
+func diskFree(dir string) (uint64, bool) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, false
+	}
+	return stat.Bavail * uint64(stat.Bsize), true
+}
@@ -0,0 +1,298 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"errors"
+	"fmt"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DistributionStrategy decides which drives hold each planned chunk
+type DistributionStrategy interface {
+	Assign(chunks []models.ChunkPlan, drives []models.DriveSpaceInfo) ([]models.ChunkAssignment, error)
+}
+
+// GetDistributionStrategy returns the strategy registered for mode
+func GetDistributionStrategy(mode models.DistributionMode) (DistributionStrategy, error) {
+	switch mode {
+	case models.DistributionPlanned:
+		return plannedDistribution{}, nil
+	case models.DistributionRoundRobin:
+		return roundRobinDistribution{}, nil
+	case models.DistributionLargestFree:
+		return largestFreeDistribution{}, nil
+	case models.DistributionRedundant:
+		return redundantDistribution{copies: max(2, replicationFactor)}, nil
+	case models.DistributionPriority:
+		return priorityDistribution{}, nil
+	default:
+		return nil, fmt.Errorf("invalid distribution strategy %q", mode)
+	}
+}
+
+// ApplyAssignments moves each planned chunk to the primary drive of its assignment
+func ApplyAssignments(plan []models.ChunkPlan, assignments []models.ChunkAssignment) []models.ChunkPlan {
+	byChunk := make(map[int]primitive.ObjectID, len(assignments))
+	for _, a := range assignments {
+		if len(a.DriveAccountIDs) > 0 {
+			byChunk[a.ChunkID] = a.DriveAccountIDs[0]
+		}
+	}
+
+	out := make([]models.ChunkPlan, len(plan))
+	for i, chunk := range plan {
+		if driveID, ok := byChunk[chunk.ChunkID]; ok {
+			chunk.DriveAccountID = driveID
+		}
+		out[i] = chunk
+	}
+	return out
+}
+
+// AddReplicas extends every assignment to copies distinct drives, picking the drives with the
+// most space left. Assignments keep their existing drives first. When too few drives have room
+// the chunk keeps the copies that fit, HealFile can add the rest once space frees up.
+func AddReplicas(assignments []models.ChunkAssignment, drives []models.DriveSpaceInfo, copies int) []models.ChunkAssignment {
+	tracker, err := newFreeSpaceTracker(drives)
+	if err != nil {
+		return assignments
+	}
+
+	// Space the existing copies will use isn't free for the new ones
+	for _, a := range assignments {
+		for _, id := range a.DriveAccountIDs {
+			tracker.take(id, a.Size)
+		}
+	}
+
+	out := make([]models.ChunkAssignment, len(assignments))
+	for i, a := range assignments {
+		used := make(map[primitive.ObjectID]bool, copies)
+		ids := append([]primitive.ObjectID(nil), a.DriveAccountIDs...)
+		for _, id := range ids {
+			used[id] = true
+		}
+		for len(ids) < copies {
+			id, ok := tracker.largest(a.Size, used)
+			if !ok {
+				log.Printf("Only %d of %d replicas fit for chunk %d", len(ids), copies, a.ChunkID)
+				break
+			}
+			tracker.take(id, a.Size)
+			used[id] = true
+			ids = append(ids, id)
+		}
+		a.DriveAccountIDs = ids
+		out[i] = a
+	}
+	return out
+}
+
+// AssignShards extends every assignment to a distinct drive for each erasure-coded shard of its
+// chunk, the drive it already has holding the first shard and the others picked by most space
+// left. It fails when a chunk's shards don't fit on enough drives.
+func AssignShards(assignments []models.ChunkAssignment, drives []models.DriveSpaceInfo, coding *models.ErasureCoding) ([]models.ChunkAssignment, error) {
+	tracker, err := newFreeSpaceTracker(drives)
+	if err != nil {
+		return nil, err
+	}
+	shards := coding.DataShards + coding.ParityShards
+
+	out := make([]models.ChunkAssignment, len(assignments))
+	for i, a := range assignments {
+		size := ShardSize(a.Size, coding.DataShards)
+		used := make(map[primitive.ObjectID]bool, shards)
+		ids := make([]primitive.ObjectID, 0, shards)
+		if len(a.DriveAccountIDs) > 0 {
+			ids = append(ids, a.DriveAccountIDs[0])
+			used[a.DriveAccountIDs[0]] = true
+			tracker.take(a.DriveAccountIDs[0], size)
+		}
+		for len(ids) < shards {
+			id, ok := tracker.largest(size, used)
+			if !ok {
+				return nil, fmt.Errorf("not enough drives with room for %d shards of chunk %d (%d bytes each)", shards, a.ChunkID, size)
+			}
+			tracker.take(id, size)
+			used[id] = true
+			ids = append(ids, id)
+		}
+		a.DriveAccountIDs = ids
+		out[i] = a
+	}
+	return out, nil
+}
+
+// freeSpaceTracker keeps the remaining free space per available drive while assigning
+type freeSpaceTracker struct {
+	order []primitive.ObjectID
+	free  map[primitive.ObjectID]int64
+}
+
+func newFreeSpaceTracker(drives []models.DriveSpaceInfo) (*freeSpaceTracker, error) {
+	t := &freeSpaceTracker{free: make(map[primitive.ObjectID]int64)}
+	for _, d := range drives {
+		if d.Available && d.FreeSpace > 0 {
+			t.order = append(t.order, d.AccountID)
+			t.free[d.AccountID] = d.FreeSpace
+		}
+	}
+	if len(t.order) == 0 {
+		return nil, errors.New("no available drives")
+	}
+	return t, nil
+}
+
+// largest returns the drive with the most space left that fits size, skipping exclude
+func (t *freeSpaceTracker) largest(size int64, exclude map[primitive.ObjectID]bool) (primitive.ObjectID, bool) {
+	var best primitive.ObjectID
+	found := false
+	for _, id := range t.order {
+		if exclude[id] || t.free[id] < size {
+			continue
+		}
+		if !found || t.free[id] > t.free[best] {
+			best = id
+			found = true
+		}
+	}
+	return best, found
+}
+
+func (t *freeSpaceTracker) take(id primitive.ObjectID, size int64) {
+	t.free[id] -= size
+}
+
+func newAssignment(chunk models.ChunkPlan, driveIDs ...primitive.ObjectID) models.ChunkAssignment {
+	return models.ChunkAssignment{
+		ChunkID:         chunk.ChunkID,
+		Size:            chunk.Size,
+		StartOffset:     chunk.StartOffset,
+		EndOffset:       chunk.EndOffset,
+		DriveAccountIDs: driveIDs,
+	}
+}
+
+// plannedDistribution keeps the drives the chunking strategy picked
+type plannedDistribution struct{}
+
+func (plannedDistribution) Assign(chunks []models.ChunkPlan, drives []models.DriveSpaceInfo) ([]models.ChunkAssignment, error) {
+	assignments := make([]models.ChunkAssignment, 0, len(chunks))
+	for _, chunk := range chunks {
+		assignments = append(assignments, newAssignment(chunk, chunk.DriveAccountID))
+	}
+	return assignments, nil
+}
+
+// roundRobinDistribution cycles through drives, skipping ones that can't fit the chunk
+type roundRobinDistribution struct{}
+
+func (roundRobinDistribution) Assign(chunks []models.ChunkPlan, drives []models.DriveSpaceInfo) ([]models.ChunkAssignment, error) {
+	tracker, err := newFreeSpaceTracker(drives)
+	if err != nil {
+		return nil, err
+	}
+
+	assignments := make([]models.ChunkAssignment, 0, len(chunks))
+	next := 0
+	for _, chunk := range chunks {
+		placed := false
+		for attempt := 0; attempt < len(tracker.order); attempt++ {
+			id := tracker.order[(next+attempt)%len(tracker.order)]
+			if tracker.free[id] >= chunk.Size {
+				tracker.take(id, chunk.Size)
+				assignments = append(assignments, newAssignment(chunk, id))
+				next = (next + attempt + 1) % len(tracker.order)
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			return nil, fmt.Errorf("no drive has room for chunk %d (%d bytes)", chunk.ChunkID, chunk.Size)
+		}
+	}
+	return assignments, nil
+}
+
+// largestFreeDistribution puts every chunk on the drive with the most space left
+type largestFreeDistribution struct{}
+
+func (largestFreeDistribution) Assign(chunks []models.ChunkPlan, drives []models.DriveSpaceInfo) ([]models.ChunkAssignment, error) {
+	tracker, err := newFreeSpaceTracker(drives)
+	if err != nil {
+		return nil, err
+	}
+
+	assignments := make([]models.ChunkAssignment, 0, len(chunks))
+	for _, chunk := range chunks {
+		id, ok := tracker.largest(chunk.Size, nil)
+		if !ok {
+			return nil, fmt.Errorf("no drive has room for chunk %d (%d bytes)", chunk.ChunkID, chunk.Size)
+		}
+		tracker.take(id, chunk.Size)
+		assignments = append(assignments, newAssignment(chunk, id))
+	}
+	return assignments, nil
+}
+
+// priorityDistribution fills drives in the order they are listed, the user's priority order,
+// moving on to the next drive once a chunk doesn't fit
+type priorityDistribution struct{}
+
+func (priorityDistribution) Assign(chunks []models.ChunkPlan, drives []models.DriveSpaceInfo) ([]models.ChunkAssignment, error) {
+	tracker, err := newFreeSpaceTracker(drives)
+	if err != nil {
+		return nil, err
+	}
+
+	assignments := make([]models.ChunkAssignment, 0, len(chunks))
+	for _, chunk := range chunks {
+		placed := false
+		for _, id := range tracker.order {
+			if tracker.free[id] >= chunk.Size {
+				tracker.take(id, chunk.Size)
+				assignments = append(assignments, newAssignment(chunk, id))
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			return nil, fmt.Errorf("no drive has room for chunk %d (%d bytes)", chunk.ChunkID, chunk.Size)
+		}
+	}
+	return assignments, nil
+}
+
+// redundantDistribution places each chunk on several distinct drives
+type redundantDistribution struct {
+	copies int
+}
+
+func (d redundantDistribution) Assign(chunks []models.ChunkPlan, drives []models.DriveSpaceInfo) ([]models.ChunkAssignment, error) {
+	tracker, err := newFreeSpaceTracker(drives)
+	if err != nil {
+		return nil, err
+	}
+	if len(tracker.order) < d.copies {
+		return nil, fmt.Errorf("redundant distribution needs at least %d available drives, have %d", d.copies, len(tracker.order))
+	}
+
+	assignments := make([]models.ChunkAssignment, 0, len(chunks))
+	for _, chunk := range chunks {
+		used := make(map[primitive.ObjectID]bool)
+		ids := make([]primitive.ObjectID, 0, d.copies)
+		for len(ids) < d.copies {
+			id, ok := tracker.largest(chunk.Size, used)
+			if !ok {
+				return nil, fmt.Errorf("not enough drives with room for %d copies of chunk %d (%d bytes)", d.copies, chunk.ChunkID, chunk.Size)
+			}
+			tracker.take(id, chunk.Size)
+			used[id] = true
+			ids = append(ids, id)
+		}
+		assignments = append(assignments, newAssignment(chunk, ids...))
+	}
+	return assignments, nil
+}
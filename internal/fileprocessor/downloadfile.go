@@ -0,0 +1,192 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Whether the files of new download sessions are encrypted on disk, set by InitFileConfig
+var encryptDownloadFiles = true
+
+// The keys of download sessions with encrypted files. They are only ever held here, so the
+// files a stopped or crashed server leaves behind can't be read by anyone, this server included.
+var (
+	downloadKeysMu sync.Mutex
+	downloadKeys   = make(map[primitive.ObjectID][]byte)
+)
+
+// ErrDownloadKeyLost is returned for the encrypted file of a download session whose key went
+// with the server that created it
+var ErrDownloadKeyLost = errors.New("download session key is gone, its files can't be read")
+
+// newDownloadKey gives the session a random key for its files when they are encrypted
+func newDownloadKey(session *models.DownloadSession) error {
+	if !encryptDownloadFiles {
+		return nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("failed to generate download session key: %w", err)
+	}
+	downloadKeysMu.Lock()
+	downloadKeys[session.ID] = key
+	downloadKeysMu.Unlock()
+	session.EncryptedAtRest = true
+	return nil
+}
+
+// forgetDownloadKey drops the key of a session whose files are gone
+func forgetDownloadKey(sessionID primitive.ObjectID) {
+	downloadKeysMu.Lock()
+	delete(downloadKeys, sessionID)
+	downloadKeysMu.Unlock()
+}
+
+// downloadFileCipher returns the cipher of one of the session's files, nil when the session's
+// files aren't encrypted. Each file gets its own key derived from the session's, so no two
+// files share a keystream.
+func downloadFileCipher(session *models.DownloadSession, path string) (cipher.Block, error) {
+	if !session.EncryptedAtRest {
+		return nil, nil
+	}
+	downloadKeysMu.Lock()
+	key, ok := downloadKeys[session.ID]
+	downloadKeysMu.Unlock()
+	if !ok {
+		return nil, ErrDownloadKeyLost
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(filepath.Base(path)))
+	return aes.NewCipher(mac.Sum(nil))
+}
+
+// DownloadFile is the temp or reconstructed file of a download session, encrypted on disk
+// with AES-CTR when the session's files are, so it can be read and written at any offset.
+// Reconstructions are checked against the file's checksum as they are written, the cipher only
+// keeps their content from being read off the disk.
+type DownloadFile struct {
+	f      *os.File
+	block  cipher.Block // nil when the file isn't encrypted
+	offset int64        // Position of Read, Write and Seek
+}
+
+// CreateDownloadFile creates or truncates one of the session's files
+func CreateDownloadFile(session *models.DownloadSession, path string) (*DownloadFile, error) {
+	block, err := downloadFileCipher(session, path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &DownloadFile{f: f, block: block}, nil
+}
+
+// OpenDownloadFile opens one of the session's files for reading
+func OpenDownloadFile(session *models.DownloadSession, path string) (*DownloadFile, error) {
+	block, err := downloadFileCipher(session, path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &DownloadFile{f: f, block: block}, nil
+}
+
+// ReconstructionAvailable reports whether the session's reconstructed file is on disk and can
+// be read, which an encrypted one can't once the server that wrote it stopped
+func ReconstructionAvailable(session *models.DownloadSession) bool {
+	if _, err := os.Stat(session.ReconstructedPath); err != nil {
+		return false
+	}
+	_, err := downloadFileCipher(session, session.ReconstructedPath)
+	return err == nil
+}
+
+// xorKeyStream encrypts or decrypts p, found at off in the file, in place
+func (d *DownloadFile) xorKeyStream(p []byte, off int64) {
+	if d.block == nil {
+		return
+	}
+	var iv [aes.BlockSize]byte
+	binary.BigEndian.PutUint64(iv[8:], uint64(off/aes.BlockSize))
+	stream := cipher.NewCTR(d.block, iv[:])
+	if skip := off % aes.BlockSize; skip > 0 {
+		var pad [aes.BlockSize]byte
+		stream.XORKeyStream(pad[:skip], pad[:skip])
+	}
+	stream.XORKeyStream(p, p)
+}
+
+func (d *DownloadFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := d.f.ReadAt(p, off)
+	d.xorKeyStream(p[:n], off)
+	return n, err
+}
+
+// WriteAt may be called concurrently for different parts of the file
+func (d *DownloadFile) WriteAt(p []byte, off int64) (int, error) {
+	if d.block == nil {
+		return d.f.WriteAt(p, off)
+	}
+	buf := make([]byte, len(p))
+	copy(buf, p)
+	d.xorKeyStream(buf, off)
+	return d.f.WriteAt(buf, off)
+}
+
+func (d *DownloadFile) Read(p []byte) (int, error) {
+	n, err := d.ReadAt(p, d.offset)
+	d.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (d *DownloadFile) Write(p []byte) (int, error) {
+	n, err := d.WriteAt(p, d.offset)
+	d.offset += int64(n)
+	return n, err
+}
+
+func (d *DownloadFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		info, err := d.f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset += info.Size()
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	d.offset = offset
+	return offset, nil
+}
+
+func (d *DownloadFile) Close() error {
+	return d.f.Close()
+}
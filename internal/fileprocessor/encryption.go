@@ -0,0 +1,315 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"SE/internal/oauth"
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Chunks are encrypted as a sequence of AES-256-GCM frames so arbitrarily large chunks can be
+// processed without holding them in memory.
+//
+// Layout: noncePrefix(8) || frame_0 || frame_1 || ... where every frame seals up to frame-size
+// plaintext bytes. Frame i uses nonce noncePrefix || uint32(i) and the additional data
+// uint32(chunkID) || finalFlag, so frames can't be reordered, truncated or moved between chunks.
+const (
+	EncryptionAlgorithm = "AES-256-GCM-STREAM"
+	defaultFrameSize    = 64 * 1024
+	noncePrefixSize     = 8
+	gcmTagSize          = 16
+)
+
+// GenerateDataKey creates a random 256-bit per-file data key
+func GenerateDataKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Bounds of the key-derivation salt a client-encrypted upload supplies
+const (
+	minClientKeySalt = 16
+	maxClientKeySalt = 64
+)
+
+// NewClientEncryption validates the base64 key-derivation salt of a client-encrypted upload
+func NewClientEncryption(keySalt string) (*models.ClientEncryptionMetadata, error) {
+	salt, err := base64.StdEncoding.DecodeString(keySalt)
+	if err != nil {
+		return nil, fmt.Errorf("key_salt must be base64: %w", err)
+	}
+	if len(salt) < minClientKeySalt || len(salt) > maxClientKeySalt {
+		return nil, fmt.Errorf("key_salt must be %d to %d bytes", minClientKeySalt, maxClientKeySalt)
+	}
+	return &models.ClientEncryptionMetadata{KeySalt: keySalt}, nil
+}
+
+// NewEncryptionMetadata wraps the data key with the server key for storage
+func NewEncryptionMetadata(dataKey []byte) (*models.EncryptionMetadata, error) {
+	wrapped, err := oauth.Encrypt(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	return &models.EncryptionMetadata{
+		Algorithm:  EncryptionAlgorithm,
+		WrappedKey: base64.StdEncoding.EncodeToString(wrapped),
+		FrameSize:  defaultFrameSize,
+	}, nil
+}
+
+// UnwrapDataKey recovers the data key from the encryption metadata
+func UnwrapDataKey(metadata *models.EncryptionMetadata) ([]byte, error) {
+	if metadata.Algorithm != EncryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q", metadata.Algorithm)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(metadata.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key: %w", err)
+	}
+	key, err := oauth.Decrypt(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return key, nil
+}
+
+// EncryptedSize returns the size of a chunk of plainSize bytes once encrypted
+func EncryptedSize(plainSize int64, frameSize int) int64 {
+	frames := (plainSize + int64(frameSize) - 1) / int64(frameSize)
+	if frames == 0 {
+		frames = 1 // An empty chunk still gets one authenticated frame
+	}
+	return noncePrefixSize + plainSize + frames*gcmTagSize
+}
+
+// PlaintextCapacity returns how many plaintext bytes fit in capacity bytes once encrypted
+func PlaintextCapacity(capacity int64) int64 {
+	payload := capacity - noncePrefixSize
+	if payload <= gcmTagSize {
+		return 0
+	}
+	sealedFrame := int64(defaultFrameSize + gcmTagSize)
+	plain := (payload / sealedFrame) * defaultFrameSize
+	if rem := payload % sealedFrame; rem > gcmTagSize {
+		plain += rem - gcmTagSize
+	}
+	return plain
+}
+
+// ReserveEncryptionOverhead shrinks each drive's free space by what encryption adds, so chunk
+// plans computed on the plaintext still fit once the chunks are encrypted
+func ReserveEncryptionOverhead(drives []models.DriveSpaceInfo) []models.DriveSpaceInfo {
+	out := make([]models.DriveSpaceInfo, len(drives))
+	for i, d := range drives {
+		d.FreeSpace = PlaintextCapacity(d.FreeSpace)
+		out[i] = d
+	}
+	return out
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("data key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func frameNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, noncePrefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	return nonce
+}
+
+func frameAD(chunkID int, final bool) []byte {
+	ad := make([]byte, 5)
+	binary.BigEndian.PutUint32(ad, uint32(chunkID))
+	if final {
+		ad[4] = 1
+	}
+	return ad
+}
+
+// EncryptChunkFile encrypts a chunk file and returns the encrypted size
+func EncryptChunkFile(inputPath, outputPath string, key []byte, chunkID int) (int64, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return 0, err
+	}
+
+	inFile, err := os.Open(inputPath)
+	if err != nil {
+		return 0, err
+	}
+	defer inFile.Close()
+
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		return 0, err
+	}
+	defer outFile.Close()
+
+	writer := bufio.NewWriter(outFile)
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return 0, err
+	}
+	if _, err := writer.Write(prefix); err != nil {
+		return 0, err
+	}
+	written := int64(noncePrefixSize)
+
+	reader := bufio.NewReaderSize(inFile, defaultFrameSize)
+	plain := make([]byte, defaultFrameSize)
+	sealed := make([]byte, 0, defaultFrameSize+gcmTagSize)
+
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(reader, plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			os.Remove(outputPath)
+			return 0, err
+		}
+
+		// The frame is final when nothing follows it
+		final := err != nil
+		if !final {
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				final = true
+			}
+		}
+
+		sealed = aead.Seal(sealed[:0], frameNonce(prefix, counter), plain[:n], frameAD(chunkID, final))
+		if _, err := writer.Write(sealed); err != nil {
+			os.Remove(outputPath)
+			return 0, err
+		}
+		written += int64(len(sealed))
+
+		if final {
+			break
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		os.Remove(outputPath)
+		return 0, err
+	}
+	return written, nil
+}
+
+// decryptingWriter decrypts frames as ciphertext is written and passes plaintext to dst
+type decryptingWriter struct {
+	dst       io.Writer
+	aead      cipher.AEAD
+	chunkID   int
+	frameSize int
+	prefix    []byte
+	counter   uint32
+	buf       []byte
+	plain     []byte
+}
+
+// NewDecryptingWriter returns a writer that decrypts a chunk written to it. Close must be
+// called to verify and flush the final frame.
+func NewDecryptingWriter(dst io.Writer, key []byte, chunkID int, frameSize int) (io.WriteCloser, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if frameSize <= 0 {
+		frameSize = defaultFrameSize
+	}
+	return &decryptingWriter{
+		dst:       dst,
+		aead:      aead,
+		chunkID:   chunkID,
+		frameSize: frameSize,
+		buf:       make([]byte, 0, 2*(frameSize+gcmTagSize)),
+	}, nil
+}
+
+func (d *decryptingWriter) Write(p []byte) (int, error) {
+	d.buf = append(d.buf, p...)
+
+	if d.prefix == nil {
+		if len(d.buf) < noncePrefixSize {
+			return len(p), nil
+		}
+		d.prefix = append([]byte(nil), d.buf[:noncePrefixSize]...)
+		d.buf = d.buf[noncePrefixSize:]
+	}
+
+	// Only decrypt a full frame once more data follows it, otherwise it may be the final one
+	sealedSize := d.frameSize + gcmTagSize
+	for len(d.buf) > sealedSize {
+		if err := d.openFrame(d.buf[:sealedSize], false); err != nil {
+			return 0, err
+		}
+		d.buf = append(d.buf[:0], d.buf[sealedSize:]...)
+	}
+	return len(p), nil
+}
+
+func (d *decryptingWriter) Close() error {
+	if d.prefix == nil {
+		return errors.New("encrypted chunk is truncated")
+	}
+	return d.openFrame(d.buf, true)
+}
+
+func (d *decryptingWriter) openFrame(sealed []byte, final bool) error {
+	var err error
+	d.plain, err = d.aead.Open(d.plain[:0], frameNonce(d.prefix, d.counter), sealed, frameAD(d.chunkID, final))
+	if err != nil {
+		return fmt.Errorf("chunk %d frame %d failed authentication", d.chunkID, d.counter)
+	}
+	d.counter++
+	_, err = d.dst.Write(d.plain)
+	return err
+}
+
+// SealBytes encrypts a small blob with the data key in a single AES-256-GCM seal, as
+// nonce(12) || ciphertext. ad binds it to what it belongs to.
+func SealBytes(key, plaintext, ad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+// OpenBytes decrypts a blob sealed by SealBytes with the same key and ad
+func OpenBytes(key, sealed, ad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data is truncated")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, errors.New("sealed data failed authentication")
+	}
+	return plain, nil
+}
@@ -0,0 +1,317 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Shards chunks are split into when erasure coding is on, 0 data shards keeps full copies
+var erasureDataShards, erasureParityShards int
+
+// Bytes of every shard coded at once
+const shardBlockSize = 64 * 1024
+
+func initErasureConfig() {
+	erasureDataShards, _ = strconv.Atoi(os.Getenv("ERASURE_DATA_SHARDS"))
+	if erasureDataShards <= 0 {
+		erasureDataShards = 0
+		return
+	}
+	erasureParityShards, _ = strconv.Atoi(os.Getenv("ERASURE_PARITY_SHARDS"))
+	if erasureParityShards <= 0 {
+		erasureParityShards = 2
+	}
+	// GF(256) has room for 256 distinct shard coordinates
+	if erasureDataShards+erasureParityShards > 255 {
+		log.Fatalf("ERASURE_DATA_SHARDS plus ERASURE_PARITY_SHARDS must be at most 255, got %d", erasureDataShards+erasureParityShards)
+	}
+}
+
+// ErasureCodingFor returns the coding new chunks are sharded with, nil when erasure coding is
+// off or fewer drives than shards are available, in which case chunks are stored as copies
+func ErasureCodingFor(drives []models.DriveSpaceInfo) *models.ErasureCoding {
+	if erasureDataShards == 0 {
+		return nil
+	}
+	available := 0
+	for _, d := range drives {
+		if d.Available && d.FreeSpace > 0 {
+			available++
+		}
+	}
+	if available < erasureDataShards+erasureParityShards {
+		return nil
+	}
+	return &models.ErasureCoding{DataShards: erasureDataShards, ParityShards: erasureParityShards}
+}
+
+// ShardSize is the size of each shard of a chunk stored at storedSize bytes, the last data
+// shard is padded with zeros up to it
+func ShardSize(storedSize int64, dataShards int) int64 {
+	return (storedSize + int64(dataShards) - 1) / int64(dataShards)
+}
+
+// EncodeShards splits the chunk file at path into the coding's data shards and computes its
+// parity shards, written next to it. It returns the shard files in shard order with the
+// checksum of each under algo.
+func EncodeShards(path string, coding *models.ErasureCoding, algo string) ([]string, []string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	k, total := coding.DataShards, coding.DataShards+coding.ParityShards
+	shardSize := ShardSize(info.Size(), k)
+	parity := parityMatrix(k, coding.ParityShards)
+
+	paths := make([]string, 0, total)
+	files := make([]*os.File, 0, total)
+	hashes := make([]hash.Hash, 0, total)
+	writers := make([]io.Writer, 0, total)
+	// Closing a shard twice does no harm
+	fail := func(err error) ([]string, []string, error) {
+		for i, f := range files {
+			f.Close()
+			os.Remove(paths[i])
+		}
+		return nil, nil, err
+	}
+	for s := 0; s < total; s++ {
+		p := fmt.Sprintf("%s.shard_%02d", path, s+1)
+		f, err := os.Create(p)
+		if err != nil {
+			return fail(err)
+		}
+		h, err := NewHash(algo)
+		if err != nil {
+			f.Close()
+			os.Remove(p)
+			return fail(err)
+		}
+		paths = append(paths, p)
+		files = append(files, f)
+		hashes = append(hashes, h)
+		writers = append(writers, io.MultiWriter(f, h))
+	}
+
+	blocks := make([][]byte, total)
+	for s := range blocks {
+		blocks[s] = make([]byte, shardBlockSize)
+	}
+	for off := int64(0); off < shardSize; off += shardBlockSize {
+		n := int(min(shardBlockSize, shardSize-off))
+		for s := 0; s < k; s++ {
+			// Bytes past the end of the chunk read as the zero padding
+			block := blocks[s][:n]
+			read, err := in.ReadAt(block, int64(s)*shardSize+off)
+			if err != nil && !errors.Is(err, io.EOF) {
+				return fail(err)
+			}
+			clear(block[read:])
+		}
+		for p, row := range parity {
+			block := blocks[k+p][:n]
+			clear(block)
+			for s, c := range row {
+				gfMulAdd(block, blocks[s][:n], c)
+			}
+		}
+		for s := 0; s < total; s++ {
+			if _, err := writers[s].Write(blocks[s][:n]); err != nil {
+				return fail(err)
+			}
+		}
+	}
+
+	checksums := make([]string, 0, total)
+	for s, f := range files {
+		if err := f.Close(); err != nil {
+			return fail(err)
+		}
+		checksums = append(checksums, fmt.Sprintf("%x", hashes[s].Sum(nil)))
+	}
+	return paths, checksums, nil
+}
+
+// JoinShards writes the chunk stored at storedSize bytes to w, rebuilt from shards, which maps
+// shard indexes from 0 to readers of their content. Any of the coding's DataShards shards do.
+func JoinShards(w io.Writer, shards map[int]io.ReaderAt, coding *models.ErasureCoding, storedSize int64) (int64, error) {
+	k := coding.DataShards
+	if len(shards) < k {
+		return 0, fmt.Errorf("%d shards can't rebuild a chunk of %d data shards", len(shards), k)
+	}
+
+	// Data shards read straight through, so prefer them over parity
+	have := make([]int, 0, len(shards))
+	for s := range shards {
+		have = append(have, s)
+	}
+	sort.Ints(have)
+	have = have[:k]
+
+	// Rows of the coding matrix that gave the shards at hand, inverted to map them back to data
+	parity := parityMatrix(k, coding.ParityShards)
+	rows := make([][]byte, k)
+	for i, s := range have {
+		if s < k {
+			rows[i] = make([]byte, k)
+			rows[i][s] = 1
+		} else {
+			rows[i] = parity[s-k]
+		}
+	}
+	decode, err := gfInvert(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	shardSize := ShardSize(storedSize, k)
+	blocks := make([][]byte, k)
+	for i := range blocks {
+		blocks[i] = make([]byte, shardBlockSize)
+	}
+	out := make([]byte, shardBlockSize)
+	var written int64
+	for s := 0; s < k && written < storedSize; s++ {
+		for off := int64(0); off < shardSize && written < storedSize; off += shardBlockSize {
+			n := int(min(shardBlockSize, shardSize-off))
+			var block []byte
+			if r, ok := shards[s]; ok {
+				block = blocks[0][:n]
+				if _, err := r.ReadAt(block, off); err != nil {
+					return written, fmt.Errorf("failed to read shard %d: %w", s+1, err)
+				}
+			} else {
+				block = out[:n]
+				clear(block)
+				for i, src := range have {
+					if _, err := shards[src].ReadAt(blocks[i][:n], off); err != nil {
+						return written, fmt.Errorf("failed to read shard %d: %w", src+1, err)
+					}
+					gfMulAdd(block, blocks[i][:n], decode[s][i])
+				}
+			}
+			// The padding of the last data shard isn't part of the chunk
+			block = block[:min(int64(n), storedSize-written)]
+			m, err := w.Write(block)
+			written += int64(m)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1, as in most Reed-Solomon codes
+var gfExp [510]byte
+var gfLog [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInverse(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+// gfMulAdd adds c times src to dst
+func gfMulAdd(dst, src []byte, c byte) {
+	switch c {
+	case 0:
+		return
+	case 1:
+		for i, b := range src {
+			dst[i] ^= b
+		}
+		return
+	}
+	var table [256]byte
+	for b := 1; b < 256; b++ {
+		table[b] = gfMul(c, byte(b))
+	}
+	for i, b := range src {
+		dst[i] ^= table[b]
+	}
+}
+
+// parityMatrix returns the rows coding the data shards into parity shards, a Cauchy matrix so
+// that any k rows of it stacked with the identity are invertible
+func parityMatrix(k, m int) [][]byte {
+	rows := make([][]byte, m)
+	for p := range rows {
+		rows[p] = make([]byte, k)
+		for s := range rows[p] {
+			rows[p][s] = gfInverse(byte(k+p) ^ byte(s))
+		}
+	}
+	return rows
+}
+
+// gfInvert returns the inverse of a square matrix with Gauss-Jordan elimination
+func gfInvert(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+	work := make([][]byte, n)
+	for i := range work {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], matrix[i])
+		work[i][n+i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("shards can't be decoded, their coding matrix is singular")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		scale := gfInverse(work[col][col])
+		for j := range work[col] {
+			work[col][j] = gfMul(work[col][j], scale)
+		}
+		for i := 0; i < n; i++ {
+			if i != col && work[i][col] != 0 {
+				gfMulAdd(work[i], work[col], work[i][col])
+			}
+		}
+	}
+
+	inverse := make([][]byte, n)
+	for i := range work {
+		inverse[i] = work[i][n:]
+	}
+	return inverse, nil
+}
@@ -0,0 +1,64 @@
+package fileprocessor
+
+import (
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SessionEvent is a progress update of an upload session, pushed to the session's event streams
+type SessionEvent struct {
+	Type            string  `json:"-"` // "upload", "progress" or "chunk"
+	Status          string  `json:"status,omitempty"`
+	Progress        float64 `json:"progress,omitempty"`
+	Message         string  `json:"message,omitempty"`
+	UploadedBytes   int64   `json:"uploaded_bytes,omitempty"`
+	ChunksCompleted int     `json:"chunks_completed,omitempty"`
+	TotalChunks     int     `json:"total_chunks,omitempty"`
+	DriveAccountID  string  `json:"drive_account_id,omitempty"`
+}
+
+// Terminal reports whether the event ends the session's processing
+func (e SessionEvent) Terminal() bool {
+	return e.Status == "complete" || e.Status == "failed" || e.Status == "incomplete"
+}
+
+// subscribers holds the event channels of every streamed session
+var (
+	subscribersMu sync.Mutex
+	subscribers   = make(map[primitive.ObjectID]map[chan SessionEvent]bool)
+)
+
+// SubscribeSession returns a channel of the session's events, call the returned func to stop receiving them
+func SubscribeSession(sessionID primitive.ObjectID) (<-chan SessionEvent, func()) {
+	ch := make(chan SessionEvent, 32)
+
+	subscribersMu.Lock()
+	if subscribers[sessionID] == nil {
+		subscribers[sessionID] = make(map[chan SessionEvent]bool)
+	}
+	subscribers[sessionID][ch] = true
+	subscribersMu.Unlock()
+
+	return ch, func() {
+		subscribersMu.Lock()
+		delete(subscribers[sessionID], ch)
+		if len(subscribers[sessionID]) == 0 {
+			delete(subscribers, sessionID)
+		}
+		subscribersMu.Unlock()
+	}
+}
+
+// PublishSessionEvent hands the event to the session's subscribers. A subscriber that fell
+// behind misses it rather than holding up the upload.
+func PublishSessionEvent(sessionID primitive.ObjectID, event SessionEvent) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	for ch := range subscribers[sessionID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package fileprocessor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Keys of the metadata extracted from images, the only ones files can be listed by
+const (
+	MetadataWidth       = "width"
+	MetadataHeight      = "height"
+	MetadataCapturedAt  = "captured_at"
+	MetadataCameraMake  = "camera_make"
+	MetadataCameraModel = "camera_model"
+)
+
+// MetadataKeys lists the keys ExtractImageMetadata may set
+var MetadataKeys = []string{MetadataWidth, MetadataHeight, MetadataCapturedAt, MetadataCameraMake, MetadataCameraModel}
+
+// MetadataFilter returns the metadata files are listed by from the query's metadata.<key>
+// parameters, e.g. metadata.camera_make=Canon. A value ending in * matches by prefix, so
+// metadata.captured_at=2024-06* lists the photos taken in June 2024.
+func MetadataFilter(query url.Values) (map[string]string, error) {
+	var filter map[string]string
+	for param, values := range query {
+		key, ok := strings.CutPrefix(param, "metadata.")
+		if !ok {
+			continue
+		}
+		if !slices.Contains(MetadataKeys, key) {
+			return nil, fmt.Errorf("unknown metadata key %q, must be one of %s", key, strings.Join(MetadataKeys, ", "))
+		}
+		if len(values) != 1 || values[0] == "" || values[0] == "*" {
+			return nil, fmt.Errorf("%s needs a single value", param)
+		}
+		if filter == nil {
+			filter = make(map[string]string)
+		}
+		filter[key] = values[0]
+	}
+	return filter, nil
+}
+
+// EXIF tags read, in IFD0 and in the Exif IFD it points to
+const (
+	exifTagMake               = 0x010F
+	exifTagModel              = 0x0110
+	exifTagDateTime           = 0x0132
+	exifTagExifIFD            = 0x8769
+	exifTagDateTimeOriginal   = 0x9003
+	exifTagOffsetTimeOriginal = 0x9011
+)
+
+// Longest camera name kept, EXIF strings are whatever the camera wrote
+const maxMetadataValue = 64
+
+// ExtractImageMetadata reads the dimensions of the image at path and, for a JPEG, the capture
+// time and camera its EXIF names. Only the image header and the segments before the image data
+// are read, never the pixels. It returns nil for content types that aren't a supported image,
+// and what it could read when the EXIF is absent or malformed; an error means not even the
+// dimensions could be read.
+func ExtractImageMetadata(path, contentType string) (map[string]string, error) {
+	if !thumbnailTypes[contentType] {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image header: %w", err)
+	}
+	metadata := map[string]string{
+		MetadataWidth:  strconv.Itoa(config.Width),
+		MetadataHeight: strconv.Itoa(config.Height),
+	}
+	if contentType != "image/jpeg" {
+		return metadata, nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return metadata, nil
+	}
+	tiff, err := readJPEGExif(bufio.NewReader(f))
+	if err != nil || tiff == nil {
+		return metadata, nil
+	}
+	for k, v := range parseExif(tiff) {
+		metadata[k] = v
+	}
+	return metadata, nil
+}
+
+// readJPEGExif returns the TIFF structure of the JPEG's EXIF segment, nil when it has none. It
+// walks the segments up to the image data, holding only the EXIF one, at most 64 KB.
+func readJPEGExif(r *bufio.Reader) ([]byte, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return nil, errors.New("not a JPEG")
+	}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != 0xFF {
+			return nil, errors.New("malformed JPEG segment")
+		}
+		marker, err := r.ReadByte()
+		for err == nil && marker == 0xFF { // Fill bytes
+			marker, err = r.ReadByte()
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case marker == 0xDA || marker == 0xD9: // Image data or its end, EXIF comes before
+			return nil, nil
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7): // No length
+			continue
+		}
+
+		var size [2]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return nil, err
+		}
+		length := int(binary.BigEndian.Uint16(size[:])) - 2
+		if length < 0 {
+			return nil, errors.New("malformed JPEG segment length")
+		}
+		if marker != 0xE1 {
+			if _, err := r.Discard(length); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, err
+		}
+		// APP1 also carries XMP, only the Exif one is read
+		if tiff, ok := bytes.CutPrefix(segment, []byte("Exif\x00\x00")); ok {
+			return tiff, nil
+		}
+	}
+}
+
+// exifReader reads the entries of a TIFF structure, checking every offset against its bounds
+type exifReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type exifEntry struct {
+	typ   uint16
+	count uint32
+	value []byte // The 4 bytes of the entry holding the value or its offset
+}
+
+// parseExif returns the capture time and camera of the TIFF structure of an EXIF segment,
+// leaving out whatever is missing or malformed
+func parseExif(tiff []byte) map[string]string {
+	out := make(map[string]string)
+	if len(tiff) < 8 {
+		return out
+	}
+	x := exifReader{data: tiff}
+	switch string(tiff[:2]) {
+	case "II":
+		x.order = binary.LittleEndian
+	case "MM":
+		x.order = binary.BigEndian
+	default:
+		return out
+	}
+	if x.order.Uint16(tiff[2:4]) != 42 {
+		return out
+	}
+
+	ifd0 := x.readIFD(x.order.Uint32(tiff[4:8]))
+	var exif map[uint16]exifEntry
+	if entry, ok := ifd0[exifTagExifIFD]; ok {
+		exif = x.readIFD(x.order.Uint32(entry.value))
+	}
+
+	if v := x.metadataString(ifd0, exifTagMake); v != "" {
+		out[MetadataCameraMake] = v
+	}
+	if v := x.metadataString(ifd0, exifTagModel); v != "" {
+		out[MetadataCameraModel] = v
+	}
+	captured := x.str(exif, exifTagDateTimeOriginal)
+	offset := x.str(exif, exifTagOffsetTimeOriginal)
+	if captured == "" {
+		captured, offset = x.str(ifd0, exifTagDateTime), ""
+	}
+	if v := exifTime(captured, offset); v != "" {
+		out[MetadataCapturedAt] = v
+	}
+	return out
+}
+
+// readIFD returns the entries of the IFD at offset by tag, none when it's out of bounds
+func (x exifReader) readIFD(offset uint32) map[uint16]exifEntry {
+	entries := make(map[uint16]exifEntry)
+	if uint64(offset)+2 > uint64(len(x.data)) {
+		return entries
+	}
+	n := int(x.order.Uint16(x.data[offset:]))
+	start := int(offset) + 2
+	for i := 0; i < n; i++ {
+		e := start + i*12
+		if e+12 > len(x.data) {
+			break
+		}
+		entries[x.order.Uint16(x.data[e:])] = exifEntry{
+			typ:   x.order.Uint16(x.data[e+2:]),
+			count: x.order.Uint32(x.data[e+4:]),
+			value: x.data[e+8 : e+12],
+		}
+	}
+	return entries
+}
+
+// str returns the ASCII value of the tag, "" when it's missing, of another type or out of
+// bounds
+func (x exifReader) str(entries map[uint16]exifEntry, tag uint16) string {
+	entry, ok := entries[tag]
+	if !ok || entry.typ != 2 || entry.count == 0 {
+		return ""
+	}
+	var raw []byte
+	if entry.count <= 4 {
+		raw = entry.value[:entry.count]
+	} else {
+		offset := uint64(x.order.Uint32(entry.value))
+		if offset+uint64(entry.count) > uint64(len(x.data)) {
+			return ""
+		}
+		raw = x.data[offset : offset+uint64(entry.count)]
+	}
+	if i := bytes.IndexByte(raw, 0); i >= 0 {
+		raw = raw[:i]
+	}
+	return strings.TrimSpace(string(raw))
+}
+
+// metadataString returns the tag's value fit for storing: printable, at most 64 characters
+func (x exifReader) metadataString(entries map[uint16]exifEntry, tag uint16) string {
+	v := strings.Map(func(r rune) rune {
+		if r == unicode.ReplacementChar || !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, x.str(entries, tag))
+	if runes := []rune(v); len(runes) > maxMetadataValue {
+		v = string(runes[:maxMetadataValue])
+	}
+	return strings.TrimSpace(v)
+}
+
+// exifTime turns an EXIF date, "2006:01:02 15:04:05", into RFC 3339. Without the offset the
+// camera recorded it has none, e.g. "2024-06-01T14:30:00", being in the camera's local time.
+func exifTime(value, offset string) string {
+	t, err := time.Parse("2006:01:02 15:04:05", value)
+	if err != nil || t.Year() < 1900 {
+		return ""
+	}
+	if offset != "" {
+		if zoned, err := time.Parse("2006:01:02 15:04:05-07:00", value+offset); err == nil {
+			return zoned.Format(time.RFC3339)
+		}
+	}
+	return t.Format("2006-01-02T15:04:05")
+}
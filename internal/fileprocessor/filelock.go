@@ -0,0 +1,99 @@
+package fileprocessor
+
+import (
+	"SE/internal/store"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// How long a file lock lasts without its holder renewing it, and how long LockFile waits for a
+// held one, set by InitFileConfig
+var (
+	fileLockTTL  = 60 * time.Second
+	fileLockWait = 5 * time.Second
+)
+
+// How often LockFile tries again while the file is locked
+const fileLockPoll = 200 * time.Millisecond
+
+// ErrFileLocked is returned by LockFile when another operation kept the file locked for the
+// whole wait
+var ErrFileLocked = errors.New("file is locked by another operation")
+
+// LockFile takes the file's lock for operation, waiting up to FILE_LOCK_WAIT_SECONDS while
+// another finalize, update, append, delete, rebalance or rekey holds it, on this server or any
+// other. The lock is renewed until the returned func releases it, so defer that right away: it
+// then runs on a panic too, and a server that dies loses the lock once FILE_LOCK_TTL_SECONDS
+// pass.
+func LockFile(ctx context.Context, fileID primitive.ObjectID, operation string) (func(), error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("failed to generate lock holder: %w", err)
+	}
+	holder := hex.EncodeToString(b)
+
+	deadline := time.Now().Add(fileLockWait)
+	for {
+		held, err := store.AcquireFileLock(ctx, fileID, holder, operation, fileLockTTL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lock file: %w", err)
+		}
+		if held == nil {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			if held.Operation != "" {
+				return nil, fmt.Errorf("%w: %s is in progress", ErrFileLocked, held.Operation)
+			}
+			return nil, ErrFileLocked
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(min(fileLockPoll, time.Until(deadline))):
+		}
+	}
+
+	// The operation often outlives the request that started it, the lock has to as well
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(fileLockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				renewCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+				ok, err := store.RenewFileLock(renewCtx, fileID, holder, fileLockTTL)
+				cancel()
+				if err != nil {
+					log.Printf("Failed to renew %s lock of file %s: %v", operation, fileID.Hex(), err)
+				} else if !ok {
+					log.Printf("Lost %s lock of file %s, it expired before it was renewed", operation, fileID.Hex())
+					return
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			releaseCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := store.ReleaseFileLock(releaseCtx, fileID, holder); err != nil {
+				log.Printf("Failed to release %s lock of file %s, it expires on its own: %v", operation, fileID.Hex(), err)
+			}
+		})
+	}, nil
+}
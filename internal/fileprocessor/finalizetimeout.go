@@ -0,0 +1,95 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// What happens to a session that isn't finalized in time
+const (
+	FinalizeTimeoutStale    = "stale"    // Marked stale and reclaimed by the session sweeper
+	FinalizeTimeoutFinalize = "finalize" // Finalized by the server as a new file
+)
+
+// How often sessions overdue for finalizing are looked for when they're auto-finalized
+const autoFinalizeInterval = time.Minute
+
+// Finalize timeout, set by initFinalizeTimeoutConfig
+var (
+	finalizeTimeout       time.Duration
+	finalizeTimeoutAction string
+)
+
+func initFinalizeTimeoutConfig() {
+	// Time from the last chunk to finalize, 0 waits until the session expires
+	finalizeTimeout = 30 * time.Minute
+	if v := os.Getenv("FINALIZE_TIMEOUT_MINUTES"); v != "" {
+		mins, err := strconv.Atoi(v)
+		if err != nil || mins < 0 {
+			log.Fatalf("FINALIZE_TIMEOUT_MINUTES must be a non-negative number, got %q", v)
+		}
+		finalizeTimeout = time.Duration(mins) * time.Minute
+	}
+
+	finalizeTimeoutAction = FinalizeTimeoutStale
+	if v := os.Getenv("FINALIZE_TIMEOUT_ACTION"); v != "" {
+		if v != FinalizeTimeoutStale && v != FinalizeTimeoutFinalize {
+			log.Fatalf("FINALIZE_TIMEOUT_ACTION must be %s or %s, got %q", FinalizeTimeoutStale, FinalizeTimeoutFinalize, v)
+		}
+		finalizeTimeoutAction = v
+	}
+}
+
+// AutoFinalizeEnabled reports whether sessions that aren't finalized in time are finalized by
+// the server
+func AutoFinalizeEnabled() bool {
+	return finalizeTimeout > 0 && finalizeTimeoutAction == FinalizeTimeoutFinalize
+}
+
+// AutoFinalizeInterval returns how often the auto-finalizer looks for overdue sessions
+func AutoFinalizeInterval() time.Duration {
+	return autoFinalizeInterval
+}
+
+// FinalizeDeadline returns when an uploading session that received every chunk has to be
+// finalized by, nil when it's still missing chunks or there is no finalize timeout
+func FinalizeDeadline(session *models.UploadSession) *time.Time {
+	if finalizeTimeout == 0 || session.Status != "uploading" || session.ChunksReceivedAt == nil {
+		return nil
+	}
+	deadline := session.ChunksReceivedAt.Add(finalizeTimeout)
+	return &deadline
+}
+
+// AutoFinalizeRequest is the finalize request an overdue session is processed with
+func AutoFinalizeRequest(session *models.UploadSession) models.ProcessRequest {
+	return models.ProcessRequest{SessionID: session.ID.Hex(), Strategy: models.StrategyBalanced}
+}
+
+// ClaimOverdueSession moves the session overdue for finalizing the longest to processing. It
+// returns nil when none is.
+func ClaimOverdueSession(ctx context.Context) (*models.UploadSession, error) {
+	message := "Auto-finalizing..."
+	session, err := store.ClaimOverdueSession(ctx, time.Now().Add(-finalizeTimeout), message)
+	if err != nil || session == nil {
+		return nil, err
+	}
+	PublishSessionEvent(session.ID, SessionEvent{Type: "progress", Status: "processing", Message: message})
+	return session, nil
+}
+
+// markStaleSessions marks the sessions overdue for finalizing stale, unless they're
+// auto-finalized, so the sweep reclaims them
+func markStaleSessions(ctx context.Context) (int, error) {
+	if finalizeTimeout == 0 || finalizeTimeoutAction != FinalizeTimeoutStale {
+		return 0, nil
+	}
+	message := fmt.Sprintf("Not finalized within %d minutes of the last chunk", int(finalizeTimeout.Minutes()))
+	return store.MarkSessionsStale(ctx, time.Now().Add(-finalizeTimeout), message)
+}
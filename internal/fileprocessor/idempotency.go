@@ -0,0 +1,78 @@
+package fileprocessor
+
+import (
+	"SE/internal/cache"
+	"SE/internal/models"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// idempotencyCacheKey names the user's key in the cache, hashed since clients choose it
+func idempotencyCacheKey(record *models.IdempotencyKey) string {
+	return fmt.Sprintf("idempotency:%s:%x", record.UserID.Hex(), sha256.Sum256([]byte(record.Key)))
+}
+
+// ClaimIdempotencyKey records the key for the user unless it is already in use. It returns nil
+// once the key is claimed, or the unexpired record that holds it.
+func ClaimIdempotencyKey(ctx context.Context, record *models.IdempotencyKey) (*models.IdempotencyKey, error) {
+	record.CreatedAt = time.Now().UTC()
+	value, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	key := idempotencyCacheKey(record)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		claimed, err := cache.Shared().SetNX(ctx, key, string(value), time.Until(record.ExpiresAt))
+		if err != nil {
+			return nil, err
+		}
+		if claimed {
+			return nil, nil
+		}
+
+		existing, ok, err := cache.Shared().Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue // Expired or freed in the meantime
+		}
+		var held models.IdempotencyKey
+		if err := json.Unmarshal([]byte(existing), &held); err != nil {
+			return nil, fmt.Errorf("invalid idempotency key record: %w", err)
+		}
+		return &held, nil
+	}
+	return nil, errors.New("idempotency key is being claimed concurrently")
+}
+
+// SetIdempotencyKeySession records the session the claimed key created, for retries to get
+func SetIdempotencyKeySession(ctx context.Context, record *models.IdempotencyKey, sessionID primitive.ObjectID) error {
+	updated := *record
+	updated.SessionID = sessionID
+	value, err := json.Marshal(&updated)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(record.ExpiresAt)
+	if ttl <= 0 {
+		return errors.New("idempotency key expired")
+	}
+	if err := cache.Shared().Set(ctx, idempotencyCacheKey(record), string(value), ttl); err != nil {
+		return err
+	}
+	record.SessionID = sessionID
+	return nil
+}
+
+// DeleteIdempotencyKey frees the claimed key
+func DeleteIdempotencyKey(ctx context.Context, record *models.IdempotencyKey) error {
+	return cache.Shared().Delete(ctx, idempotencyCacheKey(record))
+}
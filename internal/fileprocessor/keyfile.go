@@ -14,6 +14,9 @@ func GenerateKeyFile(
 	originalSize int64,
 	processedSize int64,
 	obfuscation *models.ObfuscationMetadata,
+	encryption *models.EncryptionMetadata,
+	clientEncryption *models.ClientEncryptionMetadata,
+	erasureCoding *models.ErasureCoding,
 	chunks []models.ChunkMetadata,
 	outputPath string,
 ) error {
@@ -23,6 +26,9 @@ func GenerateKeyFile(
 		OriginalSize:     originalSize,
 		ProcessedSize:    processedSize,
 		Obfuscation:      *obfuscation,
+		Encryption:       encryption,
+		ClientEncryption: clientEncryption,
+		ErasureCoding:    erasureCoding,
 		Chunks:           chunks,
 		CreatedAt:        time.Now(),
 	}
@@ -0,0 +1,124 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"slices"
+)
+
+// Prefixes of the hashed leaves and nodes of a Merkle tree, so a node can't pass for a leaf
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// MerkleStep is one sibling on the path from a chunk's leaf to the root, hashed on the side it
+// sits: SHA-256(0x01 || left || right)
+type MerkleStep struct {
+	Hash string `json:"hash"`
+	Side string `json:"side"` // "left" or "right" of the node being climbed from
+}
+
+// MerkleProof shows a chunk's checksum belongs to the file with the given root
+type MerkleProof struct {
+	ChunkID      int          `json:"chunk_id"`
+	Checksum     string       `json:"checksum"`
+	ChecksumAlgo string       `json:"checksum_algo"`
+	Index        int          `json:"index"`      // Position of the chunk's leaf, chunks are ordered by ID
+	LeafCount    int          `json:"leaf_count"` // Chunks of the file
+	Leaf         string       `json:"leaf"`
+	Path         []MerkleStep `json:"path"`
+}
+
+// MerkleRoot returns the hex SHA-256 root of the Merkle tree over the chunks' checksums, ordered
+// by chunk ID. Each leaf is SHA-256(0x00 || chunk ID as 8 bytes big-endian || checksum bytes); a
+// node left without a sibling is carried up to the next level as it is.
+func MerkleRoot(chunks []models.StoredChunk) (string, error) {
+	level, _, err := merkleLeaves(chunks)
+	if err != nil {
+		return "", err
+	}
+	if len(level) == 0 {
+		return "", nil
+	}
+	for len(level) > 1 {
+		level = merkleLevel(level)
+	}
+	return hex.EncodeToString(level[0]), nil
+}
+
+// BuildMerkleProof returns the path proving the checksum of the chunk with chunkID is a leaf of
+// MerkleRoot(chunks), nil when the file has no such chunk
+func BuildMerkleProof(chunks []models.StoredChunk, chunkID int) (*MerkleProof, error) {
+	level, sorted, err := merkleLeaves(chunks)
+	if err != nil {
+		return nil, err
+	}
+	index, ok := slices.BinarySearchFunc(sorted, chunkID, func(c models.StoredChunk, id int) int { return c.ChunkID - id })
+	if !ok {
+		return nil, nil
+	}
+
+	proof := &MerkleProof{
+		ChunkID:      chunkID,
+		Checksum:     sorted[index].Checksum,
+		ChecksumAlgo: sorted[index].ChecksumAlgo,
+		Index:        index,
+		LeafCount:    len(level),
+		Leaf:         hex.EncodeToString(level[index]),
+		Path:         []MerkleStep{},
+	}
+	for i := index; len(level) > 1; i /= 2 {
+		switch {
+		case i%2 == 1:
+			proof.Path = append(proof.Path, MerkleStep{Hash: hex.EncodeToString(level[i-1]), Side: "left"})
+		case i+1 < len(level):
+			proof.Path = append(proof.Path, MerkleStep{Hash: hex.EncodeToString(level[i+1]), Side: "right"})
+		}
+		level = merkleLevel(level)
+	}
+	return proof, nil
+}
+
+// merkleLeaves returns the leaf hashes of the chunks in chunk ID order, with the chunks in it
+func merkleLeaves(chunks []models.StoredChunk) ([][]byte, []models.StoredChunk, error) {
+	sorted := slices.Clone(chunks)
+	slices.SortFunc(sorted, func(a, b models.StoredChunk) int { return a.ChunkID - b.ChunkID })
+
+	leaves := make([][]byte, 0, len(sorted))
+	for i, chunk := range sorted {
+		if i > 0 && chunk.ChunkID == sorted[i-1].ChunkID {
+			return nil, nil, fmt.Errorf("chunk %d is listed twice", chunk.ChunkID)
+		}
+		checksum, err := hex.DecodeString(chunk.Checksum)
+		if err != nil || len(checksum) == 0 {
+			return nil, nil, fmt.Errorf("chunk %d has no valid checksum", chunk.ChunkID)
+		}
+		h := sha256.New()
+		h.Write([]byte{merkleLeafPrefix})
+		h.Write(binary.BigEndian.AppendUint64(nil, uint64(chunk.ChunkID)))
+		h.Write(checksum)
+		leaves = append(leaves, h.Sum(nil))
+	}
+	return leaves, sorted, nil
+}
+
+// merkleLevel hashes the nodes of a level in pairs into the level above it
+func merkleLevel(level [][]byte) [][]byte {
+	next := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+			continue
+		}
+		h := sha256.New()
+		h.Write([]byte{merkleNodePrefix})
+		h.Write(level[i])
+		h.Write(level[i+1])
+		next = append(next, h.Sum(nil))
+	}
+	return next
+}
@@ -2,6 +2,7 @@ package fileprocessor
 
 import (
 	"SE/internal/models"
+	"bufio"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
@@ -98,10 +99,12 @@ func ObfuscateFile(inputPath, outputPath string, seed []byte) (*models.Obfuscati
 
 	metadata := &models.ObfuscationMetadata{
 		Algorithm:   "ChaCha20-DRBG",
+		Scheme:      defaultObfuscationScheme,
 		Seed:        base64.StdEncoding.EncodeToString(seed),
 		BlockSize:   defaultBlockSize,
 		OverheadPct: defaultOverheadPct,
 		MinGap:      defaultMinGap,
+		NamePrefix:  chunkNamePrefix,
 	}
 
 	return metadata, processedSize, nil
@@ -118,7 +121,7 @@ func generateInjectionOffsets(cipher *chacha20.Cipher, fileSize int64, numInject
 
 	// Convert to offsets
 	maxOffset := fileSize - minGap
-	if maxOffset < 0 {
+	if maxOffset <= 0 {
 		maxOffset = fileSize
 	}
 
@@ -151,7 +154,7 @@ func generateInjectionOffsets(cipher *chacha20.Cipher, fileSize int64, numInject
 }
 
 // streamInjectNoise performs streaming noise injection
-func streamInjectNoise(inFile, outFile *os.File, cipher *chacha20.Cipher, offsets []int64, blockSize int) (int64, error) {
+func streamInjectNoise(inFile io.Reader, outFile io.Writer, cipher *chacha20.Cipher, offsets []int64, blockSize int) (int64, error) {
 	var totalWritten int64
 	var currentOffset int64
 	buffer := make([]byte, 32*1024) // 32KB read buffer
@@ -248,3 +251,143 @@ func CalculateChecksum(filePath string) (string, error) {
 
 	return fmt.Sprintf("%x", hash.Sum(nil)), nil
 }
+
+// regenerateInjectionOffsets rebuilds the noise injection points from the stored metadata
+func regenerateInjectionOffsets(metadata *models.ObfuscationMetadata, originalSize int64) ([]int64, error) {
+	seed, err := base64.StdEncoding.DecodeString(metadata.Seed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid obfuscation seed: %w", err)
+	}
+	if metadata.BlockSize <= 0 {
+		return nil, fmt.Errorf("invalid obfuscation block size %d", metadata.BlockSize)
+	}
+
+	// Same cipher setup as ObfuscateFile so the keystream lines up
+	nonce := make([]byte, 12)
+	cipher, err := chacha20.NewUnauthenticatedCipher(seed, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	targetOverhead := int64(float64(originalSize) * (metadata.OverheadPct / 100.0))
+	numInjections := targetOverhead / int64(metadata.BlockSize)
+	if numInjections == 0 {
+		numInjections = 1
+	}
+
+	return generateInjectionOffsets(cipher, originalSize, numInjections, int64(metadata.MinGap)), nil
+}
+
+// DeobfuscateStream strips the injected noise from src, writing the original bytes to dst
+func DeobfuscateStream(dst io.Writer, src io.Reader, metadata *models.ObfuscationMetadata, originalSize int64) error {
+	offsets, err := regenerateInjectionOffsets(metadata, originalSize)
+	if err != nil {
+		return err
+	}
+
+	blockSize := int64(metadata.BlockSize)
+	var position int64 // Bytes of original data written so far
+
+	for _, offset := range offsets {
+		// Copy original data up to the injection point
+		if offset > position {
+			if _, err := io.CopyN(dst, src, offset-position); err != nil {
+				return fmt.Errorf("failed to copy data at offset %d: %w", position, err)
+			}
+			position = offset
+		}
+
+		// Skip the noise block
+		if _, err := io.CopyN(io.Discard, src, blockSize); err != nil {
+			return fmt.Errorf("failed to skip noise at offset %d: %w", offset, err)
+		}
+	}
+
+	// Copy the remaining tail
+	if _, err := io.CopyN(dst, src, originalSize-position); err != nil {
+		return fmt.Errorf("failed to copy data at offset %d: %w", position, err)
+	}
+
+	return nil
+}
+
+// DeobfuscateFile reverses ObfuscateFile, writing the original file to outputPath.
+// It returns the SHA256 of the reconstructed file.
+func DeobfuscateFile(inputPath, outputPath string, metadata *models.ObfuscationMetadata, originalSize int64) (string, error) {
+	inFile, err := os.Open(inputPath)
+	if err != nil {
+		return "", err
+	}
+	defer inFile.Close()
+
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		return "", err
+	}
+	defer outFile.Close()
+
+	return deobfuscateFile(outFile, outputPath, func(dst io.Writer) error {
+		return DeobfuscateStream(dst, bufio.NewReaderSize(inFile, 32*1024), metadata, originalSize)
+	})
+}
+
+// DeobfuscateStoredFile strips the noise from a stored file's processed bytes in the download
+// session's temp file, whole-file or chunk by chunk as it was injected, writing them to its
+// reconstructed file. It returns the SHA256 of the reconstructed file.
+func DeobfuscateStoredFile(session *models.DownloadSession, file *models.StoredFile) (string, error) {
+	inFile, err := OpenDownloadFile(session, session.TempFilePath)
+	if err != nil {
+		return "", err
+	}
+	defer inFile.Close()
+
+	outFile, err := CreateDownloadFile(session, session.ReconstructedPath)
+	if err != nil {
+		return "", err
+	}
+	defer outFile.Close()
+
+	return deobfuscateFile(outFile, session.ReconstructedPath, func(dst io.Writer) error {
+		if file.Obfuscation.Chunking != models.StrategyContentDefined {
+			return DeobfuscateStream(dst, bufio.NewReaderSize(inFile, 32*1024), &file.Obfuscation, file.OriginalSize)
+		}
+		return deobfuscateChunks(dst, inFile, &file.Obfuscation, file.Chunks)
+	})
+}
+
+// DeobfuscateStoredStream strips the noise from a stored file's processed bytes, read from src
+// in order of their offset, writing the original bytes to dst. It returns their SHA256.
+func DeobfuscateStoredStream(dst io.Writer, src io.Reader, file *models.StoredFile) (string, error) {
+	hash := sha256.New()
+	out := io.MultiWriter(dst, hash)
+	src = bufio.NewReaderSize(src, 32*1024)
+
+	var err error
+	if file.Obfuscation.Chunking != models.StrategyContentDefined {
+		err = DeobfuscateStream(out, src, &file.Obfuscation, file.OriginalSize)
+	} else {
+		err = deobfuscateChunkStream(out, src, &file.Obfuscation, file.Chunks)
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// deobfuscateFile writes the original bytes deobfuscate produces to outFile and returns their
+// SHA256, removing outputPath when it fails
+func deobfuscateFile(outFile io.Writer, outputPath string, deobfuscate func(dst io.Writer) error) (string, error) {
+	writer := bufio.NewWriterSize(outFile, 32*1024)
+	hash := sha256.New()
+
+	if err := deobfuscate(io.MultiWriter(writer, hash)); err != nil {
+		os.Remove(outputPath)
+		return "", err
+	}
+	if err := writer.Flush(); err != nil {
+		os.Remove(outputPath)
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
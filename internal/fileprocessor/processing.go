@@ -0,0 +1,91 @@
+package fileprocessor
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// processing holds the upload sessions whose background processing is still running
+var (
+	processingMu sync.Mutex
+	processing   = make(map[primitive.ObjectID]bool)
+)
+
+// BeginProcessing records that a session's background processing started, call the returned func when it ends
+func BeginProcessing(sessionID primitive.ObjectID) func() {
+	processingMu.Lock()
+	processing[sessionID] = true
+	processingMu.Unlock()
+
+	return func() {
+		processingMu.Lock()
+		delete(processing, sessionID)
+		processingMu.Unlock()
+	}
+}
+
+// reconstructing holds the download sessions whose file is still being reconstructed
+var (
+	reconstructingMu sync.Mutex
+	reconstructing   = make(map[primitive.ObjectID]bool)
+)
+
+// BeginReconstruction records that a download session started reconstructing its file, call the returned func when it ends
+func BeginReconstruction(sessionID primitive.ObjectID) func() {
+	reconstructingMu.Lock()
+	reconstructing[sessionID] = true
+	reconstructingMu.Unlock()
+
+	return func() {
+		reconstructingMu.Lock()
+		delete(reconstructing, sessionID)
+		reconstructingMu.Unlock()
+	}
+}
+
+func isReconstructing(sessionID primitive.ObjectID) bool {
+	reconstructingMu.Lock()
+	defer reconstructingMu.Unlock()
+	return reconstructing[sessionID]
+}
+
+func processingSessions() []primitive.ObjectID {
+	processingMu.Lock()
+	defer processingMu.Unlock()
+	ids := make([]primitive.ObjectID, 0, len(processing))
+	for id := range processing {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// WaitForProcessing blocks until all background processing finished or ctx is done,
+// and returns the sessions that were still processing
+func WaitForProcessing(ctx context.Context) []primitive.ObjectID {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		ids := processingSessions()
+		if len(ids) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ids
+		case <-ticker.C:
+		}
+	}
+}
+
+// MarkSessionsIncomplete flags sessions interrupted by a shutdown, finalizing them again resumes processing
+func MarkSessionsIncomplete(ctx context.Context, sessionIDs []primitive.ObjectID) {
+	for _, id := range sessionIDs {
+		if err := UpdateSessionStatus(ctx, id, "incomplete", 0, "Processing interrupted by server shutdown, finalize again to resume"); err != nil {
+			log.Printf("Failed to mark session %s incomplete: %v", id.Hex(), err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package fileprocessor
+
+import (
+	"SE/internal/store"
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// QuotaUsage reports how much of their storage quota a user has used
+type QuotaUsage struct {
+	UsedBytes  int64 `json:"used_bytes"`
+	LimitBytes int64 `json:"limit_bytes"`
+}
+
+// Allows reports whether a new file of size bytes still fits in the quota
+func (q *QuotaUsage) Allows(size int64) bool {
+	return q.UsedBytes+size <= q.LimitBytes
+}
+
+func GetQuotaUsage(ctx context.Context, userID primitive.ObjectID) (*QuotaUsage, error) {
+	user, err := store.FindUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+
+	limit := user.QuotaBytes
+	if limit == 0 {
+		limit = defaultQuotaBytes
+	}
+
+	used, err := store.SumUserStoredBytes(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QuotaUsage{UsedBytes: used, LimitBytes: limit}, nil
+}
@@ -0,0 +1,150 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// RangePlan maps a range of a stored file's original bytes onto the chunks holding them
+type RangePlan struct {
+	Chunks []models.StoredChunk // The chunks to fetch, in order of their offset and back to back
+	start  int64
+	length int64
+	// Noise of the whole file, set unless it was injected chunk by chunk
+	offsets   []int64
+	blockSize int64
+	// Bytes of the first chunk before the range
+	skip int64
+	// Original bytes of the file before each chunk, for content-defined chunks
+	origins     []int64
+	obfuscation *models.ObfuscationMetadata
+	seed        []byte
+}
+
+// PlanRange works out which chunks hold the original bytes of the file from start for length
+// bytes, which has to be within the file. The noise injected at upload shifts the original bytes
+// further into the processed stream the chunks' offsets are in.
+func PlanRange(file *models.StoredFile, start, length int64) (*RangePlan, error) {
+	if start < 0 || length <= 0 || start+length > file.OriginalSize {
+		return nil, fmt.Errorf("range of %d bytes at %d is outside the file", length, start)
+	}
+	chunks := ChunksByOffset(file.Chunks)
+	plan := &RangePlan{start: start, length: length}
+	end := start + length - 1
+
+	if file.Obfuscation.Chunking == models.StrategyContentDefined {
+		seed, err := base64.StdEncoding.DecodeString(file.Obfuscation.Seed)
+		if err != nil {
+			return nil, fmt.Errorf("invalid obfuscation seed: %w", err)
+		}
+		plan.obfuscation = &file.Obfuscation
+		plan.seed = seed
+		var origin int64
+		for _, chunk := range chunks {
+			if origin+chunk.OriginalSize > start && origin <= end {
+				plan.Chunks = append(plan.Chunks, chunk)
+				plan.origins = append(plan.origins, origin)
+			}
+			origin += chunk.OriginalSize
+		}
+		if origin != file.OriginalSize {
+			return nil, fmt.Errorf("chunks hold %d bytes of the %d byte file", origin, file.OriginalSize)
+		}
+		return plan, nil
+	}
+
+	offsets, err := regenerateInjectionOffsets(&file.Obfuscation, file.OriginalSize)
+	if err != nil {
+		return nil, err
+	}
+	plan.offsets = offsets
+	plan.blockSize = int64(file.Obfuscation.BlockSize)
+	first, last := plan.processedOffset(start), plan.processedOffset(end)
+	for _, chunk := range chunks {
+		if chunk.StartOffset <= last && chunk.StartOffset+chunk.Size > first {
+			if n := len(plan.Chunks); n > 0 && plan.Chunks[n-1].StartOffset+plan.Chunks[n-1].Size != chunk.StartOffset {
+				return nil, fmt.Errorf("chunks aren't contiguous at offset %d", chunk.StartOffset)
+			}
+			plan.Chunks = append(plan.Chunks, chunk)
+		}
+	}
+	if len(plan.Chunks) == 0 || plan.Chunks[0].StartOffset > first {
+		return nil, fmt.Errorf("no chunk holds offset %d", first)
+	}
+	if tail := plan.Chunks[len(plan.Chunks)-1]; tail.StartOffset+tail.Size <= last {
+		return nil, fmt.Errorf("no chunk holds offset %d", last)
+	}
+	plan.skip = first - plan.Chunks[0].StartOffset
+	return plan, nil
+}
+
+// processedOffset returns where the original byte at pos is in the processed stream, after the
+// noise blocks injected before it
+func (p *RangePlan) processedOffset(pos int64) int64 {
+	injected := sort.Search(len(p.offsets), func(i int) bool { return p.offsets[i] > pos })
+	return pos + int64(injected)*p.blockSize
+}
+
+// Deobfuscate writes the planned range of original bytes to dst, stripping the noise from src,
+// the processed bytes of the plan's chunks one after another
+func (p *RangePlan) Deobfuscate(dst io.Writer, src io.Reader) error {
+	if p.obfuscation == nil {
+		if _, err := io.CopyN(io.Discard, src, p.skip); err != nil {
+			return fmt.Errorf("failed to skip to offset %d: %w", p.start, err)
+		}
+		return deobfuscateSection(dst, src, p.offsets, p.blockSize, p.start, p.length)
+	}
+
+	end := p.start + p.length
+	for i, chunk := range p.Chunks {
+		chunkMetadata := *p.obfuscation
+		chunkMetadata.Seed = base64.StdEncoding.EncodeToString(chunkNoiseSeed(p.seed, chunk.ChunkID))
+		offsets, err := regenerateInjectionOffsets(&chunkMetadata, chunk.OriginalSize)
+		if err != nil {
+			return fmt.Errorf("chunk %d: %w", chunk.ChunkID, err)
+		}
+		local := &RangePlan{offsets: offsets, blockSize: int64(p.obfuscation.BlockSize)}
+
+		// The part of the range in this chunk, in the chunk's own original bytes
+		from := max(p.start, p.origins[i]) - p.origins[i]
+		to := min(end, p.origins[i]+chunk.OriginalSize) - p.origins[i]
+		section := io.LimitReader(src, chunk.Size)
+		if _, err := io.CopyN(io.Discard, section, local.processedOffset(from)); err != nil {
+			return fmt.Errorf("chunk %d: %w", chunk.ChunkID, err)
+		}
+		if err := deobfuscateSection(dst, section, offsets, local.blockSize, from, to-from); err != nil {
+			return fmt.Errorf("chunk %d: %w", chunk.ChunkID, err)
+		}
+		// The next chunk starts where this one ends
+		if _, err := io.Copy(io.Discard, section); err != nil {
+			return fmt.Errorf("chunk %d: %w", chunk.ChunkID, err)
+		}
+	}
+	return nil
+}
+
+// deobfuscateSection copies length original bytes from start out of src, positioned at the
+// processed offset of start, skipping the noise blocks injected among them
+func deobfuscateSection(dst io.Writer, src io.Reader, offsets []int64, blockSize, start, length int64) error {
+	end := start + length
+	position := start
+	// Noise at start itself comes before it and was skipped with the bytes before the range
+	for i := sort.Search(len(offsets), func(i int) bool { return offsets[i] > start }); i < len(offsets) && offsets[i] < end; i++ {
+		if offsets[i] > position {
+			if _, err := io.CopyN(dst, src, offsets[i]-position); err != nil {
+				return fmt.Errorf("failed to copy data at offset %d: %w", position, err)
+			}
+			position = offsets[i]
+		}
+		if _, err := io.CopyN(io.Discard, src, blockSize); err != nil {
+			return fmt.Errorf("failed to skip noise at offset %d: %w", offsets[i], err)
+		}
+	}
+	if _, err := io.CopyN(dst, src, end-position); err != nil {
+		return fmt.Errorf("failed to copy data at offset %d: %w", position, err)
+	}
+	return nil
+}
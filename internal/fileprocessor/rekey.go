@@ -0,0 +1,271 @@
+package fileprocessor
+
+import (
+	"SE/internal/manifest"
+	"SE/internal/models"
+	"SE/internal/oauth"
+	"SE/internal/store"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Files rekeyed between progress saves of a rekey job
+const rekeyBatchSize = 50
+
+// rekeying holds the users whose rekey job is running in this process
+var (
+	rekeyingMu sync.Mutex
+	rekeying   = make(map[primitive.ObjectID]bool)
+)
+
+// RekeyFile re-wraps the file's data key with the current TOKEN_ENC_KEY, leaving its chunks
+// untouched. It reports false when the key already is wrapped with it or the file has no
+// server-wrapped key. The drive manifests get the new wrapping before the stored file does, so
+// a failure part way keeps the old one in place for a retry. The file is locked and read again
+// first, so an update can't put back the key it read before.
+func RekeyFile(ctx context.Context, file *models.StoredFile) (bool, error) {
+	unlock, err := LockFile(ctx, file.ID, "rekey")
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	current, err := store.GetStoredFile(ctx, file.ID)
+	if err != nil {
+		return false, err
+	}
+	if current == nil {
+		return false, nil
+	}
+	*file = *current
+
+	if file.Encryption == nil || file.Status == "deleted" || file.Status == "partially_deleted" {
+		return false, nil
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(file.Encryption.WrappedKey)
+	if err != nil {
+		return false, fmt.Errorf("invalid wrapped key: %w", err)
+	}
+	rewrapped, changed, err := oauth.Rewrap(wrapped)
+	if err != nil {
+		return false, fmt.Errorf("failed to rewrap data key: %w", err)
+	}
+	if !changed {
+		return false, nil
+	}
+
+	encryption := *file.Encryption
+	encryption.WrappedKey = base64.StdEncoding.EncodeToString(rewrapped)
+	updated := *file
+	updated.Encryption = &encryption
+	if err := manifest.AddFile(ctx, &updated); err != nil {
+		return false, fmt.Errorf("failed to update drive manifests: %w", err)
+	}
+	if err := store.UpdateStoredFileEncryption(ctx, file.ID, &encryption); err != nil {
+		return false, fmt.Errorf("failed to update file: %w", err)
+	}
+	file.Encryption = &encryption
+
+	rekeyKeyFile(ctx, file)
+	return true, nil
+}
+
+// rekeyKeyFile rewrites the key file still kept with the file's upload session, if any
+func rekeyKeyFile(ctx context.Context, file *models.StoredFile) {
+	session, err := store.GetUploadSession(ctx, file.SessionID)
+	if err != nil || session == nil || session.KeyFilePath == "" {
+		return
+	}
+	keyFile, err := ValidateKeyFile(session.KeyFilePath)
+	if err != nil {
+		return // Cleaned up with the session's temp files
+	}
+	keyFile.Encryption = file.Encryption
+
+	data, err := json.MarshalIndent(keyFile, "", "  ")
+	if err == nil {
+		err = os.WriteFile(session.KeyFilePath, data, 0600)
+	}
+	if err != nil {
+		log.Printf("Failed to rewrite key file of file %s: %v", file.ID.Hex(), err)
+	}
+}
+
+// rekeyDriveAccounts re-wraps the credentials of the user's drive accounts with the current
+// TOKEN_ENC_KEY, returning how many were re-wrapped and the accounts that failed
+func rekeyDriveAccounts(ctx context.Context, userID primitive.ObjectID) (int, []primitive.ObjectID, error) {
+	accounts, err := store.ListUserDriveAccounts(ctx, userID)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	rekeyed := 0
+	var failed []primitive.ObjectID
+	for _, account := range accounts {
+		token, changed, err := oauth.Rewrap(account.EncryptedToken)
+		if err != nil {
+			log.Printf("Failed to rewrap credentials of drive account %s: %v", account.ID.Hex(), err)
+			failed = append(failed, account.ID)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		// Not replaced means a token refresh saved the account under the current key meanwhile
+		replaced, err := store.ReplaceDriveAccountToken(ctx, account.ID, account.EncryptedToken, token)
+		if err != nil {
+			log.Printf("Failed to save credentials of drive account %s: %v", account.ID.Hex(), err)
+			failed = append(failed, account.ID)
+			continue
+		}
+		if replaced {
+			rekeyed++
+		}
+	}
+	return rekeyed, failed, nil
+}
+
+// StartRekeyJob re-wraps every data key and drive credential of the user with the current
+// TOKEN_ENC_KEY in the background. An unfinished job of the user resumes where it stopped
+// instead of starting over. The job as it starts is returned.
+func StartRekeyJob(userID primitive.ObjectID) (*models.RekeyJob, error) {
+	rekeyingMu.Lock()
+	defer rekeyingMu.Unlock()
+
+	ctx := context.Background()
+	job, err := store.GetLatestRekeyJob(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if job != nil && rekeying[userID] {
+		return job, nil
+	}
+
+	if job == nil || job.Status == "completed" {
+		total, err := store.CountUserKeyedFiles(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		job = &models.RekeyJob{UserID: userID, Status: "running", TotalFiles: total}
+		if err := store.CreateRekeyJob(ctx, job); err != nil {
+			return nil, err
+		}
+	} else {
+		job.Status = "running"
+		job.Error = ""
+		if err := store.SaveRekeyJob(ctx, job); err != nil {
+			return nil, err
+		}
+	}
+
+	rekeying[userID] = true
+	snapshot := *job
+	go func() {
+		defer func() {
+			rekeyingMu.Lock()
+			delete(rekeying, userID)
+			rekeyingMu.Unlock()
+		}()
+		runRekeyJob(ctx, job)
+	}()
+	return &snapshot, nil
+}
+
+// GetRekeyJob returns the user's latest rekey job, or nil. A job left running by a process that
+// stopped is reported as interrupted.
+func GetRekeyJob(ctx context.Context, userID primitive.ObjectID) (*models.RekeyJob, error) {
+	rekeyingMu.Lock()
+	defer rekeyingMu.Unlock()
+
+	job, err := store.GetLatestRekeyJob(ctx, userID)
+	if err != nil || job == nil {
+		return job, err
+	}
+	if job.Status == "running" && !rekeying[userID] {
+		job.Status = "interrupted"
+	}
+	return job, nil
+}
+
+func runRekeyJob(ctx context.Context, job *models.RekeyJob) {
+	log.Printf("Rekey job %s started for user %s", job.ID.Hex(), job.UserID.Hex())
+
+	drives, failedDrives, err := rekeyDriveAccounts(ctx, job.UserID)
+	if err != nil {
+		log.Printf("Rekey job %s failed to list drive accounts: %v", job.ID.Hex(), err)
+	}
+	job.RekeyedDrives += drives
+	job.FailedDrives = failedDrives
+
+	// Until it's re-wrapped the secret can't sign notifications once TOKEN_ENC_KEY_PREVIOUS is gone
+	if _, err := rekeyWebhookSecret(ctx, job.UserID); err != nil {
+		log.Printf("Rekey job %s failed to rewrap the webhook secret: %v", job.ID.Hex(), err)
+	}
+	// The same goes for the TOTP secret, logins would need a recovery code
+	if _, err := rekeyTwoFactorSecret(ctx, job.UserID); err != nil {
+		log.Printf("Rekey job %s failed to rewrap the TOTP secret: %v", job.ID.Hex(), err)
+	}
+
+	for {
+		files, err := store.ListUserKeyedFilesAfter(ctx, job.UserID, job.LastFileID, rekeyBatchSize)
+		if err != nil {
+			log.Printf("Rekey job %s failed to list files: %v", job.ID.Hex(), err)
+			job.Status = "failed"
+			job.Error = err.Error()
+			saveRekeyJob(ctx, job)
+			return
+		}
+		if len(files) == 0 {
+			break
+		}
+
+		for i := range files {
+			changed, err := RekeyFile(ctx, &files[i])
+			if err != nil {
+				log.Printf("Rekey job %s failed on file %s: %v", job.ID.Hex(), files[i].ID.Hex(), err)
+				job.FailedFiles = append(job.FailedFiles, files[i].ID)
+			} else if changed {
+				job.RekeyedFiles++
+			}
+			job.CheckedFiles++
+			job.LastFileID = files[i].ID
+		}
+		saveRekeyJob(ctx, job)
+	}
+
+	now := time.Now().UTC()
+	job.Status = "completed"
+	job.CompletedAt = &now
+	saveRekeyJob(ctx, job)
+	log.Printf("Rekey job %s completed: %d of %d files rekeyed, %d failed, %d drive accounts rekeyed",
+		job.ID.Hex(), job.RekeyedFiles, job.CheckedFiles, len(job.FailedFiles), job.RekeyedDrives)
+}
+
+// rekeyTwoFactorSecret re-wraps the user's TOTP secret with the current TOKEN_ENC_KEY, reporting
+// whether it had to
+func rekeyTwoFactorSecret(ctx context.Context, userID primitive.ObjectID) (bool, error) {
+	user, err := store.FindUserByID(ctx, userID)
+	if err != nil || user == nil || user.TwoFactor == nil {
+		return false, err
+	}
+	secret, changed, err := oauth.Rewrap(user.TwoFactor.Secret)
+	if err != nil || !changed {
+		return false, err
+	}
+	// Not replaced means two-factor authentication was set up again or disabled meanwhile
+	return store.ReplaceTwoFactorSecret(ctx, userID, user.TwoFactor.Secret, secret)
+}
+
+func saveRekeyJob(ctx context.Context, job *models.RekeyJob) {
+	if err := store.SaveRekeyJob(ctx, job); err != nil {
+		log.Printf("Failed to save progress of rekey job %s: %v", job.ID.Hex(), err)
+	}
+}
@@ -0,0 +1,219 @@
+package fileprocessor
+
+import (
+	"SE/internal/metrics"
+	"SE/internal/models"
+	"SE/internal/netguard"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrRemoteNotAllowed is returned for remote URLs an upload may not be pulled from
+var ErrRemoteNotAllowed = errors.New("remote url not allowed")
+
+// Hosts uploads may be pulled from, set by initRemoteConfig
+var (
+	remoteAllowedHosts []string // Empty allows every host not denied
+	remoteDeniedHosts  []string
+	remoteMaxBytes     int64
+)
+
+// Headers a client can't set on the request to the remote host
+var remoteForbiddenHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+	"Te":                true,
+	"Upgrade":           true,
+}
+
+// remoteClient only dials public addresses and checks every redirect against the host lists
+var remoteClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: nil, // A proxy would dial on our behalf and bypass the address check
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: checkRemoteAddr,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		DisableCompression:    true, // Content-Length has to be the size of the file itself
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return fmt.Errorf("%w: too many redirects", ErrRemoteNotAllowed)
+		}
+		return checkRemoteURL(req.URL)
+	},
+}
+
+// initRemoteConfig reads URL_UPLOAD_ALLOWED_HOSTS and URL_UPLOAD_DENIED_HOSTS (comma separated,
+// an entry also matches its subdomains) and URL_UPLOAD_MAX_SIZE_GB, which defaults to MAX_FILE_SIZE_GB
+func initRemoteConfig() {
+	remoteAllowedHosts = splitHosts(os.Getenv("URL_UPLOAD_ALLOWED_HOSTS"))
+	remoteDeniedHosts = splitHosts(os.Getenv("URL_UPLOAD_DENIED_HOSTS"))
+
+	maxGB, _ := strconv.ParseInt(os.Getenv("URL_UPLOAD_MAX_SIZE_GB"), 10, 64)
+	remoteMaxBytes = maxGB * 1024 * 1024 * 1024
+	if maxGB <= 0 || remoteMaxBytes > maxFileSizeBytes {
+		remoteMaxBytes = maxFileSizeBytes
+	}
+}
+
+func splitHosts(list string) []string {
+	hosts := make([]string, 0)
+	for _, h := range strings.Split(list, ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// GetRemoteMaxSize returns the largest file an upload can pull from a URL
+func GetRemoteMaxSize() int64 {
+	return remoteMaxBytes
+}
+
+func hostListed(host string, list []string) bool {
+	for _, entry := range list {
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRemoteURL checks the scheme and host of a URL against the host lists
+func checkRemoteURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme must be http or https", ErrRemoteNotAllowed)
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return fmt.Errorf("%w: missing host", ErrRemoteNotAllowed)
+	}
+	if hostListed(host, remoteDeniedHosts) {
+		return fmt.Errorf("%w: host %s is denied", ErrRemoteNotAllowed, host)
+	}
+	if len(remoteAllowedHosts) > 0 && !hostListed(host, remoteAllowedHosts) {
+		return fmt.Errorf("%w: host %s is not allowed", ErrRemoteNotAllowed, host)
+	}
+	return nil
+}
+
+// checkRemoteAddr refuses connections to addresses that aren't public, see netguard.CheckAddr
+func checkRemoteAddr(network, address string, c syscall.RawConn) error {
+	if err := netguard.CheckAddr(network, address, c); err != nil {
+		return fmt.Errorf("%w: %v", ErrRemoteNotAllowed, err)
+	}
+	return nil
+}
+
+// OpenRemoteFile starts downloading the file at rawURL with the given extra headers. The
+// response is only returned for a 200 that reports its size, the caller closes its body.
+func OpenRemoteFile(ctx context.Context, rawURL string, headers map[string]string) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRemoteNotAllowed, err)
+	}
+	if err := checkRemoteURL(u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		if remoteForbiddenHeaders[http.CanonicalHeaderKey(name)] {
+			return nil, fmt.Errorf("%w: header %s can't be set", ErrRemoteNotAllowed, name)
+		}
+		req.Header.Set(name, value)
+	}
+
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		// The address check fails inside the dialer, keep it recognizable
+		if errors.Is(err, ErrRemoteNotAllowed) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to fetch remote file: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("remote server returned status %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// SniffRemoteContentType peeks at the start of a remote file for its content type, the
+// returned reader still yields the whole file
+func SniffRemoteContentType(body io.Reader, filename string) (string, io.Reader) {
+	buffered := bufio.NewReaderSize(body, 512)
+	head, _ := buffered.Peek(512)
+	return DetectContentType(head, filename), buffered
+}
+
+// FetchRemoteFile writes a remote file into the session's temp file, recording progress as
+// each upload chunk is completed so the status endpoint reports it like a client upload
+func FetchRemoteFile(ctx context.Context, session *models.UploadSession, body io.Reader) error {
+	tempFile, err := os.Create(session.TempFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer tempFile.Close()
+
+	progress := &remoteProgress{ctx: ctx, session: session, chunkSize: uploadChunkSize(session)}
+	// Reading one byte past the size catches remote servers sending more than they announced
+	written, err := io.Copy(io.MultiWriter(tempFile, progress), io.LimitReader(body, session.TotalSize+1))
+	metrics.UploadBytes.Add(float64(written))
+	if err != nil {
+		return fmt.Errorf("failed to download remote file: %w", err)
+	}
+	if written != session.TotalSize {
+		return fmt.Errorf("remote file was %d bytes, expected %d", written, session.TotalSize)
+	}
+	return nil
+}
+
+// remoteProgress records the upload chunks a remote download has completed
+type remoteProgress struct {
+	ctx       context.Context
+	session   *models.UploadSession
+	chunkSize int64
+	written   int64
+	reported  int64 // Start of the first chunk not yet recorded, always chunk aligned
+}
+
+func (p *remoteProgress) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	if p.written-p.reported >= p.chunkSize || p.written >= p.session.TotalSize {
+		p.report()
+	}
+	return len(b), nil
+}
+
+func (p *remoteProgress) report() {
+	indexes := CoveredChunkIndexes(p.session, p.reported, p.written-p.reported)
+	if err := MarkChunksReceived(p.ctx, p.session, indexes); err != nil {
+		log.Printf("Failed to record received chunks: %v", err)
+	}
+	if err := UpdateSessionProgress(p.ctx, p.session.ID, p.written); err != nil {
+		log.Printf("Failed to update session progress: %v", err)
+	}
+	p.reported = (p.written / p.chunkSize) * p.chunkSize
+}
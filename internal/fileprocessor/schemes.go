@@ -0,0 +1,163 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+)
+
+// Registered obfuscation schemes
+const (
+	ObfuscationSchemeNone = "none"        // Sequential chunk names and order, for debugging
+	ObfuscationSchemeHMAC = "hmac-sha256" // Names and order derived from the seed with HMAC-SHA256
+)
+
+// ObfuscationScheme derives what an outsider sees of a file's chunks from its obfuscation seed:
+// the name each chunk is stored under and the order the chunks are uploaded and fetched in.
+// Both have to be reproducible from the seed alone, so a scheme must never change once files
+// use it; add a new scheme instead.
+type ObfuscationScheme interface {
+	ChunkFilename(seed []byte, chunkID int) string
+	// ChunkOrder returns chunkIDs in the order they are transferred
+	ChunkOrder(seed []byte, chunkIDs []int) []int
+}
+
+var defaultObfuscationScheme string
+
+// Namespace put before the name of every new chunk, recorded with each file so its chunks keep
+// their names when it changes
+var chunkNamePrefix string
+
+var chunkNamePrefixPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{0,32}$`)
+
+func init() {
+	defaultObfuscationScheme = os.Getenv("OBFUSCATION_SCHEME")
+	if defaultObfuscationScheme == "" {
+		defaultObfuscationScheme = ObfuscationSchemeHMAC
+	}
+	if _, err := GetObfuscationScheme(defaultObfuscationScheme); err != nil {
+		log.Printf("Invalid OBFUSCATION_SCHEME %q, using %s", defaultObfuscationScheme, ObfuscationSchemeHMAC)
+		defaultObfuscationScheme = ObfuscationSchemeHMAC
+	}
+}
+
+func initChunkNameConfig() {
+	chunkNamePrefix = os.Getenv("CHUNK_NAME_PREFIX")
+	if !chunkNamePrefixPattern.MatchString(chunkNamePrefix) {
+		log.Fatalf("CHUNK_NAME_PREFIX %q must be at most 32 letters, digits, '.', '_' or '-'", chunkNamePrefix)
+	}
+}
+
+// GetObfuscationScheme returns the scheme registered for name. Files stored before schemes
+// were recorded have no name and used sequential names, which is what the none scheme gives.
+func GetObfuscationScheme(name string) (ObfuscationScheme, error) {
+	switch name {
+	case ObfuscationSchemeNone, "":
+		return noneScheme{}, nil
+	case ObfuscationSchemeHMAC:
+		return hmacScheme{}, nil
+	default:
+		return nil, fmt.Errorf("unknown obfuscation scheme %q", name)
+	}
+}
+
+// SchemeForFile returns the obfuscation scheme of a file and its decoded seed
+func SchemeForFile(metadata *models.ObfuscationMetadata) (ObfuscationScheme, []byte, error) {
+	scheme, err := GetObfuscationScheme(metadata.Scheme)
+	if err != nil {
+		return nil, nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(metadata.Seed)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid obfuscation seed: %w", err)
+	}
+	return scheme, seed, nil
+}
+
+// ChunkName returns the name chunkID of the file is stored under: the file's name prefix and
+// the name its scheme derives from the seed
+func ChunkName(scheme ObfuscationScheme, seed []byte, metadata *models.ObfuscationMetadata, chunkID int) string {
+	return metadata.NamePrefix + scheme.ChunkFilename(seed, chunkID)
+}
+
+// DeriveObfuscationKey derives the key for one use of the seed, so chunk names and chunk order
+// don't reuse the noise keystream's key. The key is HMAC-SHA256 over "2xpfm/<purpose>" keyed
+// with the seed.
+func DeriveObfuscationKey(seed []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, seed)
+	mac.Write([]byte("2xpfm/" + purpose))
+	return mac.Sum(nil)
+}
+
+// noneScheme keeps the chunk_NNN names and chunk-id order
+type noneScheme struct{}
+
+func (noneScheme) ChunkFilename(seed []byte, chunkID int) string {
+	return fmt.Sprintf("chunk_%03d.2xpfm", chunkID)
+}
+
+func (noneScheme) ChunkOrder(seed []byte, chunkIDs []int) []int {
+	order := append([]int(nil), chunkIDs...)
+	sort.Ints(order)
+	return order
+}
+
+// hmacScheme names a chunk after the HMAC of its id and orders chunks by another HMAC of
+// their ids, so neither names nor upload times give away a chunk's position in the file
+type hmacScheme struct{}
+
+func (hmacScheme) ChunkFilename(seed []byte, chunkID int) string {
+	return hex.EncodeToString(chunkMAC(DeriveObfuscationKey(seed, "chunk-name"), chunkID)[:16]) + ".2xpfm"
+}
+
+func (hmacScheme) ChunkOrder(seed []byte, chunkIDs []int) []int {
+	key := DeriveObfuscationKey(seed, "chunk-order")
+	ranks := make(map[int]string, len(chunkIDs))
+	for _, id := range chunkIDs {
+		ranks[id] = string(chunkMAC(key, id))
+	}
+	order := append([]int(nil), chunkIDs...)
+	sort.Slice(order, func(i, j int) bool {
+		return ranks[order[i]] < ranks[order[j]]
+	})
+	return order
+}
+
+func chunkMAC(key []byte, chunkID int) []byte {
+	var id [8]byte
+	binary.BigEndian.PutUint64(id[:], uint64(chunkID))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(id[:])
+	return mac.Sum(nil)
+}
+
+// ApplyObfuscationScheme names every assigned chunk with the scheme and returns the indexes
+// of assignments in the order they should be uploaded
+func ApplyObfuscationScheme(assignments []models.ChunkAssignment, metadata *models.ObfuscationMetadata) ([]int, error) {
+	scheme, seed, err := SchemeForFile(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[int]int, len(assignments))
+	ids := make([]int, len(assignments))
+	for i := range assignments {
+		assignments[i].Filename = ChunkName(scheme, seed, metadata, assignments[i].ChunkID)
+		index[assignments[i].ChunkID] = i
+		ids[i] = assignments[i].ChunkID
+	}
+
+	order := make([]int, 0, len(ids))
+	for _, id := range scheme.ChunkOrder(seed, ids) {
+		order = append(order, index[id])
+	}
+	return order, nil
+}
@@ -1,14 +1,22 @@
 package fileprocessor
 
 import (
+	"SE/internal/drivemanager"
+	"SE/internal/middleware"
 	"SE/internal/models"
+	"SE/internal/oauth"
 	"SE/internal/store"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -16,10 +24,24 @@ import (
 
 var (
 	uploadTempDir           string
+	downloadTempDir         string
+	downloadDiskReserve     int64
 	maxFileSizeBytes        int64
+	maxChunks               int
 	sessionExpiryDuration   time.Duration
 	maxConcurrentPerUser    int
 	tempFileCleanupDuration time.Duration
+	downloadExpiryDuration  time.Duration
+	downloadStreamMaxBytes  int64
+	defaultUploadChunkSize  int64
+	defaultQuotaBytes       int64
+	replicationFactor       int
+	sessionSweepInterval    time.Duration
+	trashRetention          time.Duration
+	shareLinkMaxTTL         time.Duration
+	checksumAlgo            string
+	idempotencyKeyTTL       time.Duration
+	contentChunkSize        int64
 )
 
 func InitFileConfig() {
@@ -32,6 +54,29 @@ func InitFileConfig() {
 	// Create directory if not exists
 	os.MkdirAll(uploadTempDir, 0755)
 
+	// Downloads are reconstructed in their own directory, e.g. on a bigger disk
+	downloadTempDir = os.Getenv("DOWNLOAD_TEMP_DIR")
+	if downloadTempDir == "" {
+		downloadTempDir = uploadTempDir
+	}
+	os.MkdirAll(downloadTempDir, 0755)
+
+	// Free disk space a reconstruction must leave, so downloads can't starve uploads
+	reserveMB, _ := strconv.ParseInt(os.Getenv("DOWNLOAD_DISK_RESERVE_MB"), 10, 64)
+	if reserveMB <= 0 {
+		reserveMB = 512
+	}
+	downloadDiskReserve = reserveMB * 1024 * 1024
+
+	// Disk cache of the chunks downloads fetched, off unless CHUNK_CACHE_MB is set
+	chunkCacheMB, _ := strconv.ParseInt(os.Getenv("CHUNK_CACHE_MB"), 10, 64)
+	chunkCacheMax = max(chunkCacheMB, 0) * 1024 * 1024
+	chunkCacheDir = os.Getenv("CHUNK_CACHE_DIR")
+	if chunkCacheDir == "" {
+		chunkCacheDir = filepath.Join(downloadTempDir, "chunk-cache")
+	}
+	initChunkCache()
+
 	// Max file size, Can be configured in env
 	maxGB, _ := strconv.ParseInt(os.Getenv("MAX_FILE_SIZE_GB"), 10, 64)
 	if maxGB == 0 {
@@ -39,6 +84,12 @@ func InitFileConfig() {
 	}
 	maxFileSizeBytes = maxGB * 1024 * 1024 * 1024
 
+	// Most chunks a file may be uploaded or stored in, each one is a manifest entry and a drive file
+	maxChunks, _ = strconv.Atoi(os.Getenv("MAX_CHUNKS"))
+	if maxChunks <= 0 {
+		maxChunks = 20000
+	}
+
 	// Timeout for session, essential to kill uploads.
 	expiryHours, _ := strconv.Atoi(os.Getenv("SESSION_EXPIRY_HOURS"))
 	if expiryHours == 0 {
@@ -58,6 +109,169 @@ func InitFileConfig() {
 		cleanupMins = 10
 	}
 	tempFileCleanupDuration = time.Duration(cleanupMins) * time.Minute
+
+	// How long deleted files stay in the trash, restorable, before their chunks are deleted
+	trashDays, _ := strconv.Atoi(os.Getenv("TRASH_RETENTION_DAYS"))
+	if trashDays <= 0 {
+		trashDays = 30
+	}
+	trashRetention = time.Duration(trashDays) * 24 * time.Hour
+
+	// How long a reconstructed download is kept around for resumed/range requests
+	downloadExpiryMins, _ := strconv.Atoi(os.Getenv("DOWNLOAD_EXPIRY_MINUTES"))
+	if downloadExpiryMins == 0 {
+		downloadExpiryMins = 30
+	}
+	downloadExpiryDuration = time.Duration(downloadExpiryMins) * time.Minute
+
+	// Files up to this size are streamed to the client as they are fetched instead of being
+	// reconstructed on disk first, 0 always reconstructs on disk
+	streamMB, err := strconv.ParseInt(os.Getenv("DOWNLOAD_STREAM_MAX_MB"), 10, 64)
+	if err != nil || streamMB < 0 {
+		streamMB = 64
+	}
+	downloadStreamMaxBytes = streamMB * 1024 * 1024
+
+	// Download files are encrypted on disk with a key kept in memory, turned off to inspect them
+	if v := os.Getenv("DOWNLOAD_ENCRYPT_TEMP_FILES"); v != "" {
+		encrypt, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("DOWNLOAD_ENCRYPT_TEMP_FILES must be true or false, got %q", v)
+		}
+		encryptDownloadFiles = encrypt
+	}
+
+	// Default size of the chunks a client uploads, used to track which ones arrived
+	chunkSizeMB, _ := strconv.ParseInt(os.Getenv("UPLOAD_CHUNK_SIZE_MB"), 10, 64)
+	if chunkSizeMB == 0 {
+		chunkSizeMB = 10
+	}
+	defaultUploadChunkSize = chunkSizeMB * 1024 * 1024
+
+	// Storage quota for users without a per-user override
+	quotaGB, _ := strconv.ParseInt(os.Getenv("DEFAULT_QUOTA_GB"), 10, 64)
+	if quotaGB == 0 {
+		quotaGB = 100
+	}
+	defaultQuotaBytes = quotaGB * 1024 * 1024 * 1024
+
+	// How often abandoned upload sessions are swept
+	sweepMins, _ := strconv.Atoi(os.Getenv("SESSION_SWEEP_INTERVAL_MINUTES"))
+	if sweepMins == 0 {
+		sweepMins = 10
+	}
+	sessionSweepInterval = time.Duration(sweepMins) * time.Minute
+
+	// Number of drives each chunk is copied to, 1 keeps a single copy
+	replicationFactor, _ = strconv.Atoi(os.Getenv("CHUNK_REPLICAS"))
+	if replicationFactor <= 0 {
+		replicationFactor = 1
+	}
+
+	// Longest lifetime a share link can be given
+	shareMaxHours, _ := strconv.Atoi(os.Getenv("SHARE_LINK_MAX_HOURS"))
+	if shareMaxHours == 0 {
+		shareMaxHours = 7 * 24 // 7 days
+	}
+	shareLinkMaxTTL = time.Duration(shareMaxHours) * time.Hour
+
+	// Algorithm new chunks are checksummed with, existing chunks keep the one they recorded
+	checksumAlgo = os.Getenv("CHECKSUM_ALGO")
+	if checksumAlgo == "" {
+		checksumAlgo = models.ChecksumSHA256
+	}
+	if _, err := NewHash(checksumAlgo); err != nil {
+		log.Fatalf("CHECKSUM_ALGO: %v", err)
+	}
+
+	// How long an Idempotency-Key of an initiate request is remembered
+	idempotencyHours, _ := strconv.Atoi(os.Getenv("IDEMPOTENCY_KEY_HOURS"))
+	if idempotencyHours == 0 {
+		idempotencyHours = 24
+	}
+	idempotencyKeyTTL = time.Duration(idempotencyHours) * time.Hour
+
+	// How long /api/account/stats answers from the cache, 0 computes every request
+	storageStatsTTL = 60 * time.Second
+	if v := os.Getenv("STORAGE_STATS_CACHE_SECONDS"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs < 0 {
+			log.Fatalf("STORAGE_STATS_CACHE_SECONDS must be a non-negative number, got %q", v)
+		}
+		storageStatsTTL = time.Duration(secs) * time.Second
+	}
+
+	// File locks: how long one lasts unless renewed, and how long an operation waits for one
+	fileLockTTL = 60 * time.Second
+	if v := os.Getenv("FILE_LOCK_TTL_SECONDS"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs < 3 {
+			log.Fatalf("FILE_LOCK_TTL_SECONDS must be a number of at least 3, got %q", v)
+		}
+		fileLockTTL = time.Duration(secs) * time.Second
+	}
+	fileLockWait = 5 * time.Second
+	if v := os.Getenv("FILE_LOCK_WAIT_SECONDS"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs < 0 {
+			log.Fatalf("FILE_LOCK_WAIT_SECONDS must be a non-negative number, got %q", v)
+		}
+		fileLockWait = time.Duration(secs) * time.Second
+	}
+
+	// Average chunk of content-defined chunking, chunks range from a quarter to four times it
+	contentChunkMB, _ := strconv.ParseInt(os.Getenv("CONTENT_CHUNK_SIZE_MB"), 10, 64)
+	if contentChunkMB <= 0 {
+		contentChunkMB = 4
+	}
+	contentChunkSize = contentChunkMB * 1024 * 1024
+
+	// Hosts and size limit of uploads pulled from a URL
+	initRemoteConfig()
+
+	// Retries of webhook notifications
+	initWebhookConfig()
+
+	// Size of image thumbnails
+	initThumbnailConfig()
+
+	// Namespace of chunk names
+	initChunkNameConfig()
+
+	// Shards of erasure-coded chunks
+	initErasureConfig()
+
+	// Retries of failed uploads
+	initUploadRetryConfig()
+
+	// Time to finalize once every chunk is received
+	initFinalizeTimeoutConfig()
+}
+
+// GetReplicationFactor returns how many drives should hold a copy of every chunk
+func GetReplicationFactor() int {
+	return replicationFactor
+}
+
+// GetShareLinkMaxTTL returns the longest lifetime a share link can be given
+func GetShareLinkMaxTTL() time.Duration {
+	return shareLinkMaxTTL
+}
+
+// GetIdempotencyKeyTTL returns how long an initiate request's Idempotency-Key is remembered
+func GetIdempotencyKeyTTL() time.Duration {
+	return idempotencyKeyTTL
+}
+
+// GetDownloadStreamMax returns the size up to which downloads are streamed without being
+// reconstructed on disk
+func GetDownloadStreamMax() int64 {
+	return downloadStreamMaxBytes
+}
+
+// GetUploadTempDir returns the directory temp files are written to
+func GetUploadTempDir() string {
+	return uploadTempDir
 }
 
 // You fucking java users thats how it is meant to be done. Learn from below.
@@ -65,35 +279,92 @@ func GetMaxFileSize() int64 {
 	return maxFileSizeBytes
 }
 
-func CreateUploadSession(ctx context.Context, userID primitive.ObjectID, filename string, totalSize int64) (*models.UploadSession, error) {
-	// Check file size limit
+// GetMaxChunks returns the most chunks a file may be uploaded or stored in
+func GetMaxChunks() int {
+	return maxChunks
+}
+
+// ErrFileTooLarge and ErrTooManyChunks are returned for files past MAX_FILE_SIZE_GB and MAX_CHUNKS
+var (
+	ErrFileTooLarge  = errors.New("file too large")
+	ErrTooManyChunks = errors.New("too many chunks")
+)
+
+// CheckFilename rejects filenames that aren't a single path segment. They're only ever a name
+// to download the file as, but shouldn't pass for a path anywhere.
+func CheckFilename(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("invalid filename %q", name)
+	}
+	if strings.ContainsAny(name, "/\\\x00") {
+		return fmt.Errorf("filename %q must not contain path separators", name)
+	}
+	return nil
+}
+
+// CheckFileSize enforces the file size limit
+func CheckFileSize(totalSize int64) error {
 	if totalSize > maxFileSizeBytes {
-		return nil, fmt.Errorf("file size %d exceeds maximum allowed %d bytes", totalSize, maxFileSizeBytes)
+		return fmt.Errorf("%w: file size %d exceeds maximum allowed %d bytes", ErrFileTooLarge, totalSize, maxFileSizeBytes)
 	}
+	return nil
+}
 
-	// Check concurrent uploads
-	activeSessions, err := store.CountActiveUserSessions(ctx, userID)
-	if err != nil {
+// CheckChunkCount enforces the chunk count limit on a file of n chunks
+func CheckChunkCount(n int) error {
+	if n > maxChunks {
+		return fmt.Errorf("%w: %d chunks exceed the maximum of %d, use bigger chunks", ErrTooManyChunks, n, maxChunks)
+	}
+	return nil
+}
+
+// ChunkCountWarning returns a warning for a file of n chunks close to the chunk count limit,
+// empty when it isn't
+func ChunkCountWarning(n int) string {
+	if n <= maxChunks && n*5 >= maxChunks*4 {
+		return fmt.Sprintf("%d chunks are close to the maximum of %d", n, maxChunks)
+	}
+	return ""
+}
+
+// CheckUploadLimits enforces the file size limit and the chunk count limit on the client chunks
+// of an upload of totalSize bytes sent chunkSize bytes at a time, 0 meaning the default
+func CheckUploadLimits(totalSize, chunkSize int64) error {
+	if err := CheckFileSize(totalSize); err != nil {
+		return err
+	}
+	return CheckChunkCount(TotalUploadChunks(&models.UploadSession{TotalSize: totalSize, ChunkSize: chunkSize}))
+}
+
+func CreateUploadSession(ctx context.Context, userID primitive.ObjectID, filename string, totalSize int64, chunkSize int64, compress bool, clientEncryption *models.ClientEncryptionMetadata, tags []string) (*models.UploadSession, error) {
+	if err := CheckSessionAllowed(ctx, userID, totalSize, chunkSize); err != nil {
 		return nil, err
 	}
-	if activeSessions >= maxConcurrentPerUser {
-		return nil, fmt.Errorf("maximum concurrent uploads (%d) reached", maxConcurrentPerUser)
+
+	if chunkSize <= 0 {
+		chunkSize = defaultUploadChunkSize
 	}
 
 	// Create temp file path
 	sessionID := primitive.NewObjectID()
-	tempPath := filepath.Join(uploadTempDir, fmt.Sprintf("%s_%s", sessionID.Hex(), filename))
+	tempPath := GetTempFilePath(sessionID)
 
 	session := &models.UploadSession{
 		ID:               sessionID,
 		UserID:           userID,
 		OriginalFilename: filename,
+		ContentType:      ContentTypeFromFilename(filename),
 		TempFilePath:     tempPath,
 		TotalSize:        totalSize,
 		UploadedSize:     0,
+		ChunkSize:        chunkSize,
+		ReceivedChunks:   []int{},
 		Status:           "uploading",
 		CreatedAt:        time.Now(),
 		ExpiresAt:        time.Now().Add(sessionExpiryDuration),
+		Compress:         compress,
+		ClientEncryption: clientEncryption,
+		Tags:             tags,
 	}
 
 	if err := store.CreateUploadSession(ctx, session); err != nil {
@@ -103,6 +374,24 @@ func CreateUploadSession(ctx context.Context, userID primitive.ObjectID, filenam
 	return session, nil
 }
 
+// CheckSessionAllowed enforces the upload limits and the user's concurrent upload limit on a
+// new session of totalSize bytes
+func CheckSessionAllowed(ctx context.Context, userID primitive.ObjectID, totalSize, chunkSize int64) error {
+	if err := CheckUploadLimits(totalSize, chunkSize); err != nil {
+		return err
+	}
+
+	// Check concurrent uploads
+	activeSessions, err := store.CountActiveUserSessions(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if activeSessions >= maxConcurrentPerUser {
+		return fmt.Errorf("maximum concurrent uploads (%d) reached", maxConcurrentPerUser)
+	}
+	return nil
+}
+
 func GetSession(ctx context.Context, sessionID primitive.ObjectID, userID primitive.ObjectID) (*models.UploadSession, error) {
 	session, err := store.GetUploadSession(ctx, sessionID)
 	if err != nil {
@@ -121,11 +410,308 @@ func GetSession(ctx context.Context, sessionID primitive.ObjectID, userID primit
 }
 
 func UpdateSessionProgress(ctx context.Context, sessionID primitive.ObjectID, uploadedSize int64) error {
-	return store.UpdateSessionUploadProgress(ctx, sessionID, uploadedSize)
+	if err := store.UpdateSessionUploadProgress(ctx, sessionID, uploadedSize); err != nil {
+		return err
+	}
+	PublishSessionEvent(sessionID, SessionEvent{Type: "upload", Status: "uploading", UploadedBytes: uploadedSize})
+	return nil
+}
+
+// uploadChunkSize returns the session's chunk size, falling back to the default for older sessions
+func uploadChunkSize(session *models.UploadSession) int64 {
+	if session.ChunkSize > 0 {
+		return session.ChunkSize
+	}
+	return defaultUploadChunkSize
+}
+
+// TotalUploadChunks returns how many client chunks make up the session's file
+func TotalUploadChunks(session *models.UploadSession) int {
+	chunkSize := uploadChunkSize(session)
+	return int((session.TotalSize + chunkSize - 1) / chunkSize)
+}
+
+// Room a multipart chunk upload gets for its boundary and part headers
+const multipartOverhead = 64 << 10
+
+// ChunkBodyLimit returns the largest body a chunk upload of the session may send: one upload
+// chunk, plus the framing around it when it is sent as a multipart form
+func ChunkBodyLimit(session *models.UploadSession, multipart bool) int64 {
+	limit := uploadChunkSize(session)
+	if multipart {
+		limit += multipartOverhead
+	}
+	return limit
+}
+
+// CoveredChunkIndexes returns the indexes of the chunks fully covered by a write of length bytes at offset.
+// Chunk i spans [i*chunk_size, (i+1)*chunk_size), the last one is cut short at the file size.
+func CoveredChunkIndexes(session *models.UploadSession, offset, length int64) []int {
+	chunkSize := uploadChunkSize(session)
+	end := offset + length
+	if end > session.TotalSize {
+		end = session.TotalSize
+	}
+
+	indexes := make([]int, 0)
+	first := (offset + chunkSize - 1) / chunkSize // First chunk starting at or after offset
+	for i := first; i*chunkSize < end; i++ {
+		chunkEnd := (i + 1) * chunkSize
+		if chunkEnd > session.TotalSize {
+			chunkEnd = session.TotalSize
+		}
+		if chunkEnd > end {
+			break
+		}
+		indexes = append(indexes, int(i))
+	}
+	return indexes
+}
+
+// UploadChunkRange returns the byte range [start, end) of the session's chunk index
+func UploadChunkRange(session *models.UploadSession, index int) (int64, int64) {
+	chunkSize := uploadChunkSize(session)
+	start := int64(index) * chunkSize
+	return start, min(start+chunkSize, session.TotalSize)
+}
+
+// ErrChunkRangeMismatch is returned for a chunk whose Content-Range isn't the range the
+// session's chunk size gives its index
+var ErrChunkRangeMismatch = errors.New("chunk range mismatch")
+
+// CheckChunkRange checks contentRange, "bytes first-last/total", declares exactly the bytes of
+// the session's chunk index
+func CheckChunkRange(session *models.UploadSession, index int, contentRange string) error {
+	start, end := UploadChunkRange(session, index)
+	expected := fmt.Sprintf("bytes %d-%d/%d", start, end-1, session.TotalSize)
+	if contentRange == "" {
+		return fmt.Errorf("%w: Content-Range required, chunk %d is %s", ErrChunkRangeMismatch, index, expected)
+	}
+	var first, last, total int64
+	n, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &first, &last, &total)
+	if err != nil || n != 3 || fmt.Sprintf("bytes %d-%d/%d", first, last, total) != contentRange {
+		return fmt.Errorf("%w: invalid Content-Range %q", ErrChunkRangeMismatch, contentRange)
+	}
+	if first != start || last != end-1 || total != session.TotalSize {
+		return fmt.Errorf("%w: chunk %d is %s, not %s", ErrChunkRangeMismatch, index, expected, contentRange)
+	}
+	return nil
+}
+
+type chunkKey struct {
+	sessionID primitive.ObjectID
+	index     int
+}
+
+// receivingChunks holds the upload chunks a request of this process is writing
+var (
+	receivingChunksMu sync.Mutex
+	receivingChunks   = make(map[chunkKey]bool)
+)
+
+// BeginChunk claims the session's chunk for a request writing it, reporting false when another
+// request already is. Call the returned func once the write ends.
+func BeginChunk(sessionID primitive.ObjectID, index int) (func(), bool) {
+	key := chunkKey{sessionID, index}
+	receivingChunksMu.Lock()
+	defer receivingChunksMu.Unlock()
+	if receivingChunks[key] {
+		return nil, false
+	}
+	receivingChunks[key] = true
+
+	return func() {
+		receivingChunksMu.Lock()
+		delete(receivingChunks, key)
+		receivingChunksMu.Unlock()
+	}, true
+}
+
+// MissingChunks returns the indexes of chunks not yet received, in order
+func MissingChunks(session *models.UploadSession) []int {
+	received := make(map[int]bool, len(session.ReceivedChunks))
+	for _, idx := range session.ReceivedChunks {
+		received[idx] = true
+	}
+
+	missing := make([]int, 0)
+	for i := 0; i < TotalUploadChunks(session); i++ {
+		if !received[i] {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// UploadDiscrepancy is a value of a session about to be finalized that doesn't match another
+type UploadDiscrepancy struct {
+	Field    string `json:"field"`
+	Declared int64  `json:"declared"` // What the finalize request, or else the session, declared
+	Actual   int64  `json:"actual"`
+	Message  string `json:"message"`
+}
+
+// CheckFinalize compares what a finalize request declared with the session, and the session's
+// total size with the chunks it received and the bytes in its temp file. declaredSize and
+// declaredChunks of 0 weren't declared and aren't compared.
+func CheckFinalize(session *models.UploadSession, declaredSize int64, declaredChunks int) ([]UploadDiscrepancy, error) {
+	discrepancies := make([]UploadDiscrepancy, 0)
+	if declaredSize != 0 && declaredSize != session.TotalSize {
+		discrepancies = append(discrepancies, UploadDiscrepancy{
+			Field: "total_size", Declared: declaredSize, Actual: session.TotalSize,
+			Message: fmt.Sprintf("declared %d bytes, the session was initiated with %d", declaredSize, session.TotalSize),
+		})
+	}
+	totalChunks := TotalUploadChunks(session)
+	if declaredChunks != 0 && declaredChunks != totalChunks {
+		discrepancies = append(discrepancies, UploadDiscrepancy{
+			Field: "chunk_count", Declared: int64(declaredChunks), Actual: int64(totalChunks),
+			Message: fmt.Sprintf("declared %d chunks, the session has %d of %d bytes", declaredChunks, totalChunks, uploadChunkSize(session)),
+		})
+	}
+
+	// A chunk recorded twice, or past the end of the file, doesn't add to it
+	var received int64
+	seen := make(map[int]bool, len(session.ReceivedChunks))
+	for _, idx := range session.ReceivedChunks {
+		if seen[idx] || idx < 0 || idx >= totalChunks {
+			continue
+		}
+		seen[idx] = true
+		start, end := UploadChunkRange(session, idx)
+		received += end - start
+	}
+	if received != session.TotalSize {
+		discrepancies = append(discrepancies, UploadDiscrepancy{
+			Field: "received_size", Declared: session.TotalSize, Actual: received,
+			Message: fmt.Sprintf("received chunks hold %d of the %d bytes", received, session.TotalSize),
+		})
+	}
+
+	var written int64
+	info, err := os.Stat(session.TempFilePath)
+	switch {
+	case err == nil:
+		written = info.Size()
+	case !os.IsNotExist(err):
+		return nil, fmt.Errorf("failed to stat temp file: %w", err)
+	}
+	if written != session.TotalSize {
+		discrepancies = append(discrepancies, UploadDiscrepancy{
+			Field: "temp_file_size", Declared: session.TotalSize, Actual: written,
+			Message: fmt.Sprintf("%d bytes were written of the %d byte file", written, session.TotalSize),
+		})
+	}
+	return discrepancies, nil
+}
+
+// Errors for a client chunk that doesn't match what the client declared
+var (
+	ErrChunkSizeMismatch     = errors.New("chunk size mismatch")
+	ErrChunkChecksumMismatch = errors.New("chunk checksum mismatch")
+)
+
+// WriteUploadChunk streams a client chunk into the session's temp file at offset, hashing it
+// with SHA-256 on the way so it is never held in memory. declaredSize and expectedChecksum are
+// checked against what was streamed when set (-1 and "" skip them). A chunk failing a check
+// has still been written, the caller must not record it as received.
+func WriteUploadChunk(session *models.UploadSession, offset int64, body io.Reader, declaredSize int64, expectedChecksum string) (int64, string, error) {
+	tempFile, err := os.OpenFile(session.TempFilePath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer tempFile.Close()
+
+	if _, err := tempFile.Seek(offset, io.SeekStart); err != nil {
+		return 0, "", fmt.Errorf("failed to seek file: %w", err)
+	}
+
+	// Never past the end of the file, and one byte past the declared size catches longer bodies
+	limit := session.TotalSize - offset
+	if declaredSize >= 0 && declaredSize < limit {
+		limit = declaredSize
+	}
+	h := sha256.New()
+	written, err := io.Copy(tempFile, io.TeeReader(io.LimitReader(body, limit+1), h))
+	if err != nil {
+		return written, "", fmt.Errorf("failed to write chunk: %w", err)
+	}
+	checksum := fmt.Sprintf("%x", h.Sum(nil))
+
+	if written > session.TotalSize-offset {
+		return written, checksum, fmt.Errorf("%w: chunk runs past the end of the file", ErrChunkSizeMismatch)
+	}
+	if declaredSize >= 0 && written != declaredSize {
+		return written, checksum, fmt.Errorf("%w: declared %d bytes, received %d", ErrChunkSizeMismatch, declaredSize, written)
+	}
+	if expectedChecksum != "" && !strings.EqualFold(expectedChecksum, checksum) {
+		return written, checksum, ErrChunkChecksumMismatch
+	}
+	return written, checksum, nil
+}
+
+// MarkChunksReceived records the session's chunks as received, the last of them starting the
+// finalize timeout
+func MarkChunksReceived(ctx context.Context, session *models.UploadSession, chunkIndexes []int) error {
+	return store.MarkSessionChunksReceived(ctx, session.ID, chunkIndexes, TotalUploadChunks(session))
 }
 
 func UpdateSessionStatus(ctx context.Context, sessionID primitive.ObjectID, status string, progress float64, errorMsg string) error {
-	return store.UpdateSessionStatus(ctx, sessionID, status, progress, errorMsg)
+	if status == "failed" {
+		errorMsg = tagRequestID(ctx, errorMsg)
+	}
+	if status == "complete" || status == "failed" || status == "incomplete" {
+		// A failed attempt with retries left is retrying instead, and notifies nobody yet
+		var err error
+		if status, err = finishUploadAttempt(ctx, sessionID, status, errorMsg); err != nil {
+			log.Printf("Failed to record the attempt of session %s: %v", sessionID.Hex(), err)
+		}
+	}
+	if err := store.UpdateSessionStatus(ctx, sessionID, status, progress, errorMsg); err != nil {
+		return err
+	}
+	PublishSessionEvent(sessionID, SessionEvent{Type: "progress", Status: status, Progress: progress, Message: errorMsg})
+	if status == "complete" || status == "failed" || status == "incomplete" {
+		notifyUploadSession(ctx, sessionID, status, errorMsg)
+	}
+	return nil
+}
+
+// FailSessionWithCode fails the session like UpdateSessionStatus, recording the error code
+// of the failure for its status
+func FailSessionWithCode(ctx context.Context, sessionID primitive.ObjectID, progress float64, code, errorMsg string) error {
+	if err := store.SetSessionErrorCode(ctx, sessionID, code); err != nil {
+		log.Printf("Failed to record error code of session %s: %v", sessionID.Hex(), err)
+	}
+	return UpdateSessionStatus(ctx, sessionID, "failed", progress, errorMsg)
+}
+
+// ClaimSessionForProcessing moves an uploading, unexpired session to processing, reporting false
+// when it isn't uploading anymore, e.g. because another finalize claimed it first
+func ClaimSessionForProcessing(ctx context.Context, sessionID primitive.ObjectID, message string) (bool, error) {
+	ok, err := store.ClaimUploadSession(ctx, sessionID, message)
+	if err != nil || !ok {
+		return false, err
+	}
+	PublishSessionEvent(sessionID, SessionEvent{Type: "progress", Status: "processing", Message: message})
+	return true, nil
+}
+
+// UpdateChunkUploadProgress records that completed of total chunks are on their drives
+func UpdateChunkUploadProgress(ctx context.Context, sessionID primitive.ObjectID, progress float64, completed, total int) error {
+	message := fmt.Sprintf("Uploading chunk %d/%d...", completed, total)
+	if err := store.UpdateSessionStatus(ctx, sessionID, "processing", progress, message); err != nil {
+		return err
+	}
+	PublishSessionEvent(sessionID, SessionEvent{
+		Type:            "progress",
+		Status:          "processing",
+		Progress:        progress,
+		Message:         message,
+		ChunksCompleted: completed,
+		TotalChunks:     total,
+	})
+	return nil
 }
 
 func CompleteSession(ctx context.Context, sessionID primitive.ObjectID) error {
@@ -133,23 +719,240 @@ func CompleteSession(ctx context.Context, sessionID primitive.ObjectID) error {
 	return store.CompleteSession(ctx, sessionID, &now)
 }
 
-func CleanupExpiredSessions(ctx context.Context) error {
+// CleanupExpiredSessions removes expired upload sessions with their temp file. Sessions that never
+// completed also get the chunks they already uploaded deleted from the drives. It returns how many
+// sessions and drive chunks were reclaimed.
+func CleanupExpiredSessions(ctx context.Context) (int, int, error) {
 	// Get expired sessions
 	sessions, err := store.GetExpiredSessions(ctx)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 
+	active := make(map[primitive.ObjectID]bool)
+	for _, id := range processingSessions() {
+		active[id] = true
+	}
+
+	reclaimedSessions, reclaimedChunks := 0, 0
 	for _, session := range sessions {
-		// Delete temp file
-		if session.TempFilePath != "" {
-			os.Remove(session.TempFilePath)
+		// Large files can still be processing after their session expired
+		if active[session.ID] {
+			continue
 		}
-		// Delete session from DB
-		store.DeleteUploadSession(ctx, session.ID)
+
+		chunks, err := RemoveUploadSession(ctx, session)
+		reclaimedChunks += chunks
+		if err != nil {
+			log.Printf("Failed to delete expired session %s: %v", session.ID.Hex(), err)
+			continue
+		}
+		reclaimedSessions++
 	}
 
-	return nil
+	return reclaimedSessions, reclaimedChunks, nil
+}
+
+// RemoveUploadSession deletes an upload session with its temp and key files. A session that
+// never completed first gets the chunks it uploaded deleted from the drives, unless they made it
+// into a stored file, and is kept when some of them are left behind so that a retry gets them.
+// It returns how many chunks were deleted.
+func RemoveUploadSession(ctx context.Context, session *models.UploadSession) (int, error) {
+	reclaimed := 0
+	// Chunks that made it into a stored file belong to it now
+	if session.Status != "complete" && len(session.DriveChunks) > 0 {
+		file, err := store.FindStoredFileBySession(ctx, session.ID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to look up stored file: %w", err)
+		}
+		if file == nil {
+			failed := 0
+			for _, chunk := range session.DriveChunks {
+				if err := drivemanager.DeleteDriveFile(ctx, chunk.DriveAccountID, chunk.DriveFileID); err != nil {
+					log.Printf("Failed to delete orphaned chunk %s of session %s: %v", chunk.DriveFileID, session.ID.Hex(), err)
+					failed++
+					continue
+				}
+				reclaimed++
+			}
+			if failed > 0 {
+				return reclaimed, fmt.Errorf("%d chunks are left on the drives", failed)
+			}
+		}
+	}
+
+	for _, path := range []string{session.TempFilePath, session.KeyFilePath} {
+		if path != "" {
+			os.Remove(path)
+		}
+	}
+	return reclaimed, store.DeleteUploadSession(ctx, session.ID)
+}
+
+// CleanupExpiredDownloads removes expired download sessions with their temp and reconstructed
+// files, which are the largest files left on disk. It returns how many sessions were reclaimed.
+func CleanupExpiredDownloads(ctx context.Context) (int, error) {
+	sessions, err := store.GetExpiredDownloadSessions(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	reclaimed := 0
+	for i := range sessions {
+		// Large files can still be reconstructing after their session expired
+		if isReconstructing(sessions[i].ID) {
+			continue
+		}
+		if err := RemoveDownloadSession(ctx, &sessions[i]); err != nil {
+			log.Printf("Failed to delete expired download session %s: %v", sessions[i].ID.Hex(), err)
+			continue
+		}
+		reclaimed++
+	}
+	return reclaimed, nil
+}
+
+// CleanupOrphanedDownloadFiles removes the files in DOWNLOAD_TEMP_DIR named after a session
+// that has no record anymore, left behind when the TTL index removed a download session the
+// sweeper didn't get to. Uploads may share the directory, their files are kept while their
+// session exists. It returns how many files were removed.
+func CleanupOrphanedDownloadFiles(ctx context.Context) (int, error) {
+	entries, err := os.ReadDir(downloadTempDir)
+	if err != nil {
+		return 0, err
+	}
+
+	// Files written since the last sweep may belong to a session being created
+	cutoff := time.Now().Add(-sessionSweepInterval)
+	// Whether the session a file is named after exists, a reconstruction has two files
+	known := make(map[primitive.ObjectID]bool)
+	removed := 0
+	for _, entry := range entries {
+		// <id>, <id>.download and <id>.upload, or <id>_<filename> from before
+		idHex := entry.Name()
+		if i := strings.IndexAny(idHex, "_."); i >= 0 {
+			idHex = idHex[:i]
+		}
+		sessionID, err := primitive.ObjectIDFromHex(idHex)
+		if err != nil || !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) || isReconstructing(sessionID) {
+			continue
+		}
+
+		exists, checked := known[sessionID]
+		if !checked {
+			exists, err = sessionExists(ctx, sessionID)
+			if err != nil {
+				return removed, err
+			}
+			known[sessionID] = exists
+		}
+		if exists {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(downloadTempDir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove orphaned download file %s: %v", entry.Name(), err)
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// sessionExists reports whether a download or upload session with the ID exists
+func sessionExists(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	download, err := store.GetDownloadSession(ctx, sessionID)
+	if err != nil || download != nil {
+		return download != nil, err
+	}
+	upload, err := store.GetUploadSession(ctx, sessionID)
+	return upload != nil, err
+}
+
+// RemoveDownloadSession deletes a download session's files from disk and then its record
+func RemoveDownloadSession(ctx context.Context, session *models.DownloadSession) error {
+	for _, path := range []string{session.TempFilePath, session.ReconstructedPath} {
+		if path == "" {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	forgetDownloadKey(session.ID)
+	return store.DeleteDownloadSession(ctx, session.ID)
+}
+
+// StartSessionSweeper runs CleanupExpiredSessions, CleanupExpiredDownloads,
+// CleanupOrphanedDownloadFiles and CleanupExpiredTrash every SESSION_SWEEP_INTERVAL_MINUTES
+// until ctx is done
+func StartSessionSweeper(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(sessionSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// Expired right away, this sweep reclaims them
+			stale, err := markStaleSessions(ctx)
+			if err != nil {
+				log.Printf("Stale session sweep failed: %v", err)
+			} else if stale > 0 {
+				log.Printf("Session sweep marked %d sessions stale that weren't finalized in time", stale)
+			}
+
+			sessions, chunks, err := CleanupExpiredSessions(ctx)
+			if err != nil {
+				log.Printf("Session sweep failed: %v", err)
+				continue
+			}
+			if sessions > 0 || chunks > 0 {
+				log.Printf("Session sweep reclaimed %d expired sessions and %d orphaned chunks", sessions, chunks)
+			}
+
+			downloads, err := CleanupExpiredDownloads(ctx)
+			if err != nil {
+				log.Printf("Download sweep failed: %v", err)
+				continue
+			}
+			if downloads > 0 {
+				log.Printf("Download sweep reclaimed %d expired download sessions", downloads)
+			}
+
+			files, err := CleanupOrphanedDownloadFiles(ctx)
+			if err != nil {
+				log.Printf("Orphaned download file sweep failed: %v", err)
+			} else if files > 0 {
+				log.Printf("Download sweep removed %d orphaned files", files)
+			}
+
+			trashed, err := CleanupExpiredTrash(ctx)
+			if err != nil {
+				log.Printf("Trash sweep failed: %v", err)
+				continue
+			}
+			if trashed > 0 {
+				log.Printf("Trash sweep permanently deleted %d files", trashed)
+			}
+
+			states, err := oauth.CleanupExpiredStates(ctx)
+			if err != nil {
+				log.Printf("OAuth state sweep failed: %v", err)
+				continue
+			}
+			if states > 0 {
+				log.Printf("OAuth state sweep removed %d expired states", states)
+			}
+		}
+	}()
 }
 
 func ScheduleCleanup(ctx context.Context, sessionID primitive.ObjectID) {
@@ -159,6 +962,10 @@ func ScheduleCleanup(ctx context.Context, sessionID primitive.ObjectID) {
 		if err != nil || session == nil {
 			return
 		}
+		// A retry processes the file again, its attempt schedules the cleanup once it ends
+		if session.Status == "retrying" || session.Status == "processing" {
+			return
+		}
 		// Delete temp file
 		if session.TempFilePath != "" {
 			os.Remove(session.TempFilePath)
@@ -166,6 +973,59 @@ func ScheduleCleanup(ctx context.Context, sessionID primitive.ObjectID) {
 	}()
 }
 
-func GetTempFilePath(sessionID primitive.ObjectID, filename string) string {
-	return filepath.Join(uploadTempDir, fmt.Sprintf("%s_%s", sessionID.Hex(), filename))
+// GetTempFilePath returns the temp file of an upload session. It's named by the session alone,
+// a filename could climb out of the temp dir.
+func GetTempFilePath(sessionID primitive.ObjectID) string {
+	return filepath.Join(uploadTempDir, sessionID.Hex()+".upload")
+}
+
+func CreateDownloadSession(ctx context.Context, userID primitive.ObjectID, file *models.StoredFile) (*models.DownloadSession, error) {
+	sessionID := primitive.NewObjectID()
+	// Named by the session alone, like upload temp files
+	basePath := filepath.Join(downloadTempDir, sessionID.Hex())
+
+	session := &models.DownloadSession{
+		ID:                sessionID,
+		UserID:            userID,
+		FileID:            file.ID,
+		TempFilePath:      basePath + ".download",
+		ReconstructedPath: basePath,
+		Checksum:          file.OriginalChecksum,
+		Status:            "downloading",
+		CreatedAt:         time.Now(),
+		ExpiresAt:         time.Now().Add(downloadExpiryDuration),
+	}
+	if err := newDownloadKey(session); err != nil {
+		return nil, err
+	}
+
+	if err := store.CreateDownloadSession(ctx, session); err != nil {
+		forgetDownloadKey(sessionID)
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func UpdateDownloadProgress(ctx context.Context, sessionID primitive.ObjectID, progress float64) error {
+	return store.UpdateDownloadProgress(ctx, sessionID, progress)
+}
+
+func UpdateDownloadStatus(ctx context.Context, sessionID primitive.ObjectID, status string, errorMsg string) error {
+	if status == "failed" {
+		errorMsg = tagRequestID(ctx, errorMsg)
+	}
+	if err := store.UpdateDownloadStatus(ctx, sessionID, status, errorMsg); err != nil {
+		return err
+	}
+	notifyDownloadSession(ctx, sessionID, status, errorMsg)
+	return nil
+}
+
+// tagRequestID appends the ID of the request that ran into an error, so a stored error can be matched to its log lines
+func tagRequestID(ctx context.Context, errorMsg string) string {
+	if id := middleware.GetRequestID(ctx); id != "" {
+		return fmt.Sprintf("%s (request %s)", errorMsg, id)
+	}
+	return errorMsg
 }
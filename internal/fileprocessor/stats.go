@@ -0,0 +1,65 @@
+package fileprocessor
+
+import (
+	"SE/internal/cache"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// How long a user's storage stats are served from the cache, set by InitFileConfig
+var storageStatsTTL time.Duration
+
+func storageStatsCacheKey(userID primitive.ObjectID) string {
+	return "storage-stats:" + userID.Hex()
+}
+
+// UserStorageStats returns the user's storage stats, computed at most once per
+// STORAGE_STATS_CACHE_SECONDS since they take an aggregation over every file
+func UserStorageStats(ctx context.Context, userID primitive.ObjectID) (*models.StorageStats, error) {
+	key := storageStatsCacheKey(userID)
+	if storageStatsTTL > 0 {
+		if cached, ok, err := cache.Shared().Get(ctx, key); err != nil {
+			log.Printf("Failed to read cached storage stats of user %s: %v", userID.Hex(), err)
+		} else if ok {
+			var stats models.StorageStats
+			if err := json.Unmarshal([]byte(cached), &stats); err == nil {
+				return &stats, nil
+			}
+		}
+	}
+
+	stats, err := store.AggregateUserStorageStats(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	stats.ComputedAt = time.Now().UTC()
+
+	accounts, err := store.ListUserDriveAccounts(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range stats.Drives {
+		for _, a := range accounts {
+			if a.ID == stats.Drives[i].DriveAccountID {
+				stats.Drives[i].DisplayName = a.DisplayName
+				stats.Drives[i].Provider = a.Provider
+				stats.Drives[i].Linked = true
+			}
+		}
+	}
+
+	if storageStatsTTL > 0 {
+		if value, err := json.Marshal(stats); err == nil {
+			if err := cache.Shared().Set(ctx, key, string(value), storageStatsTTL); err != nil {
+				log.Printf("Failed to cache storage stats of user %s: %v", userID.Hex(), err)
+			}
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,50 @@
+package fileprocessor
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Limits on the tags of a stored file
+const (
+	MaxTagsPerFile = 20
+	MaxTagLength   = 64
+)
+
+// NormalizeTags trims and lowercases tags and drops empty and repeated ones, so tag matching
+// is case-insensitive. It fails if a tag is too long or there are too many.
+func NormalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > MaxTagLength {
+			return nil, fmt.Errorf("tag %q is longer than %d characters", tag, MaxTagLength)
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > MaxTagsPerFile {
+		return nil, fmt.Errorf("at most %d tags per file", MaxTagsPerFile)
+	}
+	return normalized, nil
+}
+
+// NormalizeTagChanges normalizes the tags to add to a file and to remove from it like
+// NormalizeTags, removals matching any length
+func NormalizeTagChanges(add, remove []string) ([]string, []string, error) {
+	add, err := NormalizeTags(add)
+	if err != nil {
+		return nil, nil, err
+	}
+	removed := make([]string, 0, len(remove))
+	for _, tag := range remove {
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" {
+			removed = append(removed, tag)
+		}
+	}
+	return add, removed, nil
+}
@@ -0,0 +1,116 @@
+package fileprocessor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+	"strconv"
+
+	_ "image/gif"
+	_ "image/png"
+)
+
+// ErrNoThumbnail is returned for files no thumbnail can be made of
+var ErrNoThumbnail = errors.New("no thumbnail for this content type")
+
+// Largest image a thumbnail is decoded from, decoding holds 4 bytes a pixel in memory
+const thumbnailMaxPixels = 40_000_000
+
+// Content types thumbnails are made of
+var thumbnailTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+var thumbnailMaxSize int
+
+func initThumbnailConfig() {
+	// Longest side of a thumbnail in pixels
+	thumbnailMaxSize, _ = strconv.Atoi(os.Getenv("THUMBNAIL_MAX_PX"))
+	if thumbnailMaxSize <= 0 {
+		thumbnailMaxSize = 256
+	}
+}
+
+// GenerateThumbnail decodes the image at path and returns a JPEG of it scaled down to at most
+// THUMBNAIL_MAX_PX on its longest side, with its width and height. Smaller images keep their
+// size and transparency is flattened onto white. ErrNoThumbnail means the content type isn't a
+// supported image.
+func GenerateThumbnail(path, contentType string) ([]byte, int, int, error) {
+	if !thumbnailTypes[contentType] {
+		return nil, 0, 0, ErrNoThumbnail
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer f.Close()
+
+	// The header is checked first so a huge image isn't decoded
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to read image header: %w", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > thumbnailMaxPixels {
+		return nil, 0, 0, fmt.Errorf("image of %dx%d pixels is too large for a thumbnail", config.Width, config.Height)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, 0, 0, err
+	}
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	thumb := scaleDown(src, thumbnailMaxSize)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+	bounds := thumb.Bounds()
+	return buf.Bytes(), bounds.Dx(), bounds.Dy(), nil
+}
+
+// scaleDown fits src into maxSize by maxSize, averaging every box of source pixels that makes
+// up a thumbnail pixel, over a white background
+func scaleDown(src image.Image, maxSize int) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if w > maxSize || h > maxSize {
+		if w >= h {
+			dw, dh = maxSize, max(1, h*maxSize/w)
+		} else {
+			dw, dh = max(1, w*maxSize/h), maxSize
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*h/dh, b.Min.Y+(y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*w/dw, b.Min.X+(x+1)*w/dw
+			var r, g, bl, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					// Colors are alpha-premultiplied, adding the missing alpha puts them on white
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr + 0xffff - ca)
+					g += uint64(cg + 0xffff - ca)
+					bl += uint64(cb + 0xffff - ca)
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = 0xff
+		}
+	}
+	return dst
+}
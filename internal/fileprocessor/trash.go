@@ -0,0 +1,174 @@
+package fileprocessor
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/manifest"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrTrashExpired is returned when restoring a file whose retention window has elapsed
+var ErrTrashExpired = errors.New("trash retention window has elapsed")
+
+// TrashRestoreDeadline returns when a trashed file stops being restorable and becomes due
+// for permanent deletion
+func TrashRestoreDeadline(file *models.StoredFile) time.Time {
+	if file.TrashedAt == nil {
+		return time.Time{}
+	}
+	return file.TrashedAt.Add(trashRetention)
+}
+
+// TrashFile moves a file to the trash, keeping its chunks until the retention window elapses
+func TrashFile(ctx context.Context, file *models.StoredFile) (time.Time, error) {
+	trashedAt := time.Now().UTC()
+	ok, err := store.TrashStoredFile(ctx, file.ID, file.Status, trashedAt)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !ok {
+		return time.Time{}, errors.New("file changed while it was trashed")
+	}
+	file.Status = "trashed"
+	file.TrashedAt = &trashedAt
+	return trashedAt, nil
+}
+
+// RestoreFile takes a file out of the trash while its retention window lasts
+func RestoreFile(ctx context.Context, file *models.StoredFile) error {
+	ok, err := store.RestoreTrashedFile(ctx, file.ID, time.Now().UTC().Add(-trashRetention))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrTrashExpired
+	}
+	return nil
+}
+
+// CleanupExpiredTrash permanently deletes the files whose trash retention window has elapsed.
+// It returns how many files were deleted.
+func CleanupExpiredTrash(ctx context.Context) (int, error) {
+	files, err := store.ListExpiredTrashedFiles(ctx, time.Now().UTC().Add(-trashRetention))
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for i := range files {
+		ok, err := deleteExpiredTrashedFile(ctx, files[i].ID)
+		if err != nil {
+			log.Printf("Failed to delete trashed file %s: %v", files[i].ID.Hex(), err)
+			continue
+		}
+		if ok {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// deleteExpiredTrashedFile deletes a trashed file under its lock, reporting false when the file
+// left the trash before it was locked. A file that stays locked is left for the next cleanup.
+func deleteExpiredTrashedFile(ctx context.Context, fileID primitive.ObjectID) (bool, error) {
+	unlock, err := LockFile(ctx, fileID, "delete")
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	file, err := store.GetStoredFile(ctx, fileID)
+	if err != nil || file == nil || file.Status != "trashed" {
+		return false, err
+	}
+	status, orphaned, err := DeleteFileChunks(ctx, file)
+	if err != nil {
+		return false, fmt.Errorf("failed to record deletion: %w", err)
+	}
+	if status == "partially_deleted" {
+		log.Printf("Trashed file %s left %d chunks behind on its drives", fileID.Hex(), len(orphaned))
+	}
+	return true, nil
+}
+
+// DeleteFileChunks removes the file's chunks from their drives and records the outcome.
+// A partially deleted file only retries the chunks that were left behind last time.
+func DeleteFileChunks(ctx context.Context, file *models.StoredFile) (string, []int, error) {
+	pending := make(map[int]bool)
+	if file.Status == "partially_deleted" {
+		for _, chunkID := range file.OrphanedChunks {
+			pending[chunkID] = true
+		}
+	} else {
+		for _, chunk := range file.Chunks {
+			pending[chunk.ChunkID] = true
+		}
+	}
+
+	orphaned := make([]int, 0)
+	touched := make([]primitive.ObjectID, 0)
+	keepEntry := make(map[primitive.ObjectID]bool)
+	for _, chunk := range file.Chunks {
+		if !pending[chunk.ChunkID] {
+			continue
+		}
+		// The chunk is orphaned if any of its replicas survives
+		failed := false
+		for _, replica := range chunk.Replicas {
+			if !containsID(touched, replica.DriveAccountID) {
+				touched = append(touched, replica.DriveAccountID)
+			}
+			if err := drivemanager.DeleteDriveFile(ctx, replica.DriveAccountID, replica.DriveFileID); err != nil {
+				log.Printf("Failed to delete chunk %d of file %s from drive %s: %v", chunk.ChunkID, file.ID.Hex(), replica.DriveAccountID.Hex(), err)
+				keepEntry[replica.DriveAccountID] = true
+				failed = true
+			}
+		}
+		if failed {
+			orphaned = append(orphaned, chunk.ChunkID)
+		}
+	}
+
+	// Drives still holding an orphaned chunk keep the file in their manifest
+	cleaned := make([]primitive.ObjectID, 0, len(touched))
+	for _, accountID := range touched {
+		if !keepEntry[accountID] {
+			cleaned = append(cleaned, accountID)
+		}
+	}
+	if err := manifest.RemoveFile(ctx, file, cleaned); err != nil {
+		log.Printf("Failed to update drive manifests for file %s: %v", file.ID.Hex(), err)
+	}
+
+	status := "deleted"
+	if len(orphaned) > 0 {
+		status = "partially_deleted"
+	}
+
+	if err := store.UpdateStoredFileDeletion(ctx, file.ID, status, orphaned); err != nil {
+		return "", nil, err
+	}
+	// The thumbnail goes with the content, even while chunks are left behind
+	if file.HasThumbnail {
+		if err := store.DeleteThumbnail(ctx, file.ID); err != nil {
+			log.Printf("Failed to delete thumbnail of file %s: %v", file.ID.Hex(), err)
+		}
+	}
+	return status, orphaned, nil
+}
+
+func containsID(ids []primitive.ObjectID, id primitive.ObjectID) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// How often due upload retries are looked for
+const uploadRetryInterval = 30 * time.Second
+
+// Retries of failed uploads, set by initUploadRetryConfig
+var (
+	uploadRetryMaxAttempts int
+	uploadRetryBackoff     time.Duration
+)
+
+func initUploadRetryConfig() {
+	// Retries after the first attempt, 0 leaves failed uploads failed
+	uploadRetryMaxAttempts = 3
+	if v := os.Getenv("UPLOAD_RETRY_MAX_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("UPLOAD_RETRY_MAX_ATTEMPTS must be a non-negative number, got %q", v)
+		}
+		uploadRetryMaxAttempts = n
+	}
+
+	// Wait before the first retry, doubled for every retry after it
+	uploadRetryBackoff = 60 * time.Second
+	if v := os.Getenv("UPLOAD_RETRY_BACKOFF_SECONDS"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs < 1 {
+			log.Fatalf("UPLOAD_RETRY_BACKOFF_SECONDS must be a positive number, got %q", v)
+		}
+		uploadRetryBackoff = time.Duration(secs) * time.Second
+	}
+}
+
+// UploadRetryEnabled reports whether failed uploads are retried
+func UploadRetryEnabled() bool {
+	return uploadRetryMaxAttempts > 0
+}
+
+// UploadRetryInterval returns how often the retrier looks for due retries
+func UploadRetryInterval() time.Duration {
+	return uploadRetryInterval
+}
+
+// StartUploadAttempt records that processing the session with req started, so the session is
+// retried when it fails. Nothing is recorded when retries are disabled.
+func StartUploadAttempt(ctx context.Context, sessionID primitive.ObjectID, req models.ProcessRequest) error {
+	if !UploadRetryEnabled() {
+		return nil
+	}
+	return store.StartSessionAttempt(ctx, sessionID, req, time.Now())
+}
+
+// ClaimUploadRetry moves the retrying session whose retry is due the longest to processing,
+// starting its next attempt. It returns nil when no retry is due.
+func ClaimUploadRetry(ctx context.Context) (*models.UploadSession, error) {
+	message := "Retrying..."
+	session, err := store.ClaimSessionRetry(ctx, message)
+	if err != nil || session == nil {
+		return nil, err
+	}
+	PublishSessionEvent(session.ID, SessionEvent{Type: "progress", Status: "processing", Message: message})
+	return session, nil
+}
+
+// finishUploadAttempt records the outcome of the session's running attempt, when it has one.
+// A failed or interrupted attempt with retries left is retried after its backoff: the returned
+// status is then "retrying", and "failed" once the last retry failed too.
+func finishUploadAttempt(ctx context.Context, sessionID primitive.ObjectID, status, errorMsg string) (string, error) {
+	session, err := store.GetUploadSession(ctx, sessionID)
+	if err != nil || session == nil || session.Retry == nil {
+		return status, err
+	}
+	n := len(session.Retry.Attempts)
+	if n == 0 || session.Retry.Attempts[n-1].FinishedAt != nil {
+		return status, nil
+	}
+
+	now := time.Now()
+	attempt := session.Retry.Attempts[n-1]
+	attempt.FinishedAt = &now
+	attempt.Status = status
+	attempt.Error = errorMsg
+
+	var nextRetryAt *time.Time
+	gaveUp := false
+	expiresAt := session.ExpiresAt
+	if status != "complete" {
+		// The first attempt isn't a retry
+		if n <= uploadRetryMaxAttempts {
+			next := now.Add(uploadRetryBackoff << (n - 1))
+			nextRetryAt = &next
+			// The sweeper would reclaim the session before its retry
+			if expiresAt.Before(next.Add(sessionExpiryDuration)) {
+				expiresAt = next.Add(sessionExpiryDuration)
+			}
+			status = "retrying"
+		} else {
+			gaveUp = true
+			status = "failed"
+		}
+	}
+	if err := store.FinishSessionAttempt(ctx, sessionID, n-1, attempt, nextRetryAt, gaveUp, expiresAt); err != nil {
+		return attempt.Status, err
+	}
+	if nextRetryAt != nil {
+		log.Printf("Attempt %d of session %s ended %s, retrying at %s", n, sessionID.Hex(), attempt.Status, nextRetryAt.Format(time.RFC3339))
+	} else if gaveUp {
+		log.Printf("Giving up on session %s after %d attempts", sessionID.Hex(), n)
+	}
+	return status, nil
+}
@@ -0,0 +1,340 @@
+package fileprocessor
+
+import (
+	"SE/internal/models"
+	"SE/internal/netguard"
+	"SE/internal/oauth"
+	"SE/internal/store"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrInvalidWebhookURL is returned for webhook URLs notifications can't be sent to
+var ErrInvalidWebhookURL = errors.New("invalid webhook url")
+
+const (
+	// How long an endpoint has to answer a delivery
+	webhookTimeout = 10 * time.Second
+	// How long an attempt holds its delivery, longer than the attempt can take
+	webhookLease = time.Minute
+	// Wait before the first retry, doubled for every retry after it
+	webhookRetryBase = 30 * time.Second
+	// How often due retries are looked for
+	webhookRetryInterval = 15 * time.Second
+)
+
+var webhookMaxAttempts int
+
+// webhookClient only dials public addresses and doesn't follow redirects, a redirect counts as
+// a failed attempt
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: checkRemoteAddr,
+		}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func initWebhookConfig() {
+	// Attempts per notification, including the first
+	webhookMaxAttempts, _ = strconv.Atoi(os.Getenv("WEBHOOK_MAX_ATTEMPTS"))
+	if webhookMaxAttempts <= 0 {
+		webhookMaxAttempts = 5
+	}
+}
+
+// WebhookPayload is the body POSTed to a webhook when an upload or download session finishes
+type WebhookPayload struct {
+	ID         string    `json:"id"` // Delivery ID, the same on every attempt
+	Event      string    `json:"event"`
+	SessionID  string    `json:"session_id"`
+	FileID     string    `json:"file_id,omitempty"`
+	Filename   string    `json:"filename"`
+	Size       int64     `json:"size"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// CheckWebhookURL checks notifications can be sent to rawURL: http or https, on a host that
+// only resolves to public addresses. Deliveries check the address again when they connect.
+func CheckWebhookURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidWebhookURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme must be http or https", ErrInvalidWebhookURL)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("%w: missing host", ErrInvalidWebhookURL)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidWebhookURL, err)
+	}
+	for _, addr := range addrs {
+		if !netguard.PublicIP(addr.IP) {
+			return fmt.Errorf("%w: address %s is not public", ErrInvalidWebhookURL, addr.IP)
+		}
+	}
+	return nil
+}
+
+// SetWebhook points the user's notifications at rawURL with a new signing secret, which is
+// returned. The previous secret stops working right away.
+func SetWebhook(ctx context.Context, userID primitive.ObjectID, rawURL string) (string, bool, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", false, err
+	}
+	secret := hex.EncodeToString(b)
+	encrypted, err := oauth.Encrypt([]byte(secret))
+	if err != nil {
+		return "", false, err
+	}
+	found, err := store.SetUserWebhook(ctx, userID, rawURL, encrypted)
+	if err != nil {
+		return "", false, err
+	}
+	return secret, found, nil
+}
+
+// notifyUploadSession queues a notification of an upload session that reached status
+func notifyUploadSession(ctx context.Context, sessionID primitive.ObjectID, status, errorMsg string) {
+	session, err := store.GetUploadSession(ctx, sessionID)
+	if err != nil || session == nil {
+		if err != nil {
+			log.Printf("Failed to look up session %s for its webhook: %v", sessionID.Hex(), err)
+		}
+		return
+	}
+	payload := WebhookPayload{
+		Event:     "upload." + status,
+		SessionID: sessionID.Hex(),
+		Filename:  session.OriginalFilename,
+		Size:      session.TotalSize,
+		Status:    status,
+		Error:     errorMsg,
+		StartedAt: session.CreatedAt,
+	}
+	if !session.FileID.IsZero() {
+		payload.FileID = session.FileID.Hex()
+	}
+	queueWebhook(ctx, session.UserID, payload)
+}
+
+// notifyDownloadSession queues a notification of a download session that reached status
+func notifyDownloadSession(ctx context.Context, sessionID primitive.ObjectID, status, errorMsg string) {
+	session, err := store.GetDownloadSession(ctx, sessionID)
+	if err != nil || session == nil {
+		if err != nil {
+			log.Printf("Failed to look up download session %s for its webhook: %v", sessionID.Hex(), err)
+		}
+		return
+	}
+	payload := WebhookPayload{
+		Event:     "download." + status,
+		SessionID: sessionID.Hex(),
+		FileID:    session.FileID.Hex(),
+		Status:    status,
+		Error:     errorMsg,
+		StartedAt: session.CreatedAt,
+	}
+	if file, err := store.GetStoredFile(ctx, session.FileID); err == nil && file != nil {
+		payload.Filename = file.OriginalFilename
+		payload.Size = file.OriginalSize
+	}
+	queueWebhook(ctx, session.UserID, payload)
+}
+
+// queueWebhook records a delivery of the payload to the user's webhook, if they set one, and
+// makes its first attempt in the background. Recording it first lets retries outlive a restart.
+func queueWebhook(ctx context.Context, userID primitive.ObjectID, payload WebhookPayload) {
+	user, err := store.FindUserByID(ctx, userID)
+	if err != nil {
+		log.Printf("Failed to look up webhook of user %s: %v", userID.Hex(), err)
+		return
+	}
+	if user == nil || user.WebhookURL == "" {
+		return
+	}
+
+	delivery := &models.WebhookDelivery{
+		ID:            primitive.NewObjectID(),
+		UserID:        userID,
+		Event:         payload.Event,
+		URL:           user.WebhookURL,
+		Status:        "pending",
+		NextAttemptAt: time.Now().UTC(),
+	}
+	payload.ID = delivery.ID.Hex()
+	payload.FinishedAt = time.Now().UTC()
+	payload.DurationMS = payload.FinishedAt.Sub(payload.StartedAt).Milliseconds()
+	delivery.Payload, err = json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to encode webhook %s: %v", payload.Event, err)
+		return
+	}
+	if err := store.InsertWebhookDelivery(ctx, delivery); err != nil {
+		log.Printf("Failed to record webhook %s of user %s: %v", payload.Event, userID.Hex(), err)
+		return
+	}
+
+	go func() {
+		claimed, err := store.ClaimWebhookDelivery(context.Background(), delivery.ID, webhookLease)
+		if err != nil {
+			log.Printf("Failed to claim webhook delivery %s: %v", delivery.ID.Hex(), err)
+			return
+		}
+		if claimed != nil {
+			attemptWebhook(context.Background(), claimed)
+		}
+	}()
+}
+
+// attemptWebhook sends a claimed delivery to the user's current webhook and records the
+// outcome, scheduling a retry after a failure until WEBHOOK_MAX_ATTEMPTS
+func attemptWebhook(ctx context.Context, delivery *models.WebhookDelivery) {
+	delivery.Attempts++
+	status, err := sendWebhook(ctx, delivery)
+	delivery.ResponseStatus = status
+
+	now := time.Now().UTC()
+	switch {
+	case err == nil:
+		delivery.Status = "delivered"
+		delivery.DeliveredAt = &now
+		delivery.LastError = ""
+	case errors.Is(err, errWebhookRemoved) || delivery.Attempts >= webhookMaxAttempts:
+		delivery.Status = "failed"
+		delivery.LastError = err.Error()
+	default:
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = now.Add(webhookRetryBase << (delivery.Attempts - 1))
+	}
+	if err != nil {
+		log.Printf("Webhook delivery %s attempt %d failed: %v", delivery.ID.Hex(), delivery.Attempts, err)
+	}
+
+	if err := store.SaveWebhookAttempt(ctx, delivery); err != nil {
+		log.Printf("Failed to save webhook delivery %s: %v", delivery.ID.Hex(), err)
+	}
+}
+
+var errWebhookRemoved = errors.New("webhook removed")
+
+// sendWebhook POSTs the payload signed with the user's secret, returning the response status.
+// X-Signature is "sha256=" and the hex HMAC-SHA256 of the X-Webhook-Timestamp, a dot and the
+// body, so a captured request can't be replayed with another timestamp.
+func sendWebhook(ctx context.Context, delivery *models.WebhookDelivery) (int, error) {
+	user, err := store.FindUserByID(ctx, delivery.UserID)
+	if err != nil {
+		return 0, err
+	}
+	if user == nil || user.WebhookURL == "" {
+		return 0, errWebhookRemoved
+	}
+	secret, err := oauth.Decrypt(user.WebhookSecret)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decrypt webhook secret: %w", err)
+	}
+	delivery.URL = user.WebhookURL
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(delivery.Payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, user.WebhookURL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "2xpfm-webhook")
+	req.Header.Set("X-Webhook-ID", delivery.ID.Hex())
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint answered %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// StartWebhookRetrier retries failed webhook deliveries once their backoff has passed, and
+// deliveries interrupted by a restart once their lease has, until ctx is done
+func StartWebhookRetrier(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(webhookRetryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			for ctx.Err() == nil {
+				delivery, err := store.ClaimWebhookDelivery(ctx, primitive.NilObjectID, webhookLease)
+				if err != nil {
+					log.Printf("Webhook retry failed: %v", err)
+					break
+				}
+				if delivery == nil {
+					break
+				}
+				attemptWebhook(ctx, delivery)
+			}
+		}
+	}()
+}
+
+// rekeyWebhookSecret re-wraps the user's webhook secret with the current TOKEN_ENC_KEY,
+// reporting whether it was re-wrapped
+func rekeyWebhookSecret(ctx context.Context, userID primitive.ObjectID) (bool, error) {
+	user, err := store.FindUserByID(ctx, userID)
+	if err != nil || user == nil || len(user.WebhookSecret) == 0 {
+		return false, err
+	}
+	secret, changed, err := oauth.Rewrap(user.WebhookSecret)
+	if err != nil || !changed {
+		return false, err
+	}
+	// Not replaced means the user set a new webhook meanwhile
+	return store.ReplaceUserWebhookSecret(ctx, userID, user.WebhookSecret, secret)
+}
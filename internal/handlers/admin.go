@@ -0,0 +1,415 @@
+package handlers
+
+import (
+	"SE/internal/audit"
+	"SE/internal/fileprocessor"
+	"SE/internal/manifest"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/replication"
+	"SE/internal/store"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SetUserQuotaHandler - PUT /api/admin/users/:user_id/quota
+func SetUserQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(r.PathValue("user_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid user_id")
+		return
+	}
+
+	var req struct {
+		QuotaBytes int64 `json:"quota_bytes"` // 0 resets to the default quota
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		middleware.WriteDecodeError(w, err, "invalid request")
+		return
+	}
+	if req.QuotaBytes < 0 {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "quota_bytes must not be negative")
+		return
+	}
+
+	found, err := store.SetUserQuota(r.Context(), userID, req.QuotaBytes)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if !found {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "user not found")
+		return
+	}
+
+	quota, err := fileprocessor.GetQuotaUsage(r.Context(), userID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":     userID.Hex(),
+		"quota_bytes": req.QuotaBytes,
+		"used_bytes":  quota.UsedBytes,
+		"limit_bytes": quota.LimitBytes,
+	})
+}
+
+// SetUserBandwidthHandler - PUT /api/admin/users/:user_id/bandwidth
+func SetUserBandwidthHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(r.PathValue("user_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid user_id")
+		return
+	}
+
+	// A missing or null cap resets it to the default, 0 is unlimited
+	var req struct {
+		BandwidthBPS        *int64 `json:"bandwidth_bps"`
+		RequestBandwidthBPS *int64 `json:"request_bandwidth_bps"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		middleware.WriteDecodeError(w, err, "invalid request")
+		return
+	}
+	if (req.BandwidthBPS != nil && *req.BandwidthBPS < 0) || (req.RequestBandwidthBPS != nil && *req.RequestBandwidthBPS < 0) {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "bandwidth limits must not be negative")
+		return
+	}
+
+	found, err := store.SetUserBandwidth(r.Context(), userID, req.BandwidthBPS, req.RequestBandwidthBPS)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if !found {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "user not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":               userID.Hex(),
+		"bandwidth_bps":         req.BandwidthBPS,
+		"request_bandwidth_bps": req.RequestBandwidthBPS,
+	})
+}
+
+// SetUserRoleHandler - PUT /api/admin/users/:user_id/role
+// The user's access tokens are revoked so the next refresh issues one with the new role
+func SetUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	adminID := r.Context().Value("userID").(primitive.ObjectID)
+	userID, err := primitive.ObjectIDFromHex(r.PathValue("user_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid user_id")
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		middleware.WriteDecodeError(w, err, "invalid request")
+		return
+	}
+	if req.Role != models.RoleUser && req.Role != models.RoleAdmin {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "role must be user or admin")
+		return
+	}
+
+	found, err := store.SetUserRole(r.Context(), userID, req.Role)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if !found {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "user not found")
+		return
+	}
+	if err := store.SetTokensRevokedBefore(r.Context(), userID, time.Now().UTC().Truncate(time.Second)); err != nil {
+		log.Printf("Failed to revoke access tokens of user %s after a role change: %v", userID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	audit.Record(r, userID, models.AuditRoleChanged, map[string]string{"role": req.Role, "by": adminID.Hex()})
+	log.Printf("Admin %s set the role of user %s to %s", adminID.Hex(), userID.Hex(), req.Role)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id": userID.Hex(),
+		"role":    req.Role,
+	})
+}
+
+// StartUserRekeyHandler - POST /api/admin/users/:user_id/rekey
+// Re-wraps every data key and drive credential of the user with the current TOKEN_ENC_KEY in the
+// background, resuming the user's unfinished job if there is one
+func StartUserRekeyHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(r.PathValue("user_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid user_id")
+		return
+	}
+
+	user, err := store.FindUserByID(r.Context(), userID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if user == nil {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "user not found")
+		return
+	}
+
+	job, err := fileprocessor.StartRekeyJob(userID)
+	if err != nil {
+		log.Printf("Failed to start rekey job for user %s: %v", userID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to start rekey job")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// GetUserRekeyHandler - GET /api/admin/users/:user_id/rekey/status
+func GetUserRekeyHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(r.PathValue("user_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid user_id")
+		return
+	}
+
+	job, err := fileprocessor.GetRekeyJob(r.Context(), userID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if job == nil {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "no rekey job for user")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// ListManifestVersionsHandler - GET /api/admin/drives/:drive_id/manifest/versions
+func ListManifestVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	accountID, ok := adminDriveAccount(w, r)
+	if !ok {
+		return
+	}
+
+	versions, err := manifest.ListVersions(r.Context(), accountID)
+	if err != nil {
+		log.Printf("Failed to list manifest versions of drive %s: %v", accountID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusBadGateway, middleware.ErrCodeDriveUnreachable, "failed to list manifest versions")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"drive_account_id": accountID.Hex(),
+		"versions":         versions,
+	})
+}
+
+// RestoreManifestHandler - POST /api/admin/drives/:drive_id/manifest/restore
+func RestoreManifestHandler(w http.ResponseWriter, r *http.Request) {
+	accountID, ok := adminDriveAccount(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Version *int `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Version == nil {
+		middleware.WriteDecodeError(w, err, "version is required")
+		return
+	}
+
+	restored, err := manifest.RestoreManifest(r.Context(), accountID, *req.Version)
+	if errors.Is(err, manifest.ErrVersionNotFound) {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "manifest version not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to restore manifest version %d of drive %s: %v", *req.Version, accountID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusBadGateway, middleware.ErrCodeDriveUnreachable, "failed to restore manifest")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"drive_account_id": accountID.Hex(),
+		"restored_version": *req.Version,
+		"version":          restored.Version,
+		"files":            len(restored.Files),
+	})
+}
+
+// ListDownloadSessionsHandler - GET /api/admin/downloads
+func ListDownloadSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	sessions, err := store.ListDownloadSessions(r.Context())
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+
+	now := time.Now()
+	var diskBytes int64
+	list := make([]map[string]interface{}, 0, len(sessions))
+	for _, session := range sessions {
+		tempSize, reconstructedSize := fileSize(session.TempFilePath), fileSize(session.ReconstructedPath)
+		diskBytes += tempSize + reconstructedSize
+		list = append(list, map[string]interface{}{
+			"id":                 session.ID.Hex(),
+			"user_id":            session.UserID.Hex(),
+			"file_id":            session.FileID.Hex(),
+			"status":             session.Status,
+			"expired":            now.After(session.ExpiresAt),
+			"temp_file_path":     session.TempFilePath,
+			"temp_file_size":     tempSize,
+			"reconstructed_path": session.ReconstructedPath,
+			"reconstructed_size": reconstructedSize,
+			"encrypted_at_rest":  session.EncryptedAtRest,
+			"created_at":         session.CreatedAt,
+			"expires_at":         session.ExpiresAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessions":   list,
+		"disk_bytes": diskBytes,
+	})
+}
+
+// DeleteDownloadSessionHandler - DELETE /api/admin/downloads/:id
+func DeleteDownloadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := primitive.ObjectIDFromHex(r.PathValue("id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid id")
+		return
+	}
+
+	session, err := store.GetDownloadSession(r.Context(), sessionID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if session == nil {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "download session not found")
+		return
+	}
+
+	// A download still reconstructing this session fails once its files are gone
+	if err := fileprocessor.RemoveDownloadSession(r.Context(), session); err != nil {
+		log.Printf("Failed to delete download session %s: %v", sessionID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "failed to delete download session")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":      sessionID.Hex(),
+		"deleted": true,
+	})
+}
+
+// RebalanceFileHandler - POST /api/admin/files/:file_id/rebalance
+func RebalanceFileHandler(w http.ResponseWriter, r *http.Request) {
+	fileID, err := primitive.ObjectIDFromHex(r.PathValue("file_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid file_id")
+		return
+	}
+
+	var req struct {
+		ChunkIDs []int `json:"chunk_ids,omitempty"` // Empty considers every chunk
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			middleware.WriteDecodeError(w, err, "invalid request")
+			return
+		}
+	}
+
+	file, err := store.GetStoredFile(r.Context(), fileID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if file == nil || file.Status == "deleted" || file.Status == "partially_deleted" {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "file not found")
+		return
+	}
+
+	// Finished even if the admin disconnects, so copies aren't left half moved
+	moves, err := replication.RebalanceFile(context.WithoutCancel(r.Context()), fileID, req.ChunkIDs)
+	if errors.Is(err, fileprocessor.ErrFileLocked) {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, err.Error())
+		return
+	}
+	if len(moves) == 0 && err != nil {
+		log.Printf("Failed to rebalance file %s: %v", fileID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusBadGateway, middleware.ErrCodeDriveUnreachable, err.Error())
+		return
+	}
+
+	var movedBytes int64
+	for _, move := range moves {
+		movedBytes += move.Bytes
+	}
+	response := map[string]interface{}{
+		"file_id":     fileID.Hex(),
+		"moves":       moves,
+		"moved_bytes": movedBytes,
+	}
+	// Some copies moved and others didn't
+	if err != nil {
+		log.Printf("Rebalance of file %s incomplete: %v", fileID.Hex(), err)
+		response["error"] = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// fileSize returns the size of the file at path, 0 if it doesn't exist
+func fileSize(path string) int64 {
+	if path == "" {
+		return 0
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// adminDriveAccount parses the drive_id path value and checks the drive account exists
+func adminDriveAccount(w http.ResponseWriter, r *http.Request) (primitive.ObjectID, bool) {
+	accountID, err := primitive.ObjectIDFromHex(r.PathValue("drive_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid drive_id")
+		return primitive.NilObjectID, false
+	}
+	if _, err := store.GetDriveAccountByID(r.Context(), accountID); err != nil {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "drive account not found")
+		return primitive.NilObjectID, false
+	}
+	return accountID, true
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"SE/internal/middleware"
+	"SE/internal/store"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Page sizes of the audit log and the webhook delivery log
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// ListAuditEventsHandler - GET /api/account/audit?limit=&before=
+// Lists the user's audit events newest first. next_before is passed as before to get the next
+// page, it is missing on the last one.
+func ListAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	limit, before, err := parsePage(r)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	// One more than asked tells whether another page follows
+	events, err := store.ListUserAuditEvents(r.Context(), userID, before, limit+1)
+	if err != nil {
+		log.Printf("Failed to list audit events of user %s: %v", userID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+
+	resp := map[string]interface{}{}
+	if len(events) > limit {
+		events = events[:limit]
+		resp["next_before"] = events[limit-1].ID.Hex()
+	}
+	resp["events"] = events
+	resp["count"] = len(events)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// parsePage reads the limit and before query parameters of a paged listing
+func parsePage(r *http.Request) (int, primitive.ObjectID, error) {
+	limit := defaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			return 0, primitive.NilObjectID, errors.New("limit must be between 1 and " + strconv.Itoa(maxPageSize))
+		}
+		limit = n
+	}
+
+	var before primitive.ObjectID
+	if v := r.URL.Query().Get("before"); v != "" {
+		id, err := primitive.ObjectIDFromHex(v)
+		if err != nil {
+			return 0, primitive.NilObjectID, errors.New("invalid before")
+		}
+		before = id
+	}
+	return limit, before, nil
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"SE/internal/audit"
+	"SE/internal/drivemanager"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// LinkS3Handler - POST /api/drive/link/s3
+// Links an S3 bucket as a storage account after checking its credentials
+func LinkS3Handler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		drivemanager.S3Config
+		DisplayName string `json:"display_name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		middleware.WriteDecodeError(w, err, "invalid request")
+		return
+	}
+
+	backend, err := drivemanager.NewS3Backend(req.S3Config)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	displayName := req.DisplayName
+	if displayName == "" {
+		displayName = "S3 " + req.Bucket
+	}
+	linkBackend(w, r, models.ProviderS3, displayName, backend, req.S3Config)
+}
+
+// LinkWebDAVHandler - POST /api/drive/link/webdav
+// Links a WebDAV folder as a storage account after checking its credentials
+func LinkWebDAVHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		drivemanager.WebDAVConfig
+		DisplayName string `json:"display_name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		middleware.WriteDecodeError(w, err, "invalid request")
+		return
+	}
+
+	backend, err := drivemanager.NewWebDAVBackend(req.WebDAVConfig)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	displayName := req.DisplayName
+	if displayName == "" {
+		displayName = "WebDAV " + strings.TrimPrefix(strings.TrimPrefix(req.URL, "https://"), "http://")
+	}
+	linkBackend(w, r, models.ProviderWebDAV, displayName, backend, req.WebDAVConfig)
+}
+
+// linkBackend checks the backend is reachable and stores it as a drive account of the user,
+// with its config encrypted in place of an OAuth token
+func linkBackend(w http.ResponseWriter, r *http.Request, provider, displayName string, backend drivemanager.StorageBackend, config interface{}) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	quota, err := drivemanager.CheckBackend(r.Context(), backend)
+	if err != nil {
+		log.Printf("Failed to reach %s backend for user %s: %v", provider, userID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusBadGateway, middleware.ErrCodeDriveUnreachable, "failed to reach storage backend")
+		return
+	}
+
+	enc, err := drivemanager.EncryptBackendConfig(config)
+	if err != nil {
+		log.Printf("Encryption failed: %v", err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "encrypt failed")
+		return
+	}
+
+	acct := models.DriveAccount{
+		Provider:       provider,
+		DisplayName:    displayName,
+		EncryptedToken: enc,
+	}
+	if err := store.AddDriveAccountToUser(r.Context(), userID, acct); err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+
+	log.Printf("Linked %s backend %q for user %s", provider, displayName, userID.Hex())
+	audit.Record(r, userID, models.AuditDriveLinked, map[string]string{"provider": provider})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"provider":     provider,
+		"display_name": displayName,
+		"total_space":  quota.Limit,
+		"used_space":   quota.Usage,
+	})
+}
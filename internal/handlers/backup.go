@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"SE/internal/audit"
+	"SE/internal/manifest"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/store"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ExportManifestHandler - GET /api/account/manifest/export
+// Downloads the manifests of all the user's drives as one signed document, from which
+// ImportManifestHandler can rebuild the file records if Mongo is lost
+func ExportManifestHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	user, err := store.FindUserByID(r.Context(), userID)
+	if err != nil || user == nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+
+	backup, err := manifest.ExportBackup(r.Context(), user)
+	if err != nil {
+		log.Printf("Manifest export failed for user %s: %v", userID.Hex(), err)
+		if errors.Is(err, manifest.ErrDriveUnreadable) {
+			middleware.WriteJSONError(w, http.StatusBadGateway, middleware.ErrCodeDriveUnreachable, err.Error())
+		} else {
+			middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		}
+		return
+	}
+
+	audit.Record(r, userID, models.AuditBackupExported, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": "2xpfm-manifest-" + time.Now().UTC().Format("20060102") + ".json",
+	}))
+	json.NewEncoder(w).Encode(backup)
+}
+
+// ImportManifestHandler - POST /api/account/manifest/import
+// Rebuilds the file records of a document from ExportManifestHandler, once its signature checks
+// out. Files whose records still exist are left alone.
+func ImportManifestHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var backup models.SignedManifestBackup
+	if err := json.NewDecoder(r.Body).Decode(&backup); err != nil {
+		middleware.WriteDecodeError(w, err, "invalid request")
+		return
+	}
+	if len(backup.Backup) == 0 || backup.Signature == "" {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "backup and signature are required")
+		return
+	}
+
+	user, err := store.FindUserByID(r.Context(), userID)
+	if err != nil || user == nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+
+	report, err := manifest.ImportBackup(r.Context(), user, &backup)
+	switch {
+	case errors.Is(err, manifest.ErrBackupSignature):
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	case errors.Is(err, manifest.ErrBackupOwner):
+		middleware.WriteJSONError(w, http.StatusUnauthorized, middleware.ErrCodeUnauthorized, err.Error())
+		return
+	case err != nil:
+		log.Printf("Manifest import failed for user %s: %v", userID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+
+	log.Printf("Manifest import for user %s restored %d files, skipped %d", userID.Hex(), len(report.Restored), len(report.Skipped))
+	audit.Record(r, userID, models.AuditBackupImported, map[string]string{
+		"restored": strconv.Itoa(len(report.Restored)),
+		"skipped":  strconv.Itoa(len(report.Skipped)),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
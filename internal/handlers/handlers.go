@@ -1,9 +1,22 @@
 package handlers
 
 import (
+	"SE/internal/audit"
+	"SE/internal/drivemanager"
+	"SE/internal/manifest"
+	"SE/internal/middleware"
+	"SE/internal/models"
+	"SE/internal/oauth"
+	"SE/internal/replication"
 	"SE/internal/store"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -13,28 +26,352 @@ func ListDriveAccountsHandler(w http.ResponseWriter, r *http.Request) {
 
 	accts, err := store.ListUserDriveAccounts(r.Context(), userID)
 	if err != nil {
-		http.Error(w, "server error", http.StatusInternalServerError)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
 		return
 	}
+	writeDriveAccounts(w, accts)
+}
 
+// writeDriveAccounts answers with the accounts in priority order
+func writeDriveAccounts(w http.ResponseWriter, accts []models.DriveAccount) {
 	// do not return encrypted token in response
 	type DriveAccountOut struct {
-		ID          primitive.ObjectID `json:"id"`
-		Provider    string             `json:"provider"`
-		DisplayName string             `json:"display_name"`
-		CreatedAt   interface{}        `json:"created_at"`
+		ID             primitive.ObjectID `json:"id"`
+		Provider       string             `json:"provider"`
+		DisplayName    string             `json:"display_name"`
+		Priority       int                `json:"priority"`
+		Disabled       bool               `json:"disabled"`
+		DisabledReason string             `json:"disabled_reason,omitempty"`
+		DisabledAt     interface{}        `json:"disabled_at,omitempty"`
+		CreatedAt      interface{}        `json:"created_at"`
 	}
 
 	out := make([]DriveAccountOut, 0, len(accts))
 	for _, a := range accts {
-		out = append(out, DriveAccountOut{
-			ID:          a.ID,
-			Provider:    a.Provider,
-			DisplayName: a.DisplayName,
-			CreatedAt:   a.CreatedAt,
-		})
+		entry := DriveAccountOut{
+			ID:             a.ID,
+			Provider:       a.Provider,
+			DisplayName:    a.DisplayName,
+			Priority:       a.Priority,
+			Disabled:       a.Disabled,
+			DisabledReason: a.DisabledReason,
+			CreatedAt:      a.CreatedAt,
+		}
+		if a.DisabledAt != nil {
+			entry.DisabledAt = a.DisabledAt
+		}
+		out = append(out, entry)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(out)
 }
+
+// SetDriveAccountPriorityHandler - PUT /api/drive/accounts/priority
+// Ranks the user's drive accounts in the order of drive_ids, for the priority distribution
+// strategy. Accounts left out are unranked and come after the ranked ones.
+func SetDriveAccountPriorityHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var req struct {
+		DriveIDs []string `json:"drive_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		middleware.WriteDecodeError(w, err, "invalid request")
+		return
+	}
+
+	accts, err := store.ListUserDriveAccounts(r.Context(), userID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	linked := make(map[primitive.ObjectID]bool, len(accts))
+	for _, a := range accts {
+		linked[a.ID] = true
+	}
+
+	order := make([]primitive.ObjectID, 0, len(req.DriveIDs))
+	seen := make(map[primitive.ObjectID]bool, len(req.DriveIDs))
+	for _, raw := range req.DriveIDs {
+		id, err := primitive.ObjectIDFromHex(raw)
+		if err != nil {
+			middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, fmt.Sprintf("invalid drive_id %q", raw))
+			return
+		}
+		if !linked[id] {
+			middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, fmt.Sprintf("drive account %s is not linked", raw))
+			return
+		}
+		if seen[id] {
+			middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, fmt.Sprintf("drive account %s is listed twice", raw))
+			return
+		}
+		seen[id] = true
+		order = append(order, id)
+	}
+
+	if err := store.SetDriveAccountPriorities(r.Context(), userID, order); err != nil {
+		log.Printf("Failed to set drive priorities of user %s: %v", userID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+
+	accts, err = store.ListUserDriveAccounts(r.Context(), userID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	writeDriveAccounts(w, accts)
+}
+
+// UnlinkDriveAccountHandler - DELETE /api/drive/accounts/:drive_id
+func UnlinkDriveAccountHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	accountID, err := primitive.ObjectIDFromHex(r.PathValue("drive_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid drive_id")
+		return
+	}
+	force := r.URL.Query().Get("force") == "true"
+
+	// Only the user's own accounts can be unlinked
+	account, err := findUserDriveAccount(r.Context(), userID, accountID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if account == nil {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "drive account not found")
+		return
+	}
+
+	affected, err := store.ListFilesUsingDrive(r.Context(), userID, accountID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+
+	// Files with a replica of every chunk elsewhere can be healed, the rest lose chunks
+	var incomplete, healable []primitive.ObjectID
+	for _, fileID := range affected {
+		file, err := store.GetStoredFile(r.Context(), fileID)
+		if err != nil {
+			middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+			return
+		}
+		if file == nil {
+			continue
+		}
+		if survivesUnlink(file, accountID) {
+			healable = append(healable, fileID)
+		} else {
+			incomplete = append(incomplete, fileID)
+		}
+	}
+	incompleteIDs := hexIDs(incomplete)
+
+	if len(incomplete) > 0 && !force {
+		middleware.WriteJSONErrorDetails(w, http.StatusConflict, middleware.ErrCodeConflict, "drive account holds the only copy of chunks of stored files, pass force=true to unlink anyway", map[string]interface{}{
+			"affected_files": incompleteIDs,
+		})
+		return
+	}
+
+	// Only Drive accounts hold a token to revoke, S3 and WebDAV credentials stay the user's
+	if account.Provider == models.ProviderGoogle || account.Provider == "" {
+		if err := oauth.RevokeDriveAccountToken(r.Context(), account); err != nil {
+			log.Printf("Failed to revoke token of drive account %s: %v", accountID.Hex(), err)
+			middleware.WriteJSONError(w, http.StatusBadGateway, middleware.ErrCodeDriveUnreachable, "failed to revoke drive token")
+			return
+		}
+	}
+
+	// Files that lose chunks can no longer be reconstructed
+	if err := store.MarkStoredFilesIncomplete(r.Context(), incomplete); err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+
+	if _, err := store.RemoveDriveAccountFromUser(r.Context(), userID, accountID); err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	drivemanager.InvalidateDriveSpace(accountID)
+	audit.Record(r, userID, models.AuditDriveUnlinked, map[string]string{"drive_id": accountID.Hex(), "provider": account.Provider})
+
+	// Copy the lost replicas to the remaining drives in the background
+	replication.QueueHeal(healable)
+
+	log.Printf("Drive account %s unlinked for user %s (%d files incomplete, %d healing)", accountID.Hex(), userID.Hex(), len(incomplete), len(healable))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"drive_account_id": accountID.Hex(),
+		"unlinked":         true,
+		"incomplete_files": incompleteIDs,
+		"healing_files":    hexIDs(healable),
+	})
+}
+
+// driveTestTimeout bounds a drive account test, Drive calls retry with backoff on their own
+const driveTestTimeout = 30 * time.Second
+
+// TestDriveAccountHandler - POST /api/drive/accounts/:drive_id/test?probe=true
+// Round-trips to the account and reports each step's latency and error. The test ran even
+// when the drive is unhealthy, so that is a 200 with healthy false.
+func TestDriveAccountHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	accountID, err := primitive.ObjectIDFromHex(r.PathValue("drive_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid drive_id")
+		return
+	}
+	probe := r.URL.Query().Get("probe") == "true"
+
+	account, err := findUserDriveAccount(r.Context(), userID, accountID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if account == nil {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "drive account not found")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), driveTestTimeout)
+	defer cancel()
+	result := drivemanager.TestDriveAccount(ctx, accountID, probe)
+	if !result.Healthy {
+		log.Printf("Drive account %s of user %s failed its test: %+v", accountID.Hex(), userID.Hex(), result.Steps)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// EnableDriveAccountHandler - POST /api/drive/accounts/{drive_id}/enable
+// Enables a drive account disabled for failing too often, without waiting for its cooldown
+// and probe, and returns the user's accounts
+func EnableDriveAccountHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	accountID, err := primitive.ObjectIDFromHex(r.PathValue("drive_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid drive_id")
+		return
+	}
+
+	account, err := findUserDriveAccount(r.Context(), userID, accountID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if account == nil {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "drive account not found")
+		return
+	}
+	if !account.Disabled {
+		middleware.WriteJSONError(w, http.StatusConflict, middleware.ErrCodeConflict, "drive account is not disabled")
+		return
+	}
+
+	if _, err := drivemanager.EnableDriveAccount(r.Context(), accountID); err != nil {
+		log.Printf("Failed to enable drive account %s of user %s: %v", accountID.Hex(), userID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	log.Printf("Drive account %s of user %s enabled", accountID.Hex(), userID.Hex())
+
+	accts, err := store.ListUserDriveAccounts(r.Context(), userID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	writeDriveAccounts(w, accts)
+}
+
+// RebuildManifestHandler - POST /api/drive/accounts/{drive_id}/manifest/rebuild
+// Writes the drive's manifest anew from the file records, reporting the chunks recorded on the
+// drive that are no longer there
+func RebuildManifestHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	accountID, err := primitive.ObjectIDFromHex(r.PathValue("drive_id"))
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "invalid drive_id")
+		return
+	}
+
+	account, err := findUserDriveAccount(r.Context(), userID, accountID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if account == nil {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "drive account not found")
+		return
+	}
+
+	report, err := manifest.Rebuild(r.Context(), userID, accountID)
+	if err != nil {
+		log.Printf("Failed to rebuild manifest of drive %s for user %s: %v", accountID.Hex(), userID.Hex(), err)
+		if errors.Is(err, manifest.ErrDriveUnreadable) {
+			middleware.WriteJSONError(w, http.StatusBadGateway, middleware.ErrCodeDriveUnreachable, "failed to rebuild manifest")
+		} else {
+			middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		}
+		return
+	}
+	audit.Record(r, userID, models.AuditManifestRebuilt, map[string]string{
+		"drive_id": accountID.Hex(),
+		"version":  strconv.Itoa(report.Version),
+		"missing":  strconv.Itoa(len(report.MissingOnDrive)),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// findUserDriveAccount returns the user's drive account with the ID, nil if the user has none
+func findUserDriveAccount(ctx context.Context, userID, accountID primitive.ObjectID) (*models.DriveAccount, error) {
+	accts, err := store.ListUserDriveAccounts(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range accts {
+		if accts[i].ID == accountID {
+			return &accts[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// survivesUnlink reports whether every chunk of the file has a replica, or enough shards to
+// rebuild it, on other drives
+func survivesUnlink(file *models.StoredFile, accountID primitive.ObjectID) bool {
+	for _, chunk := range file.Chunks {
+		_, onDrive := chunk.ReplicaOn(accountID)
+		if !onDrive {
+			continue
+		}
+		needed := 1
+		if chunk.Sharded() && file.ErasureCoding != nil {
+			needed = file.ErasureCoding.DataShards
+		}
+		if len(chunk.Replicas)-1 < needed {
+			return false
+		}
+	}
+	return true
+}
+
+func hexIDs(ids []primitive.ObjectID) []string {
+	out := make([]string, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, id.Hex())
+	}
+	return out
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"SE/internal/fileprocessor"
+	"SE/internal/middleware"
+	"SE/internal/store"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// WebhookHandler routes /api/account/webhook by method
+func WebhookHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		GetWebhookHandler(w, r)
+	case "PUT":
+		SetWebhookHandler(w, r)
+	case "DELETE":
+		DeleteWebhookHandler(w, r)
+	default:
+		middleware.WriteMethodNotAllowed(w, "GET", "PUT", "DELETE")
+	}
+}
+
+// GetWebhookHandler - GET /api/account/webhook
+func GetWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	user, err := store.FindUserByID(r.Context(), userID)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if user == nil || user.WebhookURL == "" {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "no webhook set")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"url": user.WebhookURL,
+	})
+}
+
+// SetWebhookHandler - PUT /api/account/webhook
+// Sets the webhook and returns its new signing secret, the only time it is shown
+func SetWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	var req struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		middleware.WriteDecodeError(w, err, "invalid request")
+		return
+	}
+	req.URL = strings.TrimSpace(req.URL)
+	if err := fileprocessor.CheckWebhookURL(r.Context(), req.URL); err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	secret, found, err := fileprocessor.SetWebhook(r.Context(), userID, req.URL)
+	if err != nil {
+		log.Printf("Failed to set webhook of user %s: %v", userID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	if !found {
+		middleware.WriteJSONError(w, http.StatusNotFound, middleware.ErrCodeNotFound, "user not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"url":    req.URL,
+		"secret": secret,
+	})
+}
+
+// DeleteWebhookHandler - DELETE /api/account/webhook
+func DeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	if err := store.ClearUserWebhook(r.Context(), userID); err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListWebhookDeliveriesHandler - GET /api/account/webhook/deliveries?limit=&before=
+// Lists the user's webhook deliveries newest first, paged like the audit log
+func ListWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(primitive.ObjectID)
+
+	limit, before, err := parsePage(r)
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	deliveries, err := store.ListUserWebhookDeliveries(r.Context(), userID, before, limit+1)
+	if err != nil {
+		log.Printf("Failed to list webhook deliveries of user %s: %v", userID.Hex(), err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return
+	}
+
+	resp := map[string]interface{}{}
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+		resp["next_before"] = deliveries[limit-1].ID.Hex()
+	}
+	resp["deliveries"] = deliveries
+	resp["count"] = len(deliveries)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,229 @@
+package manifest
+
+import (
+	"SE/internal/models"
+	"SE/internal/oauth"
+	"SE/internal/store"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Purpose the signatures of manifest backups are made for
+const backupSignPurpose = "manifest-backup"
+
+var (
+	// ErrDriveUnreadable is returned when a linked drive's manifest can't be read for a backup,
+	// or the drive can't be read or written for a rebuild
+	ErrDriveUnreadable = errors.New("drive manifest couldn't be read")
+	// ErrBackupSignature is returned when a backup wasn't signed by this server or was changed
+	ErrBackupSignature = errors.New("backup signature is invalid")
+	// ErrBackupOwner is returned when a backup belongs to another account
+	ErrBackupOwner = errors.New("backup belongs to another account")
+)
+
+// ExportBackup collects the manifest of every drive linked by the user into a signed backup.
+// It fails if any linked drive's manifest can't be read, since a backup missing a drive would
+// restore incomplete files.
+func ExportBackup(ctx context.Context, user *models.User) (*models.SignedManifestBackup, error) {
+	accounts, err := store.ListUserDriveAccounts(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list drive accounts: %w", err)
+	}
+
+	backup := models.ManifestBackup{
+		UserID:     user.ID,
+		Email:      user.Email,
+		Drives:     []models.DriveManifest{},
+		ExportedAt: time.Now().UTC(),
+	}
+	for _, account := range accounts {
+		manifest, _, err := Load(ctx, account.ID)
+		if err != nil {
+			return nil, fmt.Errorf("%w: drive %s: %v", ErrDriveUnreadable, account.ID.Hex(), err)
+		}
+		if manifest != nil {
+			// The backup holds the files of every part, it is restored without the drive
+			manifest.Parts = nil
+			backup.Drives = append(backup.Drives, *manifest)
+		}
+	}
+
+	raw, err := json.Marshal(backup)
+	if err != nil {
+		return nil, err
+	}
+	return &models.SignedManifestBackup{
+		Backup:    raw,
+		Signature: base64.StdEncoding.EncodeToString(oauth.Sign(backupSignPurpose, raw)),
+	}, nil
+}
+
+// ImportBackup rebuilds the file records of a signed backup for the user. The backup must be
+// the user's own, or carry the email of their account when it was exported from an account
+// lost with Mongo. Each drive of the backup is matched to the linked account with its ID, or
+// else to the account holding its manifest, so relinked drives are found again. Files Mongo
+// still knows and files whose chunks aren't all on matched drives are skipped.
+func ImportBackup(ctx context.Context, user *models.User, signed *models.SignedManifestBackup) (*models.ManifestImportReport, error) {
+	var raw bytes.Buffer
+	if err := json.Compact(&raw, signed.Backup); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBackupSignature, err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil || !oauth.Verify(backupSignPurpose, raw.Bytes(), sig) {
+		return nil, ErrBackupSignature
+	}
+
+	var backup models.ManifestBackup
+	if err := json.Unmarshal(raw.Bytes(), &backup); err != nil {
+		return nil, fmt.Errorf("failed to parse backup: %w", err)
+	}
+	if backup.UserID != user.ID && !strings.EqualFold(backup.Email, user.Email) {
+		return nil, ErrBackupOwner
+	}
+
+	linkedAs, errs, err := matchBackupDrives(ctx, user.ID, backup.Drives)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &models.ManifestImportReport{
+		Drives:   []models.DriveImport{},
+		Restored: []string{},
+		Skipped:  []models.FileSkip{},
+		Errors:   errs,
+	}
+
+	// The files of the backup in the order they first appear, with their entries on matched drives
+	var fileIDs []primitive.ObjectID
+	entries := make(map[primitive.ObjectID][]manifestEntry)
+	known := make(map[primitive.ObjectID]bool)
+	for _, drive := range backup.Drives {
+		result := models.DriveImport{DriveAccountID: drive.DriveAccountID, Files: len(drive.Files)}
+		accountID, matched := linkedAs[drive.DriveAccountID]
+		if matched {
+			result.LinkedAs = &accountID
+		}
+		report.Drives = append(report.Drives, result)
+
+		for _, mf := range drive.Files {
+			if !known[mf.FileID] {
+				known[mf.FileID] = true
+				fileIDs = append(fileIDs, mf.FileID)
+			}
+			if matched {
+				entries[mf.FileID] = append(entries[mf.FileID], manifestEntry{accountID: accountID, file: mf})
+			}
+		}
+	}
+
+	for _, fileID := range fileIDs {
+		reason, err := importFile(ctx, user.ID, fileID, entries[fileID])
+		if err != nil {
+			log.Printf("Failed to import file %s from backup: %v", fileID.Hex(), err)
+			reason = "failed to restore the file record"
+		}
+		if reason != "" {
+			report.Skipped = append(report.Skipped, models.FileSkip{FileID: fileID, Reason: reason})
+			continue
+		}
+		report.Restored = append(report.Restored, fileID.Hex())
+	}
+	sort.Strings(report.Restored)
+	return report, nil
+}
+
+// matchBackupDrives maps the drive accounts of the backup to the user's linked accounts holding
+// them. The manifests of linked accounts the backup doesn't list are read to find relinked
+// drives, those that can't be read are described in the returned messages.
+func matchBackupDrives(ctx context.Context, userID primitive.ObjectID, drives []models.DriveManifest) (map[primitive.ObjectID]primitive.ObjectID, []string, error) {
+	accounts, err := store.ListUserDriveAccounts(ctx, userID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list drive accounts: %w", err)
+	}
+
+	inBackup := make(map[primitive.ObjectID]bool, len(drives))
+	for _, drive := range drives {
+		inBackup[drive.DriveAccountID] = true
+	}
+	linkedAs := make(map[primitive.ObjectID]primitive.ObjectID)
+	var unmatched []primitive.ObjectID
+	for _, account := range accounts {
+		if inBackup[account.ID] {
+			linkedAs[account.ID] = account.ID
+		} else {
+			unmatched = append(unmatched, account.ID)
+		}
+	}
+
+	var errs []string
+	for _, accountID := range unmatched {
+		manifest, _, _, err := loadIndex(ctx, accountID)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("drive %s: %v", accountID.Hex(), err))
+			continue
+		}
+		// The manifest keeps the ID of the account that first wrote it
+		if manifest == nil || !inBackup[manifest.DriveAccountID] {
+			continue
+		}
+		if _, ok := linkedAs[manifest.DriveAccountID]; !ok {
+			linkedAs[manifest.DriveAccountID] = accountID
+		}
+	}
+	return linkedAs, errs, nil
+}
+
+// importFile restores one file of the backup from its entries on matched drives, returning why
+// it was skipped instead
+func importFile(ctx context.Context, userID, fileID primitive.ObjectID, entries []manifestEntry) (string, error) {
+	if len(entries) == 0 {
+		return "no linked drive holds its chunks", nil
+	}
+	existing, err := store.GetStoredFile(ctx, fileID)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		return "file already exists", nil
+	}
+
+	meta := entries[0].file
+	chunks := mergeChunks(nil, entries)
+	if !chunksCover(chunks, meta.ProcessedSize) {
+		return "some chunks are on no linked drive", nil
+	}
+	for _, chunk := range chunks {
+		if chunk.Sharded() && (meta.ErasureCoding == nil || len(chunk.Replicas) < meta.ErasureCoding.DataShards) {
+			return "too few shards of some chunks are on linked drives", nil
+		}
+	}
+	return "", store.RestoreStoredFile(ctx, restoredFile(userID, fileID, meta, chunks))
+}
+
+// chunksCover reports whether the chunks lay out the whole processed file, back to back
+func chunksCover(chunks []models.StoredChunk, processedSize int64) bool {
+	// Content-defined chunks keep their IDs when a file's content moves around them
+	byOffset := slices.Clone(chunks)
+	sort.SliceStable(byOffset, func(i, j int) bool {
+		return byOffset[i].StartOffset < byOffset[j].StartOffset
+	})
+	var next int64
+	for _, chunk := range byOffset {
+		if chunk.StartOffset != next {
+			return false
+		}
+		next += chunk.Size
+	}
+	return next == processedSize
+}
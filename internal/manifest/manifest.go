@@ -0,0 +1,257 @@
+package manifest
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/models"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ManifestFilename is the name of the manifest kept on every linked drive
+const ManifestFilename = "2xpfm.manifest"
+
+// driveLocks serializes read-modify-write cycles on each drive's manifest
+var driveLocks sync.Map
+
+func lockDrive(accountID primitive.ObjectID) func() {
+	mu, _ := driveLocks.LoadOrStore(accountID, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// Load reads a drive's manifest with the files of all its parts and returns it with the Drive
+// file ID of its index. A drive without a manifest yields a nil manifest and no error. Walk
+// goes through the files without holding them all.
+func Load(ctx context.Context, accountID primitive.ObjectID) (*models.DriveManifest, string, error) {
+	manifest, _, fileID, err := loadIndex(ctx, accountID)
+	if err != nil || manifest == nil {
+		return nil, fileID, err
+	}
+	if manifest.Files, err = allFiles(ctx, accountID, manifest); err != nil {
+		return nil, fileID, err
+	}
+	return manifest, fileID, nil
+}
+
+// loadIndex reads a drive's manifest index, without its parts, and also returns it as stored
+// so it can be kept as a version. The raw bytes are returned even when they fail to parse.
+func loadIndex(ctx context.Context, accountID primitive.ObjectID) (*models.DriveManifest, []byte, string, error) {
+	fileID, err := drivemanager.FindDriveFileByName(ctx, accountID, ManifestFilename)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to find manifest: %w", err)
+	}
+	if fileID == "" {
+		return nil, nil, "", nil
+	}
+
+	raw, err := downloadManifest(ctx, accountID, fileID)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	var manifest models.DriveManifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, raw, fileID, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	return &manifest, raw, fileID, nil
+}
+
+func downloadManifest(ctx context.Context, accountID primitive.ObjectID, fileID string) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := drivemanager.DownloadChunkFromDrive(ctx, accountID, fileID, &buf); err != nil {
+		return nil, fmt.Errorf("failed to download manifest: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// update replaces the file's entry in a drive's manifest with entry, nil to remove it, creating
+// the manifest if the drive has none. Only the part holding the file is rewritten, unless the
+// manifest predates parts or has outgrown them and all its files are spread over parts anew.
+func update(ctx context.Context, accountID, userID, fileID primitive.ObjectID, entry *models.ManifestFile) error {
+	unlock := lockDrive(accountID)
+	defer unlock()
+
+	index, raw, indexID, err := loadIndex(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	if index == nil {
+		index = &models.DriveManifest{DriveAccountID: accountID, UserID: userID}
+	}
+	existing, err := listParts(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	current := index.Version
+	next := *index
+	next.Files = nil
+
+	change := func(files []models.ManifestFile) []models.ManifestFile {
+		files = withoutFile(files, fileID)
+		if entry != nil {
+			files = append(files, *entry)
+		}
+		return files
+	}
+
+	total := fileCount(index)
+	if entry != nil {
+		total++
+	}
+	if parts := len(index.Parts); index.Files != nil || parts == 0 || partCount(max(parts, highestPart(existing)), total) != parts {
+		files, err := allFiles(ctx, accountID, index)
+		if err != nil {
+			return err
+		}
+		files = change(files)
+		next.Parts = make([]models.ManifestPart, partCount(max(parts, highestPart(existing)), len(files)))
+		return write(ctx, accountID, indexID, raw, current, &next, spread(files, len(next.Parts)), existing)
+	}
+
+	part := index.Parts[partOf(fileID, len(index.Parts))]
+	files, err := readPart(ctx, accountID, part)
+	if err != nil {
+		return err
+	}
+	next.Parts = slices.Clone(index.Parts)
+	return write(ctx, accountID, indexID, raw, current, &next, map[int][]models.ManifestFile{part.Part: change(files)}, existing)
+}
+
+// AddFile records the file's chunks in the manifest of every drive holding one of them
+func AddFile(ctx context.Context, file *models.StoredFile) error {
+	var errs []error
+	for _, group := range chunksByDrive(file.Chunks) {
+		entry := NewManifestFile(file, group.accountID, group.chunks)
+		err := update(ctx, group.accountID, file.UserID, file.ID, &entry)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("drive %s: %w", group.accountID.Hex(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RemoveFile drops the file from the manifests of the given drives
+func RemoveFile(ctx context.Context, file *models.StoredFile, accountIDs []primitive.ObjectID) error {
+	var errs []error
+	for _, accountID := range accountIDs {
+		err := update(ctx, accountID, file.UserID, file.ID, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("drive %s: %w", accountID.Hex(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// NewManifestFile builds the manifest entry of a file from the chunks stored on one drive
+func NewManifestFile(file *models.StoredFile, accountID primitive.ObjectID, chunks []models.StoredChunk) models.ManifestFile {
+	entry := models.ManifestFile{
+		FileID:           file.ID,
+		OriginalFilename: file.OriginalFilename,
+		ContentType:      file.ContentType,
+		OriginalSize:     file.OriginalSize,
+		ProcessedSize:    file.ProcessedSize,
+		OriginalChecksum: file.OriginalChecksum,
+		Obfuscation:      file.Obfuscation,
+		Encryption:       file.Encryption,
+		ClientEncryption: file.ClientEncryption,
+		Chunks:           make([]models.ManifestChunk, 0, len(chunks)),
+		ErasureCoding:    file.ErasureCoding,
+		MerkleRoot:       file.MerkleRoot,
+		Compress:         file.Compress,
+		CreatedAt:        file.CreatedAt,
+	}
+	for _, chunk := range chunks {
+		replica, ok := chunk.ReplicaOn(accountID)
+		if !ok {
+			continue
+		}
+		entry.Chunks = append(entry.Chunks, models.ManifestChunk{
+			ChunkID:        chunk.ChunkID,
+			DriveFileID:    replica.DriveFileID,
+			Backend:        replica.Backend,
+			Filename:       chunk.Filename,
+			StartOffset:    chunk.StartOffset,
+			EndOffset:      chunk.EndOffset,
+			Size:           chunk.Size,
+			StoredSize:     chunk.StoredSize,
+			Checksum:       chunk.Checksum,
+			ChecksumAlgo:   chunk.ChecksumAlgo,
+			Compressed:     chunk.Compressed,
+			CompressedSize: chunk.CompressedSize,
+			OriginalSize:   chunk.OriginalSize,
+			ContentHash:    chunk.ContentHash,
+			Shard:          replica.Shard,
+			ShardChecksum:  replica.Checksum,
+		})
+	}
+	return entry
+}
+
+// StoredChunk converts a manifest chunk back into a Mongo record holding the given drive's replica
+func StoredChunk(accountID primitive.ObjectID, chunk models.ManifestChunk) models.StoredChunk {
+	return models.StoredChunk{
+		ChunkID:        chunk.ChunkID,
+		Replicas:       []models.ChunkReplica{{DriveAccountID: accountID, DriveFileID: chunk.DriveFileID, Backend: chunk.Backend, Shard: chunk.Shard, Checksum: chunk.ShardChecksum}},
+		Filename:       chunk.Filename,
+		StartOffset:    chunk.StartOffset,
+		EndOffset:      chunk.EndOffset,
+		Size:           chunk.Size,
+		StoredSize:     chunk.StoredSize,
+		Checksum:       chunk.Checksum,
+		ChecksumAlgo:   manifestChecksumAlgo(chunk),
+		Compressed:     chunk.Compressed,
+		CompressedSize: chunk.CompressedSize,
+		OriginalSize:   chunk.OriginalSize,
+		ContentHash:    chunk.ContentHash,
+	}
+}
+
+// manifestChecksumAlgo is the checksum algorithm of a manifest chunk, manifests written
+// before it was recorded only held SHA-256 checksums
+func manifestChecksumAlgo(chunk models.ManifestChunk) string {
+	if chunk.ChecksumAlgo == "" {
+		return models.ChecksumSHA256
+	}
+	return chunk.ChecksumAlgo
+}
+
+type driveChunks struct {
+	accountID primitive.ObjectID
+	chunks    []models.StoredChunk
+}
+
+// chunksByDrive groups chunks by the drives holding their replicas, keeping the order drives
+// first appear in. A chunk with several replicas lands in several groups.
+func chunksByDrive(chunks []models.StoredChunk) []driveChunks {
+	index := make(map[primitive.ObjectID]int)
+	var groups []driveChunks
+	for _, chunk := range chunks {
+		for _, replica := range chunk.Replicas {
+			i, ok := index[replica.DriveAccountID]
+			if !ok {
+				i = len(groups)
+				index[replica.DriveAccountID] = i
+				groups = append(groups, driveChunks{accountID: replica.DriveAccountID})
+			}
+			groups[i].chunks = append(groups[i].chunks, chunk)
+		}
+	}
+	return groups
+}
+
+func withoutFile(files []models.ManifestFile, fileID primitive.ObjectID) []models.ManifestFile {
+	out := make([]models.ManifestFile, 0, len(files))
+	for _, f := range files {
+		if f.FileID != fileID {
+			out = append(out, f)
+		}
+	}
+	return out
+}
@@ -0,0 +1,215 @@
+package manifest
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/models"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Files of a drive's manifest are spread over part files, 2xpfm.manifest.part-<NNN>.v<version>,
+// named after the manifest version they were written at. A write leaves the parts it doesn't
+// change alone, so the index of every version kept names part files that are still there.
+const partPrefix = ManifestFilename + ".part-"
+
+// Files a manifest part holds on average before the parts are doubled, set by InitManifestConfig
+var partFiles int
+
+func partFilename(part, version int) string {
+	return fmt.Sprintf("%s%03d.v%d", partPrefix, part, version)
+}
+
+// parsePartFilename returns the part and version of a part file's name
+func parsePartFilename(name string) (int, int, bool) {
+	part, version, ok := strings.Cut(strings.TrimPrefix(name, partPrefix), ".v")
+	if !ok || !strings.HasPrefix(name, partPrefix) {
+		return 0, 0, false
+	}
+	p, err := strconv.Atoi(part)
+	if err != nil {
+		return 0, 0, false
+	}
+	v, err := strconv.Atoi(version)
+	if err != nil {
+		return 0, 0, false
+	}
+	return p, v, true
+}
+
+// partOf returns the part of a manifest spread over parts that holds the file
+func partOf(fileID primitive.ObjectID, parts int) int {
+	h := fnv.New32a()
+	h.Write(fileID[:])
+	return int(h.Sum32() % uint32(parts))
+}
+
+// partCount returns the parts files are spread over: current, at least 1, doubled until they
+// hold MANIFEST_PART_FILES on average. Parts are never merged again, so the manifest always
+// has the part of every part file on the drive and each one's newest file stays its own.
+func partCount(current, files int) int {
+	n := max(current, 1)
+	for n*partFiles < files {
+		n *= 2
+	}
+	return n
+}
+
+// spread distributes the files over parts
+func spread(files []models.ManifestFile, parts int) map[int][]models.ManifestFile {
+	out := make(map[int][]models.ManifestFile, parts)
+	for p := 0; p < parts; p++ {
+		out[p] = []models.ManifestFile{}
+	}
+	for _, f := range files {
+		p := partOf(f.FileID, parts)
+		out[p] = append(out[p], f)
+	}
+	return out
+}
+
+// fileCount returns the number of files the manifest index lists
+func fileCount(index *models.DriveManifest) int {
+	n := len(index.Files)
+	for _, part := range index.Parts {
+		n += part.Files
+	}
+	return n
+}
+
+// readPart downloads a part of the manifest and checks it is the one the index lists
+func readPart(ctx context.Context, accountID primitive.ObjectID, part models.ManifestPart) ([]models.ManifestFile, error) {
+	raw, err := downloadManifest(ctx, accountID, part.DriveFileID)
+	if err != nil {
+		return nil, fmt.Errorf("manifest part %d: %w", part.Part, err)
+	}
+	if fmt.Sprintf("%x", sha256.Sum256(raw)) != part.Checksum {
+		return nil, fmt.Errorf("manifest part %d doesn't match its checksum", part.Part)
+	}
+	var pf models.ManifestPartFile
+	if err := json.Unmarshal(raw, &pf); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest part %d: %w", part.Part, err)
+	}
+	return pf.Files, nil
+}
+
+// walkFiles calls fn with every file of the manifest index, reading its parts one at a time
+func walkFiles(ctx context.Context, accountID primitive.ObjectID, index *models.DriveManifest, fn func(models.ManifestFile) error) error {
+	// Manifests written before parts keep their files in the index
+	for _, f := range index.Files {
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	for _, part := range index.Parts {
+		files, err := readPart(ctx, accountID, part)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if err := fn(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// allFiles returns every file of the manifest index
+func allFiles(ctx context.Context, accountID primitive.ObjectID, index *models.DriveManifest) ([]models.ManifestFile, error) {
+	files := make([]models.ManifestFile, 0, fileCount(index))
+	err := walkFiles(ctx, accountID, index, func(f models.ManifestFile) error {
+		files = append(files, f)
+		return nil
+	})
+	return files, err
+}
+
+// Walk calls fn with every file of a drive's manifest, holding only one part in memory at a
+// time. It reports false for a drive without a manifest.
+func Walk(ctx context.Context, accountID primitive.ObjectID, fn func(models.ManifestFile) error) (bool, error) {
+	index, _, _, err := loadIndex(ctx, accountID)
+	if err != nil || index == nil {
+		return false, err
+	}
+	return true, walkFiles(ctx, accountID, index, fn)
+}
+
+// listParts returns the IDs of a drive's manifest part files, by part and then version
+func listParts(ctx context.Context, accountID primitive.ObjectID) (map[int]map[int]string, error) {
+	files, err := drivemanager.FindDriveFilesByPrefix(ctx, accountID, partPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list manifest parts: %w", err)
+	}
+	out := make(map[int]map[int]string)
+	for name, id := range files {
+		part, version, ok := parsePartFilename(name)
+		if !ok {
+			continue
+		}
+		if out[part] == nil {
+			out[part] = make(map[int]string)
+		}
+		out[part][version] = id
+	}
+	return out, nil
+}
+
+// highestPart returns the number of parts the part files on the drive are of
+func highestPart(existing map[int]map[int]string) int {
+	n := 0
+	for part := range existing {
+		n = max(n, part+1)
+	}
+	return n
+}
+
+// writePart uploads a part of the manifest at version, overwriting existingID, and returns
+// its entry in the index
+func writePart(ctx context.Context, accountID primitive.ObjectID, existingID string, part, version int, files []models.ManifestFile) (models.ManifestPart, error) {
+	data, err := json.MarshalIndent(models.ManifestPartFile{
+		DriveAccountID: accountID,
+		Part:           part,
+		Version:        version,
+		Files:          files,
+	}, "", "  ")
+	if err != nil {
+		return models.ManifestPart{}, fmt.Errorf("failed to marshal manifest part %d: %w", part, err)
+	}
+	id, err := drivemanager.WriteDriveFile(ctx, accountID, existingID, partFilename(part, version), data)
+	if err != nil {
+		return models.ManifestPart{}, fmt.Errorf("failed to write manifest part %d: %w", part, err)
+	}
+	return models.ManifestPart{
+		Part:        part,
+		Version:     version,
+		Files:       len(files),
+		DriveFileID: id,
+		Checksum:    fmt.Sprintf("%x", sha256.Sum256(data)),
+	}, nil
+}
+
+// stalePartFiles returns the IDs of the part files no manifest version from oldest on needs. A
+// version lists the newest file of each part written at or before it, so a part file is
+// needed until a newer one of the same part is older than every version kept.
+func stalePartFiles(existing map[int]map[int]string, oldest int) []string {
+	var stale []string
+	for _, byVersion := range existing {
+		written := make([]int, 0, len(byVersion))
+		for v := range byVersion {
+			written = append(written, v)
+		}
+		sort.Ints(written)
+		for i := 0; i+1 < len(written) && written[i+1] <= oldest; i++ {
+			stale = append(stale, byVersion[written[i]])
+		}
+	}
+	return stale
+}
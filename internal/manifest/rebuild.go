@@ -0,0 +1,140 @@
+package manifest
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Concurrent checks of the chunks of one rebuild still being on their drive
+const rebuildCheckConcurrency = 8
+
+// Rebuild writes a drive's manifest anew from the user's StoredFile records, the inverse of
+// Reconcile's repair: for a drive whose manifest is missing or corrupt while Mongo is intact.
+// Every chunk of a file that isn't deleted with a replica on the drive is listed, of a
+// partially deleted file only the chunks its delete left behind. Each chunk is first checked
+// to still be on the drive; those that aren't are still listed, Mongo being what the manifest
+// mirrors, and are reported so they can be healed. The manifest replaced, even one that no
+// longer parses, is kept as a version. Failing to read or write the drive returns
+// ErrDriveUnreadable.
+func Rebuild(ctx context.Context, userID, accountID primitive.ObjectID) (*models.ManifestRebuild, error) {
+	// Held while Mongo is read, so a file recorded meanwhile is added after the rebuild
+	unlock := lockDrive(accountID)
+	defer unlock()
+
+	stored, err := store.ListStoredFilesOnDrive(ctx, userID, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list stored files: %w", err)
+	}
+
+	report := &models.ManifestRebuild{DriveAccountID: accountID, MissingOnDrive: []models.ChunkDrift{}}
+	files := make([]models.ManifestFile, 0, len(stored))
+	for i := range stored {
+		file := &stored[i]
+		chunks := make([]models.StoredChunk, 0, len(file.Chunks))
+		for _, chunk := range file.Chunks {
+			if _, ok := chunk.ReplicaOn(accountID); !ok {
+				continue
+			}
+			if file.Status == "partially_deleted" && !slices.Contains(file.OrphanedChunks, chunk.ChunkID) {
+				continue
+			}
+			chunks = append(chunks, chunk)
+		}
+		if len(chunks) == 0 {
+			continue
+		}
+		files = append(files, NewManifestFile(file, accountID, chunks))
+		report.Chunks += len(chunks)
+	}
+	report.Files = len(files)
+
+	missing, err := missingOnDrive(ctx, accountID, files)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDriveUnreadable, err)
+	}
+	report.MissingOnDrive = missing
+
+	current, raw, indexID, err := loadIndex(ctx, accountID)
+	if err != nil && raw == nil {
+		return nil, fmt.Errorf("%w: %v", ErrDriveUnreadable, err)
+	}
+	existing, err := listParts(ctx, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDriveUnreadable, err)
+	}
+
+	// Like RestoreManifest, a corrupted manifest is numbered after the newest kept version
+	var currentVersion int
+	if current != nil {
+		currentVersion = current.Version
+	} else if raw != nil {
+		kept, err := versions(ctx, accountID)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrDriveUnreadable, err)
+		}
+		for v := range kept {
+			currentVersion = max(currentVersion, v+1)
+		}
+	}
+
+	next := &models.DriveManifest{DriveAccountID: accountID, UserID: userID}
+	next.Parts = make([]models.ManifestPart, partCount(highestPart(existing), len(files)))
+	if err := write(ctx, accountID, indexID, raw, currentVersion, next, spread(files, len(next.Parts)), existing); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDriveUnreadable, err)
+	}
+	report.Version = next.Version
+	report.RebuiltAt = next.UpdatedAt
+	return report, nil
+}
+
+// missingOnDrive returns the chunks of files whose drive file is no longer on the drive. A
+// check that fails fails the rebuild, a drive that can't be read shouldn't get a manifest.
+func missingOnDrive(ctx context.Context, accountID primitive.ObjectID, files []models.ManifestFile) ([]models.ChunkDrift, error) {
+	var (
+		mu       sync.Mutex
+		missing  = []models.ChunkDrift{}
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	sem := make(chan struct{}, rebuildCheckConcurrency)
+	for _, file := range files {
+		for _, chunk := range file.Chunks {
+			wg.Add(1)
+			go func(fileID primitive.ObjectID, chunk models.ManifestChunk) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				exists, err := drivemanager.DriveFileExists(ctx, accountID, chunk.DriveFileID)
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err != nil:
+					if firstErr == nil {
+						firstErr = fmt.Errorf("failed to check chunk %d of file %s: %w", chunk.ChunkID, fileID.Hex(), err)
+					}
+				case !exists:
+					missing = append(missing, models.ChunkDrift{
+						FileID:         fileID,
+						ChunkID:        chunk.ChunkID,
+						DriveAccountID: accountID,
+						Detail:         "drive file " + chunk.DriveFileID + " is gone",
+					})
+				}
+			}(file.FileID, chunk)
+		}
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	sortDrift(missing)
+	return missing, nil
+}
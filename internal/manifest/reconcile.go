@@ -0,0 +1,282 @@
+package manifest
+
+import (
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type chunkKey struct {
+	fileID    primitive.ObjectID
+	chunkID   int
+	accountID primitive.ObjectID
+}
+
+// manifestEntry is a file listed in one drive's manifest
+type manifestEntry struct {
+	accountID primitive.ObjectID
+	file      models.ManifestFile
+}
+
+// Reconcile compares every drive manifest of the user with the StoredChunk records in Mongo.
+// With repair set, Mongo is brought in line with the manifests: files and chunks that only the
+// manifests know about are restored and mismatched chunks take the manifest's values. Chunks
+// missing from a manifest are reported but left alone, since the manifest write may be what failed.
+func Reconcile(ctx context.Context, userID primitive.ObjectID, repair bool) (*models.ReconcileReport, error) {
+	accounts, err := store.ListUserDriveAccounts(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list drive accounts: %w", err)
+	}
+	files, err := store.ListUserStoredFiles(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list stored files: %w", err)
+	}
+
+	report := &models.ReconcileReport{
+		UserID:            userID,
+		Drives:            []models.DriveReconcile{},
+		MissingInMongo:    []models.ChunkDrift{},
+		MissingInManifest: []models.ChunkDrift{},
+		Mismatched:        []models.ChunkDrift{},
+		CheckedAt:         time.Now().UTC(),
+	}
+
+	storedFiles := make(map[primitive.ObjectID]*models.StoredFile, len(files))
+	storedChunks := make(map[chunkKey]models.StoredChunk)
+	for i := range files {
+		file := &files[i]
+		storedFiles[file.ID] = file
+		if file.Status == "deleted" {
+			continue
+		}
+		for _, chunk := range file.Chunks {
+			for _, replica := range chunk.Replicas {
+				storedChunks[chunkKey{file.ID, chunk.ChunkID, replica.DriveAccountID}] = chunk
+			}
+		}
+	}
+
+	linked := make(map[primitive.ObjectID]bool)
+	readable := make(map[primitive.ObjectID]bool)
+	seen := make(map[chunkKey]bool)
+	drifted := make(map[primitive.ObjectID]bool)
+	entries := make(map[primitive.ObjectID][]manifestEntry)
+
+	for _, account := range accounts {
+		linked[account.ID] = true
+		result := models.DriveReconcile{DriveAccountID: account.ID}
+
+		// Drift is collected per drive, so a manifest failing part way leaves no trace of it
+		var missing, mismatched []models.ChunkDrift
+		var driveEntries []manifestEntry
+		var driveSeen []chunkKey
+		found, err := Walk(ctx, account.ID, func(mf models.ManifestFile) error {
+			driveEntries = append(driveEntries, manifestEntry{accountID: account.ID, file: mf})
+			result.Files++
+			result.Chunks += len(mf.Chunks)
+
+			for _, mc := range mf.Chunks {
+				key := chunkKey{mf.FileID, mc.ChunkID, account.ID}
+				driveSeen = append(driveSeen, key)
+				drift := models.ChunkDrift{FileID: mf.FileID, ChunkID: mc.ChunkID, DriveAccountID: account.ID}
+
+				stored, ok := storedChunks[key]
+				if !ok {
+					drift.Detail = missingDetail(storedFiles[mf.FileID])
+					missing = append(missing, drift)
+					continue
+				}
+				if detail := chunkDifference(stored, account.ID, mc); detail != "" {
+					drift.Detail = detail
+					mismatched = append(mismatched, drift)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			report.Drives = append(report.Drives, models.DriveReconcile{DriveAccountID: account.ID, Error: err.Error()})
+			continue
+		}
+		readable[account.ID] = true
+		result.ManifestFound = found
+
+		for _, entry := range driveEntries {
+			entries[entry.file.FileID] = append(entries[entry.file.FileID], entry)
+		}
+		for _, key := range driveSeen {
+			seen[key] = true
+		}
+		for _, drift := range append(missing, mismatched...) {
+			drifted[drift.FileID] = true
+		}
+		report.MissingInMongo = append(report.MissingInMongo, missing...)
+		report.Mismatched = append(report.Mismatched, mismatched...)
+		report.Drives = append(report.Drives, result)
+	}
+
+	for key := range storedChunks {
+		if seen[key] {
+			continue
+		}
+		drift := models.ChunkDrift{FileID: key.fileID, ChunkID: key.chunkID, DriveAccountID: key.accountID}
+		switch {
+		case !linked[key.accountID]:
+			drift.Detail = "drive is not linked"
+		case !readable[key.accountID]:
+			// The manifest couldn't be read, its error is on the drive result
+			continue
+		default:
+			drift.Detail = "chunk not listed in the drive manifest"
+		}
+		report.MissingInManifest = append(report.MissingInManifest, drift)
+	}
+
+	sortDrift(report.MissingInMongo)
+	sortDrift(report.MissingInManifest)
+	sortDrift(report.Mismatched)
+
+	if repair {
+		report.Repaired = true
+		for fileID := range drifted {
+			if err := repairFile(ctx, userID, storedFiles[fileID], fileID, entries[fileID]); err != nil {
+				log.Printf("Failed to repair file %s from manifests: %v", fileID.Hex(), err)
+				continue
+			}
+			report.RepairedFiles = append(report.RepairedFiles, fileID.Hex())
+		}
+		sort.Strings(report.RepairedFiles)
+	}
+
+	return report, nil
+}
+
+// repairFile rewrites a file's Mongo record from its manifest entries
+func repairFile(ctx context.Context, userID primitive.ObjectID, stored *models.StoredFile, fileID primitive.ObjectID, entries []manifestEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	// Deleted files only linger in manifests whose cleanup failed, don't bring them back
+	if stored != nil && stored.Status == "deleted" {
+		return nil
+	}
+
+	var chunks []models.StoredChunk
+	if stored != nil {
+		chunks = stored.Chunks
+	}
+	chunks = mergeChunks(chunks, entries)
+
+	if stored != nil {
+		return store.UpdateStoredFileChunks(ctx, fileID, chunks)
+	}
+	return store.RestoreStoredFile(ctx, restoredFile(userID, fileID, entries[0].file, chunks))
+}
+
+// mergeChunks adds the chunks of the manifest entries to stored, sorted by chunk ID. A chunk
+// already there takes the manifest's details, its replicas on other drives stay.
+func mergeChunks(stored []models.StoredChunk, entries []manifestEntry) []models.StoredChunk {
+	var chunks []models.StoredChunk
+	index := make(map[int]int)
+	for _, chunk := range stored {
+		index[chunk.ChunkID] = len(chunks)
+		chunks = append(chunks, chunk)
+	}
+	for _, entry := range entries {
+		for _, mc := range entry.file.Chunks {
+			chunk := StoredChunk(entry.accountID, mc)
+			i, ok := index[mc.ChunkID]
+			if !ok {
+				index[mc.ChunkID] = len(chunks)
+				chunks = append(chunks, chunk)
+				continue
+			}
+			// The manifest's details win, the other drives keep their replicas
+			chunk.Replicas = append(chunk.Replicas, withoutReplica(chunks[i].Replicas, entry.accountID)...)
+			chunks[i] = chunk
+		}
+	}
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].ChunkID < chunks[j].ChunkID
+	})
+	return chunks
+}
+
+// restoredFile is the active file record of a file known only from its manifest entry
+func restoredFile(userID, fileID primitive.ObjectID, meta models.ManifestFile, chunks []models.StoredChunk) *models.StoredFile {
+	return &models.StoredFile{
+		ID:               fileID,
+		UserID:           userID,
+		OriginalFilename: meta.OriginalFilename,
+		ContentType:      meta.ContentType,
+		OriginalSize:     meta.OriginalSize,
+		ProcessedSize:    meta.ProcessedSize,
+		OriginalChecksum: meta.OriginalChecksum,
+		Obfuscation:      meta.Obfuscation,
+		Encryption:       meta.Encryption,
+		ClientEncryption: meta.ClientEncryption,
+		Chunks:           chunks,
+		ErasureCoding:    meta.ErasureCoding,
+		MerkleRoot:       meta.MerkleRoot,
+		Compress:         meta.Compress,
+		Status:           "active",
+		CreatedAt:        meta.CreatedAt,
+	}
+}
+
+func missingDetail(file *models.StoredFile) string {
+	switch {
+	case file == nil:
+		return "file not in mongo"
+	case file.Status == "deleted":
+		return "file was deleted"
+	default:
+		return "chunk not in mongo"
+	}
+}
+
+func withoutReplica(replicas []models.ChunkReplica, accountID primitive.ObjectID) []models.ChunkReplica {
+	out := make([]models.ChunkReplica, 0, len(replicas))
+	for _, r := range replicas {
+		if r.DriveAccountID != accountID {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// chunkDifference describes how a stored chunk differs from its entry in the given drive's manifest
+func chunkDifference(stored models.StoredChunk, accountID primitive.ObjectID, mc models.ManifestChunk) string {
+	replica, _ := stored.ReplicaOn(accountID)
+	switch {
+	case replica.DriveFileID != mc.DriveFileID:
+		return fmt.Sprintf("drive_file_id: mongo %s, manifest %s", replica.DriveFileID, mc.DriveFileID)
+	case stored.Checksum != mc.Checksum || stored.ChecksumAlgo != manifestChecksumAlgo(mc):
+		return "checksum differs"
+	case replica.Shard != mc.Shard || replica.Checksum != mc.ShardChecksum:
+		return "shard differs"
+	case stored.StartOffset != mc.StartOffset || stored.EndOffset != mc.EndOffset || stored.Size != mc.Size:
+		return "offsets differ"
+	case stored.StoredSize != mc.StoredSize:
+		return "stored_size differs"
+	default:
+		return ""
+	}
+}
+
+func sortDrift(drift []models.ChunkDrift) {
+	sort.Slice(drift, func(i, j int) bool {
+		if drift[i].FileID != drift[j].FileID {
+			return drift[i].FileID.Hex() < drift[j].FileID.Hex()
+		}
+		if drift[i].ChunkID != drift[j].ChunkID {
+			return drift[i].ChunkID < drift[j].ChunkID
+		}
+		return drift[i].DriveAccountID.Hex() < drift[j].DriveAccountID.Hex()
+	})
+}
@@ -0,0 +1,267 @@
+package manifest
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrVersionNotFound is returned when a drive doesn't keep the requested manifest version
+var ErrVersionNotFound = errors.New("manifest version not found")
+
+var keptVersions int
+
+// Largest manifest backup accepted by an import, in bytes
+var importBodyLimit int64
+
+// InitManifestConfig reads manifest settings from the environment
+func InitManifestConfig() {
+	// Previous manifests kept on each drive as 2xpfm.manifest.v<N>
+	keptVersions, _ = strconv.Atoi(os.Getenv("MANIFEST_VERSIONS"))
+	if keptVersions <= 0 {
+		keptVersions = 5
+	}
+
+	importMB, _ := strconv.ParseInt(os.Getenv("MANIFEST_IMPORT_MAX_MB"), 10, 64)
+	if importMB <= 0 {
+		importMB = 64
+	}
+	importBodyLimit = importMB << 20
+
+	// Files a manifest part holds on average, parts are doubled once they hold more
+	partFiles, _ = strconv.Atoi(os.Getenv("MANIFEST_PART_FILES"))
+	if partFiles <= 0 {
+		partFiles = 500
+	}
+}
+
+// GetImportBodyLimit returns the largest manifest backup an import accepts, in bytes
+func GetImportBodyLimit() int64 {
+	return importBodyLimit
+}
+
+func versionFilename(version int) string {
+	return fmt.Sprintf("%s.v%d", ManifestFilename, version)
+}
+
+// versions returns the Drive file IDs of the manifest versions kept on a drive, by version
+func versions(ctx context.Context, accountID primitive.ObjectID) (map[int]string, error) {
+	prefix := ManifestFilename + ".v"
+	files, err := drivemanager.FindDriveFilesByPrefix(ctx, accountID, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list manifest versions: %w", err)
+	}
+	out := make(map[int]string, len(files))
+	for name, id := range files {
+		v, err := strconv.Atoi(strings.TrimPrefix(name, prefix))
+		if err != nil {
+			continue
+		}
+		out[v] = id
+	}
+	return out, nil
+}
+
+// ListVersions returns the manifest versions kept on a drive, newest first
+func ListVersions(ctx context.Context, accountID primitive.ObjectID) ([]int, error) {
+	kept, err := versions(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]int, 0, len(kept))
+	for v := range kept {
+		out = append(out, v)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(out)))
+	return out, nil
+}
+
+// write replaces the drive's manifest with next, numbered one past current, writing the parts
+// given with their files and keeping the other parts next lists. The index being replaced,
+// raw, is first kept as version current so a bad write can be rolled back. Versions beyond
+// MANIFEST_VERSIONS, and the parts only they needed, are then dropped. existing are the part
+// files on the drive, see listParts. Callers hold the drive lock.
+func write(ctx context.Context, accountID primitive.ObjectID, fileID string, raw []byte, current int, next *models.DriveManifest, parts map[int][]models.ManifestFile, existing map[int]map[int]string) error {
+	kept, err := versions(ctx, accountID)
+	if err != nil {
+		return err
+	}
+
+	if raw != nil {
+		// A version left by an earlier attempt whose manifest write failed is overwritten
+		if _, err := drivemanager.WriteDriveFile(ctx, accountID, kept[current], versionFilename(current), raw); err != nil {
+			return fmt.Errorf("failed to keep manifest version %d: %w", current, err)
+		}
+		kept[current] = ""
+	} else {
+		// The manifest itself is gone but its versions may not be, carry on after them
+		for v := range kept {
+			current = max(current, v)
+		}
+	}
+
+	next.Version = current + 1
+	next.UpdatedAt = time.Now().UTC()
+
+	// Part files of this version are left by an earlier attempt whose index write failed, no
+	// version lists them. Those of the parts written now are overwritten.
+	for part, byVersion := range existing {
+		for v, id := range byVersion {
+			if v < next.Version {
+				continue
+			}
+			if _, writing := parts[part]; writing && v == next.Version {
+				continue
+			}
+			if err := drivemanager.DeleteDriveFile(ctx, accountID, id); err != nil {
+				return fmt.Errorf("failed to delete unused manifest part %d: %w", part, err)
+			}
+			delete(byVersion, v)
+		}
+	}
+	for part, files := range parts {
+		written, err := writePart(ctx, accountID, existing[part][next.Version], part, next.Version, files)
+		if err != nil {
+			return err
+		}
+		next.Parts[part] = written
+		if existing[part] == nil {
+			existing[part] = make(map[int]string)
+		}
+		existing[part][next.Version] = written.DriveFileID
+	}
+
+	data, err := json.MarshalIndent(next, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	if _, err := drivemanager.WriteDriveFile(ctx, accountID, fileID, ManifestFilename, data); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	// Old versions and parts that can't be deleted now go on the next write
+	for v, id := range kept {
+		if v > current-keptVersions || id == "" {
+			continue
+		}
+		if err := drivemanager.DeleteDriveFile(ctx, accountID, id); err != nil {
+			log.Printf("Failed to delete manifest version %d on drive %s: %v", v, accountID.Hex(), err)
+		}
+	}
+	for _, id := range stalePartFiles(existing, current-keptVersions+1) {
+		if err := drivemanager.DeleteDriveFile(ctx, accountID, id); err != nil {
+			log.Printf("Failed to delete manifest part on drive %s: %v", accountID.Hex(), err)
+		}
+	}
+	return nil
+}
+
+// Delete removes the drive's manifest with its parts and every version kept of it
+func Delete(ctx context.Context, accountID primitive.ObjectID) error {
+	unlock := lockDrive(accountID)
+	defer unlock()
+
+	fileID, err := drivemanager.FindDriveFileByName(ctx, accountID, ManifestFilename)
+	if err != nil {
+		return fmt.Errorf("failed to find manifest: %w", err)
+	}
+	kept, err := versions(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	parts, err := listParts(ctx, accountID)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(kept)+len(parts)+1)
+	for _, id := range kept {
+		ids = append(ids, id)
+	}
+	for _, byVersion := range parts {
+		for _, id := range byVersion {
+			ids = append(ids, id)
+		}
+	}
+	if fileID != "" {
+		ids = append(ids, fileID)
+	}
+	for _, id := range ids {
+		if err := drivemanager.DeleteDriveFile(ctx, accountID, id); err != nil {
+			return fmt.Errorf("failed to delete manifest: %w", err)
+		}
+	}
+	return nil
+}
+
+// RestoreManifest makes a kept version the drive's manifest again. The manifest it replaces,
+// even one that no longer parses, is kept as a version itself, and the restored manifest gets
+// the next version number so versions keep increasing. Its files are written to parts anew,
+// so the parts of the version restored are dropped with it in time.
+func RestoreManifest(ctx context.Context, accountID primitive.ObjectID, version int) (*models.DriveManifest, error) {
+	unlock := lockDrive(accountID)
+	defer unlock()
+
+	kept, err := versions(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	versionID, ok := kept[version]
+	if !ok {
+		return nil, ErrVersionNotFound
+	}
+
+	data, err := downloadManifest(ctx, accountID, versionID)
+	if err != nil {
+		return nil, err
+	}
+	var restored models.DriveManifest
+	if err := json.Unmarshal(data, &restored); err != nil {
+		return nil, fmt.Errorf("manifest version %d is unreadable: %w", version, err)
+	}
+	if restored.DriveAccountID != accountID {
+		return nil, fmt.Errorf("manifest version %d belongs to drive %s", version, restored.DriveAccountID.Hex())
+	}
+	files, err := allFiles(ctx, accountID, &restored)
+	if err != nil {
+		return nil, fmt.Errorf("manifest version %d is unreadable: %w", version, err)
+	}
+
+	current, raw, fileID, err := loadIndex(ctx, accountID)
+	if err != nil && raw == nil {
+		return nil, err
+	}
+	existing, err := listParts(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	// A corrupted manifest has no usable version, number it after the newest kept one
+	var currentVersion int
+	if current != nil {
+		currentVersion = current.Version
+	} else if raw != nil {
+		for v := range kept {
+			currentVersion = max(currentVersion, v+1)
+		}
+	}
+
+	restored.Files = nil
+	restored.Parts = make([]models.ManifestPart, partCount(max(len(restored.Parts), highestPart(existing)), len(files)))
+	if err := write(ctx, accountID, fileID, raw, currentVersion, &restored, spread(files, len(restored.Parts)), existing); err != nil {
+		return nil, err
+	}
+	restored.Files = files
+	return &restored, nil
+}
@@ -0,0 +1,237 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	enabled bool
+	addr    string
+)
+
+// InitMetricsConfig reads the metrics settings from the environment
+func InitMetricsConfig() {
+	// /metrics is only served when enabled
+	enabled, _ = strconv.ParseBool(os.Getenv("METRICS_ENABLED"))
+
+	// Optional separate listen address, e.g. ":9090", so metrics can stay off the public port
+	addr = os.Getenv("METRICS_ADDR")
+}
+
+// Enabled reports whether /metrics should be served
+func Enabled() bool {
+	return enabled
+}
+
+// Addr returns the separate address to serve /metrics on, "" to serve it on the API server
+func Addr() string {
+	return addr
+}
+
+// Pipeline metrics, served in the Prometheus text format. Callers only update these,
+// nothing else depends on how they are exported.
+var (
+	UploadBytes            = newCounter("vcrypt_upload_bytes_total", "Bytes received from clients in upload chunks.")
+	ChunkUploadDuration    = newHistogram("vcrypt_chunk_upload_duration_seconds", "Time to upload one copy of a chunk to a drive.", []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300})
+	DriveRequests          = newCounterVec("vcrypt_drive_requests_total", "Drive API requests by response status, \"error\" when no response arrived.", "status")
+	ReconstructionDuration = newHistogram("vcrypt_reconstruction_duration_seconds", "Time to reconstruct a stored file for download.", []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800})
+	ChunkCacheRequests     = newCounterVec("vcrypt_chunk_cache_requests_total", "Chunk cache lookups of downloads by result: hit, miss, or invalid for a cached copy that failed its checksum.", "result")
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+}
+
+// Counter only goes up
+type Counter struct {
+	name, help string
+	mu         sync.Mutex
+	value      float64
+}
+
+func newCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	register(c)
+	return c
+}
+
+func (c *Counter) Add(v float64) {
+	c.mu.Lock()
+	c.value += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.value))
+}
+
+// CounterVec is a counter split by the values of one label
+type CounterVec struct {
+	name, help, label string
+	mu                sync.Mutex
+	values            map[string]float64
+}
+
+func newCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{name: name, help: help, label: label, values: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValue string) {
+	c.mu.Lock()
+	c.values[labelValue]++
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%s} %s\n", c.name, c.label, strconv.Quote(k), formatFloat(c.values[k]))
+	}
+}
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct {
+	name, help string
+	bounds     []float64
+	mu         sync.Mutex
+	counts     []uint64 // Per bucket, the last one is +Inf
+	sum        float64
+	count      uint64
+}
+
+func newHistogram(name, help string, bounds []float64) *Histogram {
+	h := &Histogram{name: name, help: help, bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+// Since observes the seconds elapsed since start
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.name, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// gaugeFunc is a gauge read when metrics are scraped
+type gaugeFunc struct {
+	name, help string
+	fn         func(ctx context.Context) (float64, error)
+}
+
+// RegisterGaugeFunc adds a gauge whose value fn looks up on every scrape. A failed lookup
+// leaves the gauge out of that scrape.
+func RegisterGaugeFunc(name, help string, fn func(ctx context.Context) (float64, error)) {
+	register(&gaugeFunc{name: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	v, err := g.fn(ctx)
+	if err != nil {
+		log.Printf("Failed to read metric %s: %v", g.name, err)
+		return
+	}
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(v))
+}
+
+// Handler serves every registered metric
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryMu.Lock()
+		metrics := append([]metric(nil), registry...)
+		registryMu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, m := range metrics {
+			m.write(w)
+		}
+	})
+}
+
+// InstrumentRoundTripper counts every request made through base in counter, by status
+func InstrumentRoundTripper(counter *CounterVec, base http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := base.RoundTrip(req)
+		if err != nil {
+			counter.Inc("error")
+		} else {
+			counter.Inc(strconv.Itoa(resp.StatusCode))
+		}
+		return resp, err
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
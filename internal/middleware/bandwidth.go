@@ -0,0 +1,239 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Default transfer caps in bytes per second, 0 is unlimited
+var (
+	defaultUserBandwidth    int64
+	defaultRequestBandwidth int64
+)
+
+// Bytes a throttled read or write moves between waits, keeps transfers smooth
+const throttleStep = 32 * 1024
+
+// InitBandwidthConfig reads the transfer caps applied to uploads and downloads. Users can
+// carry their own caps that replace these.
+func InitBandwidthConfig() {
+	// Cap on everything transferred for one user at once, across requests and chunk workers
+	defaultUserBandwidth, _ = strconv.ParseInt(os.Getenv("BANDWIDTH_USER_BPS"), 10, 64)
+	if defaultUserBandwidth < 0 {
+		defaultUserBandwidth = 0
+	}
+
+	// Cap on a single upload or download
+	defaultRequestBandwidth, _ = strconv.ParseInt(os.Getenv("BANDWIDTH_REQUEST_BPS"), 10, 64)
+	if defaultRequestBandwidth < 0 {
+		defaultRequestBandwidth = 0
+	}
+
+	log.Printf("Bandwidth limits: %s per user, %s per request", formatBandwidth(defaultUserBandwidth), formatBandwidth(defaultRequestBandwidth))
+}
+
+func formatBandwidth(bps int64) string {
+	if bps == 0 {
+		return "unlimited"
+	}
+	return strconv.FormatInt(bps, 10) + " B/s"
+}
+
+// BandwidthLimiter is a token bucket of bytes. Waiters take their bytes up front and sleep off
+// the debt, so concurrent transfers sharing a limiter stay within its rate together.
+type BandwidthLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// NewBandwidthLimiter returns a limiter of bps bytes per second, nil when bps is 0
+func NewBandwidthLimiter(bps int64) *BandwidthLimiter {
+	if bps <= 0 {
+		return nil
+	}
+	return &BandwidthLimiter{rate: float64(bps), tokens: float64(bps), last: time.Now()}
+}
+
+// Wait takes n bytes from the limiter, blocking until the rate allows them
+func (l *BandwidthLimiter) Wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	// One second of transfer can build up while idle
+	l.tokens = math.Min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	debt := l.tokens
+	l.mu.Unlock()
+
+	if debt >= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(-debt / l.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *BandwidthLimiter) setRate(bps int64) {
+	l.mu.Lock()
+	l.rate = float64(bps)
+	l.mu.Unlock()
+}
+
+// idle reports whether the limiter has refilled completely, a new one behaves the same
+func (l *BandwidthLimiter) idle() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.tokens+time.Since(l.last).Seconds()*l.rate >= l.rate
+}
+
+// userLimiters are shared by every transfer of a user
+var (
+	userLimitersMu   sync.Mutex
+	userLimiters     = make(map[primitive.ObjectID]*BandwidthLimiter)
+	userLimitersOnce sync.Once
+)
+
+func userLimiter(userID primitive.ObjectID, bps int64) *BandwidthLimiter {
+	if bps <= 0 {
+		return nil
+	}
+	userLimitersOnce.Do(func() { go evictIdleUserLimiters() })
+
+	userLimitersMu.Lock()
+	defer userLimitersMu.Unlock()
+	l, ok := userLimiters[userID]
+	if !ok {
+		l = NewBandwidthLimiter(bps)
+		userLimiters[userID] = l
+	} else {
+		// The user's cap may have been changed since
+		l.setRate(bps)
+	}
+	return l
+}
+
+func evictIdleUserLimiters() {
+	for range time.Tick(time.Minute) {
+		userLimitersMu.Lock()
+		for id, l := range userLimiters {
+			if l.idle() {
+				delete(userLimiters, id)
+			}
+		}
+		userLimitersMu.Unlock()
+	}
+}
+
+// WithBandwidth returns ctx carrying the user's transfer caps: a limiter shared by all of
+// the user's transfers and a new one for this transfer alone. userBPS and requestBPS are
+// the user's own caps, nil for the configured defaults.
+func WithBandwidth(ctx context.Context, userID primitive.ObjectID, userBPS, requestBPS *int64) context.Context {
+	perUser, perRequest := defaultUserBandwidth, defaultRequestBandwidth
+	if userBPS != nil {
+		perUser = *userBPS
+	}
+	if requestBPS != nil {
+		perRequest = *requestBPS
+	}
+
+	var limiters []*BandwidthLimiter
+	if l := userLimiter(userID, perUser); l != nil {
+		limiters = append(limiters, l)
+	}
+	if l := NewBandwidthLimiter(perRequest); l != nil {
+		limiters = append(limiters, l)
+	}
+	if len(limiters) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, "bandwidth", limiters)
+}
+
+// WaitBandwidth takes n bytes from every limiter in ctx, a ctx without limiters never waits
+func WaitBandwidth(ctx context.Context, n int) error {
+	limiters, _ := ctx.Value("bandwidth").([]*BandwidthLimiter)
+	for _, l := range limiters {
+		if err := l.Wait(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasBandwidthLimits(ctx context.Context) bool {
+	limiters, _ := ctx.Value("bandwidth").([]*BandwidthLimiter)
+	return len(limiters) > 0
+}
+
+// ThrottleReader returns r limited to the caps in ctx
+func ThrottleReader(ctx context.Context, r io.Reader) io.Reader {
+	if !hasBandwidthLimits(ctx) {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r}
+}
+
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleStep {
+		p = p[:throttleStep]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := WaitBandwidth(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// ThrottleResponseWriter returns w with its body limited to the caps in ctx
+func ThrottleResponseWriter(ctx context.Context, w http.ResponseWriter) http.ResponseWriter {
+	if !hasBandwidthLimits(ctx) {
+		return w
+	}
+	return &throttledResponseWriter{ResponseWriter: w, ctx: ctx}
+}
+
+// throttledResponseWriter hides ReadFrom, so copies into it go through Write
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+}
+
+func (t *throttledResponseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		step := min(len(p), throttleStep)
+		if err := WaitBandwidth(t.ctx, step); err != nil {
+			return written, err
+		}
+		n, err := t.ResponseWriter.Write(p[:step])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[step:]
+	}
+	return written, nil
+}
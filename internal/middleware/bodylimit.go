@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Largest JSON request body accepted by LimitJSONBody
+var jsonBodyLimit int64
+
+// InitBodyLimitConfig reads the request body cap of JSON routes
+func InitBodyLimitConfig() {
+	kb, _ := strconv.ParseInt(os.Getenv("MAX_JSON_BODY_KB"), 10, 64)
+	if kb <= 0 {
+		kb = 1024
+	}
+	jsonBodyLimit = kb << 10
+	log.Printf("JSON request bodies capped at %d KB", kb)
+}
+
+// LimitBody returns a middleware capping request bodies at limit bytes. A body that declares a
+// larger Content-Length is refused with 413 up front, a longer chunked body fails to read with
+// an *http.MaxBytesError that WriteDecodeError turns into a 413.
+func LimitBody(limit int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			WriteBodyTooLarge(w, limit)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next(w, r)
+	}
+}
+
+// LimitJSONBody caps request bodies at MAX_JSON_BODY_KB, for routes taking a JSON request
+func LimitJSONBody(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		LimitBody(jsonBodyLimit, next)(w, r)
+	}
+}
+
+// WriteBodyTooLarge writes the 413 of a request body over limit bytes
+func WriteBodyTooLarge(w http.ResponseWriter, limit int64) {
+	WriteJSONErrorDetails(w, http.StatusRequestEntityTooLarge, ErrCodeBodyTooLarge, "request body too large", map[string]interface{}{
+		"limit_bytes": limit,
+	})
+}
+
+// IsBodyTooLarge reports whether err comes from reading past a body cap
+func IsBodyTooLarge(err error) (int64, bool) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return maxErr.Limit, true
+	}
+	return 0, false
+}
+
+// WriteDecodeError writes the error response of a request body that failed to decode: a 413
+// when it ran past its cap, otherwise a 400 with message
+func WriteDecodeError(w http.ResponseWriter, err error, message string) {
+	if limit, ok := IsBodyTooLarge(err); ok {
+		WriteBodyTooLarge(w, limit)
+		return
+	}
+	WriteJSONError(w, http.StatusBadRequest, ErrCodeInvalidRequest, message)
+}
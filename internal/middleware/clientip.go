@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Proxies whose X-Forwarded-For and X-Real-IP are believed, set by InitProxyConfig
+var trustedProxies []*net.IPNet
+
+// InitProxyConfig reads the proxies in front of the server, TRUSTED_PROXIES, a comma separated
+// list of IPs and CIDRs. Without it, forwarding headers are ignored.
+func InitProxyConfig() {
+	trustedProxies = nil
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				log.Fatalf("TRUSTED_PROXIES: invalid address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			trustedProxies = append(trustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Fatalf("TRUSTED_PROXIES: invalid network %q", entry)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	if len(trustedProxies) > 0 {
+		log.Printf("Trusted proxies: %d", len(trustedProxies))
+	}
+}
+
+// ClientIP returns the address of the client, RemoteAddr unless the request comes from a
+// trusted proxy. Through trusted proxies it's the last X-Forwarded-For address not of one of
+// them, anything left of it may be made up by the client, or else X-Real-IP.
+func ClientIP(r *http.Request) string {
+	if !trustedProxy(hostOnly(r.RemoteAddr)) {
+		return r.RemoteAddr
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !trustedProxy(hop) {
+			return hop
+		}
+	}
+	if xrip := strings.TrimSpace(r.Header.Get("X-Real-IP")); xrip != "" {
+		return xrip
+	}
+	return r.RemoteAddr
+}
+
+// trustedProxy reports whether addr is one of TRUSTED_PROXIES
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,285 @@
+package middleware
+
+import (
+	"bufio"
+	"compress/gzip"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Response compression, set by InitCompressConfig
+var (
+	compressResponses = true
+	// Responses shorter than this are sent as they are, gzip would only add its overhead
+	compressMinBytes = 1024
+)
+
+// InitCompressConfig reads whether responses are gzipped, COMPRESS_RESPONSES, and the size
+// below which they aren't, COMPRESS_MIN_BYTES
+func InitCompressConfig() {
+	compressResponses = true
+	if v := os.Getenv("COMPRESS_RESPONSES"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("COMPRESS_RESPONSES must be true or false, got %q", v)
+		}
+		compressResponses = b
+	}
+
+	compressMinBytes = 1024
+	if v := os.Getenv("COMPRESS_MIN_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("COMPRESS_MIN_BYTES must be a non-negative number, got %q", v)
+		}
+		compressMinBytes = n
+	}
+}
+
+// Content types that are compressed already, or are ciphertext gzip can't shrink
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/octet-stream",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/zstd",
+	"application/pdf",
+	// Sent event by event, it shouldn't wait on the compressor
+	"text/event-stream",
+}
+
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(contentType)
+	}
+	// SVG is text
+	if mediaType == "image/svg+xml" {
+		return true
+	}
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding takes gzip, by name or as *,
+// without a q of 0
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			q := strings.TrimSpace(params)
+			if v, ok := strings.CutPrefix(q, "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil && f == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+// Compress returns a middleware gzipping responses of clients that send Accept-Encoding: gzip.
+// A response is held back until it reaches COMPRESS_MIN_BYTES, so a shorter one goes out as is.
+// Responses are left alone when their content type is already compressed, when the handler set
+// a Content-Encoding, and when they offer byte ranges: the file downloads, whose Range and
+// Content-Length are about the raw bytes. A response flushed before it reaches the threshold is
+// streamed uncompressed. Every response that could be compressed carries Vary: Accept-Encoding.
+func Compress(next http.Handler) http.Handler {
+	if !compressResponses {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &compressWriter{ResponseWriter: w, gzipOK: acceptsGzip(r) && r.Method != http.MethodHead}
+		next.ServeHTTP(cw, r)
+		// Not deferred, a handler that panics has its connection dropped rather than a 200
+		cw.close()
+	})
+}
+
+// compressWriter buffers the start of a response until it knows whether to gzip it
+type compressWriter struct {
+	http.ResponseWriter
+	gzipOK   bool // The client takes gzip
+	status   int
+	buf      []byte
+	started  bool // Headers have gone out, through gz when it's set
+	hijacked bool
+	gz       *gzip.Writer
+}
+
+// eligible reports whether the response could be gzipped, whatever its size
+func (cw *compressWriter) eligible() bool {
+	h := cw.Header()
+	switch {
+	case cw.status == http.StatusNoContent, cw.status == http.StatusNotModified, cw.status == http.StatusPartialContent:
+		return false
+	case h.Get("Content-Encoding") != "", h.Get("Accept-Ranges") != "", h.Get("Content-Range") != "":
+		return false
+	}
+	return compressibleType(h.Get("Content-Type"))
+}
+
+// start sends the headers, gzipping the body from here on when compress and the response is
+// eligible
+func (cw *compressWriter) start(compress bool) {
+	cw.started = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	h := cw.Header()
+	// Sniffed from the plain bytes, net/http would sniff the gzipped ones
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if cw.eligible() {
+		h.Add("Vary", "Accept-Encoding")
+		if compress && cw.gzipOK {
+			h.Set("Content-Encoding", "gzip")
+			h.Del("Content-Length")
+			cw.gz = gzipWriters.Get().(*gzip.Writer)
+			cw.gz.Reset(cw.ResponseWriter)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+// writeBuffered sends what was held back, once the response has started
+func (cw *compressWriter) writeBuffered() error {
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	buf := cw.buf
+	cw.buf = nil
+	var err error
+	if cw.gz != nil {
+		_, err = cw.gz.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.started || cw.hijacked {
+		return
+	}
+	// Informational responses go out right away, the final one follows
+	if code >= 100 && code < 200 {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if cw.status == 0 {
+		cw.status = code
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if !cw.started {
+		if !cw.gzipOK {
+			cw.start(false)
+		} else {
+			cw.buf = append(cw.buf, b...)
+			if len(cw.buf) < compressMinBytes {
+				return len(b), nil
+			}
+			cw.start(true)
+			if err := cw.writeBuffered(); err != nil {
+				return 0, err
+			}
+			return len(b), nil
+		}
+	}
+	if cw.gz != nil {
+		return cw.gz.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// close ends the response once the handler returned, sending a short one uncompressed
+func (cw *compressWriter) close() {
+	if cw.hijacked {
+		return
+	}
+	if !cw.started {
+		cw.start(len(cw.buf) > 0 && len(cw.buf) >= compressMinBytes)
+	}
+	cw.writeBuffered()
+	if cw.gz != nil {
+		cw.gz.Close()
+		cw.gz.Reset(nil)
+		gzipWriters.Put(cw.gz)
+		cw.gz = nil
+	}
+}
+
+// Flush sends everything written so far, starting a response still under the threshold
+// uncompressed
+func (cw *compressWriter) Flush() {
+	if cw.hijacked {
+		return
+	}
+	if !cw.started {
+		cw.start(false)
+	}
+	cw.writeBuffered()
+	if cw.gz != nil {
+		cw.gz.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Support http.Hijacker when the underlying writer supports it
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok || cw.started {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil {
+		cw.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Support http.Pusher (HTTP/2) when the underlying writer supports it
+func (cw *compressWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := cw.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
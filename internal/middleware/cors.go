@@ -1,15 +1,107 @@
 package middleware
 
 import (
+	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 )
 
-// CORS returns a middleware that sets permissive CORS headers based on allowed origins.
-// Pass []string{"*"} to allow all origins (default now). Later, replace with specific origins like
-// []string{"http://localhost:3000", "https://yourapp.com"}.
-func CORS(allowedOrigins []string) func(http.Handler) http.Handler {
+// CORS settings of the route groups, set by InitCORSConfig
+var (
+    apiOrigins   []string
+    oauthOrigins []string
+    // Whether browsers may send cookies and HTTP auth along to the API and OAuth routes
+    allowCredentials bool
+    // How long browsers may cache a preflight answer
+    preflightMaxAge = 24 * time.Hour
+)
+
+// Response headers browser clients may read besides the CORS-safelisted ones: the request ID
+// for bug reports, the validators and ranges of downloads, when to retry, and the salt of
+// client-encrypted downloads
+var exposeHeaders = strings.Join([]string{
+    RequestIDHeader, "ETag", "Last-Modified", "Accept-Ranges", "Content-Range", "Content-Disposition",
+    "Allow", "Retry-After", "Idempotent-Replayed", "X-Client-Encrypted", "X-Key-Salt", "X-Export-ID",
+    APIVersionHeader, "Deprecation", "Link", "Sunset",
+}, ", ")
+
+// InitCORSConfig reads the allowed origins of the authenticated API from CORS_ALLOWED_ORIGINS
+// (comma separated, "*" when unset) and of the OAuth routes from OAUTH_CORS_ALLOWED_ORIGINS
+// (none when unset, browsers reach those by redirect rather than by script).
+// CORS_ALLOW_CREDENTIALS lets those routes be called with credentials, and CORS_MAX_AGE_SECONDS
+// sets how long browsers cache preflight answers.
+func InitCORSConfig() {
+    apiOrigins = splitOrigins(os.Getenv("CORS_ALLOWED_ORIGINS"))
+    if len(apiOrigins) == 0 {
+        apiOrigins = []string{"*"}
+    }
+    oauthOrigins = splitOrigins(os.Getenv("OAUTH_CORS_ALLOWED_ORIGINS"))
+
+    if v := os.Getenv("CORS_ALLOW_CREDENTIALS"); v != "" {
+        b, err := strconv.ParseBool(v)
+        if err != nil {
+            log.Fatalf("CORS_ALLOW_CREDENTIALS must be true or false, got %q", v)
+        }
+        allowCredentials = b
+    }
+    if allowCredentials && hasWildcardOrigin(apiOrigins) {
+        log.Printf("Warning: CORS_ALLOW_CREDENTIALS is set while CORS_ALLOWED_ORIGINS allows any origin, every site can make credentialed requests to the API")
+    }
+
+    if v := os.Getenv("CORS_MAX_AGE_SECONDS"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 {
+            log.Fatalf("CORS_MAX_AGE_SECONDS must be a non-negative number, got %q", v)
+        }
+        preflightMaxAge = time.Duration(n) * time.Second
+    }
+}
+
+// APIOrigins returns the origins allowed to call the API routes
+func APIOrigins() []string {
+    return apiOrigins
+}
+
+// OAuthOrigins returns the origins allowed to call the OAuth routes
+func OAuthOrigins() []string {
+    return oauthOrigins
+}
+
+// AllowCredentials reports whether the API and OAuth routes may be called with credentials
+func AllowCredentials() bool {
+    return allowCredentials
+}
+
+func hasWildcardOrigin(origins []string) bool {
+    for _, o := range origins {
+        if strings.TrimSpace(o) == "*" {
+            return true
+        }
+    }
+    return false
+}
+
+func splitOrigins(list string) []string {
+    origins := make([]string, 0)
+    for _, o := range strings.Split(list, ",") {
+        if o = strings.TrimSpace(o); o != "" {
+            origins = append(origins, o)
+        }
+    }
+    return origins
+}
+
+// CORS returns a middleware that sets CORS headers based on allowed origins. Pass []string{"*"}
+// to allow all origins, specific origins like []string{"http://localhost:3000", "https://yourapp.com"}
+// or nothing to allow none. With allowCredentials the requesting origin is echoed back even for
+// "*", browsers refuse credentialed responses allowing any origin. Each route group gets its
+// own, so it must wrap the route's auth and method checks for preflight requests to be answered:
+// it sets the origin, header and max-age of a preflight, and the route answers it with its
+// methods through WriteOptions.
+func CORS(allowedOrigins []string, allowCredentials bool) func(http.Handler) http.Handler {
     // Normalize allowed origins once
     norm := make([]string, 0, len(allowedOrigins))
     hasWildcard := false
@@ -23,10 +115,9 @@ func CORS(allowedOrigins []string) func(http.Handler) http.Handler {
         }
     }
 
-    allowMethods := "GET, POST, PUT, PATCH, DELETE, OPTIONS"
     // Typical headers used by browsers and APIs; during preflight we mirror the request headers when provided
-    defaultAllowHeaders := "Authorization, Content-Type, Accept, X-Requested-With"
-    maxAge := 24 * time.Hour
+    defaultAllowHeaders := "Authorization, Content-Type, Accept, X-Requested-With, X-Request-ID, Idempotency-Key, X-Chunk-Size, X-Chunk-Checksum, Accept-Version"
+    maxAge := toSeconds(preflightMaxAge)
 
     originAllowed := func(origin string) bool {
         if origin == "" {
@@ -53,32 +144,25 @@ func CORS(allowedOrigins []string) func(http.Handler) http.Handler {
             w.Header().Add("Vary", "Access-Control-Request-Headers")
 
             if originAllowed(origin) {
-                // If wildcard is used and credentials are NOT used, we can safely return "*"
-                if hasWildcard {
+                if hasWildcard && !allowCredentials {
                     w.Header().Set("Access-Control-Allow-Origin", "*")
                 } else {
-                    // Echo back the requesting origin when doing an allowlist
+                    // Echo back the requesting origin when doing an allowlist or allowing credentials
                     w.Header().Set("Access-Control-Allow-Origin", origin)
                 }
-                // Not enabling credentials by default. If you need credentials, set this to true and
-                // ensure you DO NOT use wildcard origins (browsers block that combination).
-                // w.Header().Set("Access-Control-Allow-Credentials", "true")
-
-                // Preflight handling
-                if r.Method == http.MethodOptions {
-                    reqMethod := r.Header.Get("Access-Control-Request-Method")
-                    if reqMethod != "" {
-                        w.Header().Set("Access-Control-Allow-Methods", allowMethods)
-                        reqHeaders := r.Header.Get("Access-Control-Request-Headers")
-                        if reqHeaders != "" {
-                            w.Header().Set("Access-Control-Allow-Headers", reqHeaders)
-                        } else {
-                            w.Header().Set("Access-Control-Allow-Headers", defaultAllowHeaders)
-                        }
-                        w.Header().Set("Access-Control-Max-Age", toSeconds(maxAge))
-                        w.WriteHeader(http.StatusNoContent)
-                        return
+                if allowCredentials {
+                    w.Header().Set("Access-Control-Allow-Credentials", "true")
+                }
+                w.Header().Set("Access-Control-Expose-Headers", exposeHeaders)
+
+                if IsPreflight(r) {
+                    reqHeaders := r.Header.Get("Access-Control-Request-Headers")
+                    if reqHeaders != "" {
+                        w.Header().Set("Access-Control-Allow-Headers", reqHeaders)
+                    } else {
+                        w.Header().Set("Access-Control-Allow-Headers", defaultAllowHeaders)
                     }
+                    w.Header().Set("Access-Control-Max-Age", maxAge)
                 }
             }
 
@@ -87,6 +171,11 @@ func CORS(allowedOrigins []string) func(http.Handler) http.Handler {
     }
 }
 
+// IsPreflight reports whether the request is a CORS preflight
+func IsPreflight(r *http.Request) bool {
+    return r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
 func toSeconds(d time.Duration) string {
     return strconvFormatInt(int64(d/time.Second))
 }
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error codes of JSON error responses. Clients match on these, so they never change meaning;
+// add a new code instead.
+const (
+	ErrCodeInvalidRequest      = "invalid_request"
+	ErrCodeUnauthorized        = "unauthorized"
+	ErrCodeForbidden           = "forbidden"
+	ErrCodeNotFound            = "not_found"
+	ErrCodeMethodNotAllowed    = "method_not_allowed"
+	ErrCodeConflict            = "conflict"
+	ErrCodeGone                = "gone"
+	ErrCodePreconditionFailed  = "precondition_failed"
+	ErrCodeFileUnavailable     = "file_unavailable"
+	ErrCodeTooLarge            = "too_large"
+	ErrCodeBodyTooLarge        = "body_too_large"
+	ErrCodeRateLimited         = "rate_limited"
+	ErrCodeQuotaExceeded       = "quota_exceeded"
+	ErrCodeInsufficientStorage = "insufficient_storage"
+	ErrCodeDiskFull            = "disk_full"
+	ErrCodeInvalidChunk        = "invalid_chunk"
+	ErrCodeRangeNotSatisfiable = "range_not_satisfiable"
+	ErrCodeUploadIncomplete    = "upload_incomplete"
+	ErrCodeUploadMismatch      = "upload_mismatch"
+	ErrCodeDriveUnreachable    = "drive_unreachable"
+	ErrCodeRemoteUnreachable   = "remote_unreachable"
+	ErrCodeTimeout             = "timeout"
+	ErrCodeInvalidCredentials  = "invalid_credentials"
+	ErrCodeInvalidToken        = "invalid_token"
+	ErrCodeInvalidCode         = "invalid_code"
+	ErrCodeEmailExists         = "email_exists"
+	ErrCodeEmailUnverified     = "email_unverified"
+	ErrCodeWeakPassword        = "weak_password"
+	ErrCodeOAuthFailed         = "oauth_failed"
+	ErrCodeOAuthStateInvalid   = "oauth_state_invalid"
+	ErrCodeOAuthStateUsed      = "oauth_state_used"
+	ErrCodeOAuthStateExpired   = "oauth_state_expired"
+	ErrCodeInternal            = "internal_error"
+	ErrCodeUnsupportedVersion  = "unsupported_version"
+)
+
+// WriteJSONError writes an error response of {code, message, request_id}
+func WriteJSONError(w http.ResponseWriter, status int, code, message string) {
+	WriteJSONErrorDetails(w, status, code, message, nil)
+}
+
+// WriteJSONErrorDetails writes an error response like WriteJSONError with the extra fields of
+// details added to the body
+func WriteJSONErrorDetails(w http.ResponseWriter, status int, code, message string, details map[string]interface{}) {
+	body := make(map[string]interface{}, len(details)+3)
+	for k, v := range details {
+		body[k] = v
+	}
+	body["code"] = code
+	body["message"] = message
+	// RequestID has set the header by the time a handler writes an error
+	body["request_id"] = w.Header().Get(RequestIDHeader)
+
+	// Headers set for a body that never came, like a download's, don't describe this one
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -3,15 +3,108 @@ package middleware
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// jsonLogs switches Logger to one JSON object per request
+var jsonLogs bool
+
+// jsonLogger writes bare JSON lines, without the timestamp prefix of the standard logger
+var jsonLogger = log.New(os.Stderr, "", 0)
+
+// Request log levels, a request is logged at error for 5xx, warn for 4xx and info otherwise.
+// Debug also logs body previews.
+const (
+    levelError = iota
+    levelWarn
+    levelInfo
+    levelDebug
+)
+
+var levelNames = map[string]int{"error": levelError, "warn": levelWarn, "info": levelInfo, "debug": levelDebug}
+
+var levelLabels = []string{"error", "warn", "info", "debug"}
+
+var (
+    // logLevel is the least severe level of requests that are logged
+    logLevel = levelInfo
+    // logSampleRate logs 1 in every logSampleRate successful requests, errors are always logged
+    logSampleRate uint64 = 1
+    // Successful requests seen, for sampling
+    logSampleCount atomic.Uint64
+)
+
+// InitLogConfig reads the request log format, LOG_FORMAT=json for JSON lines, text otherwise,
+// the LOG_LEVEL (error, warn, info or debug) and LOG_SAMPLE_RATE
+func InitLogConfig() {
+    jsonLogs = strings.EqualFold(os.Getenv("LOG_FORMAT"), "json")
+
+    if name := os.Getenv("LOG_LEVEL"); name != "" {
+        level, ok := levelNames[strings.ToLower(name)]
+        if !ok {
+            log.Fatalf("LOG_LEVEL must be error, warn, info or debug, got %q", name)
+        }
+        logLevel = level
+    }
+
+    // 1 in N successful requests is logged, 1 logs them all
+    rate, _ := strconv.ParseUint(os.Getenv("LOG_SAMPLE_RATE"), 10, 64)
+    if rate == 0 {
+        rate = 1
+    }
+    logSampleRate = rate
+}
+
+// requestLevel returns the level a request that answered status is logged at
+func requestLevel(status int) int {
+    switch {
+    case status >= 500:
+        return levelError
+    case status >= 400:
+        return levelWarn
+    default:
+        return levelInfo
+    }
+}
+
+// shouldLogRequest decides whether a request that answered status is logged, sampling the
+// successful ones
+func shouldLogRequest(status int) bool {
+    level := requestLevel(status)
+    if level > logLevel {
+        return false
+    }
+    if level < levelInfo || logSampleRate == 1 {
+        return true
+    }
+    return logSampleCount.Add(1)%logSampleRate == 1
+}
+
+// requestLogEntry is a request logged in the JSON format
+type requestLogEntry struct {
+    Timestamp  string  `json:"ts"`
+    Level      string  `json:"level"`
+    RequestID  string  `json:"request_id,omitempty"`
+    Method     string  `json:"method"`
+    Path       string  `json:"path"`
+    Status     int     `json:"status"`
+    DurationMs float64 `json:"duration_ms"`
+    ReqSize    int     `json:"req_size"` // -1 when unknown
+    RespSize   int     `json:"resp_size"`
+    ClientIP   string  `json:"client_ip"`
+    ReqBody    string  `json:"req_body,omitempty"` // Only at debug level
+    RespBody   string  `json:"resp_body,omitempty"`
+}
+
 // loggingResponseWriter wraps http.ResponseWriter to capture status code and size
 type loggingResponseWriter struct {
     http.ResponseWriter
@@ -73,17 +166,22 @@ func (lrw *loggingResponseWriter) Push(target string, opts *http.PushOptions) er
 }
 
 // Logger returns a middleware that logs request method, path, response status, size and duration.
+// Bodies are only previewed at debug level, below it they are neither read ahead nor buffered.
 func Logger(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         start := time.Now()
+        debug := logLevel >= levelDebug
         // Prepare response writer wrapper
-        lrw := &loggingResponseWriter{ResponseWriter: w, bodyBuf: &bytes.Buffer{}}
+        lrw := &loggingResponseWriter{ResponseWriter: w}
+        if debug {
+            lrw.bodyBuf = &bytes.Buffer{}
+        }
 
         // Capture a safe preview of the request body (and restore it for handlers)
         reqCT := r.Header.Get("Content-Type")
         var reqBodyPreview string
         var reqBodySize int
-        if shouldLogBody(reqCT) {
+        if debug && shouldLogBody(reqCT) {
             // Read entire body to allow handlers to read it afterwards
             bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, int64(requestReadHardLimit)))
             if err == nil {
@@ -107,63 +205,81 @@ func Logger(next http.Handler) http.Handler {
             } else {
                 reqBodySize = -1
             }
-            reqBodyPreview = "<omitted>"
+            if debug {
+                reqBodyPreview = "<omitted>"
+            }
         }
 
         next.ServeHTTP(lrw, r)
 
+        status := lrw.statusCode
+        if status == 0 {
+            status = http.StatusOK
+        }
+        if !shouldLogRequest(status) {
+            return
+        }
         duration := time.Since(start)
 
         method := r.Method
-        path := r.URL.Path
-        query := r.URL.RawQuery
+        path := maskPath(r.URL.Path)
+        query := maskQuery(r.URL.RawQuery)
         if query != "" {
             path = path + "?" + query
         }
 
-        ip := clientIP(r)
+        ip := ClientIP(r)
 
-        status := lrw.statusCode
-        if status == 0 {
-            status = http.StatusOK
-        }
         // Decide whether to log response body content based on content type
         resCT := lrw.Header().Get("Content-Type")
         var resBodyPreview string
-        if shouldLogBody(resCT) {
-            resBodyPreview = previewBytes(lrw.bodyBuf.Bytes(), responseLogLimit, resCT)
-        } else {
-            resBodyPreview = "<omitted>"
+        if debug {
+            if shouldLogBody(resCT) {
+                resBodyPreview = previewBytes(lrw.bodyBuf.Bytes(), responseLogLimit, resCT)
+            } else {
+                resBodyPreview = "<omitted>"
+            }
+        }
+
+        level := requestLevel(status)
+        if jsonLogs {
+            entry, err := json.Marshal(requestLogEntry{
+                Timestamp:  start.UTC().Format(time.RFC3339Nano),
+                Level:      levelLabels[level],
+                RequestID:  GetRequestID(r.Context()),
+                Method:     method,
+                Path:       path,
+                Status:     status,
+                DurationMs: float64(duration.Microseconds()) / 1000,
+                ReqSize:    reqBodySize,
+                RespSize:   lrw.bytesWritten,
+                ClientIP:   ip,
+                ReqBody:    reqBodyPreview,
+                RespBody:   resBodyPreview,
+            })
+            if err == nil {
+                jsonLogger.Print(string(entry))
+                return
+            }
         }
 
         // Sizes
         reqSizeStr := sizeString(reqBodySize)
         resSizeStr := sizeString(lrw.bytesWritten)
 
-        log.Printf("%s %s -> %d (%s) in %s from %s\nRequest CT=%q size=%s body=%s\nResponse CT=%q size=%s body=%s",
-            method, path, status, resSizeStr, duration, ip,
+        if !debug {
+            log.Printf("%s [%s] %s %s -> %d (%s) in %s from %s, request size=%s",
+                strings.ToUpper(levelLabels[level]), GetRequestID(r.Context()), method, path, status, resSizeStr, duration, ip, reqSizeStr)
+            return
+        }
+        log.Printf("%s [%s] %s %s -> %d (%s) in %s from %s\nRequest CT=%q size=%s body=%s\nResponse CT=%q size=%s body=%s",
+            strings.ToUpper(levelLabels[level]), GetRequestID(r.Context()), method, path, status, resSizeStr, duration, ip,
             reqCT, reqSizeStr, reqBodyPreview,
             resCT, resSizeStr, resBodyPreview,
         )
     })
 }
 
-// clientIP tries to read the client IP from common proxy headers, falling back to RemoteAddr.
-func clientIP(r *http.Request) string {
-    // X-Forwarded-For may contain multiple IPs, take the first
-    if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-        parts := strings.Split(xff, ",")
-        if len(parts) > 0 {
-            return strings.TrimSpace(parts[0])
-        }
-        return xff
-    }
-    if xrip := r.Header.Get("X-Real-IP"); xrip != "" {
-        return xrip
-    }
-    return r.RemoteAddr
-}
-
 // --- helpers for body logging ---
 
 const (
@@ -193,6 +309,8 @@ func previewBytes(b []byte, limit int, contentType string) string {
     if len(b) == 0 {
         return "<empty>"
     }
+    // Mask before truncating so a cut never exposes part of a secret
+    b = maskSensitive(b, contentType)
     truncated := ""
     if len(b) > limit {
         b = b[:limit]
@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const maskedValue = "****"
+
+// sensitiveFields are body fields whose values never reach the logs
+var sensitiveFields = map[string]bool{
+	"password":      true,
+	"new_password":  true,
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"id_token":      true,
+	"code":          true,
+	"client_secret": true,
+	"secret":        true,
+	"seed":          true,
+	"wrapped_key":   true,
+}
+
+func isSensitiveField(name string) bool {
+	return sensitiveFields[strings.ToLower(name)]
+}
+
+// sensitiveJSONValue matches a sensitive string field in JSON that is too truncated to parse
+var sensitiveJSONValue = regexp.MustCompile(`"([A-Za-z_]+)"\s*:\s*"(?:[^"\\]|\\.)*("|$)`)
+
+// maskSensitive replaces the values of sensitive fields in a JSON or form body
+func maskSensitive(b []byte, contentType string) []byte {
+	ct := strings.ToLower(contentType)
+	switch {
+	case strings.Contains(ct, "json"):
+		var v interface{}
+		if err := json.Unmarshal(b, &v); err == nil {
+			if masked, err := json.Marshal(maskValue(v)); err == nil {
+				return masked
+			}
+		}
+		return sensitiveJSONValue.ReplaceAllFunc(b, func(m []byte) []byte {
+			name := sensitiveJSONValue.FindSubmatch(m)[1]
+			if !isSensitiveField(string(name)) {
+				return m
+			}
+			return []byte(`"` + string(name) + `":"` + maskedValue + `"`)
+		})
+	case strings.Contains(ct, "x-www-form-urlencoded"):
+		values, err := url.ParseQuery(string(b))
+		if err != nil {
+			return b
+		}
+		for name := range values {
+			if isSensitiveField(name) {
+				values.Set(name, maskedValue)
+			}
+		}
+		return []byte(encodeMasked(values))
+	default:
+		return b
+	}
+}
+
+func maskValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for name, field := range t {
+			if isSensitiveField(name) {
+				t[name] = maskedValue
+			} else {
+				t[name] = maskValue(field)
+			}
+		}
+	case []interface{}:
+		for i := range t {
+			t[i] = maskValue(t[i])
+		}
+	}
+	return v
+}
+
+// sensitivePathPrefixes are routes whose last path segment is a credential
+var sensitivePathPrefixes = []string{"/api/shared/", APIPrefix + "/shared/"}
+
+// maskPath hides the token of share link downloads
+func maskPath(path string) string {
+	for _, prefix := range sensitivePathPrefixes {
+		if strings.HasPrefix(path, prefix) && len(path) > len(prefix) {
+			return prefix + maskedValue
+		}
+	}
+	return path
+}
+
+// maskQuery replaces the values of sensitive query parameters, the OAuth callback carries its code there
+func maskQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawQuery
+	}
+	masked := false
+	for name := range values {
+		if isSensitiveField(name) {
+			values.Set(name, maskedValue)
+			masked = true
+		}
+	}
+	if !masked {
+		return rawQuery
+	}
+	return encodeMasked(values)
+}
+
+// encodeMasked encodes values, leaving the mask itself readable
+func encodeMasked(values url.Values) string {
+	return strings.ReplaceAll(values.Encode(), url.QueryEscape(maskedValue), maskedValue)
+}
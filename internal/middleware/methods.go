@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// AllowedMethods returns the methods a route serving methods answers: GET routes answer HEAD
+// too, and every route answers OPTIONS
+func AllowedMethods(methods []string) []string {
+	allowed := make([]string, 0, len(methods)+2)
+	for _, m := range methods {
+		allowed = append(allowed, m)
+		if m == http.MethodGet && !slices.Contains(methods, http.MethodHead) {
+			allowed = append(allowed, http.MethodHead)
+		}
+	}
+	if !slices.Contains(allowed, http.MethodOptions) {
+		allowed = append(allowed, http.MethodOptions)
+	}
+	return allowed
+}
+
+// MethodAllowed reports whether a route serving methods answers the method, OPTIONS aside
+func MethodAllowed(methods []string, method string) bool {
+	return slices.Contains(methods, method) || (method == http.MethodHead && slices.Contains(methods, http.MethodGet))
+}
+
+// WriteMethodNotAllowed answers a method the route doesn't serve, listing the ones it does in
+// the Allow header
+func WriteMethodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(AllowedMethods(methods), ", "))
+	WriteJSONError(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "method not allowed")
+}
+
+// WriteOptions answers an OPTIONS request, listing the methods the route serves in the Allow
+// header. A CORS preflight CORS let through gets them in Access-Control-Allow-Methods as well,
+// one from an origin it doesn't allow only the Allow header, which browsers don't accept.
+func WriteOptions(w http.ResponseWriter, r *http.Request, methods ...string) {
+	allowed := strings.Join(AllowedMethods(methods), ", ")
+	w.Header().Set("Allow", allowed)
+	if IsPreflight(r) && w.Header().Get("Access-Control-Allow-Origin") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", allowed)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
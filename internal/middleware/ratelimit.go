@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"SE/internal/cache"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var limiter *rateLimiter
+
+// InitRateLimitConfig reads the rate limit settings shared by every RateLimit-wrapped route
+func InitRateLimitConfig() {
+	// Sustained requests per second allowed per user (or per IP when unauthenticated)
+	rps, _ := strconv.ParseFloat(os.Getenv("RATE_LIMIT_RPS"), 64)
+	if rps <= 0 {
+		rps = 10
+	}
+
+	// Requests allowed in a burst before throttling kicks in
+	burst, _ := strconv.Atoi(os.Getenv("RATE_LIMIT_BURST"))
+	if burst <= 0 {
+		burst = 20
+	}
+
+	limiter = newRateLimiter(rps, burst)
+	log.Printf("Rate limit: %.1f req/s, burst %d", rps, burst)
+}
+
+// RateLimit returns a middleware that throttles requests with a sliding window per client.
+// Behind AuthMiddleware clients are keyed by user ID, otherwise by IP.
+func RateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if limiter == nil {
+			next(w, r)
+			return
+		}
+
+		var key string
+		if uid, ok := r.Context().Value("userID").(primitive.ObjectID); ok {
+			key = "user:" + uid.Hex()
+		} else {
+			key = "ip:" + hostOnly(ClientIP(r))
+		}
+
+		if wait, ok := limiter.allow(r.Context(), key); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			WriteJSONError(w, http.StatusTooManyRequests, ErrCodeRateLimited, "rate limit exceeded")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// hostOnly strips the port RemoteAddr carries so every connection from an IP shares a bucket
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// rateLimiter counts each client's requests in windows of the time a full burst takes to
+// refill, in the shared cache so every replica of the server counts against the same limit. A
+// request is allowed while the requests of the current window, with those of the previous one
+// weighted by how much of it still overlaps the last window length, stay within the burst.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	window time.Duration
+}
+
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	window := time.Duration(float64(burst) / rps * float64(time.Second))
+	if window < time.Millisecond {
+		window = time.Millisecond
+	}
+	return &rateLimiter{rate: rps, burst: float64(burst), window: window}
+}
+
+// allow counts a request of key, or reports how long until one would be allowed. Replicas
+// reading the counters at the same moment can let a request or two past the burst. Clients are
+// let through when the cache can't be reached, losing the limit beats failing every request.
+func (l *rateLimiter) allow(ctx context.Context, key string) (time.Duration, bool) {
+	now := time.Now()
+	index := now.UnixNano() / int64(l.window)
+	elapsed := time.Duration(now.UnixNano() - index*int64(l.window))
+	currentKey := fmt.Sprintf("ratelimit:%s:%d", key, index)
+
+	previous, err := l.count(ctx, fmt.Sprintf("ratelimit:%s:%d", key, index-1))
+	if err != nil {
+		log.Printf("Rate limit of %s not checked: %v", key, err)
+		return 0, true
+	}
+	current, err := l.count(ctx, currentKey)
+	if err != nil {
+		log.Printf("Rate limit of %s not checked: %v", key, err)
+		return 0, true
+	}
+
+	// Requests turned away aren't counted, they would push back the next allowed one
+	if previous*l.overlap(elapsed)+current+1 > l.burst {
+		return l.wait(previous, current, elapsed), false
+	}
+
+	n, err := cache.Shared().Incr(ctx, currentKey)
+	if err != nil {
+		log.Printf("Rate limit of %s not counted: %v", key, err)
+		return 0, true
+	}
+	if n == 1 {
+		// Read as the previous window throughout the next one
+		if err := cache.Shared().Expire(ctx, currentKey, 2*l.window); err != nil {
+			log.Printf("Failed to expire rate limit window of %s: %v", key, err)
+		}
+	}
+	return 0, true
+}
+
+// count returns the requests counted under key
+func (l *rateLimiter) count(ctx context.Context, key string) (float64, error) {
+	v, ok, err := cache.Shared().Get(ctx, key)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+// overlap returns how much of the previous window is within a window length of now, elapsed
+// into the current one
+func (l *rateLimiter) overlap(elapsed time.Duration) float64 {
+	return 1 - float64(elapsed)/float64(l.window)
+}
+
+// wait returns how long until a request is allowed again: once the previous window overlaps
+// little enough, or when the current one is full, once it is the previous one and does
+func (l *rateLimiter) wait(previous, current float64, elapsed time.Duration) time.Duration {
+	if current+1 <= l.burst {
+		// previous*overlap(elapsed+wait)+current+1 <= burst
+		return time.Duration((1-(l.burst-current-1)/previous)*float64(l.window)) - elapsed
+	}
+	next := l.window - elapsed
+	if current > 0 {
+		next += time.Duration(max(0, 1-(l.burst-1)/current) * float64(l.window))
+	}
+	return next
+}
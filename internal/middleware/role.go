@@ -0,0 +1,15 @@
+package middleware
+
+import "net/http"
+
+// RequireRole only lets through users whose access token carries role, must be wrapped by
+// the auth middleware that puts the token's role in the context
+func RequireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if got, _ := r.Context().Value("role").(string); got != role {
+			WriteJSONError(w, http.StatusForbidden, ErrCodeForbidden, "forbidden")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
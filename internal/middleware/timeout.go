@@ -0,0 +1,203 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Budgets of a request, 0 leaves requests unbounded
+var (
+	requestTimeout     time.Duration
+	longRequestTimeout time.Duration
+)
+
+// ErrHandlerTimeout is returned by writes of a handler whose request timed out before it
+// answered, the timeout response went out instead
+var ErrHandlerTimeout = errors.New("request timed out")
+
+// InitTimeoutConfig reads the request timeouts
+func InitTimeoutConfig() {
+	// Budget of most routes, which answer from Mongo or with a few Drive calls
+	requestTimeout = 60 * time.Second
+	if v, ok := os.LookupEnv("REQUEST_TIMEOUT_SECONDS"); ok {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs < 0 {
+			log.Fatalf("REQUEST_TIMEOUT_SECONDS must be a number of seconds, got %q", v)
+		}
+		requestTimeout = time.Duration(secs) * time.Second
+	}
+
+	// Budget of transfers and of routes going through every chunk or drive, like downloads,
+	// exports and verification
+	longRequestTimeout = 120 * time.Minute
+	if v, ok := os.LookupEnv("LONG_REQUEST_TIMEOUT_MINUTES"); ok {
+		mins, err := strconv.Atoi(v)
+		if err != nil || mins < 0 {
+			log.Fatalf("LONG_REQUEST_TIMEOUT_MINUTES must be a number of minutes, got %q", v)
+		}
+		longRequestTimeout = time.Duration(mins) * time.Minute
+	}
+	log.Printf("Requests time out after %s, long requests after %s", formatTimeout(requestTimeout), formatTimeout(longRequestTimeout))
+}
+
+func formatTimeout(d time.Duration) string {
+	if d == 0 {
+		return "never"
+	}
+	return d.String()
+}
+
+// RequestTimeout returns the budget of a request, REQUEST_TIMEOUT_SECONDS
+func RequestTimeout() time.Duration {
+	return requestTimeout
+}
+
+// LongRequestTimeout returns the budget of a long request, LONG_REQUEST_TIMEOUT_MINUTES
+func LongRequestTimeout() time.Duration {
+	return longRequestTimeout
+}
+
+// Timeout returns a middleware giving each request d to finish. The handler runs with a
+// context whose deadline is d away, so the Drive and Mongo calls made with it are cancelled when
+// it passes. A handler that hasn't started its response by then is answered with a 504, and
+// whatever it writes afterwards is dropped. A response already under way can't be replaced, it
+// ends when the handler gives up on the cancelled context. d of 0 doesn't bound requests.
+func Timeout(d time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	if d <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+
+		tw := &timeoutWriter{w: w, h: w.Header().Clone(), ctx: ctx, r: r, d: d}
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			next(tw, r.WithContext(ctx))
+			close(done)
+		}()
+
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-done:
+			tw.finish()
+		case <-ctx.Done():
+			// A client that went away gets no answer, the handler only has to stop
+			if r.Context().Err() == nil {
+				tw.mu.Lock()
+				started := tw.wroteHeader
+				if !started {
+					tw.timeout()
+				}
+				tw.mu.Unlock()
+				if !started {
+					return
+				}
+			}
+			// The response is under way, the handler has to end it
+			select {
+			case p := <-panicked:
+				panic(p)
+			case <-done:
+				tw.finish()
+			}
+		}
+	}
+}
+
+// timeoutWriter hands the handler its own header map, copied to the response when the
+// handler starts it, so the 504 can be written while the handler still runs
+type timeoutWriter struct {
+	w   http.ResponseWriter
+	h   http.Header
+	ctx context.Context
+	r   *http.Request
+	d   time.Duration
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.h
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeader(code)
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeader(http.StatusOK)
+	if tw.timedOut {
+		return 0, ErrHandlerTimeout
+	}
+	return tw.w.Write(p)
+}
+
+// FlushError is what http.ResponseController uses to flush
+func (tw *timeoutWriter) FlushError() error {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeader(http.StatusOK)
+	if tw.timedOut {
+		return ErrHandlerTimeout
+	}
+	return http.NewResponseController(tw.w).Flush()
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.FlushError()
+}
+
+// writeHeader starts the response with the handler's headers, unless it timed out. A response
+// started once the deadline passed is an error of the cancelled context, the 504 replaces it.
+// Callers hold mu.
+func (tw *timeoutWriter) writeHeader(code int) {
+	if tw.wroteHeader || tw.timedOut {
+		return
+	}
+	if errors.Is(tw.ctx.Err(), context.DeadlineExceeded) {
+		tw.timeout()
+		return
+	}
+	tw.wroteHeader = true
+	dst := tw.w.Header()
+	clear(dst)
+	for k, v := range tw.h {
+		dst[k] = v
+	}
+	tw.w.WriteHeader(code)
+}
+
+// timeout answers the request with a 504 in place of the handler. Callers hold mu.
+func (tw *timeoutWriter) timeout() {
+	tw.timedOut = true
+	log.Printf("[%s] %s %s timed out after %s", GetRequestID(tw.r.Context()), tw.r.Method, tw.r.URL.Path, tw.d)
+	WriteJSONError(tw.w, http.StatusGatewayTimeout, ErrCodeTimeout, "request timed out")
+}
+
+// finish starts the response of a handler that returned without writing anything, as net/http
+// would have
+func (tw *timeoutWriter) finish() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeader(http.StatusOK)
+}
@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// APIVersion is the version of the API served, APIPrefix the path its routes are under
+const (
+	APIVersion = "1"
+	APIPrefix  = "/api/v" + APIVersion
+)
+
+// Headers a client picks the version with and the response names the served one in
+const (
+	AcceptVersionHeader = "Accept-Version"
+	APIVersionHeader    = "API-Version"
+)
+
+// supportedAPIVersions lists the versions a client can ask for, oldest first
+var supportedAPIVersions = []string{APIVersion}
+
+// When the unversioned routes are removed, announced in their Sunset header, set by
+// InitVersionConfig. Zero announces no date.
+var unversionedSunset time.Time
+
+// InitVersionConfig reads the date the unversioned /api/ routes go away, API_UNVERSIONED_SUNSET
+func InitVersionConfig() {
+	unversionedSunset = time.Time{}
+	if v := os.Getenv("API_UNVERSIONED_SUNSET"); v != "" {
+		t, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			log.Fatalf("API_UNVERSIONED_SUNSET must be a date like 2006-01-02, got %q", v)
+		}
+		unversionedSunset = t
+	}
+}
+
+// Versioning returns a middleware serving the API's routes under APIPrefix. A request to
+// /api/v1/... is served by the route registered for /api/..., which keeps answering as an alias
+// with a Deprecation header and a Link to its versioned path. Every API response names the
+// version served in API-Version, which handlers read with GetAPIVersion. Routes check the
+// versions a client asks for with CheckAcceptVersion.
+func Versioning(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, versioned := strings.CutPrefix(r.URL.Path, APIPrefix)
+		if versioned && rest != "" && rest[0] != '/' {
+			versioned = false // e.g. /api/v10
+		}
+		// Not the API, or a version that isn't served, which no route answers
+		if !versioned && (!strings.HasPrefix(r.URL.Path, "/api/") || isVersionSegment(r.URL.Path[len("/api/"):])) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set(APIVersionHeader, APIVersion)
+
+		if !versioned {
+			w.Header().Set("Deprecation", "true")
+			successor := APIPrefix + strings.TrimPrefix(r.URL.Path, "/api")
+			w.Header().Add("Link", "<"+successor+`>; rel="successor-version"`)
+			if !unversionedSunset.IsZero() {
+				w.Header().Set("Sunset", unversionedSunset.UTC().Format(http.TimeFormat))
+			}
+			next.ServeHTTP(w, r.WithContext(withAPIVersion(r.Context(), APIVersion)))
+			return
+		}
+
+		// Served by the unversioned route, the request logged keeps its path
+		u := *r.URL
+		u.Path = "/api" + rest
+		if u.RawPath != "" {
+			u.RawPath = "/api" + strings.TrimPrefix(u.RawPath, APIPrefix)
+		}
+		served := r.WithContext(withAPIVersion(r.Context(), APIVersion))
+		served.URL = &u
+		next.ServeHTTP(w, served)
+	})
+}
+
+// CheckAcceptVersion answers 406 with the supported versions, reporting false, when the
+// request's Accept-Version, e.g. "1" or "v1, v2", names none the API serves the request with.
+// Requests outside the API and without the header pass.
+func CheckAcceptVersion(w http.ResponseWriter, r *http.Request) bool {
+	version := GetAPIVersion(r.Context())
+	accept := r.Header.Values(AcceptVersionHeader)
+	if version == "" || len(accept) == 0 || acceptsAPIVersion(accept, version) {
+		return true
+	}
+	WriteJSONErrorDetails(w, http.StatusNotAcceptable, ErrCodeUnsupportedVersion,
+		"none of the versions in Accept-Version is served at this path",
+		map[string]interface{}{"supported_versions": supportedAPIVersions})
+	return false
+}
+
+// acceptsAPIVersion reports whether the Accept-Version values name version, with or without
+// its v
+func acceptsAPIVersion(values []string, version string) bool {
+	for _, header := range values {
+		for _, v := range strings.Split(header, ",") {
+			v = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(v)), "v")
+			if v == version || v == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isVersionSegment reports whether the path starts with a version, like v2
+func isVersionSegment(path string) bool {
+	segment, _, _ := strings.Cut(path, "/")
+	digits, ok := strings.CutPrefix(segment, "v")
+	if !ok || digits == "" {
+		return false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func withAPIVersion(ctx context.Context, version string) context.Context {
+	return context.WithValue(ctx, "apiVersion", version)
+}
+
+// GetAPIVersion returns the API version the request is served with, "" outside the API routes
+func GetAPIVersion(ctx context.Context) string {
+	v, _ := ctx.Value("apiVersion").(string)
+	return v
+}
@@ -11,16 +11,47 @@ type UploadSession struct {
 	ID                 primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	UserID             primitive.ObjectID `bson:"user_id" json:"user_id"`
 	OriginalFilename   string             `bson:"original_filename" json:"original_filename"`
+	ContentType        string             `bson:"content_type,omitempty" json:"content_type,omitempty"` // Guessed from the filename, then sniffed from the first chunk
 	TempFilePath       string             `bson:"temp_file_path" json:"temp_file_path"`
 	KeyFilePath        string             `bson:"key_file_path,omitempty" json:"key_file_path,omitempty"`
 	TotalSize          int64              `bson:"total_size" json:"total_size"`
 	UploadedSize       int64              `bson:"uploaded_size" json:"uploaded_size"`
-	Status             string             `bson:"status" json:"status"` // "uploading", "processing", "complete", "failed"
+	ChunkSize          int64              `bson:"chunk_size" json:"chunk_size"`                                     // Size of each client upload chunk
+	ReceivedChunks     []int              `bson:"received_chunks" json:"received_chunks"`                           // Zero-based indexes of fully received chunks
+	ChunksReceivedAt   *time.Time         `bson:"chunks_received_at,omitempty" json:"chunks_received_at,omitempty"` // When the last chunk came in, starts the finalize timeout
+	Status             string             `bson:"status" json:"status"`                                             // "uploading", "processing", "retrying", "complete", "failed", "incomplete", "stale"
 	ProcessingProgress float64            `bson:"processing_progress" json:"processing_progress"`
 	ErrorMessage       string             `bson:"error_message,omitempty" json:"error_message,omitempty"`
+	ErrorCode          string             `bson:"error_code,omitempty" json:"error_code,omitempty"` // Code of the failure, like the error codes of the API, when it has one
 	CreatedAt          time.Time          `bson:"created_at" json:"created_at"`
 	ExpiresAt          time.Time          `bson:"expires_at" json:"expires_at"`
 	CompletedAt        *time.Time         `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+	FileID             primitive.ObjectID `bson:"file_id,omitempty" json:"file_id,omitempty"` // Set once the StoredFile is created
+	DriveChunks        []ChunkReplica     `bson:"drive_chunks,omitempty" json:"-"`            // Chunks uploaded while processing, reclaimed if the session is abandoned
+	Compress           bool               `bson:"compress,omitempty" json:"compress"`         // Client opted into gzip compression of chunks
+	// Set when the client encrypts the file itself, the server then never encrypts it
+	ClientEncryption *ClientEncryptionMetadata `bson:"client_encryption,omitempty" json:"client_encryption,omitempty"`
+	Tags             []string                  `bson:"tags,omitempty" json:"tags,omitempty"` // Given to the stored file
+	// Processing attempts of a finalized upload, set when failed uploads are retried
+	Retry *UploadRetry `bson:"retry,omitempty" json:"retry,omitempty"`
+}
+
+// UploadRetry records the attempts at processing an upload session. A failed or interrupted
+// attempt is retried after a backoff, processing the whole file again, until the attempts
+// UPLOAD_RETRY_MAX_ATTEMPTS allows are used up.
+type UploadRetry struct {
+	Request     ProcessRequest  `bson:"request" json:"-"` // The finalize request every attempt processes
+	Attempts    []UploadAttempt `bson:"attempts" json:"attempts"`
+	NextRetryAt *time.Time      `bson:"next_retry_at,omitempty" json:"next_retry_at,omitempty"` // Set while the session is retrying
+	GaveUp      bool            `bson:"gave_up,omitempty" json:"gave_up,omitempty"`             // Every attempt failed, the session failed for good
+}
+
+// UploadAttempt is one attempt at processing an upload session
+type UploadAttempt struct {
+	StartedAt  time.Time  `bson:"started_at" json:"started_at"`
+	FinishedAt *time.Time `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+	Status     string     `bson:"status" json:"status"` // "processing" until it ends, then "complete", "failed" or "incomplete"
+	Error      string     `bson:"error,omitempty" json:"error,omitempty"`
 }
 
 // ChunkingStrategy defines how to split the file
@@ -31,6 +62,19 @@ const (
 	StrategyBalanced     ChunkingStrategy = "balanced"     // Balance across drives
 	StrategyProportional ChunkingStrategy = "proportional" // Proportional to space
 	StrategyManual       ChunkingStrategy = "manual"       // User-defined sizes
+	// Boundaries from a rolling hash of the content, so an edited file keeps its unchanged chunks
+	StrategyContentDefined ChunkingStrategy = "content_defined"
+)
+
+// DistributionMode selects how planned chunks are placed on drives
+type DistributionMode string
+
+const (
+	DistributionPlanned     DistributionMode = ""             // Keep the drive chosen by the chunking strategy
+	DistributionRoundRobin  DistributionMode = "round_robin"  // Cycle through drives in order
+	DistributionLargestFree DistributionMode = "largest_free" // Drive with the most free space first
+	DistributionRedundant   DistributionMode = "redundant"    // Each chunk on two different drives
+	DistributionPriority    DistributionMode = "priority"     // Fill drives in the user's priority order
 )
 
 // DriveSpaceInfo represents available space on a drive
@@ -44,6 +88,11 @@ type DriveSpaceInfo struct {
 	Error       string             `json:"error,omitempty"`
 	OwnerName   string             `json:"owner_name,omitempty"`  // Add this
 	OwnerEmail  string             `json:"owner_email,omitempty"` // Add this
+	Priority    int                `json:"priority"`              // The account's priority, 0 when unranked
+	Disabled    bool               `json:"disabled,omitempty"`    // The account failed too often, see Error
+	Full        bool               `json:"full,omitempty"`        // An upload found the drive out of storage, it gets no chunks for now
+	Cached      bool               `json:"cached"`                // Served from the space cache instead of a live Drive call
+	CacheAge    int64              `json:"cache_age_seconds"`     // Age of the cached value, 0 for live values
 }
 
 // ChunkPlan defines how a chunk should be distributed
@@ -55,13 +104,42 @@ type ChunkPlan struct {
 	EndOffset      int64              `json:"end_offset"`
 }
 
+// ChunkAssignment places a planned chunk on one or more drives
+type ChunkAssignment struct {
+	ChunkID         int                  `json:"chunk_id"`
+	Size            int64                `json:"size"`
+	StartOffset     int64                `json:"start_offset"`
+	EndOffset       int64                `json:"end_offset"`
+	DriveAccountIDs []primitive.ObjectID `json:"drive_account_ids"`  // First entry holds the primary copy
+	Filename        string               `json:"filename,omitempty"` // Name the chunk is stored under, from the obfuscation scheme
+}
+
 // ObfuscationMetadata for key file
 type ObfuscationMetadata struct {
-	Algorithm   string  `json:"algorithm"`
-	Seed        string  `json:"seed"` // base64
-	BlockSize   int     `json:"block_size"`
-	OverheadPct float64 `json:"overhead_pct"`
-	MinGap      int     `json:"min_gap"`
+	Algorithm   string  `bson:"algorithm" json:"algorithm"`
+	Scheme      string  `bson:"scheme,omitempty" json:"scheme,omitempty"` // Chunk naming and order, empty for files stored before schemes, which use "none"
+	Seed        string  `bson:"seed" json:"seed"`                         // base64
+	BlockSize   int     `bson:"block_size" json:"block_size"`
+	OverheadPct float64 `bson:"overhead_pct" json:"overhead_pct"`
+	MinGap      int     `bson:"min_gap" json:"min_gap"`
+	// StrategyContentDefined when noise was injected into every chunk on its own, with a seed
+	// derived for the chunk. Empty when it was injected into the whole file.
+	Chunking ChunkingStrategy `bson:"chunking,omitempty" json:"chunking,omitempty"`
+	// CHUNK_NAME_PREFIX when the file was stored, put before the scheme's name of every chunk
+	NamePrefix string `bson:"name_prefix,omitempty" json:"name_prefix,omitempty"`
+}
+
+// EncryptionMetadata describes how chunks were encrypted. The data key is wrapped with the server key.
+type EncryptionMetadata struct {
+	Algorithm  string `bson:"algorithm" json:"algorithm"`
+	WrappedKey string `bson:"wrapped_key" json:"wrapped_key"` // base64
+	FrameSize  int    `bson:"frame_size" json:"frame_size"`
+}
+
+// ClientEncryptionMetadata describes a file the client encrypted before uploading it. The key
+// is derived on the client, the server only keeps the salt it was derived with.
+type ClientEncryptionMetadata struct {
+	KeySalt string `bson:"key_salt" json:"key_salt"` // base64
 }
 
 // ChunkMetadata for key file
@@ -73,23 +151,316 @@ type ChunkMetadata struct {
 	StartOffset    int64  `json:"start_offset"`
 	EndOffset      int64  `json:"end_offset"`
 	Size           int64  `json:"size"`
+	StoredSize     int64  `json:"stored_size"`
 	Checksum       string `json:"checksum"`
+	ChecksumAlgo   string `json:"checksum_algo"`
+	Compressed     bool   `json:"compressed,omitempty"`
+	CompressedSize int64  `json:"compressed_size,omitempty"`
+	OriginalSize   int64  `json:"original_size,omitempty"` // Content-defined chunks only, see StoredChunk
+	ContentHash    string `json:"content_hash,omitempty"`
+
+	Replicas []ChunkReplica `json:"replicas,omitempty"` // Every copy, the drive fields above name the first one
 }
 
 // KeyFile structure - what user downloads
 type KeyFile struct {
-	Version          string              `json:"version"`
-	OriginalFilename string              `json:"original_filename"`
-	OriginalSize     int64               `json:"original_size"`
-	ProcessedSize    int64               `json:"processed_size"`
-	Obfuscation      ObfuscationMetadata `json:"obfuscation"`
-	Chunks           []ChunkMetadata     `json:"chunks"`
-	CreatedAt        time.Time           `json:"created_at"`
+	Version          string                    `json:"version"`
+	OriginalFilename string                    `json:"original_filename"`
+	OriginalSize     int64                     `json:"original_size"`
+	ProcessedSize    int64                     `json:"processed_size"`
+	Obfuscation      ObfuscationMetadata       `json:"obfuscation"`
+	Encryption       *EncryptionMetadata       `json:"encryption,omitempty"`
+	ClientEncryption *ClientEncryptionMetadata `json:"client_encryption,omitempty"`
+	ErasureCoding    *ErasureCoding            `json:"erasure_coding,omitempty"`
+	Chunks           []ChunkMetadata           `json:"chunks"`
+	CreatedAt        time.Time                 `json:"created_at"`
 }
 
-// ProcessRequest - what user sends to finalize
+// ProcessRequest - what user sends to finalize, kept with the session to retry it
 type ProcessRequest struct {
-	SessionID        string           `json:"session_id"`
-	Strategy         ChunkingStrategy `json:"strategy"`
-	ManualChunkSizes []int64          `json:"manual_chunk_sizes,omitempty"` // Only for manual strategy
+	SessionID        string           `bson:"session_id" json:"session_id"`
+	Strategy         ChunkingStrategy `bson:"strategy" json:"strategy"`
+	ManualChunkSizes []int64          `bson:"manual_chunk_sizes,omitempty" json:"manual_chunk_sizes,omitempty"` // Only for manual strategy
+	Distribution     DistributionMode `bson:"distribution_strategy,omitempty" json:"distribution_strategy,omitempty"`
+	ChunkSizeBytes   int64            `bson:"chunk_size_bytes,omitempty" json:"chunk_size_bytes,omitempty"` // Fixed chunk size, replaces the strategy's sizes
+	Thumbnail        bool             `bson:"thumbnail,omitempty" json:"thumbnail,omitempty"`               // Store a preview of an image file
+	Metadata         bool             `bson:"metadata,omitempty" json:"metadata,omitempty"`                 // Extract the dimensions and EXIF of an image file
+	// What the client uploaded, checked against the session when given
+	TotalSize  int64 `bson:"total_size,omitempty" json:"total_size,omitempty"`
+	ChunkCount int   `bson:"chunk_count,omitempty" json:"chunk_count,omitempty"`
+}
+
+// StoredFile is the persisted record of a processed upload, used to reconstruct it later
+type StoredFile struct {
+	ID               primitive.ObjectID        `bson:"_id,omitempty" json:"id"`
+	UserID           primitive.ObjectID        `bson:"user_id" json:"user_id"`
+	SessionID        primitive.ObjectID        `bson:"session_id" json:"session_id"`
+	OriginalFilename string                    `bson:"original_filename" json:"original_filename"`
+	ContentType      string                    `bson:"content_type,omitempty" json:"content_type,omitempty"`
+	OriginalSize     int64                     `bson:"original_size" json:"original_size"`
+	ProcessedSize    int64                     `bson:"processed_size" json:"processed_size"`
+	OriginalChecksum string                    `bson:"original_checksum" json:"original_checksum"`                     // SHA256 of the original file
+	ChecksumState    []byte                    `bson:"checksum_state,omitempty" json:"-"`                              // SHA256 state after the whole file, lets an append extend OriginalChecksum
+	Obfuscation      ObfuscationMetadata       `bson:"obfuscation" json:"-"`                                           // Needed to strip the noise on download
+	Encryption       *EncryptionMetadata       `bson:"encryption,omitempty" json:"-"`                                  // Nil for files stored before chunk encryption and client-encrypted files
+	ClientEncryption *ClientEncryptionMetadata `bson:"client_encryption,omitempty" json:"client_encryption,omitempty"` // Set for files the client encrypted itself
+	Chunks           []StoredChunk             `bson:"chunks" json:"chunks"`
+	ErasureCoding    *ErasureCoding            `bson:"erasure_coding,omitempty" json:"erasure_coding,omitempty"` // Set when chunks were split into shards, see ChunkReplica.Shard
+	MerkleRoot       string                    `bson:"merkle_root,omitempty" json:"merkle_root,omitempty"`       // Root of the Merkle tree over the chunk checksums, see fileprocessor.MerkleRoot
+	Compress         bool                      `bson:"compress,omitempty" json:"compress"`                       // Chunks were compressed where it saved space
+	Tags             []string                  `bson:"tags,omitempty" json:"tags,omitempty"`                     // Normalized to lowercase
+	HasThumbnail     bool                      `bson:"has_thumbnail,omitempty" json:"has_thumbnail,omitempty"`   // A Thumbnail of the file is stored
+	Metadata         map[string]string         `bson:"metadata,omitempty" json:"metadata,omitempty"`             // Read from an image at upload, keyed by fileprocessor.MetadataKeys
+	Status           string                    `bson:"status" json:"status"`                                     // "active", "trashed", "partially_deleted", "incomplete", "deleted"
+	TrashedAt        *time.Time                `bson:"trashed_at,omitempty" json:"trashed_at,omitempty"`
+	TrashedFrom      string                    `bson:"trashed_from,omitempty" json:"-"`                            // Status a restore returns the file to
+	OrphanedChunks   []int                     `bson:"orphaned_chunks,omitempty" json:"orphaned_chunks,omitempty"` // Chunk IDs a delete couldn't remove from their drive
+	CreatedAt        time.Time                 `bson:"created_at" json:"created_at"`
+	UpdatedAt        time.Time                 `bson:"updated_at" json:"updated_at"`
+	ContentModified  *time.Time                `bson:"content_modified_at,omitempty" json:"content_modified_at,omitempty"` // When the content was uploaded, updated or appended to, nil for files stored before it was kept
+}
+
+// LastModified returns when the file's content last changed. Files stored before that was kept
+// report their last update, which is no earlier.
+func (f *StoredFile) LastModified() time.Time {
+	if f.ContentModified != nil {
+		return *f.ContentModified
+	}
+	return f.UpdatedAt
+}
+
+// ErasureCoding is how the sharded chunks of a file were Reed-Solomon coded. Any DataShards of
+// a chunk's DataShards+ParityShards shards rebuild it.
+type ErasureCoding struct {
+	DataShards   int `bson:"data_shards" json:"data_shards"`
+	ParityShards int `bson:"parity_shards" json:"parity_shards"`
+}
+
+// Algorithms a chunk checksum can be computed with
+const (
+	ChecksumSHA256  = "sha256"
+	ChecksumBLAKE2b = "blake2b" // BLAKE2b-256
+)
+
+// StoredChunk records where a single chunk of a StoredFile lives
+type StoredChunk struct {
+	ChunkID        int            `bson:"chunk_id" json:"chunk_id"`
+	Replicas       []ChunkReplica `bson:"replicas" json:"replicas"` // Every drive holding a copy of the chunk
+	Filename       string         `bson:"filename" json:"filename"`
+	StartOffset    int64          `bson:"start_offset" json:"start_offset"` // Offset in the processed (obfuscated) stream
+	EndOffset      int64          `bson:"end_offset" json:"end_offset"`
+	Size           int64          `bson:"size" json:"size"`                                           // Plaintext size in the processed stream
+	StoredSize     int64          `bson:"stored_size" json:"stored_size"`                             // Size on the drive, after encryption
+	Checksum       string         `bson:"checksum" json:"checksum"`                                   // Hash of the chunk as stored on the drive
+	ChecksumAlgo   string         `bson:"checksum_algo" json:"checksum_algo"`                         // Algorithm of Checksum, see ChecksumSHA256
+	Compressed     bool           `bson:"compressed,omitempty" json:"compressed,omitempty"`           // Gzipped before encryption
+	CompressedSize int64          `bson:"compressed_size,omitempty" json:"compressed_size,omitempty"` // Size after gzip, before encryption
+	// Set for content-defined chunks, whose noise is stripped chunk by chunk: the bytes of the
+	// original file in the chunk and their HMAC under a key derived from the obfuscation seed
+	OriginalSize int64  `bson:"original_size,omitempty" json:"original_size,omitempty"`
+	ContentHash  string `bson:"content_hash,omitempty" json:"-"`
+
+	// Single location of chunks stored before replicas, moved into Replicas when loaded
+	LegacyDriveAccountID primitive.ObjectID `bson:"drive_account_id,omitempty" json:"-"`
+	LegacyDriveFileID    string             `bson:"drive_file_id,omitempty" json:"-"`
+}
+
+// ChunkReplica is one copy of a chunk on a drive
+type ChunkReplica struct {
+	DriveAccountID primitive.ObjectID `bson:"drive_account_id" json:"drive_account_id"`
+	DriveFileID    string             `bson:"drive_file_id" json:"drive_file_id"`
+	Backend        string             `bson:"backend,omitempty" json:"backend,omitempty"` // Provider of the account, empty for copies stored before S3 and WebDAV, which are on Google Drive
+	// Erasure-coded shard the drive holds instead of a full copy, from 1, the data shards first
+	Shard    int    `bson:"shard,omitempty" json:"shard,omitempty"`
+	Checksum string `bson:"checksum,omitempty" json:"checksum,omitempty"` // Hash of the shard, with the chunk's ChecksumAlgo
+}
+
+// Sharded reports whether the chunk is stored as erasure-coded shards rather than full copies
+func (c *StoredChunk) Sharded() bool {
+	for _, r := range c.Replicas {
+		if r.Shard > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ReplicaOn returns the chunk's copy on the drive, if it has one
+func (c *StoredChunk) ReplicaOn(accountID primitive.ObjectID) (ChunkReplica, bool) {
+	for _, r := range c.Replicas {
+		if r.DriveAccountID == accountID {
+			return r, true
+		}
+	}
+	return ChunkReplica{}, false
+}
+
+// DownloadSession tracks the reconstruction of a StoredFile for download
+type DownloadSession struct {
+	ID                primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID            primitive.ObjectID `bson:"user_id" json:"user_id"`
+	FileID            primitive.ObjectID `bson:"file_id" json:"file_id"`
+	TempFilePath      string             `bson:"temp_file_path" json:"temp_file_path"`                           // Processed bytes fetched from drives
+	ReconstructedPath string             `bson:"reconstructed_path" json:"reconstructed_path"`                   // Original bytes after noise removal
+	Checksum          string             `bson:"checksum,omitempty" json:"checksum,omitempty"`                   // OriginalChecksum of the file when it was reconstructed
+	EncryptedAtRest   bool               `bson:"encrypted_at_rest,omitempty" json:"encrypted_at_rest,omitempty"` // Files encrypted with a key only the creating server holds in memory
+	Status            string             `bson:"status" json:"status"`                                           // "downloading", "complete", "failed"
+	Progress          float64            `bson:"progress" json:"progress"`
+	ErrorMessage      string             `bson:"error_message,omitempty" json:"error_message,omitempty"`
+	CreatedAt         time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt         time.Time          `bson:"expires_at" json:"expires_at"`
+	CompletedAt       *time.Time         `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+}
+
+// IdempotencyKey remembers the upload session an Idempotency-Key header created, so a retried
+// initiate request returns it instead of creating another one. It is kept in the cache.
+type IdempotencyKey struct {
+	UserID      primitive.ObjectID `json:"user_id"`
+	Key         string             `json:"key"`
+	RequestHash string             `json:"request_hash"`         // SHA-256 of the request payload
+	SessionID   primitive.ObjectID `json:"session_id,omitempty"` // Zero while the first request is still running
+	CreatedAt   time.Time          `json:"created_at"`
+	ExpiresAt   time.Time          `json:"expires_at"`
+}
+
+// ShareLink grants read-only download access to one StoredFile without an account. Only the
+// hash of its token is stored.
+type ShareLink struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	FileID        primitive.ObjectID `bson:"file_id" json:"file_id"`
+	UserID        primitive.ObjectID `bson:"user_id" json:"user_id"` // Owner of the file, who created the link
+	TokenHash     string             `bson:"token_hash" json:"-"`
+	MaxDownloads  int                `bson:"max_downloads" json:"max_downloads"` // 0 means unlimited
+	DownloadCount int                `bson:"download_count" json:"download_count"`
+	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt     time.Time          `bson:"expires_at" json:"expires_at"`
+	RevokedAt     *time.Time         `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+}
+
+// RekeyJob tracks the re-wrapping of a user's data keys and drive credentials with the current
+// TOKEN_ENC_KEY. Files are rekeyed in ID order, so an interrupted job resumes after LastFileID.
+type RekeyJob struct {
+	ID            primitive.ObjectID   `bson:"_id,omitempty" json:"job_id"`
+	UserID        primitive.ObjectID   `bson:"user_id" json:"user_id"`
+	Status        string               `bson:"status" json:"status"`                       // "running", "interrupted", "failed", "completed"
+	TotalFiles    int                  `bson:"total_files" json:"total_files"`             // Files with a server-wrapped data key when the job started
+	CheckedFiles  int                  `bson:"checked_files" json:"checked_files"`         // Files done so far, including failed ones
+	RekeyedFiles  int                  `bson:"rekeyed_files" json:"rekeyed_files"`         // Files whose key was still wrapped with the previous key
+	FailedFiles   []primitive.ObjectID `bson:"failed_files,omitempty" json:"failed_files"` // Files to retry, running the job again picks them up
+	RekeyedDrives int                  `bson:"rekeyed_drives" json:"rekeyed_drives"`       // Drive accounts whose credentials were re-wrapped
+	FailedDrives  []primitive.ObjectID `bson:"failed_drives,omitempty" json:"failed_drives"`
+	LastFileID    primitive.ObjectID   `bson:"last_file_id,omitempty" json:"-"`        // Last file checked
+	Error         string               `bson:"error,omitempty" json:"error,omitempty"` // Why the job stopped early
+	StartedAt     time.Time            `bson:"started_at" json:"started_at"`
+	UpdatedAt     time.Time            `bson:"updated_at" json:"updated_at"`
+	CompletedAt   *time.Time           `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+}
+
+// Thumbnail is the small JPEG preview of an image file, sealed with the file's data key
+type Thumbnail struct {
+	FileID    primitive.ObjectID `bson:"_id" json:"file_id"`
+	Width     int                `bson:"width" json:"width"`
+	Height    int                `bson:"height" json:"height"`
+	Data      []byte             `bson:"data" json:"-"` // Nonce and AES-256-GCM ciphertext of the JPEG
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// ExportJob tracks an export of every active file of a user, streamed as a ZIP archive while
+// the job runs
+type ExportJob struct {
+	ID            primitive.ObjectID   `bson:"_id,omitempty" json:"export_id"`
+	UserID        primitive.ObjectID   `bson:"user_id" json:"user_id"`
+	Status        string               `bson:"status" json:"status"`                       // "running", "interrupted", "failed", "completed"
+	TotalFiles    int                  `bson:"total_files" json:"total_files"`             // Active files when the export started
+	ExportedFiles int                  `bson:"exported_files" json:"exported_files"`       // Files written to the archive so far
+	ExportedBytes int64                `bson:"exported_bytes" json:"exported_bytes"`       // Original bytes of the files written so far
+	FailedFiles   []primitive.ObjectID `bson:"failed_files,omitempty" json:"failed_files"` // Files left out of the archive because they couldn't be reconstructed
+	Error         string               `bson:"error,omitempty" json:"error,omitempty"`     // Why the export stopped early
+	StartedAt     time.Time            `bson:"started_at" json:"started_at"`
+	UpdatedAt     time.Time            `bson:"updated_at" json:"updated_at"`
+	CompletedAt   *time.Time           `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+}
+
+// AccountDeletionJob tracks the deletion of a user's account and everything stored for it. What
+// couldn't be deleted is listed so that deleting the account again retries it; the user record
+// goes last, once nothing is left or the deletion is forced.
+type AccountDeletionJob struct {
+	ID              primitive.ObjectID   `bson:"_id,omitempty" json:"job_id"`
+	UserID          primitive.ObjectID   `bson:"user_id" json:"user_id"`
+	Status          string               `bson:"status" json:"status"` // "running", "interrupted", "incomplete", "failed", "completed"
+	Force           bool                 `bson:"force,omitempty" json:"force"`
+	TotalFiles      int                  `bson:"total_files" json:"total_files"`                     // Files not yet deleted when the run started
+	DeletedFiles    int                  `bson:"deleted_files" json:"deleted_files"`                 // Files whose chunks are all gone
+	FailedFiles     []primitive.ObjectID `bson:"failed_files,omitempty" json:"failed_files"`         // Files with chunks left on their drives
+	DeletedSessions int                  `bson:"deleted_sessions" json:"deleted_sessions"`           // Upload and download sessions removed with their temp and key files
+	FailedSessions  []primitive.ObjectID `bson:"failed_sessions,omitempty" json:"failed_sessions"`   // Sessions still in use, or upload sessions with chunks left on drives
+	FailedManifests []primitive.ObjectID `bson:"failed_manifests,omitempty" json:"failed_manifests"` // Drive accounts whose manifest couldn't be deleted
+	DeletedDrives   int                  `bson:"deleted_drives" json:"deleted_drives"`               // Drive accounts unlinked
+	FailedDrives    []primitive.ObjectID `bson:"failed_drives,omitempty" json:"failed_drives"`       // Drive accounts whose grant couldn't be revoked
+	Error           string               `bson:"error,omitempty" json:"error,omitempty"`             // Why the job stopped early
+	StartedAt       time.Time            `bson:"started_at" json:"started_at"`
+	UpdatedAt       time.Time            `bson:"updated_at" json:"updated_at"`
+	CompletedAt     *time.Time           `bson:"completed_at,omitempty" json:"completed_at,omitempty"` // When the user record was removed
+}
+
+// DriveHealth counts the operations against a drive account, and how many failed, since the
+// start of its current error window
+type DriveHealth struct {
+	DriveAccountID primitive.ObjectID `bson:"_id" json:"drive_account_id"`
+	WindowStart    time.Time          `bson:"window_start" json:"window_start"`
+	Attempts       int                `bson:"attempts" json:"attempts"`
+	Failures       int                `bson:"failures" json:"failures"`
+	LastError      string             `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	LastErrorAt    *time.Time         `bson:"last_error_at,omitempty" json:"last_error_at,omitempty"`
+}
+
+// ResumableUpload is a Google Drive resumable upload session of a chunk still being uploaded.
+// Uploading the same bytes under the same name to the account again resumes it.
+type ResumableUpload struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	DriveAccountID primitive.ObjectID `bson:"drive_account_id" json:"drive_account_id"`
+	Name           string             `bson:"name" json:"name"`
+	Fingerprint    string             `bson:"fingerprint" json:"-"` // SHA-256 of the bytes being uploaded
+	URI            string             `bson:"uri" json:"-"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// StorageStats summarizes what a user stores, every file that isn't deleted counted
+type StorageStats struct {
+	TotalFiles          int                    `bson:"total_files" json:"total_files"`
+	TotalOriginalBytes  int64                  `bson:"total_original_bytes" json:"total_original_bytes"`
+	TotalProcessedBytes int64                  `bson:"total_processed_bytes" json:"total_processed_bytes"` // After obfuscation noise
+	TotalStoredBytes    int64                  `bson:"total_stored_bytes" json:"total_stored_bytes"`       // On the drives, every copy or shard counted
+	ByStatus            map[string]StatusStats `bson:"by_status" json:"by_status"`
+	Drives              []DriveUsage           `bson:"drives" json:"drives"`
+	ComputedAt          time.Time              `bson:"computed_at" json:"computed_at"`
+}
+
+// StatusStats totals the user's files of one status
+type StatusStats struct {
+	Files          int   `bson:"files" json:"files"`
+	OriginalBytes  int64 `bson:"original_bytes" json:"original_bytes"`
+	ProcessedBytes int64 `bson:"processed_bytes" json:"processed_bytes"`
+}
+
+// DriveUsage totals what the user's files keep on one drive
+type DriveUsage struct {
+	DriveAccountID primitive.ObjectID `bson:"_id" json:"drive_account_id"`
+	DisplayName    string             `bson:"-" json:"display_name,omitempty"`
+	Provider       string             `bson:"-" json:"provider,omitempty"`
+	Linked         bool               `bson:"-" json:"linked"` // False for a drive unlinked while chunks were left on it
+	Files          int                `bson:"files" json:"files"`
+	Chunks         int                `bson:"chunks" json:"chunks"` // Copies and shards
+	StoredBytes    int64              `bson:"stored_bytes" json:"stored_bytes"`
+}
+
+// FileLock keeps a file to the operation changing it, so deletes, updates, appends, rebalances
+// and rekeys of one file never overlap. The holder renews it while working, a lock past its
+// ExpiresAt belongs to a holder that died and can be taken over.
+type FileLock struct {
+	FileID     primitive.ObjectID `bson:"_id" json:"file_id"`
+	Holder     string             `bson:"holder" json:"-"` // Random token of the holder, only it renews and releases the lock
+	Operation  string             `bson:"operation" json:"operation"`
+	AcquiredAt time.Time          `bson:"acquired_at" json:"acquired_at"`
+	ExpiresAt  time.Time          `bson:"expires_at" json:"expires_at"`
 }
@@ -0,0 +1,153 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DriveManifest is the 2xpfm.manifest kept on each drive. It lists every chunk stored on
+// that drive so the drive's contents can be mapped back to files without Mongo. As stored it
+// is an index of the parts holding the files, see ManifestPart; loaded, Files holds them all.
+type DriveManifest struct {
+	DriveAccountID primitive.ObjectID `json:"drive_account_id"`
+	UserID         primitive.ObjectID `json:"user_id"`
+	Files          []ManifestFile     `json:"files,omitempty"` // Stored here only by manifests written before parts
+	Parts          []ManifestPart     `json:"parts,omitempty"`
+	Version        int                `json:"version"` // Increases on every write, earlier versions are kept as 2xpfm.manifest.v<N>
+	UpdatedAt      time.Time          `json:"updated_at"`
+}
+
+// ManifestPart is a part file of a drive manifest, 2xpfm.manifest.part-<NNN>.v<version>. A
+// file is kept in the part its ID hashes to, so adding or removing one rewrites only that part.
+type ManifestPart struct {
+	Part        int    `json:"part"`
+	Version     int    `json:"version"` // Manifest version the part was written at
+	Files       int    `json:"files"`
+	DriveFileID string `json:"drive_file_id"`
+	Checksum    string `json:"checksum"` // SHA-256 of the part file
+}
+
+// ManifestPartFile is the content of a manifest part file
+type ManifestPartFile struct {
+	DriveAccountID primitive.ObjectID `json:"drive_account_id"`
+	Part           int                `json:"part"`
+	Version        int                `json:"version"`
+	Files          []ManifestFile     `json:"files"`
+}
+
+// ManifestFile is a stored file as seen by one drive, holding only the chunks on that drive
+type ManifestFile struct {
+	FileID           primitive.ObjectID        `json:"file_id"`
+	OriginalFilename string                    `json:"original_filename"`
+	ContentType      string                    `json:"content_type,omitempty"`
+	OriginalSize     int64                     `json:"original_size"`
+	ProcessedSize    int64                     `json:"processed_size"`
+	OriginalChecksum string                    `json:"original_checksum"`
+	Obfuscation      ObfuscationMetadata       `json:"obfuscation"`
+	Encryption       *EncryptionMetadata       `json:"encryption,omitempty"`
+	ClientEncryption *ClientEncryptionMetadata `json:"client_encryption,omitempty"`
+	Chunks           []ManifestChunk           `json:"chunks"`
+	ErasureCoding    *ErasureCoding            `json:"erasure_coding,omitempty"`
+	MerkleRoot       string                    `json:"merkle_root,omitempty"` // Covers all of the file's chunks, not only the ones listed
+	Compress         bool                      `json:"compress,omitempty"`
+	CreatedAt        time.Time                 `json:"created_at"`
+}
+
+// ManifestChunk mirrors a StoredChunk located on the manifest's drive
+type ManifestChunk struct {
+	ChunkID     int    `json:"chunk_id"`
+	DriveFileID string `json:"drive_file_id"`
+	Backend     string `json:"backend,omitempty"` // Provider of the drive, see ChunkReplica
+	Filename    string `json:"filename"`
+	StartOffset int64  `json:"start_offset"`
+	EndOffset   int64  `json:"end_offset"`
+	Size        int64  `json:"size"`
+	StoredSize  int64  `json:"stored_size"`
+	Checksum    string `json:"checksum"`
+	// Empty in manifests written before the algorithm was recorded, which means sha256
+	ChecksumAlgo   string `json:"checksum_algo,omitempty"`
+	Compressed     bool   `json:"compressed,omitempty"`
+	CompressedSize int64  `json:"compressed_size,omitempty"`
+	OriginalSize   int64  `json:"original_size,omitempty"` // Content-defined chunks only, see StoredChunk
+	ContentHash    string `json:"content_hash,omitempty"`
+	Shard          int    `json:"shard,omitempty"` // Erasure-coded shard of the chunk on the drive, see ChunkReplica
+	ShardChecksum  string `json:"shard_checksum,omitempty"`
+}
+
+// ReconcileReport is the drift found between the drive manifests and Mongo for one user
+type ReconcileReport struct {
+	UserID            primitive.ObjectID `json:"user_id"`
+	Drives            []DriveReconcile   `json:"drives"`
+	MissingInMongo    []ChunkDrift       `json:"missing_in_mongo"`    // Listed in a manifest, unknown to Mongo
+	MissingInManifest []ChunkDrift       `json:"missing_in_manifest"` // Recorded in Mongo, absent from its drive's manifest
+	Mismatched        []ChunkDrift       `json:"mismatched"`          // In both, but the details differ
+	Repaired          bool               `json:"repaired"`
+	RepairedFiles     []string           `json:"repaired_files,omitempty"`
+	CheckedAt         time.Time          `json:"checked_at"`
+}
+
+// DriveReconcile is the outcome of reading one drive's manifest
+type DriveReconcile struct {
+	DriveAccountID primitive.ObjectID `json:"drive_account_id"`
+	ManifestFound  bool               `json:"manifest_found"`
+	Files          int                `json:"files"`
+	Chunks         int                `json:"chunks"`
+	Error          string             `json:"error,omitempty"`
+}
+
+// ManifestRebuild is the outcome of writing a drive's manifest anew from Mongo
+type ManifestRebuild struct {
+	DriveAccountID primitive.ObjectID `json:"drive_account_id"`
+	Version        int                `json:"version"`
+	Files          int                `json:"files"`
+	Chunks         int                `json:"chunks"`
+	MissingOnDrive []ChunkDrift       `json:"missing_on_drive"` // Recorded in Mongo, but their drive file is gone
+	RebuiltAt      time.Time          `json:"rebuilt_at"`
+}
+
+// ChunkDrift describes a single chunk that differs between a manifest and Mongo
+type ChunkDrift struct {
+	FileID         primitive.ObjectID `json:"file_id"`
+	ChunkID        int                `json:"chunk_id"`
+	DriveAccountID primitive.ObjectID `json:"drive_account_id"`
+	Detail         string             `json:"detail,omitempty"`
+}
+
+// ManifestBackup is every drive manifest of a user, exported so the file records can be rebuilt
+// if Mongo is lost
+type ManifestBackup struct {
+	UserID     primitive.ObjectID `json:"user_id"`
+	Email      string             `json:"email"`
+	Drives     []DriveManifest    `json:"drives"`
+	ExportedAt time.Time          `json:"exported_at"`
+}
+
+// SignedManifestBackup is the document GET /api/account/manifest/export hands out. Signature
+// is the base64 HMAC of Backup as compacted JSON, so reformatting the document keeps it valid.
+type SignedManifestBackup struct {
+	Backup    json.RawMessage `json:"backup"`
+	Signature string          `json:"signature"`
+}
+
+// ManifestImportReport is the outcome of rebuilding file records from a manifest backup
+type ManifestImportReport struct {
+	Drives   []DriveImport `json:"drives"`
+	Restored []string      `json:"restored"`
+	Skipped  []FileSkip    `json:"skipped"`
+	Errors   []string      `json:"errors,omitempty"` // Linked accounts whose manifest couldn't be read to match them
+}
+
+// DriveImport is how a drive of the backup was matched to a linked drive account
+type DriveImport struct {
+	DriveAccountID primitive.ObjectID  `json:"drive_account_id"`    // As in the backup
+	LinkedAs       *primitive.ObjectID `json:"linked_as,omitempty"` // Linked account holding the drive, nil when none does
+	Files          int                 `json:"files"`
+}
+
+// FileSkip is a file of the backup that wasn't restored, and why
+type FileSkip struct {
+	FileID primitive.ObjectID `json:"file_id"`
+	Reason string             `json:"reason"`
+}
@@ -9,25 +9,149 @@ import (
 // DriveAccount represents and is used to store configuration of a drive account.
 type DriveAccount struct {
 	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	Provider       string             `bson:"provider" json:"provider"` // "google"
+	Provider       string             `bson:"provider" json:"provider"` // ProviderGoogle, ProviderS3 or ProviderWebDAV
 	DisplayName    string             `bson:"display_name,omitempty" json:"display_name"`
-	EncryptedToken []byte             `bson:"encrypted_token" json:"-"` // store encrypted oauth2 token JSON
+	EncryptedToken []byte             `bson:"encrypted_token" json:"-"`           // store encrypted oauth2 token JSON, or the S3 / WebDAV config
+	Priority       int                `bson:"priority,omitempty" json:"priority"` // 1 is filled first, 0 after every ranked account
+	Disabled       bool               `bson:"disabled,omitempty" json:"disabled"` // Failed too often, new chunks skip it until it's enabled again
+	DisabledReason string             `bson:"disabled_reason,omitempty" json:"disabled_reason,omitempty"`
+	DisabledAt     *time.Time         `bson:"disabled_at,omitempty" json:"disabled_at,omitempty"`
 	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
 }
 
+// Storage providers an account can be linked with
+const (
+	ProviderGoogle = "google"
+	ProviderS3     = "s3"
+	ProviderWebDAV = "webdav"
+)
+
+// Roles a user can hold, carried in the role claim of their access tokens
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 // User is our standard user object stored in MongoDB.
 type User struct {
 	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	Email         string             `bson:"email" json:"email"`
 	PasswordsHash []byte             `bson:"passwords_hash" json:"-"`
-	DriveAccounts []DriveAccount     `bson:"drive_accounts" json:"drive_accounts"` // Fixed field name
-	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
+	DriveAccounts []DriveAccount     `bson:"drive_accounts" json:"drive_accounts"`               // Fixed field name
+	QuotaBytes    int64              `bson:"quota_bytes,omitempty" json:"quota_bytes,omitempty"` // 0 means the default quota applies
+	// Transfer caps in bytes per second, nil means the configured default applies and 0 unlimited
+	BandwidthBPS        *int64    `bson:"bandwidth_bps,omitempty" json:"bandwidth_bps,omitempty"`                 // Across all of the user's transfers
+	RequestBandwidthBPS *int64    `bson:"request_bandwidth_bps,omitempty" json:"request_bandwidth_bps,omitempty"` // Per upload or download
+	CreatedAt           time.Time `bson:"created_at" json:"created_at"`
+	// Endpoint notified when the user's uploads and downloads finish, and its signing secret
+	// encrypted with TOKEN_ENC_KEY
+	WebhookURL    string `bson:"webhook_url,omitempty" json:"webhook_url,omitempty"`
+	WebhookSecret []byte `bson:"webhook_secret,omitempty" json:"-"`
+	Role          string `bson:"role,omitempty" json:"role,omitempty"` // RoleUser or RoleAdmin, empty counts as RoleUser
+	// TOTP second factor, set up but not yet enabled until a first code is verified
+	TwoFactor *TwoFactor `bson:"two_factor,omitempty" json:"-"`
+	// Subject of the Google account the user signs in with, empty until they first do
+	GoogleID string `bson:"google_id,omitempty" json:"-"`
+}
+
+// TwoFactor is a user's TOTP second factor
+type TwoFactor struct {
+	Secret        []byte     `bson:"secret"`                   // TOTP secret encrypted with TOKEN_ENC_KEY
+	Enabled       bool       `bson:"enabled"`                  // Login asks for a code
+	RecoveryCodes []string   `bson:"recovery_codes,omitempty"` // Hashes of the unused one-time recovery codes
+	LastStep      int64      `bson:"last_step,omitempty"`      // Time step of the last accepted code, so a code works once
+	EnabledAt     *time.Time `bson:"enabled_at,omitempty"`
 }
 
 // OAuthState is used to temporarily store OAuth state values so the user can be tracked back after OAuth flow
 type OAuthState struct {
 	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"` // Missing on states stored before states expired
+	UsedAt    *time.Time         `bson:"used_at,omitempty" json:"used_at,omitempty"`
 	State     string             `bson:"state" json:"state"`
-	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"` // Nil for signing in, the user isn't known yet
 	Provider  string             `bson:"provider" json:"provider"`
+	Purpose   string             `bson:"purpose,omitempty" json:"purpose,omitempty"` // OAuthPurposeLogin, empty for linking a drive
+}
+
+// OAuthPurposeLogin marks the states of signing in with Google, which the Drive linking
+// callback refuses and the other way round
+const OAuthPurposeLogin = "login"
+
+// RefreshToken is a long-lived token used to obtain new access tokens. Only its hash is stored.
+type RefreshToken struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID     primitive.ObjectID `bson:"user_id" json:"user_id"`
+	TokenHash  string             `bson:"token_hash" json:"-"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt  time.Time          `bson:"expires_at" json:"expires_at"`
+	RevokedAt  *time.Time         `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+	ReplacedBy primitive.ObjectID `bson:"replaced_by,omitempty" json:"replaced_by,omitempty"` // Set when rotated
+}
+
+// PasswordResetToken is a single-use token emailed to reset a forgotten password. Only its hash is stored.
+type PasswordResetToken struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	TokenHash string             `bson:"token_hash" json:"-"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"`
+	UsedAt    *time.Time         `bson:"used_at,omitempty" json:"used_at,omitempty"`
+}
+
+// TokenRevocation kills every token a user was issued before RevokedBefore
+type TokenRevocation struct {
+	UserID        primitive.ObjectID `bson:"_id" json:"user_id"`
+	RevokedBefore time.Time          `bson:"revoked_before" json:"revoked_before"`
+}
+
+// AuditEvent records a security-relevant action on a user's account
+type AuditEvent struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Type      string             `bson:"type" json:"type"` // One of the AuditX event types
+	IP        string             `bson:"ip,omitempty" json:"ip,omitempty"`
+	RequestID string             `bson:"request_id,omitempty" json:"request_id,omitempty"`
+	Details   map[string]string  `bson:"details,omitempty" json:"details,omitempty"` // e.g. file_id, drive_id
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
 }
+
+// WebhookDelivery is one notification sent to a user's webhook, with the outcome of its latest attempt
+type WebhookDelivery struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID         primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Event          string             `bson:"event" json:"event"`                 // e.g. "upload.complete", "download.failed"
+	Payload        []byte             `bson:"payload" json:"-"`                   // The JSON body, sent unchanged on every attempt
+	URL            string             `bson:"url,omitempty" json:"url,omitempty"` // Where the latest attempt went
+	Status         string             `bson:"status" json:"status"`               // "pending", "delivered", "failed"
+	Attempts       int                `bson:"attempts" json:"attempts"`
+	ResponseStatus int                `bson:"response_status,omitempty" json:"response_status,omitempty"` // HTTP status of the latest attempt
+	LastError      string             `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+	NextAttemptAt  time.Time          `bson:"next_attempt_at" json:"next_attempt_at"` // Also set while an attempt runs, so no one else claims it
+	DeliveredAt    *time.Time         `bson:"delivered_at,omitempty" json:"delivered_at,omitempty"`
+}
+
+// Audit event types
+const (
+	AuditLoginSuccess    = "login_success"
+	AuditLoginFailure    = "login_failure"
+	AuditTwoFactorOn     = "2fa_enabled"
+	AuditTwoFactorOff    = "2fa_disabled"
+	AuditDriveLinked     = "drive_linked"
+	AuditGoogleLinked    = "google_linked"
+	AuditDriveUnlinked   = "drive_unlinked"
+	AuditFileUploaded    = "file_uploaded"
+	AuditFileUpdated     = "file_updated"
+	AuditFileAppended    = "file_appended"
+	AuditFileDownloaded  = "file_downloaded"
+	AuditFileDeleted     = "file_deleted"
+	AuditFilesDeleted    = "files_deleted"
+	AuditShareCreated    = "share_created"
+	AuditRoleChanged     = "role_changed"
+	AuditDataExported    = "data_exported"
+	AuditBackupExported  = "backup_exported"
+	AuditBackupImported  = "backup_imported"
+	AuditManifestRebuilt = "manifest_rebuilt"
+	AuditAccountDeleted  = "account_deleted"
+)
@@ -0,0 +1,36 @@
+// Package netguard keeps connections to user supplied hosts off the server's own network
+package netguard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// ErrNotPublic is returned for connections to addresses that aren't public
+var ErrNotPublic = errors.New("address is not public")
+
+// CheckAddr refuses connections to loopback, private and link-local addresses, for use as a
+// net.Dialer's Control. It runs on the resolved address, so a public name pointing at an
+// internal one is refused too.
+func CheckAddr(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: unresolved address %s", ErrNotPublic, host)
+	}
+	if !PublicIP(ip) {
+		return fmt.Errorf("%w: %s", ErrNotPublic, ip)
+	}
+	return nil
+}
+
+// PublicIP reports whether ip can be reached outside the server's own network
+func PublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
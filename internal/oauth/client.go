@@ -0,0 +1,244 @@
+package oauth
+
+import (
+	"SE/internal/metrics"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/oauth2"
+)
+
+// DriveClientForAccount returns an *http.Client for a linked drive account. Expired access
+// tokens are refreshed with the stored refresh token and the new token is saved back to the
+// account. A request rejected with 401 is retried once after forcing a refresh, and rate
+// limits and server errors are retried with backoff.
+func DriveClientForAccount(ctx context.Context, accountID primitive.ObjectID) (*http.Client, error) {
+	account, err := store.GetDriveAccountByID(ctx, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get drive account: %w", err)
+	}
+
+	// Decrypt OAuth token
+	tokenData, err := Decrypt(account.EncryptedToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt token: %w", err)
+	}
+
+	var token oauth2.Token
+	if err := json.Unmarshal(tokenData, &token); err != nil {
+		return nil, fmt.Errorf("failed to parse token: %w", err)
+	}
+
+	src := &accountTokenSource{ctx: ctx, accountID: accountID, token: &token}
+	return &http.Client{
+		Transport: &driveTransport{base: metrics.InstrumentRoundTripper(metrics.DriveRequests, http.DefaultTransport), src: src},
+	}, nil
+}
+
+// RevokeDriveAccountToken revokes the account's grant at Google. A token Google no longer
+// recognizes counts as revoked.
+func RevokeDriveAccountToken(ctx context.Context, account *models.DriveAccount) error {
+	tokenData, err := Decrypt(account.EncryptedToken)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt token: %w", err)
+	}
+
+	var token oauth2.Token
+	if err := json.Unmarshal(tokenData, &token); err != nil {
+		return fmt.Errorf("failed to parse token: %w", err)
+	}
+
+	// Revoking the refresh token also invalidates its access tokens
+	revokeToken := token.RefreshToken
+	if revokeToken == "" {
+		revokeToken = token.AccessToken
+	}
+
+	form := url.Values{"token": {revokeToken}}
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://oauth2.googleapis.com/revoke", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("revoke request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusBadRequest && strings.Contains(string(body), "invalid_token") {
+		return nil
+	}
+	return fmt.Errorf("revoke returned status %d: %s", resp.StatusCode, string(body))
+}
+
+// accountTokenSource hands out the account's access token, refreshing and persisting it as needed
+type accountTokenSource struct {
+	ctx       context.Context
+	accountID primitive.ObjectID
+	mu        sync.Mutex
+	token     *oauth2.Token
+}
+
+func (s *accountTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token.Valid() {
+		return s.token, nil
+	}
+	return s.refreshLocked()
+}
+
+// forceRefresh refreshes the token unless another request already replaced the rejected one
+func (s *accountTokenSource) forceRefresh(rejected *oauth2.Token) (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token.AccessToken != rejected.AccessToken {
+		return s.token, nil
+	}
+	return s.refreshLocked()
+}
+
+func (s *accountTokenSource) refreshLocked() (*oauth2.Token, error) {
+	if s.token.RefreshToken == "" {
+		return nil, fmt.Errorf("drive account %s has no refresh token", s.accountID.Hex())
+	}
+
+	// Passing only the refresh token makes the config's source refresh unconditionally
+	fresh, err := oauthConf.TokenSource(s.ctx, &oauth2.Token{RefreshToken: s.token.RefreshToken}).Token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh token: %w", err)
+	}
+	s.token = fresh
+
+	// The refreshed token is still usable for this client if saving it fails
+	if err := s.persist(fresh); err != nil {
+		log.Printf("Failed to save refreshed token for drive account %s: %v", s.accountID.Hex(), err)
+	}
+	return fresh, nil
+}
+
+func (s *accountTokenSource) persist(token *oauth2.Token) error {
+	b, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	enc, err := Encrypt(b)
+	if err != nil {
+		return err
+	}
+	return store.UpdateDriveAccountToken(s.ctx, s.accountID, enc)
+}
+
+// driveTransport authorizes requests, retries once with a fresh token on 401 and retries
+// rate limits and server errors with backoff, up to DRIVE_MAX_ATTEMPTS attempts
+type driveTransport struct {
+	base http.RoundTripper
+	src  *accountTokenSource
+}
+
+func (t *driveTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The body has been consumed after an attempt, so only requests that can rewind it are retried
+	rewindable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		resp, err := t.roundTripAuthorized(req)
+		if attempt >= driveMaxAttempts || !rewindable {
+			return resp, err
+		}
+
+		var reason string
+		switch {
+		case err != nil:
+			if !transientError(err) {
+				return nil, err
+			}
+			reason = "failed: " + err.Error()
+		case retryable(resp):
+			reason = "got " + strconv.Itoa(resp.StatusCode)
+		default:
+			return resp, nil
+		}
+
+		delay := retryDelay(resp, attempt-1)
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		logRetry(t.src.ctx, req, reason, attempt, delay)
+		if err := sleepCtx(t.src.ctx, req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// roundTripAuthorized sends the request with the account's token, refreshing it once on 401
+func (t *driveTransport) roundTripAuthorized(req *http.Request) (*http.Response, error) {
+	token, err := t.src.Token()
+	if err != nil {
+		return nil, tokenError{err}
+	}
+
+	resp, err := t.base.RoundTrip(authorize(req, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// The body has been consumed, so only requests that can rewind it are retried
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, nil
+	}
+
+	token, err = t.src.forceRefresh(token)
+	if err != nil {
+		log.Printf("Drive request got 401 and token refresh failed: %v", err)
+		return resp, nil
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	retry := authorize(req, token)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	return t.base.RoundTrip(retry)
+}
+
+// authorize returns a copy of req carrying the token, as RoundTrippers must not modify requests
+func authorize(req *http.Request, token *oauth2.Token) *http.Request {
+	out := req.Clone(req.Context())
+	token.SetAuthHeader(out)
+	return out
+}
@@ -1,12 +1,16 @@
 package oauth
 
 import (
+	"SE/internal/audit"
+	"SE/internal/middleware"
 	"SE/internal/models"
 	"SE/internal/store"
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -15,7 +19,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"golang.org/x/oauth2"
@@ -24,6 +30,14 @@ import (
 
 var oauthConf *oauth2.Config
 var tokenEncKey []byte
+var driveMaxAttempts int
+
+// How long a state handed out by NewState can be brought back to the callback
+var oauthStateTTL time.Duration
+
+// previousTokenEncKey is the key TOKEN_ENC_KEY replaced, still accepted for decryption until
+// everything sealed with it has been re-wrapped
+var previousTokenEncKey []byte
 
 func InitOAuthConfig() {
 	// Decode base64-encoded TOKEN_ENC_KEY
@@ -37,6 +51,30 @@ func InitOAuthConfig() {
 		log.Fatalf("TOKEN_ENC_KEY must decode to exactly 32 bytes for AES-256, got %d bytes", len(tokenEncKey))
 	}
 
+	// Set while rotating TOKEN_ENC_KEY, to the old key
+	if prev := os.Getenv("TOKEN_ENC_KEY_PREVIOUS"); prev != "" {
+		previousTokenEncKey, err = base64.StdEncoding.DecodeString(prev)
+		if err != nil {
+			log.Fatalf("TOKEN_ENC_KEY_PREVIOUS must be valid base64: %v", err)
+		}
+		if len(previousTokenEncKey) != 32 {
+			log.Fatalf("TOKEN_ENC_KEY_PREVIOUS must decode to exactly 32 bytes for AES-256, got %d bytes", len(previousTokenEncKey))
+		}
+		log.Printf("TOKEN_ENC_KEY_PREVIOUS set, data sealed with the previous key is still readable")
+	}
+
+	// Attempts per Drive request, including the first, before a 429 or 5xx is returned
+	driveMaxAttempts, _ = strconv.Atoi(os.Getenv("DRIVE_MAX_ATTEMPTS"))
+	if driveMaxAttempts <= 0 {
+		driveMaxAttempts = 5
+	}
+
+	stateMinutes, _ := strconv.Atoi(os.Getenv("OAUTH_STATE_TTL_MINUTES"))
+	if stateMinutes <= 0 {
+		stateMinutes = 10
+	}
+	oauthStateTTL = time.Duration(stateMinutes) * time.Minute
+
 	// Ensure BASE_URL doesn't have trailing slash
 	baseURL := strings.TrimSuffix(os.Getenv("BASE_URL"), "/")
 
@@ -66,19 +104,10 @@ func InitOAuthConfig() {
 func DriveLinkHandler(w http.ResponseWriter, r *http.Request) {
 	uid := r.Context().Value("userID").(primitive.ObjectID)
 
-	state, err := randomState()
-	if err != nil {
-		http.Error(w, "server error", http.StatusInternalServerError)
-		return
-	}
-
 	// store state -> user
-	if err := store.InsertOAuthState(r.Context(), &models.OAuthState{
-		State:    state,
-		UserID:   uid,
-		Provider: "google",
-	}); err != nil {
-		http.Error(w, "server error", http.StatusInternalServerError)
+	state, err := NewState(r.Context(), uid, "")
+	if err != nil {
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
 		return
 	}
 
@@ -98,37 +127,11 @@ func DriveLinkHandler(w http.ResponseWriter, r *http.Request) {
 
 // GET /oauth2/callback?state=...&code=...
 func OauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query()
-	state := q.Get("state")
-	code := q.Get("code")
-	errParam := q.Get("error")
-
-	// Check for OAuth errors
-	if errParam != "" {
-		errDesc := q.Get("error_description")
-		log.Printf("OAuth error: %s - %s", errParam, errDesc)
-		http.Error(w, fmt.Sprintf("OAuth error: %s", errParam), http.StatusBadRequest)
-		return
-	}
-
-	if state == "" || code == "" {
-		log.Printf("Missing OAuth params: state=%s, code=%s", state, code)
-		http.Error(w, "missing params", http.StatusBadRequest)
-		return
-	}
-
-	// lookup and delete state
-	stored, err := store.FindAndDeleteState(r.Context(), state)
-	if err != nil {
-		log.Printf("Error finding state: %v", err)
-		http.Error(w, "server error", http.StatusInternalServerError)
-		return
-	}
+	stored, code := ConsumeState(w, r, "")
 	if stored == nil {
-		log.Printf("Invalid or expired state: %s", state)
-		http.Error(w, "invalid or expired state", http.StatusBadRequest)
 		return
 	}
+	state := stored.State
 
 	log.Printf("OAuth callback for user %s, exchanging code...", stored.UserID.Hex())
 
@@ -136,7 +139,7 @@ func OauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	tok, err := oauthConf.Exchange(r.Context(), code)
 	if err != nil {
 		log.Printf("Token exchange failed: %v", err)
-		http.Error(w, "token exchange failed", http.StatusInternalServerError)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeOAuthFailed, "token exchange failed")
 		return
 	}
 
@@ -145,15 +148,15 @@ func OauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	// marshal token to JSON
 	b, err := json.Marshal(tok)
 	if err != nil {
-		http.Error(w, "server error", http.StatusInternalServerError)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
 		return
 	}
 
 	// encrypt token
-	enc, err := encrypt(b)
+	enc, err := Encrypt(b)
 	if err != nil {
 		log.Printf("Encryption failed: %v", err)
-		http.Error(w, "encrypt failed", http.StatusInternalServerError)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "encrypt failed")
 		return
 	}
 
@@ -166,23 +169,174 @@ func OauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
 
 	if err := store.AddDriveAccountToUser(r.Context(), stored.UserID, acct); err != nil {
 		log.Printf("Failed to save drive account: %v", err)
-		http.Error(w, "db save failed", http.StatusInternalServerError)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "db save failed")
 		return
 	}
 
 	log.Printf("Drive account added successfully for user %s", stored.UserID.Hex())
+	audit.Record(r, stored.UserID, models.AuditDriveLinked, map[string]string{"provider": acct.Provider})
+
+	// The state is used up, the sweeper would remove it anyway
+	if err := store.DeleteOAuthState(r.Context(), state); err != nil {
+		log.Printf("Failed to delete OAuth state %s: %v", state, err)
+	}
 
 	// redirect to completion page
 	http.Redirect(w, r, os.Getenv("BASE_URL")+"/oauth/finished", http.StatusSeeOther)
 }
 
-// AES-GCM encrypt helper
-func encrypt(plain []byte) ([]byte, error) {
-	if len(tokenEncKey) != 32 {
+// NewState stores a state for an authorization of the purpose, empty for linking a drive to
+// userID, and returns it for the authorization URL
+func NewState(ctx context.Context, userID primitive.ObjectID, purpose string) (string, error) {
+	state, err := randomState()
+	if err != nil {
+		return "", err
+	}
+	err = store.InsertOAuthState(ctx, &models.OAuthState{
+		ExpiresAt: time.Now().UTC().Add(oauthStateTTL),
+		State:     state,
+		UserID:    userID,
+		Provider:  "google",
+		Purpose:   purpose,
+	})
+	return state, err
+}
+
+// ConsumeState validates the callback's state for the purpose and marks it used, returning it
+// with the authorization code. It answers the request itself and returns nil when the callback
+// carries an error or the state isn't one it can use.
+func ConsumeState(w http.ResponseWriter, r *http.Request, purpose string) (*models.OAuthState, string) {
+	q := r.URL.Query()
+	state := q.Get("state")
+	code := q.Get("code")
+	errParam := q.Get("error")
+
+	again := "start linking again"
+	if purpose == models.OAuthPurposeLogin {
+		again = "start signing in again"
+	}
+
+	// Check for OAuth errors
+	if errParam != "" {
+		errDesc := q.Get("error_description")
+		log.Printf("OAuth error: %s - %s", errParam, errDesc)
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeOAuthFailed, fmt.Sprintf("OAuth error: %s", errParam))
+		return nil, ""
+	}
+
+	if state == "" || code == "" {
+		log.Printf("Missing OAuth params: state=%s, code=%s", state, code)
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeInvalidRequest, "missing params")
+		return nil, ""
+	}
+
+	// Mark the state used before anything else, so a replayed callback can't use it again
+	stored, consumed, err := store.ConsumeOAuthState(r.Context(), state)
+	if err != nil {
+		log.Printf("Error finding state: %v", err)
+		middleware.WriteJSONError(w, http.StatusInternalServerError, middleware.ErrCodeInternal, "server error")
+		return nil, ""
+	}
+	// A state of the other flow is as good as unknown, or a login could link a drive
+	if stored == nil || stored.Purpose != purpose {
+		log.Printf("Unknown OAuth state: %s", state)
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeOAuthStateInvalid, "unknown state, "+again)
+		return nil, ""
+	}
+	if !consumed {
+		log.Printf("OAuth state %s for user %s was already used", state, stored.UserID.Hex())
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeOAuthStateUsed, "state was already used, "+again)
+		return nil, ""
+	}
+	if time.Now().After(stateExpiry(stored)) {
+		log.Printf("OAuth state %s for user %s expired", state, stored.UserID.Hex())
+		middleware.WriteJSONError(w, http.StatusBadRequest, middleware.ErrCodeOAuthStateExpired, "state expired, "+again)
+		return nil, ""
+	}
+	return stored, code
+}
+
+// stateExpiry returns when s stops being accepted. States stored before they carried an
+// expiry last oauthStateTTL from their creation.
+func stateExpiry(s *models.OAuthState) time.Time {
+	if s.ExpiresAt.IsZero() {
+		return s.CreatedAt.Add(oauthStateTTL)
+	}
+	return s.ExpiresAt
+}
+
+// CleanupExpiredStates removes the states that expired more than oauthStateTTL ago. Keeping
+// them that long lets a late callback be told its state expired rather than that it's unknown.
+func CleanupExpiredStates(ctx context.Context) (int64, error) {
+	cutoff := time.Now().UTC().Add(-oauthStateTTL)
+	return store.DeleteExpiredOAuthStates(ctx, cutoff, cutoff.Add(-oauthStateTTL))
+}
+
+// AES-GCM encrypt helper, keyed with TOKEN_ENC_KEY
+func Encrypt(plain []byte) ([]byte, error) {
+	return encryptWith(tokenEncKey, plain)
+}
+
+// AES-GCM decrypt helper, falls back to TOKEN_ENC_KEY_PREVIOUS for data sealed before a rotation
+func Decrypt(data []byte) ([]byte, error) {
+	plain, err := decryptWith(tokenEncKey, data)
+	if err != nil && previousTokenEncKey != nil {
+		if prev, prevErr := decryptWith(previousTokenEncKey, data); prevErr == nil {
+			return prev, nil
+		}
+	}
+	return plain, err
+}
+
+// Rewrap re-encrypts data sealed with TOKEN_ENC_KEY_PREVIOUS under TOKEN_ENC_KEY and reports
+// whether it had to. Data already sealed with TOKEN_ENC_KEY is returned as is.
+func Rewrap(data []byte) ([]byte, bool, error) {
+	if _, err := decryptWith(tokenEncKey, data); err == nil {
+		return data, false, nil
+	}
+	if previousTokenEncKey == nil {
+		return nil, false, errors.New("data isn't sealed with TOKEN_ENC_KEY and TOKEN_ENC_KEY_PREVIOUS is not set")
+	}
+	plain, err := decryptWith(previousTokenEncKey, data)
+	if err != nil {
+		return nil, false, errors.New("data is sealed with neither TOKEN_ENC_KEY nor TOKEN_ENC_KEY_PREVIOUS")
+	}
+	sealed, err := Encrypt(plain)
+	if err != nil {
+		return nil, false, err
+	}
+	return sealed, true, nil
+}
+
+// HMAC-SHA256 of data for the purpose, keyed with a key derived from TOKEN_ENC_KEY so
+// signatures of one purpose don't verify for another
+func Sign(purpose string, data []byte) []byte {
+	return signWith(tokenEncKey, purpose, data)
+}
+
+// Verify reports whether sig is the signature of data for the purpose, made with TOKEN_ENC_KEY
+// or, during a rotation, TOKEN_ENC_KEY_PREVIOUS
+func Verify(purpose string, data, sig []byte) bool {
+	if hmac.Equal(sig, signWith(tokenEncKey, purpose, data)) {
+		return true
+	}
+	return previousTokenEncKey != nil && hmac.Equal(sig, signWith(previousTokenEncKey, purpose, data))
+}
+
+func signWith(key []byte, purpose string, data []byte) []byte {
+	derive := hmac.New(sha256.New, key)
+	derive.Write([]byte("sign:" + purpose))
+	mac := hmac.New(sha256.New, derive.Sum(nil))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func encryptWith(key, plain []byte) ([]byte, error) {
+	if len(key) != 32 {
 		return nil, errors.New("invalid encryption key length")
 	}
 
-	block, err := aes.NewCipher(tokenEncKey)
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
@@ -201,13 +355,12 @@ func encrypt(plain []byte) ([]byte, error) {
 	return ciphertext, nil
 }
 
-// AES-GCM decrypt helper
-func Decrypt(data []byte) ([]byte, error) {
-	if len(tokenEncKey) != 32 {
+func decryptWith(key, data []byte) ([]byte, error) {
+	if len(key) != 32 {
 		return nil, errors.New("invalid encryption key length")
 	}
 
-	block, err := aes.NewCipher(tokenEncKey)
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
@@ -247,10 +400,3 @@ func maskString(s string) string {
 	}
 	return s[:4] + "****" + s[len(s)-4:]
 }
-
-// NewClient returns an *http.Client that automatically refreshes the Google OAuth2 token
-// using the refresh_token as needed. Use this instead of oauth2.StaticTokenSource so
-// requests keep working after access tokens expire.
-func NewClient(ctx context.Context, tok *oauth2.Token) *http.Client {
-	return oauthConf.Client(ctx, tok)
-}
@@ -0,0 +1,99 @@
+package oauth
+
+import (
+	"SE/internal/middleware"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+)
+
+// retryable reports whether a Drive response is worth repeating. Rate limits and server
+// errors are; other 403s (storage quota, daily limit, permissions) are not, and 401s are
+// handled by the token refresh instead.
+func retryable(resp *http.Response) bool {
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true
+	case resp.StatusCode == http.StatusForbidden:
+		return rateLimited(resp)
+	default:
+		return false
+	}
+}
+
+// rateLimited looks for Drive's rate limit reasons in a 403 body, leaving the body readable
+func rateLimited(resp *http.Response) bool {
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	return bytes.Contains(body, []byte("rateLimitExceeded")) || bytes.Contains(body, []byte("userRateLimitExceeded"))
+}
+
+// retryDelay is the wait before the given retry: Retry-After if the response has one,
+// otherwise exponential backoff with full jitter
+func retryDelay(resp *http.Response, retry int) time.Duration {
+	if resp != nil {
+		if after := resp.Header.Get("Retry-After"); after != "" {
+			if secs, err := strconv.Atoi(after); err == nil && secs >= 0 {
+				return min(time.Duration(secs)*time.Second, retryMaxDelay)
+			}
+			if at, err := http.ParseTime(after); err == nil {
+				return min(max(time.Until(at), 0), retryMaxDelay)
+			}
+		}
+	}
+	backoff := min(retryBaseDelay<<retry, retryMaxDelay)
+	return rand.N(backoff) + time.Millisecond
+}
+
+// tokenError marks a failure to get an access token, which retrying won't fix
+type tokenError struct{ err error }
+
+func (e tokenError) Error() string { return e.err.Error() }
+func (e tokenError) Unwrap() error { return e.err }
+
+// transientError reports whether a transport error may go away on retry
+func transientError(err error) bool {
+	var tokenErr tokenError
+	if errors.As(err, &tokenErr) {
+		return false
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// sleepCtx waits for d unless either context is done first
+func sleepCtx(ctx, reqCtx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-reqCtx.Done():
+		return reqCtx.Err()
+	}
+}
+
+func logRetry(ctx context.Context, req *http.Request, reason string, attempt int, delay time.Duration) {
+	prefix := ""
+	if id := middleware.GetRequestID(ctx); id != "" {
+		prefix = "[" + id + "] "
+	}
+	log.Printf("%sDrive request %s %s %s, retrying in %s (attempt %d/%d)",
+		prefix, req.Method, req.URL.Path, reason, delay.Round(time.Millisecond), attempt+1, driveMaxAttempts)
+}
@@ -0,0 +1,227 @@
+package replication
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/fileprocessor"
+	"SE/internal/manifest"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fileLocks keeps two heals of the same file from uploading the same replicas
+var fileLocks sync.Map
+
+func lockFile(fileID primitive.ObjectID) func() {
+	mu, _ := fileLocks.LoadOrStore(fileID, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// HealFile brings every chunk of a stored file back to the configured replication factor.
+// Replicas on drives that are no longer linked are dropped, then chunks with too few copies
+// are downloaded from a surviving replica and uploaded to the drives with the most free space.
+// Erasure-coded chunks only lose the shards on unlinked drives.
+// It is meant to run in the background, errors are returned for the caller to log.
+func HealFile(ctx context.Context, fileID primitive.ObjectID) error {
+	unlock := lockFile(fileID)
+	defer unlock()
+	// Other servers change the file's chunks too, a heal would write back the ones it read
+	release, err := fileprocessor.LockFile(ctx, fileID, "heal")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	file, err := store.GetStoredFile(ctx, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to load file: %w", err)
+	}
+	if file == nil {
+		return errors.New("file not found")
+	}
+	if file.Status == "deleted" || file.Status == "partially_deleted" {
+		return nil
+	}
+
+	accounts, err := store.ListUserDriveAccounts(ctx, file.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to list drive accounts: %w", err)
+	}
+	linked := make(map[primitive.ObjectID]bool, len(accounts))
+	for _, account := range accounts {
+		linked[account.ID] = true
+	}
+
+	factor := fileprocessor.GetReplicationFactor()
+	changed := false
+	var errs []error
+	var needed []int
+	var assignments []models.ChunkAssignment
+
+	for i := range file.Chunks {
+		chunk := &file.Chunks[i]
+		live := make([]models.ChunkReplica, 0, len(chunk.Replicas))
+		for _, r := range chunk.Replicas {
+			if linked[r.DriveAccountID] {
+				live = append(live, r)
+			}
+		}
+		if len(live) != len(chunk.Replicas) {
+			chunk.Replicas = live
+			changed = true
+		}
+
+		switch {
+		case len(live) == 0:
+			errs = append(errs, fmt.Errorf("chunk %d has no surviving replica", chunk.ChunkID))
+		case chunk.Sharded():
+			// Shards aren't copies, a lost one can't be copied back from the others
+			if file.ErasureCoding == nil || len(live) < file.ErasureCoding.DataShards {
+				errs = append(errs, fmt.Errorf("chunk %d has too few surviving shards, %d", chunk.ChunkID, len(live)))
+			}
+		case len(live) < factor:
+			ids := make([]primitive.ObjectID, 0, len(live))
+			for _, r := range live {
+				ids = append(ids, r.DriveAccountID)
+			}
+			needed = append(needed, i)
+			assignments = append(assignments, models.ChunkAssignment{
+				ChunkID:         chunk.ChunkID,
+				Size:            storedSize(chunk),
+				StartOffset:     chunk.StartOffset,
+				EndOffset:       chunk.EndOffset,
+				DriveAccountIDs: ids,
+			})
+		}
+	}
+
+	var uploaded []models.ChunkReplica
+	if len(needed) > 0 {
+		drives, err := drivemanager.GetUserDriveSpaces(ctx, file.UserID, true)
+		if err != nil {
+			return fmt.Errorf("failed to get drive spaces: %w", err)
+		}
+		assignments = fileprocessor.AddReplicas(assignments, drives, factor)
+
+		for n, i := range needed {
+			chunk := &file.Chunks[i]
+			targets := assignments[n].DriveAccountIDs[len(chunk.Replicas):]
+			if len(targets) == 0 {
+				continue
+			}
+			added, err := healChunk(ctx, chunk, targets)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			if len(added) > 0 {
+				chunk.Replicas = append(chunk.Replicas, added...)
+				uploaded = append(uploaded, added...)
+				changed = true
+			}
+		}
+	}
+
+	if !changed {
+		return errors.Join(errs...)
+	}
+
+	// The file may have been deleted while chunks were copied, don't bring its record back
+	current, err := store.GetStoredFile(ctx, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to reload file: %w", err)
+	}
+	if current == nil || current.Status == "deleted" || current.Status == "partially_deleted" {
+		for _, r := range uploaded {
+			drivemanager.DeleteDriveFile(ctx, r.DriveAccountID, r.DriveFileID)
+		}
+		return nil
+	}
+
+	if err := store.UpdateStoredFileChunks(ctx, fileID, file.Chunks); err != nil {
+		return fmt.Errorf("failed to save replicas: %w", err)
+	}
+	if err := manifest.AddFile(ctx, file); err != nil {
+		log.Printf("Failed to update drive manifests for file %s: %v", fileID.Hex(), err)
+	}
+	if len(uploaded) > 0 {
+		log.Printf("Healed file %s: %d replicas added", fileID.Hex(), len(uploaded))
+	}
+	return errors.Join(errs...)
+}
+
+// healChunk copies a chunk from one of its replicas to each target drive
+func healChunk(ctx context.Context, chunk *models.StoredChunk, targets []primitive.ObjectID) ([]models.ChunkReplica, error) {
+	tmp, err := os.CreateTemp(fileprocessor.GetUploadTempDir(), fmt.Sprintf("heal_%03d_*.2xpfm", chunk.ChunkID))
+	if err != nil {
+		return nil, fmt.Errorf("chunk %d: failed to create temp file: %w", chunk.ChunkID, err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := downloadSurvivor(ctx, tmp, chunk); err != nil {
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("chunk %d: %w", chunk.ChunkID, err)
+	}
+
+	added := make([]models.ChunkReplica, 0, len(targets))
+	var errs []error
+	for _, accountID := range targets {
+		replica, err := drivemanager.UploadChunkToDrive(ctx, accountID, tmp.Name(), chunk.Filename)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("chunk %d: failed to upload to drive %s: %w", chunk.ChunkID, accountID.Hex(), err))
+			continue
+		}
+		added = append(added, replica)
+	}
+	return added, errors.Join(errs...)
+}
+
+// downloadSurvivor writes a replica of the chunk that matches its checksum into f
+func downloadSurvivor(ctx context.Context, f *os.File, chunk *models.StoredChunk) error {
+	// Checked up front, an unknown algorithm fails the same way on every replica
+	if _, err := fileprocessor.NewHash(chunk.ChecksumAlgo); err != nil {
+		return fmt.Errorf("chunk %d: %w", chunk.ChunkID, err)
+	}
+
+	var errs []error
+	for _, replica := range drivemanager.OrderReplicas(chunk.Replicas) {
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		hash, _ := fileprocessor.NewHash(chunk.ChecksumAlgo)
+		if _, err := drivemanager.DownloadChunkFromDrive(ctx, replica.DriveAccountID, replica.DriveFileID, io.MultiWriter(f, hash)); err != nil {
+			errs = append(errs, fmt.Errorf("chunk %d: failed to download from drive %s: %w", chunk.ChunkID, replica.DriveAccountID.Hex(), err))
+			continue
+		}
+		if checksum := fmt.Sprintf("%x", hash.Sum(nil)); checksum != chunk.Checksum {
+			errs = append(errs, fmt.Errorf("chunk %d: checksum mismatch on drive %s", chunk.ChunkID, replica.DriveAccountID.Hex()))
+			continue
+		}
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// storedSize is the space a copy of the chunk takes on a drive
+func storedSize(chunk *models.StoredChunk) int64 {
+	// Chunks stored before encryption only recorded their plaintext size
+	if chunk.StoredSize > 0 {
+		return chunk.StoredSize
+	}
+	return chunk.Size
+}
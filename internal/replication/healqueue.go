@@ -0,0 +1,45 @@
+package replication
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Heals running at once across every QueueHeal, set by InitReplicationConfig
+var healSlots chan struct{}
+
+// InitReplicationConfig reads how many files are healed at once, HEAL_CONCURRENCY
+func InitReplicationConfig() {
+	n := 2
+	if v := os.Getenv("HEAL_CONCURRENCY"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("HEAL_CONCURRENCY must be a positive number, got %q", v)
+		}
+	}
+	healSlots = make(chan struct{}, n)
+}
+
+// QueueHeal heals the files in the background, HEAL_CONCURRENCY at a time however many are
+// queued, so unlinking a drive holding thousands of files doesn't copy them all at once
+func QueueHeal(fileIDs []primitive.ObjectID) {
+	if len(fileIDs) == 0 {
+		return
+	}
+	go func() {
+		for _, fileID := range fileIDs {
+			healSlots <- struct{}{}
+			go func(fileID primitive.ObjectID) {
+				defer func() { <-healSlots }()
+				if err := HealFile(context.Background(), fileID); err != nil {
+					log.Printf("Failed to heal file %s: %v", fileID.Hex(), err)
+				}
+			}(fileID)
+		}
+	}()
+}
@@ -0,0 +1,272 @@
+package replication
+
+import (
+	"SE/internal/drivemanager"
+	"SE/internal/fileprocessor"
+	"SE/internal/manifest"
+	"SE/internal/models"
+	"SE/internal/store"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ChunkMove is a chunk copy RebalanceFile moved from one drive to another
+type ChunkMove struct {
+	ChunkID int                `json:"chunk_id"`
+	From    primitive.ObjectID `json:"from_drive_account_id"`
+	To      primitive.ObjectID `json:"to_drive_account_id"`
+	Bytes   int64              `json:"bytes"`
+}
+
+// RebalanceFile moves copies of the file's chunks from its owner's fullest drives to the
+// emptiest ones, considering only chunkIDs when given. A copy only moves when that leaves the
+// target drive less full than the source. The copy on the target is read back and checked
+// against the chunk checksum, and the source copy is only deleted once the record and the
+// manifests point at the target, so a crash at any point leaves at worst an orphaned copy.
+func RebalanceFile(ctx context.Context, fileID primitive.ObjectID, chunkIDs []int) ([]ChunkMove, error) {
+	unlock := lockFile(fileID)
+	defer unlock()
+	// Other servers finalize, change and delete the file too
+	release, err := fileprocessor.LockFile(ctx, fileID, "rebalance")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	file, err := store.GetStoredFile(ctx, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load file: %w", err)
+	}
+	if file == nil || file.Status == "deleted" || file.Status == "partially_deleted" {
+		return nil, errors.New("file not found")
+	}
+
+	drives, err := drivemanager.GetUserDriveSpaces(ctx, file.UserID, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get drive spaces: %w", err)
+	}
+	planned := planMoves(file, drives, chunkIDs)
+	if len(planned) == 0 {
+		return []ChunkMove{}, nil
+	}
+
+	var moves []ChunkMove
+	var errs []error
+	var sources []models.ChunkReplica
+	for _, move := range planned {
+		chunk := chunkByID(file, move.ChunkID)
+		source, _ := chunk.ReplicaOn(move.From)
+		replica, err := copyChunk(ctx, chunk, source, move.To)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for i := range chunk.Replicas {
+			if chunk.Replicas[i].DriveAccountID == move.From {
+				chunk.Replicas[i] = replica
+			}
+		}
+		moves = append(moves, move)
+		sources = append(sources, source)
+	}
+	if len(moves) == 0 {
+		return []ChunkMove{}, errors.Join(errs...)
+	}
+
+	// The file may have been deleted while chunks were copied, drop the new copies then
+	current, err := store.GetStoredFile(ctx, fileID)
+	if err != nil || current == nil || current.Status == "deleted" || current.Status == "partially_deleted" {
+		discardMoved(ctx, file, moves)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reload file: %w", err)
+		}
+		return nil, errors.New("file deleted during rebalance")
+	}
+
+	if err := store.UpdateStoredFileChunks(ctx, fileID, file.Chunks); err != nil {
+		discardMoved(ctx, file, moves)
+		return nil, fmt.Errorf("failed to save moved chunks: %w", err)
+	}
+	if err := manifest.AddFile(ctx, file); err != nil {
+		log.Printf("Failed to update drive manifests for file %s: %v", fileID.Hex(), err)
+	}
+	if emptied := drivesWithoutChunks(file, sources); len(emptied) > 0 {
+		if err := manifest.RemoveFile(ctx, file, emptied); err != nil {
+			log.Printf("Failed to update drive manifests for file %s: %v", fileID.Hex(), err)
+		}
+	}
+
+	// Nothing references the source copies any more
+	for _, source := range sources {
+		if err := drivemanager.DeleteDriveFile(ctx, source.DriveAccountID, source.DriveFileID); err != nil {
+			log.Printf("Failed to delete moved chunk copy %s from drive %s: %v", source.DriveFileID, source.DriveAccountID.Hex(), err)
+		}
+	}
+
+	log.Printf("Rebalanced file %s: %d chunk copies moved", fileID.Hex(), len(moves))
+	return moves, errors.Join(errs...)
+}
+
+// planMoves picks the copies to move, each from its drive to the drive that ends up least
+// full, tracking the space every planned move takes and frees
+func planMoves(file *models.StoredFile, drives []models.DriveSpaceInfo, chunkIDs []int) []ChunkMove {
+	used := make(map[primitive.ObjectID]int64)
+	total := make(map[primitive.ObjectID]int64)
+	for _, d := range drives {
+		if d.Available && d.TotalSpace > 0 {
+			used[d.AccountID] = d.TotalSpace - d.FreeSpace
+			total[d.AccountID] = d.TotalSpace
+		}
+	}
+	fill := func(id primitive.ObjectID, delta int64) float64 {
+		return float64(used[id]+delta) / float64(total[id])
+	}
+
+	selected := make(map[int]bool, len(chunkIDs))
+	for _, id := range chunkIDs {
+		selected[id] = true
+	}
+
+	var moves []ChunkMove
+	for _, chunk := range file.Chunks {
+		if len(chunkIDs) > 0 && !selected[chunk.ChunkID] {
+			continue
+		}
+		size := storedSize(&chunk)
+		holders := make(map[primitive.ObjectID]bool, len(chunk.Replicas))
+		for _, r := range chunk.Replicas {
+			holders[r.DriveAccountID] = true
+		}
+
+		for _, r := range chunk.Replicas {
+			from := r.DriveAccountID
+			if total[from] == 0 {
+				continue // Unreachable drives can't be read from
+			}
+			// A shard moves to a drive holding no other shard of the chunk, and takes a shard's space
+			bytes := size
+			if r.Shard > 0 && file.ErasureCoding != nil {
+				bytes = fileprocessor.ShardSize(size, file.ErasureCoding.DataShards)
+			}
+			var to primitive.ObjectID
+			found := false
+			for id := range total {
+				if holders[id] || total[id]-used[id] < bytes {
+					continue
+				}
+				if !found || fill(id, bytes) < fill(to, bytes) {
+					to, found = id, true
+				}
+			}
+			if !found || fill(to, bytes) >= fill(from, -bytes) {
+				continue
+			}
+
+			used[from] -= bytes
+			used[to] += bytes
+			holders[to] = true
+			moves = append(moves, ChunkMove{ChunkID: chunk.ChunkID, From: from, To: to, Bytes: bytes})
+			break // One copy of a chunk per pass, the drives' fill has changed
+		}
+	}
+	return moves
+}
+
+// copyChunk copies the chunk's source replica onto the target drive and reads it back,
+// returning the new replica only once its checksum matches
+func copyChunk(ctx context.Context, chunk *models.StoredChunk, source models.ChunkReplica, target primitive.ObjectID) (models.ChunkReplica, error) {
+	tmp, err := os.CreateTemp(fileprocessor.GetUploadTempDir(), fmt.Sprintf("move_%03d_*.2xpfm", chunk.ChunkID))
+	if err != nil {
+		return models.ChunkReplica{}, fmt.Errorf("chunk %d: failed to create temp file: %w", chunk.ChunkID, err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := verifyReplica(ctx, chunk, source, tmp); err != nil {
+		return models.ChunkReplica{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return models.ChunkReplica{}, fmt.Errorf("chunk %d: %w", chunk.ChunkID, err)
+	}
+
+	replica, err := drivemanager.UploadChunkToDrive(ctx, target, tmp.Name(), chunk.Filename)
+	if err != nil {
+		return models.ChunkReplica{}, fmt.Errorf("chunk %d: failed to upload to drive %s: %w", chunk.ChunkID, target.Hex(), err)
+	}
+	replica.Shard = source.Shard
+	replica.Checksum = source.Checksum
+
+	if err := verifyReplica(ctx, chunk, replica, io.Discard); err != nil {
+		drivemanager.DeleteDriveFile(ctx, target, replica.DriveFileID)
+		return models.ChunkReplica{}, err
+	}
+	return replica, nil
+}
+
+// verifyReplica downloads a replica into w and checks it against the chunk checksum, or the
+// shard's own checksum for a shard
+func verifyReplica(ctx context.Context, chunk *models.StoredChunk, replica models.ChunkReplica, w io.Writer) error {
+	hash, err := fileprocessor.NewHash(chunk.ChecksumAlgo)
+	if err != nil {
+		return fmt.Errorf("chunk %d: %w", chunk.ChunkID, err)
+	}
+	if _, err := drivemanager.DownloadChunkFromDrive(ctx, replica.DriveAccountID, replica.DriveFileID, io.MultiWriter(w, hash)); err != nil {
+		return fmt.Errorf("chunk %d: failed to download from drive %s: %w", chunk.ChunkID, replica.DriveAccountID.Hex(), err)
+	}
+	want := chunk.Checksum
+	if replica.Shard > 0 {
+		want = replica.Checksum
+	}
+	if checksum := fmt.Sprintf("%x", hash.Sum(nil)); checksum != want {
+		return fmt.Errorf("chunk %d: checksum mismatch on drive %s", chunk.ChunkID, replica.DriveAccountID.Hex())
+	}
+	return nil
+}
+
+// discardMoved deletes the target copies of moves that were never recorded
+func discardMoved(ctx context.Context, file *models.StoredFile, moves []ChunkMove) {
+	for _, move := range moves {
+		if replica, ok := chunkByID(file, move.ChunkID).ReplicaOn(move.To); ok {
+			drivemanager.DeleteDriveFile(ctx, replica.DriveAccountID, replica.DriveFileID)
+		}
+	}
+}
+
+// drivesWithoutChunks returns the source drives that hold no chunk of the file any more
+func drivesWithoutChunks(file *models.StoredFile, sources []models.ChunkReplica) []primitive.ObjectID {
+	var out []primitive.ObjectID
+	seen := make(map[primitive.ObjectID]bool)
+	for _, source := range sources {
+		id := source.DriveAccountID
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		holds := false
+		for i := range file.Chunks {
+			if _, ok := file.Chunks[i].ReplicaOn(id); ok {
+				holds = true
+				break
+			}
+		}
+		if !holds {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+func chunkByID(file *models.StoredFile, chunkID int) *models.StoredChunk {
+	for i := range file.Chunks {
+		if file.Chunks[i].ChunkID == chunkID {
+			return &file.Chunks[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Audit Event Management
+var auditCol *mongo.Collection
+
+func initAuditCollection(ctx context.Context) {
+	auditCol = db.Collection("audit_events")
+
+	ensureIndexes(ctx, auditCol, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "_id", Value: -1}},
+		},
+	})
+}
+
+func InsertAuditEvent(ctx context.Context, event *models.AuditEvent) error {
+	if auditCol == nil {
+		return errors.New("audit events collection not initialized")
+	}
+	if event.ID.IsZero() {
+		event.ID = primitive.NewObjectID()
+	}
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now().UTC()
+	}
+	_, err := auditCol.InsertOne(ctx, event)
+	return err
+}
+
+// ListUserAuditEvents returns up to limit of the user's events, newest first. A non-zero before
+// pages on from the event with that ID.
+func ListUserAuditEvents(ctx context.Context, userID, before primitive.ObjectID, limit int) ([]models.AuditEvent, error) {
+	if auditCol == nil {
+		return nil, errors.New("audit events collection not initialized")
+	}
+	filter := bson.M{"user_id": userID}
+	if !before.IsZero() {
+		filter["_id"] = bson.M{"$lt": before}
+	}
+	opts := options.Find().SetSort(bson.M{"_id": -1}).SetLimit(int64(limit))
+	cursor, err := auditCol.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	events := []models.AuditEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,100 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Account Deletion Job Management
+var accountDeletionsCol *mongo.Collection
+
+func initAccountDeletionsCollection(ctx context.Context) {
+	accountDeletionsCol = db.Collection("account_deletions")
+
+	ensureIndexes(ctx, accountDeletionsCol, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "started_at", Value: -1}},
+		},
+	})
+}
+
+func CreateAccountDeletionJob(ctx context.Context, job *models.AccountDeletionJob) error {
+	if accountDeletionsCol == nil {
+		return errors.New("account deletions collection not initialized")
+	}
+	now := time.Now().UTC()
+	job.ID = primitive.NewObjectID()
+	job.StartedAt = now
+	job.UpdatedAt = now
+	_, err := accountDeletionsCol.InsertOne(ctx, job)
+	return err
+}
+
+// GetLatestAccountDeletionJob returns the user's most recently started account deletion, or nil
+func GetLatestAccountDeletionJob(ctx context.Context, userID primitive.ObjectID) (*models.AccountDeletionJob, error) {
+	if accountDeletionsCol == nil {
+		return nil, errors.New("account deletions collection not initialized")
+	}
+	var job models.AccountDeletionJob
+	err := accountDeletionsCol.FindOne(ctx, bson.M{"user_id": userID},
+		options.FindOne().SetSort(bson.D{{Key: "started_at", Value: -1}})).Decode(&job)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// SaveAccountDeletionJob records the job's progress
+func SaveAccountDeletionJob(ctx context.Context, job *models.AccountDeletionJob) error {
+	if accountDeletionsCol == nil {
+		return errors.New("account deletions collection not initialized")
+	}
+	job.UpdatedAt = time.Now().UTC()
+	_, err := accountDeletionsCol.ReplaceOne(ctx, bson.M{"_id": job.ID}, job)
+	return err
+}
+
+// DeleteUserRecords removes every record kept for the user and the drive accounts it had, and
+// then the user. Audit events, the token revocation and the account deletion jobs are kept.
+// Each step can be run again, so a failure part way is retried by calling it again.
+func DeleteUserRecords(ctx context.Context, userID primitive.ObjectID, accountIDs []primitive.ObjectID) error {
+	byUser := []*mongo.Collection{
+		filesCol, sessionsCol, downloadsCol, shareLinksCol, refreshTokensCol,
+		passwordResetsCol, stateCol, webhookDeliveriesCol, exportJobsCol, rekeyJobsCol,
+	}
+	for _, col := range append(byUser, driveHealthCol, resumableCol, usersCol) {
+		if col == nil {
+			return errors.New("collections not initialized")
+		}
+	}
+	for _, col := range byUser {
+		if _, err := col.DeleteMany(ctx, bson.M{"user_id": userID}); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", col.Name(), err)
+		}
+	}
+
+	if len(accountIDs) > 0 {
+		if _, err := driveHealthCol.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": accountIDs}}); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", driveHealthCol.Name(), err)
+		}
+		if _, err := resumableCol.DeleteMany(ctx, bson.M{"drive_account_id": bson.M{"$in": accountIDs}}); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", resumableCol.Name(), err)
+		}
+	}
+
+	if _, err := usersCol.DeleteOne(ctx, bson.M{"_id": userID}); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	return nil
+}
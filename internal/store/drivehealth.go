@@ -0,0 +1,144 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Drive Health Management, keyed by the drive account they count
+var driveHealthCol *mongo.Collection
+
+func initDriveHealthCollection(ctx context.Context) {
+	driveHealthCol = db.Collection("drive_health")
+}
+
+// RecordDriveHealth counts an operation against the drive account, failed with errMsg unless
+// it's empty, and returns the counts. A window older than window is started over.
+func RecordDriveHealth(ctx context.Context, accountID primitive.ObjectID, errMsg string, window time.Duration) (*models.DriveHealth, error) {
+	if driveHealthCol == nil {
+		return nil, errors.New("drive health collection not initialized")
+	}
+	now := time.Now().UTC()
+	inc := bson.M{"attempts": 1}
+	update := bson.M{"$inc": inc}
+	if errMsg != "" {
+		inc["failures"] = 1
+		update["$set"] = bson.M{"last_error": errMsg, "last_error_at": now}
+	}
+
+	var health models.DriveHealth
+	err := driveHealthCol.FindOneAndUpdate(ctx,
+		bson.M{"_id": accountID, "window_start": bson.M{"$gt": now.Add(-window)}},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&health)
+	if err == nil {
+		return &health, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+
+	// No window running, this operation starts one. The last error outlives its window.
+	health = models.DriveHealth{DriveAccountID: accountID, WindowStart: now, Attempts: 1}
+	set := bson.M{"window_start": now, "attempts": 1, "failures": 0}
+	if errMsg != "" {
+		health.Failures = 1
+		health.LastError = errMsg
+		health.LastErrorAt = &now
+		set["failures"] = 1
+		set["last_error"] = errMsg
+		set["last_error_at"] = now
+	}
+	_, err = driveHealthCol.UpdateOne(ctx, bson.M{"_id": accountID}, bson.M{"$set": set}, options.Update().SetUpsert(true))
+	if err != nil {
+		return nil, err
+	}
+	return &health, nil
+}
+
+// ResetDriveHealth forgets the counts of the drive account
+func ResetDriveHealth(ctx context.Context, accountID primitive.ObjectID) error {
+	if driveHealthCol == nil {
+		return errors.New("drive health collection not initialized")
+	}
+	_, err := driveHealthCol.DeleteOne(ctx, bson.M{"_id": accountID})
+	return err
+}
+
+// DisableDriveAccount disables the drive account for the reason, reporting whether it was
+// enabled until now
+func DisableDriveAccount(ctx context.Context, accountID primitive.ObjectID, reason string) (bool, error) {
+	res, err := usersCol.UpdateOne(ctx,
+		bson.M{"drive_accounts": bson.M{"$elemMatch": bson.M{"_id": accountID, "disabled": bson.M{"$ne": true}}}},
+		bson.M{"$set": bson.M{
+			"drive_accounts.$.disabled":        true,
+			"drive_accounts.$.disabled_reason": reason,
+			"drive_accounts.$.disabled_at":     time.Now().UTC(),
+		}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// RestartDriveAccountCooldown records a new reason for a disabled drive account, its cooldown
+// starting over from now
+func RestartDriveAccountCooldown(ctx context.Context, accountID primitive.ObjectID, reason string) error {
+	_, err := usersCol.UpdateOne(ctx,
+		bson.M{"drive_accounts": bson.M{"$elemMatch": bson.M{"_id": accountID, "disabled": true}}},
+		bson.M{"$set": bson.M{
+			"drive_accounts.$.disabled_reason": reason,
+			"drive_accounts.$.disabled_at":     time.Now().UTC(),
+		}},
+	)
+	return err
+}
+
+// EnableDriveAccount enables a disabled drive account, reporting whether it was disabled
+func EnableDriveAccount(ctx context.Context, accountID primitive.ObjectID) (bool, error) {
+	res, err := usersCol.UpdateOne(ctx,
+		bson.M{"drive_accounts": bson.M{"$elemMatch": bson.M{"_id": accountID, "disabled": true}}},
+		bson.M{"$unset": bson.M{
+			"drive_accounts.$.disabled":        "",
+			"drive_accounts.$.disabled_reason": "",
+			"drive_accounts.$.disabled_at":     "",
+		}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// ListDisabledDriveAccounts returns the drive accounts, of any user, disabled before the time
+func ListDisabledDriveAccounts(ctx context.Context, before time.Time) ([]models.DriveAccount, error) {
+	filter := bson.M{"drive_accounts": bson.M{"$elemMatch": bson.M{"disabled": true, "disabled_at": bson.M{"$lte": before}}}}
+	cursor, err := usersCol.Find(ctx, filter, options.Find().SetProjection(bson.M{"drive_accounts": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var accounts []models.DriveAccount
+	for cursor.Next(ctx) {
+		var u models.User
+		if err := cursor.Decode(&u); err != nil {
+			return nil, err
+		}
+		for _, account := range u.DriveAccounts {
+			if account.Disabled && account.DisabledAt != nil && !account.DisabledAt.After(before) {
+				accounts = append(accounts, account)
+			}
+		}
+	}
+	return accounts, cursor.Err()
+}
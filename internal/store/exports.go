@@ -0,0 +1,65 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Export Job Management
+var exportJobsCol *mongo.Collection
+
+func initExportJobsCollection(ctx context.Context) {
+	exportJobsCol = db.Collection("export_jobs")
+
+	ensureIndexes(ctx, exportJobsCol, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "started_at", Value: -1}},
+		},
+	})
+}
+
+func CreateExportJob(ctx context.Context, job *models.ExportJob) error {
+	if exportJobsCol == nil {
+		return errors.New("export jobs collection not initialized")
+	}
+	now := time.Now().UTC()
+	job.ID = primitive.NewObjectID()
+	job.StartedAt = now
+	job.UpdatedAt = now
+	_, err := exportJobsCol.InsertOne(ctx, job)
+	return err
+}
+
+// GetLatestExportJob returns the user's most recently started export job, or nil
+func GetLatestExportJob(ctx context.Context, userID primitive.ObjectID) (*models.ExportJob, error) {
+	if exportJobsCol == nil {
+		return nil, errors.New("export jobs collection not initialized")
+	}
+	var job models.ExportJob
+	err := exportJobsCol.FindOne(ctx, bson.M{"user_id": userID},
+		options.FindOne().SetSort(bson.D{{Key: "started_at", Value: -1}})).Decode(&job)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// SaveExportJob records the job's progress
+func SaveExportJob(ctx context.Context, job *models.ExportJob) error {
+	if exportJobsCol == nil {
+		return errors.New("export jobs collection not initialized")
+	}
+	job.UpdatedAt = time.Now().UTC()
+	_, err := exportJobsCol.ReplaceOne(ctx, bson.M{"_id": job.ID}, job)
+	return err
+}
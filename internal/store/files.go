@@ -0,0 +1,705 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Stored File Management
+var (
+	filesCol     *mongo.Collection
+	downloadsCol *mongo.Collection
+
+	downloadSessionTTLGrace time.Duration
+)
+
+func initFilesCollections(ctx context.Context) {
+	filesCol = db.Collection("stored_files")
+	downloadsCol = db.Collection("download_sessions")
+
+	ensureIndexes(ctx, filesCol, []mongo.IndexModel{
+		{
+			Keys: bson.M{"user_id": 1},
+		},
+		{
+			// Multikey, serves the tag filter of the file list
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "tags", Value: 1}},
+		},
+		{
+			// Serves the trash sweeper
+			Keys: bson.D{{Key: "status", Value: 1}, {Key: "trashed_at", Value: 1}},
+		},
+		{
+			// Serves duplicate detection at initiate
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "original_checksum", Value: 1}},
+		},
+	})
+	// How long past expires_at a download session's record is kept before Mongo removes it.
+	// The session sweeper deletes an expired session's files and then its record; a TTL index
+	// can't touch the disk, so it only catches records the sweeper missed, like those of a
+	// server that never came back, and their files are left to the orphan sweep.
+	graceMins, _ := strconv.Atoi(os.Getenv("DOWNLOAD_SESSION_TTL_GRACE_MINUTES"))
+	if graceMins <= 0 {
+		graceMins = 60
+	}
+	downloadSessionTTLGrace = time.Duration(graceMins) * time.Minute
+	ensureDownloadSessionTTL(ctx)
+
+	ensureIndexes(ctx, downloadsCol, []mongo.IndexModel{
+		{
+			// Serves reusing a reconstruction still on disk
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "file_id", Value: 1}, {Key: "created_at", Value: -1}},
+		},
+		{
+			Keys:    bson.M{"expires_at": 1},
+			Options: options.Index().SetExpireAfterSeconds(int32(downloadSessionTTLGrace.Seconds())),
+		},
+	})
+}
+
+// ensureDownloadSessionTTL brings an existing expires_at index of download sessions to the
+// configured grace: the plain index of earlier versions is dropped, a TTL index with another
+// grace is changed in place
+func ensureDownloadSessionTTL(ctx context.Context) {
+	specs, err := downloadsCol.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return
+	}
+	grace := int32(downloadSessionTTLGrace.Seconds())
+	for _, spec := range specs {
+		if spec.Name != "expires_at_1" {
+			continue
+		}
+		switch {
+		case spec.ExpireAfterSeconds == nil:
+			_, _ = downloadsCol.Indexes().DropOne(ctx, spec.Name)
+		case *spec.ExpireAfterSeconds != grace:
+			err := db.RunCommand(ctx, bson.D{
+				{Key: "collMod", Value: downloadsCol.Name()},
+				{Key: "index", Value: bson.M{"name": spec.Name, "expireAfterSeconds": grace}},
+			}).Err()
+			if err != nil {
+				log.Printf("Failed to change the TTL of %s: %v", downloadsCol.Name(), err)
+			}
+		}
+	}
+}
+
+func CreateStoredFile(ctx context.Context, file *models.StoredFile) error {
+	if filesCol == nil {
+		return errors.New("files collection not initialized")
+	}
+	now := time.Now().UTC()
+	// Kept when the caller picked it, to lock the file before it's recorded
+	if file.ID.IsZero() {
+		file.ID = primitive.NewObjectID()
+	}
+	file.CreatedAt = now
+	file.UpdatedAt = now
+	file.ContentModified = &now
+	_, err := filesCol.InsertOne(ctx, file)
+	return err
+}
+
+func GetStoredFile(ctx context.Context, fileID primitive.ObjectID) (*models.StoredFile, error) {
+	if filesCol == nil {
+		return nil, errors.New("files collection not initialized")
+	}
+	var file models.StoredFile
+	err := filesCol.FindOne(ctx, bson.M{"_id": fileID}).Decode(&file)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	migrateLegacyChunks(&file)
+	return &file, nil
+}
+
+// FindStoredFileBySession returns the stored file created by an upload session, or nil
+func FindStoredFileBySession(ctx context.Context, sessionID primitive.ObjectID) (*models.StoredFile, error) {
+	if filesCol == nil {
+		return nil, errors.New("files collection not initialized")
+	}
+	var file models.StoredFile
+	err := filesCol.FindOne(ctx, bson.M{"session_id": sessionID}).Decode(&file)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	migrateLegacyChunks(&file)
+	return &file, nil
+}
+
+// FindDuplicateStoredFile returns the user's newest active, server-encrypted file with the
+// given checksum and size, or nil
+func FindDuplicateStoredFile(ctx context.Context, userID primitive.ObjectID, checksum string, size int64) (*models.StoredFile, error) {
+	if filesCol == nil {
+		return nil, errors.New("files collection not initialized")
+	}
+	var file models.StoredFile
+	err := filesCol.FindOne(ctx, bson.M{
+		"user_id":           userID,
+		"original_checksum": checksum,
+		"original_size":     size,
+		"status":            "active",
+		"client_encryption": bson.M{"$exists": false},
+	}, options.FindOne().SetSort(bson.D{{Key: "created_at", Value: -1}})).Decode(&file)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	migrateLegacyChunks(&file)
+	return &file, nil
+}
+
+// migrateLegacyChunks moves the single location of chunks stored before replicas into Replicas
+// and fills in the checksum algorithm of chunks stored before it was recorded
+func migrateLegacyChunks(file *models.StoredFile) {
+	for i := range file.Chunks {
+		chunk := &file.Chunks[i]
+		if len(chunk.Replicas) == 0 && !chunk.LegacyDriveAccountID.IsZero() {
+			chunk.Replicas = []models.ChunkReplica{{
+				DriveAccountID: chunk.LegacyDriveAccountID,
+				DriveFileID:    chunk.LegacyDriveFileID,
+			}}
+		}
+		chunk.LegacyDriveAccountID = primitive.NilObjectID
+		chunk.LegacyDriveFileID = ""
+		// Chunks stored before the algorithm was recorded were all SHA-256
+		if chunk.ChecksumAlgo == "" {
+			chunk.ChecksumAlgo = models.ChecksumSHA256
+		}
+	}
+}
+
+// ListUserStoredFiles returns every stored file of the user, including deleted ones
+func ListUserStoredFiles(ctx context.Context, userID primitive.ObjectID) ([]models.StoredFile, error) {
+	if filesCol == nil {
+		return nil, errors.New("files collection not initialized")
+	}
+	cursor, err := filesCol.Find(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	files := []models.StoredFile{}
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, err
+	}
+	for i := range files {
+		migrateLegacyChunks(&files[i])
+	}
+	return files, nil
+}
+
+// ListUserFiles returns the user's files that aren't deleted, newest first. A non-empty tag
+// only returns the files carrying it, and metadata the files whose metadata has each of its
+// values, a value ending in * by prefix. Trashed files are only returned with includeTrashed.
+func ListUserFiles(ctx context.Context, userID primitive.ObjectID, tag string, metadata map[string]string, includeTrashed bool) ([]models.StoredFile, error) {
+	if filesCol == nil {
+		return nil, errors.New("files collection not initialized")
+	}
+	hidden := bson.A{"deleted"}
+	if !includeTrashed {
+		hidden = append(hidden, "trashed")
+	}
+	filter := bson.M{"user_id": userID, "status": bson.M{"$nin": hidden}}
+	if tag != "" {
+		filter["tags"] = tag
+	}
+	for key, value := range metadata {
+		if prefix, ok := strings.CutSuffix(value, "*"); ok {
+			filter["metadata."+key] = bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}
+		} else {
+			filter["metadata."+key] = value
+		}
+	}
+	cursor, err := filesCol.Find(ctx, filter, options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	files := []models.StoredFile{}
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, err
+	}
+	for i := range files {
+		migrateLegacyChunks(&files[i])
+	}
+	return files, nil
+}
+
+// ChangeStoredFileTags adds and removes tags of the user's file in one update, so concurrent
+// changes don't undo each other. Added tags go after the file's own, removals win. $addToSet and
+// $pull can't change the same field in one update, so it's a pipeline. The file keeps its tags
+// when they would be more than maxTags; ok is false then, and when the file isn't the user's or
+// is deleted. It returns the file's tags.
+func ChangeStoredFileTags(ctx context.Context, fileID, userID primitive.ObjectID, add, remove []string, maxTags int) ([]string, bool, error) {
+	if filesCol == nil {
+		return nil, false, errors.New("files collection not initialized")
+	}
+	// Literal, a tag starting with $ would be read as a field path
+	current := bson.M{"$ifNull": bson.A{"$tags", bson.A{}}}
+	added := bson.M{"$filter": bson.M{
+		"input": bson.M{"$literal": add},
+		"as":    "tag",
+		"cond":  bson.M{"$not": bson.A{bson.M{"$in": bson.A{"$$tag", current}}}},
+	}}
+	tags := bson.M{"$filter": bson.M{
+		"input": bson.M{"$concatArrays": bson.A{current, added}},
+		"as":    "tag",
+		"cond":  bson.M{"$not": bson.A{bson.M{"$in": bson.A{"$$tag", bson.M{"$literal": remove}}}}},
+	}}
+
+	var file models.StoredFile
+	err := filesCol.FindOneAndUpdate(ctx,
+		bson.M{
+			"_id":     fileID,
+			"user_id": userID,
+			"status":  bson.M{"$ne": "deleted"},
+			"$expr":   bson.M{"$lte": bson.A{bson.M{"$size": tags}, maxTags}},
+		},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"tags": tags, "updated_at": time.Now()}}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"tags": 1}),
+	).Decode(&file)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return file.Tags, true, nil
+}
+
+// RestoreStoredFile inserts a stored file keeping the ID it was recovered with
+func RestoreStoredFile(ctx context.Context, file *models.StoredFile) error {
+	if filesCol == nil {
+		return errors.New("files collection not initialized")
+	}
+	file.UpdatedAt = time.Now().UTC()
+	if file.CreatedAt.IsZero() {
+		file.CreatedAt = file.UpdatedAt
+	}
+	_, err := filesCol.InsertOne(ctx, file)
+	return err
+}
+
+// UpdateStoredFileChunks replaces the chunk list of a stored file
+func UpdateStoredFileChunks(ctx context.Context, fileID primitive.ObjectID, chunks []models.StoredChunk) error {
+	if filesCol == nil {
+		return errors.New("files collection not initialized")
+	}
+	_, err := filesCol.UpdateOne(ctx, bson.M{"_id": fileID}, bson.M{"$set": bson.M{
+		"chunks":     chunks,
+		"updated_at": time.Now().UTC(),
+	}})
+	return err
+}
+
+// SetStoredFileMerkleRoot records the Merkle root of a file stored without one
+func SetStoredFileMerkleRoot(ctx context.Context, fileID primitive.ObjectID, root string) error {
+	if filesCol == nil {
+		return errors.New("files collection not initialized")
+	}
+	_, err := filesCol.UpdateOne(ctx, bson.M{"_id": fileID, "merkle_root": bson.M{"$in": bson.A{nil, ""}}}, bson.M{"$set": bson.M{"merkle_root": root}})
+	return err
+}
+
+// ReplaceStoredFileContent records a new version of an active file's content, updated or
+// appended to, read from it when its updated_at was lastUpdated, and sets when the content
+// changed. It reports false when the file changed since.
+func ReplaceStoredFileContent(ctx context.Context, file *models.StoredFile, lastUpdated time.Time) (bool, error) {
+	if filesCol == nil {
+		return false, errors.New("files collection not initialized")
+	}
+	now := time.Now().UTC()
+	file.UpdatedAt = now
+	file.ContentModified = &now
+	res, err := filesCol.UpdateOne(ctx,
+		bson.M{"_id": file.ID, "status": "active", "updated_at": lastUpdated},
+		bson.M{"$set": bson.M{
+			"session_id":          file.SessionID,
+			"content_type":        file.ContentType,
+			"original_size":       file.OriginalSize,
+			"processed_size":      file.ProcessedSize,
+			"original_checksum":   file.OriginalChecksum,
+			"checksum_state":      file.ChecksumState,
+			"obfuscation":         file.Obfuscation,
+			"encryption":          file.Encryption,
+			"chunks":              file.Chunks,
+			"erasure_coding":      file.ErasureCoding,
+			"merkle_root":         file.MerkleRoot,
+			"compress":            file.Compress,
+			"metadata":            file.Metadata,
+			"updated_at":          file.UpdatedAt,
+			"content_modified_at": file.ContentModified,
+		}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// ListFilesUsingDrive returns the IDs of the user's live files with a chunk on the drive
+func ListFilesUsingDrive(ctx context.Context, userID, accountID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	if filesCol == nil {
+		return nil, errors.New("files collection not initialized")
+	}
+	cursor, err := filesCol.Find(ctx, bson.M{
+		"user_id": userID,
+		"status":  bson.M{"$ne": "deleted"},
+		"$or": bson.A{
+			bson.M{"chunks.replicas.drive_account_id": accountID},
+			bson.M{"chunks.drive_account_id": accountID},
+		},
+	}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var docs []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, 0, len(docs))
+	for _, d := range docs {
+		ids = append(ids, d.ID)
+	}
+	return ids, nil
+}
+
+// ListStoredFilesOnDrive returns the user's files that aren't deleted with a chunk on the
+// drive, oldest first
+func ListStoredFilesOnDrive(ctx context.Context, userID, accountID primitive.ObjectID) ([]models.StoredFile, error) {
+	if filesCol == nil {
+		return nil, errors.New("files collection not initialized")
+	}
+	cursor, err := filesCol.Find(ctx, bson.M{
+		"user_id": userID,
+		"status":  bson.M{"$ne": "deleted"},
+		"$or": bson.A{
+			bson.M{"chunks.replicas.drive_account_id": accountID},
+			bson.M{"chunks.drive_account_id": accountID},
+		},
+	}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	files := []models.StoredFile{}
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, err
+	}
+	for i := range files {
+		migrateLegacyChunks(&files[i])
+	}
+	return files, nil
+}
+
+// MarkStoredFilesIncomplete flags files that lost chunks and can no longer be reconstructed
+func MarkStoredFilesIncomplete(ctx context.Context, fileIDs []primitive.ObjectID) error {
+	if filesCol == nil {
+		return errors.New("files collection not initialized")
+	}
+	if len(fileIDs) == 0 {
+		return nil
+	}
+	_, err := filesCol.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": fileIDs}}, bson.M{"$set": bson.M{
+		"status":     "incomplete",
+		"updated_at": time.Now().UTC(),
+	}})
+	return err
+}
+
+// SumUserStoredBytes totals the original size of the user's files that haven't been deleted
+func SumUserStoredBytes(ctx context.Context, userID primitive.ObjectID) (int64, error) {
+	if filesCol == nil {
+		return 0, errors.New("files collection not initialized")
+	}
+	cursor, err := filesCol.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"user_id": userID, "status": bson.M{"$ne": "deleted"}}}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "total": bson.M{"$sum": "$original_size"}}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var result []struct {
+		Total int64 `bson:"total"`
+	}
+	if err := cursor.All(ctx, &result); err != nil {
+		return 0, err
+	}
+	if len(result) == 0 {
+		return 0, nil
+	}
+	return result[0].Total, nil
+}
+
+// UpdateStoredFileDeletion records the outcome of a delete, keeping the chunks that are still on a drive
+func UpdateStoredFileDeletion(ctx context.Context, fileID primitive.ObjectID, status string, orphanedChunks []int) error {
+	if filesCol == nil {
+		return errors.New("files collection not initialized")
+	}
+	_, err := filesCol.UpdateOne(ctx,
+		bson.M{"_id": fileID},
+		bson.M{"$set": bson.M{
+			"status":          status,
+			"orphaned_chunks": orphanedChunks,
+			"updated_at":      time.Now().UTC(),
+		}},
+	)
+	return err
+}
+
+// TrashStoredFile moves a file with status fromStatus to the trash. It reports false when the
+// file's status changed meanwhile.
+func TrashStoredFile(ctx context.Context, fileID primitive.ObjectID, fromStatus string, trashedAt time.Time) (bool, error) {
+	if filesCol == nil {
+		return false, errors.New("files collection not initialized")
+	}
+	res, err := filesCol.UpdateOne(ctx,
+		bson.M{"_id": fileID, "status": fromStatus},
+		bson.M{"$set": bson.M{
+			"status":       "trashed",
+			"trashed_at":   trashedAt,
+			"trashed_from": fromStatus,
+			"updated_at":   time.Now().UTC(),
+		}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// RestoreTrashedFile moves a file trashed after cutoff back to the status it was trashed
+// from. It reports false when the file isn't in the trash or was trashed before cutoff.
+func RestoreTrashedFile(ctx context.Context, fileID primitive.ObjectID, cutoff time.Time) (bool, error) {
+	if filesCol == nil {
+		return false, errors.New("files collection not initialized")
+	}
+	res, err := filesCol.UpdateOne(ctx,
+		bson.M{"_id": fileID, "status": "trashed", "trashed_at": bson.M{"$gt": cutoff}},
+		mongo.Pipeline{
+			{{Key: "$set", Value: bson.M{
+				"status":     bson.M{"$ifNull": bson.A{"$trashed_from", "active"}},
+				"updated_at": time.Now().UTC(),
+			}}},
+			{{Key: "$unset", Value: bson.A{"trashed_at", "trashed_from"}}},
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// ListExpiredTrashedFiles returns the files trashed before cutoff
+func ListExpiredTrashedFiles(ctx context.Context, cutoff time.Time) ([]models.StoredFile, error) {
+	if filesCol == nil {
+		return nil, errors.New("files collection not initialized")
+	}
+	cursor, err := filesCol.Find(ctx, bson.M{"status": "trashed", "trashed_at": bson.M{"$lte": cutoff}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	files := []models.StoredFile{}
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, err
+	}
+	for i := range files {
+		migrateLegacyChunks(&files[i])
+	}
+	return files, nil
+}
+
+func UpdateSessionFileID(ctx context.Context, sessionID primitive.ObjectID, fileID primitive.ObjectID) error {
+	if sessionsCol == nil {
+		return errors.New("sessions collection not initialized")
+	}
+	_, err := sessionsCol.UpdateOne(ctx,
+		bson.M{"_id": sessionID},
+		bson.M{"$set": bson.M{"file_id": fileID}},
+	)
+	return err
+}
+
+// Download Session Management
+
+func CreateDownloadSession(ctx context.Context, session *models.DownloadSession) error {
+	if downloadsCol == nil {
+		return errors.New("download sessions collection not initialized")
+	}
+	_, err := downloadsCol.InsertOne(ctx, session)
+	return err
+}
+
+// FindReusableDownloadSession returns the newest completed, unexpired download of a file
+// so range requests can be served from the already reconstructed copy.
+func FindReusableDownloadSession(ctx context.Context, userID, fileID primitive.ObjectID) (*models.DownloadSession, error) {
+	if downloadsCol == nil {
+		return nil, errors.New("download sessions collection not initialized")
+	}
+	var session models.DownloadSession
+	err := downloadsCol.FindOne(ctx, bson.M{
+		"user_id":    userID,
+		"file_id":    fileID,
+		"status":     "complete",
+		"expires_at": bson.M{"$gt": time.Now()},
+	}, options.FindOne().SetSort(bson.M{"created_at": -1})).Decode(&session)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+func UpdateDownloadProgress(ctx context.Context, sessionID primitive.ObjectID, progress float64) error {
+	if downloadsCol == nil {
+		return errors.New("download sessions collection not initialized")
+	}
+	_, err := downloadsCol.UpdateOne(ctx,
+		bson.M{"_id": sessionID},
+		bson.M{"$set": bson.M{"progress": progress}},
+	)
+	return err
+}
+
+func UpdateDownloadStatus(ctx context.Context, sessionID primitive.ObjectID, status string, errorMsg string) error {
+	if downloadsCol == nil {
+		return errors.New("download sessions collection not initialized")
+	}
+	update := bson.M{"status": status}
+	if errorMsg != "" {
+		update["error_message"] = errorMsg
+	}
+	if status == "complete" {
+		update["progress"] = float64(100)
+		update["completed_at"] = time.Now()
+	}
+	_, err := downloadsCol.UpdateOne(ctx,
+		bson.M{"_id": sessionID},
+		bson.M{"$set": update},
+	)
+	return err
+}
+
+// CountActiveDownloadSessions counts unexpired download sessions still reconstructing their file
+func CountActiveDownloadSessions(ctx context.Context) (int, error) {
+	if downloadsCol == nil {
+		return 0, errors.New("download sessions collection not initialized")
+	}
+	count, err := downloadsCol.CountDocuments(ctx, bson.M{
+		"status":     "downloading",
+		"expires_at": bson.M{"$gt": time.Now()},
+	})
+	return int(count), err
+}
+
+// ListDownloadSessions returns every download session, newest first
+func ListDownloadSessions(ctx context.Context) ([]models.DownloadSession, error) {
+	if downloadsCol == nil {
+		return nil, errors.New("download sessions collection not initialized")
+	}
+	cursor, err := downloadsCol.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var sessions []models.DownloadSession
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// ListUserDownloadSessions returns every download session of the user
+func ListUserDownloadSessions(ctx context.Context, userID primitive.ObjectID) ([]models.DownloadSession, error) {
+	if downloadsCol == nil {
+		return nil, errors.New("download sessions collection not initialized")
+	}
+	cursor, err := downloadsCol.Find(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var sessions []models.DownloadSession
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// GetExpiredDownloadSessions returns the download sessions past their expiry
+func GetExpiredDownloadSessions(ctx context.Context) ([]models.DownloadSession, error) {
+	if downloadsCol == nil {
+		return nil, errors.New("download sessions collection not initialized")
+	}
+	cursor, err := downloadsCol.Find(ctx, bson.M{"expires_at": bson.M{"$lt": time.Now()}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var sessions []models.DownloadSession
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func GetDownloadSession(ctx context.Context, sessionID primitive.ObjectID) (*models.DownloadSession, error) {
+	if downloadsCol == nil {
+		return nil, errors.New("download sessions collection not initialized")
+	}
+	var session models.DownloadSession
+	err := downloadsCol.FindOne(ctx, bson.M{"_id": sessionID}).Decode(&session)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+func DeleteDownloadSession(ctx context.Context, sessionID primitive.ObjectID) error {
+	if downloadsCol == nil {
+		return errors.New("download sessions collection not initialized")
+	}
+	_, err := downloadsCol.DeleteOne(ctx, bson.M{"_id": sessionID})
+	return err
+}
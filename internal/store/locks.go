@@ -0,0 +1,89 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// File Lock Management, keyed by the file they lock
+var fileLocksCol *mongo.Collection
+
+func initFileLocksCollection(ctx context.Context) {
+	fileLocksCol = db.Collection("file_locks")
+	// Expired locks are taken over without waiting for the TTL monitor, it only tidies up
+	ensureIndexes(ctx, fileLocksCol, []mongo.IndexModel{
+		{
+			Keys:    bson.M{"expires_at": 1},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+}
+
+// AcquireFileLock takes the file's lock for holder until ttl from now, unless another holder
+// has it and it hasn't expired. It returns nil once the lock is taken, or the lock holding it.
+func AcquireFileLock(ctx context.Context, fileID primitive.ObjectID, holder, operation string, ttl time.Duration) (*models.FileLock, error) {
+	if fileLocksCol == nil {
+		return nil, errors.New("file locks collection not initialized")
+	}
+	now := time.Now().UTC()
+	// Matches an expired lock, or inserts the lock when there is none. A lock that is held
+	// doesn't match, so the upsert collides with it on _id.
+	_, err := fileLocksCol.UpdateOne(ctx,
+		bson.M{"_id": fileID, "expires_at": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{
+			"holder":      holder,
+			"operation":   operation,
+			"acquired_at": now,
+			"expires_at":  now.Add(ttl),
+		}},
+		options.Update().SetUpsert(true),
+	)
+	if err == nil {
+		return nil, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+
+	var held models.FileLock
+	if err := fileLocksCol.FindOne(ctx, bson.M{"_id": fileID}).Decode(&held); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			// Released in the meantime, the caller tries again
+			return &models.FileLock{FileID: fileID}, nil
+		}
+		return nil, err
+	}
+	return &held, nil
+}
+
+// RenewFileLock extends holder's lock of the file to ttl from now, reporting false when the
+// holder lost it
+func RenewFileLock(ctx context.Context, fileID primitive.ObjectID, holder string, ttl time.Duration) (bool, error) {
+	if fileLocksCol == nil {
+		return false, errors.New("file locks collection not initialized")
+	}
+	res, err := fileLocksCol.UpdateOne(ctx,
+		bson.M{"_id": fileID, "holder": holder},
+		bson.M{"$set": bson.M{"expires_at": time.Now().UTC().Add(ttl)}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// ReleaseFileLock frees holder's lock of the file, a lock another holder took over is left alone
+func ReleaseFileLock(ctx context.Context, fileID primitive.ObjectID, holder string) error {
+	if fileLocksCol == nil {
+		return errors.New("file locks collection not initialized")
+	}
+	_, err := fileLocksCol.DeleteOne(ctx, bson.M{"_id": fileID, "holder": holder})
+	return err
+}
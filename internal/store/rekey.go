@@ -0,0 +1,124 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Rekey Job Management
+var rekeyJobsCol *mongo.Collection
+
+func initRekeyJobsCollection(ctx context.Context) {
+	rekeyJobsCol = db.Collection("rekey_jobs")
+
+	ensureIndexes(ctx, rekeyJobsCol, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "started_at", Value: -1}},
+		},
+	})
+}
+
+func CreateRekeyJob(ctx context.Context, job *models.RekeyJob) error {
+	if rekeyJobsCol == nil {
+		return errors.New("rekey jobs collection not initialized")
+	}
+	now := time.Now().UTC()
+	job.ID = primitive.NewObjectID()
+	job.StartedAt = now
+	job.UpdatedAt = now
+	_, err := rekeyJobsCol.InsertOne(ctx, job)
+	return err
+}
+
+// GetLatestRekeyJob returns the user's most recently started rekey job, or nil
+func GetLatestRekeyJob(ctx context.Context, userID primitive.ObjectID) (*models.RekeyJob, error) {
+	if rekeyJobsCol == nil {
+		return nil, errors.New("rekey jobs collection not initialized")
+	}
+	var job models.RekeyJob
+	err := rekeyJobsCol.FindOne(ctx, bson.M{"user_id": userID},
+		options.FindOne().SetSort(bson.D{{Key: "started_at", Value: -1}})).Decode(&job)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// SaveRekeyJob records the job's progress
+func SaveRekeyJob(ctx context.Context, job *models.RekeyJob) error {
+	if rekeyJobsCol == nil {
+		return errors.New("rekey jobs collection not initialized")
+	}
+	job.UpdatedAt = time.Now().UTC()
+	_, err := rekeyJobsCol.ReplaceOne(ctx, bson.M{"_id": job.ID}, job)
+	return err
+}
+
+// keyedFilesFilter matches the user's files whose data key is wrapped by the server. Files being
+// deleted are left out, their manifest entries are going away.
+func keyedFilesFilter(userID primitive.ObjectID) bson.M {
+	return bson.M{
+		"user_id":    userID,
+		"status":     bson.M{"$nin": bson.A{"deleted", "partially_deleted"}},
+		"encryption": bson.M{"$exists": true},
+	}
+}
+
+// CountUserKeyedFiles counts the user's files with a server-wrapped data key
+func CountUserKeyedFiles(ctx context.Context, userID primitive.ObjectID) (int, error) {
+	if filesCol == nil {
+		return 0, errors.New("files collection not initialized")
+	}
+	n, err := filesCol.CountDocuments(ctx, keyedFilesFilter(userID))
+	return int(n), err
+}
+
+// ListUserKeyedFilesAfter returns up to limit of the user's files with a server-wrapped data
+// key, in ID order starting after afterID
+func ListUserKeyedFilesAfter(ctx context.Context, userID, afterID primitive.ObjectID, limit int) ([]models.StoredFile, error) {
+	if filesCol == nil {
+		return nil, errors.New("files collection not initialized")
+	}
+	filter := keyedFilesFilter(userID)
+	if !afterID.IsZero() {
+		filter["_id"] = bson.M{"$gt": afterID}
+	}
+	cursor, err := filesCol.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	files := []models.StoredFile{}
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, err
+	}
+	for i := range files {
+		migrateLegacyChunks(&files[i])
+	}
+	return files, nil
+}
+
+// UpdateStoredFileEncryption replaces the encryption metadata of a file
+func UpdateStoredFileEncryption(ctx context.Context, fileID primitive.ObjectID, encryption *models.EncryptionMetadata) error {
+	if filesCol == nil {
+		return errors.New("files collection not initialized")
+	}
+	_, err := filesCol.UpdateOne(ctx, bson.M{"_id": fileID}, bson.M{"$set": bson.M{
+		"encryption": encryption,
+		"updated_at": time.Now().UTC(),
+	}})
+	return err
+}
@@ -0,0 +1,80 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Resumable Upload Management
+var resumableCol *mongo.Collection
+
+// Google expires resumable upload sessions after a week
+const resumableUploadTTL = 7 * 24 * time.Hour
+
+func initResumableUploadsCollection(ctx context.Context) {
+	resumableCol = db.Collection("resumable_uploads")
+
+	ensureIndexes(ctx, resumableCol, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "drive_account_id", Value: 1}, {Key: "name", Value: 1}, {Key: "fingerprint", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.M{"created_at": 1},
+			Options: options.Index().SetExpireAfterSeconds(int32(resumableUploadTTL.Seconds())),
+		},
+	})
+}
+
+// SaveResumableUpload records the session URI of an upload, replacing an older session of the
+// same bytes
+func SaveResumableUpload(ctx context.Context, upload *models.ResumableUpload) error {
+	if resumableCol == nil {
+		return errors.New("resumable uploads collection not initialized")
+	}
+	upload.CreatedAt = time.Now().UTC()
+	filter := bson.M{"drive_account_id": upload.DriveAccountID, "name": upload.Name, "fingerprint": upload.Fingerprint}
+	_, err := resumableCol.UpdateOne(ctx, filter, bson.M{
+		"$set": bson.M{"uri": upload.URI, "created_at": upload.CreatedAt},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+// FindResumableUpload returns the unfinished upload of the bytes with fingerprint to the
+// account under name
+func FindResumableUpload(ctx context.Context, accountID primitive.ObjectID, name, fingerprint string) (*models.ResumableUpload, error) {
+	if resumableCol == nil {
+		return nil, errors.New("resumable uploads collection not initialized")
+	}
+	var upload models.ResumableUpload
+	filter := bson.M{"drive_account_id": accountID, "name": name, "fingerprint": fingerprint}
+	err := resumableCol.FindOne(ctx, filter).Decode(&upload)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The TTL monitor runs once a minute, so an expired session can still be here
+	if time.Since(upload.CreatedAt) >= resumableUploadTTL {
+		return nil, nil
+	}
+	return &upload, nil
+}
+
+// DeleteResumableUpload forgets an upload that finished or whose session is gone
+func DeleteResumableUpload(ctx context.Context, upload *models.ResumableUpload) error {
+	if resumableCol == nil {
+		return errors.New("resumable uploads collection not initialized")
+	}
+	filter := bson.M{"drive_account_id": upload.DriveAccountID, "name": upload.Name, "fingerprint": upload.Fingerprint}
+	_, err := resumableCol.DeleteOne(ctx, filter)
+	return err
+}
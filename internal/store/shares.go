@@ -0,0 +1,100 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Share Link Management
+var shareLinksCol *mongo.Collection
+
+func initSharesCollection(ctx context.Context) {
+	shareLinksCol = db.Collection("share_links")
+
+	ensureIndexes(ctx, shareLinksCol, []mongo.IndexModel{
+		{
+			Keys:    bson.M{"token_hash": 1},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.M{"file_id": 1},
+		},
+		{
+			Keys:    bson.M{"expires_at": 1},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+}
+
+func InsertShareLink(ctx context.Context, link *models.ShareLink) error {
+	if shareLinksCol == nil {
+		return errors.New("share links collection not initialized")
+	}
+	if link.ID.IsZero() {
+		link.ID = primitive.NewObjectID()
+	}
+	link.CreatedAt = time.Now().UTC()
+	_, err := shareLinksCol.InsertOne(ctx, link)
+	return err
+}
+
+func FindShareLinkByHash(ctx context.Context, tokenHash string) (*models.ShareLink, error) {
+	if shareLinksCol == nil {
+		return nil, errors.New("share links collection not initialized")
+	}
+	var link models.ShareLink
+	err := shareLinksCol.FindOne(ctx, bson.M{"token_hash": tokenHash}).Decode(&link)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &link, nil
+}
+
+// ClaimShareDownload counts a download against the link. It returns false if the link was
+// revoked, expired or used up in the meantime, so the cap holds under concurrent requests.
+func ClaimShareDownload(ctx context.Context, linkID primitive.ObjectID) (bool, error) {
+	if shareLinksCol == nil {
+		return false, errors.New("share links collection not initialized")
+	}
+	res, err := shareLinksCol.UpdateOne(ctx,
+		bson.M{
+			"_id":        linkID,
+			"revoked_at": bson.M{"$exists": false},
+			"expires_at": bson.M{"$gt": time.Now().UTC()},
+			"$or": []bson.M{
+				{"max_downloads": 0},
+				{"$expr": bson.M{"$lt": []string{"$download_count", "$max_downloads"}}},
+			},
+		},
+		bson.M{"$inc": bson.M{"download_count": 1}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// RevokeShareLink revokes one of the user's share links, reporting whether it existed
+func RevokeShareLink(ctx context.Context, linkID, userID primitive.ObjectID) (bool, error) {
+	if shareLinksCol == nil {
+		return false, errors.New("share links collection not initialized")
+	}
+	res, err := shareLinksCol.UpdateOne(ctx,
+		bson.M{"_id": linkID, "user_id": userID},
+		bson.M{"$set": bson.M{"revoked_at": time.Now().UTC()}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
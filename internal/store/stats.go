@@ -0,0 +1,88 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// AggregateUserStorageStats totals the user's files that aren't deleted by status, and what
+// their chunks keep on each drive. Mongo does the counting, so no file is loaded here. Drives
+// are only named by their ID.
+func AggregateUserStorageStats(ctx context.Context, userID primitive.ObjectID) (*models.StorageStats, error) {
+	if filesCol == nil {
+		return nil, errors.New("files collection not initialized")
+	}
+	match := bson.D{{Key: "$match", Value: bson.M{"user_id": userID, "status": bson.M{"$ne": "deleted"}}}}
+
+	cursor, err := filesCol.Aggregate(ctx, mongo.Pipeline{
+		match,
+		{{Key: "$group", Value: bson.M{
+			"_id":             "$status",
+			"files":           bson.M{"$sum": 1},
+			"original_bytes":  bson.M{"$sum": "$original_size"},
+			"processed_bytes": bson.M{"$sum": "$processed_size"},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var byStatus []struct {
+		Status             string `bson:"_id"`
+		models.StatusStats `bson:",inline"`
+	}
+	if err := cursor.All(ctx, &byStatus); err != nil {
+		return nil, err
+	}
+
+	stats := &models.StorageStats{ByStatus: make(map[string]models.StatusStats, len(byStatus))}
+	for _, s := range byStatus {
+		stats.ByStatus[s.Status] = s.StatusStats
+		stats.TotalFiles += s.Files
+		stats.TotalOriginalBytes += s.OriginalBytes
+		stats.TotalProcessedBytes += s.ProcessedBytes
+	}
+
+	// A partially deleted file only has its orphaned chunks left on the drives, and a shard
+	// takes its share of the chunk, see fileprocessor.ShardSize
+	cursor, err = filesCol.Aggregate(ctx, mongo.Pipeline{
+		match,
+		{{Key: "$unwind", Value: "$chunks"}},
+		{{Key: "$match", Value: bson.M{"$expr": bson.M{"$or": bson.A{
+			bson.M{"$ne": bson.A{"$status", "partially_deleted"}},
+			bson.M{"$in": bson.A{"$chunks.chunk_id", bson.M{"$ifNull": bson.A{"$orphaned_chunks", bson.A{}}}}},
+		}}}}},
+		{{Key: "$unwind", Value: "$chunks.replicas"}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    bson.M{"drive": "$chunks.replicas.drive_account_id", "file": "$_id"},
+			"chunks": bson.M{"$sum": 1},
+			"stored_bytes": bson.M{"$sum": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{bson.M{"$ifNull": bson.A{"$chunks.replicas.shard", 0}}, 0}},
+				bson.M{"$toLong": bson.M{"$ceil": bson.M{"$divide": bson.A{"$chunks.stored_size", "$erasure_coding.data_shards"}}}},
+				"$chunks.stored_size",
+			}}},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":          "$_id.drive",
+			"files":        bson.M{"$sum": 1},
+			"chunks":       bson.M{"$sum": "$chunks"},
+			"stored_bytes": bson.M{"$sum": "$stored_bytes"},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	stats.Drives = []models.DriveUsage{}
+	if err := cursor.All(ctx, &stats.Drives); err != nil {
+		return nil, err
+	}
+	for _, d := range stats.Drives {
+		stats.TotalStoredBytes += d.StoredBytes
+	}
+	return stats, nil
+}
@@ -2,9 +2,14 @@ package store
 
 import (
 	"SE/internal/models"
+	"cmp"
 	"context"
 	"errors"
+	"fmt"
+	"log"
+	"math"
 	"os"
+	"slices"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -38,21 +43,99 @@ func InitStore(ctx context.Context) error {
 	// Initialize sessions collection
 	initSessionsCollection(ctx)
 
-	// Create TTL index for oauth states
-	_, err = stateCol.Indexes().CreateOne(ctx, mongo.IndexModel{
-		Keys:    bson.M{"created_at": 1},
-		Options: options.Index().SetExpireAfterSeconds(600),
+	// Initialize stored files and download sessions collections
+	initFilesCollections(ctx)
+
+	// Initialize refresh token and revocation collections
+	initTokensCollections(ctx)
+
+	// Initialize share links collection
+	initSharesCollection(ctx)
+
+	// Initialize rekey jobs collection
+	initRekeyJobsCollection(ctx)
+
+	// Initialize audit events collection
+	initAuditCollection(ctx)
+
+	// Initialize webhook deliveries collection
+	initWebhookDeliveriesCollection(ctx)
+
+	// Initialize resumable uploads collection
+	initResumableUploadsCollection(ctx)
+
+	// Initialize drive health collection
+	initDriveHealthCollection(ctx)
+
+	// Initialize export jobs collection
+	initExportJobsCollection(ctx)
+
+	// Initialize thumbnails collection
+	initThumbnailsCollection(ctx)
+
+	// Initialize account deletions collection
+	initAccountDeletionsCollection(ctx)
+
+	// Initialize file locks collection
+	initFileLocksCollection(ctx)
+
+	// OAuth states are purged by the state sweeper, which keeps them past their expiry for a
+	// while so a late callback is told its state expired. The TTL index that used to purge them
+	// would delete them too early.
+	_, _ = stateCol.Indexes().DropOne(ctx, "created_at_1")
+	err = ensureIndexes(ctx, stateCol, []mongo.IndexModel{
+		{
+			Keys:    bson.M{"state": 1},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.M{"expires_at": 1},
+		},
 	})
 	if err != nil {
 		return err
 	}
 
-	// Create unique index on email
-	_, err = usersCol.Indexes().CreateOne(ctx, mongo.IndexModel{
-		Keys:    bson.M{"email": 1},
-		Options: options.Index().SetUnique(true),
+	return ensureIndexes(ctx, usersCol, []mongo.IndexModel{
+		{
+			// Create unique index on email
+			Keys:    bson.M{"email": 1},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			// Serves looking up a drive account by its ID
+			Keys: bson.M{"drive_accounts._id": 1},
+		},
+		{
+			// One user per Google account, users who never signed in with Google have none
+			Keys:    bson.M{"google_id": 1},
+			Options: options.Index().SetUnique(true).SetSparse(true),
+		},
 	})
-	return err
+}
+
+// ensureIndexes creates the indexes the collection doesn't have yet, logging the ones it
+// created. An index that exists with the same keys and options is left alone, so this runs on
+// every start.
+func ensureIndexes(ctx context.Context, col *mongo.Collection, indexes []mongo.IndexModel) error {
+	existing := make(map[string]bool)
+	if specs, err := col.Indexes().ListSpecifications(ctx); err == nil {
+		for _, spec := range specs {
+			existing[spec.Name] = true
+		}
+	}
+
+	names, err := col.Indexes().CreateMany(ctx, indexes)
+	if err != nil {
+		log.Printf("Failed to create indexes of %s: %v", col.Name(), err)
+		return err
+	}
+	for _, name := range names {
+		if !existing[name] {
+			log.Printf("Created index %s of %s", name, col.Name())
+		}
+	}
+	return nil
 }
 
 func DisconnectStore(ctx context.Context) error {
@@ -74,6 +157,109 @@ func FindUserByEmail(ctx context.Context, email string) (*models.User, error) {
 	return &u, nil
 }
 
+// FindUserByGoogleID returns the user who signs in with the Google account, nil when none does
+func FindUserByGoogleID(ctx context.Context, googleID string) (*models.User, error) {
+	var u models.User
+	err := usersCol.FindOne(ctx, bson.M{"google_id": googleID}).Decode(&u)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+// LinkGoogleAccount lets the user sign in with the Google account, reporting false when the
+// user already signs in with one
+func LinkGoogleAccount(ctx context.Context, userID primitive.ObjectID, googleID string) (bool, error) {
+	res, err := usersCol.UpdateOne(ctx,
+		bson.M{"_id": userID, "google_id": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"google_id": googleID}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+func FindUserByID(ctx context.Context, userID primitive.ObjectID) (*models.User, error) {
+	var u models.User
+	err := usersCol.FindOne(ctx, bson.M{"_id": userID}).Decode(&u)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+// SetUserQuota sets a per-user storage quota, 0 resets it to the default
+func SetUserQuota(ctx context.Context, userID primitive.ObjectID, quotaBytes int64) (bool, error) {
+	res, err := usersCol.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"quota_bytes": quotaBytes}})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// SetUserRole sets the user's role, reporting whether the user exists
+func SetUserRole(ctx context.Context, userID primitive.ObjectID, role string) (bool, error) {
+	res, err := usersCol.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"role": role}})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// PromoteUsersToAdmin gives the admin role to the users with the emails that don't hold it yet,
+// returning how many were promoted
+func PromoteUsersToAdmin(ctx context.Context, emails []string) (int64, error) {
+	if len(emails) == 0 {
+		return 0, nil
+	}
+	res, err := usersCol.UpdateMany(ctx,
+		bson.M{"email": bson.M{"$in": emails}, "role": bson.M{"$ne": models.RoleAdmin}},
+		bson.M{"$set": bson.M{"role": models.RoleAdmin}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+// SetUserBandwidth sets the user's transfer caps, nil resets a cap to the default
+func SetUserBandwidth(ctx context.Context, userID primitive.ObjectID, bandwidthBPS, requestBandwidthBPS *int64) (bool, error) {
+	set, unset := bson.M{}, bson.M{}
+	for field, value := range map[string]*int64{"bandwidth_bps": bandwidthBPS, "request_bandwidth_bps": requestBandwidthBPS} {
+		if value == nil {
+			unset[field] = ""
+		} else {
+			set[field] = *value
+		}
+	}
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	res, err := usersCol.UpdateOne(ctx, bson.M{"_id": userID}, update)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// UpdateUserPassword replaces the user's bcrypt password hash
+func UpdateUserPassword(ctx context.Context, userID primitive.ObjectID, passwordHash []byte) error {
+	_, err := usersCol.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"passwords_hash": passwordHash}})
+	return err
+}
+
 func CreateUser(ctx context.Context, u *models.User) error {
 	u.CreatedAt = time.Now().UTC()
 	u.ID = primitive.NewObjectID()
@@ -87,16 +273,47 @@ func InsertOAuthState(ctx context.Context, state *models.OAuthState) error {
 	return err
 }
 
-func FindAndDeleteState(ctx context.Context, state string) (*models.OAuthState, error) {
+// ConsumeOAuthState marks the state used and returns it, reporting whether this call was the one
+// that used it. A state used before is returned with false, an unknown one as nil.
+func ConsumeOAuthState(ctx context.Context, state string) (*models.OAuthState, bool, error) {
 	var s models.OAuthState
-	err := stateCol.FindOneAndDelete(ctx, bson.M{"state": state}).Decode(&s)
+	err := stateCol.FindOneAndUpdate(ctx,
+		bson.M{"state": state, "used_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"used_at": time.Now().UTC()}},
+	).Decode(&s)
+	if err == nil {
+		return &s, true, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, false, err
+	}
+
+	err = stateCol.FindOne(ctx, bson.M{"state": state}).Decode(&s)
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
-			return nil, nil
+			return nil, false, nil
 		}
-		return nil, err
+		return nil, false, err
+	}
+	return &s, false, nil
+}
+
+func DeleteOAuthState(ctx context.Context, state string) error {
+	_, err := stateCol.DeleteOne(ctx, bson.M{"state": state})
+	return err
+}
+
+// DeleteExpiredOAuthStates removes the states that expired before cutoff, used or not. States
+// stored without an expiry are removed once created before createdBefore.
+func DeleteExpiredOAuthStates(ctx context.Context, cutoff, createdBefore time.Time) (int64, error) {
+	res, err := stateCol.DeleteMany(ctx, bson.M{"$or": bson.A{
+		bson.M{"expires_at": bson.M{"$lt": cutoff}},
+		bson.M{"expires_at": bson.M{"$exists": false}, "created_at": bson.M{"$lt": createdBefore}},
+	}})
+	if err != nil {
+		return 0, err
 	}
-	return &s, nil
+	return res.DeletedCount, nil
 }
 
 func AddDriveAccountToUser(ctx context.Context, userID primitive.ObjectID, acct models.DriveAccount) error {
@@ -117,9 +334,49 @@ func ListUserDriveAccounts(ctx context.Context, userID primitive.ObjectID) ([]mo
 	if u.DriveAccounts == nil {
 		return []models.DriveAccount{}, nil
 	}
+	// Ranked accounts first, the rest in the order they were linked
+	slices.SortStableFunc(u.DriveAccounts, func(a, b models.DriveAccount) int {
+		return cmp.Compare(priorityRank(a.Priority), priorityRank(b.Priority))
+	})
 	return u.DriveAccounts, nil
 }
 
+// priorityRank orders unranked accounts, priority 0, after every ranked one
+func priorityRank(priority int) int {
+	if priority <= 0 {
+		return math.MaxInt
+	}
+	return priority
+}
+
+// SetDriveAccountPriorities ranks the user's drive accounts in the order of accountIDs, 1 first.
+// Accounts left out become unranked. Each account is updated in place, so tokens refreshed
+// meanwhile aren't overwritten.
+func SetDriveAccountPriorities(ctx context.Context, userID primitive.ObjectID, accountIDs []primitive.ObjectID) error {
+	accounts, err := ListUserDriveAccounts(ctx, userID)
+	if err != nil {
+		return err
+	}
+	rank := make(map[primitive.ObjectID]int, len(accountIDs))
+	for i, id := range accountIDs {
+		rank[id] = i + 1
+	}
+
+	set := bson.M{}
+	filters := make([]interface{}, 0, len(accounts))
+	for i, account := range accounts {
+		name := fmt.Sprintf("d%d", i)
+		set["drive_accounts.$["+name+"].priority"] = rank[account.ID]
+		filters = append(filters, bson.M{name + "._id": account.ID})
+	}
+	if len(filters) == 0 {
+		return nil
+	}
+	_, err = usersCol.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": set},
+		options.Update().SetArrayFilters(options.ArrayFilters{Filters: filters}))
+	return err
+}
+
 func GetDriveAccountByID(ctx context.Context, accountID primitive.ObjectID) (*models.DriveAccount, error) {
 	var u models.User
 	err := usersCol.FindOne(ctx, bson.M{"drive_accounts._id": accountID}).Decode(&u)
@@ -134,15 +391,67 @@ func GetDriveAccountByID(ctx context.Context, accountID primitive.ObjectID) (*mo
 	return nil, errors.New("account not found")
 }
 
+// RemoveDriveAccountFromUser unlinks a drive account, reporting whether the user had it
+func RemoveDriveAccountFromUser(ctx context.Context, userID, accountID primitive.ObjectID) (bool, error) {
+	res, err := usersCol.UpdateOne(ctx,
+		bson.M{"_id": userID},
+		bson.M{"$pull": bson.M{"drive_accounts": bson.M{"_id": accountID}}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+// UpdateDriveAccountToken replaces the encrypted OAuth token of a drive account
+func UpdateDriveAccountToken(ctx context.Context, accountID primitive.ObjectID, encryptedToken []byte) error {
+	res, err := usersCol.UpdateOne(ctx,
+		bson.M{"drive_accounts._id": accountID},
+		bson.M{"$set": bson.M{"drive_accounts.$.encrypted_token": encryptedToken}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errors.New("account not found")
+	}
+	return nil
+}
+
+// ReplaceDriveAccountToken swaps the account's encrypted token for another unless it has been
+// changed since it was read, e.g. by a token refresh. It reports whether it was replaced.
+func ReplaceDriveAccountToken(ctx context.Context, accountID primitive.ObjectID, oldToken, newToken []byte) (bool, error) {
+	res, err := usersCol.UpdateOne(ctx,
+		bson.M{"drive_accounts": bson.M{"$elemMatch": bson.M{"_id": accountID, "encrypted_token": oldToken}}},
+		bson.M{"$set": bson.M{"drive_accounts.$.encrypted_token": newToken}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
 // Upload Session Management
 var sessionsCol *mongo.Collection
 
 func initSessionsCollection(ctx context.Context) {
 	sessionsCol = db.Collection("upload_sessions")
-	// Create TTL index for session expiry
-	_, _ = sessionsCol.Indexes().CreateOne(ctx, mongo.IndexModel{
-		Keys:    bson.M{"expires_at": 1},
-		Options: options.Index().SetExpireAfterSeconds(0),
+	// Expired sessions are removed by the session sweeper, which first reclaims their drive
+	// chunks, so the TTL index older versions created has to go
+	_, _ = sessionsCol.Indexes().DropOne(ctx, "expires_at_1")
+	ensureIndexes(ctx, sessionsCol, []mongo.IndexModel{
+		{
+			Keys: bson.M{"expires_at": 1},
+		},
+		{
+			// Serves the active session limit
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "status", Value: 1}},
+		},
+		{
+			// Serves the upload retrier, only retrying sessions have it
+			Keys:    bson.M{"retry.next_retry_at": 1},
+			Options: options.Index().SetSparse(true),
+		},
 	})
 }
 
@@ -169,13 +478,78 @@ func GetUploadSession(ctx context.Context, sessionID primitive.ObjectID) (*model
 	return &session, nil
 }
 
+// GetUserUploadSessions returns the sessions among sessionIDs that belong to the user
+func GetUserUploadSessions(ctx context.Context, userID primitive.ObjectID, sessionIDs []primitive.ObjectID) ([]*models.UploadSession, error) {
+	if sessionsCol == nil {
+		return nil, errors.New("sessions collection not initialized")
+	}
+	cursor, err := sessionsCol.Find(ctx, bson.M{
+		"_id":     bson.M{"$in": sessionIDs},
+		"user_id": userID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var sessions []*models.UploadSession
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// ListUserUploadSessions returns every upload session of the user
+func ListUserUploadSessions(ctx context.Context, userID primitive.ObjectID) ([]*models.UploadSession, error) {
+	if sessionsCol == nil {
+		return nil, errors.New("sessions collection not initialized")
+	}
+	cursor, err := sessionsCol.Find(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var sessions []*models.UploadSession
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
 func UpdateSessionUploadProgress(ctx context.Context, sessionID primitive.ObjectID, uploadedSize int64) error {
 	if sessionsCol == nil {
 		return errors.New("sessions collection not initialized")
 	}
+	// $max keeps concurrent chunk writes from moving progress backwards
+	_, err := sessionsCol.UpdateOne(ctx,
+		bson.M{"_id": sessionID},
+		bson.M{"$max": bson.M{"uploaded_size": uploadedSize}},
+	)
+	return err
+}
+
+// MarkSessionChunksReceived adds the chunks to the session's received ones, recording when
+// the last of its totalChunks came in
+func MarkSessionChunksReceived(ctx context.Context, sessionID primitive.ObjectID, chunkIndexes []int, totalChunks int) error {
+	if sessionsCol == nil {
+		return errors.New("sessions collection not initialized")
+	}
+	if len(chunkIndexes) == 0 {
+		return nil
+	}
+	// $addToSet is atomic, so parallel chunk uploads can't drop each other's entries
 	_, err := sessionsCol.UpdateOne(ctx,
 		bson.M{"_id": sessionID},
-		bson.M{"$set": bson.M{"uploaded_size": uploadedSize}},
+		bson.M{"$addToSet": bson.M{"received_chunks": bson.M{"$each": chunkIndexes}}},
+	)
+	if err != nil {
+		return err
+	}
+	// Indexes are checked against the total, so holding as many means holding every chunk
+	_, err = sessionsCol.UpdateOne(ctx,
+		bson.M{"_id": sessionID, "received_chunks": bson.M{"$size": totalChunks}, "chunks_received_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"chunks_received_at": time.Now()}},
 	)
 	return err
 }
@@ -198,6 +572,147 @@ func UpdateSessionStatus(ctx context.Context, sessionID primitive.ObjectID, stat
 	return err
 }
 
+// SetSessionErrorCode records the code of the failure the session is about to fail with
+func SetSessionErrorCode(ctx context.Context, sessionID primitive.ObjectID, code string) error {
+	if sessionsCol == nil {
+		return errors.New("sessions collection not initialized")
+	}
+	_, err := sessionsCol.UpdateOne(ctx, bson.M{"_id": sessionID}, bson.M{"$set": bson.M{"error_code": code}})
+	return err
+}
+
+// ClaimUploadSession sets an uploading session that hasn't expired to processing, reporting
+// whether it was still uploading
+func ClaimUploadSession(ctx context.Context, sessionID primitive.ObjectID, message string) (bool, error) {
+	if sessionsCol == nil {
+		return false, errors.New("sessions collection not initialized")
+	}
+	res, err := sessionsCol.UpdateOne(ctx,
+		bson.M{"_id": sessionID, "status": "uploading", "expires_at": bson.M{"$gt": time.Now()}},
+		bson.M{"$set": bson.M{"status": "processing", "processing_progress": 0.0, "error_message": message}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// StartSessionAttempt records that processing the session with req started, the request kept
+// for retrying it
+func StartSessionAttempt(ctx context.Context, sessionID primitive.ObjectID, req models.ProcessRequest, startedAt time.Time) error {
+	if sessionsCol == nil {
+		return errors.New("sessions collection not initialized")
+	}
+	_, err := sessionsCol.UpdateOne(ctx,
+		bson.M{"_id": sessionID},
+		bson.M{
+			"$set":  bson.M{"retry.request": req},
+			"$push": bson.M{"retry.attempts": models.UploadAttempt{StartedAt: startedAt, Status: "processing"}},
+		},
+	)
+	return err
+}
+
+// FinishSessionAttempt records the outcome of the session's attempt at index, and when the
+// next one is due, nil when there is none. The session expires no sooner than expiresAt.
+func FinishSessionAttempt(ctx context.Context, sessionID primitive.ObjectID, index int, attempt models.UploadAttempt, nextRetryAt *time.Time, gaveUp bool, expiresAt time.Time) error {
+	if sessionsCol == nil {
+		return errors.New("sessions collection not initialized")
+	}
+	set := bson.M{
+		fmt.Sprintf("retry.attempts.%d", index): attempt,
+		"retry.gave_up":                         gaveUp,
+		"expires_at":                            expiresAt,
+	}
+	update := bson.M{"$set": set}
+	if nextRetryAt != nil {
+		set["retry.next_retry_at"] = nextRetryAt
+	} else {
+		update["$unset"] = bson.M{"retry.next_retry_at": ""}
+	}
+	_, err := sessionsCol.UpdateOne(ctx, bson.M{"_id": sessionID}, update)
+	return err
+}
+
+// ClaimSessionRetry sets the unexpired retrying session whose retry is due the longest to
+// processing, recording a new attempt. It returns nil when no retry is due.
+func ClaimSessionRetry(ctx context.Context, message string) (*models.UploadSession, error) {
+	if sessionsCol == nil {
+		return nil, errors.New("sessions collection not initialized")
+	}
+	now := time.Now()
+	filter := bson.M{
+		"status":              "retrying",
+		"retry.next_retry_at": bson.M{"$lte": now},
+		"expires_at":          bson.M{"$gt": now},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.M{"retry.next_retry_at": 1}).
+		SetReturnDocument(options.After)
+
+	var session models.UploadSession
+	err := sessionsCol.FindOneAndUpdate(ctx, filter,
+		bson.M{
+			"$set":   bson.M{"status": "processing", "processing_progress": 0.0, "error_message": message},
+			"$unset": bson.M{"retry.next_retry_at": "", "error_code": ""},
+			"$push":  bson.M{"retry.attempts": models.UploadAttempt{StartedAt: now, Status: "processing"}},
+		},
+		opts,
+	).Decode(&session)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+// MarkSessionsStale sets the uploading sessions that received every chunk before cutoff to
+// stale, expiring them so the session sweeper reclaims them. It returns how many were marked.
+func MarkSessionsStale(ctx context.Context, cutoff time.Time, message string) (int, error) {
+	if sessionsCol == nil {
+		return 0, errors.New("sessions collection not initialized")
+	}
+	res, err := sessionsCol.UpdateMany(ctx,
+		bson.M{"status": "uploading", "chunks_received_at": bson.M{"$lte": cutoff}},
+		bson.M{"$set": bson.M{"status": "stale", "error_message": message, "expires_at": time.Now()}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.ModifiedCount), nil
+}
+
+// ClaimOverdueSession sets the unexpired uploading session that received every chunk the
+// longest before cutoff to processing. It returns nil when there is none.
+func ClaimOverdueSession(ctx context.Context, cutoff time.Time, message string) (*models.UploadSession, error) {
+	if sessionsCol == nil {
+		return nil, errors.New("sessions collection not initialized")
+	}
+	filter := bson.M{
+		"status":             "uploading",
+		"chunks_received_at": bson.M{"$lte": cutoff},
+		"expires_at":         bson.M{"$gt": time.Now()},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.M{"chunks_received_at": 1}).
+		SetReturnDocument(options.After)
+
+	var session models.UploadSession
+	err := sessionsCol.FindOneAndUpdate(ctx, filter,
+		bson.M{"$set": bson.M{"status": "processing", "processing_progress": 0.0, "error_message": message}},
+		opts,
+	).Decode(&session)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
 func CompleteSession(ctx context.Context, sessionID primitive.ObjectID, completedAt *time.Time) error {
 	if sessionsCol == nil {
 		return errors.New("sessions collection not initialized")
@@ -223,13 +738,24 @@ func CountActiveUserSessions(ctx context.Context, userID primitive.ObjectID) (in
 	return int(count), err
 }
 
+// CountActiveSessions counts unexpired upload sessions of all users that are uploading or processing
+func CountActiveSessions(ctx context.Context) (int, error) {
+	if sessionsCol == nil {
+		return 0, errors.New("sessions collection not initialized")
+	}
+	count, err := sessionsCol.CountDocuments(ctx, bson.M{
+		"status":     bson.M{"$in": []string{"uploading", "processing"}},
+		"expires_at": bson.M{"$gt": time.Now()},
+	})
+	return int(count), err
+}
+
 func GetExpiredSessions(ctx context.Context) ([]*models.UploadSession, error) {
 	if sessionsCol == nil {
 		return nil, errors.New("sessions collection not initialized")
 	}
 	cursor, err := sessionsCol.Find(ctx, bson.M{
 		"expires_at": bson.M{"$lt": time.Now()},
-		"status":     bson.M{"$in": []string{"uploading", "processing"}},
 	})
 	if err != nil {
 		return nil, err
@@ -243,6 +769,31 @@ func GetExpiredSessions(ctx context.Context) ([]*models.UploadSession, error) {
 	return sessions, nil
 }
 
+// AddSessionDriveChunk records a chunk uploaded to a drive on behalf of the session
+func AddSessionDriveChunk(ctx context.Context, sessionID primitive.ObjectID, replica models.ChunkReplica) error {
+	if sessionsCol == nil {
+		return errors.New("sessions collection not initialized")
+	}
+	_, err := sessionsCol.UpdateOne(ctx,
+		bson.M{"_id": sessionID},
+		bson.M{"$push": bson.M{"drive_chunks": replica}},
+	)
+	return err
+}
+
+// RemoveSessionDriveChunks forgets the session's uploaded chunks stored in the drive files
+// named, once they were deleted from their drives
+func RemoveSessionDriveChunks(ctx context.Context, sessionID primitive.ObjectID, driveFileIDs []string) error {
+	if sessionsCol == nil {
+		return errors.New("sessions collection not initialized")
+	}
+	_, err := sessionsCol.UpdateOne(ctx,
+		bson.M{"_id": sessionID},
+		bson.M{"$pull": bson.M{"drive_chunks": bson.M{"drive_file_id": bson.M{"$in": driveFileIDs}}}},
+	)
+	return err
+}
+
 func DeleteUploadSession(ctx context.Context, sessionID primitive.ObjectID) error {
 	if sessionsCol == nil {
 		return errors.New("sessions collection not initialized")
@@ -251,6 +802,17 @@ func DeleteUploadSession(ctx context.Context, sessionID primitive.ObjectID) erro
 	return err
 }
 
+func UpdateSessionContentType(ctx context.Context, sessionID primitive.ObjectID, contentType string) error {
+	if sessionsCol == nil {
+		return errors.New("sessions collection not initialized")
+	}
+	_, err := sessionsCol.UpdateOne(ctx,
+		bson.M{"_id": sessionID},
+		bson.M{"$set": bson.M{"content_type": contentType}},
+	)
+	return err
+}
+
 func UpdateSessionKeyFile(ctx context.Context, sessionID primitive.ObjectID, keyFilePath string) error {
 	if sessionsCol == nil {
 		return errors.New("sessions collection not initialized")
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Thumbnail Management, keyed by the file they preview
+var thumbnailsCol *mongo.Collection
+
+func initThumbnailsCollection(ctx context.Context) {
+	thumbnailsCol = db.Collection("thumbnails")
+}
+
+// SaveThumbnail stores the file's thumbnail, replacing the one it had
+func SaveThumbnail(ctx context.Context, thumbnail *models.Thumbnail) error {
+	if thumbnailsCol == nil {
+		return errors.New("thumbnails collection not initialized")
+	}
+	_, err := thumbnailsCol.ReplaceOne(ctx, bson.M{"_id": thumbnail.FileID}, thumbnail, options.Replace().SetUpsert(true))
+	return err
+}
+
+// GetThumbnail returns the file's thumbnail, or nil
+func GetThumbnail(ctx context.Context, fileID primitive.ObjectID) (*models.Thumbnail, error) {
+	if thumbnailsCol == nil {
+		return nil, errors.New("thumbnails collection not initialized")
+	}
+	var thumbnail models.Thumbnail
+	err := thumbnailsCol.FindOne(ctx, bson.M{"_id": fileID}).Decode(&thumbnail)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &thumbnail, nil
+}
+
+func DeleteThumbnail(ctx context.Context, fileID primitive.ObjectID) error {
+	if thumbnailsCol == nil {
+		return errors.New("thumbnails collection not initialized")
+	}
+	_, err := thumbnailsCol.DeleteOne(ctx, bson.M{"_id": fileID})
+	return err
+}
+
+// SetStoredFileThumbnail records whether a thumbnail of the file is stored. The file's
+// updated_at is left alone, its content didn't change.
+func SetStoredFileThumbnail(ctx context.Context, fileID primitive.ObjectID, hasThumbnail bool) error {
+	if filesCol == nil {
+		return errors.New("files collection not initialized")
+	}
+	update := bson.M{"$set": bson.M{"has_thumbnail": true}}
+	if !hasThumbnail {
+		update = bson.M{"$unset": bson.M{"has_thumbnail": ""}}
+	}
+	_, err := filesCol.UpdateOne(ctx, bson.M{"_id": fileID}, update)
+	return err
+}
@@ -0,0 +1,186 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Refresh Token Management
+var (
+	refreshTokensCol  *mongo.Collection
+	revocationsCol    *mongo.Collection
+	passwordResetsCol *mongo.Collection
+)
+
+func initTokensCollections(ctx context.Context) {
+	refreshTokensCol = db.Collection("refresh_tokens")
+	revocationsCol = db.Collection("token_revocations")
+	passwordResetsCol = db.Collection("password_resets")
+
+	ensureIndexes(ctx, refreshTokensCol, []mongo.IndexModel{
+		{
+			Keys:    bson.M{"token_hash": 1},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.M{"expires_at": 1},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+
+	ensureIndexes(ctx, passwordResetsCol, []mongo.IndexModel{
+		{
+			Keys:    bson.M{"token_hash": 1},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.M{"expires_at": 1},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+}
+
+func InsertRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	if refreshTokensCol == nil {
+		return errors.New("refresh tokens collection not initialized")
+	}
+	if token.ID.IsZero() {
+		token.ID = primitive.NewObjectID()
+	}
+	token.CreatedAt = time.Now().UTC()
+	_, err := refreshTokensCol.InsertOne(ctx, token)
+	return err
+}
+
+func FindRefreshTokenByHash(ctx context.Context, tokenHash string) (*models.RefreshToken, error) {
+	if refreshTokensCol == nil {
+		return nil, errors.New("refresh tokens collection not initialized")
+	}
+	var token models.RefreshToken
+	err := refreshTokensCol.FindOne(ctx, bson.M{"token_hash": tokenHash}).Decode(&token)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &token, nil
+}
+
+// RotateRefreshToken revokes tokenID in favour of replacementID. It returns false if the
+// token was already revoked, which means it is being reused.
+func RotateRefreshToken(ctx context.Context, tokenID, replacementID primitive.ObjectID) (bool, error) {
+	if refreshTokensCol == nil {
+		return false, errors.New("refresh tokens collection not initialized")
+	}
+	res, err := refreshTokensCol.UpdateOne(ctx,
+		bson.M{"_id": tokenID, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{
+			"revoked_at":  time.Now().UTC(),
+			"replaced_by": replacementID,
+		}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+func RevokeUserRefreshTokens(ctx context.Context, userID primitive.ObjectID) error {
+	if refreshTokensCol == nil {
+		return errors.New("refresh tokens collection not initialized")
+	}
+	_, err := refreshTokensCol.UpdateMany(ctx,
+		bson.M{"user_id": userID, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now().UTC()}},
+	)
+	return err
+}
+
+func SetTokensRevokedBefore(ctx context.Context, userID primitive.ObjectID, revokedBefore time.Time) error {
+	if revocationsCol == nil {
+		return errors.New("token revocations collection not initialized")
+	}
+	_, err := revocationsCol.UpdateOne(ctx,
+		bson.M{"_id": userID},
+		bson.M{"$set": bson.M{"revoked_before": revokedBefore}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func GetTokenRevocation(ctx context.Context, userID primitive.ObjectID) (*models.TokenRevocation, error) {
+	if revocationsCol == nil {
+		return nil, errors.New("token revocations collection not initialized")
+	}
+	var revocation models.TokenRevocation
+	err := revocationsCol.FindOne(ctx, bson.M{"_id": userID}).Decode(&revocation)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &revocation, nil
+}
+
+func InsertPasswordResetToken(ctx context.Context, token *models.PasswordResetToken) error {
+	if passwordResetsCol == nil {
+		return errors.New("password resets collection not initialized")
+	}
+	if token.ID.IsZero() {
+		token.ID = primitive.NewObjectID()
+	}
+	token.CreatedAt = time.Now().UTC()
+	_, err := passwordResetsCol.InsertOne(ctx, token)
+	return err
+}
+
+func FindPasswordResetByHash(ctx context.Context, tokenHash string) (*models.PasswordResetToken, error) {
+	if passwordResetsCol == nil {
+		return nil, errors.New("password resets collection not initialized")
+	}
+	var token models.PasswordResetToken
+	err := passwordResetsCol.FindOne(ctx, bson.M{"token_hash": tokenHash}).Decode(&token)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &token, nil
+}
+
+// ConsumePasswordResetToken marks the token used. It returns false if it was already used.
+func ConsumePasswordResetToken(ctx context.Context, tokenID primitive.ObjectID) (bool, error) {
+	if passwordResetsCol == nil {
+		return false, errors.New("password resets collection not initialized")
+	}
+	res, err := passwordResetsCol.UpdateOne(ctx,
+		bson.M{"_id": tokenID, "used_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"used_at": time.Now().UTC()}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// ConsumeUserPasswordResets marks every outstanding reset token of the user used
+func ConsumeUserPasswordResets(ctx context.Context, userID primitive.ObjectID) error {
+	if passwordResetsCol == nil {
+		return errors.New("password resets collection not initialized")
+	}
+	_, err := passwordResetsCol.UpdateMany(ctx,
+		bson.M{"user_id": userID, "used_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"used_at": time.Now().UTC()}},
+	)
+	return err
+}
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SetTwoFactorSecret records a new TOTP secret, encrypted, waiting to be enabled. It reports
+// false when the user already has two-factor authentication enabled.
+func SetTwoFactorSecret(ctx context.Context, userID primitive.ObjectID, encryptedSecret []byte) (bool, error) {
+	res, err := usersCol.UpdateOne(ctx,
+		bson.M{"_id": userID, "two_factor.enabled": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"two_factor": bson.M{"secret": encryptedSecret, "enabled": false}}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// EnableTwoFactor enables the TOTP secret that was set up, encrypted as encryptedSecret, with the
+// hashes of its recovery codes. step is the time step of the code that proved the secret. It
+// reports false when the secret was replaced or enabled meanwhile.
+func EnableTwoFactor(ctx context.Context, userID primitive.ObjectID, encryptedSecret []byte, recoveryHashes []string, step int64) (bool, error) {
+	res, err := usersCol.UpdateOne(ctx,
+		bson.M{"_id": userID, "two_factor.secret": encryptedSecret, "two_factor.enabled": false},
+		bson.M{"$set": bson.M{
+			"two_factor.enabled":        true,
+			"two_factor.recovery_codes": recoveryHashes,
+			"two_factor.last_step":      step,
+			"two_factor.enabled_at":     time.Now().UTC(),
+		}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// DisableTwoFactor removes the user's second factor, enabled or only set up
+func DisableTwoFactor(ctx context.Context, userID primitive.ObjectID) error {
+	_, err := usersCol.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$unset": bson.M{"two_factor": ""}})
+	return err
+}
+
+// UseTwoFactorStep records step as the time step of the user's last accepted code. It reports
+// false when a code of that step or a later one was accepted already.
+func UseTwoFactorStep(ctx context.Context, userID primitive.ObjectID, step int64) (bool, error) {
+	res, err := usersCol.UpdateOne(ctx,
+		bson.M{"_id": userID, "two_factor.enabled": true, "two_factor.last_step": bson.M{"$not": bson.M{"$gte": step}}},
+		bson.M{"$set": bson.M{"two_factor.last_step": step}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// ConsumeRecoveryCode removes the hash of a recovery code from the user's unused codes,
+// reporting whether it was one of them
+func ConsumeRecoveryCode(ctx context.Context, userID primitive.ObjectID, hash string) (bool, error) {
+	res, err := usersCol.UpdateOne(ctx,
+		bson.M{"_id": userID, "two_factor.enabled": true, "two_factor.recovery_codes": hash},
+		bson.M{"$pull": bson.M{"two_factor.recovery_codes": hash}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// ReplaceTwoFactorSecret swaps the user's encrypted TOTP secret for another unless it has been
+// changed since it was read. It reports whether it was replaced.
+func ReplaceTwoFactorSecret(ctx context.Context, userID primitive.ObjectID, oldSecret, newSecret []byte) (bool, error) {
+	res, err := usersCol.UpdateOne(ctx,
+		bson.M{"_id": userID, "two_factor.secret": oldSecret},
+		bson.M{"$set": bson.M{"two_factor.secret": newSecret}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
@@ -0,0 +1,150 @@
+package store
+
+import (
+	"SE/internal/models"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How long the delivery log keeps a delivery
+const webhookDeliveryRetention = 30 * 24 * time.Hour
+
+// Webhook Delivery Management
+var webhookDeliveriesCol *mongo.Collection
+
+func initWebhookDeliveriesCollection(ctx context.Context) {
+	webhookDeliveriesCol = db.Collection("webhook_deliveries")
+
+	ensureIndexes(ctx, webhookDeliveriesCol, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "_id", Value: -1}},
+		},
+		{
+			Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}},
+		},
+		{
+			Keys:    bson.M{"created_at": 1},
+			Options: options.Index().SetExpireAfterSeconds(int32(webhookDeliveryRetention.Seconds())),
+		},
+	})
+}
+
+// SetUserWebhook sets the user's webhook URL and encrypted signing secret
+func SetUserWebhook(ctx context.Context, userID primitive.ObjectID, url string, encryptedSecret []byte) (bool, error) {
+	res, err := usersCol.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"webhook_url": url, "webhook_secret": encryptedSecret}})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// ClearUserWebhook removes the user's webhook. Pending deliveries fail on their next attempt.
+func ClearUserWebhook(ctx context.Context, userID primitive.ObjectID) error {
+	_, err := usersCol.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$unset": bson.M{"webhook_url": "", "webhook_secret": ""}})
+	return err
+}
+
+// ReplaceUserWebhookSecret swaps the user's encrypted webhook secret for another unless it has
+// been changed since it was read. It reports whether it was replaced.
+func ReplaceUserWebhookSecret(ctx context.Context, userID primitive.ObjectID, oldSecret, newSecret []byte) (bool, error) {
+	res, err := usersCol.UpdateOne(ctx,
+		bson.M{"_id": userID, "webhook_secret": oldSecret},
+		bson.M{"$set": bson.M{"webhook_secret": newSecret}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func InsertWebhookDelivery(ctx context.Context, delivery *models.WebhookDelivery) error {
+	if webhookDeliveriesCol == nil {
+		return errors.New("webhook deliveries collection not initialized")
+	}
+	if delivery.ID.IsZero() {
+		delivery.ID = primitive.NewObjectID()
+	}
+	delivery.CreatedAt = time.Now().UTC()
+	_, err := webhookDeliveriesCol.InsertOne(ctx, delivery)
+	return err
+}
+
+// ClaimWebhookDelivery takes a pending delivery that is due, the given one or with a zero
+// deliveryID the one due longest, and holds it for lease so no one else attempts it
+// meanwhile. It returns nil when nothing is due.
+func ClaimWebhookDelivery(ctx context.Context, deliveryID primitive.ObjectID, lease time.Duration) (*models.WebhookDelivery, error) {
+	if webhookDeliveriesCol == nil {
+		return nil, errors.New("webhook deliveries collection not initialized")
+	}
+	now := time.Now().UTC()
+	filter := bson.M{"status": "pending", "next_attempt_at": bson.M{"$lte": now}}
+	if !deliveryID.IsZero() {
+		filter["_id"] = deliveryID
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.M{"next_attempt_at": 1}).
+		SetReturnDocument(options.After)
+
+	var delivery models.WebhookDelivery
+	err := webhookDeliveriesCol.FindOneAndUpdate(ctx, filter,
+		bson.M{"$set": bson.M{"next_attempt_at": now.Add(lease)}},
+		opts,
+	).Decode(&delivery)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// SaveWebhookAttempt records the outcome of an attempt of the delivery
+func SaveWebhookAttempt(ctx context.Context, delivery *models.WebhookDelivery) error {
+	if webhookDeliveriesCol == nil {
+		return errors.New("webhook deliveries collection not initialized")
+	}
+	_, err := webhookDeliveriesCol.UpdateOne(ctx,
+		bson.M{"_id": delivery.ID},
+		bson.M{"$set": bson.M{
+			"url":             delivery.URL,
+			"status":          delivery.Status,
+			"attempts":        delivery.Attempts,
+			"response_status": delivery.ResponseStatus,
+			"last_error":      delivery.LastError,
+			"next_attempt_at": delivery.NextAttemptAt,
+			"delivered_at":    delivery.DeliveredAt,
+		}},
+	)
+	return err
+}
+
+// ListUserWebhookDeliveries returns up to limit of the user's deliveries, newest first. A
+// non-zero before pages on from the delivery with that ID.
+func ListUserWebhookDeliveries(ctx context.Context, userID, before primitive.ObjectID, limit int) ([]models.WebhookDelivery, error) {
+	if webhookDeliveriesCol == nil {
+		return nil, errors.New("webhook deliveries collection not initialized")
+	}
+	filter := bson.M{"user_id": userID}
+	if !before.IsZero() {
+		filter["_id"] = bson.M{"$lt": before}
+	}
+	opts := options.Find().SetSort(bson.M{"_id": -1}).SetLimit(int64(limit))
+	cursor, err := webhookDeliveriesCol.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	deliveries := []models.WebhookDelivery{}
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
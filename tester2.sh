@@ -196,10 +196,14 @@ while [ $OFFSET -lt $TEST_FILE_SIZE ]; do
     dd if=test_file.bin of=chunk.tmp bs=1 skip=$OFFSET count=$CHUNK_SIZE 2>/dev/null
 
     # Upload chunk
-    UPLOAD_RESPONSE=$(curl -s -X POST "$BASE_URL/api/files/upload/chunk?session_id=$SESSION_ID" \
+    CHUNK_END=$((OFFSET + CHUNK_SIZE))
+    if [ $CHUNK_END -gt $TEST_FILE_SIZE ]; then
+        CHUNK_END=$TEST_FILE_SIZE
+    fi
+    UPLOAD_RESPONSE=$(curl -s -X POST "$BASE_URL/api/files/upload/chunk?session_id=$SESSION_ID&chunk_index=$((CHUNK_NUM - 1))" \
         -H "Authorization: Bearer $TOKEN" \
-        -F "chunk=@chunk.tmp" \
-        -F "offset=$OFFSET")
+        -H "Content-Range: bytes $OFFSET-$((CHUNK_END - 1))/$TEST_FILE_SIZE" \
+        -F "chunk=@chunk.tmp")
 
     PROGRESS=$(echo "$UPLOAD_RESPONSE" | grep -o '"progress":[0-9.]*' | cut -d':' -f2)
 